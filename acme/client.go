@@ -0,0 +1,350 @@
+// Package acme obtains and renews TLS certificates from an ACME certificate
+// authority such as Let's Encrypt (RFC 8555), answering http-01 challenges on
+// the plain HTTP listener. It implements only what the server needs: one
+// account, one certificate covering every configured domain.
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often pending authorizations and orders are polled
+const pollInterval = 2 * time.Second
+
+// directory lists the CA's endpoints
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error"`
+}
+
+// problem is an ACME error document
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", strings.TrimPrefix(p.Type, "urn:ietf:params:acme:error:"), p.Detail)
+}
+
+// client signs requests to the CA with the account key
+type client struct {
+	http         *http.Client
+	directoryURL string
+	key          *ecdsa.PrivateKey
+
+	dir   *directory
+	kid   string
+	mu    sync.Mutex
+	nonce string
+}
+
+// discover fetches the CA's directory
+func (c *client) discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: directory returned %s", resp.Status)
+	}
+	c.dir = &directory{}
+	return json.NewDecoder(resp.Body).Decode(c.dir)
+}
+
+// register creates the account, or finds the existing one for the key
+func (c *client) register(ctx context.Context, email string) error {
+	payload := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		payload["contact"] = []string{"mailto:" + email}
+	}
+	resp, err := c.post(ctx, c.dir.NewAccount, payload, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = resp.Header.Get("Location")
+	if c.kid == "" {
+		return errors.New("acme: account has no URL")
+	}
+	return nil
+}
+
+// post sends a signed request and decodes the JSON response into out. A nil
+// payload makes it a POST-as-GET. A rejected nonce is retried once, as RFC
+// 8555 asks.
+func (c *client) post(ctx context.Context, url string, payload interface{}, out interface{}) (*http.Response, error) {
+	resp, body, err := c.postRaw(ctx, url, payload)
+	var p *problem
+	if errors.As(err, &p) && p.Type == "urn:ietf:params:acme:error:badNonce" {
+		resp, body, err = c.postRaw(ctx, url, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return nil, fmt.Errorf("acme: decoding response from %s: %w", url, err)
+		}
+	}
+	return resp, nil
+}
+
+func (c *client) postRaw(ctx context.Context, url string, payload interface{}) (*http.Response, []byte, error) {
+	nonce, err := c.takeNonce(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	c.saveNonce(resp)
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		p := &problem{}
+		if json.Unmarshal(data, p) != nil || p.Type == "" {
+			return nil, nil, fmt.Errorf("acme: %s returned %s", url, resp.Status)
+		}
+		return nil, nil, p
+	}
+	return resp, data, nil
+}
+
+func (c *client) takeNonce(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	nonce := c.nonce
+	c.nonce = ""
+	c.mu.Unlock()
+	if nonce != "" {
+		return nonce, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce = resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: no nonce from the CA")
+	}
+	return nonce, nil
+}
+
+func (c *client) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonce = nonce
+		c.mu.Unlock()
+	}
+}
+
+// sign wraps payload in a flattened JWS signed with ES256. Before the
+// account exists the key itself identifies the sender.
+func (c *client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	h64 := b64(header)
+	p64 := b64(body)
+	digest := sha256.Sum256([]byte(h64 + "." + p64))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return json.Marshal(map[string]string{"protected": h64, "payload": p64, "signature": b64(sig)})
+}
+
+// jwk returns the account's public key with its members in the order RFC
+// 7638 uses for thumbprints
+func (c *client) jwk() json.RawMessage {
+	pad := func(n *big.Int) string { return b64(n.FillBytes(make([]byte, 32))) }
+	return json.RawMessage(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":%q,"y":%q}`, pad(c.key.X), pad(c.key.Y)))
+}
+
+// keyAuthorization is the response to an http-01 challenge token
+func (c *client) keyAuthorization(token string) string {
+	thumbprint := sha256.Sum256(c.jwk())
+	return token + "." + b64(thumbprint[:])
+}
+
+// obtain orders a certificate for domains, publishing challenge responses
+// through respond while the CA validates them, and returns the PEM chain
+func (c *client) obtain(ctx context.Context, domains []string, csr []byte, respond func(token, keyAuth string), done func(token string)) ([]byte, error) {
+	identifiers := make([]map[string]string, len(domains))
+	for i, d := range domains {
+		identifiers[i] = map[string]string{"type": "dns", "value": d}
+	}
+	var o order
+	resp, err := c.post(ctx, c.dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, &o)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authzURL := range o.Authorizations {
+		if err := c.authorize(ctx, authzURL, respond, done); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := c.post(ctx, o.Finalize, map[string]string{"csr": b64(csr)}, &o); err != nil {
+		return nil, err
+	}
+	for o.Status != "valid" {
+		if o.Status == "invalid" {
+			if o.Error != nil {
+				return nil, o.Error
+			}
+			return nil, errors.New("acme: order is invalid")
+		}
+		if err := sleep(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+		if _, err := c.post(ctx, orderURL, nil, &o); err != nil {
+			return nil, err
+		}
+	}
+
+	_, chain, err := c.postRaw(ctx, o.Certificate, nil)
+	return chain, err
+}
+
+// authorize proves control of one domain with the http-01 challenge
+func (c *client) authorize(ctx context.Context, url string, respond func(token, keyAuth string), done func(token string)) error {
+	var authz authorization
+	if _, err := c.post(ctx, url, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var ch *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			ch = &authz.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return fmt.Errorf("acme: no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	respond(ch.Token, c.keyAuthorization(ch.Token))
+	defer done(ch.Token)
+	if _, err := c.post(ctx, ch.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	for {
+		if err := sleep(ctx, pollInterval); err != nil {
+			return err
+		}
+		if _, err := c.post(ctx, url, nil, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+			continue
+		}
+		for _, ch := range authz.Challenges {
+			if ch.Type == "http-01" && ch.Error != nil {
+				return fmt.Errorf("validating %s: %w", authz.Identifier.Value, ch.Error)
+			}
+		}
+		return fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,322 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A certificate is renewed when it has less than this left
+	renewBefore = 30 * 24 * time.Hour
+	// How often the certificate's expiry is checked
+	renewCheckInterval = 12 * time.Hour
+	// Time allowed for one attempt to obtain a certificate
+	obtainTimeout = 5 * time.Minute
+	// Wait after a failed attempt before a handshake may trigger another
+	retryAfter = time.Minute
+)
+
+// Files kept in the cache directory
+const (
+	accountKeyFile  = "acme_account.key"
+	certificateFile = "certificate.pem"
+)
+
+// Path prefix of http-01 challenge requests
+const challengePath = "/.well-known/acme-challenge/"
+
+// Manager keeps a certificate for the configured domains, obtaining it on
+// first use and renewing it before it expires
+type Manager struct {
+	Domains      []string
+	CacheDir     string
+	Email        string
+	DirectoryURL string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+
+	// obtainMu serializes requests to the CA and guards the fields below
+	obtainMu   sync.Mutex
+	lastFailed time.Time
+	client     *client
+
+	tokensMu sync.RWMutex
+	tokens   map[string]string
+}
+
+// Load reads a cached certificate, if there is one, so a restart doesn't
+// have to ask the CA again
+func (m *Manager) Load() error {
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(m.CacheDir, certificateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return fmt.Errorf("cached certificate: %w", err)
+	}
+	if !m.covers(cert.Leaf) {
+		log.Printf("ACME: cached certificate doesn't cover %v, a new one will be obtained", m.Domains)
+		return nil
+	}
+	m.cert = &cert
+	log.Printf("ACME: loaded certificate for %v, valid until %s", cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Start renews the certificate in the background until stop is closed
+func (m *Manager) Start(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(renewCheckInterval)
+		defer ticker.Stop()
+		for {
+			if m.needsRenewal() {
+				if _, err := m.obtain(); err != nil {
+					log.Printf("ACME: failed to renew certificate: %v", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// TLSConfig returns a TLS configuration serving the managed certificate
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// GetCertificate serves the certificate to handshakes for the configured
+// domains, obtaining it first if there is none yet
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name == "" {
+		// Clients connecting by IP address send no server name
+		name = m.Domains[0]
+	}
+	if !slices.Contains(m.Domains, name) {
+		return nil, fmt.Errorf("acme: host %q is not configured", hello.ServerName)
+	}
+
+	if cert := m.current(); cert != nil {
+		return cert, nil
+	}
+	return m.obtain()
+}
+
+// HTTPHandler answers http-01 challenges and redirects every other request
+// to HTTPS on httpsPort
+func (m *Manager) HTTPHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, challengePath); ok {
+			m.tokensMu.RLock()
+			keyAuth, found := m.tokens[token]
+			m.tokensMu.RUnlock()
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(keyAuth))
+			return
+		}
+
+		// Only redirect to our own names, whatever Host the request claims
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !slices.Contains(m.Domains, host) {
+			host = m.Domains[0]
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+func (m *Manager) current() *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert
+}
+
+func (m *Manager) needsRenewal() bool {
+	cert := m.current()
+	return cert == nil || time.Until(cert.Leaf.NotAfter) < renewBefore
+}
+
+func (m *Manager) covers(leaf *x509.Certificate) bool {
+	for _, d := range m.Domains {
+		if leaf.VerifyHostname(d) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// obtain gets a new certificate from the CA. Only one request runs at a
+// time; handshakes waiting on it share its result, while those with a
+// certificate to serve carry on meanwhile.
+func (m *Manager) obtain() (*tls.Certificate, error) {
+	m.obtainMu.Lock()
+	defer m.obtainMu.Unlock()
+	if !m.needsRenewal() {
+		return m.current(), nil
+	}
+	if time.Since(m.lastFailed) < retryAfter {
+		if cert := m.current(); cert != nil {
+			return cert, nil
+		}
+		return nil, errors.New("acme: no certificate yet, the last attempt failed")
+	}
+
+	cert, err := m.request()
+	if err != nil {
+		m.lastFailed = time.Now()
+		if current := m.current(); current != nil {
+			return current, err
+		}
+		return nil, err
+	}
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	log.Printf("ACME: obtained certificate for %v, valid until %s", cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return cert, nil
+}
+
+func (m *Manager) request() (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+
+	if m.client == nil {
+		key, err := m.accountKey()
+		if err != nil {
+			return nil, err
+		}
+		c := &client{http: &http.Client{Timeout: 30 * time.Second}, directoryURL: m.DirectoryURL, key: key}
+		if err := c.discover(ctx); err != nil {
+			return nil, err
+		}
+		if err := c.register(ctx, m.Email); err != nil {
+			return nil, err
+		}
+		m.client = c
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.Domains[0]},
+		DNSNames: m.Domains,
+	}, certKey)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("ACME: requesting certificate for %v from %s", m.Domains, m.DirectoryURL)
+	chain, err := m.client.obtain(ctx, m.Domains, csr, m.setToken, m.clearToken)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, err
+	}
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), chain...)
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, fmt.Errorf("acme: unusable certificate from the CA: %w", err)
+	}
+	if err := writeFile(filepath.Join(m.CacheDir, certificateFile), data); err != nil {
+		log.Printf("ACME: failed to cache certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+// accountKey loads the account key from the cache, creating it on first use
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.CacheDir, accountKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m *Manager) setToken(token, keyAuth string) {
+	m.tokensMu.Lock()
+	defer m.tokensMu.Unlock()
+	if m.tokens == nil {
+		m.tokens = make(map[string]string)
+	}
+	m.tokens[token] = keyAuth
+}
+
+func (m *Manager) clearToken(token string) {
+	m.tokensMu.Lock()
+	defer m.tokensMu.Unlock()
+	delete(m.tokens, token)
+}
+
+// writeFile replaces a private file atomically
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
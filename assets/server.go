@@ -0,0 +1,170 @@
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix is the path static files are served under
+const Prefix = "/static/"
+
+// immutableCacheControl lets browsers and proxies keep content-hashed files
+// for good, since a changed file gets a new URL
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// asset is a static file, read and compressed once at startup
+type asset struct {
+	hash        string
+	hashedName  string
+	contentType string
+	body        []byte
+	gzip        []byte // nil when compressing doesn't pay off
+	brotli      []byte // nil unless a precompressed .br file is embedded
+}
+
+var (
+	byName       = map[string]*asset{}
+	byHashedName = map[string]*asset{}
+)
+
+// Page templates are parsed rather than served, and .br files are the
+// precompressed variants of the file they are named after
+func init() {
+	err := fs.WalkDir(StaticFiles, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := strings.TrimPrefix(p, "static/")
+		ext := path.Ext(name)
+		if ext == ".html" || ext == ".br" {
+			return nil
+		}
+
+		body, err := StaticFiles.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		a := &asset{
+			hash:        hex.EncodeToString(sum[:])[:12],
+			contentType: mime.TypeByExtension(ext),
+			body:        body,
+		}
+		if a.contentType == "" {
+			a.contentType = http.DetectContentType(body)
+		}
+		a.hashedName = strings.TrimSuffix(name, ext) + "." + a.hash + ext
+		if Compressible(a.contentType) {
+			a.gzip = gzipped(body)
+		}
+		if br, err := StaticFiles.ReadFile(p + ".br"); err == nil {
+			a.brotli = br
+		}
+
+		byName[name] = a
+		byHashedName[a.hashedName] = a
+		return nil
+	})
+	if err != nil {
+		panic("assets: " + err.Error())
+	}
+}
+
+// Compressible reports whether files of a content type are text that shrinks
+// when compressed, rather than already compressed media
+func Compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/javascript" ||
+		mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// gzipped compresses body, returning nil when that doesn't make it smaller
+func gzipped(body []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(body)
+	zw.Close()
+	if buf.Len() >= len(body) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// URL returns the content-hashed URL of a file in static/, which can be cached
+// for good. Files that don't exist get their plain URL, and a 404.
+func URL(name string) string {
+	if a, ok := byName[name]; ok {
+		return Prefix + a.hashedName
+	}
+	return Prefix + name
+}
+
+// Handler serves the files in static/ other than page templates, compressed
+// when the client accepts it. Content-hashed URLs are cached for good; plain
+// file names still work but are revalidated on every use.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, Prefix)
+	a, immutable := byHashedName[name], true
+	if a == nil {
+		a, immutable = byName[name], false
+	}
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", a.contentType)
+	if immutable {
+		h.Set("Cache-Control", immutableCacheControl)
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+
+	body, encoding := a.body, ""
+	if a.gzip != nil || a.brotli != nil {
+		h.Add("Vary", "Accept-Encoding")
+		switch {
+		case a.brotli != nil && AcceptsEncoding(r, "br"):
+			body, encoding = a.brotli, "br"
+		case a.gzip != nil && AcceptsEncoding(r, "gzip"):
+			body, encoding = a.gzip, "gzip"
+		}
+	}
+
+	// Each encoding is its own representation, with its own ETag
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+		h.Set("ETag", strconv.Quote(a.hash+"-"+encoding))
+	} else {
+		h.Set("ETag", strconv.Quote(a.hash))
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// AcceptsEncoding reports whether the request's Accept-Encoding header allows
+// a content coding, i.e. lists it without q=0
+func AcceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		token, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(token), coding) {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
@@ -1,8 +1,17 @@
+// Package assets holds the files embedded in the binary: the page templates,
+// and the scripts and stylesheets pages load from /static/.
 package assets
 
 import (
 	"embed"
+	"html/template"
 )
 
 //go:embed static/*
 var StaticFiles embed.FS
+
+// Page parses a page template from static/. Templates link static files with
+// the asset function, as in <script src="{{asset "upload.js"}}"></script>.
+func Page(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(template.FuncMap{"asset": URL}).ParseFS(StaticFiles, "static/"+name))
+}
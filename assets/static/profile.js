@@ -0,0 +1,17 @@
+const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+const toggle = document.getElementById('toggle');
+toggle.addEventListener('click', async () => {
+    const makePrivate = toggle.dataset.private !== 'true';
+    const response = await fetch('/api/user/privacy', {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+        body: JSON.stringify({ private: makePrivate })
+    });
+    if (!response.ok) {
+        alert('Failed to save profile privacy');
+        return;
+    }
+    toggle.dataset.private = String(makePrivate);
+    toggle.textContent = makePrivate ? 'Make public' : 'Make private';
+    document.getElementById('visibility').textContent = makePrivate ? 'private' : 'public';
+});
@@ -0,0 +1,309 @@
+// Sent with every write so the server knows it came from this page
+const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+const uploadArea = document.getElementById('uploadArea');
+const fileInput = document.getElementById('fileInput');
+const uploadButton = document.getElementById('uploadButton');
+const selectedFile = document.getElementById('selectedFile');
+const fileName = document.getElementById('fileName');
+const message = document.getElementById('message');
+const filePreview = document.getElementById('filePreview');
+const progress = document.getElementById('progress');
+const progressBar = document.getElementById('progressBar');
+
+let selectedFileObj = null;
+
+// Click to select file
+uploadArea.addEventListener('click', () => {
+    fileInput.click();
+});
+
+// Drag and drop
+uploadArea.addEventListener('dragover', (e) => {
+    e.preventDefault();
+    uploadArea.classList.add('dragover');
+});
+
+uploadArea.addEventListener('dragleave', () => {
+    uploadArea.classList.remove('dragover');
+});
+
+uploadArea.addEventListener('drop', (e) => {
+    e.preventDefault();
+    uploadArea.classList.remove('dragover');
+
+    if (e.dataTransfer.files.length > 0) {
+        handleFile(e.dataTransfer.files[0]);
+    }
+});
+
+// File input change
+fileInput.addEventListener('change', (e) => {
+    if (e.target.files.length > 0) {
+        handleFile(e.target.files[0]);
+    }
+});
+
+function handleFile(file) {
+    selectedFileObj = file;
+    fileName.textContent = file.name;
+    selectedFile.style.display = 'block';
+    uploadButton.style.display = 'inline-block';
+    message.innerHTML = '';
+
+    // Show preview for images
+    if (file.type.startsWith('image/')) {
+        const reader = new FileReader();
+        reader.onload = (e) => {
+            filePreview.innerHTML = `<img src="${e.target.result}" alt="Preview">`;
+        };
+        reader.readAsDataURL(file);
+    } else {
+        filePreview.innerHTML = '';
+    }
+}
+
+// Upload button click
+uploadButton.addEventListener('click', async () => {
+    if (!selectedFileObj) {
+        showMessage('Please select a file first', 'error');
+        return;
+    }
+
+    const formData = new FormData();
+    formData.append('wallpaper', selectedFileObj);
+    formData.append('title', document.getElementById('titleInput').value);
+    formData.append('description', document.getElementById('descriptionInput').value);
+    formData.append('tags', document.getElementById('tagsInput').value);
+    formData.append('license', document.getElementById('licenseInput').value);
+
+    uploadButton.disabled = true;
+    progress.style.display = 'block';
+    progressBar.style.width = '0%';
+    progressBar.textContent = '0%';
+    message.innerHTML = '';
+
+    // The server reports what it has received, which is the real progress
+    // even when a proxy in between buffers the upload
+    const ticket = crypto.randomUUID();
+    const poll = setInterval(() => showUploadProgress(ticket), 500);
+
+    try {
+        const xhr = new XMLHttpRequest();
+
+        xhr.addEventListener('load', () => {
+            clearInterval(poll);
+            progress.style.display = 'none';
+            uploadButton.disabled = false;
+
+            const response = JSON.parse(xhr.responseText);
+
+            if (xhr.status === 200 && response.success) {
+                showMessage(`${response.message} (Total uploads: ${response.upload_count})`, 'success');
+                selectedFileObj = null;
+                fileInput.value = '';
+                selectedFile.style.display = 'none';
+                uploadButton.style.display = 'none';
+                filePreview.innerHTML = '';
+                document.getElementById('titleInput').value = '';
+                document.getElementById('descriptionInput').value = '';
+                document.getElementById('tagsInput').value = '';
+                document.getElementById('licenseInput').value = '';
+            } else if (xhr.status === 409 && response.duplicate) {
+                showDuplicate(response);
+            } else if (xhr.status === 429) {
+                const minutes = Math.ceil(response.cooldown_seconds / 60);
+                showMessage(`${response.message}`, 'info');
+            } else {
+                showMessage(response.message || 'Upload failed', 'error');
+            }
+        });
+
+        xhr.addEventListener('error', () => {
+            clearInterval(poll);
+            progress.style.display = 'none';
+            uploadButton.disabled = false;
+            showMessage('Network error occurred', 'error');
+        });
+
+        xhr.open('POST', `/api/upload?ticket=${ticket}`);
+        xhr.setRequestHeader('X-CSRF-Token', csrfToken);
+        xhr.send(formData);
+
+    } catch (error) {
+        clearInterval(poll);
+        progress.style.display = 'none';
+        uploadButton.disabled = false;
+        showMessage('Upload failed: ' + error.message, 'error');
+    }
+});
+
+async function showUploadProgress(ticket) {
+    try {
+        const response = await fetch(`/api/upload/progress/${ticket}`);
+        if (!response.ok) {
+            return;
+        }
+        const p = await response.json();
+        if (p.status !== 'receiving') {
+            progressBar.style.width = '100%';
+            progressBar.textContent = 'Processing…';
+        } else if (p.total_bytes > 0) {
+            const percent = Math.min(100, Math.round((p.received_bytes / p.total_bytes) * 100));
+            progressBar.style.width = percent + '%';
+            progressBar.textContent = percent + '%';
+        }
+    } catch (error) {
+        // The upload itself reports failures
+    }
+}
+
+function showMessage(text, type) {
+    message.innerHTML = `<div class="message ${type}">${text}</div>`;
+}
+
+// Show the wallpaper an upload was refused as a duplicate of. Titles and
+// names come from users, so they are set as text.
+function showDuplicate(response) {
+    const dup = response.duplicate;
+    const box = document.createElement('div');
+    box.className = 'message error';
+    box.append(response.message);
+    const img = document.createElement('img');
+    img.src = dup.thumbnail_url;
+    img.alt = dup.title || 'Existing wallpaper';
+    img.className = 'duplicate-thumb';
+    box.append(img, `${dup.title || 'Wallpaper #' + dup.id}, uploaded by ${dup.uploader_name || 'someone'}`);
+    message.replaceChildren(box);
+}
+
+// Fetch and display username
+async function loadUsername() {
+    try {
+        const response = await fetch('/api/user');
+        if (response.ok) {
+            const data = await response.json();
+            document.getElementById('username').textContent = `Logged in as ${data.username}`;
+            if (data.max_file_size_mb) {
+                document.getElementById('maxFileSize').textContent = `Maximum file size: ${data.max_file_size_mb}MB`;
+                document.getElementById('maxFileSizeHint').textContent = data.max_file_size_mb;
+            }
+            if (data.can_upload === false) {
+                uploadArea.style.display = 'none';
+                showMessage('Uploading is limited to members with an uploader role in the Discord server.', 'error');
+            }
+        } else {
+            document.getElementById('username').textContent = 'Logged in';
+        }
+    } catch (error) {
+        document.getElementById('username').textContent = 'Logged in';
+    }
+}
+
+// Fetch and display configuration
+async function loadConfig() {
+    try {
+        const response = await fetch('/api/config');
+        if (response.ok) {
+            const data = await response.json();
+
+            // Format rate limit text
+            const cooldownMinutes = data.upload_cooldown_minutes;
+            let rateLimitText;
+            if (cooldownMinutes === 60) {
+                rateLimitText = 'One upload per hour';
+            } else if (cooldownMinutes < 60) {
+                rateLimitText = `One upload per ${cooldownMinutes} minute${cooldownMinutes !== 1 ? 's' : ''}`;
+            } else {
+                const hours = Math.floor(cooldownMinutes / 60);
+                const mins = cooldownMinutes % 60;
+                if (mins === 0) {
+                    rateLimitText = `One upload per ${hours} hour${hours !== 1 ? 's' : ''}`;
+                } else {
+                    rateLimitText = `One upload per ${hours} hour${hours !== 1 ? 's' : ''} and ${mins} minute${mins !== 1 ? 's' : ''}`;
+                }
+            }
+            document.getElementById('uploadRateLimit').textContent = rateLimitText;
+            if (data.allowed_extensions) {
+                fileInput.accept = data.allowed_extensions.join(',');
+            }
+        } else {
+            document.getElementById('uploadRateLimit').textContent = 'One upload per hour';
+        }
+    } catch (error) {
+        document.getElementById('uploadRateLimit').textContent = 'One upload per hour';
+    }
+}
+
+// Warn before the user runs into an upload limit
+async function loadUploadStatus() {
+    try {
+        const response = await fetch('/api/upload/status');
+        if (response.ok) {
+            const data = await response.json();
+            if (!data.can_upload) {
+                showMessage(`Next upload available at ${new Date(data.next_upload_at).toLocaleString()}`, 'info');
+            } else if (data.warnings.length > 0) {
+                showMessage(data.warnings.join('<br>'), 'info');
+            }
+        }
+    } catch (error) {
+        // Advisory only
+    }
+}
+
+// API tokens are shown in full only once, right after creation
+async function loadTokens() {
+    const list = document.getElementById('tokenList');
+    try {
+        const response = await fetch('/api/tokens');
+        if (!response.ok) {
+            return;
+        }
+        const data = await response.json();
+        list.innerHTML = '';
+        for (const token of data.tokens) {
+            const item = document.createElement('li');
+            const label = document.createElement('span');
+            const used = token.last_used_at ? `last used ${new Date(token.last_used_at).toLocaleString()}` : 'never used';
+            label.textContent = `${token.name} (${token.prefix}…, ${used})`;
+            const revoke = document.createElement('button');
+            revoke.textContent = 'Revoke';
+            revoke.addEventListener('click', async () => {
+                if (!confirm(`Revoke "${token.name}"? Scripts using it will stop working.`)) {
+                    return;
+                }
+                await fetch(`/api/tokens/${token.id}`, { method: 'DELETE', headers: { 'X-CSRF-Token': csrfToken } });
+                loadTokens();
+            });
+            item.append(label, revoke);
+            list.appendChild(item);
+        }
+    } catch (error) {
+        // Token management is optional
+    }
+}
+
+document.getElementById('createToken').addEventListener('click', async () => {
+    const nameInput = document.getElementById('tokenName');
+    const newToken = document.getElementById('newToken');
+    const response = await fetch('/api/tokens', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken },
+        body: JSON.stringify({ name: nameInput.value })
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        showMessage(data.message, 'error');
+        return;
+    }
+    newToken.textContent = `Copy this token now, it won't be shown again: ${data.token}`;
+    newToken.style.display = 'block';
+    nameInput.value = '';
+    loadTokens();
+});
+
+// Load config, then the username and the user's own limits, and the
+// upload status on page load
+loadConfig().then(loadUsername);
+loadUploadStatus();
+loadTokens();
@@ -0,0 +1,308 @@
+package backup
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// Entries of a backup archive: the database, the upload directory's files
+// under uploads/ and a description of the backup
+const (
+	databaseEntry = "database.db"
+	uploadsPrefix = "uploads/"
+	infoEntry     = "backup.json"
+)
+
+// ErrDatabaseExists is returned by Restore when there is a database it would
+// overwrite and it was not told to
+var ErrDatabaseExists = errors.New("database already exists")
+
+// Info describes a backup
+type Info struct {
+	CreatedAt time.Time `json:"created_at"`
+	Files     int       `json:"files"`
+}
+
+// Subdirectories of the upload directory left out of backups: thumbnails
+// and resized copies are generated again when needed, and partial uploads
+// can't be resumed after a restore anyway
+var skippedDirectories = []string{storage.ThumbnailDirectory, storage.VariantDirectory, storage.PartialDirectory}
+
+// Write writes a backup of the database and the upload directory to w as a
+// zip archive. The database is copied first, so files stored while the
+// backup runs are in it as orphans but files purged meanwhile are missing.
+func Write(w io.Writer) (*Info, error) {
+	tmp, err := os.MkdirTemp("", "wallpaper-gacha-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	snapshot := filepath.Join(tmp, databaseEntry)
+	if err := models.SnapshotDatabase(context.Background(), snapshot); err != nil {
+		return nil, fmt.Errorf("copying database: %w", err)
+	}
+
+	info := &Info{CreatedAt: time.Now().UTC()}
+	zw := zip.NewWriter(w)
+	if err := addFile(zw, snapshot, databaseEntry, zip.Deflate); err != nil {
+		return nil, fmt.Errorf("adding database: %w", err)
+	}
+
+	dir := config.AppConfig.UploadDirectory
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if slices.Contains(skippedDirectories, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		// Images are already compressed
+		if err := addFile(zw, p, uploadsPrefix+filepath.ToSlash(rel), zip.Store); err != nil {
+			return fmt.Errorf("adding %s: %w", rel, err)
+		}
+		info.Files++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := zw.Create(infoEntry)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, zw.Close()
+}
+
+// addFile copies a file into the archive
+func addFile(zw *zip.Writer, name, entry string, method uint16) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: entry, Method: method, Modified: stat.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// Create writes a backup to a new file in dir, named after the time it was
+// made, and returns its path
+func Create(dir string) (string, *Info, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", nil, err
+	}
+	name := filepath.Join(dir, "wallpaper-gacha-"+time.Now().UTC().Format("20060102-150405")+".zip")
+	info, err := WriteFile(name)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, info, nil
+}
+
+// WriteFile writes a backup to the named file. The file only appears once the
+// backup is complete.
+func WriteFile(name string) (*Info, error) {
+	tmp := name + ".part"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return info, nil
+}
+
+// Prune deletes all but the newest keep backups made by Create in dir
+func Prune(dir string, keep int) error {
+	if keep < 0 {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "wallpaper-gacha-*.zip"))
+	if err != nil {
+		return err
+	}
+	// Names sort by the time in them
+	slices.Sort(names)
+	for len(names) > keep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		log.Printf("Backup: deleted old backup %s", names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+// Run makes a backup in the configured directory, uploads it to S3 if a
+// bucket is configured and deletes the oldest backups past the number kept
+func Run() (string, error) {
+	cfg := config.AppConfig.Backup
+	name, info, err := Create(cfg.Directory)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Backup: wrote %s with the database and %d files", name, info.Files)
+
+	if cfg.S3.Bucket != "" {
+		key, err := Upload(cfg.S3, name)
+		if err != nil {
+			return name, fmt.Errorf("uploading to S3: %w", err)
+		}
+		log.Printf("Backup: uploaded %s to s3://%s/%s", filepath.Base(name), cfg.S3.Bucket, key)
+	}
+	return name, Prune(cfg.Directory, cfg.Keep)
+}
+
+// Restore loads a backup made by Write into the configured database path and
+// upload directory. The server must not be running. Upload files already in
+// place with the same size are left alone. An existing database is only
+// replaced when overwrite is set; it is replaced last, so a failed restore
+// leaves it as it was.
+func Restore(name string, overwrite bool) (*Info, error) {
+	if config.AppConfig.DatabaseDriver != "sqlite" {
+		return nil, fmt.Errorf("backups can only be restored into a sqlite database")
+	}
+	dbPath := config.AppConfig.DatabasePath
+	if _, err := os.Stat(dbPath); err == nil && !overwrite {
+		return nil, ErrDatabaseExists
+	}
+
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var info Info
+	var database *zip.File
+	for _, f := range zr.File {
+		switch f.Name {
+		case infoEntry:
+			if err := readInfo(f, &info); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", infoEntry, err)
+			}
+		case databaseEntry:
+			database = f
+		}
+	}
+	if database == nil || info.CreatedAt.IsZero() {
+		return nil, fmt.Errorf("%s is not a backup", name)
+	}
+
+	dir := config.AppConfig.UploadDirectory
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, uploadsPrefix) || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		rel := path.Clean(strings.TrimPrefix(f.Name, uploadsPrefix))
+		if !fs.ValidPath(rel) || rel == "." {
+			return nil, fmt.Errorf("%s has an invalid path: %s", name, f.Name)
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(rel))
+		if stat, err := os.Stat(dest); err == nil && stat.Size() == int64(f.UncompressedSize64) {
+			continue
+		}
+		if err := extract(f, dest, 0644); err != nil {
+			return nil, fmt.Errorf("restoring %s: %w", rel, err)
+		}
+	}
+
+	if err := extract(database, dbPath, 0600); err != nil {
+		return nil, fmt.Errorf("restoring database: %w", err)
+	}
+	// The journal of the replaced database must not be applied to this one
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return &info, nil
+}
+
+// readInfo decodes the description of a backup
+func readInfo(f *zip.File, info *Info) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(info)
+}
+
+// extract writes an archive entry to dest, replacing it in one step
+func extract(f *zip.File, dest string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp := dest + ".restoring"
+	w, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
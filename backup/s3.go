@@ -0,0 +1,154 @@
+package backup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// Upload copies a file to the bucket under its base name, after the
+// configured prefix, and returns the object's key. The file is sent in a
+// single request, so it can be at most 5GB.
+func Upload(bucket config.S3, name string) (string, error) {
+	key := strings.TrimPrefix(bucket.Prefix+filepath.Base(name), "/")
+	return key, PutFile(bucket, key, name, "application/zip")
+}
+
+// PutFile copies a file to the bucket as the object with the given key,
+// which already includes the prefix
+func PutFile(bucket config.S3, key, name, contentType string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The signature covers the hash of the content
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, objectURL(bucket, key), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	signS3(req, bucket, hex.EncodeToString(hash.Sum(nil)), time.Now())
+	return doS3(req, http.StatusOK)
+}
+
+// DeleteObject deletes the object with the given key from the bucket.
+// Deleting an object that doesn't exist succeeds.
+func DeleteObject(bucket config.S3, key string) error {
+	req, err := http.NewRequest(http.MethodDelete, objectURL(bucket, key), nil)
+	if err != nil {
+		return err
+	}
+	emptyHash := sha256.Sum256(nil)
+	signS3(req, bucket, hex.EncodeToString(emptyHash[:]), time.Now())
+	return doS3(req, http.StatusNoContent, http.StatusOK)
+}
+
+// objectURL returns the path-style URL of an object
+func objectURL(bucket config.S3, key string) string {
+	return bucket.Endpoint + escapePath("/"+bucket.Bucket+"/"+key)
+}
+
+// doS3 sends a signed request, failing unless it answers with one of the
+// expected statuses
+func doS3(req *http.Request, expected ...int) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !slices.Contains(expected, resp.StatusCode) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// escapePath percent-encodes everything in an object path but unreserved
+// characters and slashes, as AWS Signature Version 4 expects
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signS3 adds AWS Signature Version 4 headers to a request without a query
+// string, for content with the given SHA-256
+func signS3(req *http.Request, bucket config.S3, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Requests without a body have no content type to sign
+	signed := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Content-Type") == "" {
+		signed = signed[1:]
+	}
+	headers := map[string]string{
+		"content-type":         req.Header.Get("Content-Type"),
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(headers[h]) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + bucket.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + bucket.SecretAccessKey)
+	for _, part := range []string{day, bucket.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		bucket.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,269 @@
+// Package bot answers Discord slash commands delivered to the interactions
+// endpoint. Pulls made here go through the gacha package, so they count
+// against the same daily allowance as pulls on the website.
+package bot
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/i18n"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+const (
+	maxInteractionSize = 64 << 10
+	// Discord rejects attachments over 8MB for bots without boosts
+	maxAttachmentSize = 8 << 20
+)
+
+var commands = []discord.Command{
+	discord.NewCommand("pull", "Pull a random wallpaper"),
+	discord.NewCommand("collection", "Show how many wallpapers you have collected"),
+}
+
+// attachable lists the formats Discord renders inline in embeds
+var attachable = []string{".png", ".jpg", ".jpeg", ".webp", ".gif"}
+
+// RegisterCommands installs the bot's slash commands for the application
+func RegisterCommands(ctx context.Context) error {
+	return discord.RegisterCommands(ctx, commands)
+}
+
+// InteractionsHandler receives slash command interactions from Discord
+func InteractionsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxInteractionSize))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	if !verify(r.Header.Get("X-Signature-Ed25519"), r.Header.Get("X-Signature-Timestamp"), body) {
+		http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var in discord.Interaction
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, "Invalid interaction", http.StatusBadRequest)
+		return
+	}
+
+	switch in.Type {
+	case discord.InteractionPing:
+		respond(w, discord.ResponsePong, nil)
+	case discord.InteractionApplicationCommand:
+		handleCommand(w, r, &in)
+	default:
+		http.Error(w, "Unsupported interaction type", http.StatusBadRequest)
+	}
+}
+
+// verify checks Discord's signature over the timestamp and body
+func verify(signature, timestamp string, body []byte) bool {
+	key, err := hex.DecodeString(config.AppConfig.DiscordPublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize || timestamp == "" {
+		return false
+	}
+	return ed25519.Verify(key, append([]byte(timestamp), body...), sig)
+}
+
+func respond(w http.ResponseWriter, responseType int, msg *discord.Message) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Type int              `json:"type"`
+		Data *discord.Message `json:"data,omitempty"`
+	}{responseType, msg})
+}
+
+// reply answers privately so failures don't clutter the channel
+func reply(w http.ResponseWriter, content string) {
+	respond(w, discord.ResponseChannelMessage, &discord.Message{Content: content, Flags: discord.MessageFlagEphemeral})
+}
+
+func handleCommand(w http.ResponseWriter, r *http.Request, in *discord.Interaction) {
+	// Replies are in the language the user has Discord in
+	locale := i18n.Negotiate(in.Locale, config.AppConfig.DefaultLocale)
+	invoker := in.Invoker()
+	if invoker == nil || in.GuildID == "" || !config.AppConfig.IsAllowedGuild(in.GuildID) {
+		reply(w, i18n.Translate(locale, "This command can only be used in an allowed server."))
+		return
+	}
+
+	if enabled, message := config.AppConfig.InMaintenance(); enabled && !config.AppConfig.IsAdmin(invoker.ID) {
+		reply(w, message)
+		return
+	}
+
+	ban, err := models.GetActiveBan(r.Context(), invoker.ID)
+	if err == nil {
+		reply(w, i18n.Translate(locale, middleware.BanMessage(ban)))
+		return
+	} else if err != sql.ErrNoRows {
+		log.Printf("Failed to check ban status for user %s (ID: %s): %v", invoker.Username, invoker.ID, err)
+		reply(w, i18n.Translate(locale, "Something went wrong, please try again later."))
+		return
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), invoker.ID, invoker.Username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		reply(w, i18n.Translate(locale, "Something went wrong, please try again later."))
+		return
+	}
+
+	switch in.Data.Name {
+	case "pull":
+		// Attaching the image can outlast Discord's three second deadline,
+		// so acknowledge now and fill in the message afterwards
+		respond(w, discord.ResponseDeferredChannelMessage, nil)
+		go pull(context.WithoutCancel(r.Context()), in.Token, user, in.GuildID, locale)
+	case "collection":
+		reply(w, collectionSummary(r.Context(), user, locale))
+	default:
+		reply(w, i18n.Translate(locale, "Unknown command."))
+	}
+}
+
+func pull(ctx context.Context, token string, user *models.User, guildID, locale string) {
+	msg, f, name := pullMessage(ctx, user, guildID, locale)
+	var file *discord.File
+	if f != nil {
+		defer f.Close()
+		file = &discord.File{Name: name, Data: f}
+	}
+	if err := discord.EditInteractionResponse(ctx, token, msg, file); err != nil {
+		log.Printf("Failed to send pull result to user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+	}
+}
+
+// pullMessage makes a pull from the guild's pool and describes the result,
+// along with the image file to attach, if any
+func pullMessage(ctx context.Context, user *models.User, guildID, locale string) (discord.Message, *os.File, string) {
+	result, err := gacha.Pull(ctx, user, guildID, models.PullSourceDiscord, nil, false, "")
+	switch err {
+	case nil:
+	case gacha.ErrNoPullsLeft:
+		return discord.Message{Content: i18n.Sprintf(locale, "You have used all of today's pulls. More <t:%d:R>.", nextReset(ctx, user).Unix())}, nil, ""
+	case gacha.ErrEmptyPool:
+		return discord.Message{Content: i18n.Translate(locale, "There are no wallpapers to pull yet.")}, nil, ""
+	default:
+		log.Printf("Pull failed for user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		return discord.Message{Content: i18n.Translate(locale, "Something went wrong, please try again later.")}, nil, ""
+	}
+	log.Printf("User %s (ID: %s) pulled upload %d via Discord (duplicate: %t)", user.Username, user.DiscordID, result.Upload.ID, result.Pull.Duplicate)
+
+	upload := result.Upload
+	embed := discord.Embed{Title: upload.Title, Description: upload.Description}
+	if embed.Title == "" {
+		embed.Title = upload.OriginalFilename
+	}
+	footer := []string{i18n.Sprintf(locale, "Uploaded by %s", upload.UploaderName)}
+	if result.Pull.Wishlisted {
+		footer = append(footer, i18n.Translate(locale, "From your wishlist"))
+	}
+	if result.Pull.Dust > 0 {
+		footer = append(footer, i18n.Sprintf(locale, "Duplicate, converted to %d dust", result.Pull.Dust))
+	} else if result.Pull.Duplicate {
+		footer = append(footer, i18n.Translate(locale, "Duplicate"))
+	}
+	if a := result.Allowance; a.Limit >= 0 {
+		footer = append(footer, i18n.Sprintf(locale, "%d/%d pulls left today", a.Remaining, a.Limit))
+	}
+	if a := result.Allowance; a.Bonus > 0 {
+		footer = append(footer, i18n.Sprintf(locale, "%d bonus", a.Bonus))
+	}
+	embed.Footer = &discord.EmbedText{Text: strings.Join(footer, " · ")}
+
+	f, name := attachment(upload)
+	if f != nil {
+		embed.Image = &discord.EmbedImage{URL: "attachment://" + name}
+	}
+	var content []string
+	for _, a := range result.Unlocked {
+		format := "Achievement unlocked: **%s** (+%d rerolls)"
+		if a.Rerolls == 1 {
+			format = "Achievement unlocked: **%s** (+%d reroll)"
+		}
+		content = append(content, i18n.Sprintf(locale, format, a.Name, a.Rerolls))
+	}
+	return discord.Message{Content: strings.Join(content, "\n"), Embeds: []discord.Embed{embed}}, f, name
+}
+
+// attachment opens the wallpaper for attaching to the message, falling back
+// to its thumbnail when the original is too large or not shown inline. It
+// returns nil when neither is available.
+func attachment(upload *models.Upload) (*os.File, string) {
+	ext := strings.ToLower(filepath.Ext(upload.Filename))
+	candidates := []struct{ path, name string }{
+		{storage.ThumbnailPath(upload.Filename), fmt.Sprintf("wallpaper-%d.jpg", upload.ID)},
+	}
+	if slices.Contains(attachable, ext) && upload.FileSize <= maxAttachmentSize {
+		candidates = append([]struct{ path, name string }{
+			{storage.Path(upload.Filename), fmt.Sprintf("wallpaper-%d%s", upload.ID, ext)},
+		}, candidates...)
+	}
+
+	for _, c := range candidates {
+		f, err := os.Open(c.path)
+		if err != nil {
+			continue
+		}
+		return f, c.name
+	}
+	return nil, ""
+}
+
+func nextReset(ctx context.Context, user *models.User) time.Time {
+	allowance, err := gacha.PullAllowance(ctx, user)
+	if err != nil {
+		return time.Now()
+	}
+	return allowance.ResetsAt
+}
+
+func collectionSummary(ctx context.Context, user *models.User, locale string) string {
+	_, total, err := models.ListCollection(ctx, user.DiscordID, 1, 0)
+	if err != nil {
+		log.Printf("Failed to list collection for user %s: %v", user.DiscordID, err)
+		return i18n.Translate(locale, "Something went wrong, please try again later.")
+	}
+	allowance, err := gacha.PullAllowance(ctx, user)
+	if err != nil {
+		log.Printf("Failed to get pull allowance for user %s: %v", user.DiscordID, err)
+		return i18n.Translate(locale, "Something went wrong, please try again later.")
+	}
+
+	// Whole sentences are translated, so each form is spelled out
+	if allowance.Limit < 0 {
+		if total == 1 {
+			return i18n.Translate(locale, "You have collected 1 wallpaper.")
+		}
+		return i18n.Sprintf(locale, "You have collected %d wallpapers.", total)
+	}
+	if total == 1 {
+		return i18n.Sprintf(locale, "You have collected 1 wallpaper and have %d of %d pulls left today.", allowance.Remaining, allowance.Limit)
+	}
+	return i18n.Sprintf(locale, "You have collected %d wallpapers and have %d of %d pulls left today.", total, allowance.Remaining, allowance.Limit)
+}
@@ -0,0 +1,107 @@
+// Package cache keeps recently used values in memory so hot lookups don't
+// each go to the database. Entries expire after a fixed time, so a value
+// changed behind the cache's back, for example by a command run in another
+// process, is never served for longer than that.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+)
+
+var lookups = metrics.NewCounterVec("cache_lookups_total",
+	"Lookups in the in-memory caches, by cache and whether the value was cached", "cache", "result")
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// LRU is a fixed-size cache that is safe for concurrent use. Once full it
+// evicts the least recently used entry to make room.
+type LRU[K comparable, V any] struct {
+	name     string
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+// New returns an empty cache of at most capacity entries, each kept for ttl.
+// The name labels its metrics.
+func New[K comparable, V any](name string, capacity int, ttl time.Duration) *LRU[K, V] {
+	return &LRU[K, V]{
+		name:     name,
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value cached for key, if there is one that hasn't expired
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry[K, V])
+		if time.Now().Before(e.expiresAt) {
+			c.order.MoveToFront(el)
+			lookups.Inc(c.name, "hit")
+			return e.value, true
+		}
+		c.remove(el)
+	}
+	lookups.Inc(c.name, "miss")
+	var zero V
+	return zero, false
+}
+
+// Set caches value for key, replacing any value already cached
+func (c *LRU[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value, e.expiresAt = value, expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// Remove drops the value cached for key
+func (c *LRU[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge drops every cached value
+func (c *LRU[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.entries)
+}
+
+func (c *LRU[K, V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*entry[K, V]).key)
+}
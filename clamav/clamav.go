@@ -0,0 +1,105 @@
+// Package clamav scans files with a ClamAV daemon (clamd) over its INSTREAM
+// protocol, so uploads can be checked for malware before they are stored.
+package clamav
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// Size of the chunks files are streamed to clamd in
+const chunkSize = 64 << 10
+
+// Enabled reports whether uploads are scanned
+func Enabled() bool {
+	return config.AppConfig.ClamAV.Address != ""
+}
+
+// dial connects to clamd. Addresses containing a slash are unix sockets;
+// anything else is a TCP host:port.
+func dial(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	if strings.Contains(address, "/") {
+		return d.DialContext(ctx, "unix", address)
+	}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// Scan streams r to clamd and returns the name of the signature it matched,
+// or "" if the file is clean. An error means the file could not be scanned,
+// for example because clamd is unreachable or the file is over its
+// StreamMaxLength.
+func Scan(ctx context.Context, r io.Reader) (string, error) {
+	cfg := config.AppConfig.ClamAV
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	conn, err := dial(ctx, cfg.Address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				// clamd hangs up once a stream passes its size limit; its
+				// reply says why
+				return readReply(conn, werr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return readReply(conn, err)
+	}
+	return readReply(conn, nil)
+}
+
+// readReply parses clamd's answer to a stream: "stream: OK", "stream: <name>
+// FOUND" or "<message> ERROR". writeErr is returned if there is no answer.
+func readReply(conn net.Conn, writeErr error) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(conn, 4096))
+	reply := strings.TrimSpace(string(bytes.TrimRight(data, "\x00")))
+	if reply == "" {
+		if writeErr != nil {
+			return "", writeErr
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errors.New("clamd closed the connection without replying")
+	}
+
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
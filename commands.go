@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/backup"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/handlers"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/oauth"
+)
+
+// command is a subcommand of the binary
+type command struct {
+	args    string
+	summary string
+	run     func(args []string)
+}
+
+// commands lists the subcommands by name. Running the binary without one
+// starts the server.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":   {"[-test-mode] [config.json]", "run the web server (the default)", serve},
+		"migrate": {"[-config config.json]", "create or update the database schema and exit", migrate},
+		"admin":   {"[-config config.json] grant|revoke <discord_id> | list", "manage administrators", admin},
+		"backup":  {"[-config config.json] [-o file.zip]", "back up the database and uploads", backupCommand},
+		"restore": {"[-config config.json] [-force] <file.zip>", "restore a backup; the server must be stopped", restoreCommand},
+		"import":  {"[-config config.json] [-user <discord_id>] [-tags a,b] [-manifest file.csv] [-rarity common] [-guild <guild_id>] <dir>", "add every image in a folder as uploads", importFolder},
+		"uploads": {"[-config config.json] [-dry-run] reassign <upload_id> <discord_id> | merge <upload_id> <into_id>", "transfer an upload to another user or merge duplicated uploads", uploadsCommand},
+		"help":    {"", "show this list", help},
+	}
+}
+
+// help prints the available commands
+func help(args []string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, name := range []string{"serve", "migrate", "admin", "backup", "restore", "import", "uploads", "help"} {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
+	}
+}
+
+// commandUsage returns a flag set's usage function, printing the command's
+// arguments before the flags
+func commandUsage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", filepath.Base(os.Args[0]), flags.Name(), commands[flags.Name()].args)
+		flags.PrintDefaults()
+	}
+}
+
+// openDatabase loads the configuration and opens the database, creating or
+// updating its schema, for commands that work on the data without serving
+func openDatabase(configFile string) {
+	if err := config.Load(configFile); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := initDatabase(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	if err := models.AssignDefaultGuild(context.Background(), config.AppConfig.DefaultGuildID); err != nil {
+		log.Fatalf("Failed to assign wallpapers to the default guild: %v", err)
+	}
+}
+
+// initDatabase opens the configured database with its connection pool
+// settings
+func initDatabase() error {
+	cfg := config.AppConfig
+	return models.InitDatabase(context.Background(), cfg.DatabaseDriver, cfg.DatabaseDSN(), models.PoolOptions{
+		MaxOpenConns:    cfg.DatabasePool.MaxOpenConns,
+		MaxIdleConns:    cfg.DatabasePool.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(cfg.DatabasePool.ConnMaxLifetimeMinutes) * time.Minute,
+		BusyTimeout:     time.Duration(cfg.DatabasePool.BusyTimeoutMS) * time.Millisecond,
+		QueryTimeout:    time.Duration(max(cfg.DatabasePool.QueryTimeoutSeconds, 0)) * time.Second,
+	})
+}
+
+// migrate brings the database schema up to date. The server does the same
+// at startup; this lets it be done ahead of a deploy.
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = commandUsage(flags)
+	configFile := flags.String("config", "config.json", "configuration file")
+	flags.Parse(args)
+
+	openDatabase(*configFile)
+	defer models.Close()
+	log.Printf("The %s database schema is up to date", config.AppConfig.DatabaseDriver)
+}
+
+// admin grants, revokes or lists administrators kept in the database.
+// Administrators in admin_discord_ids are listed but can only be changed in
+// the config file.
+func admin(args []string) {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	flags.Usage = commandUsage(flags)
+	configFile := flags.String("config", "config.json", "configuration file")
+	flags.Parse(args)
+
+	action, discordID := flags.Arg(0), flags.Arg(1)
+	switch {
+	case action == "list" && flags.NArg() == 1:
+	case (action == "grant" || action == "revoke") && flags.NArg() == 2 && isUserID(discordID):
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	openDatabase(*configFile)
+	defer models.Close()
+
+	switch action {
+	case "list":
+		for _, id := range config.AppConfig.AdminDiscordIDs {
+			fmt.Printf("%s\tconfig\n", id)
+		}
+		grants, err := models.ListAdminGrants(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list administrators: %v", err)
+		}
+		for _, g := range grants {
+			fmt.Printf("%s\tgranted by %s on %s\n", g.DiscordID, g.GrantedBy, g.CreatedAt.Format("2006-01-02"))
+		}
+		return
+	case "grant":
+		if err := models.GrantAdmin(ctx, discordID, commandActor()); err != nil {
+			log.Fatalf("Failed to grant admin to %s: %v", discordID, err)
+		}
+		recordCommandAudit(models.AuditAdminGrant, "user:"+discordID)
+		log.Printf("Granted admin to %s; a running server picks it up within a minute", discordID)
+	case "revoke":
+		err := models.RevokeAdmin(ctx, discordID)
+		if err == sql.ErrNoRows {
+			if config.AppConfig.IsAdmin(discordID) {
+				log.Fatalf("%s is an administrator through admin_discord_ids; remove them from the config file", discordID)
+			}
+			log.Fatalf("%s has no admin grant", discordID)
+		} else if err != nil {
+			log.Fatalf("Failed to revoke admin from %s: %v", discordID, err)
+		}
+		recordCommandAudit(models.AuditAdminRevoke, "user:"+discordID)
+		log.Printf("Revoked admin from %s; a running server drops it within a minute", discordID)
+	}
+}
+
+// backupCommand writes a backup to the backup directory, or the file given
+// with -o, and uploads it to S3 if a bucket is configured
+func backupCommand(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Usage = commandUsage(flags)
+	configFile := flags.String("config", "config.json", "configuration file")
+	output := flags.String("o", "", "file to write the backup to instead of the backup directory")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	openDatabase(*configFile)
+	defer models.Close()
+
+	if *output == "" {
+		name, err := backup.Run()
+		if err != nil {
+			log.Fatalf("Backup failed: %v", err)
+		}
+		fmt.Println(name)
+		return
+	}
+
+	info, err := backup.WriteFile(*output)
+	if err != nil {
+		log.Fatalf("Backup failed: %v", err)
+	}
+	log.Printf("Wrote %s with the database and %d files", *output, info.Files)
+	if s3 := config.AppConfig.Backup.S3; s3.Bucket != "" {
+		key, err := backup.Upload(s3, *output)
+		if err != nil {
+			log.Fatalf("Failed to upload backup to S3: %v", err)
+		}
+		log.Printf("Uploaded to s3://%s/%s", s3.Bucket, key)
+	}
+}
+
+// restoreCommand loads a backup into the configured database and upload
+// directory
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = commandUsage(flags)
+	configFile := flags.String("config", "config.json", "configuration file")
+	force := flags.Bool("force", false, "replace an existing database")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// The database is replaced as a file, so it must not be open
+	if err := config.Load(*configFile); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	info, err := backup.Restore(flags.Arg(0), *force)
+	if errors.Is(err, backup.ErrDatabaseExists) {
+		log.Fatalf("%s already exists; stop the server and pass -force to replace it", config.AppConfig.DatabasePath)
+	} else if err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+	log.Printf("Restored the backup made at %s with %d files", info.CreatedAt.Format(time.RFC3339), info.Files)
+}
+
+// importFolder stores every image under a folder as uploads by one user, or
+// the system user, with the same checks, hashing and duplicate detection as
+// web uploads. Files are identified by their path within the folder, so
+// running it again only adds new files.
+func importFolder(args []string) {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = commandUsage(flags)
+	configFile := flags.String("config", "config.json", "configuration file")
+	discordID := flags.String("user", "", "Discord ID of the user the uploads are attributed to (default the system user)")
+	rawTags := flags.String("tags", "", "comma-separated tags added to every upload")
+	manifestFile := flags.String("manifest", "", "CSV file giving the rarity, title, description, tags or license of files")
+	rawRarity := flags.String("rarity", models.RarityCommon, "rarity of files the manifest and folder names leave out")
+	guildID := flags.String("guild", "", "ID of the Discord server the uploads are added to (default the default guild)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (*discordID != "" && !isUserID(*discordID)) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	dir := flags.Arg(0)
+
+	var tags []string
+	if *rawTags != "" {
+		var err error
+		if tags, err = models.NormalizeTags(strings.Split(*rawTags, ",")); err != nil {
+			log.Fatalf("Invalid tags: %v", err)
+		}
+	}
+	defaultRarity, err := models.ParseRarity(*rawRarity)
+	if err != nil || defaultRarity == "" {
+		log.Fatalf("Invalid -rarity %q: must be one of %s", *rawRarity, strings.Join(models.Rarities, ", "))
+	}
+	manifest := map[string]handlers.ImportDetails{}
+	if *manifestFile != "" {
+		if manifest, err = readManifest(*manifestFile); err != nil {
+			log.Fatalf("Invalid manifest %s: %v", *manifestFile, err)
+		}
+	}
+
+	openDatabase(*configFile)
+	defer models.Close()
+	if err := os.MkdirAll(config.AppConfig.UploadDirectory, 0755); err != nil {
+		log.Fatalf("Failed to create upload directory: %v", err)
+	}
+	if *guildID == "" {
+		*guildID = config.AppConfig.DefaultGuildID
+	} else if !config.AppConfig.IsAllowedGuild(*guildID) {
+		log.Fatalf("Invalid -guild %s: not one of the configured guilds", *guildID)
+	}
+
+	var user *models.User
+	if *discordID == "" {
+		if user, err = models.GetSystemUser(ctx); err != nil {
+			log.Fatalf("Failed to get the system user: %v", err)
+		}
+	} else if user, err = models.GetUser(ctx, *discordID); err == sql.ErrNoRows {
+		log.Fatalf("User %s has never signed in", *discordID)
+	} else if err != nil {
+		log.Fatalf("Failed to get user %s: %v", *discordID, err)
+	}
+
+	var imported, skipped, failed int
+	seen := make(map[string]bool, len(manifest))
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() || !handlers.Importable(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		details, listed := manifest[rel]
+		seen[rel] = listed
+		details.Tags = slices.Compact(slices.Sorted(slices.Values(append(details.Tags, tags...))))
+		if details.Rarity == "" {
+			details.Rarity = folderRarity(rel, defaultRarity)
+		}
+		details.GuildID = *guildID
+
+		upload, err := handlers.ImportFile(ctx, user, path, rel, details)
+		switch {
+		case errors.Is(err, handlers.ErrAlreadyImported):
+			skipped++
+			fmt.Printf("skipped  %s: already imported as upload %d (%s)\n", rel, upload.ID, upload.Rarity)
+		case err != nil:
+			failed++
+			fmt.Printf("failed   %s: %v\n", rel, err)
+		default:
+			imported++
+			fmt.Printf("imported %s as upload %d (%s)\n", rel, upload.ID, upload.Rarity)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", dir, err)
+	}
+
+	for rel := range manifest {
+		if !seen[rel] {
+			failed++
+			fmt.Printf("failed   %s: listed in the manifest but not found\n", rel)
+		}
+	}
+
+	log.Printf("Imported %d files from %s, skipped %d imported before, %d failed", imported, dir, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// readManifest reads an import manifest: a CSV file with a header row naming
+// its columns. The path column, relative to the imported folder, is required;
+// rarity, title, description, tags (separated by semicolons) and license are
+// optional. Every row is checked before anything is imported.
+func readManifest(name string) (map[string]handlers.ImportDetails, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		switch column {
+		case "path", "rarity", "title", "description", "tags", "license":
+		default:
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+		if _, ok := columns[column]; ok {
+			return nil, fmt.Errorf("column %q appears twice", column)
+		}
+		columns[column] = i
+	}
+	if _, ok := columns["path"]; !ok {
+		return nil, errors.New("missing path column")
+	}
+
+	manifest := map[string]handlers.ImportDetails{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		field := func(column string) string {
+			if i, ok := columns[column]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		rel := path.Clean(filepath.ToSlash(field("path")))
+		if rel == "." || path.IsAbs(rel) || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("line %d: path must be within the imported folder", line)
+		}
+		if _, ok := manifest[rel]; ok {
+			return nil, fmt.Errorf("line %d: %s is listed twice", line, rel)
+		}
+
+		var details handlers.ImportDetails
+		if details.Rarity, err = models.ParseRarity(field("rarity")); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if details.License, err = models.NormalizeLicense(field("license")); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if raw := field("tags"); raw != "" {
+			if details.Tags, err = models.NormalizeTags(strings.Split(raw, ";")); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		details.Title = field("title")
+		details.Description = field("description")
+		manifest[rel] = details
+	}
+	return manifest, nil
+}
+
+// folderRarity returns the rarity named by the innermost folder of a path
+// that is named after one, so files sorted into e.g. legendary/ get that
+// rarity, or def if none is
+func folderRarity(rel, def string) string {
+	dirs := strings.Split(path.Dir(rel), "/")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if rarity, err := models.ParseRarity(dirs[i]); err == nil && rarity != "" {
+			return rarity
+		}
+	}
+	return def
+}
+
+// uploadsCommand transfers an upload to another user or merges an
+// accidentally duplicated upload into the canonical one, the same as the
+// admin API. With -dry-run it prints what would change without changing it.
+func uploadsCommand(args []string) {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("uploads", flag.ExitOnError)
+	flags.Usage = commandUsage(flags)
+	configFile := flags.String("config", "config.json", "configuration file")
+	dryRun := flags.Bool("dry-run", false, "show what would change without changing it")
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	uploadID, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+	valid := flags.NArg() == 3 && err == nil
+	var intoID int64
+	switch action {
+	case "reassign":
+		valid = valid && isUserID(flags.Arg(2))
+	case "merge":
+		intoID, err = strconv.ParseInt(flags.Arg(2), 10, 64)
+		valid = valid && err == nil
+	default:
+		valid = false
+	}
+	if !valid {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	openDatabase(*configFile)
+	defer models.Close()
+
+	switch action {
+	case "reassign":
+		discordID := flags.Arg(2)
+		previous, err := models.ReassignUpload(ctx, uploadID, discordID, *dryRun)
+		if err == sql.ErrNoRows {
+			log.Fatalf("Upload %d not found", uploadID)
+		} else if err != nil {
+			log.Fatalf("Failed to reassign upload %d to %s: %v", uploadID, discordID, err)
+		}
+		if *dryRun {
+			log.Printf("Dry run: upload %d would be reassigned from %s to %s", uploadID, previous, discordID)
+			return
+		}
+		recordCommandAudit(models.AuditReassignUpload, fmt.Sprintf("upload:%d", uploadID))
+		log.Printf("Reassigned upload %d from %s to %s", uploadID, previous, discordID)
+	case "merge":
+		merge, err := models.MergeUploads(ctx, uploadID, intoID, *dryRun)
+		if err == sql.ErrNoRows {
+			log.Fatalf("Upload %d or %d not found", uploadID, intoID)
+		} else if err != nil {
+			log.Fatalf("Failed to merge upload %d into %d: %v", uploadID, intoID, err)
+		}
+		fmt.Printf("pulls\t%d\nlikes\t%d\nwishlists\t%d\nshowcases\t%d\nbanners\t%d\nseasons\t%d\ntrades\t%d\ntags\t%d\n",
+			merge.Pulls, merge.Likes, merge.Wishlists, merge.Showcases, merge.Banners, merge.Seasons, merge.Trades, merge.Tags)
+		if *dryRun {
+			log.Printf("Dry run: merging upload %d into %d would move the rows above", uploadID, intoID)
+			return
+		}
+		recordCommandAudit(models.AuditMergeUpload, fmt.Sprintf("upload:%d", uploadID))
+		log.Printf("Merged upload %d into %d and moved it to the trash", uploadID, intoID)
+	}
+}
+
+// isUserID reports whether s is a Discord ID or the ID of an account from
+// another sign-in provider
+func isUserID(s string) bool {
+	return isDiscordID(s) || oauth.IsUserID(s)
+}
+
+// isDiscordID reports whether s looks like a Discord snowflake
+func isDiscordID(s string) bool {
+	if len(s) < 15 || len(s) > 20 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// commandActor names who ran a command in the audit log
+func commandActor() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "cli:" + user
+	}
+	return "cli"
+}
+
+// recordCommandAudit records an action taken from the command line
+func recordCommandAudit(action, target string) {
+	entry := &models.AuditEntry{ActorID: commandActor(), Action: action, Target: target}
+	if err := models.RecordAudit(context.Background(), entry); err != nil {
+		log.Printf("Failed to record audit entry: %v", err)
+	}
+}
@@ -1,77 +1,1820 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/i18n"
 )
 
 type Config struct {
-	ServerPort             int      `json:"server_port"`
-	ServerHost             string   `json:"server_host"`
-	DiscordClientID        string   `json:"discord_client_id"`
-	DiscordClientSecret    string   `json:"discord_client_secret"`
-	DiscordRedirectURI     string   `json:"discord_redirect_uri"`
-	AllowedServerIDs       []string `json:"allowed_server_ids"`
-	UploadCooldownMinutes  int      `json:"upload_cooldown_minutes"`
-	MaxFileSizeMB          int      `json:"max_file_size_mb"`
-	DatabasePath           string   `json:"database_path"`
-	UploadDirectory        string   `json:"upload_directory"`
-	SessionSecret          string   `json:"session_secret"`
+	ServerPort             int                 `json:"server_port"`
+	ServerHost             string              `json:"server_host"`
+	DiscordClientID        string              `json:"discord_client_id"`
+	DiscordClientSecret    string              `json:"discord_client_secret"`
+	DiscordRedirectURI     string              `json:"discord_redirect_uri"`
+	Guilds                 map[string]Guild    `json:"guilds"`
+	DefaultGuildID         string              `json:"default_guild_id"`
+	AllowedServerIDs       []string            `json:"allowed_server_ids"`
+	UploadRoleIDs          map[string][]string `json:"upload_role_ids"`
+	UploadCooldownMinutes  int                 `json:"upload_cooldown_minutes"`
+	UploadCooldownTiers    map[string]int      `json:"upload_cooldown_tiers"`
+	MaxUploadsPerDay       int                 `json:"max_uploads_per_day"`
+	MaxStorageMB           int                 `json:"max_storage_mb"`
+	MaxFileSizeMB          int                 `json:"max_file_size_mb"`
+	RoleMaxFileSizeMB      map[string]int      `json:"role_max_file_size_mb"`
+	UploadFormats          map[string][]string `json:"upload_formats"`
+	MinWidth               int                 `json:"min_width"`
+	MinHeight              int                 `json:"min_height"`
+	MaxImagePixels         int                 `json:"max_image_pixels"`
+	AllowedAspectRatios    []string            `json:"allowed_aspect_ratios"`
+	AspectRatioTolerance   float64             `json:"aspect_ratio_tolerance"`
+	MaxZipSizeMB           int                 `json:"max_zip_size_mb"`
+	MaxDownloadSizeMB      int                 `json:"max_collection_download_mb"`
+	DatabaseDriver         string              `json:"database_driver"`
+	DatabaseURL            string              `json:"database_url"`
+	DatabasePath           string              `json:"database_path"`
+	DatabasePool           DatabasePool        `json:"database_pool"`
+	UploadDirectory        string              `json:"upload_directory"`
+	SessionSecret          Secrets             `json:"session_secret"`
+	SessionStore           string              `json:"session_store"`
+	RedisURL               string              `json:"redis_url"`
+	DuplicateHashDistance  int                 `json:"duplicate_hash_distance"`
+	DuplicateAction        string              `json:"duplicate_action"`
+	MaxConcurrentUploads   int                 `json:"max_concurrent_uploads"`
+	MaxUploadsPerUser      int                 `json:"max_concurrent_uploads_per_user"`
+	MetricsEnabled         bool                `json:"metrics_enabled"`
+	AdminDiscordIDs        []string            `json:"admin_discord_ids"`
+	ResetTimezone          string              `json:"reset_timezone"`
+	MirrorDirectories      []string            `json:"mirror_directories"`
+	IntegrityCheckHours    int                 `json:"integrity_check_interval_hours"`
+	OrphanCheckHours       int                 `json:"orphan_check_interval_hours"`
+	OrphanMinAgeHours      int                 `json:"orphan_min_age_hours"`
+	DeleteOrphans          bool                `json:"delete_orphans"`
+	ImpersonationMinutes   int                 `json:"impersonation_minutes"`
+	TrashRetentionDays     int                 `json:"trash_retention_days"`
+	DeletionGraceDays      int                 `json:"account_deletion_grace_days"`
+	DraftTTLMinutes        int                 `json:"draft_ttl_minutes"`
+	PullsPerDay            int                 `json:"pulls_per_day"`
+	RerollsPerDay          int                 `json:"rerolls_per_day"`
+	MaxRerollTokens        int                 `json:"max_reroll_tokens"`
+	LikePullWeight         float64             `json:"like_pull_weight"`
+	WishlistSize           int                 `json:"wishlist_size"`
+	ShowcaseSize           int                 `json:"showcase_size"`
+	WishlistRateUp         float64             `json:"wishlist_rate_up"`
+	RarityRates            map[string]float64  `json:"rarity_rates"`
+	RarityVotingHours      int                 `json:"rarity_voting_hours"`
+	RarityVoteMinVotes     int                 `json:"rarity_vote_min_votes"`
+	TradeOfferHours        int                 `json:"trade_offer_hours"`
+	NotificationDays       int                 `json:"notification_retention_days"`
+	FingerprintDays        int                 `json:"fingerprint_retention_days"`
+	DustAutoConvert        bool                `json:"dust_auto_convert"`
+	DustRates              map[string]int      `json:"dust_rates"`
+	DustPullCost           int                 `json:"dust_pull_cost"`
+	DustRarityCosts        map[string]int      `json:"dust_rarity_costs"`
+	DustWallpaperCost      int                 `json:"dust_wallpaper_cost"`
+	Rewards                Rewards             `json:"rewards"`
+	DiskSpace              DiskSpace           `json:"disk_space"`
+	DiscordBotToken        string              `json:"discord_bot_token"`
+	DiscordPublicKey       string              `json:"discord_public_key"`
+	GuildRecheckMinutes    int                 `json:"guild_recheck_minutes"`
+	GuildCacheMinutes      int                 `json:"guild_cache_minutes"`
+	UnixSocketPath         string              `json:"unix_socket_path"`
+	UnixSocketMode         string              `json:"unix_socket_mode"`
+	DisableTCP             bool                `json:"disable_tcp"`
+	ReadTimeoutSeconds     int                 `json:"read_timeout_seconds"`
+	ReadHeaderTimeoutSecs  int                 `json:"read_header_timeout_seconds"`
+	WriteTimeoutSeconds    int                 `json:"write_timeout_seconds"`
+	IdleTimeoutSeconds     int                 `json:"idle_timeout_seconds"`
+	MaxHeaderBytes         int                 `json:"max_header_bytes"`
+	MaxBodyBytes           int64               `json:"max_body_bytes"`
+	BodyReadTimeoutSecs    int                 `json:"body_read_timeout_seconds"`
+	CompressMinBytes       int                 `json:"compress_min_bytes"`
+	HTTP2Enabled           bool                `json:"http2_enabled"`
+	DisableKeepAlives      bool                `json:"disable_keep_alives"`
+	AuthorizationPolicy    map[string]string   `json:"authorization_policy"`
+	ReportHideThreshold    int                 `json:"report_hide_threshold"`
+	LinkApprovalThreshold  int                 `json:"link_approval_threshold"`
+	ProcessingWorkers      int                 `json:"processing_workers"`
+	ProcessingQueueSize    int                 `json:"processing_queue_size"`
+	ProcessingNice         int                 `json:"processing_nice"`
+	ShutdownTimeoutSeconds int                 `json:"shutdown_timeout_seconds"`
+	WebhookURLs            []string            `json:"webhook_urls"`
+	WebhookSecret          string              `json:"webhook_secret"`
+	WebhookEvents          []string            `json:"webhook_events"`
+	WebhookWorkers         int                 `json:"webhook_workers"`
+	WebhookMaxAttempts     int                 `json:"webhook_max_attempts"`
+	WebhookMaxPending      int                 `json:"webhook_max_pending"`
+	RateLimitAuth          RateLimit           `json:"rate_limit_auth"`
+	RateLimitUpload        RateLimit           `json:"rate_limit_upload"`
+	RateLimitPull          RateLimit           `json:"rate_limit_pull"`
+	RateLimitDownload      RateLimit           `json:"rate_limit_download"`
+	TrustedProxies         []string            `json:"trusted_proxies"`
+	UploadHooks            []UploadHook        `json:"upload_hooks"`
+	UploadRules            []UploadRule        `json:"upload_rules"`
+	ContentSafety          ContentSafety       `json:"content_safety"`
+	ClamAV                 ClamAV              `json:"clamav"`
+	Tracing                Tracing             `json:"tracing"`
+	TLS                    TLS                 `json:"tls"`
+	SecurityHeaders        SecurityHeaders     `json:"security_headers"`
+	SiteURL                string              `json:"site_url"`
+	ContentURL             string              `json:"content_url"`
+	SignedURLs             SignedURLs          `json:"signed_urls"`
+	CORS                   CORS                `json:"cors"`
+	Maintenance            Maintenance         `json:"maintenance"`
+	Backup                 Backup              `json:"backup"`
+	PoolExport             PoolExport          `json:"pool_export"`
+	DiscordImport          DiscordImport       `json:"discord_import"`
+	Transcode              Transcode           `json:"transcode"`
+	ImageConverter         ImageConverter      `json:"image_converter"`
+	QualityCheck           QualityCheck        `json:"quality_check"`
+	LinkPreviews           bool                `json:"link_previews"`
+	DefaultLocale          string              `json:"default_locale"`
+	Schedules              map[string]Schedule `json:"schedules"`
+	Watermark              Watermark           `json:"watermark"`
+	GitHubLogin            GitHubLogin         `json:"github_login"`
+	GoogleLogin            GoogleLogin         `json:"google_login"`
+
+	resetLocation  *time.Location
+	trustedProxies []netip.Prefix
+	contentHost    string
+	aspectRatios   []aspectRange
+}
+
+// aspectRange is an inclusive range of width/height ratios
+type aspectRange struct {
+	min, max float64
+}
+
+// RateLimit configures a token bucket: PerMinute requests are allowed per
+// minute on average, with bursts of up to Burst. A negative PerMinute turns
+// the limit off.
+type RateLimit struct {
+	PerMinute int `json:"per_minute"`
+	Burst     int `json:"burst"`
+}
+
+// Tracing configures export of request traces to an OpenTelemetry collector
+// over OTLP/HTTP. Tracing is off while OTLPEndpoint is empty. SampleRatio is
+// the share of traces recorded, from 0 (exclusive) to 1.
+type Tracing struct {
+	OTLPEndpoint string            `json:"otlp_endpoint"`
+	Headers      map[string]string `json:"headers"`
+	ServiceName  string            `json:"service_name"`
+	SampleRatio  float64           `json:"sample_ratio"`
+}
+
+// TLS configures HTTPS with certificates obtained automatically from an ACME
+// certificate authority, by default Let's Encrypt. It is off while Domains is
+// empty; otherwise the TCP listener serves HTTPS and a plain HTTP listener on
+// HTTPPort answers the CA's challenges and redirects everything else.
+type TLS struct {
+	Domains      []string `json:"domains"`
+	Email        string   `json:"email"`
+	CacheDir     string   `json:"cache_dir"`
+	DirectoryURL string   `json:"directory_url"`
+	HTTPPort     int      `json:"http_port"`
+}
+
+// Secrets is a list of keys, newest first, given in the configuration as
+// either a single string or an array. New data is protected with the first
+// key; the others are still accepted, so a secret can be rotated by adding a
+// new one in front and removing the old one later.
+type Secrets []string
+
+func (s *Secrets) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = Secrets{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("must be a string or a list of strings")
+	}
+	*s = list
+	return nil
+}
+
+// Current returns the key new data is protected with
+func (s Secrets) Current() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
+
+// UploadHook is an external HTTP check called at one stage of the upload
+// pipeline: "pre_validate", "post_store" or "pre_approve". When the hook
+// can't be reached the upload is refused, unless FailOpen is set.
+type UploadHook struct {
+	Stage          string `json:"stage"`
+	URL            string `json:"url"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	FailOpen       bool   `json:"fail_open"`
+}
+
+// Types of upload rules
+const (
+	// UploadRuleFilenamePattern refuses files whose name matches Pattern
+	UploadRuleFilenamePattern = "filename_pattern"
+	// UploadRuleTagMinDimensions refuses images tagged Tag that are smaller
+	// than MinWidth by MinHeight
+	UploadRuleTagMinDimensions = "tag_min_dimensions"
+	// UploadRuleBannerLimit refuses uploads past the MaxUploads a user may
+	// have featured in a running banner: BannerID, or any when it is 0
+	UploadRuleBannerLimit = "banner_upload_limit"
+)
+
+// UploadRuleTypes lists the types of upload rules
+var UploadRuleTypes = []string{UploadRuleFilenamePattern, UploadRuleTagMinDimensions, UploadRuleBannerLimit}
+
+// MaxUploadRuleNameLength and MaxUploadRuleMessageLength bound the text of
+// an upload rule
+const (
+	MaxUploadRuleNameLength    = 100
+	MaxUploadRuleMessageLength = 500
+)
+
+// UploadRule is a content policy check uploads must pass, set in
+// upload_rules or by admins at runtime. Which fields apply depends on Type.
+// Message, when set, replaces the explanation given to uploaders the rule
+// refuses.
+type UploadRule struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Pattern    string `json:"pattern,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	MinWidth   int    `json:"min_width,omitempty"`
+	MinHeight  int    `json:"min_height,omitempty"`
+	BannerID   int64  `json:"banner_id,omitempty"`
+	MaxUploads int    `json:"max_uploads,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// Validate checks an upload rule, normalizing its tag
+func (r *UploadRule) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" || len(r.Name) > MaxUploadRuleNameLength {
+		return fmt.Errorf("name is required and must be at most %d characters", MaxUploadRuleNameLength)
+	}
+	if len(r.Message) > MaxUploadRuleMessageLength {
+		return fmt.Errorf("message must be at most %d characters", MaxUploadRuleMessageLength)
+	}
+	switch r.Type {
+	case UploadRuleFilenamePattern:
+		if r.Pattern == "" {
+			return fmt.Errorf("pattern is required")
+		}
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("pattern is not a valid regular expression: %w", err)
+		}
+	case UploadRuleTagMinDimensions:
+		r.Tag = strings.Join(strings.Fields(strings.ToLower(r.Tag)), " ")
+		if r.Tag == "" {
+			return fmt.Errorf("tag is required")
+		}
+		if r.MinWidth < 0 || r.MinHeight < 0 || r.MinWidth+r.MinHeight == 0 {
+			return fmt.Errorf("min_width and min_height must not be negative, and one must be set")
+		}
+	case UploadRuleBannerLimit:
+		if r.BannerID < 0 {
+			return fmt.Errorf("banner_id must not be negative")
+		}
+		if r.MaxUploads < 1 {
+			return fmt.Errorf("max_uploads must be at least 1")
+		}
+	default:
+		return fmt.Errorf("type must be one of: %s", strings.Join(UploadRuleTypes, ", "))
+	}
+	return nil
+}
+
+// ContentSafety configures a background check of new uploads against an
+// external classifier, such as an NSFW detection API or a locally hosted
+// model. It is off while URL is empty. Uploads stay out of the gallery until
+// checked; flagged ones are then either reported for admin review ("flag") or
+// moved to the trash ("reject"), depending on Action.
+type ContentSafety struct {
+	URL            string  `json:"url"`
+	Action         string  `json:"action"`
+	Threshold      float64 `json:"threshold"`
+	TimeoutSeconds int     `json:"timeout_seconds"`
+}
+
+// ClamAV configures malware scanning of uploads by a ClamAV daemon before
+// they are stored. It is off while Address is empty. Address is either the
+// path of clamd's unix socket or a TCP host:port. Infected files are kept in
+// QuarantineDirectory for admins to inspect. When clamd can't be reached,
+// uploads are refused unless FailOpen is set.
+type ClamAV struct {
+	Address             string `json:"address"`
+	TimeoutSeconds      int    `json:"timeout_seconds"`
+	QuarantineDirectory string `json:"quarantine_directory"`
+	FailOpen            bool   `json:"fail_open"`
+}
+
+// SecurityHeaders configures the security headers sent with every response.
+// HSTSMaxAgeSeconds tells browsers to reach the site only over HTTPS for that
+// long; it defaults to a year when the server serves HTTPS itself and is off
+// otherwise, or when negative. ContentSecurityPolicy replaces the policy sent
+// with pages, for sites that load scripts or images from elsewhere.
+type SecurityHeaders struct {
+	HSTSMaxAgeSeconds     int    `json:"hsts_max_age_seconds"`
+	HSTSIncludeSubdomains bool   `json:"hsts_include_subdomains"`
+	HSTSPreload           bool   `json:"hsts_preload"`
+	ContentSecurityPolicy string `json:"content_security_policy"`
+}
+
+// SignedURLs lets a CDN or caching proxy in front of the server deliver
+// stored files. While enabled, originals sent as downloads and every file of
+// private and unlisted uploads are redirected, after the usual access checks,
+// to BaseURL with a signature that expires after TTLMinutes to two times
+// that. BaseURL defaults to the server's own /files route, on the content
+// host when there is one.
+type SignedURLs struct {
+	Enabled    bool   `json:"enabled"`
+	BaseURL    string `json:"base_url"`
+	TTLMinutes int    `json:"ttl_minutes"`
+}
+
+// CORS lets pages on other origins call the /api routes from a browser. It is
+// off while AllowedOrigins is empty. Origins are given as
+// "https://app.example.com", or "*" for any. AllowCredentials lets those
+// pages send cookies, and can't be combined with "*". AllowedMethods defaults
+// to GET, POST, PUT, PATCH and DELETE; MaxAgeSeconds, how long browsers may
+// keep a preflight answer, to 600.
+type CORS struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	MaxAgeSeconds    int      `json:"max_age_seconds"`
+}
+
+// Maintenance puts the site into maintenance mode at startup: everyone but
+// admins gets Message, which defaults to a generic notice, instead of the
+// site. Admins can switch it on and off at runtime, which takes precedence
+// until the runtime setting is cleared.
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// DatabasePool tunes the database connection pool. Zero values keep the
+// defaults of Go's database/sql: no limit on open connections, two idle ones
+// kept and no maximum lifetime. BusyTimeoutMS is how long a SQLite connection
+// waits for another connection's write to finish before giving up with
+// "database is locked". QueryTimeoutSeconds cancels any statement that runs
+// longer; a negative value lets statements run until their request ends.
+type DatabasePool struct {
+	MaxOpenConns           int `json:"max_open_conns"`
+	MaxIdleConns           int `json:"max_idle_conns"`
+	ConnMaxLifetimeMinutes int `json:"conn_max_lifetime_minutes"`
+	BusyTimeoutMS          int `json:"busy_timeout_ms"`
+	QueryTimeoutSeconds    int `json:"query_timeout_seconds"`
+}
+
+// Backup configures where backups are kept and how often the server makes
+// them. Scheduled backups are off while IntervalHours is 0. Directory keeps
+// the newest Keep backups; a negative Keep keeps them all. Backups are also
+// uploaded to S3 when S3.Bucket is set.
+type Backup struct {
+	IntervalHours int    `json:"interval_hours"`
+	Directory     string `json:"directory"`
+	Keep          int    `json:"keep"`
+	S3            S3     `json:"s3"`
+}
+
+// PoolExport configures the export of the public pool to a
+// content-addressed layout that community members can mirror. It is off
+// while IntervalHours is 0. The export is kept in Directory, and also
+// published to S3 when S3.Bucket is set.
+type PoolExport struct {
+	IntervalHours int    `json:"interval_hours"`
+	Directory     string `json:"directory"`
+	S3            S3     `json:"s3"`
+}
+
+// DiscordImport configures importing the wallpapers members post to a
+// Discord channel, read with discord_bot_token. It is off while ChannelID is
+// empty; otherwise the channel is checked for new posts every IntervalHours.
+type DiscordImport struct {
+	ChannelID     string `json:"channel_id"`
+	IntervalHours int    `json:"interval_hours"`
+}
+
+// Transcode configures converting stored files to one canonical format, jpeg
+// at Quality or lossless png, in the background. It is off while Format is
+// empty. With KeepOriginals the files converted from are kept beside them.
+type Transcode struct {
+	Format        string `json:"format"`
+	Quality       int    `json:"quality"`
+	KeepOriginals bool   `json:"keep_originals"`
+}
+
+// ImageConverter configures an external program, such as ImageMagick, that
+// decodes AVIF and HEIC/HEIF images, which Go can't, so they get thumbnails
+// and the other upload checks. It is off while Command is empty. Command
+// reads an image on stdin and writes it to stdout in the format named where
+// its arguments say {format}. With WebP, HEIC/HEIF originals are also served
+// converted to WebP to browsers that don't accept HEIC.
+type ImageConverter struct {
+	Command        []string `json:"command"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+	WebP           bool     `json:"webp"`
+}
+
+// QualityCheck scores new uploads from 0 to 100 for JPEG artifacts, upscaling
+// and low resolution, and reports those scoring below MinScore for admin
+// review
+type QualityCheck struct {
+	Enabled  bool `json:"enabled"`
+	MinScore int  `json:"min_score"`
+}
+
+// Rewards are the bonus pulls granted for taking part in the community:
+// Upload for each upload, DailyLogin for the first visit of each day,
+// LikesReceived for every LikesPerReward likes a user's uploads receive, and
+// UploadPulled each time one of their uploads has been pulled by others as
+// many times as one of UploadPulledMilestones. An amount of 0 turns a reward
+// off.
+type Rewards struct {
+	Upload                 int   `json:"upload"`
+	DailyLogin             int   `json:"daily_login"`
+	LikesReceived          int   `json:"likes_received"`
+	LikesPerReward         int   `json:"likes_per_reward"`
+	UploadPulled           int   `json:"upload_pulled"`
+	UploadPulledMilestones []int `json:"upload_pulled_milestones"`
+}
+
+// DiskSpace guards the volumes holding uploads and the SQLite database, as a
+// full disk can corrupt the database. While either has less than MinFreeMB
+// free, new uploads are refused. AlertWebhookURL, a Discord webhook, is told
+// when space runs low and when it recovers.
+type DiskSpace struct {
+	MinFreeMB       int    `json:"min_free_mb"`
+	AlertWebhookURL string `json:"alert_webhook_url"`
+}
+
+// Guild is the settings of a Discord server whose members may sign in. Each
+// guild has its own wallpapers, pull pool, banners and leaderboards. Name is
+// shown in the guild selector. UploadRoleIDs, when set, limits uploading to
+// the guild to members with one of the roles.
+type Guild struct {
+	Name          string   `json:"name"`
+	UploadRoleIDs []string `json:"upload_role_ids"`
+}
+
+// Watermark stamps Text, the site name by default, on thumbnails and resized
+// previews. While it is enabled, original files are only served to users who
+// have the wallpaper in their collection, its uploader and admins.
+type Watermark struct {
+	Enabled bool   `json:"enabled"`
+	Text    string `json:"text"`
+}
+
+// Schedule overrides when a scheduled task runs. Spec is "@every <duration>",
+// @hourly, @daily, @weekly, @monthly or a five-field cron expression, and
+// empty keeps the task's default. Each run starts up to JitterSeconds late,
+// picked at random, so tasks sharing a schedule don't all start at once.
+type Schedule struct {
+	Spec          string `json:"schedule"`
+	JitterSeconds int    `json:"jitter_seconds"`
+	Disabled      bool   `json:"disabled"`
+}
+
+// S3 is a bucket of Amazon S3 or a compatible service. Endpoint defaults to
+// AWS's endpoint for Region; objects are addressed by path, as services such
+// as MinIO expect.
+type S3 struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// GitHubLogin lets members of the listed GitHub organizations sign in with
+// their GitHub account. It is off while ClientID is empty. RedirectURI must
+// end in /auth/callback/github.
+type GitHubLogin struct {
+	ClientID      string   `json:"client_id"`
+	ClientSecret  string   `json:"client_secret"`
+	RedirectURI   string   `json:"redirect_uri"`
+	Organizations []string `json:"organizations"`
+}
+
+// GoogleLogin lets Google accounts with a verified email address in one of
+// the listed domains sign in. It is off while ClientID is empty. RedirectURI
+// must end in /auth/callback/google.
+type GoogleLogin struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURI  string   `json:"redirect_uri"`
+	Domains      []string `json:"domains"`
+}
+
+func (l *RateLimit) setDefaults(perMinute, burst int) {
+	if l.PerMinute == 0 {
+		l.PerMinute = perMinute
+	}
+	if l.Burst <= 0 {
+		l.Burst = burst
+	}
 }
 
 var AppConfig *Config
 
 // Load reads and parses the configuration file
 func Load(filename string) error {
+	c, err := load(filename)
+	if err != nil {
+		return err
+	}
+	AppConfig, source = c, func() (*Config, error) { return load(filename) }
+	return nil
+}
+
+func load(filename string) (*Config, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("failed to open config file: %w", err)
+		return nil, fmt.Errorf("failed to open config file: %w", err)
 	}
 	defer file.Close()
 
 	decoder := json.NewDecoder(file)
-	AppConfig = &Config{}
-	if err := decoder.Decode(AppConfig); err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+	c := &Config{}
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	return c, c.validate()
+}
+
+// LoadTestMode builds a self-contained configuration for integration tests.
+// Settings from filename are applied first when the file exists; the Discord
+// application, session secret, database and upload directory are always
+// replaced with throwaway values.
+func LoadTestMode(filename, uploadDir string) error {
+	c, err := loadTestMode(filename, uploadDir)
+	if err != nil {
+		return err
+	}
+	AppConfig, source = c, func() (*Config, error) { return loadTestMode(filename, uploadDir) }
+	return nil
+}
+
+func loadTestMode(filename, uploadDir string) (*Config, error) {
+	c := &Config{}
+	if file, err := os.Open(filename); err == nil {
+		defer file.Close()
+		if err := json.NewDecoder(file).Decode(c); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+
+	host, port := c.ServerHost, c.ServerPort
+	if host == "" {
+		host = "localhost"
+	}
+	if port == 0 {
+		port = 8080
+	}
+
+	c.DiscordClientID = "test-client"
+	c.DiscordClientSecret = "test-secret"
+	c.DiscordRedirectURI = fmt.Sprintf("http://%s:%d/auth/callback", host, port)
+	// The fake provider only knows its own two guilds; upload roles the file
+	// gives them are kept
+	guilds := map[string]Guild{TestGuildID: {Name: "Test Guild"}, TestSecondGuildID: {Name: "Second Test Guild"}}
+	for id, g := range guilds {
+		if roles, ok := c.UploadRoleIDs[id]; ok {
+			g.UploadRoleIDs = roles
+		}
+		if configured, ok := c.Guilds[id]; ok {
+			g.UploadRoleIDs = configured.UploadRoleIDs
+		}
+		guilds[id] = g
+	}
+	c.Guilds, c.DefaultGuildID = guilds, TestGuildID
+	c.AllowedServerIDs, c.UploadRoleIDs = nil, nil
+	c.SessionSecret = Secrets{"test-mode-session-secret"}
+	c.DatabaseDriver = "sqlite"
+	c.DatabasePath = ":memory:"
+	c.UploadDirectory = uploadDir
+	c.MirrorDirectories = nil
+	c.AdminDiscordIDs = []string{TestAdminID}
+	// The fake provider has no bot API, and only imitates Discord
+	c.DiscordBotToken = ""
+	c.DiscordImport = DiscordImport{}
+	c.GitHubLogin = GitHubLogin{}
+	c.GoogleLogin = GoogleLogin{}
+
+	return c, c.validate()
+}
+
+// Identities used by test mode's fake Discord provider
+const (
+	TestGuildID        = "100000000000000001"
+	TestSecondGuildID  = "100000000000000002"
+	TestAdminID        = "200000000000000001"
+	TestUploaderRoleID = "300000000000000001"
+)
+
+// validate checks required settings and fills in defaults
+func (c *Config) validate() error {
 	// Validate required fields
-	if AppConfig.DiscordClientID == "" {
+	if c.DiscordClientID == "" {
 		return fmt.Errorf("discord_client_id is required")
 	}
-	if AppConfig.DiscordClientSecret == "" {
+	if c.DiscordClientSecret == "" {
 		return fmt.Errorf("discord_client_secret is required")
 	}
-	if AppConfig.DiscordRedirectURI == "" {
+	if c.DiscordRedirectURI == "" {
 		return fmt.Errorf("discord_redirect_uri is required")
 	}
-	if len(AppConfig.AllowedServerIDs) == 0 {
-		return fmt.Errorf("at least one allowed_server_id is required")
+	if err := c.validateGuilds(); err != nil {
+		return err
 	}
-	if AppConfig.SessionSecret == "" {
+	if len(c.SessionSecret) == 0 {
 		return fmt.Errorf("session_secret is required")
 	}
+	for _, secret := range c.SessionSecret {
+		if secret == "" {
+			return fmt.Errorf("session_secret must not contain empty keys")
+		}
+	}
+	if c.SessionStore == "" {
+		c.SessionStore = "database"
+	}
+	switch c.SessionStore {
+	case "database":
+	case "redis":
+		if c.RedisURL == "" {
+			return fmt.Errorf("redis_url is required when session_store is redis")
+		}
+	default:
+		return fmt.Errorf("session_store must be database or redis")
+	}
 
 	// Set defaults
-	if AppConfig.ServerPort == 0 {
-		AppConfig.ServerPort = 8080
+	if c.ServerPort == 0 {
+		c.ServerPort = 8080
+	}
+	if c.ServerHost == "" {
+		c.ServerHost = "localhost"
+	}
+	if c.UploadCooldownMinutes == 0 {
+		c.UploadCooldownMinutes = 60
+	}
+	for tier, minutes := range c.UploadCooldownTiers {
+		if minutes < 0 {
+			return fmt.Errorf("upload_cooldown_tiers: cooldown for %s must not be negative", tier)
+		}
+	}
+	if c.MaxFileSizeMB == 0 {
+		c.MaxFileSizeMB = 50
+	}
+	for roleID, mb := range c.RoleMaxFileSizeMB {
+		if mb <= 0 {
+			return fmt.Errorf("role_max_file_size_mb: size for role %s must be positive", roleID)
+		}
+	}
+	if err := c.validateUploadFormats(); err != nil {
+		return err
+	}
+	if c.MaxZipSizeMB == 0 {
+		c.MaxZipSizeMB = 200
+	}
+	if c.MaxDownloadSizeMB == 0 {
+		c.MaxDownloadSizeMB = 2048
+	}
+	if c.DatabaseDriver == "" {
+		c.DatabaseDriver = "sqlite"
+	}
+	switch c.DatabaseDriver {
+	case "sqlite":
+		if c.DatabasePath == "" {
+			c.DatabasePath = "./wallpaper.db"
+		}
+	case "postgres":
+		if c.DatabaseURL == "" {
+			return fmt.Errorf("database_url is required when database_driver is postgres")
+		}
+	default:
+		return fmt.Errorf("database_driver must be sqlite or postgres")
+	}
+	if c.UploadDirectory == "" {
+		c.UploadDirectory = "./uploads"
+	}
+	if c.DuplicateHashDistance == 0 {
+		c.DuplicateHashDistance = 6
+	}
+	if c.DuplicateAction == "" {
+		c.DuplicateAction = "reject"
+	}
+	if c.MaxConcurrentUploads == 0 {
+		c.MaxConcurrentUploads = 4
+	}
+	if c.MaxUploadsPerUser == 0 {
+		c.MaxUploadsPerUser = 1
+	}
+	if c.ReadHeaderTimeoutSecs == 0 {
+		c.ReadHeaderTimeoutSecs = 10
+	}
+	if c.IdleTimeoutSeconds == 0 {
+		c.IdleTimeoutSeconds = 120
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = 1 << 20
+	}
+	if c.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 1 << 20
+	}
+	if c.BodyReadTimeoutSecs == 0 {
+		c.BodyReadTimeoutSecs = 30
+	}
+	if c.CompressMinBytes == 0 {
+		c.CompressMinBytes = 1024
+	}
+	if c.ProcessingWorkers == 0 {
+		c.ProcessingWorkers = runtime.NumCPU()
+	}
+	if c.ProcessingQueueSize == 0 {
+		c.ProcessingQueueSize = 64
+	}
+	if c.ProcessingNice < 0 || c.ProcessingNice > 19 {
+		return fmt.Errorf("processing_nice must be between 0 and 19")
+	}
+	if c.ShutdownTimeoutSeconds == 0 {
+		c.ShutdownTimeoutSeconds = 60
+	}
+	if c.WebhookWorkers == 0 {
+		c.WebhookWorkers = 2
+	}
+	if c.WebhookMaxAttempts == 0 {
+		c.WebhookMaxAttempts = 8
+	}
+	if c.WebhookMaxPending == 0 {
+		c.WebhookMaxPending = 1000
+	}
+	if c.UnixSocketMode == "" {
+		c.UnixSocketMode = "0660"
+	}
+	if c.DisableTCP && c.UnixSocketPath == "" {
+		return fmt.Errorf("unix_socket_path is required when disable_tcp is set")
+	}
+	if c.TrashRetentionDays == 0 {
+		c.TrashRetentionDays = 30
+	}
+	if c.DeletionGraceDays == 0 {
+		c.DeletionGraceDays = 14
+	}
+	if c.DeletionGraceDays < 0 {
+		return fmt.Errorf("account_deletion_grace_days must not be negative")
+	}
+	if c.OrphanMinAgeHours <= 0 {
+		c.OrphanMinAgeHours = 24
+	}
+	if c.DraftTTLMinutes == 0 {
+		c.DraftTTLMinutes = 60
+	}
+	if c.PullsPerDay == 0 {
+		c.PullsPerDay = 10 // negative allows unlimited pulls
+	}
+	if c.RerollsPerDay == 0 {
+		c.RerollsPerDay = 1 // negative allows unlimited rerolls
+	}
+	if c.MaxRerollTokens <= 0 {
+		c.MaxRerollTokens = 3
+	}
+	if c.LikePullWeight == 0 {
+		c.LikePullWeight = 0.1 // negative draws every wallpaper equally often
+	}
+	if c.WishlistSize <= 0 {
+		c.WishlistSize = 5
+	}
+	if c.ShowcaseSize <= 0 {
+		c.ShowcaseSize = 6
+	}
+	if c.WishlistRateUp == 0 {
+		c.WishlistRateUp = 2 // below 1 gives wishlisted wallpapers no rate-up
+	}
+	if err := c.validateRarityRates(); err != nil {
+		return err
+	}
+	if c.RarityVotingHours == 0 {
+		c.RarityVotingHours = 72 // negative turns rarity voting off
+	}
+	if c.RarityVoteMinVotes <= 0 {
+		c.RarityVoteMinVotes = 3
+	}
+	if c.TradeOfferHours <= 0 {
+		c.TradeOfferHours = 72
+	}
+	if c.NotificationDays <= 0 {
+		c.NotificationDays = 90
+	}
+	if c.FingerprintDays <= 0 {
+		c.FingerprintDays = 90
+	}
+	if c.Watermark.Enabled && strings.TrimSpace(c.Watermark.Text) == "" {
+		c.Watermark.Text = "Wallpaper Gacha"
+	}
+	for name, s := range c.Schedules {
+		if s.JitterSeconds < 0 {
+			return fmt.Errorf("schedules: jitter_seconds of %s must not be negative", name)
+		}
+	}
+	if err := c.validateDust(); err != nil {
+		return err
+	}
+	if c.DustPullCost <= 0 {
+		c.DustPullCost = 50
+	}
+	if c.DustWallpaperCost <= 0 {
+		c.DustWallpaperCost = 150
+	}
+	if c.DiscordBotToken != "" {
+		key, err := hex.DecodeString(c.DiscordPublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("discord_public_key must be the application's hex-encoded public key when discord_bot_token is set")
+		}
+	}
+	if c.GuildRecheckMinutes == 0 {
+		c.GuildRecheckMinutes = 60 // negative disables re-verification
+	}
+	if c.GuildCacheMinutes == 0 {
+		c.GuildCacheMinutes = 30 // negative checks guilds at every sign-in
+	}
+	if c.ReportHideThreshold == 0 {
+		c.ReportHideThreshold = 3 // negative disables auto-hiding
+	}
+	if c.LinkApprovalThreshold == 0 {
+		c.LinkApprovalThreshold = 100 // negative has every link approved
+	}
+	if c.ImpersonationMinutes == 0 {
+		c.ImpersonationMinutes = 30
+	}
+	if c.ResetTimezone == "" {
+		c.ResetTimezone = "UTC"
+	}
+	loc, err := time.LoadLocation(c.ResetTimezone)
+	if err != nil {
+		return fmt.Errorf("invalid reset_timezone %q: %w", c.ResetTimezone, err)
+	}
+	c.resetLocation = loc
+	if c.DuplicateAction != "reject" && c.DuplicateAction != "flag" && c.DuplicateAction != "off" {
+		return fmt.Errorf("duplicate_action must be one of: reject, flag, off")
+	}
+	if c.MinWidth < 0 || c.MinHeight < 0 {
+		return fmt.Errorf("min_width and min_height must not be negative")
+	}
+	if c.MaxImagePixels == 0 {
+		c.MaxImagePixels = 100_000_000
+	}
+	if c.MaxImagePixels < 0 {
+		return fmt.Errorf("max_image_pixels must not be negative")
+	}
+	if c.AspectRatioTolerance == 0 {
+		c.AspectRatioTolerance = 0.01
+	}
+	if c.AspectRatioTolerance < 0 || c.AspectRatioTolerance >= 1 {
+		return fmt.Errorf("aspect_ratio_tolerance must be between 0 and 1")
+	}
+	c.aspectRatios = nil
+	for _, spec := range c.AllowedAspectRatios {
+		r, err := parseAspectRange(spec)
+		if err != nil {
+			return fmt.Errorf("invalid allowed_aspect_ratios entry %q: %w", spec, err)
+		}
+		c.aspectRatios = append(c.aspectRatios, r)
+	}
+	c.RateLimitAuth.setDefaults(20, 10)
+	c.RateLimitUpload.setDefaults(10, 5)
+	c.RateLimitPull.setDefaults(30, 10)
+	c.RateLimitDownload.setDefaults(2, 2)
+	for i := range c.UploadHooks {
+		h := &c.UploadHooks[i]
+		if h.Stage != "pre_validate" && h.Stage != "post_store" && h.Stage != "pre_approve" {
+			return fmt.Errorf("upload_hooks[%d]: stage must be one of: pre_validate, post_store, pre_approve", i)
+		}
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("upload_hooks[%d]: url must be an http or https URL", i)
+		}
+		if h.TimeoutSeconds <= 0 {
+			h.TimeoutSeconds = 10
+		}
+	}
+	for i := range c.UploadRules {
+		if err := c.UploadRules[i].Validate(); err != nil {
+			return fmt.Errorf("upload_rules[%d]: %w", i, err)
+		}
+	}
+	if c.ContentSafety.URL != "" {
+		if u, err := url.Parse(c.ContentSafety.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("content_safety.url must be an http or https URL")
+		}
+	}
+	if c.ContentSafety.Action == "" {
+		c.ContentSafety.Action = "flag"
+	}
+	if c.ContentSafety.Action != "flag" && c.ContentSafety.Action != "reject" {
+		return fmt.Errorf("content_safety.action must be one of: flag, reject")
+	}
+	if c.ContentSafety.Threshold == 0 {
+		c.ContentSafety.Threshold = 0.8
+	}
+	if c.ContentSafety.Threshold < 0 || c.ContentSafety.Threshold > 1 {
+		return fmt.Errorf("content_safety.threshold must be between 0 and 1")
+	}
+	if c.ContentSafety.TimeoutSeconds <= 0 {
+		c.ContentSafety.TimeoutSeconds = 30
+	}
+	if c.ClamAV.TimeoutSeconds <= 0 {
+		c.ClamAV.TimeoutSeconds = 30
+	}
+	if c.ClamAV.QuarantineDirectory == "" {
+		c.ClamAV.QuarantineDirectory = "./quarantine"
+	}
+	// Files in the upload directory that no upload references are cleaned
+	// up as orphans
+	if within(c.ClamAV.QuarantineDirectory, c.UploadDirectory) {
+		return fmt.Errorf("clamav.quarantine_directory must be outside upload_directory")
+	}
+	if err := c.validateDatabasePool(); err != nil {
+		return err
+	}
+	if err := c.validateBackup(); err != nil {
+		return err
+	}
+	if err := c.validatePoolExport(); err != nil {
+		return err
+	}
+	if err := c.validateRewards(); err != nil {
+		return err
+	}
+	if err := c.validateDiskSpace(); err != nil {
+		return err
+	}
+	if err := c.validateDiscordImport(); err != nil {
+		return err
+	}
+	if err := c.validateTranscode(); err != nil {
+		return err
+	}
+	if err := c.validateImageConverter(); err != nil {
+		return err
+	}
+	if c.QualityCheck.MinScore == 0 {
+		c.QualityCheck.MinScore = 60
+	}
+	if c.QualityCheck.MinScore < 1 || c.QualityCheck.MinScore > 100 {
+		return fmt.Errorf("quality_check.min_score must be between 1 and 100")
+	}
+	if err := c.validateLogins(); err != nil {
+		return err
+	}
+	if c.Tracing.OTLPEndpoint != "" {
+		if u, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing.otlp_endpoint must be an http or https URL")
+		}
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = "wallpaper-gacha"
+	}
+	if c.Tracing.SampleRatio == 0 {
+		c.Tracing.SampleRatio = 1
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+	c.trustedProxies = nil
+	for _, p := range c.TrustedProxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(p)
+			if addrErr != nil {
+				return fmt.Errorf("invalid trusted_proxies entry %q: must be an IP address or CIDR range", p)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		c.trustedProxies = append(c.trustedProxies, prefix.Masked())
+	}
+	if len(c.TLS.Domains) > 0 {
+		if c.DisableTCP {
+			return fmt.Errorf("tls.domains needs the TCP listener; unset disable_tcp")
+		}
+		for i, d := range c.TLS.Domains {
+			d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+			if _, err := netip.ParseAddr(d); err == nil || d == "" || strings.ContainsAny(d, "/:*") {
+				return fmt.Errorf("invalid tls.domains entry %q: must be a DNS name", c.TLS.Domains[i])
+			}
+			c.TLS.Domains[i] = d
+		}
+		if c.TLS.CacheDir == "" {
+			c.TLS.CacheDir = "./certs"
+		}
+		if c.TLS.DirectoryURL == "" {
+			c.TLS.DirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+		}
+		if c.TLS.HTTPPort == 0 {
+			c.TLS.HTTPPort = 80
+		}
+		if c.TLS.HTTPPort < 0 || c.TLS.HTTPPort > 65535 || c.TLS.HTTPPort == c.ServerPort {
+			return fmt.Errorf("tls.http_port must be a port other than server_port")
+		}
+		if c.SecurityHeaders.HSTSMaxAgeSeconds == 0 {
+			c.SecurityHeaders.HSTSMaxAgeSeconds = 365 * 24 * 60 * 60
+		}
+	}
+	if err := c.validateSiteURL(); err != nil {
+		return err
+	}
+	if c.DefaultLocale == "" {
+		c.DefaultLocale = i18n.English
 	}
-	if AppConfig.ServerHost == "" {
-		AppConfig.ServerHost = "localhost"
+	if !i18n.IsSupported(c.DefaultLocale) {
+		return fmt.Errorf("default_locale must be one of: %s", strings.Join(i18n.Supported, ", "))
 	}
-	if AppConfig.UploadCooldownMinutes == 0 {
-		AppConfig.UploadCooldownMinutes = 60
+	if err := c.validateContentURL(); err != nil {
+		return err
 	}
-	if AppConfig.MaxFileSizeMB == 0 {
-		AppConfig.MaxFileSizeMB = 50
+	if err := c.validateSignedURLs(); err != nil {
+		return err
 	}
-	if AppConfig.DatabasePath == "" {
-		AppConfig.DatabasePath = "./wallpaper.db"
+	if err := c.validateCORS(); err != nil {
+		return err
 	}
-	if AppConfig.UploadDirectory == "" {
-		AppConfig.UploadDirectory = "./uploads"
+	if c.Maintenance.Message == "" {
+		c.Maintenance.Message = DefaultMaintenanceMessage
 	}
+	if c.SecurityHeaders.HSTSPreload && (c.SecurityHeaders.HSTSMaxAgeSeconds < 365*24*60*60 || !c.SecurityHeaders.HSTSIncludeSubdomains) {
+		return fmt.Errorf("security_headers.hsts_preload needs hsts_include_subdomains and an hsts_max_age_seconds of at least a year")
+	}
+
+	return nil
+}
+
+// grantedAdmins holds the administrators granted from the command line, in
+// addition to admin_discord_ids
+var grantedAdmins = struct {
+	sync.RWMutex
+	ids map[string]bool
+}{}
+
+// SetGrantedAdmins replaces the set of administrators granted from the
+// command line
+func SetGrantedAdmins(ids []string) {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	grantedAdmins.Lock()
+	grantedAdmins.ids = set
+	grantedAdmins.Unlock()
+}
+
+// IsAdmin reports whether the Discord ID belongs to a configured or granted
+// administrator
+func (c *Config) IsAdmin(discordID string) bool {
+	for _, id := range c.AdminDiscordIDs {
+		if id == discordID {
+			return true
+		}
+	}
+	grantedAdmins.RLock()
+	defer grantedAdmins.RUnlock()
+	return grantedAdmins.ids[discordID]
+}
+
+// DatabaseDSN returns the data source for the configured database driver:
+// the file path for SQLite, the connection URL for PostgreSQL
+func (c *Config) DatabaseDSN() string {
+	if c.DatabaseDriver == "postgres" {
+		return c.DatabaseURL
+	}
+	return c.DatabasePath
+}
+
+// parseAspectRange parses a ratio such as "16:9", or an inclusive range such
+// as "9:21-9:16"
+func parseAspectRange(spec string) (aspectRange, error) {
+	lo, hi, isRange := strings.Cut(spec, "-")
+	min, err := parseAspectRatio(lo)
+	if err != nil {
+		return aspectRange{}, err
+	}
+	max := min
+	if isRange {
+		if max, err = parseAspectRatio(hi); err != nil {
+			return aspectRange{}, err
+		}
+	}
+	if min > max {
+		min, max = max, min
+	}
+	return aspectRange{min: min, max: max}, nil
+}
+
+func parseAspectRatio(s string) (float64, error) {
+	w, h, ok := strings.Cut(strings.TrimSpace(s), ":")
+	width, err1 := strconv.ParseFloat(strings.TrimSpace(w), 64)
+	height, err2 := strconv.ParseFloat(strings.TrimSpace(h), 64)
+	if !ok || err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+		return 0, fmt.Errorf("ratios must be written as width:height, e.g. 16:9")
+	}
+	return width / height, nil
+}
+
+// AspectRatioAllowed reports whether an image of the given size matches one
+// of allowed_aspect_ratios, within aspect_ratio_tolerance. Every ratio is
+// allowed when none are configured.
+func (c *Config) AspectRatioAllowed(width, height int) bool {
+	if len(c.aspectRatios) == 0 {
+		return true
+	}
+	ratio := float64(width) / float64(height)
+	for _, r := range c.aspectRatios {
+		if ratio >= r.min*(1-c.AspectRatioTolerance) && ratio <= r.max*(1+c.AspectRatioTolerance) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxy reports whether addr is a reverse proxy whose X-Forwarded-For
+// header can be believed
+func (c *Config) TrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range c.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetLocation returns the time zone in which daily limits reset
+func (c *Config) ResetLocation() *time.Location {
+	if c.resetLocation == nil {
+		return time.UTC
+	}
+	return c.resetLocation
+}
+
+// WatermarkText returns the text stamped on previews, or "" when watermarking
+// is off
+func (c *Config) WatermarkText() string {
+	if !c.Watermark.Enabled {
+		return ""
+	}
+	return c.Watermark.Text
+}
+
+// defaultUploadFormats are the file extensions uploads may have and the
+// content types each may contain, when upload_formats is not set
+var defaultUploadFormats = map[string][]string{
+	".png":  {"image/png"},
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".jxl":  {"image/jxl"},
+	".webp": {"image/webp"},
+	".avif": {"image/avif"},
+	".heic": {"image/heic"},
+	".heif": {"image/heif", "image/heic"},
+}
+
+// validateUploadFormats fills in upload_formats. Extensions are normalized to
+// lowercase with a leading dot, and a known extension with no content types
+// listed gets its usual ones.
+func (c *Config) validateUploadFormats() error {
+	if len(c.UploadFormats) == 0 {
+		c.UploadFormats = defaultUploadFormats
+		return nil
+	}
+	formats := make(map[string][]string, len(c.UploadFormats))
+	for ext, types := range c.UploadFormats {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if ext == "." {
+			return fmt.Errorf("upload_formats: extensions must not be empty")
+		}
+		if len(types) == 0 {
+			types = defaultUploadFormats[ext]
+		}
+		if len(types) == 0 {
+			return fmt.Errorf("upload_formats: %s needs a list of content types", ext)
+		}
+		formats[ext] = types
+	}
+	c.UploadFormats = formats
+	return nil
+}
+
+// UploadExtensions returns the file extensions uploads may have, sorted
+func (c *Config) UploadExtensions() []string {
+	exts := make([]string, 0, len(c.UploadFormats))
+	for ext := range c.UploadFormats {
+		exts = append(exts, ext)
+	}
+	slices.Sort(exts)
+	return exts
+}
+
+// defaultRarityRates are the chances of drawing each rarity tier, for tiers
+// rarity_rates leaves out
+var defaultRarityRates = map[string]float64{
+	"common":    60,
+	"rare":      30,
+	"epic":      8,
+	"legendary": 2,
+}
+
+// validateRarityRates fills in missing tiers of rarity_rates and checks that
+// at least one tier can be drawn
+func (c *Config) validateRarityRates() error {
+	rates := make(map[string]float64, len(defaultRarityRates))
+	for tier, rate := range defaultRarityRates {
+		rates[tier] = rate
+	}
+	for tier, rate := range c.RarityRates {
+		if _, ok := defaultRarityRates[tier]; !ok {
+			return fmt.Errorf("rarity_rates: unknown rarity %q", tier)
+		}
+		if rate < 0 {
+			return fmt.Errorf("rarity_rates: rate of %s must not be negative", tier)
+		}
+		rates[tier] = rate
+	}
+
+	var total float64
+	for _, rate := range rates {
+		total += rate
+	}
+	if total == 0 {
+		return fmt.Errorf("rarity_rates: at least one rarity needs a rate above 0")
+	}
+	c.RarityRates = rates
+	return nil
+}
+
+// defaultDustRates are the dust a spare copy of each rarity converts into,
+// and defaultDustRarityCosts the dust a pull guaranteed to draw each rarity
+// costs, for tiers dust_rates and dust_rarity_costs leave out
+var (
+	defaultDustRates       = map[string]int{"common": 5, "rare": 15, "epic": 50, "legendary": 150}
+	defaultDustRarityCosts = map[string]int{"common": 25, "rare": 75, "epic": 250, "legendary": 750}
+)
+
+// validateDust fills in missing tiers of dust_rates and dust_rarity_costs
+// and checks them
+func (c *Config) validateDust() error {
+	rates := maps.Clone(defaultDustRates)
+	for tier, rate := range c.DustRates {
+		if _, ok := defaultDustRates[tier]; !ok {
+			return fmt.Errorf("dust_rates: unknown rarity %q", tier)
+		}
+		if rate < 0 {
+			return fmt.Errorf("dust_rates: rate of %s must not be negative", tier)
+		}
+		rates[tier] = rate
+	}
+	c.DustRates = rates
+
+	costs := maps.Clone(defaultDustRarityCosts)
+	for tier, cost := range c.DustRarityCosts {
+		if _, ok := defaultDustRarityCosts[tier]; !ok {
+			return fmt.Errorf("dust_rarity_costs: unknown rarity %q", tier)
+		}
+		if cost < 1 {
+			return fmt.Errorf("dust_rarity_costs: cost of %s must be at least 1", tier)
+		}
+		costs[tier] = cost
+	}
+	c.DustRarityCosts = costs
+	return nil
+}
+
+// rarityRateOverrides holds the rarity rates admins set at runtime, which
+// take precedence over rarity_rates
+var rarityRateOverrides = struct {
+	sync.RWMutex
+	rates map[string]float64
+}{}
+
+// SetRarityRateOverrides replaces the rarity rates set at runtime
+func SetRarityRateOverrides(rates map[string]float64) {
+	rarityRateOverrides.Lock()
+	rarityRateOverrides.rates = maps.Clone(rates)
+	rarityRateOverrides.Unlock()
+}
+
+// EffectiveRarityRates returns rarity_rates with the rates set at runtime
+// applied
+func (c *Config) EffectiveRarityRates() map[string]float64 {
+	rates := maps.Clone(c.RarityRates)
+	rarityRateOverrides.RLock()
+	defer rarityRateOverrides.RUnlock()
+	for tier, rate := range rarityRateOverrides.rates {
+		rates[tier] = rate
+	}
+	return rates
+}
+
+// DefaultMaintenanceMessage is shown during maintenance when neither the
+// config nor the admin who started it gave a message
+const DefaultMaintenanceMessage = "Wallpaper Gacha is down for maintenance and will be back shortly."
+
+// maintenanceOverride holds the maintenance mode admins set at runtime,
+// which takes precedence over maintenance in the config while set
+var maintenanceOverride = struct {
+	sync.RWMutex
+	set     bool
+	enabled bool
+	message string
+}{}
+
+// SetMaintenanceOverride replaces the maintenance mode set at runtime. A nil
+// enabled clears it, going back to the config.
+func SetMaintenanceOverride(enabled *bool, message string) {
+	maintenanceOverride.Lock()
+	defer maintenanceOverride.Unlock()
+	maintenanceOverride.set = enabled != nil
+	maintenanceOverride.enabled = enabled != nil && *enabled
+	maintenanceOverride.message = message
+}
+
+// InMaintenance reports whether the site is in maintenance mode, with the
+// message to show everyone but admins
+func (c *Config) InMaintenance() (bool, string) {
+	maintenanceOverride.RLock()
+	defer maintenanceOverride.RUnlock()
+	if !maintenanceOverride.set {
+		return c.Maintenance.Enabled, c.Maintenance.Message
+	}
+	if maintenanceOverride.message == "" {
+		return maintenanceOverride.enabled, c.Maintenance.Message
+	}
+	return maintenanceOverride.enabled, maintenanceOverride.message
+}
+
+// validateSiteURL checks that site_url is the root of a site, defaulting it
+// to that of discord_redirect_uri, which users must be able to reach
+func (c *Config) validateSiteURL() error {
+	if c.SiteURL == "" {
+		if u, err := url.Parse(c.DiscordRedirectURI); err == nil && u.Host != "" {
+			c.SiteURL = u.Scheme + "://" + u.Host
+		}
+		return nil
+	}
+	u, err := url.Parse(c.SiteURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return fmt.Errorf("site_url must be an http(s) URL without a path, e.g. https://wallpapers.example.com")
+	}
+	c.SiteURL = u.Scheme + "://" + u.Host
+	return nil
+}
+
+// validateContentURL checks that content_url is the root of a site on
+// another host name than the one users sign in to, since cookies are shared
+// between ports of the same host
+func (c *Config) validateContentURL() error {
+	if c.ContentURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.ContentURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return fmt.Errorf("content_url must be an http(s) URL without a path, e.g. https://usercontent.example.com")
+	}
+	if site, err := url.Parse(c.DiscordRedirectURI); err == nil && strings.EqualFold(site.Hostname(), u.Hostname()) {
+		return fmt.Errorf("content_url must be on another host than discord_redirect_uri")
+	}
+	c.ContentURL = u.Scheme + "://" + u.Host
+	c.contentHost = strings.ToLower(u.Hostname())
+	return nil
+}
+
+// ContentHost returns the host name uploaded files are served from, or ""
+// when they are served by the site itself
+func (c *Config) ContentHost() string {
+	return c.contentHost
+}
+
+// validateSignedURLs checks the signed URL settings and fills in defaults
+func (c *Config) validateSignedURLs() error {
+	s := &c.SignedURLs
+	if !s.Enabled {
+		return nil
+	}
+	if s.BaseURL == "" {
+		s.BaseURL = c.ContentURL + "/files"
+	} else if u, err := url.Parse(s.BaseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" {
+		return fmt.Errorf("signed_urls.base_url must be an http(s) URL without a query")
+	}
+	s.BaseURL = strings.TrimSuffix(s.BaseURL, "/")
+	if s.TTLMinutes < 0 {
+		return fmt.Errorf("signed_urls.ttl_minutes must not be negative")
+	}
+	if s.TTLMinutes == 0 {
+		s.TTLMinutes = 60
+	}
+	return nil
+}
+
+// validateCORS checks the CORS settings and fills in defaults
+func (c *Config) validateCORS() error {
+	cors := &c.CORS
+	if len(cors.AllowedOrigins) == 0 {
+		return nil
+	}
+	for i, origin := range cors.AllowedOrigins {
+		if origin == "*" {
+			if cors.AllowCredentials {
+				return fmt.Errorf("cors.allow_credentials can't be combined with the origin \"*\"; list the origins instead")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid cors.allowed_origins entry %q: must be \"*\" or an origin such as https://app.example.com", origin)
+		}
+		cors.AllowedOrigins[i] = strings.ToLower(u.Scheme + "://" + u.Host)
+	}
+	if len(cors.AllowedMethods) == 0 {
+		cors.AllowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	for i, method := range cors.AllowedMethods {
+		cors.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	if cors.MaxAgeSeconds < 0 {
+		return fmt.Errorf("cors.max_age_seconds must not be negative")
+	}
+	if cors.MaxAgeSeconds == 0 {
+		cors.MaxAgeSeconds = 600
+	}
+	return nil
+}
+
+// CORSOrigin returns the value of Access-Control-Allow-Origin for a request
+// from origin, or "" when the origin may not call the API
+func (c *Config) CORSOrigin(origin string) string {
+	for _, allowed := range c.CORS.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// validateDatabasePool checks the connection pool settings and fills in
+// defaults
+func (c *Config) validateDatabasePool() error {
+	p := &c.DatabasePool
+	if p.MaxOpenConns < 0 || p.MaxIdleConns < 0 || p.ConnMaxLifetimeMinutes < 0 || p.BusyTimeoutMS < 0 {
+		return fmt.Errorf("database_pool settings other than query_timeout_seconds must not be negative")
+	}
+	if p.BusyTimeoutMS == 0 {
+		p.BusyTimeoutMS = 5000
+	}
+	if p.QueryTimeoutSeconds == 0 {
+		p.QueryTimeoutSeconds = 30
+	}
+	return nil
+}
+
+// validateBackup checks the backup settings and fills in defaults
+func (c *Config) validateBackup() error {
+	b := &c.Backup
+	if b.IntervalHours < 0 {
+		return fmt.Errorf("backup.interval_hours must not be negative")
+	}
+	if b.IntervalHours > 0 && c.DatabaseDriver != "sqlite" {
+		return fmt.Errorf("backup.interval_hours requires the sqlite database driver")
+	}
+	if b.Directory == "" {
+		b.Directory = "./backups"
+	}
+	// Backups would otherwise contain each other
+	if within(b.Directory, c.UploadDirectory) {
+		return fmt.Errorf("backup.directory must be outside upload_directory")
+	}
+	if b.Keep == 0 {
+		b.Keep = 7
+	}
+
+	return b.S3.validate("backup.s3")
+}
+
+// validatePoolExport checks the pool export settings and fills in defaults
+func (c *Config) validatePoolExport() error {
+	p := &c.PoolExport
+	if p.IntervalHours < 0 {
+		return fmt.Errorf("pool_export.interval_hours must not be negative")
+	}
+	if p.IntervalHours > 0 && c.Watermark.Enabled {
+		return fmt.Errorf("pool_export publishes original files, which watermark keeps to their owners; turn one of them off")
+	}
+	if p.Directory == "" {
+		p.Directory = "./pool-export"
+	}
+	if within(p.Directory, c.UploadDirectory) {
+		return fmt.Errorf("pool_export.directory must be outside upload_directory")
+	}
+	return p.S3.validate("pool_export.s3")
+}
+
+// validateDiscordImport checks the Discord channel import settings and fills
+// in defaults
+func (c *Config) validateDiscordImport() error {
+	d := &c.DiscordImport
+	if d.ChannelID == "" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(d.ChannelID, 10, 64); err != nil {
+		return fmt.Errorf("discord_import.channel_id %q is not a Discord channel ID", d.ChannelID)
+	}
+	if c.DiscordBotToken == "" {
+		return fmt.Errorf("discord_import requires discord_bot_token")
+	}
+	if d.IntervalHours < 0 {
+		return fmt.Errorf("discord_import.interval_hours must not be negative")
+	}
+	if d.IntervalHours == 0 {
+		d.IntervalHours = 1
+	}
+	return nil
+}
+
+// validateRewards checks the rewards and fills in defaults
+func (c *Config) validateRewards() error {
+	rw := &c.Rewards
+	if rw.Upload < 0 || rw.DailyLogin < 0 || rw.LikesReceived < 0 || rw.UploadPulled < 0 {
+		return fmt.Errorf("rewards must not be negative")
+	}
+	if rw.LikesPerReward == 0 {
+		rw.LikesPerReward = 10
+	}
+	if rw.LikesPerReward < 1 {
+		return fmt.Errorf("rewards.likes_per_reward must be at least 1")
+	}
+	if rw.UploadPulledMilestones == nil {
+		rw.UploadPulledMilestones = []int{10, 50, 100}
+	}
+	for i, m := range rw.UploadPulledMilestones {
+		if m < 1 || (i > 0 && m <= rw.UploadPulledMilestones[i-1]) {
+			return fmt.Errorf("rewards.upload_pulled_milestones must be positive and in ascending order")
+		}
+	}
+	return nil
+}
 
+// validateDiskSpace checks the disk space guard and fills in defaults
+func (c *Config) validateDiskSpace() error {
+	d := &c.DiskSpace
+	if d.MinFreeMB == 0 {
+		d.MinFreeMB = 1024
+	}
+	if d.MinFreeMB < 0 {
+		return fmt.Errorf("disk_space.min_free_mb must not be negative")
+	}
+	if d.AlertWebhookURL != "" {
+		if u, err := url.Parse(d.AlertWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("disk_space.alert_webhook_url must be an http or https URL")
+		}
+	}
+	return nil
+}
+
+// validateTranscode checks the transcoding settings and fills in defaults
+func (c *Config) validateTranscode() error {
+	t := &c.Transcode
+	switch t.Format {
+	case "":
+		return nil
+	case "jpeg", "png":
+	case "webp":
+		return fmt.Errorf("transcode.format webp is not supported, as there is no WebP encoder; use jpeg or png")
+	default:
+		return fmt.Errorf("transcode.format must be jpeg or png, not %q", t.Format)
+	}
+	if t.Quality == 0 {
+		t.Quality = 90
+	}
+	if t.Quality < 1 || t.Quality > 100 {
+		return fmt.Errorf("transcode.quality must be between 1 and 100")
+	}
 	return nil
 }
+
+// validateImageConverter checks the image converter settings and fills in
+// defaults
+func (c *Config) validateImageConverter() error {
+	ic := &c.ImageConverter
+	if len(ic.Command) == 0 {
+		if ic.WebP {
+			return fmt.Errorf("image_converter.webp needs image_converter.command")
+		}
+		return nil
+	}
+	if ic.Command[0] == "" {
+		return fmt.Errorf("image_converter.command must start with the program to run")
+	}
+	if !slices.ContainsFunc(ic.Command[1:], func(arg string) bool { return strings.Contains(arg, "{format}") }) {
+		return fmt.Errorf("image_converter.command must say where the output format goes with {format}")
+	}
+	if ic.TimeoutSeconds == 0 {
+		ic.TimeoutSeconds = 60
+	}
+	if ic.TimeoutSeconds < 0 {
+		return fmt.Errorf("image_converter.timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+// validate checks the settings of an S3 bucket, named by the setting holding
+// it, when one is set, and fills in the endpoint
+func (s *S3) validate(setting string) error {
+	if s.Bucket == "" {
+		return nil
+	}
+	if s.Region == "" {
+		return fmt.Errorf("%s.region is required", setting)
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return fmt.Errorf("%s.access_key_id and %s.secret_access_key are required", setting, setting)
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	if u, err := url.Parse(s.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s.endpoint must be an http or https URL", setting)
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	return nil
+}
+
+// validateGuilds moves the guilds listed by the older allowed_server_ids and
+// upload_role_ids settings into guilds, and checks that there is at least
+// one guild. The first of allowed_server_ids, or else the guild with the
+// lowest ID, is the default guild unless default_guild_id says otherwise.
+func (c *Config) validateGuilds() error {
+	for guildID := range c.UploadRoleIDs {
+		if !slices.Contains(c.AllowedServerIDs, guildID) {
+			return fmt.Errorf("upload_role_ids: %s is not one of the allowed_server_ids", guildID)
+		}
+	}
+	if len(c.AllowedServerIDs) > 0 {
+		if c.Guilds == nil {
+			c.Guilds = make(map[string]Guild)
+		}
+		if c.DefaultGuildID == "" {
+			c.DefaultGuildID = c.AllowedServerIDs[0]
+		}
+	}
+	for _, id := range c.AllowedServerIDs {
+		if _, ok := c.Guilds[id]; ok {
+			return fmt.Errorf("guilds: %s is also listed in allowed_server_ids", id)
+		}
+		c.Guilds[id] = Guild{UploadRoleIDs: c.UploadRoleIDs[id]}
+	}
+	c.AllowedServerIDs, c.UploadRoleIDs = nil, nil
+
+	if len(c.Guilds) == 0 {
+		return fmt.Errorf("at least one guild is required")
+	}
+	for id := range c.Guilds {
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return fmt.Errorf("guilds: %q is not a Discord server ID", id)
+		}
+	}
+	if c.DefaultGuildID == "" {
+		ids := make([]string, 0, len(c.Guilds))
+		for id := range c.Guilds {
+			ids = append(ids, id)
+		}
+		c.DefaultGuildID = slices.MinFunc(ids, compareIDs)
+	} else if _, ok := c.Guilds[c.DefaultGuildID]; !ok {
+		return fmt.Errorf("default_guild_id %s is not one of the guilds", c.DefaultGuildID)
+	}
+	return nil
+}
+
+// compareIDs orders Discord IDs numerically
+func compareIDs(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// GuildIDs returns the IDs of the guilds whose members may sign in: the
+// default guild first, then the others in order
+func (c *Config) GuildIDs() []string {
+	ids := make([]string, 0, len(c.Guilds))
+	for id := range c.Guilds {
+		if id != c.DefaultGuildID {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, compareIDs)
+	return append([]string{c.DefaultGuildID}, ids...)
+}
+
+// IsAllowedGuild reports whether the guild is one whose members may sign in
+func (c *Config) IsAllowedGuild(guildID string) bool {
+	_, ok := c.Guilds[guildID]
+	return ok
+}
+
+// GuildName returns the name a guild is shown by, its ID when it has none
+func (c *Config) GuildName(guildID string) string {
+	if name := c.Guilds[guildID].Name; name != "" {
+		return name
+	}
+	return guildID
+}
+
+// UploadRolesConfigured reports whether any guild limits uploading to
+// members with particular roles
+func (c *Config) UploadRolesConfigured() bool {
+	for _, g := range c.Guilds {
+		if len(g.UploadRoleIDs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminCooldownTier is the upload_cooldown_tiers key that applies to admins
+const AdminCooldownTier = "admin"
+
+// RoleCooldownsConfigured reports whether upload_cooldown_tiers gives any
+// Discord role its own upload cooldown
+func (c *Config) RoleCooldownsConfigured() bool {
+	for tier := range c.UploadCooldownTiers {
+		if tier != AdminCooldownTier {
+			return true
+		}
+	}
+	return false
+}
+
+// validateLogins checks the settings of the sign-in providers besides
+// Discord. Organizations and domains are matched case-insensitively.
+func (c *Config) validateLogins() error {
+	if g := &c.GitHubLogin; g.ClientID != "" {
+		if g.ClientSecret == "" || g.RedirectURI == "" {
+			return fmt.Errorf("github_login.client_secret and github_login.redirect_uri are required")
+		}
+		if len(g.Organizations) == 0 {
+			return fmt.Errorf("github_login.organizations must list at least one organization")
+		}
+		for i, org := range g.Organizations {
+			g.Organizations[i] = strings.ToLower(org)
+		}
+	}
+	if g := &c.GoogleLogin; g.ClientID != "" {
+		if g.ClientSecret == "" || g.RedirectURI == "" {
+			return fmt.Errorf("google_login.client_secret and google_login.redirect_uri are required")
+		}
+		if len(g.Domains) == 0 {
+			return fmt.Errorf("google_login.domains must list at least one domain")
+		}
+		for i, domain := range g.Domains {
+			g.Domains[i] = strings.ToLower(strings.TrimPrefix(domain, "@"))
+		}
+	}
+	return nil
+}
+
+// within reports whether dir is parent or inside it
+func within(dir, parent string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// reloadable lists the settings, by their names in the config file, that
+// Reload applies to the running server. The others are read once as the
+// server starts, to open listeners, connections and workers, so changing
+// them takes a restart.
+var reloadable = map[string]bool{
+	// Cooldowns and quotas
+	"upload_cooldown_minutes":    true,
+	"upload_cooldown_tiers":      true,
+	"max_uploads_per_day":        true,
+	"max_storage_mb":             true,
+	"max_file_size_mb":           true,
+	"role_max_file_size_mb":      true,
+	"max_zip_size_mb":            true,
+	"max_collection_download_mb": true,
+	"pulls_per_day":              true,
+	"rerolls_per_day":            true,
+	"max_reroll_tokens":          true,
+	"wishlist_size":              true,
+	"showcase_size":              true,
+	// Upload checks and moderation
+	"min_width":               true,
+	"min_height":              true,
+	"max_image_pixels":        true,
+	"allowed_aspect_ratios":   true,
+	"aspect_ratio_tolerance":  true,
+	"duplicate_hash_distance": true,
+	"duplicate_action":        true,
+	"upload_rules":            true,
+	"report_hide_threshold":   true,
+	"link_approval_threshold": true,
+	"admin_discord_ids":       true,
+	// Drop rates and the economy
+	"rarity_rates":          true,
+	"like_pull_weight":      true,
+	"wishlist_rate_up":      true,
+	"rarity_voting_hours":   true,
+	"rarity_vote_min_votes": true,
+	"trade_offer_hours":     true,
+	"dust_auto_convert":     true,
+	"dust_rates":            true,
+	"dust_rarity_costs":     true,
+	"dust_pull_cost":        true,
+	"dust_wallpaper_cost":   true,
+	"rewards":               true,
+	// Webhooks
+	"webhook_urls":         true,
+	"webhook_secret":       true,
+	"webhook_events":       true,
+	"webhook_max_attempts": true,
+	// The site
+	"maintenance":    true,
+	"link_previews":  true,
+	"default_locale": true,
+	"disk_space":     true,
+}
+
+// ReloadResult lists the settings a reload changed, and those that differ in
+// the file but only take effect after a restart
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+var (
+	// reloadMu keeps reloads from racing each other
+	reloadMu sync.Mutex
+	// source builds the configuration again the way the server was started,
+	// from its file and, in test mode, with the test settings applied
+	source func() (*Config, error)
+)
+
+// Reload reads the configuration file again and applies the settings that
+// can change at runtime. The file is checked as a whole first, so a mistake
+// leaves the running configuration as it was. Those settings are swapped in
+// with the rest of the running configuration as one new Config; code that
+// holds on to AppConfig keeps the settings it started with.
+func Reload() (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if source == nil {
+		return nil, fmt.Errorf("no configuration was loaded")
+	}
+	next, err := source()
+	if err != nil {
+		return nil, err
+	}
+
+	current := AppConfig
+	merged := *current
+	result := &ReloadResult{Changed: []string{}, RestartRequired: []string{}}
+	cur, nxt, out := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem(), reflect.ValueOf(&merged).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || reflect.DeepEqual(cur.Field(i).Interface(), nxt.Field(i).Interface()) {
+			continue
+		}
+		if !reloadable[name] {
+			result.RestartRequired = append(result.RestartRequired, name)
+			continue
+		}
+		out.Field(i).Set(nxt.Field(i))
+		result.Changed = append(result.Changed, name)
+	}
+	// Parsed from allowed_aspect_ratios, which may have changed
+	merged.aspectRatios = next.aspectRatios
+
+	AppConfig = &merged
+	return result, nil
+}
@@ -0,0 +1,343 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// Interaction and response types used by the bot
+const (
+	InteractionPing               = 1
+	InteractionApplicationCommand = 2
+
+	ResponsePong                     = 1
+	ResponseChannelMessage           = 4
+	ResponseDeferredChannelMessage   = 5
+	MessageFlagEphemeral             = 1 << 6
+	commandTypeChatInput             = 1
+	maxInteractionResponseBodyLength = 64 << 10
+)
+
+// Command is a slash command registered for the application
+type Command struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        int    `json:"type"`
+}
+
+// NewCommand returns a slash command with the given name and description
+func NewCommand(name, description string) Command {
+	return Command{Name: name, Description: description, Type: commandTypeChatInput}
+}
+
+// Interaction is an event Discord delivers to the interactions endpoint
+type Interaction struct {
+	ID      string `json:"id"`
+	Type    int    `json:"type"`
+	Token   string `json:"token"`
+	GuildID string `json:"guild_id"`
+	Member  *struct {
+		User User `json:"user"`
+	} `json:"member"`
+	User *User `json:"user"`
+	// Locale is the language the invoking user has picked in Discord
+	Locale string `json:"locale"`
+	Data   struct {
+		Name string `json:"name"`
+	} `json:"data"`
+}
+
+// Invoker returns the user who triggered the interaction, whether it came
+// from a guild or a direct message
+func (i *Interaction) Invoker() *User {
+	if i.Member != nil {
+		return &i.Member.User
+	}
+	return i.User
+}
+
+// Embed is a rich content block in a message
+type Embed struct {
+	Title       string      `json:"title,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Image       *EmbedImage `json:"image,omitempty"`
+	Footer      *EmbedText  `json:"footer,omitempty"`
+}
+
+type EmbedImage struct {
+	URL string `json:"url"`
+}
+
+type EmbedText struct {
+	Text string `json:"text"`
+}
+
+// Message is the content of an interaction response
+type Message struct {
+	Content string  `json:"content,omitempty"`
+	Embeds  []Embed `json:"embeds,omitempty"`
+	Flags   int     `json:"flags,omitempty"`
+}
+
+// File is an attachment uploaded with a message. Embeds refer to it as
+// attachment://<Name>.
+type File struct {
+	Name string
+	Data io.Reader
+}
+
+// RegisterCommands replaces the application's global slash commands
+func RegisterCommands(ctx context.Context, commands []Command) error {
+	body, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s/applications/%s/commands", apiBase, config.AppConfig.DiscordClientID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+config.AppConfig.DiscordBotToken)
+	req.Header.Set("Content-Type", "application/json")
+	return doBot(req, "commands")
+}
+
+// EditInteractionResponse replaces the original response to an interaction,
+// typically one that was deferred, optionally uploading a file with it
+func EditInteractionResponse(ctx context.Context, token string, msg Message, file *File) error {
+	url := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", apiBase, config.AppConfig.DiscordClientID, token)
+
+	payload := struct {
+		Message
+		Attachments []map[string]interface{} `json:"attachments,omitempty"`
+	}{Message: msg}
+	if file != nil {
+		payload.Attachments = []map[string]interface{}{{"id": 0, "filename": file.Name}}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var req *http.Request
+	if file == nil {
+		req, err = http.NewRequestWithContext(ctx, "PATCH", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if err := mw.WriteField("payload_json", string(body)); err != nil {
+			return err
+		}
+		part, err := mw.CreateFormFile("files[0]", file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, file.Data); err != nil {
+			return err
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+
+		req, err = http.NewRequestWithContext(ctx, "PATCH", url, &buf)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+	}
+	return doBot(req, "interaction_response")
+}
+
+// SendDirectMessage has the bot message a user privately. Discord only
+// allows this when the user shares a server with the bot and accepts direct
+// messages from its members.
+func SendDirectMessage(ctx context.Context, userID string, msg Message) error {
+	body, err := json.Marshal(map[string]string{"recipient_id": userID})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", apiBase+"/users/@me/channels", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+config.AppConfig.DiscordBotToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := do(req, "dm_channel")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxInteractionResponseBodyLength))
+		return fmt.Errorf("POST %s failed: %s: %s", req.URL.Path, resp.Status, string(body))
+	}
+	var channel struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&channel); err != nil {
+		return err
+	}
+
+	if body, err = json.Marshal(msg); err != nil {
+		return err
+	}
+	req, err = http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/channels/%s/messages", apiBase, channel.ID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+config.AppConfig.DiscordBotToken)
+	req.Header.Set("Content-Type", "application/json")
+	return doBot(req, "dm_message")
+}
+
+// ExecuteWebhook posts a message to a channel through one of its webhooks,
+// which needs no bot token
+func ExecuteWebhook(ctx context.Context, webhookURL string, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doBot(req, "webhook")
+}
+
+// Channel is a channel of a guild the bot can see
+type Channel struct {
+	ID      string `json:"id"`
+	GuildID string `json:"guild_id"`
+	Name    string `json:"name"`
+}
+
+// ChannelMessage is a message posted to a channel
+type ChannelMessage struct {
+	ID          string       `json:"id"`
+	Author      User         `json:"author"`
+	Content     string       `json:"content"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment is a file attached to a message. URL is signed by Discord and
+// expires, so attachments are downloaded soon after their message is read.
+type Attachment struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+// maxMessagesPerPage is the most messages Discord returns per request
+const maxMessagesPerPage = 100
+
+// GetChannel returns a channel the bot can see
+func GetChannel(ctx context.Context, channelID string) (*Channel, error) {
+	var channel Channel
+	if err := getBot(ctx, "channel", "/channels/"+url.PathEscape(channelID), &channel); err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+	return &channel, nil
+}
+
+// GetChannelMessages returns up to a page of the messages posted to a channel
+// after the one with the given ID, oldest first. After "0" starts from the
+// channel's first message. The bot needs the channel's Read Message History
+// permission, and the Message Content intent to see messages' text and
+// attachments.
+func GetChannelMessages(ctx context.Context, channelID, after string) ([]ChannelMessage, error) {
+	path := fmt.Sprintf("/channels/%s/messages?after=%s&limit=%d", url.PathEscape(channelID), url.QueryEscape(after), maxMessagesPerPage)
+	var messages []ChannelMessage
+	if err := getBot(ctx, "channel_messages", path, &messages); err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	// Discord lists the newest first
+	slices.SortFunc(messages, func(a, b ChannelMessage) int { return compareSnowflakes(a.ID, b.ID) })
+	return messages, nil
+}
+
+// compareSnowflakes orders Discord IDs, which grow over time, numerically
+func compareSnowflakes(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// DownloadAttachment writes an attachment's file to w, failing if it is
+// larger than maxBytes
+func DownloadAttachment(ctx context.Context, a Attachment, w io.Writer, maxBytes int64) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := do(req, "attachment")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s failed: %s", req.URL.Path, resp.Status)
+	}
+
+	n, err := io.Copy(w, io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if n > maxBytes {
+		return fmt.Errorf("file too large (max %d bytes)", maxBytes)
+	}
+	return nil
+}
+
+// getBot fetches path with the bot's token into v. endpoint names the call in
+// metrics.
+func getBot(ctx context.Context, endpoint, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+config.AppConfig.DiscordBotToken)
+
+	resp, err := do(req, endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxInteractionResponseBodyLength))
+		return fmt.Errorf("GET %s failed: %s: %s", req.URL.Path, resp.Status, string(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func doBot(req *http.Request, endpoint string) error {
+	resp, err := do(req, endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxInteractionResponseBodyLength))
+		return fmt.Errorf("%s %s failed: %s: %s", req.Method, req.URL.Path, resp.Status, string(body))
+	}
+	return nil
+}
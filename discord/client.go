@@ -0,0 +1,397 @@
+// Package discord talks to the Discord OAuth and REST APIs on behalf of
+// signed-in users.
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+)
+
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	// GlobalName is the display name the user picked, if any
+	GlobalName string `json:"global_name"`
+	// Avatar is the hash of the user's avatar, empty for the default one
+	Avatar string `json:"avatar"`
+	// Bot is set for bot accounts, such as the authors of messages posted
+	// by other bots
+	Bot bool `json:"bot"`
+}
+
+type Guild struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Member struct {
+	Roles []string `json:"roles"`
+}
+
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// ErrRevoked is returned when Discord no longer honours a refresh token,
+// typically because the user deauthorized the application
+var ErrRevoked = errors.New("discord authorization revoked")
+
+// Base URL of the Discord API, including its OAuth endpoints
+var apiBase = "https://discord.com/api"
+
+var client = &http.Client{Timeout: 15 * time.Second}
+
+// Calls rate limited by Discord, or failing on its side, are retried up to
+// maxAttempts times in all. Rate limited calls wait as long as Discord asks,
+// unless that is longer than maxRetryWait; other failures back off
+// exponentially from initialBackoff.
+const (
+	maxAttempts    = 4
+	initialBackoff = 250 * time.Millisecond
+	maxRetryWait   = 10 * time.Second
+)
+
+var requestDuration = metrics.NewHistogramVec("discord_request_duration_seconds",
+	"Latency of Discord API calls, by endpoint and response status", metrics.DurationBuckets, "endpoint", "status")
+
+var retries = metrics.NewCounterVec("discord_retries_total",
+	"Discord API calls retried, by endpoint and reason", "endpoint", "reason")
+
+// do sends a request to Discord, retrying it when Discord rate limits it or
+// fails. Requests that change something, such as token exchanges, are only
+// retried when rate limited, since Discord may have acted on them otherwise.
+func do(req *http.Request, endpoint string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send(req, endpoint)
+		wait, reason := retryDelay(req, resp, err, attempt)
+		if reason == "" {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		retries.Inc(endpoint, reason)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying a call and why, or ""
+// if it should not be retried
+func retryDelay(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, string) {
+	if attempt >= maxAttempts || req.Context().Err() != nil || (req.Body != nil && req.GetBody == nil) {
+		return 0, ""
+	}
+	delay := initialBackoff << (attempt - 1)
+	delay += rand.N(delay / 2)
+	idempotent := req.Method != http.MethodPost
+
+	switch {
+	case err != nil:
+		if idempotent {
+			return delay, "network"
+		}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		if wait, ok := retryAfter(resp); ok {
+			delay = wait
+		}
+		if delay <= maxRetryWait {
+			return delay, "rate_limited"
+		}
+	case resp.StatusCode >= 500:
+		if idempotent {
+			return delay, "server_error"
+		}
+	}
+	return 0, ""
+}
+
+// retryAfter reads the delay Discord asks for in a rate limited response's
+// Retry-After header, which may have a fractional part
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	secs, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64)
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+// send makes one attempt at a call, recording its latency under endpoint and
+// tracing it as part of the request's context
+func send(req *http.Request, endpoint string) (*http.Response, error) {
+	_, span := tracing.StartSpan(req.Context(), "discord "+endpoint, tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("http.request.method", req.Method)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+	}
+	span.SetError(err)
+	requestDuration.ObserveSince(start, endpoint, status)
+	return resp, err
+}
+
+// UseAPI points OAuth and API calls at another Discord-compatible provider,
+// such as test mode's fake server
+func UseAPI(baseURL string) {
+	apiBase = baseURL
+}
+
+// AuthorizeURL returns the URL users are sent to for signing in, carrying the
+// OAuth state and PKCE challenge. Member roles are only requested when uploads
+// are restricted, file sizes raised or cooldowns set by role.
+func AuthorizeURL(state, challenge string) string {
+	scope := "identify guilds"
+	if config.AppConfig.UploadRolesConfigured() || len(config.AppConfig.RoleMaxFileSizeMB) > 0 || config.AppConfig.RoleCooldownsConfigured() {
+		scope += " guilds.members.read"
+	}
+	return fmt.Sprintf(
+		"%s/oauth2/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=%s&state=%s&code_challenge=%s&code_challenge_method=S256",
+		apiBase,
+		config.AppConfig.DiscordClientID,
+		url.QueryEscape(config.AppConfig.DiscordRedirectURI),
+		url.PathEscape(scope),
+		url.QueryEscape(state),
+		challenge,
+	)
+}
+
+// ExchangeCode trades an authorization code and its PKCE verifier for tokens
+func ExchangeCode(ctx context.Context, code, verifier string) (*Token, error) {
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", config.AppConfig.DiscordRedirectURI)
+	data.Set("code_verifier", verifier)
+	return requestToken(ctx, data)
+}
+
+// RefreshToken trades a refresh token for fresh tokens. Discord rotates
+// refresh tokens, so the returned one replaces the old.
+func RefreshToken(ctx context.Context, refreshToken string) (*Token, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", refreshToken)
+	return requestToken(ctx, data)
+}
+
+func requestToken(ctx context.Context, data url.Values) (*Token, error) {
+	data.Set("client_id", config.AppConfig.DiscordClientID)
+	data.Set("client_secret", config.AppConfig.DiscordClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", apiBase+"/oauth2/token", strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := do(req, "oauth2_token")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusBadRequest && strings.Contains(string(body), "invalid_grant") {
+			return nil, ErrRevoked
+		}
+		return nil, fmt.Errorf("token exchange failed: %s", string(body))
+	}
+
+	var token Token
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// GetUser returns the user the access token belongs to
+func GetUser(ctx context.Context, token string) (*User, error) {
+	var user User
+	if err := get(ctx, token, "user", "/users/@me", &user); err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return &user, nil
+}
+
+// cdnBase is where Discord serves avatars
+const cdnBase = "https://cdn.discordapp.com"
+
+// AvatarURL returns the URL of a user's avatar, or of the default avatar
+// Discord gives users without one. Animated avatars, whose hashes start with
+// a_, are GIFs.
+func AvatarURL(userID, hash string) string {
+	if hash == "" {
+		// Users on the new username system get one of six defaults by ID
+		id, _ := strconv.ParseUint(userID, 10, 64)
+		return fmt.Sprintf("%s/embed/avatars/%d.png", cdnBase, (id>>22)%6)
+	}
+	ext := "png"
+	if strings.HasPrefix(hash, "a_") {
+		ext = "gif"
+	}
+	return fmt.Sprintf("%s/avatars/%s/%s.%s", cdnBase, url.PathEscape(userID), url.PathEscape(hash), ext)
+}
+
+// GetGuilds returns the guilds the access token's user is a member of
+func GetGuilds(ctx context.Context, token string) ([]Guild, error) {
+	var guilds []Guild
+	if err := get(ctx, token, "guilds", "/users/@me/guilds", &guilds); err != nil {
+		return nil, fmt.Errorf("failed to get guilds: %w", err)
+	}
+	return guilds, nil
+}
+
+// GetMember returns the access token's user's membership of a guild
+func GetMember(ctx context.Context, token, guildID string) (*Member, error) {
+	var member Member
+	if err := get(ctx, token, "guild_member", "/users/@me/guilds/"+url.PathEscape(guildID)+"/member", &member); err != nil {
+		return nil, fmt.Errorf("failed to get guild member: %w", err)
+	}
+	return &member, nil
+}
+
+// get fetches path with the user's access token into v. endpoint names the
+// call in metrics.
+func get(ctx context.Context, token, endpoint, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := do(req, endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s", string(body))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// InAllowedGuild reports whether any of the guilds is one of the configured
+// allowed servers
+func InAllowedGuild(guilds []Guild) bool {
+	return len(AllowedGuildIDs(guilds)) > 0
+}
+
+// AllowedGuildIDs returns the IDs of the guilds that are configured allowed
+// servers, in the order of config.GuildIDs
+func AllowedGuildIDs(guilds []Guild) []string {
+	var ids []string
+	for _, id := range config.AppConfig.GuildIDs() {
+		if slices.ContainsFunc(guilds, func(g Guild) bool { return g.ID == id }) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// UploadGuildIDs returns the allowed guilds the user may upload to. Members
+// of a guild without upload roles can always upload to it; in guilds with
+// them they need one of the roles. Guilds whose roles couldn't be looked up
+// are left out, and the error is returned along with the others.
+func UploadGuildIDs(ctx context.Context, token string, guilds []Guild) ([]string, error) {
+	var ids []string
+	var errs []error
+	for _, id := range AllowedGuildIDs(guilds) {
+		roles := config.AppConfig.Guilds[id].UploadRoleIDs
+		if len(roles) == 0 {
+			ids = append(ids, id)
+			continue
+		}
+
+		member, err := GetMember(ctx, token, id)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if slices.ContainsFunc(member.Roles, func(role string) bool { return slices.Contains(roles, role) }) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, errors.Join(errs...)
+}
+
+// MaxFileSizeMB returns the largest file size role_max_file_size_mb gives any
+// of the user's roles in the allowed guilds, or 0 when none of them have one
+func MaxFileSizeMB(ctx context.Context, token string, guilds []Guild) (int, error) {
+	largest := 0
+	for _, guild := range guilds {
+		if !config.AppConfig.IsAllowedGuild(guild.ID) {
+			continue
+		}
+		member, err := GetMember(ctx, token, guild.ID)
+		if err != nil {
+			return 0, err
+		}
+		for _, role := range member.Roles {
+			largest = max(largest, config.AppConfig.RoleMaxFileSizeMB[role])
+		}
+	}
+	return largest, nil
+}
+
+// UploadCooldownMinutes returns the shortest upload cooldown
+// upload_cooldown_tiers gives any of the user's roles in the allowed guilds,
+// and false when none of them have one
+func UploadCooldownMinutes(ctx context.Context, token string, guilds []Guild) (int, bool, error) {
+	shortest, found := 0, false
+	for _, guild := range guilds {
+		if !config.AppConfig.IsAllowedGuild(guild.ID) {
+			continue
+		}
+		member, err := GetMember(ctx, token, guild.ID)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, role := range member.Roles {
+			if minutes, ok := config.AppConfig.UploadCooldownTiers[role]; ok && (!found || minutes < shortest) {
+				shortest, found = minutes, true
+			}
+		}
+	}
+	return shortest, found, nil
+}
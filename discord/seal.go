@@ -0,0 +1,65 @@
+package discord
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// sealCipher derives the cipher protecting stored refresh tokens from a
+// session secret, so a leaked database alone doesn't expose usable tokens
+func sealCipher(secret string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte("wallpaper-gacha refresh token:" + secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealToken encrypts a token for storage with the current session secret
+func SealToken(token string) (string, error) {
+	gcm, err := sealCipher(config.AppConfig.SessionSecret.Current())
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(token), nil)), nil
+}
+
+// OpenToken decrypts a token sealed by SealToken under any of the configured
+// session secrets. It fails if the secret it was sealed with has been removed.
+func OpenToken(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	err = errors.New("no session secret configured")
+	for _, secret := range config.AppConfig.SessionSecret {
+		var gcm cipher.AEAD
+		gcm, err = sealCipher(secret)
+		if err != nil {
+			return "", err
+		}
+		if len(data) < gcm.NonceSize() {
+			return "", errors.New("sealed token too short")
+		}
+
+		var plain []byte
+		plain, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		if err == nil {
+			return string(plain), nil
+		}
+	}
+	return "", err
+}
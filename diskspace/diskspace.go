@@ -0,0 +1,174 @@
+// Package diskspace watches the free space of the volumes the server writes
+// uploads and the SQLite database to. Running a disk out of space can
+// corrupt the database, so while a volume is below disk_space.min_free_mb
+// new uploads are refused, and operators are alerted through a Discord
+// webhook when that starts and ends.
+package diskspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+)
+
+const (
+	// How long a check is relied on before requests check again
+	maxAge = 10 * time.Second
+	// How long posting an alert may take, retries included
+	alertTimeout = 30 * time.Second
+)
+
+var (
+	freeBytes = metrics.NewGaugeVec("disk_free_bytes",
+		"Free space on the volumes holding uploads and the database, in bytes", "volume")
+	totalBytes = metrics.NewGaugeVec("disk_total_bytes",
+		"Size of the volumes holding uploads and the database, in bytes", "volume")
+	lowVolumes = metrics.NewGaugeVec("disk_low",
+		"1 while a volume has less free space than disk_space.min_free_mb, otherwise 0", "volume")
+)
+
+// Volume is the free space of a volume the server writes to when it was last
+// checked. Low is set while it has less than MinFreeBytes free.
+type Volume struct {
+	Name         string    `json:"name"`
+	FreeBytes    uint64    `json:"free_bytes"`
+	TotalBytes   uint64    `json:"total_bytes"`
+	MinFreeBytes uint64    `json:"min_free_bytes"`
+	Low          bool      `json:"low"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+var (
+	mu        sync.Mutex
+	volumes   []Volume
+	checkedAt time.Time
+	// low names the volumes last found low, so alerts go out only when that
+	// changes
+	low         string
+	unsupported sync.Once
+)
+
+// paths returns the directories to check by the name of their volume: the
+// upload directory, and the directory of the SQLite database unless it is
+// held in memory
+func paths() map[string]string {
+	cfg := config.AppConfig
+	p := map[string]string{"uploads": cfg.UploadDirectory}
+	if cfg.DatabaseDriver == "sqlite" {
+		path, _, _ := strings.Cut(strings.TrimPrefix(cfg.DatabasePath, "file:"), "?")
+		if path != "" && path != ":memory:" {
+			p["database"] = filepath.Dir(path)
+		}
+	}
+	return p
+}
+
+// Check measures the free space of each volume now, updates the metrics and
+// alerts if the set of low volumes changed. Volumes that can't be measured
+// are left out and logged.
+func Check() []Volume {
+	minFree := uint64(config.AppConfig.DiskSpace.MinFreeMB) << 20
+	now := time.Now().UTC()
+
+	dirs := paths()
+	var checked []Volume
+	var lowNames []string
+	for _, name := range []string{"uploads", "database"} {
+		path, ok := dirs[name]
+		if !ok {
+			continue
+		}
+		free, total, err := freeSpace(path)
+		if errors.Is(err, errors.ErrUnsupported) {
+			unsupported.Do(func() {
+				log.Printf("Disk space: free space can't be measured on this platform, so uploads are never refused for it")
+			})
+			break
+		} else if err != nil {
+			log.Printf("Disk space: failed to measure %s volume at %s: %v", name, path, err)
+			continue
+		}
+		v := Volume{Name: name, FreeBytes: free, TotalBytes: total, MinFreeBytes: minFree, Low: free < minFree, CheckedAt: now}
+		checked = append(checked, v)
+
+		freeBytes.Set(float64(free), name)
+		totalBytes.Set(float64(total), name)
+		if v.Low {
+			lowVolumes.Set(1, name)
+			lowNames = append(lowNames, name)
+		} else {
+			lowVolumes.Set(0, name)
+		}
+	}
+
+	current := strings.Join(lowNames, ", ")
+	mu.Lock()
+	volumes, checkedAt = checked, now
+	changed := current != low
+	low = current
+	mu.Unlock()
+
+	if changed {
+		alert(checked, current)
+	}
+	return checked
+}
+
+// Status returns the volumes as last checked, checking again if that was
+// more than a few seconds ago
+func Status() []Volume {
+	mu.Lock()
+	fresh := time.Since(checkedAt) < maxAge
+	current := volumes
+	mu.Unlock()
+	if fresh {
+		return current
+	}
+	return Check()
+}
+
+// Low reports whether any volume is below the configured free space
+func Low() bool {
+	for _, v := range Status() {
+		if v.Low {
+			return true
+		}
+	}
+	return false
+}
+
+// alert logs that the low volumes changed to low, empty once all recovered,
+// and posts it to the alert webhook if one is configured
+func alert(checked []Volume, low string) {
+	var message string
+	if low == "" {
+		message = "Disk space recovered; uploads are accepted again."
+	} else {
+		message = fmt.Sprintf("Disk space is low (%s), so uploads are refused until space is freed.", low)
+	}
+	for _, v := range checked {
+		message += fmt.Sprintf("\n%s: %d MB free of %d MB (minimum %d MB)", v.Name, v.FreeBytes>>20, v.TotalBytes>>20, v.MinFreeBytes>>20)
+	}
+	log.Printf("Disk space: %s", message)
+
+	url := config.AppConfig.DiskSpace.AlertWebhookURL
+	if url == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+		defer cancel()
+		if err := discord.ExecuteWebhook(ctx, url, discord.Message{Content: message}); err != nil {
+			log.Printf("Disk space: failed to post alert: %v", err)
+		}
+	}()
+}
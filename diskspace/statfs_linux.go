@@ -0,0 +1,13 @@
+package diskspace
+
+import "syscall"
+
+// freeSpace returns the bytes available to the server on the volume holding
+// path, and the size of the volume
+func freeSpace(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package diskspace
+
+import "errors"
+
+// freeSpace is unavailable where volumes can't be measured
+func freeSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
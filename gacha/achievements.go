@@ -0,0 +1,156 @@
+package gacha
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// A tag only counts as a completed collection once it is on at least this
+// many pullable wallpapers
+const minTagCollection = 3
+
+// Achievement is a milestone that grants reroll tokens the first time a user
+// reaches it. It is reached once the user's Metric counter hits Goal.
+type Achievement struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Rerolls     int    `json:"rerolls"`
+	Metric      string `json:"metric"`
+	Goal        int    `json:"goal"`
+}
+
+// achievementMetrics reads each counter an achievement can be measured
+// against. Pulls don't include rerolls, trades or dust exchanges.
+var achievementMetrics = map[string]func(models.AchievementCounters) int{
+	"pulls":          func(c models.AchievementCounters) int { return c.Pulls },
+	"collected":      func(c models.AchievementCounters) int { return c.Collected },
+	"uploads":        func(c models.AchievementCounters) int { return c.Uploads },
+	"completed_tags": func(c models.AchievementCounters) int { return c.CompletedTags },
+}
+
+//go:embed achievements.json
+var achievementsJSON []byte
+
+// Achievements lists every achievement, as defined in achievements.json.
+// Keys are stored in the reroll ledger, so they must not change.
+var Achievements = loadAchievements()
+
+func loadAchievements() []Achievement {
+	var list []Achievement
+	if err := json.Unmarshal(achievementsJSON, &list); err != nil {
+		panic("gacha: invalid achievements.json: " + err.Error())
+	}
+	for _, a := range list {
+		if _, ok := achievementMetrics[a.Metric]; !ok || a.Key == "" || a.Goal < 1 {
+			panic(fmt.Sprintf("gacha: invalid achievement %q in achievements.json", a.Key))
+		}
+	}
+	return list
+}
+
+// UnlockedAchievement is an achievement together with when the user reached
+// it and how far along they are; UnlockedAt is zero for achievements still
+// locked
+type UnlockedAchievement struct {
+	Achievement
+	UnlockedAt time.Time
+	Progress   int
+}
+
+// UserAchievements returns every achievement, whether the user has unlocked
+// it and their progress towards it
+func UserAchievements(ctx context.Context, user *models.User) ([]UnlockedAchievement, error) {
+	unlocked, err := models.UnlockedAchievements(ctx, user.DiscordID)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := models.GetAchievementCounters(ctx, user.DiscordID, minTagCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]UnlockedAchievement, len(Achievements))
+	for i, a := range Achievements {
+		list[i] = UnlockedAchievement{Achievement: a, UnlockedAt: unlocked[a.Key], Progress: min(achievementMetrics[a.Metric](counters), a.Goal)}
+		if !list[i].UnlockedAt.IsZero() {
+			// Counters can drop after the fact, e.g. when uploads are deleted
+			list[i].Progress = a.Goal
+		}
+	}
+	return list, nil
+}
+
+// awardAchievements grants any achievements the user has newly reached and
+// returns them. The event that reached them has already happened, so
+// failures are logged rather than returned.
+func awardAchievements(ctx context.Context, user *models.User) []Achievement {
+	counters, err := models.GetAchievementCounters(ctx, user.DiscordID, minTagCollection)
+	if err != nil {
+		log.Printf("Failed to check achievements for user %s: %v", user.DiscordID, err)
+		return nil
+	}
+
+	unlocked, err := models.UnlockedAchievements(ctx, user.DiscordID)
+	if err != nil {
+		log.Printf("Failed to check achievements for user %s: %v", user.DiscordID, err)
+		return nil
+	}
+
+	var awarded []Achievement
+	for _, a := range Achievements {
+		if _, ok := unlocked[a.Key]; ok || achievementMetrics[a.Metric](counters) < a.Goal {
+			continue
+		}
+		granted, err := models.GrantAchievement(ctx, user.DiscordID, a.Key, a.Rerolls, config.AppConfig.MaxRerollTokens)
+		if err != nil {
+			log.Printf("Failed to grant achievement %s to user %s: %v", a.Key, user.DiscordID, err)
+			continue
+		}
+		if granted {
+			log.Printf("User %s (ID: %s) unlocked achievement %s", user.Username, user.DiscordID, a.Key)
+			awarded = append(awarded, a)
+		}
+	}
+	return awarded
+}
+
+// How many users can wait for an achievement check before more are dropped
+const achievementQueueSize = 256
+
+var achievementChecks = make(chan string, achievementQueueSize)
+
+// QueueAchievementCheck asks for the user's achievements to be evaluated in
+// the background, after an event such as an upload or a trade that may have
+// reached one. Pulls award theirs straight away so the response can list
+// them. If the queue is full the check is dropped; the next event catches up.
+func QueueAchievementCheck(discordID string) {
+	select {
+	case achievementChecks <- discordID:
+	default:
+		log.Printf("Achievements: queue full, skipped check for user %s", discordID)
+	}
+}
+
+// AchievementChecks returns the queue of users waiting for an achievement
+// check, for the background worker to drain
+func AchievementChecks() <-chan string {
+	return achievementChecks
+}
+
+// CheckAchievements grants any achievements the user has newly reached
+func CheckAchievements(ctx context.Context, discordID string) error {
+	user, err := models.GetUser(ctx, discordID)
+	if err != nil {
+		return err
+	}
+	awardAchievements(ctx, user)
+	return nil
+}
@@ -0,0 +1,61 @@
+package gacha
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// ErrNotInPool is returned when exchanging dust for a wallpaper that can't
+// be pulled
+var ErrNotInPool = errors.New("wallpaper is not in the pull pool")
+
+// ExchangeDust spends the user's dust on a wallpaper from the guild's pool
+// they don't own yet. With uploadID zero it draws one at random, for
+// dust_pull_cost, or from the given rarity, for its dust_rarity_costs;
+// otherwise it buys that wallpaper for dust_wallpaper_cost. It returns
+// ErrEmptyPool when the user already owns every wallpaper there is to draw,
+// ErrNotInPool for a wallpaper that can't be pulled in the guild, and
+// models.ErrAlreadyOwned or models.ErrNotEnoughDust when the exchange is
+// not allowed.
+func ExchangeDust(ctx context.Context, user *models.User, guildID string, uploadID int64, rarity string) (*Result, error) {
+	var upload *models.Upload
+	var d *models.Draw
+	var err error
+	cost, reason := config.AppConfig.DustPullCost, models.DustPull
+	if uploadID == 0 {
+		weights := poolWeights(user, guildID)
+		if rarity != "" {
+			cost, reason = config.AppConfig.DustRarityCosts[rarity], models.DustRarity
+			weights.RarityRates = map[string]float64{rarity: 1}
+		}
+		owned, err := models.OwnedUploadIDs(ctx, user.DiscordID)
+		if err != nil {
+			return nil, err
+		}
+		upload, d, err = draw(ctx, user, weights, owned...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cost, reason = config.AppConfig.DustWallpaperCost, models.DustWallpaper
+		upload, err = models.GetPoolUpload(ctx, uploadID, guildID)
+		if err == sql.ErrNoRows {
+			return nil, ErrNotInPool
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	pull, err := models.ExchangeDust(ctx, user.DiscordID, upload.ID, cost, reason)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		recordDraw(ctx, pull, d)
+	}
+	return result(ctx, user, pull, upload)
+}
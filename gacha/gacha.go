@@ -0,0 +1,319 @@
+// Package gacha draws random wallpapers for users. The web app and the
+// Discord bot both pull through it, so they share one daily allowance and one
+// collection per user. Each guild has its own pool; a user in several guilds
+// pulls from the one they are browsing, into the same collection.
+package gacha
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/live"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+)
+
+var (
+	// ErrNoPullsLeft is returned when the user has used today's pulls
+	ErrNoPullsLeft = errors.New("no pulls left today")
+	// ErrEmptyPool is returned when there are no wallpapers to draw from
+	ErrEmptyPool = errors.New("there are no wallpapers to pull yet")
+	// ErrPullNotFound is returned when rerolling a pull the user doesn't have
+	ErrPullNotFound = errors.New("pull not found")
+)
+
+// Allowance describes how many pulls a user has left today. Limit and
+// Remaining are -1 when pulls are unlimited. Bonus pulls granted by admins
+// are spent once the day's pulls are used up.
+type Allowance struct {
+	Used      int
+	Limit     int
+	Remaining int
+	Bonus     int
+	ResetsAt  time.Time
+}
+
+// Wallet describes a user's reroll tokens. PerDay and RemainingToday are -1
+// when rerolls are not limited per day.
+type Wallet struct {
+	Balance        int
+	Max            int
+	UsedToday      int
+	PerDay         int
+	RemainingToday int
+}
+
+// Result is a completed pull and the wallpaper it drew, along with any
+// achievements it unlocked
+type Result struct {
+	Pull      *models.Pull
+	Upload    *models.Upload
+	Allowance Allowance
+	Unlocked  []Achievement
+}
+
+// poolWeights limits draws to the guild's pool and sets how likely each
+// rarity tier is and how much likes and the user's wishlist raise a
+// wallpaper's chance of being drawn for them
+func poolWeights(user *models.User, guildID string) models.PoolWeights {
+	return models.PoolWeights{
+		Guild:          guildID,
+		Like:           max(config.AppConfig.LikePullWeight, 0),
+		Wishlist:       user.DiscordID,
+		WishlistRateUp: max(config.AppConfig.WishlistRateUp, 1),
+		RarityRates:    config.AppConfig.EffectiveRarityRates(),
+	}
+}
+
+// duplicateDust returns the dust a duplicate of the upload is converted into
+// when it is pulled, or zero to keep it, as it is unless dust_auto_convert
+// is set
+func duplicateDust(upload *models.Upload) int {
+	if !config.AppConfig.DustAutoConvert {
+		return 0
+	}
+	return config.AppConfig.DustRates[upload.Rarity]
+}
+
+// window returns the user's current daily window
+func window(user *models.User) (time.Time, time.Time) {
+	return models.DailyWindow(time.Now(), user.ResetLocation(config.AppConfig.ResetLocation()))
+}
+
+// PullAllowance returns the user's pull allowance for today
+func PullAllowance(ctx context.Context, user *models.User) (Allowance, error) {
+	start, end := window(user)
+	used, err := models.CountPullsSince(ctx, user.DiscordID, start)
+	if err != nil {
+		return Allowance{}, err
+	}
+
+	bonus, err := models.WalletBalance(ctx, user.DiscordID)
+	if err != nil {
+		return Allowance{}, err
+	}
+
+	a := Allowance{Used: used, Limit: config.AppConfig.PullsPerDay, Remaining: -1, Bonus: bonus, ResetsAt: end}
+	if a.Limit >= 0 {
+		a.Remaining = max(a.Limit-used, 0)
+	}
+	return a, nil
+}
+
+// Pull draws a random wallpaper from the guild's pool for the user and adds
+// it to their collection. A pull on a banner, which must be one of the
+// guild's, draws the wallpapers it features more often; with a nil banner it
+// draws from the standard pool, or with archive set from the archive pool of
+// out-of-season wallpapers. A non-empty deviceClass only draws wallpapers of
+// that class (see models.DeviceClass). It returns ErrNoPullsLeft once the
+// daily allowance and bonus pulls are used up and ErrEmptyPool when there is
+// nothing to draw.
+func Pull(ctx context.Context, user *models.User, guildID, source string, banner *models.Banner, archive bool, deviceClass string) (*Result, error) {
+	return drawPull(ctx, user, guildID, source, banner, archive, deviceClass, time.Time{})
+}
+
+// StartPull makes a pull like Pull that is held back for the user to reveal
+// until revealAt: it stays out of their pull history and collection and isn't
+// announced on the live feed, or as a legendary pull, until Reveal is called
+// for it or AnnounceDuePulls finds revealAt has passed. It counts towards the
+// allowance, achievements and stats straight away.
+func StartPull(ctx context.Context, user *models.User, guildID, source string, banner *models.Banner, archive bool, deviceClass string, revealAt time.Time) (*Result, error) {
+	return drawPull(ctx, user, guildID, source, banner, archive, deviceClass, revealAt)
+}
+
+// drawPull makes a pull for Pull and StartPull, holding it back until
+// revealAt unless that is zero
+func drawPull(ctx context.Context, user *models.User, guildID, source string, banner *models.Banner, archive bool, deviceClass string, revealAt time.Time) (*Result, error) {
+	start, _ := window(user)
+
+	weights := poolWeights(user, guildID)
+	weights.Archive = archive
+	weights.DeviceClass = deviceClass
+	pull := &models.Pull{DiscordID: user.DiscordID, Source: source}
+	if !revealAt.IsZero() {
+		pull.RevealAt = sql.NullTime{Time: revealAt, Valid: true}
+	}
+	if banner != nil {
+		weights.Banner, weights.BannerRateUp = banner.ID, banner.RateUp
+		pull.BannerID = sql.NullInt64{Int64: banner.ID, Valid: true}
+	}
+	upload, d, err := draw(ctx, user, weights)
+	if err != nil {
+		return nil, err
+	}
+
+	pull.UploadID = upload.ID
+	if err := models.CreatePull(ctx, pull, start, config.AppConfig.PullsPerDay, duplicateDust(upload)); err == sql.ErrNoRows {
+		return nil, ErrNoPullsLeft
+	} else if err != nil {
+		return nil, err
+	}
+	recordDraw(ctx, pull, d)
+
+	return result(ctx, user, pull, upload)
+}
+
+// draw takes the user's next draw under today's seed and draws an upload
+// from the pool with it, leaving out the excluded ones. It returns
+// ErrEmptyPool when there is nothing to draw.
+func draw(ctx context.Context, user *models.User, w models.PoolWeights, exclude ...int64) (*models.Upload, *models.Draw, error) {
+	d, err := models.NewDraw(ctx, user.DiscordID)
+	if err != nil {
+		return nil, nil, err
+	}
+	upload, err := models.RandomPoolUpload(ctx, w, d, exclude...)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrEmptyPool
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return upload, d, nil
+}
+
+// recordDraw keeps the draw behind a pull so the user can verify it. The
+// pull stands either way, so failures are only logged.
+func recordDraw(ctx context.Context, pull *models.Pull, d *models.Draw) {
+	if err := models.RecordDraw(ctx, pull.ID, d); err != nil {
+		log.Printf("Failed to record the draw behind pull %d: %v", pull.ID, err)
+	}
+}
+
+var pullsTotal = metrics.NewCounterVec("gacha_pulls_total",
+	"Wallpapers pulled, by where the pull was made, whether it was a duplicate and rarity", "source", "outcome", "rarity")
+
+func result(ctx context.Context, user *models.User, pull *models.Pull, upload *models.Upload) (*Result, error) {
+	outcome := "new"
+	if pull.Duplicate {
+		outcome = "duplicate"
+	}
+	pullsTotal.Inc(pull.Source, outcome, upload.Rarity)
+	if !pull.RevealAt.Valid {
+		announcePull(user, pull, upload)
+	}
+
+	if pull.Source != models.PullSourceDust {
+		rewardUploadPulled(ctx, upload)
+	}
+
+	unlocked := awardAchievements(ctx, user)
+	allowance, err := PullAllowance(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Pull: pull, Upload: upload, Allowance: allowance, Unlocked: unlocked}, nil
+}
+
+// announcePull publishes a new wallpaper pulled to the live feed and tells
+// the user, and the webhooks, about legendary ones
+func announcePull(user *models.User, pull *models.Pull, upload *models.Upload) {
+	if !pull.Duplicate {
+		publishPull(user, pull, upload)
+	}
+	// Wallpapers bought with dust were paid for rather than pulled
+	if upload.Rarity == models.RarityLegendary && pull.Source != models.PullSourceDust {
+		notify.LegendaryPull(user.DiscordID, upload)
+		webhooks.Notify(webhooks.EventPullLegendary, newPullEvent(user, pull, upload, !user.ProfilePrivate))
+	}
+}
+
+// pullEvent is the live feed's view of a pull. The user is left out for
+// viewers other than them and admins when their profile is private.
+type pullEvent struct {
+	PullID    int64  `json:"pull_id"`
+	DiscordID string `json:"discord_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	UploadID  int64  `json:"upload_id"`
+	Title     string `json:"title"`
+	Source    string `json:"source"`
+	BannerID  *int64 `json:"banner_id,omitempty"`
+}
+
+// newPullEvent returns the public view of a pull, naming the user only when
+// withUser is set
+func newPullEvent(user *models.User, pull *models.Pull, upload *models.Upload, withUser bool) pullEvent {
+	event := pullEvent{PullID: pull.ID, UploadID: upload.ID, Title: upload.Title, Source: pull.Source}
+	if pull.BannerID.Valid {
+		event.BannerID = &pull.BannerID.Int64
+	}
+	if withUser {
+		event.DiscordID, event.Username = user.DiscordID, user.Username
+	}
+	return event
+}
+
+// publishPull announces a pull that found a wallpaper new to the user on
+// the live feed
+func publishPull(user *models.User, pull *models.Pull, upload *models.Upload) {
+	event := newPullEvent(user, pull, upload, true)
+	if user.ProfilePrivate {
+		live.PublishPrivate(upload.GuildID, live.EventPullCreated, user.DiscordID, event, newPullEvent(user, pull, upload, false))
+	} else {
+		live.Publish(upload.GuildID, live.EventPullCreated, event)
+	}
+}
+
+// RerollWallet returns the user's reroll tokens and today's reroll usage
+func RerollWallet(ctx context.Context, user *models.User) (Wallet, error) {
+	balance, err := models.RerollBalance(ctx, user.DiscordID)
+	if err != nil {
+		return Wallet{}, err
+	}
+	start, _ := window(user)
+	used, err := models.CountRerollsSince(ctx, user.DiscordID, start)
+	if err != nil {
+		return Wallet{}, err
+	}
+
+	w := Wallet{Balance: balance, Max: config.AppConfig.MaxRerollTokens, UsedToday: used, PerDay: config.AppConfig.RerollsPerDay, RemainingToday: -1}
+	if w.PerDay >= 0 {
+		w.RemainingToday = max(w.PerDay-used, 0)
+	}
+	return w, nil
+}
+
+// Reroll spends a reroll token to discard one of the user's duplicate pulls
+// and draw a different wallpaper in its place, from the pool of the guild
+// the discarded one belongs to. The redraw does not use up a daily pull and
+// cannot itself be rerolled. It returns ErrPullNotFound, ErrEmptyPool, or
+// models.ErrNotRerollable, models.ErrNoRerolls or models.ErrRerollLimit when
+// the reroll is not allowed.
+func Reroll(ctx context.Context, user *models.User, pullID int64) (*Result, error) {
+	old, err := models.GetPull(ctx, pullID, user.DiscordID)
+	if err == sql.ErrNoRows {
+		return nil, ErrPullNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !old.Duplicate || old.Discarded || old.Source == models.PullSourceReroll {
+		return nil, models.ErrNotRerollable
+	}
+
+	discarded, err := models.GetUpload(ctx, old.UploadID)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrNotRerollable
+	} else if err != nil {
+		return nil, err
+	}
+
+	upload, d, err := draw(ctx, user, poolWeights(user, discarded.GuildID), old.UploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	start, _ := window(user)
+	pull, err := models.RerollPull(ctx, user.DiscordID, pullID, upload.ID, start, config.AppConfig.RerollsPerDay, duplicateDust(upload))
+	if err == sql.ErrNoRows {
+		return nil, ErrPullNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	recordDraw(ctx, pull, d)
+
+	return result(ctx, user, pull, upload)
+}
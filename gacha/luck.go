@@ -0,0 +1,66 @@
+package gacha
+
+import (
+	"context"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Luck summarises how a user's random draws have turned out. Draws are pulls
+// and rerolls; wallpapers received in trades or bought with dust aren't left
+// to chance and only count in BySource. ExpectedNew is how many draws would
+// on average have found a wallpaper the user didn't own yet, estimated as if
+// every wallpaper in today's pools, those of every guild, were equally likely, and Luck is New
+// divided by it: above 1 is luckier than average.
+type Luck struct {
+	Pulls       int
+	Draws       int
+	New         int
+	Duplicates  int
+	ExpectedNew float64
+	Luck        float64
+	PoolSize    int
+	BySource    map[string]int
+	ByBanner    map[int64]int
+}
+
+// PullLuck works out the user's luck across every pull they have made
+func PullLuck(ctx context.Context, user *models.User) (Luck, error) {
+	outcomes, err := models.ListPullOutcomes(ctx, user.DiscordID)
+	if err != nil {
+		return Luck{}, err
+	}
+	pool, err := models.CountPoolUploads(ctx, "")
+	if err != nil {
+		return Luck{}, err
+	}
+
+	l := Luck{Pulls: len(outcomes), PoolSize: pool, BySource: map[string]int{}, ByBanner: map[int64]int{}}
+	owned := 0
+	for _, o := range outcomes {
+		l.BySource[o.Source]++
+		if o.BannerID != 0 {
+			l.ByBanner[o.BannerID]++
+		}
+
+		switch o.Source {
+		case models.PullSourceWeb, models.PullSourceDiscord, models.PullSourceReroll:
+			l.Draws++
+			if pool > 0 {
+				l.ExpectedNew += float64(max(pool-owned, 0)) / float64(pool)
+			}
+			if o.Duplicate {
+				l.Duplicates++
+			} else {
+				l.New++
+			}
+		}
+		if !o.Duplicate {
+			owned++
+		}
+	}
+	if l.ExpectedNew > 0 {
+		l.Luck = float64(l.New) / l.ExpectedNew
+	}
+	return l, nil
+}
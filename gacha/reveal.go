@@ -0,0 +1,164 @@
+package gacha
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// ErrInvalidRevealToken is returned for reveal tokens that weren't issued to
+// the user or have expired
+var ErrInvalidRevealToken = errors.New("invalid or expired reveal token")
+
+// RevealTokenLifetime is how long a pull can be revealed after it was made.
+// The pull counts whether or not it is revealed; one that isn't is announced
+// and joins the pull history once the token expires.
+const RevealTokenLifetime = time.Hour
+
+// revealClaims is what a reveal token vouches for: the pull, its owner, when
+// the token expires and the achievements the pull unlocked
+type revealClaims struct {
+	PullID    int64    `json:"p"`
+	DiscordID string   `json:"u"`
+	Expires   int64    `json:"e"`
+	Unlocked  []string `json:"a,omitempty"`
+}
+
+// RevealToken returns a token that lets the user who made a pull reveal it
+// until expires. Clients see only an opaque string; the wallpaper isn't in
+// it.
+func RevealToken(result *Result, expires time.Time) string {
+	claims := revealClaims{PullID: result.Pull.ID, DiscordID: result.Pull.DiscordID, Expires: expires.Unix()}
+	for _, a := range result.Unlocked {
+		claims.Unlocked = append(claims.Unlocked, a.Key)
+	}
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + revealSignature(config.AppConfig.SessionSecret.Current(), encoded)
+}
+
+// Reveal returns the pull a reveal token was issued for, as it was when the
+// pull was made apart from the allowance, which is current. The first reveal
+// of a pull held back by StartPull announces it. It returns
+// ErrInvalidRevealToken for tokens of other users, expired ones and ones
+// whose pull no longer exists.
+func Reveal(ctx context.Context, user *models.User, token string) (*Result, error) {
+	claims, ok := verifyRevealToken(token)
+	if !ok || claims.DiscordID != user.DiscordID {
+		return nil, ErrInvalidRevealToken
+	}
+
+	pull, err := models.GetPull(ctx, claims.PullID, user.DiscordID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRevealToken
+	} else if err != nil {
+		return nil, err
+	}
+	upload, err := models.GetUpload(ctx, pull.UploadID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRevealToken
+	} else if err != nil {
+		return nil, err
+	}
+	if claimed, err := models.ClaimPullReveal(ctx, pull.ID); err != nil {
+		return nil, err
+	} else if claimed {
+		announcePull(user, pull, upload)
+	}
+	allowance, err := PullAllowance(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var unlocked []Achievement
+	for _, a := range Achievements {
+		if slices.Contains(claims.Unlocked, a.Key) {
+			unlocked = append(unlocked, a)
+		}
+	}
+	return &Result{Pull: pull, Upload: upload, Allowance: allowance, Unlocked: unlocked}, nil
+}
+
+// AnnounceDuePulls announces the pulls held back by StartPull that weren't
+// revealed before their reveal time, and lets them into the pull history.
+// Pulls whose user or wallpaper is gone are let in without an announcement.
+func AnnounceDuePulls(ctx context.Context) error {
+	pulls, err := models.PullRevealsDue(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, pull := range pulls {
+		if claimed, err := models.ClaimPullReveal(ctx, pull.ID); err != nil {
+			log.Printf("Failed to release pull %d: %v", pull.ID, err)
+			continue
+		} else if !claimed {
+			// Revealed in the meantime
+			continue
+		}
+		user, err := models.GetUser(ctx, pull.DiscordID)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Failed to load the user of pull %d: %v", pull.ID, err)
+			}
+			continue
+		}
+		upload, err := models.GetUpload(ctx, pull.UploadID)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Failed to load the wallpaper of pull %d: %v", pull.ID, err)
+			}
+			continue
+		}
+		announcePull(user, pull, upload)
+	}
+	return nil
+}
+
+// verifyRevealToken checks a reveal token was signed with one of the
+// configured session secrets and hasn't expired
+func verifyRevealToken(token string) (revealClaims, bool) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return revealClaims{}, false
+	}
+	valid := false
+	for _, secret := range config.AppConfig.SessionSecret {
+		if hmac.Equal([]byte(signature), []byte(revealSignature(secret, encoded))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return revealClaims{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return revealClaims{}, false
+	}
+	var claims revealClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || time.Now().Unix() >= claims.Expires {
+		return revealClaims{}, false
+	}
+	return claims, true
+}
+
+// revealSignature signs the claims of a reveal token with a key derived from
+// a session secret
+func revealSignature(secret, encoded string) string {
+	key := sha256.Sum256([]byte("wallpaper-gacha pull reveal:" + secret))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,113 @@
+package gacha
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Community actions rewarded with bonus pulls (see config.Rewards), stored
+// as the reason of the reward in the wallet ledger
+const (
+	RewardUpload        = "upload"
+	RewardDailyLogin    = "daily_login"
+	RewardLikesReceived = "likes_received"
+	RewardUploadPulled  = "upload_pulled"
+)
+
+// RewardActions lists every rewarded action
+var RewardActions = []string{RewardUpload, RewardDailyLogin, RewardLikesReceived, RewardUploadPulled}
+
+var rewardsTotal = metrics.NewCounterVec("gacha_rewards_total",
+	"Rewards of bonus pulls granted, by action", "action")
+
+// reward grants the user amount bonus pulls for an action, once per
+// reference. The action has already happened, so failures are logged rather
+// than returned.
+func reward(ctx context.Context, discordID, action string, amount int, reference string) {
+	if amount <= 0 {
+		return
+	}
+	granted, err := models.GrantReward(ctx, discordID, action, amount, reference)
+	if err != nil {
+		log.Printf("Failed to reward user %s for %s (%s): %v", discordID, action, reference, err)
+		return
+	}
+	if granted {
+		log.Printf("User %s earned %d bonus pulls for %s (%s)", discordID, amount, action, reference)
+		rewardsTotal.Inc(action)
+	}
+}
+
+// RewardUploaded rewards the uploader of a new upload
+func RewardUploaded(ctx context.Context, upload *models.Upload) {
+	reward(ctx, upload.DiscordID, RewardUpload, config.AppConfig.Rewards.Upload, fmt.Sprintf("upload:%d", upload.ID))
+}
+
+// loginRewards holds the day each user was last rewarded for visiting, by
+// Discord ID, so visits later that day don't reach the database
+var loginRewards sync.Map
+
+// RewardVisit rewards the user's first visit of the day, in their own time
+// zone
+func RewardVisit(ctx context.Context, user *models.User) {
+	amount := config.AppConfig.Rewards.DailyLogin
+	if amount <= 0 {
+		return
+	}
+	start, _ := window(user)
+	day := start.Format(time.DateOnly)
+	if last, ok := loginRewards.Load(user.DiscordID); ok && last == day {
+		return
+	}
+	reward(ctx, user.DiscordID, RewardDailyLogin, amount, "login:"+day)
+	loginRewards.Store(user.DiscordID, day)
+}
+
+// RewardLiked rewards an uploader each time the likes their uploads
+// received reach another multiple of likes_per_reward. Each multiple is
+// rewarded once, so taking likes back and giving them again earns nothing.
+func RewardLiked(ctx context.Context, discordID string) {
+	rw := config.AppConfig.Rewards
+	if rw.LikesReceived <= 0 {
+		return
+	}
+	likes, err := models.CountLikesReceived(ctx, discordID)
+	if err != nil {
+		log.Printf("Failed to count likes received by user %s: %v", discordID, err)
+		return
+	}
+	if reached := likes / rw.LikesPerReward * rw.LikesPerReward; reached > 0 {
+		reward(ctx, discordID, RewardLikesReceived, rw.LikesReceived, fmt.Sprintf("likes:%d", reached))
+	}
+}
+
+// rewardUploadPulled rewards the uploader of a pulled wallpaper once other
+// users have pulled it as many times as one of the milestones
+func rewardUploadPulled(ctx context.Context, upload *models.Upload) {
+	rw := config.AppConfig.Rewards
+	if rw.UploadPulled <= 0 || upload.DiscordID == "" {
+		return
+	}
+	pulls, err := models.CountPullsByOthers(ctx, upload)
+	if err != nil {
+		log.Printf("Failed to count pulls of upload %d: %v", upload.ID, err)
+		return
+	}
+	// Pulls made at the same moment can pass a milestone together
+	reached := 0
+	for _, m := range rw.UploadPulledMilestones {
+		if pulls >= m {
+			reached = m
+		}
+	}
+	if reached > 0 {
+		reward(ctx, upload.DiscordID, RewardUploadPulled, rw.UploadPulled, fmt.Sprintf("pulled:%d:%d", upload.ID, reached))
+	}
+}
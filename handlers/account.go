@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+)
+
+// AccountDeletionEvent is the webhook payload sent when a user asks for their
+// account to be deleted or changes their mind
+type AccountDeletionEvent struct {
+	DiscordID   string     `json:"discord_id"`
+	Username    string     `json:"username"`
+	RequestedAt *time.Time `json:"requested_at,omitempty"`
+	DeleteAfter *time.Time `json:"delete_after,omitempty"`
+}
+
+// deletionDeadline returns when an account whose deletion was requested at
+// the given time is deleted
+func deletionDeadline(requestedAt time.Time) time.Time {
+	return requestedAt.AddDate(0, 0, config.AppConfig.DeletionGraceDays)
+}
+
+// ExportDataHandler sends the signed-in user a zip of everything kept about
+// them: data.json with their records and the files of their uploads
+func ExportDataHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+
+	if middleware.GetImpersonatorID(r) != "" {
+		respondImpersonating(w, "Data cannot be exported while viewing as another user")
+		return
+	}
+
+	data, err := models.ExportUserData(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to export data of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to export data")
+		return
+	}
+	uploads, err := models.ListUserUploads(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to list uploads of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to export data")
+		return
+	}
+
+	recordAudit(r, discordID, models.AuditDataExport, "user:"+discordID, "")
+	log.Printf("User %s (ID: %s) exported their data", middleware.GetUsername(r), discordID)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "wallpaper-gacha-" + discordID + ".zip"}))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Headers are sent by now, so failures below can only be logged and
+	// leave the client with a truncated zip
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "data.json", Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(map[string]interface{}{
+			"exported_at": time.Now().UTC(),
+			"records":     data,
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to write data export of user %s: %v", discordID, err)
+		return
+	}
+
+	for _, u := range uploads {
+		if err := addUploadFile(zw, "uploads/", u); err != nil {
+			log.Printf("Failed to add upload %d to data export of user %s: %v", u.ID, discordID, err)
+			if !os.IsNotExist(err) {
+				return
+			}
+		}
+	}
+}
+
+// addUploadFile copies an upload's stored file into a zip as
+// <dir><id>-<original name>. Images are stored uncompressed since they are
+// already compressed.
+func addUploadFile(zw *zip.Writer, dir string, u models.Upload) error {
+	src, err := os.Open(storage.Path(u.Filename))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	original := filepath.Base(u.OriginalFilename)
+	name := fmt.Sprintf("%s%d-%s%s", dir, u.ID, strings.TrimSuffix(original, filepath.Ext(original)), filepath.Ext(u.Filename))
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: u.UploadedAt})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// RequestDeletionHandler schedules the signed-in user's account for deletion
+// after the grace period and lets admins know through the webhooks. Asking
+// again reports the existing schedule.
+func RequestDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	if middleware.GetImpersonatorID(r) != "" {
+		respondImpersonating(w, "Account deletion cannot be requested while viewing as another user")
+		return
+	}
+
+	requestedAt, created, err := models.RequestAccountDeletion(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to schedule deletion of user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to schedule account deletion")
+		return
+	}
+
+	requestedAt = requestedAt.UTC()
+	deleteAfter := deletionDeadline(requestedAt)
+	if created {
+		log.Printf("User %s (ID: %s) asked for their account to be deleted after %s", username, discordID, deleteAfter.Format(time.RFC3339))
+		recordAudit(r, discordID, models.AuditDeletionRequest, "user:"+discordID, "")
+		webhooks.Notify(webhooks.EventDeletionRequested, AccountDeletionEvent{
+			DiscordID:   discordID,
+			Username:    username,
+			RequestedAt: &requestedAt,
+			DeleteAfter: &deleteAfter,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"requested_at": requestedAt,
+		"delete_after": deleteAfter,
+	})
+}
+
+// CancelDeletionHandler withdraws the signed-in user's deletion request
+func CancelDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	if middleware.GetImpersonatorID(r) != "" {
+		respondImpersonating(w, "Account deletion cannot be cancelled while viewing as another user")
+		return
+	}
+
+	err := models.CancelAccountDeletion(r.Context(), discordID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Account deletion is not scheduled")
+		return
+	} else if err != nil {
+		log.Printf("Failed to cancel deletion of user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to cancel account deletion")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) cancelled their account deletion", username, discordID)
+	recordAudit(r, discordID, models.AuditDeletionCancel, "user:"+discordID, "")
+	webhooks.Notify(webhooks.EventDeletionCancelled, AccountDeletionEvent{DiscordID: discordID, Username: username})
+
+	w.WriteHeader(http.StatusNoContent)
+}
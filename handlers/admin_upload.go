@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// Maximum number of near-duplicates listed in the moderation view
+const maxSimilarMatches = 10
+
+// UploadModeration is the moderation state of an upload
+type UploadModeration struct {
+	Frozen       bool   `json:"frozen"`
+	ReportCount  int    `json:"report_count"`
+	ReportHidden bool   `json:"report_hidden"`
+	DuplicateOf  int64  `json:"duplicate_of,omitempty"`
+	SafetyStatus string `json:"safety_status,omitempty"`
+	QualityScore *int64 `json:"quality_score,omitempty"`
+}
+
+type UploadStatsResponse struct {
+	Views     int64 `json:"views"`
+	Downloads int64 `json:"downloads"`
+	Pulls     int64 `json:"pulls"`
+}
+
+type UploaderReputationResponse struct {
+	DiscordID         string     `json:"discord_id"`
+	Username          string     `json:"username"`
+	JoinedAt          *time.Time `json:"joined_at,omitempty"`
+	Uploads           int        `json:"uploads"`
+	DeletedUploads    int        `json:"deleted_uploads"`
+	ReportsReceived   int        `json:"reports_received"`
+	ReportsUpheld     int        `json:"reports_upheld"`
+	TakedownsApproved int        `json:"takedowns_approved"`
+	Banned            bool       `json:"banned"`
+}
+
+type SimilarUploadResponse struct {
+	UploadID     int64  `json:"upload_id"`
+	Distance     int    `json:"distance"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// UploadDetailResponse gathers everything a moderator needs to judge an upload
+type UploadDetailResponse struct {
+	Upload     WallpaperResponse          `json:"upload"`
+	Moderation UploadModeration           `json:"moderation"`
+	Stats      UploadStatsResponse        `json:"stats"`
+	Reports    []ReportResponse           `json:"reports"`
+	Uploader   UploaderReputationResponse `json:"uploader"`
+	Similar    []SimilarUploadResponse    `json:"similar"`
+}
+
+// AdminUploadDetailHandler returns an upload with its access counters, report
+// history, uploader reputation and near-duplicate matches, including uploads
+// hidden from the gallery
+func AdminUploadDetailHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload")
+		return
+	}
+
+	stats, err := models.GetUploadStats(r.Context(), upload.ID)
+	if err != nil {
+		log.Printf("Failed to get stats for upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload details")
+		return
+	}
+
+	reports, err := models.ListUploadReports(r.Context(), upload.ID)
+	if err != nil {
+		log.Printf("Failed to list reports for upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload details")
+		return
+	}
+
+	reputation, err := models.GetUploaderReputation(r.Context(), upload.DiscordID)
+	if err != nil {
+		log.Printf("Failed to get reputation of user %s: %v", upload.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload details")
+		return
+	}
+
+	var similar []models.SimilarUpload
+	if upload.PHash.Valid {
+		similar, err = models.FindSimilarUploads(r.Context(), uint64(upload.PHash.Int64), config.AppConfig.DuplicateHashDistance, upload.ID, upload.GuildID, maxSimilarMatches)
+		if err != nil {
+			log.Printf("Failed to find uploads similar to %d: %v", upload.ID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to get upload details")
+			return
+		}
+	}
+
+	resp := UploadDetailResponse{
+		Upload: newWallpaperResponse(r, *upload),
+		Moderation: UploadModeration{
+			Frozen:       upload.Frozen,
+			ReportCount:  upload.ReportCount,
+			ReportHidden: upload.ReportHidden,
+			DuplicateOf:  upload.DuplicateOf.Int64,
+			SafetyStatus: upload.SafetyStatus,
+		},
+		Stats: UploadStatsResponse{
+			Views:     stats.Views,
+			Downloads: stats.Downloads,
+			Pulls:     stats.Pulls,
+		},
+		Reports: make([]ReportResponse, 0, len(reports)),
+		Uploader: UploaderReputationResponse{
+			DiscordID:         reputation.DiscordID,
+			Username:          upload.UploaderName,
+			Uploads:           reputation.Uploads,
+			DeletedUploads:    reputation.DeletedUploads,
+			ReportsReceived:   reputation.ReportsReceived,
+			ReportsUpheld:     reputation.ReportsUpheld,
+			TakedownsApproved: reputation.TakedownsApproved,
+			Banned:            reputation.Banned,
+		},
+		Similar: make([]SimilarUploadResponse, 0, len(similar)),
+	}
+	for i := range reports {
+		resp.Reports = append(resp.Reports, newReportResponse(&reports[i]))
+	}
+	for _, s := range similar {
+		resp.Similar = append(resp.Similar, SimilarUploadResponse{
+			UploadID:     s.UploadID,
+			Distance:     s.Distance,
+			ThumbnailURL: thumbnailURL(r, s.UploadID),
+		})
+	}
+	if upload.QualityScore.Valid {
+		resp.Moderation.QualityScore = &upload.QualityScore.Int64
+	}
+	if user, err := models.GetUser(r.Context(), upload.DiscordID); err == nil {
+		resp.Uploader.JoinedAt = &user.CreatedAt
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxAPITokensPerUser   = 10
+	maxAPITokenNameLength = 50
+	apiTokenPrefixDisplay = 10 // characters of the token kept to identify it
+)
+
+type APITokenResponse struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	CanUpload  bool       `json:"can_upload"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newAPITokenResponse(t models.APIToken) APITokenResponse {
+	resp := APITokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Prefix:    t.Prefix,
+		CanUpload: t.Permission == middleware.RoleUploader,
+		CreatedAt: t.CreatedAt,
+	}
+	if t.LastUsedAt.Valid {
+		resp.LastUsedAt = &t.LastUsedAt.Time
+	}
+	return resp
+}
+
+func apiTokenTarget(id int64) string {
+	return fmt.Sprintf("token:%d", id)
+}
+
+// APITokensHandler lists the signed-in user's API tokens
+func APITokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := models.ListAPITokens(r.Context(), middleware.GetDiscordID(r))
+	if err != nil {
+		log.Printf("Failed to list API tokens: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list API tokens")
+		return
+	}
+
+	items := make([]APITokenResponse, 0, len(tokens))
+	for _, t := range tokens {
+		items = append(items, newAPITokenResponse(t))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tokens": items})
+}
+
+// CreateAPITokenHandler generates an API token for the signed-in user. The
+// token itself is only returned in this response.
+func CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	if middleware.GetImpersonatorID(r) != "" {
+		respondImpersonating(w, "API tokens cannot be created while viewing as another user")
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	name := strings.TrimSpace(sanitizeText(body.Name))
+	if name == "" {
+		respondError(w, http.StatusBadRequest, "Token name is required")
+		return
+	}
+	if utf8.RuneCountInString(name) > maxAPITokenNameLength {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Token name must be at most %d characters", maxAPITokenNameLength))
+		return
+	}
+
+	count, err := models.CountActiveAPITokens(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to count API tokens for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API token")
+		return
+	}
+	if count >= maxAPITokensPerUser {
+		apiError(w, http.StatusConflict, codeLimitReached, fmt.Sprintf("You can have at most %d API tokens; revoke one first", maxAPITokensPerUser))
+		return
+	}
+
+	token, hash, err := middleware.NewAPIToken()
+	if err != nil {
+		log.Printf("Failed to generate API token: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API token")
+		return
+	}
+
+	// Tokens act with the permission the user has now
+	permission := middleware.RoleUser
+	if middleware.CanUpload(r) {
+		permission = middleware.RoleUploader
+	}
+	t := &models.APIToken{DiscordID: discordID, Name: name, Prefix: token[:apiTokenPrefixDisplay], Permission: permission}
+	if err := models.CreateAPIToken(r.Context(), t, hash); err != nil {
+		log.Printf("Failed to create API token for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create API token")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) created API token %d (%s)", username, discordID, t.ID, name)
+	recordAudit(r, discordID, models.AuditTokenCreate, apiTokenTarget(t.ID), name)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":   token,
+		"details": newAPITokenResponse(*t),
+	})
+}
+
+// RevokeAPITokenHandler revokes one of the signed-in user's API tokens
+func RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	discordID := middleware.GetDiscordID(r)
+	err = models.RevokeAPIToken(r.Context(), tokenID, discordID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "API token not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to revoke API token %d: %v", tokenID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to revoke API token")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) revoked API token %d", middleware.GetUsername(r), discordID, tokenID)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditTokenRevoke, apiTokenTarget(tokenID), "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// AuditEntryResponse is the JSON representation of an audit log entry
+type AuditEntryResponse struct {
+	ID        int64     `json:"id"`
+	ActorID   string    `json:"actor_id"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Details   string    `json:"details"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordAudit writes an audit log entry for an action taken in the request.
+// Failures are logged but never fail the request, since the action already happened.
+// For the same reason the entry is written even if the client has gone away.
+func recordAudit(r *http.Request, actorID, action, target, details string) {
+	saveAudit(r, models.RecordAudit, actorID, action, target, details)
+}
+
+// saveAudit records an audit entry with save, logging failures
+func saveAudit(r *http.Request, save func(context.Context, *models.AuditEntry) error, actorID, action, target, details string) {
+	entry := &models.AuditEntry{
+		ActorID: actorID,
+		Action:  action,
+		Target:  target,
+		Details: details,
+		IP:      middleware.ClientIP(r),
+	}
+	if err := save(context.WithoutCancel(r.Context()), entry); err != nil {
+		log.Printf("Failed to record audit entry %s by %s on %q: %v", action, actorID, target, err)
+	}
+}
+
+func uploadTarget(id int64) string {
+	return fmt.Sprintf("upload:%d", id)
+}
+
+func userTarget(discordID string) string {
+	return "user:" + discordID
+}
+
+// AdminAuditHandler lists audit log entries, optionally filtered by actor,
+// action or target
+func AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+	query := r.URL.Query()
+
+	entries, total, err := models.ListAuditLog(r.Context(), models.AuditFilter{
+		ActorID: query.Get("actor"),
+		Action:  query.Get("action"),
+		Target:  query.Get("target"),
+		Limit:   perPage,
+		Offset:  offset,
+	})
+	if err != nil {
+		log.Printf("Failed to list audit log: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list audit log")
+		return
+	}
+
+	items := make([]AuditEntryResponse, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, AuditEntryResponse{
+			ID:        e.ID,
+			ActorID:   e.ActorID,
+			Action:    e.Action,
+			Target:    e.Target,
+			Details:   e.Details,
+			IP:        e.IP,
+			CreatedAt: e.CreatedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entries":  items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
@@ -1,48 +1,135 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
-	"io"
+	"errors"
 	"log"
 	"net/http"
-	"net/url"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
 	"github.com/Zinbhe/wallpaper-gacha/middleware"
 	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/oauth"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
 
-type DiscordUser struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-}
-
-type DiscordGuild struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-}
+// Session keys holding the OAuth state value issued by LoginHandler, the
+// provider it was issued for and the guild the user asked to sign in to
+const (
+	oauthStateSessionKey    = "oauth_state"
+	oauthProviderSessionKey = "oauth_provider"
+	oauthGuildSessionKey    = "oauth_guild"
+)
 
-type TokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
+// loginProvider returns the provider named in the request's path, or the
+// default one when it names none
+func loginProvider(r *http.Request) (oauth.Provider, bool) {
+	name := mux.Vars(r)["provider"]
+	if name == "" {
+		name = oauth.Default
+	}
+	return oauth.Get(name)
 }
 
-// LoginHandler redirects to Discord OAuth
+// LoginHandler redirects to the provider's OAuth page with a random state
+// value that the callback must echo back, so a login can't be started on the
+// user's behalf, and a PKCE challenge whose verifier stays on the server
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("User initiated Discord OAuth authentication from IP: %s", r.RemoteAddr)
-	authURL := fmt.Sprintf(
-		"https://discord.com/api/oauth2/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=identify%%20guilds",
-		config.AppConfig.DiscordClientID,
-		url.QueryEscape(config.AppConfig.DiscordRedirectURI),
-	)
+	provider, ok := loginProvider(r)
+	if !ok {
+		renderErrorPage(w, http.StatusNotFound, "Unknown login provider", "This server doesn't offer that way to log in.")
+		return
+	}
+	log.Printf("User initiated %s OAuth authentication from IP: %s", provider.Title(), r.RemoteAddr)
+
+	state, err := newOAuthState()
+	if err != nil {
+		log.Printf("Failed to generate OAuth state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := newOAuthState()
+	if err != nil {
+		log.Printf("Failed to generate PKCE verifier: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := middleware.Store.Get(r, middleware.SessionName)
+	if err != nil {
+		session = sessions.NewSession(middleware.Store, middleware.SessionName)
+	}
+	session.Values[oauthStateSessionKey] = state
+	session.Values[oauthProviderSessionKey] = provider.Name()
+	session.Values[oauthGuildSessionKey] = r.URL.Query().Get("guild")
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to save OAuth state in session: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	storePKCEVerifier(state, verifier)
+
+	authURL := provider.AuthorizeURL(state, pkceChallenge(verifier))
 	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
 }
 
-// CallbackHandler handles the OAuth callback from Discord
+// newOAuthState returns an unguessable value for the OAuth state parameter.
+// It is also used for PKCE verifiers: 43 URL-safe characters.
+func newOAuthState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CallbackHandler handles the OAuth callback from a provider
 func CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := loginProvider(r)
+	if !ok {
+		renderErrorPage(w, http.StatusNotFound, "Unknown login provider", "This server doesn't offer that way to log in.")
+		return
+	}
+
+	// The state must match the one issued to this browser, for this
+	// provider; it is single-use
+	session, err := middleware.Store.Get(r, middleware.SessionName)
+	if err != nil {
+		session = sessions.NewSession(middleware.Store, middleware.SessionName)
+	}
+	expected, _ := session.Values[oauthStateSessionKey].(string)
+	expectedProvider, _ := session.Values[oauthProviderSessionKey].(string)
+	delete(session.Values, oauthStateSessionKey)
+	requestedGuild, _ := session.Values[oauthGuildSessionKey].(string)
+	delete(session.Values, oauthProviderSessionKey)
+	delete(session.Values, oauthGuildSessionKey)
+	state := r.URL.Query().Get("state")
+	if expected == "" || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 || expectedProvider != provider.Name() {
+		log.Printf("OAuth callback rejected: state mismatch from IP: %s", r.RemoteAddr)
+		session.Save(r, w)
+		renderErrorPage(w, http.StatusBadRequest, "Login link expired",
+			"This login didn't start from this browser, or it has already been used. Please log in again.")
+		return
+	}
+
+	verifier, ok := takePKCEVerifier(state)
+	if !ok {
+		log.Printf("OAuth callback rejected: no pending PKCE verifier from IP: %s", r.RemoteAddr)
+		session.Save(r, w)
+		renderErrorPage(w, http.StatusBadRequest, "Login link expired",
+			"This login took too long or the server restarted while it was in progress. Please log in again.")
+		return
+	}
+
 	code := r.URL.Query().Get("code")
 	if code == "" {
 		log.Printf("OAuth callback failed: no code provided from IP: %s", r.RemoteAddr)
@@ -52,58 +139,99 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Processing OAuth callback from IP: %s", r.RemoteAddr)
 
-	// Exchange code for access token
-	token, err := exchangeCode(code)
-	if err != nil {
-		log.Printf("Failed to exchange code: %v", err)
-		http.Error(w, "Failed to authenticate with Discord", http.StatusInternalServerError)
+	account, err := provider.SignIn(r.Context(), code, verifier)
+	var denied *oauth.DeniedError
+	if errors.As(err, &denied) {
+		log.Printf("Authentication denied: %s sign-in from IP: %s: %v", provider.Title(), r.RemoteAddr, err)
+		middleware.Error(w, r, http.StatusForbidden, middleware.CodeNotInGuild, denied.Reason)
 		return
-	}
-
-	// Get user info
-	user, err := getDiscordUser(token)
-	if err != nil {
-		log.Printf("Failed to get user info: %v", err)
-		http.Error(w, "Failed to get user information", http.StatusInternalServerError)
+	} else if err != nil {
+		log.Printf("Failed to authenticate with %s: %v", provider.Title(), err)
+		http.Error(w, "Failed to authenticate with "+provider.Title(), http.StatusInternalServerError)
 		return
 	}
 
-	// Get user's guilds
-	guilds, err := getDiscordGuilds(token)
-	if err != nil {
-		log.Printf("Failed to get guilds: %v", err)
-		http.Error(w, "Failed to verify server membership", http.StatusInternalServerError)
-		return
+	log.Printf("User %s (ID: %s) verified by %s", account.Username, account.ID, provider.Title())
+
+	// Users in several allowed servers browse the one they asked for, if
+	// they're in it, and otherwise the first of them
+	guildID := account.GuildIDs[0]
+	if slices.Contains(account.GuildIDs, requestedGuild) {
+		guildID = requestedGuild
+	}
+	permission := middleware.RoleUploader
+	if len(account.UploadGuildIDs) == 0 {
+		permission = middleware.RoleUser
+		log.Printf("User %s (ID: %s) has no uploader role; signing in without upload access", account.Username, account.ID)
 	}
 
-	// Check if user is in an allowed server
-	if !isInAllowedServer(guilds) {
-		log.Printf("Authentication denied: user %s (ID: %s) not in allowed Discord servers", user.Username, user.ID)
-		http.Error(w, "You are not in an allowed Discord server", http.StatusForbidden)
+	// Banned users never get a session, but the device they tried from is
+	// noted, to catch them coming back with another account
+	if ban, err := models.GetActiveBan(r.Context(), account.ID); err == nil {
+		log.Printf("Authentication denied: user %s (ID: %s) is banned from IP: %s", account.Username, account.ID, r.RemoteAddr)
+		recordFingerprint(r, account.ID)
+		middleware.Error(w, r, http.StatusForbidden, middleware.CodeBanned, middleware.BanMessage(ban))
+		return
+	} else if err != sql.ErrNoRows {
+		log.Printf("Failed to check ban status for user %s (ID: %s): %v", account.Username, account.ID, err)
+		http.Error(w, "Failed to verify account status", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("User %s (ID: %s) verified in allowed Discord server", user.Username, user.ID)
-
 	// Create or update user in database
-	dbUser, err := models.GetOrCreateUser(user.ID, user.Username)
+	dbUser, err := models.GetOrCreateUser(r.Context(), account.ID, account.Username)
 	if err != nil {
 		log.Printf("Failed to create user: %v", err)
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
-
-	// Create session - if there's an invalid/stale cookie, create a new session
-	session, err := middleware.Store.Get(r, "wallpaper-session")
-	if err != nil {
-		log.Printf("Invalid session cookie detected for user %s (ID: %s), creating new session: %v", user.Username, user.ID, err)
-		// Create a fresh session using sessions.NewSession
-		session = sessions.NewSession(middleware.Store, "wallpaper-session")
+	if err := dbUser.UpdateProfile(r.Context(), account.Username, account.DisplayName, account.Avatar); err != nil {
+		log.Printf("Warning: Failed to update profile of user %s (ID: %s): %v", account.Username, dbUser.DiscordID, err)
+	}
+	if account.Confirmed != nil {
+		if err := account.Confirmed(); err != nil {
+			log.Printf("Warning: Failed to store sign-in details of user %s (ID: %s): %v", dbUser.Username, dbUser.DiscordID, err)
+		}
+	}
+	recordFingerprint(r, dbUser.DiscordID)
+
+	// An account linked to another signs in to that one
+	if dbUser.LinkedTo != "" {
+		if ban, err := models.GetActiveBan(r.Context(), dbUser.LinkedTo); err == nil {
+			log.Printf("Authentication denied: user %s (ID: %s) is linked to banned user %s, from IP: %s", account.Username, account.ID, dbUser.LinkedTo, r.RemoteAddr)
+			middleware.Error(w, r, http.StatusForbidden, middleware.CodeBanned, middleware.BanMessage(ban))
+			return
+		} else if err != sql.ErrNoRows {
+			log.Printf("Failed to check ban status for user %s (ID: %s): %v", account.Username, dbUser.LinkedTo, err)
+			http.Error(w, "Failed to verify account status", http.StatusInternalServerError)
+			return
+		}
+		primary, err := models.GetUser(r.Context(), dbUser.LinkedTo)
+		if err != nil {
+			log.Printf("Failed to get user %s linked from user %s: %v", dbUser.LinkedTo, dbUser.DiscordID, err)
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %s (ID: %s) is linked to user %s (ID: %s); signing in as them", dbUser.Username, dbUser.DiscordID, primary.Username, primary.DiscordID)
+		dbUser = primary
 	}
 
+	// Sign the user in on the session that carried the state
 	session.Values["discord_id"] = dbUser.DiscordID
 	session.Values["username"] = dbUser.Username
 	session.Values["authenticated"] = true
+	session.Values[middleware.LoginAtSessionKey] = time.Now().Unix()
+	session.Values[middleware.PermissionSessionKey] = permission
+	session.Values[middleware.GuildSessionKey] = guildID
+	session.Values[middleware.GuildsSessionKey] = strings.Join(account.GuildIDs, ",")
+	session.Values[middleware.UploadGuildsSessionKey] = strings.Join(account.UploadGuildIDs, ",")
+
+	// A new token per sign-in, so one planted before sign-in is useless
+	if _, err := middleware.NewCSRFToken(session); err != nil {
+		log.Printf("Failed to create CSRF token for user %s (ID: %s): %v", dbUser.Username, dbUser.DiscordID, err)
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
+	}
 
 	if err := session.Save(r, w); err != nil {
 		log.Printf("Failed to save session for user %s (ID: %s): %v", dbUser.Username, dbUser.DiscordID, err)
@@ -112,12 +240,14 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("User successfully authenticated: %s (ID: %s) from IP: %s", dbUser.Username, dbUser.DiscordID, r.RemoteAddr)
+	recordAudit(r, dbUser.DiscordID, models.AuditLogin, "", "")
+	gacha.RewardVisit(r.Context(), dbUser)
 	http.Redirect(w, r, "/upload", http.StatusSeeOther)
 }
 
 // LogoutHandler destroys the session
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	session, err := middleware.Store.Get(r, "wallpaper-session")
+	session, err := middleware.Store.Get(r, middleware.SessionName)
 	if err != nil {
 		log.Printf("Logout attempt with invalid session from IP: %s", r.RemoteAddr)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -140,127 +270,47 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func exchangeCode(code string) (string, error) {
-	data := url.Values{}
-	data.Set("client_id", config.AppConfig.DiscordClientID)
-	data.Set("client_secret", config.AppConfig.DiscordClientSecret)
-	data.Set("grant_type", "authorization_code")
-	data.Set("code", code)
-	data.Set("redirect_uri", config.AppConfig.DiscordRedirectURI)
-
-	req, err := http.NewRequest("POST", "https://discord.com/api/oauth2/token", strings.NewReader(data.Encode()))
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("token exchange failed: %s", string(body))
-	}
-
-	var tokenResp TokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return "", err
-	}
-
-	return tokenResp.AccessToken, nil
-}
-
-func getDiscordUser(token string) (*DiscordUser, error) {
-	req, err := http.NewRequest("GET", "https://discord.com/api/users/@me", nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get user: %s", string(body))
-	}
-
-	var user DiscordUser
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
+// UserInfoHandler returns the current user's information
+func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	username := middleware.GetUsername(r)
+	discordID := middleware.GetDiscordID(r)
 
-func getDiscordGuilds(token string) ([]DiscordGuild, error) {
-	req, err := http.NewRequest("GET", "https://discord.com/api/users/@me/guilds", nil)
-	if err != nil {
-		return nil, err
+	if discordID == "" {
+		respondError(w, http.StatusUnauthorized, "Not authenticated")
+		return
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
 	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get guilds: %s", string(body))
-	}
-
-	var guilds []DiscordGuild
-	if err := json.NewDecoder(resp.Body).Decode(&guilds); err != nil {
-		return nil, err
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
 	}
 
-	return guilds, nil
-}
-
-func isInAllowedServer(guilds []DiscordGuild) bool {
-	allowedServers := make(map[string]bool)
-	for _, id := range config.AppConfig.AllowedServerIDs {
-		allowedServers[id] = true
+	info := map[string]interface{}{
+		"username":                username,
+		"discord_id":              discordID,
+		"timezone":                userResetLocation(user).String(),
+		"next_daily_reset":        nextDailyReset(user),
+		"guild_id":                middleware.GetGuildID(r),
+		"can_upload":              middleware.CanUpload(r),
+		"max_file_size_mb":        maxFileSizeMB(user),
+		"upload_cooldown_minutes": uploadCooldownMinutes(user),
+		"profile_private":         user.ProfilePrivate,
+		"discord_dms":             user.DiscordDMs,
 	}
-
-	for _, guild := range guilds {
-		if allowedServers[guild.ID] {
-			return true
-		}
+	if user.DeletionRequestedAt.Valid {
+		info["delete_after"] = deletionDeadline(user.DeletionRequestedAt.Time)
 	}
-
-	return false
-}
-
-// UserInfoHandler returns the current user's information
-func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
-	username := middleware.GetUsername(r)
-	discordID := middleware.GetDiscordID(r)
-
-	if discordID == "" {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
-		return
+	if impersonatorID := middleware.GetImpersonatorID(r); impersonatorID != "" {
+		info["impersonated_by"] = impersonatorID
+	} else {
+		// Pages ask for the user as they load, which counts as a visit
+		gacha.RewardVisit(r.Context(), user)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"username":   username,
-		"discord_id": discordID,
-	})
+	json.NewEncoder(w).Encode(info)
 }
 
 // ConfigHandler returns public configuration values
@@ -269,5 +319,11 @@ func ConfigHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"upload_cooldown_minutes": config.AppConfig.UploadCooldownMinutes,
 		"max_file_size_mb":        config.AppConfig.MaxFileSizeMB,
+		"allowed_extensions":      config.AppConfig.UploadExtensions(),
+		"min_width":               config.AppConfig.MinWidth,
+		"min_height":              config.AppConfig.MinHeight,
+		"allowed_aspect_ratios":   config.AppConfig.AllowedAspectRatios,
+		"reset_timezone":          config.AppConfig.ResetLocation().String(),
+		"next_daily_reset":        nextDailyReset(nil),
 	})
 }
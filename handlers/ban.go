@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+	"github.com/gorilla/mux"
+)
+
+// Maximum length of a ban reason, in characters
+const maxBanReasonLength = 500
+
+// BanResponse is the JSON representation of a ban
+type BanResponse struct {
+	DiscordID string     `json:"discord_id"`
+	Reason    string     `json:"reason"`
+	BannedBy  string     `json:"banned_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func newBanResponse(b *models.Ban) BanResponse {
+	resp := BanResponse{
+		DiscordID: b.DiscordID,
+		Reason:    b.Reason,
+		BannedBy:  b.BannedBy,
+		CreatedAt: b.CreatedAt,
+	}
+	if b.ExpiresAt.Valid {
+		resp.ExpiresAt = &b.ExpiresAt.Time
+	}
+	return resp
+}
+
+// AdminBansHandler lists active bans
+func AdminBansHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	bans, total, err := models.ListBans(r.Context(), perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list bans: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list bans")
+		return
+	}
+
+	items := make([]BanResponse, 0, len(bans))
+	for i := range bans {
+		items = append(items, newBanResponse(&bans[i]))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"bans":     items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// AdminBanHandler bans a Discord user with a reason and an optional RFC 3339
+// expiry; banning an already banned user replaces the ban
+func AdminBanHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		DiscordID string     `json:"discord_id"`
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	body.DiscordID = strings.TrimSpace(body.DiscordID)
+	reason := strings.TrimSpace(body.Reason)
+	if body.DiscordID == "" || reason == "" {
+		respondError(w, http.StatusBadRequest, "discord_id and reason are required")
+		return
+	}
+	if len([]rune(reason)) > maxBanReasonLength {
+		respondError(w, http.StatusBadRequest, "Reason is too long")
+		return
+	}
+	if config.AppConfig.IsAdmin(body.DiscordID) {
+		respondError(w, http.StatusBadRequest, "Admins cannot be banned")
+		return
+	}
+
+	ban := &models.Ban{
+		DiscordID: body.DiscordID,
+		Reason:    reason,
+		BannedBy:  middleware.GetRealDiscordID(r),
+	}
+	if body.ExpiresAt != nil {
+		if !body.ExpiresAt.After(time.Now()) {
+			respondError(w, http.StatusBadRequest, "expires_at must be in the future")
+			return
+		}
+		ban.ExpiresAt = sql.NullTime{Time: body.ExpiresAt.UTC().Truncate(time.Second), Valid: true}
+	}
+
+	if err := models.BanUser(r.Context(), ban); err != nil {
+		log.Printf("Failed to ban user %s: %v", body.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to ban user")
+		return
+	}
+
+	// Banned users are refused on every request anyway; dropping their
+	// sessions means lifting the ban doesn't restore them
+	if _, err := middleware.Store.Backend.DeleteUser(ban.DiscordID); err != nil {
+		log.Printf("Failed to end sessions of banned user %s: %v", ban.DiscordID, err)
+	}
+
+	log.Printf("Admin %s (ID: %s) banned user %s: %s", middleware.GetUsername(r), ban.BannedBy, ban.DiscordID, ban.Reason)
+	details := ban.Reason
+	if ban.ExpiresAt.Valid {
+		details += " (until " + ban.ExpiresAt.Time.Format(time.RFC3339) + ")"
+	}
+	recordAudit(r, ban.BannedBy, models.AuditBan, userTarget(ban.DiscordID), details)
+	resp := newBanResponse(ban)
+	webhooks.Notify(webhooks.EventUserBanned, resp)
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// AdminUnbanHandler lifts a ban
+func AdminUnbanHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := mux.Vars(r)["id"]
+
+	err := models.UnbanUser(r.Context(), discordID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "That user is not banned")
+		return
+	} else if err != nil {
+		log.Printf("Failed to unban user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to unban user")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) unbanned user %s", middleware.GetUsername(r), middleware.GetRealDiscordID(r), discordID)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditUnban, userTarget(discordID), "")
+	webhooks.Notify(webhooks.EventUserUnbanned, map[string]string{"discord_id": discordID})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxBannerNameLength        = 100
+	maxBannerDescriptionLength = 1000
+	maxBannerUploads           = 500
+	maxBannerRateUp            = 100
+	defaultBannerRateUp        = 2
+)
+
+// BannerResponse is the JSON representation of a banner. CreatedBy is only
+// shown to admins.
+type BannerResponse struct {
+	ID          int64     `json:"id"`
+	GuildID     string    `json:"guild_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	UploadIDs   []int64   `json:"upload_ids"`
+	Tags        []string  `json:"tags"`
+	RateUp      float64   `json:"rate_up"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	Active      bool      `json:"active"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newBannerResponse(b *models.Banner, admin bool) BannerResponse {
+	resp := BannerResponse{
+		ID:          b.ID,
+		GuildID:     b.GuildID,
+		Name:        b.Name,
+		Description: b.Description,
+		UploadIDs:   b.UploadIDs,
+		Tags:        b.Tags,
+		RateUp:      b.RateUp,
+		StartsAt:    b.StartsAt,
+		EndsAt:      b.EndsAt,
+		Active:      b.Active(time.Now()),
+		CreatedAt:   b.CreatedAt,
+	}
+	if admin {
+		resp.CreatedBy = b.CreatedBy
+	}
+	return resp
+}
+
+func bannerTarget(id int64) string {
+	return fmt.Sprintf("banner:%d", id)
+}
+
+// loadActiveBanner looks up the guild's running banner with the raw ID,
+// responding with 404 and returning nil if there is none
+func loadActiveBanner(w http.ResponseWriter, r *http.Request, raw, guildID string) *models.Banner {
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Banner not found")
+		return nil
+	}
+	banner, err := models.GetBanner(r.Context(), id)
+	if err == sql.ErrNoRows || (err == nil && (!banner.Active(time.Now()) || banner.GuildID != guildID)) {
+		respondError(w, http.StatusNotFound, "Banner not found or not running")
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to get banner %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get banner")
+		return nil
+	}
+	return banner
+}
+
+// BannersHandler lists the banners running now in the current guild
+func BannersHandler(w http.ResponseWriter, r *http.Request) {
+	writeBanners(w, r, middleware.GetGuildID(r), true, false)
+}
+
+// AdminBannersHandler lists every banner of every guild, past and upcoming
+// included, or only those of the guild named by ?guild=
+func AdminBannersHandler(w http.ResponseWriter, r *http.Request) {
+	writeBanners(w, r, r.URL.Query().Get("guild"), false, true)
+}
+
+func writeBanners(w http.ResponseWriter, r *http.Request, guildID string, activeOnly, admin bool) {
+	banners, err := models.ListBanners(r.Context(), guildID, activeOnly)
+	if err != nil {
+		log.Printf("Failed to list banners: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list banners")
+		return
+	}
+	items := make([]BannerResponse, 0, len(banners))
+	for _, b := range banners {
+		items = append(items, newBannerResponse(b, admin))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"banners": items})
+}
+
+// parseBanner reads and validates a banner from the request body, writing a
+// 400 response and returning nil if it is invalid. The banner runs in
+// guildID unless the body names another guild.
+func parseBanner(w http.ResponseWriter, r *http.Request, guildID string) *models.Banner {
+	var body struct {
+		GuildID     string    `json:"guild_id"`
+		Name        string    `json:"name"`
+		Description string    `json:"description"`
+		UploadIDs   []int64   `json:"upload_ids"`
+		Tags        []string  `json:"tags"`
+		RateUp      float64   `json:"rate_up"`
+		StartsAt    time.Time `json:"starts_at"`
+		EndsAt      time.Time `json:"ends_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return nil
+	}
+
+	if body.GuildID != "" {
+		guildID = body.GuildID
+	}
+	if !config.AppConfig.IsAllowedGuild(guildID) {
+		respondError(w, http.StatusBadRequest, "guild_id must be one of the configured guilds")
+		return nil
+	}
+
+	b := &models.Banner{
+		GuildID:     guildID,
+		Name:        strings.TrimSpace(body.Name),
+		Description: sanitizeText(body.Description),
+		RateUp:      body.RateUp,
+		StartsAt:    body.StartsAt.UTC().Truncate(time.Second),
+		EndsAt:      body.EndsAt.UTC().Truncate(time.Second),
+		UploadIDs:   []int64{},
+	}
+	if b.Name == "" || len([]rune(b.Name)) > maxBannerNameLength {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("name is required and must be at most %d characters", maxBannerNameLength))
+		return nil
+	}
+	if len([]rune(b.Description)) > maxBannerDescriptionLength {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("description must be at most %d characters", maxBannerDescriptionLength))
+		return nil
+	}
+	if b.RateUp == 0 {
+		b.RateUp = defaultBannerRateUp
+	}
+	if b.RateUp < 1 || b.RateUp > maxBannerRateUp {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("rate_up must be between 1 and %d", maxBannerRateUp))
+		return nil
+	}
+	if b.StartsAt.IsZero() || !b.EndsAt.After(b.StartsAt) {
+		respondError(w, http.StatusBadRequest, "starts_at and ends_at are required, and ends_at must be after starts_at")
+		return nil
+	}
+
+	tags, err := models.NormalizeTags(body.Tags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	b.Tags = append([]string{}, tags...)
+	if len(body.UploadIDs) > maxBannerUploads {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("A banner can list at most %d uploads", maxBannerUploads))
+		return nil
+	}
+	for _, id := range body.UploadIDs {
+		if upload, err := models.GetUpload(r.Context(), id); err == sql.ErrNoRows || (err == nil && upload.GuildID != b.GuildID) {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Upload %d does not exist in the banner's guild", id))
+			return nil
+		} else if err != nil {
+			log.Printf("Failed to get upload %d: %v", id, err)
+			respondError(w, http.StatusInternalServerError, "Failed to save banner")
+			return nil
+		}
+		b.UploadIDs = append(b.UploadIDs, id)
+	}
+	if len(b.UploadIDs) == 0 && len(b.Tags) == 0 {
+		respondError(w, http.StatusBadRequest, "A banner must feature at least one upload or tag")
+		return nil
+	}
+	return b
+}
+
+// AdminCreateBannerHandler creates a banner, in the admin's current guild
+// unless the body names another
+func AdminCreateBannerHandler(w http.ResponseWriter, r *http.Request) {
+	banner := parseBanner(w, r, middleware.GetGuildID(r))
+	if banner == nil {
+		return
+	}
+	banner.CreatedBy = middleware.GetRealDiscordID(r)
+
+	if err := models.CreateBanner(r.Context(), banner); err != nil {
+		log.Printf("Failed to create banner: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to save banner")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) created banner %d (%s)", middleware.GetUsername(r), banner.CreatedBy, banner.ID, banner.Name)
+	recordAudit(r, banner.CreatedBy, models.AuditBannerCreate, bannerTarget(banner.ID), banner.Name)
+	writeJSON(w, http.StatusCreated, newBannerResponse(banner, true))
+}
+
+// AdminUpdateBannerHandler replaces a banner's settings and featured
+// wallpapers. It stays in its guild unless the body names another.
+func AdminUpdateBannerHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid banner ID")
+		return
+	}
+	existing, err := models.GetBanner(r.Context(), id)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Banner not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get banner %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save banner")
+		return
+	}
+	banner := parseBanner(w, r, existing.GuildID)
+	if banner == nil {
+		return
+	}
+	banner.ID = id
+
+	if err := models.UpdateBanner(r.Context(), banner); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Banner not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to update banner %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save banner")
+		return
+	}
+
+	actorID := middleware.GetRealDiscordID(r)
+	log.Printf("Admin %s (ID: %s) updated banner %d (%s)", middleware.GetUsername(r), actorID, id, banner.Name)
+	recordAudit(r, actorID, models.AuditBannerUpdate, bannerTarget(id), banner.Name)
+	writeJSON(w, http.StatusOK, newBannerResponse(banner, true))
+}
+
+// AdminDeleteBannerHandler removes a banner
+func AdminDeleteBannerHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid banner ID")
+		return
+	}
+
+	if err := models.DeleteBanner(r.Context(), id); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Banner not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete banner %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete banner")
+		return
+	}
+
+	actorID := middleware.GetRealDiscordID(r)
+	log.Printf("Admin %s (ID: %s) deleted banner %d", middleware.GetUsername(r), actorID, id)
+	recordAudit(r, actorID, models.AuditBannerDelete, bannerTarget(id), "")
+	w.WriteHeader(http.StatusNoContent)
+}
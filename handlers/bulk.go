@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+)
+
+// bulkAuditActions maps each bulk action to the action recorded per upload
+var bulkAuditActions = map[string]string{
+	models.BulkApprove: models.AuditBulkApprove,
+	models.BulkReject:  models.AuditBulkReject,
+	models.BulkDelete:  models.AuditBulkDelete,
+	models.BulkTag:     models.AuditBulkTag,
+}
+
+// BulkResultResponse is the outcome of a bulk action on one upload
+type BulkResultResponse struct {
+	UploadID int64  `json:"upload_id"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// AdminBulkUploadsHandler applies approve, reject, delete or tag to a list of
+// uploads in one transaction and reports what happened to each. Rejecting
+// needs a reason and a note for the uploaders.
+func AdminBulkUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs    []int64  `json:"ids"`
+		Action string   `json:"action"`
+		Tags   []string `json:"tags"`
+		Reason string   `json:"reason"`
+		Note   string   `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	auditAction, ok := bulkAuditActions[req.Action]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "action must be approve, reject, delete or tag")
+		return
+	}
+
+	seen := make(map[int64]bool, len(req.IDs))
+	var ids []int64
+	for _, id := range req.IDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		respondError(w, http.StatusBadRequest, "ids must list at least one upload")
+		return
+	}
+	if len(ids) > models.MaxBulkUploads {
+		respondError(w, http.StatusBadRequest, "ids may list at most "+strconv.Itoa(models.MaxBulkUploads)+" uploads")
+		return
+	}
+
+	var tags []string
+	if req.Action == models.BulkTag {
+		var err error
+		if tags, err = models.NormalizeTags(req.Tags); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(tags) == 0 {
+			respondError(w, http.StatusBadRequest, "tags must list at least one tag")
+			return
+		}
+	}
+
+	var rejection *models.Rejection
+	details := strings.Join(tags, ",")
+	if req.Action == models.BulkReject {
+		var err error
+		if rejection, err = newRejection(r, req.Reason, req.Note); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		details = rejection.Reason
+	}
+
+	results, err := models.BulkModerate(r.Context(), ids, req.Action, tags, rejection)
+	if err != nil {
+		log.Printf("Failed to %s uploads %v: %v", req.Action, ids, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update uploads")
+		return
+	}
+
+	adminID := middleware.GetRealDiscordID(r)
+	resp := make([]BulkResultResponse, 0, len(results))
+	var done int
+	for _, res := range results {
+		resp = append(resp, BulkResultResponse{UploadID: res.UploadID, Status: res.Status, Reason: res.Reason})
+		if res.Status != models.BulkDone {
+			continue
+		}
+		done++
+		recordAudit(r, adminID, auditAction, uploadTarget(res.UploadID), details)
+
+		switch {
+		case res.Published:
+			upload, err := models.GetUpload(r.Context(), res.UploadID)
+			if err != nil {
+				log.Printf("Failed to load approved upload %d: %v", res.UploadID, err)
+				continue
+			}
+			AnnounceUpload(upload)
+		case req.Action == models.BulkReject:
+			upload, err := models.GetUpload(r.Context(), res.UploadID)
+			if err != nil {
+				log.Printf("Failed to load rejected upload %d: %v", res.UploadID, err)
+				continue
+			}
+			notify.UploadRejected(upload, rejection.Summary())
+		}
+	}
+
+	log.Printf("Admin %s (ID: %s) applied %s to %d of %d uploads", middleware.GetUsername(r), adminID, req.Action, done, len(ids))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"action":  req.Action,
+		"updated": done,
+		"results": resp,
+	})
+}
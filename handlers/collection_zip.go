@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// maxDownloadIDs bounds how many wallpapers a download can pick by ID
+const maxDownloadIDs = 1000
+
+// CollectionDownloadHandler streams a zip of the wallpapers in the signed-in
+// user's collection, or of those picked with ids=1,2,3. The archive is built
+// while it is sent, and refused up front when its files add up to more than
+// max_collection_download_mb.
+func CollectionDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	ids, err := parseDownloadIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	uploads, err := models.CollectionUploads(r.Context(), discordID, ids)
+	if err != nil {
+		log.Printf("Failed to list collection of user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to download collection")
+		return
+	}
+	if len(uploads) == 0 {
+		respondError(w, http.StatusNotFound, "There are no wallpapers in your collection to download")
+		return
+	}
+
+	var total int64
+	for _, u := range uploads {
+		total += u.FileSize
+	}
+	if limit := int64(config.AppConfig.MaxDownloadSizeMB) * 1024 * 1024; limit > 0 && total > limit {
+		apiError(w, http.StatusRequestEntityTooLarge, codeDownloadTooLarge,
+			fmt.Sprintf("These wallpapers add up to %s, more than the %s a download may hold; pick fewer with ids", formatBytes(total), formatBytes(limit)))
+		return
+	}
+
+	log.Printf("User %s (ID: %s) downloading %d wallpapers (%s) from their collection", username, discordID, len(uploads), formatBytes(total))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "wallpaper-gacha-collection.zip"}))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Headers are sent by now, so failures below can only be logged and
+	// leave the client with a truncated zip
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	for _, u := range uploads {
+		if err := addUploadFile(zw, "", u); err != nil {
+			log.Printf("Failed to add upload %d to collection download of user %s (ID: %s): %v", u.ID, username, discordID, err)
+			if !os.IsNotExist(err) {
+				return
+			}
+		}
+	}
+}
+
+// parseDownloadIDs reads a comma-separated list of upload IDs, which may be
+// empty
+func parseDownloadIDs(raw string) ([]int64, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	parts := strings.Split(raw, ",")
+	if len(parts) > maxDownloadIDs {
+		return nil, fmt.Errorf("ids may list at most %d wallpapers", maxDownloadIDs)
+	}
+	ids := make([]int64, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("ids must be a comma-separated list of wallpaper IDs")
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
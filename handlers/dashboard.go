@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+const (
+	// Period covered by the daily series unless ?days= says otherwise
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+	// Number of most used tags listed
+	statsTopTags = 10
+	// How long computed statistics are served before they are gathered again
+	statsCacheTTL = 5 * time.Minute
+)
+
+type DailyCountResponse struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+type NamedCountResponse struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type SiteTotalsResponse struct {
+	Uploads        int   `json:"uploads"`
+	TrashedUploads int   `json:"trashed_uploads"`
+	Users          int   `json:"users"`
+	Pulls          int   `json:"pulls"`
+	ActiveUsers    int   `json:"active_users"`
+	PendingReports int   `json:"pending_reports"`
+	StorageBytes   int64 `json:"storage_bytes"`
+}
+
+// SiteStatsResponse is the admin dashboard's view of the site. PullCounts
+// groups pullable wallpapers by how often they have been drawn, which shows
+// how evenly the pool is spread.
+type SiteStatsResponse struct {
+	Days              int                  `json:"days"`
+	GeneratedAt       time.Time            `json:"generated_at"`
+	Totals            SiteTotalsResponse   `json:"totals"`
+	UploadsPerDay     []DailyCountResponse `json:"uploads_per_day"`
+	PullsPerDay       []DailyCountResponse `json:"pulls_per_day"`
+	ActiveUsersPerDay []DailyCountResponse `json:"active_users_per_day"`
+	PullCounts        []NamedCountResponse `json:"pull_counts"`
+	TopTags           []NamedCountResponse `json:"top_tags"`
+}
+
+func newDailyCountResponses(counts []models.DailyCount) []DailyCountResponse {
+	list := make([]DailyCountResponse, 0, len(counts))
+	for _, c := range counts {
+		list = append(list, DailyCountResponse{Day: c.Day, Count: c.Count})
+	}
+	return list
+}
+
+func newNamedCountResponses(counts []models.NamedCount) []NamedCountResponse {
+	list := make([]NamedCountResponse, 0, len(counts))
+	for _, c := range counts {
+		list = append(list, NamedCountResponse{Name: c.Name, Count: c.Count})
+	}
+	return list
+}
+
+// statsCache holds recently computed statistics by period, so a dashboard
+// refreshing itself doesn't rerun the aggregate queries each time
+var statsCache = struct {
+	sync.Mutex
+	entries map[int]SiteStatsResponse
+}{entries: make(map[int]SiteStatsResponse)}
+
+// AdminStatsHandler returns site totals and daily series for the last ?days=
+// days (30 by default), cached for five minutes
+func AdminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	days := defaultStatsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsDays {
+			respondError(w, http.StatusBadRequest, "days must be between 1 and "+strconv.Itoa(maxStatsDays))
+			return
+		}
+		days = n
+	}
+
+	statsCache.Lock()
+	defer statsCache.Unlock()
+	if cached, ok := statsCache.entries[days]; ok && time.Since(cached.GeneratedAt) < statsCacheTTL {
+		writeJSON(w, http.StatusOK, cached)
+		return
+	}
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	stats, err := models.GetSiteStats(r.Context(), today.AddDate(0, 0, 1-days), statsTopTags)
+	if err != nil {
+		log.Printf("Failed to gather site statistics: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to gather statistics")
+		return
+	}
+
+	resp := SiteStatsResponse{
+		Days:        days,
+		GeneratedAt: now,
+		Totals: SiteTotalsResponse{
+			Uploads:        stats.Uploads,
+			TrashedUploads: stats.TrashedUploads,
+			Users:          stats.Users,
+			Pulls:          stats.Pulls,
+			ActiveUsers:    stats.ActiveUsers,
+			PendingReports: stats.PendingReports,
+			StorageBytes:   stats.StorageBytes,
+		},
+		UploadsPerDay:     newDailyCountResponses(stats.UploadsPerDay),
+		PullsPerDay:       newDailyCountResponses(stats.PullsPerDay),
+		ActiveUsersPerDay: newDailyCountResponses(stats.ActiveUsersPerDay),
+		PullCounts:        newNamedCountResponses(stats.PullCounts),
+		TopTags:           newNamedCountResponses(stats.TopTags),
+	}
+	statsCache.entries[days] = resp
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type DailyValueResponse struct {
+	Day   string `json:"day"`
+	Value int64  `json:"value"`
+}
+
+// TimeSeriesResponse is a metric for each UTC day of a period, from the
+// daily statistics rollup. Days not rolled up yet are left out.
+type TimeSeriesResponse struct {
+	Metric string               `json:"metric"`
+	From   string               `json:"from"`
+	To     string               `json:"to"`
+	Points []DailyValueResponse `json:"points"`
+}
+
+// TimeSeriesHandler returns one metric of the daily statistics rollup from
+// ?from= to ?to= (YYYY-MM-DD, both included), by default the last 30 days
+func TimeSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	metric := strings.ToLower(strings.TrimSpace(query.Get("metric")))
+	if !slices.Contains(models.TimeSeriesMetrics, metric) {
+		respondError(w, http.StatusBadRequest, "metric must be one of: "+strings.Join(models.TimeSeriesMetrics, ", "))
+		return
+	}
+
+	now := time.Now().UTC()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "to must be a date such as 2026-01-31")
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, 1-defaultStatsDays)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "from must be a date such as 2026-01-01")
+			return
+		}
+		from = t
+	}
+	if from.After(to) {
+		respondError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	if to.Sub(from) >= maxStatsDays*24*time.Hour {
+		respondError(w, http.StatusBadRequest, "The period may be at most "+strconv.Itoa(maxStatsDays)+" days")
+		return
+	}
+
+	values, err := models.ListDailyStats(r.Context(), metric, from, to)
+	if err != nil {
+		log.Printf("Failed to list daily %s: %v", metric, err)
+		respondError(w, http.StatusInternalServerError, "Failed to gather statistics")
+		return
+	}
+
+	resp := TimeSeriesResponse{
+		Metric: metric,
+		From:   from.Format(time.DateOnly),
+		To:     to.Format(time.DateOnly),
+		Points: make([]DailyValueResponse, 0, len(values)),
+	}
+	for _, v := range values {
+		resp.Points = append(resp.Points, DailyValueResponse{Day: v.Day, Value: v.Value})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// DeleteUploadHandler lets a user delete one of their own uploads. The upload
+// is moved to the trash, where admins can restore it until it is purged.
+func DeleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete upload")
+		return
+	}
+
+	if upload.DeletedAt.Valid {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	if upload.DiscordID != discordID {
+		log.Printf("Delete denied: user %s (ID: %s) does not own upload %d", username, discordID, uploadID)
+		apiError(w, http.StatusForbidden, codeNotOwner, "You can only delete your own uploads")
+		return
+	}
+
+	err = models.SoftDeleteUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete upload %d for user %s (ID: %s): %v", uploadID, username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete upload")
+		return
+	}
+
+	log.Printf("Upload deleted: user %s (ID: %s) moved upload %d ('%s') to the trash", username, discordID, uploadID, upload.OriginalFilename)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditDelete, uploadTarget(uploadID), upload.OriginalFilename)
+	w.WriteHeader(http.StatusNoContent)
+}
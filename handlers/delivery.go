@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+	"github.com/gorilla/mux"
+)
+
+// DeliveryResponse is the admin view of a queued webhook notification
+type DeliveryResponse struct {
+	ID            int64      `json:"id"`
+	URL           string     `json:"url"`
+	Event         string     `json:"event"`
+	Payload       string     `json:"payload"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+func newDeliveryResponse(d *models.Delivery) DeliveryResponse {
+	resp := DeliveryResponse{
+		ID:            d.ID,
+		URL:           d.URL,
+		Event:         d.Event,
+		Payload:       d.Payload,
+		Status:        d.Status,
+		Attempts:      d.Attempts,
+		NextAttemptAt: d.NextAttemptAt,
+		LastError:     d.LastError,
+		CreatedAt:     d.CreatedAt,
+	}
+	if d.DeliveredAt.Valid {
+		resp.DeliveredAt = &d.DeliveredAt.Time
+	}
+	return resp
+}
+
+// AdminDeliveriesHandler lists webhook deliveries, optionally filtered by
+// status (pending, in_flight, delivered or dead)
+func AdminDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", models.DeliveryPending, models.DeliveryInFlight, models.DeliveryDelivered, models.DeliveryDead:
+	default:
+		respondError(w, http.StatusBadRequest, "status must be pending, in_flight, delivered or dead")
+		return
+	}
+
+	deliveries, total, err := models.ListDeliveries(r.Context(), status, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list deliveries: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list deliveries")
+		return
+	}
+
+	items := make([]DeliveryResponse, 0, len(deliveries))
+	for i := range deliveries {
+		items = append(items, newDeliveryResponse(&deliveries[i]))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"deliveries": items,
+		"page":       page,
+		"per_page":   perPage,
+		"total":      total,
+	})
+}
+
+// AdminRetryDeliveryHandler puts a dead-lettered delivery back in the queue
+// with a fresh attempt budget
+func AdminRetryDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid delivery ID")
+		return
+	}
+
+	delivery, err := models.RetryDeadDelivery(r.Context(), id)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "No dead delivery with that ID")
+		return
+	} else if err != nil {
+		log.Printf("Failed to retry delivery %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to retry delivery")
+		return
+	}
+	webhooks.Wake()
+
+	log.Printf("Admin %s (ID: %s) requeued delivery %d", middleware.GetUsername(r), middleware.GetRealDiscordID(r), id)
+	writeJSON(w, http.StatusOK, newDeliveryResponse(delivery))
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// discordImportCounts tallies the attachments a Discord channel import went
+// through
+type discordImportCounts struct {
+	imported, skipped, failed int
+}
+
+// ImportDiscordChannel imports the wallpapers members posted to the
+// discord_import channel since it was last checked, the whole history the
+// first time. Each image attached to a message runs through the upload
+// pipeline, with the same checks and duplicate detection as web uploads, as
+// an upload by the member who posted it, and is added to the channel's
+// guild. Attachments are identified by message and attachment ID, so none is
+// imported twice.
+func ImportDiscordChannel() error {
+	ctx := context.Background()
+	channelID := config.AppConfig.DiscordImport.ChannelID
+	if channelID == "" {
+		return nil
+	}
+
+	channel, err := discord.GetChannel(ctx, channelID)
+	if err != nil {
+		return err
+	}
+	if !config.AppConfig.IsAllowedGuild(channel.GuildID) {
+		return fmt.Errorf("channel %s is not in one of the configured guilds", channelID)
+	}
+	after, err := models.GetDiscordImportCursor(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("failed to get the last imported message: %w", err)
+	}
+
+	var counts discordImportCounts
+	defer func() {
+		log.Printf("Discord import: imported %d wallpapers from #%s, skipped %d imported before, %d failed", counts.imported, channel.Name, counts.skipped, counts.failed)
+	}()
+	for {
+		messages, err := discord.GetChannelMessages(ctx, channelID, after)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		for i := range messages {
+			if err := importDiscordMessage(ctx, channel.GuildID, &messages[i], &counts); err != nil {
+				// Picked up again from this message on the next run
+				return err
+			}
+			after = messages[i].ID
+			if err := models.SetDiscordImportCursor(ctx, channelID, after); err != nil {
+				return fmt.Errorf("failed to record the last imported message: %w", err)
+			}
+		}
+	}
+}
+
+// importDiscordMessage imports the images attached to a message. Attachments
+// that are refused are counted as failed and passed over; an error is only
+// returned when the message should be tried again, such as when Discord or
+// the database can't be reached.
+func importDiscordMessage(ctx context.Context, guildID string, m *discord.ChannelMessage, counts *discordImportCounts) error {
+	if m.Author.Bot {
+		return nil
+	}
+	var attachments []discord.Attachment
+	for _, a := range m.Attachments {
+		if Importable(a.Filename) {
+			attachments = append(attachments, a)
+		}
+	}
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	user, err := discordImportUser(ctx, &m.Author)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		log.Printf("Discord import: skipping message %s by banned user %s", m.ID, m.Author.ID)
+		counts.failed += len(attachments)
+		return nil
+	}
+
+	title, description := discordImportText(m.Content)
+	maxSize := int64(config.AppConfig.MaxFileSizeMB) * 1024 * 1024
+	for _, a := range attachments {
+		externalID := m.ID + "/" + a.ID
+		if _, err := models.FindImportedUpload(ctx, models.SourceDiscord, externalID); err == nil {
+			counts.skipped++
+			continue
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		if a.Size > maxSize {
+			log.Printf("Discord import: skipping %s (%s): file too large (max %dMB)", externalID, a.Filename, config.AppConfig.MaxFileSizeMB)
+			counts.failed++
+			continue
+		}
+
+		upload, err := importDiscordAttachment(ctx, user, a, externalID, maxSize, ImportDetails{
+			Title:       title,
+			Description: description,
+			GuildID:     guildID,
+			Source:      models.SourceDiscord,
+		})
+		switch {
+		case errors.Is(err, ErrAlreadyImported):
+			counts.skipped++
+		case errors.Is(err, errAttachmentUnavailable):
+			return err
+		case err != nil:
+			log.Printf("Discord import: skipping %s (%s) by %s: %v", externalID, a.Filename, m.Author.Username, err)
+			counts.failed++
+		default:
+			log.Printf("Discord import: imported %s (%s) by %s as upload %d", externalID, a.Filename, m.Author.Username, upload.ID)
+			counts.imported++
+		}
+	}
+	return nil
+}
+
+// errAttachmentUnavailable is returned by importDiscordAttachment when the
+// file couldn't be downloaded
+var errAttachmentUnavailable = errors.New("attachment unavailable")
+
+// importDiscordAttachment downloads an attachment under its own name, which
+// the upload pipeline checks the format by, and imports it
+func importDiscordAttachment(ctx context.Context, user *models.User, a discord.Attachment, externalID string, maxSize int64, details ImportDetails) (*models.Upload, error) {
+	dir, err := os.MkdirTemp("", "wallpaper-discord-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, filepath.Base(filepath.Clean("/"+a.Filename)))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	err = discord.DownloadAttachment(ctx, a, f, maxSize)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errAttachmentUnavailable, externalID, err)
+	}
+	return ImportFile(ctx, user, path, externalID, details)
+}
+
+// discordImportUser returns the account a message's images are attributed
+// to: its author's, created if they never signed in, or the main account
+// theirs is linked to. It returns nil for banned users.
+func discordImportUser(ctx context.Context, author *discord.User) (*models.User, error) {
+	user, err := models.GetOrCreateUser(ctx, author.ID, author.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user.LinkedTo != "" {
+		if user, err = models.GetUser(ctx, user.LinkedTo); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := models.GetActiveBan(ctx, user.DiscordID); err == nil {
+		return nil, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	return user, nil
+}
+
+// discordImportText splits a message's text into the title and description
+// of the wallpapers attached to it: the first line, if short enough to be a
+// title, and the rest
+func discordImportText(content string) (string, string) {
+	content = sanitizeText(content)
+	title, description, _ := strings.Cut(content, "\n")
+	title = strings.TrimSpace(title)
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		title, description = "", content
+	}
+	description = strings.TrimSpace(description)
+	if runes := []rune(description); len(runes) > maxDescriptionLength {
+		description = string(runes[:maxDescriptionLength])
+	}
+	return title, description
+}
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Maximum number of drafts a user may have staged at once
+const maxDraftsPerUser = 5
+
+// DraftResponse is the public representation of an upload draft
+type DraftResponse struct {
+	ID               int64     `json:"id"`
+	OriginalFilename string    `json:"original_filename"`
+	Title            string    `json:"title"`
+	Description      string    `json:"description"`
+	Tags             []string  `json:"tags"`
+	License          string    `json:"license,omitempty"`
+	Visibility       string    `json:"visibility"`
+	FileSize         int64     `json:"file_size"`
+	FileURL          string    `json:"file_url"`
+	CreatedAt        time.Time `json:"created_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+func newDraftResponse(r *http.Request, d models.Draft) DraftResponse {
+	if d.Tags == nil {
+		d.Tags = []string{}
+	}
+	return DraftResponse{
+		ID:               d.ID,
+		OriginalFilename: d.OriginalFilename,
+		Title:            d.Title,
+		Description:      d.Description,
+		Tags:             d.Tags,
+		License:          d.License,
+		Visibility:       d.Visibility,
+		FileSize:         d.FileSize,
+		FileURL:          middleware.ContentURL(r, fmt.Sprintf("/api/drafts/%d/file", d.ID), nil),
+		CreatedAt:        d.CreatedAt,
+		ExpiresAt:        d.ExpiresAt,
+	}
+}
+
+func draftTTL() time.Duration {
+	return time.Duration(config.AppConfig.DraftTTLMinutes) * time.Minute
+}
+
+// loadDraft fetches the signed-in user's draft named in the URL, writing an
+// error response and returning nil when it can't be used
+func loadDraft(w http.ResponseWriter, r *http.Request) *models.Draft {
+	draftID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid draft ID")
+		return nil
+	}
+
+	draft, err := models.GetDraft(r.Context(), draftID, middleware.GetDiscordID(r))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Draft not found or expired")
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to get draft %d: %v", draftID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get draft")
+		return nil
+	}
+	return draft
+}
+
+// CreateDraftHandler stages a file and its metadata as a draft the user can
+// come back to and publish later
+func CreateDraftHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	drafts, err := models.ListDrafts(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to list drafts for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create draft")
+		return
+	}
+	if len(drafts) >= maxDraftsPerUser {
+		apiError(w, http.StatusConflict, codeLimitReached, fmt.Sprintf("You can have at most %d drafts; publish or discard one first", maxDraftsPerUser))
+		return
+	}
+	if refuseLowDisk(w, username, discordID) {
+		return
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	maxMB := maxFileSizeMB(user)
+	maxSize := int64(maxMB) * 1024 * 1024
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	if err := r.ParseMultipartForm(maxSize); err != nil {
+		apiError(w, http.StatusBadRequest, codeFileTooLarge, fmt.Sprintf("File too large (max %dMB)", maxMB))
+		return
+	}
+
+	title, description, tags, err := validateUploadMetadata(r.FormValue("title"), r.FormValue("description"), strings.Split(r.FormValue("tags"), ","))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	license, err := models.NormalizeLicense(r.FormValue("license"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visibility, err := models.NormalizeVisibility(r.FormValue("visibility"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	file, header, err := r.FormFile("wallpaper")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "No file provided")
+		return
+	}
+	defer file.Close()
+
+	// Content checks run when the draft is published; reject obvious
+	// mismatches early so users don't tag a file that can never be uploaded
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if _, ok := config.AppConfig.UploadFormats[ext]; !ok {
+		apiError(w, http.StatusBadRequest, codeInvalidFileType, invalidFileTypeMessage())
+		return
+	}
+
+	filename := uuid.New().String() + ext
+	destPath := storage.DraftPath(filename)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		log.Printf("Failed to create draft directory: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to save draft")
+		return
+	}
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		log.Printf("Failed to create draft file for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save draft")
+		return
+	}
+	written, err := io.Copy(destFile, file)
+	destFile.Close()
+	if err != nil {
+		log.Printf("Failed to write draft file for user %s (ID: %s): %v", username, discordID, err)
+		storage.RemoveDraft(filename)
+		respondError(w, http.StatusInternalServerError, "Failed to save draft")
+		return
+	}
+
+	draft := &models.Draft{
+		DiscordID:        discordID,
+		Filename:         filename,
+		OriginalFilename: header.Filename,
+		Title:            title,
+		Description:      description,
+		Tags:             tags,
+		License:          license,
+		Visibility:       visibility,
+		FileSize:         written,
+	}
+	if err := models.CreateDraft(r.Context(), draft, draftTTL()); err != nil {
+		log.Printf("Failed to record draft for user %s (ID: %s): %v", username, discordID, err)
+		storage.RemoveDraft(filename)
+		respondError(w, http.StatusInternalServerError, "Failed to save draft")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) saved draft %d for '%s'", username, discordID, draft.ID, header.Filename)
+	writeJSON(w, http.StatusCreated, newDraftResponse(r, *draft))
+}
+
+// DraftsHandler lists the signed-in user's unexpired drafts
+func DraftsHandler(w http.ResponseWriter, r *http.Request) {
+	drafts, err := models.ListDrafts(r.Context(), middleware.GetDiscordID(r))
+	if err != nil {
+		log.Printf("Failed to list drafts: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list drafts")
+		return
+	}
+
+	resp := make([]DraftResponse, 0, len(drafts))
+	for _, d := range drafts {
+		resp = append(resp, newDraftResponse(r, d))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// DraftHandler returns one of the signed-in user's drafts
+func DraftHandler(w http.ResponseWriter, r *http.Request) {
+	draft := loadDraft(w, r)
+	if draft == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, newDraftResponse(r, *draft))
+}
+
+// DraftFileHandler serves a draft's file so the upload UI can preview it
+func DraftFileHandler(w http.ResponseWriter, r *http.Request) {
+	if redirectToContentHost(w, r, "/api/drafts/"+mux.Vars(r)["id"]+"/file") {
+		return
+	}
+	draft := loadDraft(w, r)
+	if draft == nil {
+		return
+	}
+	serveImageFile(w, r, storage.DraftPath(draft.Filename))
+}
+
+// UpdateDraftHandler replaces a draft's metadata and extends its expiry
+func UpdateDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draft := loadDraft(w, r)
+	if draft == nil {
+		return
+	}
+
+	var req struct {
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		License     string   `json:"license"`
+		Visibility  string   `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	title, description, tags, err := validateUploadMetadata(req.Title, req.Description, req.Tags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	license, err := models.NormalizeLicense(req.License)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visibility, err := models.NormalizeVisibility(req.Visibility)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	draft.Title, draft.Description, draft.Tags, draft.License, draft.Visibility = title, description, tags, license, visibility
+	if err := models.UpdateDraft(r.Context(), draft, draftTTL()); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Draft not found or expired")
+		return
+	} else if err != nil {
+		log.Printf("Failed to update draft %d: %v", draft.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update draft")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newDraftResponse(r, *draft))
+}
+
+// DeleteDraftHandler discards a draft and its file
+func DeleteDraftHandler(w http.ResponseWriter, r *http.Request) {
+	draftID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid draft ID")
+		return
+	}
+
+	filename, err := models.DeleteDraft(r.Context(), draftID, middleware.GetDiscordID(r))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Draft not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete draft %d: %v", draftID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete draft")
+		return
+	}
+	storage.RemoveDraft(filename)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PublishDraftHandler runs a draft through the upload pipeline with the same
+// limits as a direct upload, then discards the draft
+func PublishDraftHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	draft := loadDraft(w, r)
+	if draft == nil {
+		return
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	if !admitUpload(w, r, user, username) {
+		return
+	}
+	defer limiter.release(discordID)
+
+	file, err := os.Open(storage.DraftPath(draft.Filename))
+	if err != nil {
+		log.Printf("Failed to open file of draft %d: %v", draft.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to read draft file")
+		return
+	}
+	defer file.Close()
+
+	upload, uerr := storeUpload(user, username, uploadInput{
+		ctx:         r.Context(),
+		file:        file,
+		filename:    draft.OriginalFilename,
+		title:       draft.Title,
+		description: draft.Description,
+		tags:        draft.Tags,
+		license:     draft.License,
+		visibility:  draft.Visibility,
+		guildID:     middleware.GetGuildID(r),
+		source:      models.SourceWeb,
+		limits:      uploadLimits(user),
+	})
+	if uerr != nil {
+		// The draft is kept so the user can retry or discard it
+		respondUploadError(w, r, uerr)
+		return
+	}
+
+	if _, err := models.DeleteDraft(r.Context(), draft.ID, discordID); err != nil && err != sql.ErrNoRows {
+		log.Printf("Warning: Failed to delete published draft %d: %v", draft.ID, err)
+	} else {
+		storage.RemoveDraft(draft.Filename)
+	}
+
+	respondUploaded(w, r, user, username, upload)
+}
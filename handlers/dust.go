@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// DustRatesResponse lists what dust is earned and spent for. Duplicate is
+// the dust a spare copy of each rarity converts into, which happens as it is
+// pulled when AutoConvert is set and otherwise only when the user asks.
+type DustRatesResponse struct {
+	AutoConvert   bool           `json:"auto_convert"`
+	Duplicate     map[string]int `json:"duplicate"`
+	PullCost      int            `json:"pull_cost"`
+	RarityCost    map[string]int `json:"rarity_cost"`
+	WallpaperCost int            `json:"wallpaper_cost"`
+}
+
+type DustEntryResponse struct {
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DustHandler shows the signed-in user's dust balance, the exchange rates
+// and a page of their dust history
+func (s *Server) DustHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	balance, err := s.Backend.DustBalance(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to get dust balance for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get dust")
+		return
+	}
+
+	page, perPage, offset := parsePagination(r)
+	entries, total, err := s.Backend.ListDustLedger(r.Context(), discordID, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list dust ledger for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get dust")
+		return
+	}
+
+	history := make([]DustEntryResponse, 0, len(entries))
+	for _, e := range entries {
+		history = append(history, DustEntryResponse{Amount: e.Amount, Reason: e.Reason, Reference: e.Reference, CreatedAt: e.CreatedAt})
+	}
+
+	cfg := s.Config()
+	rates := DustRatesResponse{
+		AutoConvert:   cfg.DustAutoConvert,
+		Duplicate:     cfg.DustRates,
+		PullCost:      cfg.DustPullCost,
+		RarityCost:    cfg.DustRarityCosts,
+		WallpaperCost: cfg.DustWallpaperCost,
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"balance":  balance,
+		"rates":    rates,
+		"history":  history,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// DustConvertHandler turns the signed-in user's spare copies into dust: those
+// of the wallpaper named by upload_id, or of every wallpaper without one.
+// The first copy of each wallpaper stays in the collection.
+func (s *Server) DustConvertHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		UploadID int64 `json:"upload_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UploadID < 0 {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	discordID := middleware.GetDiscordID(r)
+	copies, dust, err := s.Backend.ConvertSpareCopies(r.Context(), discordID, body.UploadID, s.Config().DustRates)
+	if err != nil {
+		log.Printf("Failed to convert spare copies for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to convert duplicates")
+		return
+	}
+	balance, err := s.Backend.DustBalance(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to get dust balance for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get dust")
+		return
+	}
+
+	if copies > 0 {
+		log.Printf("User %s converted %d spare copies into %d dust", discordID, copies, dust)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"converted": copies,
+		"dust":      dust,
+		"balance":   balance,
+	})
+}
+
+// DustExchangeHandler spends dust on a wallpaper the signed-in user doesn't
+// own yet: a random one, a random one of the given rarity, or the one named
+// by upload_id
+func (s *Server) DustExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		UploadID int64  `json:"upload_id"`
+		Rarity   string `json:"rarity"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UploadID < 0 {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	rarity, err := models.ParseRarity(body.Rarity)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "rarity must be one of: "+strings.Join(models.Rarities, ", "))
+		return
+	}
+	if rarity != "" && body.UploadID != 0 {
+		respondError(w, http.StatusBadRequest, "Give either upload_id or rarity, not both")
+		return
+	}
+
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+	user, err := s.Backend.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	result, err := s.Backend.ExchangeDust(r.Context(), user, middleware.GetGuildID(r), body.UploadID, rarity)
+	switch err {
+	case nil:
+	case models.ErrNotEnoughDust:
+		apiError(w, http.StatusConflict, codeInsufficientDust, "You don't have enough dust")
+		return
+	case models.ErrAlreadyOwned:
+		apiError(w, http.StatusConflict, codeAlreadyOwned, "You already have this wallpaper")
+		return
+	case gacha.ErrNotInPool:
+		respondError(w, http.StatusNotFound, "Wallpaper not found")
+		return
+	case gacha.ErrEmptyPool:
+		apiError(w, http.StatusNotFound, codeNothingToPull, "You already have every wallpaper")
+		return
+	default:
+		log.Printf("Dust exchange failed for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to exchange dust")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) exchanged dust for upload %d", username, discordID, result.Upload.ID)
+	writeJSON(w, http.StatusOK, s.newPullResponse(r, result))
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/assets"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// Link previews let links to wallpapers pasted into Discord and other chats
+// unfurl: /wallpapers/{id} is a page carrying OpenGraph and Twitter Card
+// tags, and /oembed describes it to consumers that ask. Both are public so
+// the crawlers fetching them needn't sign in, and so they only show uploads
+// in a public pool, without naming uploaders whose profiles are private.
+
+var wallpaperPage = assets.Page("wallpaper.html")
+
+// rarityColors are the theme colours of the rarities, which Discord uses for
+// the bar along an embed
+var rarityColors = map[string]string{
+	models.RarityCommon:    "#9e9e9e",
+	models.RarityRare:      "#3b82f6",
+	models.RarityEpic:      "#a855f7",
+	models.RarityLegendary: "#f59e0b",
+}
+
+// defaultThemeColor is used for uploads without a rarity
+const defaultThemeColor = "#5865F2"
+
+// wallpaperURLPattern matches the path of a wallpaper's page
+var wallpaperURLPattern = regexp.MustCompile(`^/wallpapers/([0-9]+)/?$`)
+
+func wallpaperPagePath(uploadID int64) string {
+	return "/wallpapers/" + strconv.FormatInt(uploadID, 10)
+}
+
+func wallpaperPreviewPath(uploadID int64) string {
+	return wallpaperPagePath(uploadID) + "/preview"
+}
+
+// wallpaperTitle is what an upload is called in previews
+func wallpaperTitle(u *models.Upload) string {
+	if u.Title != "" {
+		return u.Title
+	}
+	return u.OriginalFilename
+}
+
+// wallpaperSummary describes an upload in a line, e.g.
+// "Legendary wallpaper by alice, 3840×2160"
+func wallpaperSummary(u *models.Upload) string {
+	summary := "Wallpaper"
+	if u.Rarity != "" {
+		summary = rarityName(u.Rarity) + " wallpaper"
+	}
+	if u.UploaderName != "" {
+		summary += " by " + u.UploaderName
+	}
+	if u.Width > 0 && u.Height > 0 {
+		summary += fmt.Sprintf(", %d×%d", u.Width, u.Height)
+	}
+	return summary
+}
+
+func rarityName(rarity string) string {
+	if rarity == "" {
+		return ""
+	}
+	return strings.ToUpper(rarity[:1]) + rarity[1:]
+}
+
+// previewSize returns the size of an upload's thumbnail. Uploads are only
+// given a size when their format can be decoded, so ok is false for those
+// without a thumbnail.
+func previewSize(u *models.Upload) (w, h int, ok bool) {
+	if u.Width <= 0 || u.Height <= 0 {
+		return 0, 0, false
+	}
+	w, h = imaging.FitSize(u.Width, u.Height, thumbnailSize, thumbnailSize)
+	return w, h, true
+}
+
+// loadPreviewUpload resolves the {id} route variable to an upload that may be
+// previewed, writing a 404 page and returning nil otherwise
+func loadPreviewUpload(w http.ResponseWriter, r *http.Request) *models.Upload {
+	if !config.AppConfig.LinkPreviews {
+		http.NotFound(w, r)
+		return nil
+	}
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	upload, err := models.GetPublicUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		renderErrorPage(w, http.StatusNotFound, "Wallpaper not found", "This wallpaper doesn't exist or can't be shown outside the site.")
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		renderErrorPage(w, http.StatusInternalServerError, "Something went wrong", "The wallpaper couldn't be loaded, try again later.")
+		return nil
+	}
+	return upload
+}
+
+// WallpaperPageHandler renders the preview page of a wallpaper in a public
+// pool, whose meta tags chat apps build their link previews from
+func WallpaperPageHandler(w http.ResponseWriter, r *http.Request) {
+	upload := loadPreviewUpload(w, r)
+	if upload == nil {
+		return
+	}
+
+	base := siteURL(r)
+	page := struct {
+		Title, Description, URL, FullURL, OEmbedURL string
+		ImageURL, PreviewPath                       string
+		ImageWidth, ImageHeight                     int
+		Rarity, Uploader, Resolution, ThemeColor    string
+	}{
+		Title:       wallpaperTitle(upload),
+		Description: wallpaperSummary(upload),
+		URL:         base + wallpaperPagePath(upload.ID),
+		FullURL:     imagePath(upload.ID),
+		Rarity:      rarityName(upload.Rarity),
+		Uploader:    upload.UploaderName,
+		ThemeColor:  defaultThemeColor,
+	}
+	page.OEmbedURL = base + "/oembed?" + url.Values{"url": {page.URL}, "format": {"json"}}.Encode()
+	if color, ok := rarityColors[upload.Rarity]; ok {
+		page.ThemeColor = color
+	}
+	if width, height, ok := previewSize(upload); ok {
+		page.PreviewPath = wallpaperPreviewPath(upload.ID)
+		page.ImageURL = base + page.PreviewPath
+		page.ImageWidth, page.ImageHeight = width, height
+		page.Resolution = fmt.Sprintf("%d×%d", upload.Width, upload.Height)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := wallpaperPage.Execute(w, page); err != nil {
+		log.Printf("Failed to render wallpaper page: %v", err)
+	}
+}
+
+// WallpaperPreviewHandler serves the thumbnail of a wallpaper in a public
+// pool, the image of its link previews
+func WallpaperPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	upload := loadPreviewUpload(w, r)
+	if upload == nil {
+		return
+	}
+	thumbPath, ok := generateThumbnail(w, r, upload)
+	if !ok {
+		return
+	}
+	// Chat apps keep their own copy, so the file may be cached for a while
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	serveImageFile(w, r, thumbPath)
+}
+
+// OEmbedResponse describes a wallpaper's page to oEmbed consumers. It is a
+// photo, the wallpaper's thumbnail, when that fits the size asked for and
+// otherwise a link.
+type OEmbedResponse struct {
+	Version         string `json:"version"`
+	Type            string `json:"type"`
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name,omitempty"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	URL             string `json:"url,omitempty"`
+	Width           int    `json:"width,omitempty"`
+	Height          int    `json:"height,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+	Rarity          string `json:"rarity,omitempty"`
+}
+
+// OEmbedHandler answers oEmbed requests for the URL of a wallpaper's page on
+// this site, following https://oembed.com: only the JSON format is offered,
+// and maxwidth and maxheight are respected
+func OEmbedHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.AppConfig.LinkPreviews {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		apiError(w, http.StatusNotImplemented, middleware.CodeInvalidRequest, "Only the json format is supported")
+		return
+	}
+	maxWidth, maxHeight := thumbnailSize, thumbnailSize
+	for param, limit := range map[string]*int{"maxwidth": &maxWidth, "maxheight": &maxHeight} {
+		if v := query.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				respondError(w, http.StatusBadRequest, param+" must be a positive number")
+				return
+			}
+			*limit = n
+		}
+	}
+
+	base := siteURL(r)
+	site, _ := url.Parse(base)
+	target, err := url.Parse(query.Get("url"))
+	if err != nil || site == nil || !strings.EqualFold(target.Host, site.Host) {
+		respondError(w, http.StatusNotFound, "Not a wallpaper on this site")
+		return
+	}
+	match := wallpaperURLPattern.FindStringSubmatch(target.Path)
+	if match == nil {
+		respondError(w, http.StatusNotFound, "Not a wallpaper on this site")
+		return
+	}
+	uploadID, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Not a wallpaper on this site")
+		return
+	}
+	upload, err := models.GetPublicUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Wallpaper not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to describe wallpaper")
+		return
+	}
+
+	resp := OEmbedResponse{
+		Version:      "1.0",
+		Type:         "link",
+		Title:        wallpaperTitle(upload),
+		AuthorName:   upload.UploaderName,
+		ProviderName: "Wallpaper Gacha",
+		ProviderURL:  base + "/",
+		Rarity:       upload.Rarity,
+	}
+	if width, height, ok := previewSize(upload); ok && width <= maxWidth && height <= maxHeight {
+		preview := base + wallpaperPreviewPath(upload.ID)
+		resp.Type = "photo"
+		resp.URL, resp.Width, resp.Height = preview, width, height
+		resp.ThumbnailURL, resp.ThumbnailWidth, resp.ThumbnailHeight = preview, width, height
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
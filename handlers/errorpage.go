@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/assets"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+)
+
+var errorPage = assets.Page("error.html")
+
+// renderErrorPage shows a human-readable error for flows that end in the
+// browser, such as the OAuth callback, instead of a bare text response
+func renderErrorPage(w http.ResponseWriter, status int, title, message string) {
+	title, message = middleware.Translate(w, title), middleware.Translate(w, message)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := errorPage.Execute(w, struct{ Title, Message string }{title, message}); err != nil {
+		log.Printf("Failed to render error page: %v", err)
+	}
+}
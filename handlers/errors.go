@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+)
+
+// Error codes of failures particular to the site's features. Failures with no
+// more specific cause carry the code of their status; see
+// middleware.StatusCode.
+const (
+	codeInvalidFileType     = "INVALID_FILE_TYPE"
+	codeInvalidImage        = "INVALID_IMAGE"
+	codeFileTooLarge        = "FILE_TOO_LARGE"
+	codeImageDimensions     = "INVALID_DIMENSIONS"
+	codeDuplicateUpload     = "DUPLICATE_UPLOAD"
+	codeMalwareDetected     = "MALWARE_DETECTED"
+	codeUploadRejected      = "UPLOAD_REJECTED"
+	codeUploadRuleViolated  = "UPLOAD_RULE_VIOLATED"
+	codeUploadLimitReached  = "UPLOAD_LIMIT_REACHED"
+	codeStorageQuota        = "STORAGE_QUOTA_EXCEEDED"
+	codeServerBusy          = "SERVER_BUSY"
+	codeInsufficientStorage = "INSUFFICIENT_STORAGE"
+	codeSkipped             = "SKIPPED"
+	codeUploadOffset        = "UPLOAD_OFFSET_MISMATCH"
+	codeUploadIncomplete    = "UPLOAD_INCOMPLETE"
+	codeUploadInProgress    = "UPLOAD_IN_PROGRESS"
+	codeLimitReached        = "LIMIT_REACHED"
+	codeImpersonating       = "IMPERSONATING"
+	codeNotOwner            = "NOT_OWNER"
+	codeOwnResource         = "OWN_RESOURCE"
+	codeAlreadyOwned        = "ALREADY_OWNED"
+	codeAlreadyReported     = "ALREADY_REPORTED"
+	codeNothingToPull       = "NOTHING_TO_PULL"
+	codeInvalidRevealToken  = "INVALID_REVEAL_TOKEN"
+	codeNotRerollable       = "NOT_REROLLABLE"
+	codeNoRerollTokens      = "NO_REROLL_TOKENS"
+	codeRerollLimitReached  = "REROLL_LIMIT_REACHED"
+	codeInsufficientDust    = "INSUFFICIENT_DUST"
+	codeNoSpareCopy         = "NO_SPARE_COPY"
+	codeDownloadTooLarge    = "DOWNLOAD_TOO_LARGE"
+	codeTradeNotPending     = "TRADE_NOT_PENDING"
+	codeSearchUnavailable   = "SEARCH_UNAVAILABLE"
+	codeResourceUnavailable = "RESOURCE_UNAVAILABLE"
+	codeNotInCollection     = "NOT_IN_COLLECTION"
+	codeVotingClosed        = "VOTING_CLOSED"
+	codeAlreadyVoted        = "ALREADY_VOTED"
+	codeInvalidLinkCode     = "INVALID_LINK_CODE"
+	codeCannotLink          = "CANNOT_LINK"
+	codeEmptyPoolTier       = "EMPTY_POOL_TIER"
+)
+
+// uploadErrorCodes are the error codes of rejected uploads, by the reason
+// they are counted under in upload_rejections_total
+var uploadErrorCodes = map[string]string{
+	"extension":        codeInvalidFileType,
+	"content_mismatch": codeInvalidFileType,
+	"content_type":     codeInvalidFileType,
+	"corrupt":          codeInvalidImage,
+	"too_large":        codeFileTooLarge,
+	"resolution":       codeImageDimensions,
+	"aspect_ratio":     codeImageDimensions,
+	"duplicate":        codeDuplicateUpload,
+	"malware":          codeMalwareDetected,
+	"hook_rejected":    codeUploadRejected,
+	"upload_rule":      codeUploadRuleViolated,
+	"quota":            codeUploadLimitReached,
+	"storage_quota":    codeStorageQuota,
+	"busy":             codeServerBusy,
+	"disk_space":       codeInsufficientStorage,
+}
+
+// code returns the error code of a rejected or failed upload
+func (e *uploadError) code() string {
+	if code, ok := uploadErrorCodes[e.reason]; ok {
+		return code
+	}
+	return middleware.StatusCode(e.status)
+}
+
+// respondImpersonating refuses an action a user can only take for themselves
+// while an admin is viewing the site as them
+func respondImpersonating(w http.ResponseWriter, message string) {
+	apiError(w, http.StatusForbidden, codeImpersonating, message)
+}
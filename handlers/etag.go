@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Tables each conditional listing is built from
+var (
+	galleryTables     = []string{"uploads", "users", "upload_tags", "tags", "blobs"}
+	collectionTables  = []string{"pulls", "uploads", "users", "upload_tags", "tags", "blobs"}
+	leaderboardTables = []string{"pulls", "uploads", "users", "bans"}
+)
+
+// etagLifetime bounds how long a listing's ETag stays the same when its
+// tables don't change, so writes this process doesn't see, expiring bans and
+// signed content URLs in the listing can't be served stale for longer
+const etagLifetime = time.Minute
+
+// etagEpoch tells this process's ETags apart from those of earlier runs and
+// other instances, whose table versions count from elsewhere
+var etagEpoch = rand.Text()
+
+// notModified sets a weak ETag on a listing built from tables, derived from
+// their versions and from the request and user it is for, and answers 304
+// when it matches the client's If-None-Match. Handlers call it before
+// reading the tables and stop when it returns true.
+func notModified(w http.ResponseWriter, r *http.Request, tables ...string) bool {
+	h := sha256.New()
+	for _, part := range []string{
+		etagEpoch,
+		strconv.FormatInt(time.Now().Unix()/int64(etagLifetime.Seconds()), 10),
+		models.TableVersions(tables...),
+		middleware.GetDiscordID(r),
+		middleware.GetRealDiscordID(r),
+		middleware.GetGuildID(r),
+		r.URL.RequestURI(),
+	} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagMatches reports whether the request's If-None-Match lists etag. The
+// comparison is weak, as compressing a response weakens its ETag.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
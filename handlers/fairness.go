@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// PullSeedResponse is a day's pull seed. The seed is only shown once the
+// day is over; until then only its commitment, the SHA-256 of the seed's
+// bytes, is.
+type PullSeedResponse struct {
+	Day        string    `json:"day"`
+	Commitment string    `json:"commitment"`
+	Seed       string    `json:"seed,omitempty"`
+	RevealsAt  time.Time `json:"reveals_at"`
+}
+
+func newPullSeedResponse(s models.PullSeed, now time.Time) PullSeedResponse {
+	resp := PullSeedResponse{Day: s.Day, Commitment: s.Commitment, RevealsAt: s.RevealsAt()}
+	if s.Revealed(now) {
+		resp.Seed = s.Seed
+	}
+	return resp
+}
+
+// PullVerifyResponse is the draw behind a pull and, once its seed is
+// revealed, the rolls it gives and whether the pull follows from them.
+// The rolls are the first and second 8 bytes of the HMAC-SHA256 of
+// "<discord_id>:<nonce>" keyed with the seed's bytes, each taken as a
+// big-endian integer whose top 53 bits are divided by 2^53.
+type PullVerifyResponse struct {
+	PullID     int64             `json:"pull_id"`
+	DiscordID  string            `json:"discord_id"`
+	Day        string            `json:"day"`
+	Nonce      int64             `json:"nonce"`
+	Seed       PullSeedResponse  `json:"seed"`
+	Tiers      []models.TierRate `json:"tiers"`
+	Rarity     string            `json:"rarity"`
+	UploadID   int64             `json:"upload_id"`
+	PoolTotal  float64           `json:"pool_total"`
+	RangeStart float64           `json:"range_start"`
+	RangeEnd   float64           `json:"range_end"`
+	RarityRoll *float64          `json:"rarity_roll"`
+	PickRoll   *float64          `json:"pick_roll"`
+	Verified   *bool             `json:"verified"`
+	Mismatch   string            `json:"mismatch,omitempty"`
+}
+
+// PullSeedsHandler pages through the daily pull seeds, newest first, with the
+// seeds of days that are over revealed
+func PullSeedsHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	seeds, total, err := models.ListPullSeeds(r.Context(), perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list pull seeds: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list pull seeds")
+		return
+	}
+
+	now := time.Now()
+	items := make([]PullSeedResponse, 0, len(seeds))
+	for _, s := range seeds {
+		items = append(items, newPullSeedResponse(s, now))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"seeds":    items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// PullVerifyHandler shows the draw behind one of the signed-in user's pulls
+// and, once the day's seed is revealed, recomputes it from the seed
+func PullVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	pullID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid pull ID")
+		return
+	}
+
+	if _, err := models.GetPull(r.Context(), pullID, middleware.GetDiscordID(r)); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Pull not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get pull %d: %v", pullID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to verify pull")
+		return
+	}
+
+	d, err := models.GetDraw(r.Context(), pullID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "This pull wasn't drawn from a seed, so there is nothing to verify")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get the draw behind pull %d: %v", pullID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to verify pull")
+		return
+	}
+	seed, err := models.GetPullSeed(r.Context(), d.Day)
+	if err != nil {
+		log.Printf("Failed to get the pull seed for %s: %v", d.Day, err)
+		respondError(w, http.StatusInternalServerError, "Failed to verify pull")
+		return
+	}
+
+	resp := PullVerifyResponse{
+		PullID:     d.PullID,
+		DiscordID:  d.DiscordID,
+		Day:        d.Day,
+		Nonce:      d.Nonce,
+		Seed:       newPullSeedResponse(*seed, time.Now()),
+		Tiers:      append([]models.TierRate{}, d.Tiers...),
+		Rarity:     d.Rarity,
+		UploadID:   d.UploadID,
+		PoolTotal:  d.Total,
+		RangeStart: d.Start,
+		RangeEnd:   d.End,
+	}
+	if resp.Seed.Seed != "" {
+		secret, _ := hex.DecodeString(seed.Seed)
+		rarity, pick := models.DrawRolls(secret, d.DiscordID, d.Nonce)
+		resp.RarityRoll, resp.PickRoll = &rarity, &pick
+
+		err := models.VerifyDraw(d, seed)
+		verified := err == nil
+		resp.Verified = &verified
+		if err != nil {
+			resp.Mismatch = err.Error()
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
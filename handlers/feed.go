@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+const (
+	// How many of the newest uploads the feed lists
+	feedSize = 50
+	// How long a generated feed is served before it is rebuilt
+	feedCacheTTL = 5 * time.Minute
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Creator     string       `xml:"dc:creator"`
+	Description string       `xml:"description"`
+	Categories  []string     `xml:"category"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// cachedFeed is a generated feed along with its ETag
+type cachedFeed struct {
+	body    []byte
+	etag    string
+	builtAt time.Time
+}
+
+// feedCache holds the last generated feed of each guild so readers polling
+// it don't each hit the database
+var feedCache = struct {
+	sync.Mutex
+	feeds map[string]cachedFeed
+}{feeds: make(map[string]cachedFeed)}
+
+// siteURL returns the public base URL of the site, site_url in the config,
+// which defaults to that of the Discord redirect URI
+func siteURL(r *http.Request) string {
+	if config.AppConfig.SiteURL != "" {
+		return config.AppConfig.SiteURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// buildFeed renders the RSS feed of the guild's newest uploads
+func buildFeed(ctx context.Context, base, guildID string) ([]byte, error) {
+	uploads, _, err := models.ListUploads(ctx, models.UploadFilter{GuildID: guildID, Limit: feedSize})
+	if err != nil {
+		return nil, err
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		DC:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         "Wallpaper Gacha",
+			Link:          base + "/",
+			Description:   "Newly uploaded wallpapers",
+			LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+			Items:         make([]rssItem, 0, len(uploads)),
+		},
+	}
+	for _, u := range uploads {
+		title := u.Title
+		if title == "" {
+			title = u.OriginalFilename
+		}
+		description := u.Description
+		if len(u.Tags) > 0 {
+			description = strings.TrimSpace(description + "\n\nTags: " + strings.Join(u.Tags, ", "))
+		}
+		link := base + imagePath(u.ID)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       title,
+			Link:        link,
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+			PubDate:     u.UploadedAt.UTC().Format(time.RFC1123Z),
+			Creator:     u.UploaderName,
+			Description: description,
+			Categories:  u.Tags,
+			// Thumbnails are generated on first request, so their size isn't known
+			Enclosure: rssEnclosure{URL: base + thumbnailPath(u.ID), Type: "image/jpeg"},
+		})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FeedHandler serves an RSS feed of the current guild's newest uploads,
+// rebuilt at most every few minutes
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+	guildID := middleware.GetGuildID(r)
+	feedCache.Lock()
+	feed, ok := feedCache.feeds[guildID]
+	if !ok || time.Since(feed.builtAt) > feedCacheTTL {
+		body, err := buildFeed(r.Context(), siteURL(r), guildID)
+		if err != nil {
+			feedCache.Unlock()
+			log.Printf("Failed to build feed: %v", err)
+			http.Error(w, "Failed to build feed", http.StatusInternalServerError)
+			return
+		}
+		sum := sha256.Sum256(body)
+		feed = cachedFeed{body: body, etag: `"` + hex.EncodeToString(sum[:8]) + `"`, builtAt: time.Now()}
+		feedCache.feeds[guildID] = feed
+	}
+	feedCache.Unlock()
+	body, etag := feed.body, feed.etag
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(feedCacheTTL.Seconds())))
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(body)
+}
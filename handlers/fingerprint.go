@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// AltClusterResponse is a group of accounts suspected of being run by one
+// person, as they signed in from the same devices
+type AltClusterResponse struct {
+	Members         []AltClusterMemberResponse `json:"members"`
+	Fingerprints    int                        `json:"fingerprints"`
+	LastSeenAt      time.Time                  `json:"last_seen_at"`
+	Flagged         bool                       `json:"flagged"`
+	BannedMember    bool                       `json:"banned_member"`
+	CooldownEvasion bool                       `json:"cooldown_evasion"`
+}
+
+// AltClusterMemberResponse is one account of an AltClusterResponse
+type AltClusterMemberResponse struct {
+	DiscordID  string    `json:"discord_id"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Banned     bool      `json:"banned"`
+	Uploads    int       `json:"uploads"`
+}
+
+// deviceFingerprint returns a soft fingerprint of the device a request came
+// from: a hash of its User-Agent and the /24 (IPv4) or /48 (IPv6) network of
+// its address, so that it survives the address changing within a home or
+// mobile network. Only the hash is stored.
+func deviceFingerprint(r *http.Request) string {
+	network := middleware.ClientIP(r)
+	if addr, err := netip.ParseAddr(network); err == nil {
+		bits := 48
+		if addr.Is4() {
+			bits = 24
+		}
+		if prefix, err := addr.Prefix(bits); err == nil {
+			network = prefix.String()
+		}
+	}
+	sum := sha256.Sum256([]byte(r.UserAgent() + "|" + network))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordFingerprint stores the fingerprint of the device a user is signing
+// in from. Failures are only logged, as they shouldn't stop the sign-in.
+func recordFingerprint(r *http.Request, discordID string) {
+	if err := models.RecordFingerprint(r.Context(), discordID, deviceFingerprint(r)); err != nil {
+		log.Printf("Warning: Failed to record device fingerprint of user %s: %v", discordID, err)
+	}
+}
+
+// AdminAltClustersHandler lists the groups of accounts that signed in from
+// devices with the same fingerprint, flagged ones first: those mixing banned
+// and unbanned accounts, and those whose members uploaded closer together
+// than upload_cooldown_minutes within fingerprint_retention_days
+func AdminAltClustersHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+	cooldown := time.Duration(config.AppConfig.UploadCooldownMinutes) * time.Minute
+	since := time.Now().AddDate(0, 0, -config.AppConfig.FingerprintDays)
+
+	clusters, err := models.ListAltClusters(r.Context(), cooldown, since)
+	if err != nil {
+		log.Printf("Failed to list suspected alt accounts: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list suspected alt accounts")
+		return
+	}
+
+	items := []AltClusterResponse{}
+	for i := offset; i < len(clusters) && i < offset+perPage; i++ {
+		c := &clusters[i]
+		item := AltClusterResponse{
+			Members:         make([]AltClusterMemberResponse, 0, len(c.Members)),
+			Fingerprints:    c.Fingerprints,
+			LastSeenAt:      c.LastSeenAt,
+			Flagged:         c.Flagged(),
+			BannedMember:    c.BannedMember,
+			CooldownEvasion: c.CooldownEvasion,
+		}
+		for _, m := range c.Members {
+			item.Members = append(item.Members, AltClusterMemberResponse{
+				DiscordID:  m.DiscordID,
+				Username:   m.Username,
+				CreatedAt:  m.CreatedAt,
+				LastSeenAt: m.LastSeenAt,
+				Banned:     m.Banned,
+				Uploads:    m.Uploads,
+			})
+		}
+		items = append(items, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"clusters": items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    len(clusters),
+	})
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// Color search matches palette colors within this Euclidean RGB distance
+// unless the request sets tolerance; 442 spans the whole RGB cube
+const (
+	defaultColorTolerance = 30
+	maxColorTolerance     = 442
+)
+
+// WallpaperResponse is the public representation of an upload in listings
+type WallpaperResponse struct {
+	ID               int64      `json:"id"`
+	Filename         string     `json:"filename"`
+	OriginalFilename string     `json:"original_filename"`
+	Title            string     `json:"title"`
+	Description      string     `json:"description"`
+	FileSize         int64      `json:"file_size"`
+	UploaderID       string     `json:"uploader_id"`
+	UploaderName     string     `json:"uploader_name"`
+	UploadedAt       time.Time  `json:"uploaded_at"`
+	Tags             []string   `json:"tags"`
+	ImageURL         string     `json:"image_url"`
+	ThumbnailURL     string     `json:"thumbnail_url"`
+	BlurHash         string     `json:"blurhash,omitempty"`
+	License          string     `json:"license,omitempty"`
+	Visibility       string     `json:"visibility"`
+	GuildID          string     `json:"guild_id"`
+	Width            int        `json:"width,omitempty"`
+	Height           int        `json:"height,omitempty"`
+	DeviceClass      string     `json:"device_class,omitempty"`
+	Rarity           string     `json:"rarity"`
+	VotingEndsAt     *time.Time `json:"rarity_voting_ends_at,omitempty"`
+	Archived         bool       `json:"archived"`
+	Likes            int        `json:"likes"`
+	Palette          []string   `json:"palette"`
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"`
+	Source           string     `json:"source,omitempty"`
+	ExternalID       string     `json:"external_id,omitempty"`
+	PoolEnabled      *bool      `json:"pool_enabled,omitempty"`
+}
+
+type GalleryResponse struct {
+	Uploads []WallpaperResponse `json:"uploads"`
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+	Total   int                 `json:"total"`
+}
+
+// newWallpaperResponse builds the listing representation of an upload for the
+// current user, linking to its files on the content host when there is one.
+// Import provenance and whether it is in the pull pool are only included for
+// admins.
+func newWallpaperResponse(r *http.Request, u models.Upload) WallpaperResponse {
+	return wallpaperResponseWith(config.AppConfig, r, u)
+}
+
+// wallpaperResponseWith is newWallpaperResponse under the given configuration
+// rather than the loaded one
+func wallpaperResponseWith(cfg *config.Config, r *http.Request, u models.Upload) WallpaperResponse {
+	resp := wallpaperResponse(u, cfg.IsAdmin(middleware.GetRealDiscordID(r)))
+	resp.ImageURL = middleware.ContentURLWith(cfg, r, imagePath(u.ID), nil)
+	resp.ThumbnailURL = middleware.ContentURLWith(cfg, r, thumbnailPath(u.ID), nil)
+	return resp
+}
+
+// wallpaperResponse builds the listing representation of an upload, with
+// import provenance and pool_enabled if admin is set. Its files are linked by their paths on
+// the site, which work for anyone signed in.
+func wallpaperResponse(u models.Upload, admin bool) WallpaperResponse {
+	tags := u.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	resp := WallpaperResponse{
+		ID:               u.ID,
+		Filename:         u.Filename,
+		OriginalFilename: u.OriginalFilename,
+		Title:            u.Title,
+		Description:      u.Description,
+		FileSize:         u.FileSize,
+		UploaderID:       u.DiscordID,
+		UploaderName:     u.UploaderName,
+		UploadedAt:       u.UploadedAt,
+		Tags:             tags,
+		ImageURL:         imagePath(u.ID),
+		ThumbnailURL:     thumbnailPath(u.ID),
+		BlurHash:         u.BlurHash,
+		License:          u.License,
+		Visibility:       u.Visibility,
+		GuildID:          u.GuildID,
+		Width:            u.Width,
+		Height:           u.Height,
+		DeviceClass:      models.DeviceClass(u.Width, u.Height),
+		Rarity:           u.Rarity,
+		Archived:         u.Archived,
+		Likes:            u.LikeCount,
+		Palette:          u.Palette,
+	}
+	if resp.Palette == nil {
+		resp.Palette = []string{}
+	}
+	if u.DeletedAt.Valid {
+		resp.DeletedAt = &u.DeletedAt.Time
+	}
+	if u.RarityVotingEndsAt.Valid {
+		resp.VotingEndsAt = &u.RarityVotingEndsAt.Time
+	}
+	if admin {
+		resp.Source = u.Source
+		resp.ExternalID = u.ExternalID.String
+		resp.PoolEnabled = &u.PoolEnabled
+	}
+	return resp
+}
+
+// GalleryHandler lists uploads, newest or (with sort=popular) most liked
+// first, optionally filtered by tag, by license (a comma-separated list such
+// as "cc0,cc-by"), by minimum resolution, by orientation, by device class and
+// by palette color
+func GalleryHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+	filter, err := parseUploadFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Limit, filter.Offset = perPage, offset
+	if notModified(w, r, galleryTables...) {
+		return
+	}
+
+	uploads, total, err := models.ListUploads(r.Context(), filter)
+	if err != nil {
+		log.Printf("Failed to list uploads: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list uploads")
+		return
+	}
+
+	resp := GalleryResponse{
+		Uploads: make([]WallpaperResponse, 0, len(uploads)),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	for _, u := range uploads {
+		resp.Uploads = append(resp.Uploads, newWallpaperResponse(r, u))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseUploadFilter reads the tag, license, min_width, min_height,
+// orientation, class, pool, color, tolerance and sort query parameters, into
+// a filter of the current guild's uploads. Errors are suitable for showing to
+// the user.
+func parseUploadFilter(r *http.Request) (models.UploadFilter, error) {
+	query := r.URL.Query()
+	filter := models.UploadFilter{GuildID: middleware.GetGuildID(r), Tag: strings.ToLower(strings.TrimSpace(query.Get("tag")))}
+	licenses, err := models.ParseLicenseFilter(query.Get("license"))
+	if err != nil {
+		return filter, err
+	}
+	filter.Licenses = licenses
+
+	for name, dest := range map[string]*int{"min_width": &filter.MinWidth, "min_height": &filter.MinHeight} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return filter, errors.New(name + " must be a non-negative number of pixels")
+			}
+			*dest = n
+		}
+	}
+	filter.Orientation = strings.ToLower(strings.TrimSpace(query.Get("orientation")))
+	switch filter.Orientation {
+	case "", models.OrientationLandscape, models.OrientationPortrait, models.OrientationSquare:
+	default:
+		return filter, errors.New("orientation must be one of: landscape, portrait, square")
+	}
+	if filter.DeviceClass, err = models.ParseDeviceClass(query.Get("class")); err != nil {
+		return filter, err
+	}
+	filter.Pool = strings.ToLower(strings.TrimSpace(query.Get("pool")))
+	switch filter.Pool {
+	case "", models.PoolStandard, models.PoolArchive:
+	default:
+		return filter, errors.New("pool must be one of: standard, archive")
+	}
+	if v := query.Get("color"); v != "" {
+		if filter.Color, err = models.ParseColor(v); err != nil {
+			return filter, err
+		}
+		filter.Tolerance = defaultColorTolerance
+		if v := query.Get("tolerance"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxColorTolerance {
+				return filter, fmt.Errorf("tolerance must be between 0 and %d", maxColorTolerance)
+			}
+			filter.Tolerance = n
+		}
+	}
+	filter.Sort = strings.ToLower(strings.TrimSpace(query.Get("sort")))
+	switch filter.Sort {
+	case "", models.SortNewest, models.SortPopular:
+	default:
+		return filter, errors.New("sort must be one of: newest, popular")
+	}
+	return filter, nil
+}
+
+// TagsHandler returns tags matching the q prefix for autocomplete
+func TagsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > maxPageSize {
+		limit = 10
+	}
+
+	tags, err := models.SearchTags(r.Context(), strings.TrimSpace(r.URL.Query().Get("q")), limit)
+	if err != nil {
+		log.Printf("Failed to search tags: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to search tags")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tags": tags,
+	})
+}
+
+// AdminUpdateTagsHandler replaces the tags on any upload
+func AdminUpdateTagsHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	tags, err := models.NormalizeTags(req.Tags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload")
+		return
+	}
+
+	if err := models.SetUploadTags(r.Context(), upload.ID, tags); err != nil {
+		log.Printf("Failed to update tags on upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update tags")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) set tags on upload %d to %v", middleware.GetUsername(r), middleware.GetDiscordID(r), upload.ID, tags)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditSetTags, uploadTarget(upload.ID), strings.Join(tags, ","))
+
+	upload.Tags = tags
+	writeJSON(w, http.StatusOK, newWallpaperResponse(r, *upload))
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+)
+
+// GuildResponse is an allowed Discord server the user may browse
+type GuildResponse struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Current bool   `json:"current"`
+}
+
+// writeGuilds responds with the guilds the user may switch between and the
+// one they are browsing
+func writeGuilds(w http.ResponseWriter, r *http.Request, current string) {
+	guilds := middleware.GetGuilds(r)
+	items := make([]GuildResponse, 0, len(guilds))
+	for _, id := range guilds {
+		items = append(items, GuildResponse{ID: id, Name: config.AppConfig.GuildName(id), Current: id == current})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"current": current, "guilds": items})
+}
+
+// GuildsHandler lists the allowed servers the signed-in user is in, for the
+// guild selector. Admins may browse every one of them.
+func GuildsHandler(w http.ResponseWriter, r *http.Request) {
+	writeGuilds(w, r, middleware.GetGuildID(r))
+}
+
+// SelectGuildHandler switches the guild the session browses: its gallery,
+// pull pool, banners and leaderboards. API token requests pick a guild with
+// the X-Guild-ID header instead.
+func SelectGuildHandler(w http.ResponseWriter, r *http.Request) {
+	if middleware.GetAPITokenID(r) != 0 {
+		respondError(w, http.StatusBadRequest, "API token requests pick a guild with the "+middleware.GuildHeader+" header")
+		return
+	}
+
+	var body struct {
+		GuildID string `json:"guild_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.GuildID == "" {
+		respondError(w, http.StatusBadRequest, "guild_id is required")
+		return
+	}
+	if !slices.Contains(middleware.GetGuilds(r), body.GuildID) {
+		apiError(w, http.StatusForbidden, middleware.CodeNotInGuild, "You are not in that Discord server")
+		return
+	}
+
+	session, err := middleware.Store.Get(r, middleware.SessionName)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Invalid session")
+		return
+	}
+	middleware.SelectGuild(session, body.GuildID)
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to save guild selection for user %s: %v", middleware.GetRealDiscordID(r), err)
+		respondError(w, http.StatusInternalServerError, "Failed to save session")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) switched to guild %s", middleware.GetUsername(r), middleware.GetRealDiscordID(r), body.GuildID)
+	writeGuilds(w, r, body.GuildID)
+}
@@ -1,16 +1,20 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/Zinbhe/wallpaper-gacha/assets"
+	"github.com/Zinbhe/wallpaper-gacha/config"
 	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/oauth"
 )
 
 // HomeHandler serves the landing page
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	// Check if user is already authenticated
-	session, err := middleware.Store.Get(r, "wallpaper-session")
+	session, err := middleware.Store.Get(r, middleware.SessionName)
 	if err == nil {
 		if auth, ok := session.Values["authenticated"].(bool); ok && auth {
 			http.Redirect(w, r, "/upload", http.StatusSeeOther)
@@ -18,22 +22,40 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	content, err := assets.StaticFiles.ReadFile("static/index.html")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = homePage.Execute(w, struct {
+		Providers     []oauth.Provider
+		MaxFileSizeMB int
+	}{oauth.Enabled(), config.AppConfig.MaxFileSizeMB})
 	if err != nil {
-		http.Error(w, "Page not found", http.StatusNotFound)
-		return
+		log.Printf("Failed to render home page: %v", err)
 	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write(content)
 }
 
-// UploadPageHandler serves the upload page
+// homePage offers a login button for each enabled provider, and tells
+// visitors how large a file they may upload
+var homePage = assets.Page("index.html")
+
+var uploadPage = assets.Page("upload.html")
+
+// UploadPageHandler serves the upload page, carrying the CSRF token its
+// scripts send with every write and the allowed formats and file size. The
+// scripts raise the size to the user's own when their roles allow more.
 func UploadPageHandler(w http.ResponseWriter, r *http.Request) {
-	content, err := assets.StaticFiles.ReadFile("static/upload.html")
+	token, err := middleware.CSRFToken(w, r)
 	if err != nil {
-		http.Error(w, "Page not found", http.StatusNotFound)
+		log.Printf("Failed to get CSRF token for user %s (ID: %s): %v", middleware.GetUsername(r), middleware.GetRealDiscordID(r), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	formats := strings.ToUpper(strings.ReplaceAll(strings.Join(config.AppConfig.UploadExtensions(), ", "), ".", ""))
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write(content)
+	err = uploadPage.Execute(w, struct {
+		CSRFToken     string
+		Formats       string
+		MaxFileSizeMB int
+	}{token, formats, config.AppConfig.MaxFileSizeMB})
+	if err != nil {
+		log.Printf("Failed to render upload page: %v", err)
+	}
 }
@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/processing"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/gorilla/mux"
+)
+
+// Longest edge of generated thumbnails, in pixels
+const thumbnailSize = 400
+
+// Largest width or height an image can be resized to, which also bounds how
+// many variants of one upload can pile up in the cache
+const maxResizeDimension = 4096
+
+// Resized images of an upload never change, so clients and proxies may keep
+// them for a year
+const resizedCacheControl = "public, max-age=31536000, immutable"
+
+// Resize modes: fit within the box, or fill it and crop the overflow
+const (
+	fitContain = "contain"
+	fitCover   = "cover"
+)
+
+func init() {
+	// Not every platform's MIME table knows about JPEG XL and HEIF
+	mime.AddExtensionType(".jxl", "image/jxl")
+	mime.AddExtensionType(".avif", "image/avif")
+	mime.AddExtensionType(".heic", "image/heic")
+	mime.AddExtensionType(".heif", "image/heif")
+}
+
+func imagePath(uploadID int64) string {
+	return "/images/" + strconv.FormatInt(uploadID, 10)
+}
+
+func thumbnailPath(uploadID int64) string {
+	return imagePath(uploadID) + "/thumb"
+}
+
+// imageURL returns the URL the current user loads an upload's file from,
+// which is on the content host when there is one
+func imageURL(r *http.Request, uploadID int64) string {
+	return middleware.ContentURL(r, imagePath(uploadID), nil)
+}
+
+func thumbnailURL(r *http.Request, uploadID int64) string {
+	return middleware.ContentURL(r, thumbnailPath(uploadID), nil)
+}
+
+// redirectToContentHost sends a request for an uploaded file made to the site
+// itself on to path on the content host, signed for the current user, and
+// reports whether it did. With a content host, uploaded files are never
+// served from the origin that holds the session cookie.
+func redirectToContentHost(w http.ResponseWriter, r *http.Request, path string) bool {
+	if config.AppConfig.ContentHost() == "" || middleware.OnContentHost(r) {
+		return false
+	}
+	http.Redirect(w, r, middleware.ContentURL(r, path, r.URL.Query()), http.StatusFound)
+	return true
+}
+
+// loadVisibleUpload resolves the {id} route variable to an upload the current
+// user may see, writing a 404 and returning nil otherwise. Unlisted uploads
+// may be seen by anyone with the link; private ones only by their uploader
+// and admins. Uploads of another guild than the current one may only be seen
+// by their uploader and users with them in their collection.
+func loadVisibleUpload(w http.ResponseWriter, r *http.Request) *models.Upload {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		middleware.Error(w, r, http.StatusInternalServerError, middleware.CodeInternal, "Failed to load image")
+		return nil
+	}
+
+	if config.AppConfig.IsAdmin(middleware.GetRealDiscordID(r)) {
+		return upload
+	}
+	discordID := middleware.GetDiscordID(r)
+	if upload.Frozen || upload.DeletedAt.Valid || upload.ReportHidden ||
+		(upload.Visibility == models.VisibilityPrivate && upload.DiscordID != discordID) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if upload.GuildID != middleware.GetGuildID(r) && upload.DiscordID != discordID {
+		owned, err := models.OwnsUpload(r.Context(), discordID, upload.ID)
+		if err != nil {
+			log.Printf("Failed to check collection for upload %d: %v", upload.ID, err)
+			middleware.Error(w, r, http.StatusInternalServerError, middleware.CodeInternal, "Failed to load image")
+			return nil
+		}
+		if !owned {
+			http.NotFound(w, r)
+			return nil
+		}
+	}
+	return upload
+}
+
+// ImageHandler serves the original file for an upload. With ?download=1 it
+// is sent as an attachment named after the original file. With w and/or h
+// (and optionally fit=cover) it serves a resized JPEG instead, generated on
+// first request and cached, and watermarked when watermarking is on; the
+// original is then only served to those mayGetOriginal allows. HEIC originals
+// are served as WebP to browsers that don't accept HEIC when
+// image_converter.webp is on. Range requests let large originals be streamed
+// and interrupted downloads resumed.
+func ImageHandler(w http.ResponseWriter, r *http.Request) {
+	if redirectToContentHost(w, r, "/images/"+mux.Vars(r)["id"]) {
+		return
+	}
+	resize, err := parseResize(r.URL.Query())
+	if err != nil {
+		middleware.Error(w, r, http.StatusBadRequest, middleware.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	upload := loadVisibleUpload(w, r)
+	if upload == nil {
+		return
+	}
+	if resize == nil {
+		allowed, err := mayGetOriginal(r, upload)
+		if err != nil {
+			log.Printf("Failed to check collection for upload %d: %v", upload.ID, err)
+			middleware.Error(w, r, http.StatusInternalServerError, middleware.CodeInternal, "Failed to load image")
+			return
+		}
+		if !allowed {
+			middleware.Error(w, r, http.StatusForbidden, codeNotInCollection, "The original is only available once the wallpaper is in your collection; ask for w or h for a watermarked preview")
+			return
+		}
+	}
+
+	download := r.URL.Query().Get("download") == "1"
+	var attachment string
+	if download {
+		attachment = upload.OriginalFilename
+		if resize != nil {
+			attachment = strings.TrimSuffix(attachment, filepath.Ext(attachment)) + ".jpg"
+		} else if ext := filepath.Ext(upload.Filename); !strings.EqualFold(ext, filepath.Ext(attachment)) {
+			// The file was transcoded to another format
+			attachment = strings.TrimSuffix(attachment, filepath.Ext(attachment)) + ext
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment}))
+	}
+
+	// Range requests resume or seek within a fetch that was already counted
+	if r.Header.Get("Range") == "" {
+		models.RecordImageAccess(upload.ID, download)
+	}
+
+	if resize != nil {
+		serveResized(w, r, upload, resize, attachment)
+		return
+	}
+
+	// Browsers that can't display HEIC get a WebP copy of it
+	path, etag := storage.Path(upload.Filename), upload.SHA256
+	if !download && convertsToWebP(upload) {
+		w.Header().Add("Vary", "Accept")
+		if !acceptsHEIF(r) {
+			webp, err := webPCopy(upload)
+			if err == processing.ErrBusy {
+				w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfterSeconds))
+				middleware.Error(w, r, http.StatusServiceUnavailable, codeServerBusy, "Image is being converted, try again shortly")
+				return
+			} else if err != nil {
+				// The browser may still manage the original
+				log.Printf("Failed to convert upload %d to WebP: %v", upload.ID, err)
+			} else {
+				path, etag = webp, etag+"-webp"
+			}
+		}
+	}
+	if redirectToSignedURL(w, r, upload, path, attachment) {
+		return
+	}
+
+	// Stored files never change, so their hash is a strong validator that
+	// lets If-Range resume a download even if the file was restored or moved
+	if etag != "" {
+		w.Header().Set("ETag", strconv.Quote(etag))
+	}
+	// Originals served only to some users mustn't be handed to others by
+	// shared caches
+	if config.AppConfig.WatermarkText() != "" || upload.Visibility == models.VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private")
+	}
+	serveImageFile(w, r, path)
+}
+
+// convertsToWebP reports whether an upload's original is served as WebP to
+// browsers that can't display it: HEIC and HEIF files, when
+// image_converter.webp is on
+func convertsToWebP(upload *models.Upload) bool {
+	if !config.AppConfig.ImageConverter.WebP {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(upload.Filename))
+	return ext == ".heic" || ext == ".heif"
+}
+
+// acceptsHEIF reports whether the request's Accept header names HEIC or HEIF,
+// which only browsers that display them send
+func acceptsHEIF(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "image/heic") || strings.Contains(accept, "image/heif")
+}
+
+// webPCopy returns the path of an upload's WebP copy, converting the
+// original on first request
+func webPCopy(upload *models.Upload) (string, error) {
+	path := storage.WebPPath(upload.Filename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err := processing.Run(func() error {
+			return imaging.GenerateWebP(storage.Path(upload.Filename), path)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// mayGetOriginal reports whether the current user may fetch an upload's
+// original file. With watermarking on, only its uploader, admins and users
+// with it in their collection may.
+func mayGetOriginal(r *http.Request, upload *models.Upload) (bool, error) {
+	if config.AppConfig.WatermarkText() == "" {
+		return true, nil
+	}
+	discordID := middleware.GetDiscordID(r)
+	if upload.DiscordID == discordID || config.AppConfig.IsAdmin(middleware.GetRealDiscordID(r)) {
+		return true, nil
+	}
+	return models.OwnsUpload(r.Context(), discordID, upload.ID)
+}
+
+// resizeRequest is the size an image was asked for. A zero width or height
+// leaves that side unconstrained.
+type resizeRequest struct {
+	width, height int
+	fit           string
+}
+
+// parseResize reads the w, h and fit query parameters, returning nil when no
+// resizing was asked for
+func parseResize(query url.Values) (*resizeRequest, error) {
+	req := &resizeRequest{fit: fitContain}
+	for name, dest := range map[string]*int{"w": &req.width, "h": &req.height} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxResizeDimension {
+				return nil, fmt.Errorf("%s must be between 1 and %d", name, maxResizeDimension)
+			}
+			*dest = n
+		}
+	}
+	if fit := query.Get("fit"); fit != "" {
+		if fit != fitContain && fit != fitCover {
+			return nil, errors.New("fit must be contain or cover")
+		}
+		req.fit = fit
+	}
+
+	if req.width == 0 && req.height == 0 {
+		if query.Has("fit") {
+			return nil, errors.New("fit needs w or h")
+		}
+		return nil, nil
+	}
+	if req.fit == fitCover && (req.width == 0 || req.height == 0) {
+		return nil, errors.New("fit=cover needs both w and h")
+	}
+	return req, nil
+}
+
+// serveResized serves a resized copy of an upload, generating and caching it
+// on first request. attachment is the file name it is downloaded as, if any.
+func serveResized(w http.ResponseWriter, r *http.Request, upload *models.Upload, req *resizeRequest, attachment string) {
+	path := storage.VariantPath(upload.Filename, req.width, req.height, req.fit)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		width, height := req.width, req.height
+		if width == 0 {
+			width = maxResizeDimension
+		}
+		if height == 0 {
+			height = maxResizeDimension
+		}
+		err := processing.Run(func() error {
+			return imaging.GenerateResized(storage.Path(upload.Filename), path, width, height, req.fit == fitCover, config.AppConfig.WatermarkText())
+		})
+		if err == processing.ErrBusy {
+			w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfterSeconds))
+			middleware.Error(w, r, http.StatusServiceUnavailable, codeServerBusy, "Image is being resized, try again shortly")
+			return
+		} else if err != nil {
+			// Formats without a decoder (e.g. JXL, or AVIF and HEIC without an
+			// image converter) can't be resized
+			log.Printf("Failed to resize upload %d to %dx%d (%s): %v", upload.ID, req.width, req.height, req.fit, err)
+			middleware.Error(w, r, http.StatusNotFound, codeResourceUnavailable, "Resized image unavailable")
+			return
+		}
+	}
+	if redirectToSignedURL(w, r, upload, path, attachment) {
+		return
+	}
+
+	// Uploads only their uploader or admins can see mustn't linger in shared
+	// caches
+	if upload.Frozen || upload.DeletedAt.Valid || upload.ReportHidden || upload.Visibility == models.VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		w.Header().Set("Cache-Control", resizedCacheControl)
+	}
+	serveImageFile(w, r, path)
+}
+
+// ThumbnailHandler serves a downscaled JPEG preview, generating it on first request
+func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	if redirectToContentHost(w, r, "/images/"+mux.Vars(r)["id"]+"/thumb") {
+		return
+	}
+	upload := loadVisibleUpload(w, r)
+	if upload == nil {
+		return
+	}
+
+	thumbPath, ok := generateThumbnail(w, r, upload)
+	if !ok {
+		return
+	}
+	if redirectToSignedURL(w, r, upload, thumbPath, "") {
+		return
+	}
+
+	serveImageFile(w, r, thumbPath)
+}
+
+// generateThumbnail returns the path of an upload's thumbnail, generating it
+// on first request. When it can't, it writes the error and returns false.
+func generateThumbnail(w http.ResponseWriter, r *http.Request, upload *models.Upload) (string, bool) {
+	thumbPath := storage.ThumbnailPath(upload.Filename)
+	if _, err := os.Stat(thumbPath); os.IsNotExist(err) {
+		err := processing.Run(func() error {
+			return imaging.GenerateThumbnail(storage.Path(upload.Filename), thumbPath, thumbnailSize, config.AppConfig.WatermarkText())
+		})
+		if err == processing.ErrBusy {
+			w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfterSeconds))
+			middleware.Error(w, r, http.StatusServiceUnavailable, codeServerBusy, "Thumbnail is being generated, try again shortly")
+			return "", false
+		} else if err != nil {
+			// Formats without a decoder (e.g. JXL, or AVIF and HEIC without an
+			// image converter) have no thumbnail
+			log.Printf("Failed to generate thumbnail for upload %d: %v", upload.ID, err)
+			middleware.Error(w, r, http.StatusNotFound, codeResourceUnavailable, "Thumbnail unavailable")
+			return "", false
+		}
+	}
+	return thumbPath, true
+}
+
+// redirectToSignedURL sends a request for the stored file at path on to a
+// signed URL of it and reports whether it did. Signed URLs, when enabled, are
+// used for files of uploads that aren't public and for anything sent as an
+// attachment; the access checks have been made by then.
+func redirectToSignedURL(w http.ResponseWriter, r *http.Request, upload *models.Upload, path, attachment string) bool {
+	if !config.AppConfig.SignedURLs.Enabled || (upload.Visibility == models.VisibilityPublic && attachment == "") {
+		return false
+	}
+	name := storage.RelativeName(path)
+	if name == "" {
+		return false
+	}
+	// The URL is the user's own to share, not the next visitor's
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Del("Content-Disposition")
+	http.Redirect(w, r, storage.Files.SignedURL(name, attachment, storage.SignedURLExpiry()), http.StatusFound)
+	return true
+}
+
+// SignedFileHandler serves a stored file to anyone with a URL signed for it,
+// without a session, so a CDN or proxy in front of the route can keep and
+// deliver the file until the signature expires
+func SignedFileHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	expires, attachment, ok := storage.VerifySignedURL(name, r.URL.Query())
+	if !ok {
+		middleware.Error(w, r, http.StatusForbidden, middleware.CodeForbidden, "This link has expired, reload the page to get a new one")
+		return
+	}
+
+	if attachment != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment}))
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(time.Until(expires).Seconds())))
+	serveImageFile(w, r, filepath.Join(config.AppConfig.UploadDirectory, filepath.FromSlash(name)))
+}
+
+// imageContentType returns the content type of an image file by its
+// extension. Newer formats such as JXL and HEIC are missing from many systems'
+// MIME tables, so those fall back to the types upload_formats accepts.
+func imageContentType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	if types := config.AppConfig.UploadFormats[ext]; len(types) > 0 {
+		return types[0]
+	}
+	return ""
+}
+
+// serveImageFile sends an image file, answering Range and conditional
+// requests
+func serveImageFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to open image file %s: %v", path, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("Failed to stat image file %s: %v", path, err)
+		middleware.Error(w, r, http.StatusInternalServerError, middleware.CodeInternal, "Failed to load image")
+		return
+	}
+
+	if contentType := imageContentType(path); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// AdminImpersonateHandler starts a time-limited "view as user" session for an
+// admin. Impersonation is read-only unless the request body sets "write": true.
+func AdminImpersonateHandler(w http.ResponseWriter, r *http.Request) {
+	adminID := middleware.GetRealDiscordID(r)
+	targetID := mux.Vars(r)["id"]
+
+	var body struct {
+		Write bool `json:"write"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	if targetID == adminID {
+		apiError(w, http.StatusBadRequest, codeOwnResource, "You cannot impersonate yourself")
+		return
+	}
+
+	target, err := models.GetUser(r.Context(), targetID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get user %s for impersonation: %v", targetID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	session, err := middleware.Store.Get(r, middleware.SessionName)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Invalid session")
+		return
+	}
+
+	expires := time.Now().Add(time.Duration(config.AppConfig.ImpersonationMinutes) * time.Minute)
+	session.Values[middleware.ImpersonateIDSessionKey] = target.DiscordID
+	session.Values[middleware.ImpersonateUsernameSessionKey] = target.Username
+	session.Values[middleware.ImpersonateExpiresSessionKey] = expires.Unix()
+	session.Values[middleware.ImpersonateWriteSessionKey] = body.Write
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to save impersonation session for admin %s: %v", adminID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save session")
+		return
+	}
+
+	log.Printf("Impersonation started: admin (ID: %s) is viewing as %s (ID: %s), write=%t, expires %s, from IP: %s",
+		adminID, target.Username, target.DiscordID, body.Write, expires.UTC().Format(time.RFC3339), r.RemoteAddr)
+	recordAudit(r, adminID, models.AuditImpersonateStart, userTarget(target.DiscordID), fmt.Sprintf("write=%t", body.Write))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"impersonating": target.DiscordID,
+		"username":      target.Username,
+		"write":         body.Write,
+		"expires_at":    expires.UTC(),
+	})
+}
+
+// AdminStopImpersonationHandler ends an admin's impersonation session
+func AdminStopImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := middleware.Store.Get(r, middleware.SessionName)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "Invalid session")
+		return
+	}
+
+	targetID, _ := session.Values[middleware.ImpersonateIDSessionKey].(string)
+	middleware.ClearImpersonation(session)
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Failed to save session while ending impersonation: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to save session")
+		return
+	}
+
+	if targetID != "" {
+		log.Printf("Impersonation ended: admin (ID: %s) stopped viewing as %s from IP: %s", middleware.GetRealDiscordID(r), targetID, r.RemoteAddr)
+		recordAudit(r, middleware.GetRealDiscordID(r), models.AuditImpersonateStop, userTarget(targetID), "")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
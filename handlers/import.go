@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// ErrAlreadyImported is returned by ImportFile for a file imported before
+var ErrAlreadyImported = errors.New("already imported")
+
+// Importable reports whether a file name has an extension uploads accept, so
+// importers can pass over other files in a folder
+func Importable(name string) bool {
+	_, ok := config.AppConfig.UploadFormats[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// ImportDetails describes an imported file. All fields are optional and
+// expected to be validated already.
+type ImportDetails struct {
+	Title       string
+	Description string
+	Tags        []string
+	License     string
+	Rarity      string
+	// GuildID is the guild the file is added to
+	GuildID string
+	// Source is where the file came from, models.SourceFolder unless set
+	Source string
+}
+
+// ImportFile runs a file on disk through the upload pipeline for the user, as
+// an upload from details.Source. externalID identifies the file within the
+// source, so importing it again returns ErrAlreadyImported along with the
+// earlier upload, moved to the given rarity if it differs. The thumbnail is
+// generated straight away rather than on first view.
+func ImportFile(ctx context.Context, user *models.User, path, externalID string, details ImportDetails) (*models.Upload, error) {
+	if details.Source == "" {
+		details.Source = models.SourceFolder
+	}
+	existing, err := models.FindImportedUpload(ctx, details.Source, externalID)
+	if err == nil {
+		if details.Rarity != "" && details.Rarity != existing.Rarity {
+			if err := models.SetUploadRarity(ctx, existing.ID, details.Rarity); err != nil {
+				return nil, err
+			}
+			existing.Rarity = details.Rarity
+		}
+		return existing, ErrAlreadyImported
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if maxSize := int64(config.AppConfig.MaxFileSizeMB) * 1024 * 1024; info.Size() > maxSize {
+		return nil, fmt.Errorf("file too large (max %dMB)", config.AppConfig.MaxFileSizeMB)
+	}
+
+	upload, uerr := storeUpload(user, user.Username, uploadInput{
+		ctx:         ctx,
+		file:        f,
+		filename:    filepath.Base(path),
+		title:       details.Title,
+		description: details.Description,
+		tags:        details.Tags,
+		license:     details.License,
+		guildID:     details.GuildID,
+		source:      details.Source,
+		externalID:  sql.NullString{String: externalID, Valid: true},
+		rarity:      details.Rarity,
+	})
+	if uerr != nil {
+		return nil, errors.New(uerr.message)
+	}
+	if len(details.Tags) > 0 {
+		upload.Tags = details.Tags
+	}
+
+	// Formats without a decoder (e.g. JXL, AVIF, HEIC) have no thumbnail
+	if err := imaging.GenerateThumbnail(storage.Path(upload.Filename), storage.ThumbnailPath(upload.Filename), thumbnailSize, config.AppConfig.WatermarkText()); err != nil {
+		log.Printf("Import: no thumbnail for upload %d (%s): %v", upload.ID, externalID, err)
+	}
+	return upload, nil
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// AdminIntegrityHandler returns the most recent storage integrity report
+func AdminIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	report := jobs.LastIntegrityReport()
+	if report == nil {
+		respondError(w, http.StatusNotFound, "No integrity check has run yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// AdminRunIntegrityHandler runs a storage integrity check immediately
+func AdminRunIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Admin %s (ID: %s) triggered an integrity check", middleware.GetUsername(r), middleware.GetDiscordID(r))
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditIntegrityCheck, "", "")
+	report := jobs.RunIntegrityCheck(config.AppConfig.UploadDirectory, config.AppConfig.MirrorDirectories)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// AdminOrphansHandler returns the most recent orphaned-file scan
+func AdminOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	report := jobs.LastOrphanReport()
+	if report == nil {
+		respondError(w, http.StatusNotFound, "No orphan scan has run yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// AdminRunOrphansHandler scans for orphaned files immediately, deleting them
+// only if delete_orphans is configured
+func AdminRunOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Admin %s (ID: %s) triggered an orphan scan", middleware.GetUsername(r), middleware.GetDiscordID(r))
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditOrphanCheck, "", "")
+	report := jobs.RunOrphanCheck(
+		config.AppConfig.UploadDirectory,
+		time.Duration(config.AppConfig.OrphanMinAgeHours)*time.Hour,
+		config.AppConfig.DeleteOrphans,
+	)
+	writeJSON(w, http.StatusOK, report)
+}
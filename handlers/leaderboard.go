@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/oauth"
+)
+
+// How long computed leaderboards are served before being recounted
+const leaderboardTTL = time.Minute
+
+// Most entries a leaderboard lists
+const maxLeaderboardSize = 100
+
+// leaderboardPeriods maps the period parameter to how far back it counts;
+// zero covers all time
+var leaderboardPeriods = map[string]time.Duration{
+	"all":   0,
+	"month": 30 * 24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+}
+
+// LeaderboardEntryResponse is one ranked user
+type LeaderboardEntryResponse struct {
+	Rank        int    `json:"rank"`
+	DiscordID   string `json:"discord_id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+	Score       int    `json:"score"`
+}
+
+type leaderboardSnapshot struct {
+	boards     map[string][]LeaderboardEntryResponse
+	computedAt time.Time
+}
+
+// Leaderboards are aggregates over every pull and upload, so each guild's
+// period is counted at most once per leaderboardTTL however often it is
+// requested. The cache is keyed by guild and period.
+var (
+	leaderboardMu    sync.Mutex
+	leaderboardCache = map[string]*leaderboardSnapshot{}
+)
+
+func leaderboardKey(guildID, period string) string {
+	return guildID + "/" + period
+}
+
+func leaderboards(ctx context.Context, guildID, period string) (*leaderboardSnapshot, error) {
+	leaderboardMu.Lock()
+	defer leaderboardMu.Unlock()
+	key := leaderboardKey(guildID, period)
+	if s, ok := leaderboardCache[key]; ok && time.Since(s.computedAt) < leaderboardTTL {
+		return s, nil
+	}
+	s, err := countLeaderboards(ctx, guildID, period)
+	if err != nil {
+		return nil, err
+	}
+	leaderboardCache[key] = s
+	return s, nil
+}
+
+// RefreshLeaderboards recounts the leaderboards of every guild and period,
+// so that requests find them already counted
+func RefreshLeaderboards() error {
+	ctx := context.Background()
+	for _, guildID := range config.AppConfig.GuildIDs() {
+		for period := range leaderboardPeriods {
+			s, err := countLeaderboards(ctx, guildID, period)
+			if err != nil {
+				return fmt.Errorf("failed to count %s leaderboards of guild %s: %w", period, guildID, err)
+			}
+			leaderboardMu.Lock()
+			leaderboardCache[leaderboardKey(guildID, period)] = s
+			leaderboardMu.Unlock()
+		}
+	}
+	return nil
+}
+
+func countLeaderboards(ctx context.Context, guildID, period string) (*leaderboardSnapshot, error) {
+	var since time.Time
+	if d := leaderboardPeriods[period]; d > 0 {
+		since = time.Now().Add(-d)
+	}
+	s := &leaderboardSnapshot{boards: map[string][]LeaderboardEntryResponse{}, computedAt: time.Now()}
+	for _, board := range models.Leaderboards {
+		entries, err := models.GetLeaderboard(ctx, board, guildID, since, maxLeaderboardSize)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]LeaderboardEntryResponse, len(entries))
+		for i, e := range entries {
+			items[i] = LeaderboardEntryResponse{
+				Rank:        e.Rank,
+				DiscordID:   e.DiscordID,
+				Username:    e.Username,
+				DisplayName: e.DisplayName,
+				AvatarURL:   oauth.AvatarURL(e.DiscordID, e.Avatar),
+				Score:       e.Score,
+			}
+		}
+		s.boards[board] = items
+	}
+	return s, nil
+}
+
+// LeaderboardHandler ranks users by uploads, pulls and wallpapers collected
+// in the current guild, over all time or the last month or week
+func LeaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "all"
+	}
+	if _, ok := leaderboardPeriods[period]; !ok {
+		respondError(w, http.StatusBadRequest, "period must be all, month or week")
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 {
+		limit = 10
+	}
+	limit = min(limit, maxLeaderboardSize)
+	if notModified(w, r, leaderboardTables...) {
+		return
+	}
+
+	snapshot, err := leaderboards(r.Context(), middleware.GetGuildID(r), period)
+	if err != nil {
+		log.Printf("Failed to compute leaderboards: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get leaderboards")
+		return
+	}
+
+	boards := make(map[string][]LeaderboardEntryResponse, len(snapshot.boards))
+	for board, entries := range snapshot.boards {
+		boards[board] = entries[:min(limit, len(entries))]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"period":      period,
+		"boards":      boards,
+		"computed_at": snapshot.computedAt.UTC(),
+	})
+}
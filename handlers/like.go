@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+)
+
+// LikeHandler likes a wallpaper on POST and takes the like back on DELETE.
+// Both are idempotent and return the resulting like count.
+func LikeHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+
+	upload := loadVisibleUpload(w, r)
+	if upload == nil {
+		return
+	}
+
+	liked := r.Method == http.MethodPost
+	var count int
+	var added bool
+	var err error
+	if liked {
+		if upload.DiscordID == discordID {
+			apiError(w, http.StatusBadRequest, codeOwnResource, "You cannot like your own upload")
+			return
+		}
+		// Likes raise a wallpaper's pull weight, so the user must exist
+		// for their like to be kept
+		if _, err = models.GetOrCreateUser(r.Context(), discordID, middleware.GetUsername(r)); err == nil {
+			count, added, err = models.LikeUpload(r.Context(), discordID, upload.ID)
+		}
+	} else {
+		count, err = models.UnlikeUpload(r.Context(), discordID, upload.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to update like of upload %d for user %s (ID: %s): %v", upload.ID, middleware.GetUsername(r), discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save like")
+		return
+	}
+	if added {
+		notify.UploadLiked(upload, middleware.GetUsername(r))
+		gacha.RewardLiked(r.Context(), upload.DiscordID)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"liked": liked, "likes": count})
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// linkCodeLength is the number of characters in a link code. Codes are
+// short enough to type, and only live for models.LinkCodeLifetime.
+const linkCodeLength = 12
+
+// LinkResponse is an alt account linked, or waiting to be linked, to a
+// primary one
+type LinkResponse struct {
+	ID              int64      `json:"id"`
+	PrimaryID       string     `json:"primary_id"`
+	PrimaryUsername string     `json:"primary_username"`
+	AltID           string     `json:"alt_id"`
+	AltUsername     string     `json:"alt_username"`
+	Status          string     `json:"status"`
+	Uploads         int        `json:"uploads"`
+	Pulls           int        `json:"pulls"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ResolvedAt      *time.Time `json:"resolved_at,omitempty"`
+}
+
+func newLinkResponse(l *models.AccountLink) LinkResponse {
+	resp := LinkResponse{
+		ID:              l.ID,
+		PrimaryID:       l.PrimaryID,
+		PrimaryUsername: l.PrimaryUsername,
+		AltID:           l.AltID,
+		AltUsername:     l.AltUsername,
+		Status:          l.Status,
+		Uploads:         l.Uploads,
+		Pulls:           l.Pulls,
+		CreatedAt:       l.CreatedAt,
+	}
+	if l.ResolvedAt.Valid {
+		resp.ResolvedAt = &l.ResolvedAt.Time
+	}
+	return resp
+}
+
+// hashLinkCode returns the hash a link code is stored and looked up by. Codes
+// are compared case-insensitively and without surrounding spaces, as users
+// type them in.
+func hashLinkCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateLinkCodeHandler issues the signed-in user a code to enter while
+// signed in with another account, to link that account to this one. A new
+// code replaces the previous one.
+func CreateLinkCodeHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	if middleware.GetImpersonatorID(r) != "" {
+		respondImpersonating(w, "Accounts cannot be linked while viewing as another user")
+		return
+	}
+
+	code := rand.Text()[:linkCodeLength]
+	expiresAt, err := models.CreateLinkCode(r.Context(), discordID, hashLinkCode(code))
+	if err != nil {
+		log.Printf("Failed to create link code for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create link code")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"code":       code,
+		"expires_at": expiresAt,
+	})
+}
+
+// LinkAccountHandler links the signed-in account, as an alt, to the account
+// that issued the given link code. Its collection, balances and uploads are
+// merged into that account straight away, or once an admin approves when it
+// brings more than link_approval_threshold uploads and pulls. Merging signs
+// the alt out; signing in with it again signs in to the primary account.
+func LinkAccountHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+	if middleware.GetImpersonatorID(r) != "" {
+		respondImpersonating(w, "Accounts cannot be linked while viewing as another user")
+		return
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Code) == "" {
+		respondError(w, http.StatusBadRequest, "A link code is required")
+		return
+	}
+
+	link, err := models.LinkAccount(r.Context(), hashLinkCode(body.Code), discordID, config.AppConfig.LinkApprovalThreshold)
+	if respondLinkError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to link user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to link accounts")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) linked their account to user %s: %s", username, discordID, link.PrimaryID, link.Status)
+	recordAudit(r, discordID, models.AuditAccountLink, userTarget(link.PrimaryID), link.Status)
+
+	status := http.StatusAccepted
+	if link.Status == models.LinkMerged {
+		status = http.StatusOK
+		endMergedSessions(link.AltID)
+	}
+	writeJSON(w, status, newLinkResponse(link))
+}
+
+// respondLinkError answers for the errors of accounts that can't be linked,
+// returning false for other errors
+func respondLinkError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, models.ErrInvalidLinkCode):
+		apiError(w, http.StatusBadRequest, codeInvalidLinkCode, "The link code is wrong or has expired")
+	case errors.Is(err, models.ErrLinkSelf):
+		apiError(w, http.StatusBadRequest, codeCannotLink, "An account can't be linked to itself")
+	case errors.Is(err, models.ErrPrimaryLinked):
+		apiError(w, http.StatusConflict, codeCannotLink, "The account that issued the code is linked to another account itself")
+	case errors.Is(err, models.ErrAltLinked):
+		apiError(w, http.StatusConflict, codeCannotLink, "This account is already linked, or waiting for approval to be")
+	case errors.Is(err, models.ErrAltHasLinks):
+		apiError(w, http.StatusConflict, codeCannotLink, "Accounts with linked accounts of their own can't be linked to another")
+	default:
+		return false
+	}
+	return true
+}
+
+// endMergedSessions signs out a merged alt account's browsers, whose
+// sessions would otherwise still show it empty
+func endMergedSessions(altID string) {
+	if _, err := middleware.Store.Backend.DeleteUser(altID); err != nil {
+		log.Printf("Failed to end sessions of merged user %s: %v", altID, err)
+	}
+}
+
+// MyLinksHandler lists the accounts linked, or waiting to be linked, to the
+// signed-in user's account
+func MyLinksHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	links, err := models.ListUserLinks(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to list linked accounts of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list linked accounts")
+		return
+	}
+
+	items := make([]LinkResponse, 0, len(links))
+	for i := range links {
+		items = append(items, newLinkResponse(&links[i]))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"links": items})
+}
+
+// AdminLinksHandler lists account links by status (pending by default)
+func AdminLinksHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.LinkPending
+	}
+	page, perPage, offset := parsePagination(r)
+
+	links, total, err := models.ListLinks(r.Context(), status, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list account links: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list account links")
+		return
+	}
+
+	items := make([]LinkResponse, 0, len(links))
+	for i := range links {
+		items = append(items, newLinkResponse(&links[i]))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"links":    items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// AdminResolveLinkHandler approves a pending account link, merging the alt
+// into the primary account, or rejects it
+func AdminResolveLinkHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid link ID")
+		return
+	}
+
+	var body struct {
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	var approve bool
+	var action string
+	switch body.Action {
+	case "approve":
+		approve, action = true, models.AuditLinkApprove
+	case "reject":
+		action = models.AuditLinkReject
+	default:
+		respondError(w, http.StatusBadRequest, "action must be approve or reject")
+		return
+	}
+
+	adminID := middleware.GetRealDiscordID(r)
+	link, err := models.ResolveLink(r.Context(), id, approve, adminID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "No pending account link with that ID")
+		return
+	} else if respondLinkError(w, err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to resolve account link %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to resolve account link")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) marked the link of user %s to user %s as %s", middleware.GetUsername(r), adminID, link.AltID, link.PrimaryID, link.Status)
+	recordAudit(r, adminID, action, userTarget(link.AltID), "linked to "+link.PrimaryID)
+	if approve {
+		endMergedSessions(link.AltID)
+	}
+	writeJSON(w, http.StatusOK, newLinkResponse(link))
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/live"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+)
+
+// LiveHandler streams new uploads and pulls in the current guild to the
+// signed-in user over a WebSocket
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	live.Serve(w, r, discordID, middleware.GetGuildID(r), config.AppConfig.IsAdmin(middleware.GetRealDiscordID(r)))
+}
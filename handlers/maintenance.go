@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// maxMaintenanceMessage bounds the message shown during maintenance
+const maxMaintenanceMessage = 500
+
+// MaintenanceResponse is whether the site is in maintenance mode: the mode
+// in effect, the one in the config and the one an admin set at runtime, if
+// any
+type MaintenanceResponse struct {
+	Enabled           bool                         `json:"enabled"`
+	Message           string                       `json:"message"`
+	ConfiguredEnabled bool                         `json:"configured_enabled"`
+	Override          *MaintenanceOverrideResponse `json:"override"`
+}
+
+// MaintenanceOverrideResponse is the maintenance mode set at runtime
+type MaintenanceOverrideResponse struct {
+	Enabled   bool      `json:"enabled"`
+	Message   string    `json:"message"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func writeMaintenance(w http.ResponseWriter, r *http.Request) {
+	override, err := models.GetMaintenanceOverride(r.Context())
+	if err != nil {
+		log.Printf("Failed to get maintenance mode: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get maintenance mode")
+		return
+	}
+
+	enabled, message := config.AppConfig.InMaintenance()
+	resp := MaintenanceResponse{Enabled: enabled, Message: message, ConfiguredEnabled: config.AppConfig.Maintenance.Enabled}
+	if override != nil {
+		o := MaintenanceOverrideResponse(*override)
+		resp.Override = &o
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminMaintenanceHandler shows whether the site is in maintenance mode
+func AdminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	writeMaintenance(w, r)
+}
+
+// AdminUpdateMaintenanceHandler starts or ends maintenance mode without a
+// restart. The setting is stored, so it survives restarts, and takes
+// precedence over maintenance in the config; a null enabled removes it. An
+// empty message shows the configured one.
+func AdminUpdateMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Enabled *bool  `json:"enabled"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(body.Message) > maxMaintenanceMessage {
+		respondError(w, http.StatusBadRequest, "message must be at most "+strconv.Itoa(maxMaintenanceMessage)+" characters")
+		return
+	}
+	if body.Enabled == nil && body.Message != "" {
+		respondError(w, http.StatusBadRequest, "message can only be set along with enabled")
+		return
+	}
+
+	wasEnabled, _ := config.AppConfig.InMaintenance()
+	actorID := middleware.GetRealDiscordID(r)
+	if err := models.SetMaintenanceOverride(r.Context(), body.Enabled, body.Message, actorID); err != nil {
+		log.Printf("Failed to update maintenance mode: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to save maintenance mode")
+		return
+	}
+	if err := jobs.LoadMaintenanceMode(); err != nil {
+		log.Printf("Failed to apply maintenance mode: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to apply maintenance mode")
+		return
+	}
+
+	enabled, _ := config.AppConfig.InMaintenance()
+	details := strconv.FormatBool(wasEnabled) + " -> " + strconv.FormatBool(enabled)
+	if body.Enabled == nil {
+		details += " (config)"
+	}
+	recordAudit(r, actorID, models.AuditMaintenance, "site", details)
+	log.Printf("Admin %s (ID: %s) set maintenance mode %s", middleware.GetUsername(r), actorID, details)
+	writeMaintenance(w, r)
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// PastNameResponse is a name a user went by before renaming themselves
+type PastNameResponse struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	ReplacedAt  time.Time `json:"replaced_at"`
+}
+
+// AdminUserNamesHandler shows a user's current name and the names they had
+// before, so moderators can recognise users who rename themselves. Uploads
+// are always attributed by current name.
+func AdminUserNamesHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := mux.Vars(r)["id"]
+	user, err := models.GetUser(r.Context(), discordID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get name history")
+		return
+	}
+
+	names, err := models.ListPastNames(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to list past names of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get name history")
+		return
+	}
+	past := make([]PastNameResponse, 0, len(names))
+	for _, n := range names {
+		past = append(past, PastNameResponse{Username: n.Username, DisplayName: n.DisplayName, ReplacedAt: n.ReplacedAt})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"discord_id":   user.DiscordID,
+		"username":     user.Username,
+		"display_name": user.DisplayName,
+		"past_names":   past,
+	})
+}
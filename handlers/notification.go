@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// NotificationResponse is the JSON representation of a notification.
+// UploadID and TradeID are left out when it isn't about one.
+type NotificationResponse struct {
+	ID        int64      `json:"id"`
+	Type      string     `json:"type"`
+	Message   string     `json:"message"`
+	UploadID  *int64     `json:"upload_id,omitempty"`
+	TradeID   *int64     `json:"trade_id,omitempty"`
+	Read      bool       `json:"read"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+func newNotificationResponse(n *models.Notification) NotificationResponse {
+	resp := NotificationResponse{
+		ID:        n.ID,
+		Type:      n.Type,
+		Message:   n.Message,
+		Read:      n.ReadAt.Valid,
+		CreatedAt: n.CreatedAt,
+	}
+	if n.UploadID.Valid {
+		resp.UploadID = &n.UploadID.Int64
+	}
+	if n.TradeID.Valid {
+		resp.TradeID = &n.TradeID.Int64
+	}
+	if n.ReadAt.Valid {
+		resp.ReadAt = &n.ReadAt.Time
+	}
+	return resp
+}
+
+// NotificationsHandler lists the signed-in user's notifications, newest
+// first, along with how many are unread. ?unread=1 lists only unread ones.
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	page, perPage, offset := parsePagination(r)
+
+	notifications, total, err := models.ListNotifications(r.Context(), discordID, r.URL.Query().Get("unread") == "1", perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list notifications: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list notifications")
+		return
+	}
+	unread, err := models.CountUnreadNotifications(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to count unread notifications: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list notifications")
+		return
+	}
+
+	// Messages are kept in English and shown in the reader's locale
+	items := make([]NotificationResponse, 0, len(notifications))
+	for _, n := range notifications {
+		item := newNotificationResponse(n)
+		item.Message = middleware.Translate(w, item.Message)
+		items = append(items, item)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"notifications": items,
+		"unread":        unread,
+		"page":          page,
+		"per_page":      perPage,
+		"total":         total,
+	})
+}
+
+// UnreadNotificationsHandler returns how many of the signed-in user's
+// notifications are unread, for pages that only show a badge
+func UnreadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	unread, err := models.CountUnreadNotifications(r.Context(), middleware.GetDiscordID(r))
+	if err != nil {
+		log.Printf("Failed to count unread notifications: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to count notifications")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"unread": unread})
+}
+
+// NotificationSettingsHandler opts the signed-in user in to or out of
+// notifications by direct message from the Discord bot
+func NotificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		DiscordDMs *bool `json:"discord_dms"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.DiscordDMs == nil {
+		respondError(w, http.StatusBadRequest, "Request body must set discord_dms to true or false")
+		return
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+	if err := user.SetDiscordDMs(r.Context(), *body.DiscordDMs); err != nil {
+		log.Printf("Failed to set Discord DM preference for user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save notification settings")
+		return
+	}
+	state := "off"
+	if user.DiscordDMs {
+		state = "on"
+	}
+	log.Printf("User %s (ID: %s) turned Discord DM notifications %s", user.Username, user.DiscordID, state)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"discord_dms": user.DiscordDMs})
+}
+
+// ReadNotificationHandler marks one of the signed-in user's notifications
+// as read
+func ReadNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid notification ID")
+		return
+	}
+
+	err = models.MarkNotificationRead(r.Context(), id, middleware.GetDiscordID(r))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Notification not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to mark notification %d as read: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to mark notification as read")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReadAllNotificationsHandler marks every notification of the signed-in
+// user as read
+func ReadAllNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	marked, err := models.MarkAllNotificationsRead(r.Context(), middleware.GetDiscordID(r))
+	if err != nil {
+		log.Printf("Failed to mark notifications as read: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to mark notifications as read")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"marked": marked})
+}
@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/scheduler"
+	"github.com/gorilla/mux"
+)
+
+// fields describes a response written as a map, by an example of each value
+type fields map[string]interface{}
+
+// file describes a response that is a file rather than JSON, by its media type
+type file string
+
+// apiDoc documents an API route for the OpenAPI document
+type apiDoc struct {
+	Summary string
+	// Status is the status of a successful response, 200 if unset
+	Status int
+	// Response is an example of the successful response body, which is empty
+	// if nil
+	Response interface{}
+}
+
+// paged adds the pagination fields to a page of results
+func paged(f fields) fields {
+	f["page"] = 0
+	f["per_page"] = 0
+	f["total"] = 0
+	return f
+}
+
+// apiDocs documents every /api route, keyed like the authorization policy.
+// MountVersionedAPI refuses to start with a route missing here.
+var apiDocs = map[string]apiDoc{
+	"GET /api/openapi.json":                  {Summary: "This document", Response: fields{}},
+	"POST /api/takedown":                     {Summary: "Request a wallpaper be taken down", Status: http.StatusCreated, Response: TakedownResponse{}},
+	"GET /api/takedown/{token}":              {Summary: "Check the status of a takedown request", Response: TakedownResponse{}},
+	"GET /api/user":                          {Summary: "The signed-in user", Response: fields{"username": "", "discord_id": "", "guild_id": "", "timezone": "", "next_daily_reset": time.Time{}, "can_upload": false, "max_file_size_mb": 0, "upload_cooldown_minutes": 0, "profile_private": false, "discord_dms": false, "delete_after": time.Time{}, "impersonated_by": ""}},
+	"PUT /api/user/timezone":                 {Summary: "Set the time zone daily pulls reset in", Response: fields{"timezone": "", "next_daily_reset": time.Time{}}},
+	"PUT /api/user/privacy":                  {Summary: "Make the signed-in user's profile private or public", Response: fields{"private": false}},
+	"PUT /api/user/showcase":                 {Summary: "Choose the wallpapers shown on the signed-in user's profile", Response: fields{"showcase": []ShowcaseEntryResponse{}, "max": 0}},
+	"PUT /api/user/notifications":            {Summary: "Opt in to or out of notifications by Discord direct message", Response: fields{"discord_dms": false}},
+	"GET /api/guilds":                        {Summary: "The Discord servers the signed-in user may browse, and the current one", Response: fields{"current": "", "guilds": []GuildResponse{}}},
+	"PUT /api/guilds/current":                {Summary: "Switch the Discord server the session browses", Response: fields{"current": "", "guilds": []GuildResponse{}}},
+	"GET /api/me/uploads":                    {Summary: "The signed-in user's uploads with their status, counters and rejections", Response: paged(fields{"uploads": []MyUploadResponse{}})},
+	"GET /api/me/uploads/{id:[0-9]+}/status": {Summary: "Status of one of the signed-in user's uploads, with its place in the moderation queue", Response: UploadStatusResponse{}},
+	"GET /api/me/storage":                    {Summary: "How much storage the signed-in user's uploads use against their quota", Response: StorageResponse{}},
+	"GET /api/me/export":                     {Summary: "Download the signed-in user's data", Response: file("application/zip")},
+	"POST /api/me/delete":                    {Summary: "Request deletion of the signed-in user's account", Response: fields{"requested_at": time.Time{}, "delete_after": time.Time{}}},
+	"DELETE /api/me/delete":                  {Summary: "Cancel a pending account deletion", Status: http.StatusNoContent},
+	"GET /api/me/links":                      {Summary: "Accounts linked to the signed-in user's", Response: fields{"links": []LinkResponse{}}},
+	"POST /api/me/links":                     {Summary: "Link the signed-in account to the one that issued a link code", Response: LinkResponse{}},
+	"POST /api/me/links/code":                {Summary: "Get a code for linking another account to this one", Status: http.StatusCreated, Response: fields{"code": "", "expires_at": time.Time{}}},
+	"GET /api/me/sessions":                   {Summary: "The signed-in user's sessions", Response: fields{"sessions": []SessionResponse{}}},
+	"DELETE /api/me/sessions":                {Summary: "Sign out of every session but this one", Response: fields{"revoked": 0}},
+	"DELETE /api/me/sessions/{id:[0-9a-f]+}": {Summary: "Sign out of a session", Status: http.StatusNoContent},
+	"GET /api/users/{id:(?:[a-z]+:)?[0-9]+}": {Summary: "A user's profile", Response: ProfileResponse{}},
+	"GET /api/feed.xml":                      {Summary: "RSS feed of the newest wallpapers", Response: file("application/rss+xml")},
+	"GET /api/config":                        {Summary: "Upload requirements and the daily reset time", Response: fields{"upload_cooldown_minutes": 0, "max_file_size_mb": 0, "allowed_extensions": []string{}, "min_width": 0, "min_height": 0, "allowed_aspect_ratios": []string{}, "reset_timezone": "", "next_daily_reset": time.Time{}}},
+	"GET /api/tokens":                        {Summary: "The signed-in user's API tokens", Response: fields{"tokens": []APITokenResponse{}}},
+	"POST /api/tokens":                       {Summary: "Create an API token", Status: http.StatusCreated, Response: fields{"token": "", "details": APITokenResponse{}}},
+	"DELETE /api/tokens/{id:[0-9]+}":         {Summary: "Revoke an API token", Status: http.StatusNoContent},
+
+	"POST /api/upload":                               {Summary: "Upload a wallpaper", Response: UploadResponse{}},
+	"POST /api/upload/zip":                           {Summary: "Upload a zip archive of wallpapers", Response: ZipUploadResponse{}},
+	"GET /api/upload/status":                         {Summary: "The signed-in user's upload quota and cooldown", Response: UploadQuota{}},
+	"GET /api/upload/progress/{ticket}":              {Summary: "How much of an upload the server has received", Response: UploadProgressResponse{}},
+	"POST /api/upload/sessions":                      {Summary: "Start a resumable upload", Status: http.StatusCreated, Response: UploadSessionResponse{}},
+	"GET /api/upload/sessions/{id:[0-9]+}":           {Summary: "The progress of a resumable upload", Response: UploadSessionResponse{}},
+	"PATCH /api/upload/sessions/{id:[0-9]+}":         {Summary: "Send the next chunk of a resumable upload", Response: UploadSessionResponse{}},
+	"DELETE /api/upload/sessions/{id:[0-9]+}":        {Summary: "Abandon a resumable upload", Status: http.StatusNoContent},
+	"POST /api/upload/sessions/{id:[0-9]+}/complete": {Summary: "Finish a resumable upload", Response: UploadResponse{}},
+	"GET /api/drafts":                                {Summary: "The signed-in user's drafts", Response: []DraftResponse{}},
+	"POST /api/drafts":                               {Summary: "Save a wallpaper as a draft", Status: http.StatusCreated, Response: DraftResponse{}},
+	"GET /api/drafts/{id:[0-9]+}":                    {Summary: "A draft", Response: DraftResponse{}},
+	"PUT /api/drafts/{id:[0-9]+}":                    {Summary: "Edit a draft", Response: DraftResponse{}},
+	"DELETE /api/drafts/{id:[0-9]+}":                 {Summary: "Discard a draft", Status: http.StatusNoContent},
+	"GET /api/drafts/{id:[0-9]+}/file":               {Summary: "A draft's image", Response: file("image/*")},
+	"POST /api/drafts/{id:[0-9]+}/publish":           {Summary: "Publish a draft", Response: UploadResponse{}},
+
+	"GET /api/uploads":                          {Summary: "The gallery", Response: GalleryResponse{}},
+	"PATCH /api/uploads/{id:[0-9]+}":            {Summary: "Edit the title, description or tags of your upload", Response: WallpaperResponse{}},
+	"DELETE /api/uploads/{id:[0-9]+}":           {Summary: "Delete an upload", Status: http.StatusNoContent},
+	"POST /api/uploads/{id:[0-9]+}/report":      {Summary: "Report an upload", Status: http.StatusCreated, Response: ReportResponse{}},
+	"POST /api/uploads/{id:[0-9]+}/like":        {Summary: "Like an upload", Response: fields{"liked": false, "likes": 0}},
+	"DELETE /api/uploads/{id:[0-9]+}/like":      {Summary: "Unlike an upload", Response: fields{"liked": false, "likes": 0}},
+	"GET /api/uploads/{id:[0-9]+}/rarity-vote":  {Summary: "An upload's rarity vote", Response: RarityVoteResponse{}},
+	"POST /api/uploads/{id:[0-9]+}/rarity-vote": {Summary: "Vote on a new upload's rarity", Response: RarityVoteResponse{}},
+	"GET /api/uploads/{id:[0-9]+}/image":        {Summary: "An upload's image", Response: file("image/*")},
+	"GET /api/random":                           {Summary: "A random wallpaper", Response: RandomWallpaperResponse{}},
+	"GET /api/wallpapers/trending":              {Summary: "Wallpapers viewed and downloaded most lately", Response: paged(fields{"uploads": []TrendingWallpaperResponse{}})},
+	"GET /api/wallpapers/{id:[0-9]+}":           {Summary: "A wallpaper with its pull count and related wallpapers", Response: WallpaperDetailResponse{}},
+	"GET /api/tags":                             {Summary: "Tags matching a prefix", Response: fields{"tags": []string{}}},
+	"GET /api/search":                           {Summary: "Search wallpapers", Response: GalleryResponse{}},
+
+	"POST /api/pulls":                      {Summary: "Pull wallpapers", Response: PullResponse{}},
+	"POST /api/pulls/start":                {Summary: "Pull a wallpaper without revealing it", Response: PullStartResponse{}},
+	"POST /api/pulls/reveal":               {Summary: "Reveal a pull", Response: PullResponse{}},
+	"GET /api/pulls/status":                {Summary: "The signed-in user's pulls left today", Response: PullAllowanceResponse{}},
+	"GET /api/pulls/history":               {Summary: "The signed-in user's past pulls", Response: paged(fields{"pulls": []PullHistoryEntryResponse{}, "stats": LuckResponse{}})},
+	"POST /api/pulls/{id:[0-9]+}/reroll":   {Summary: "Reroll a pull", Response: PullResponse{}},
+	"GET /api/pulls/seeds":                 {Summary: "Daily pull seeds, revealed once their day is over", Response: paged(fields{"seeds": []PullSeedResponse{}})},
+	"GET /api/pulls/{id:[0-9]+}/verify":    {Summary: "Verify one of the signed-in user's pulls against its day's seed", Response: PullVerifyResponse{}},
+	"GET /api/rerolls":                     {Summary: "The signed-in user's rerolls", Response: paged(fields{"wallet": RerollWalletResponse{}, "achievements": []AchievementResponse{}, "history": []RerollEntryResponse{}})},
+	"GET /api/achievements":                {Summary: "Achievements and which the signed-in user has earned", Response: fields{"achievements": []AchievementResponse{}, "earned": 0, "total": 0}},
+	"GET /api/wallet":                      {Summary: "The signed-in user's bonus pulls", Response: paged(fields{"discord_id": "", "bonus_pulls": 0, "transactions": []WalletTransactionResponse{}})},
+	"GET /api/wallet/earnings":             {Summary: "Bonus pulls the signed-in user earned by taking part", Response: paged(fields{"total_earned": 0, "by_action": map[string]int{}, "rewards": config.Rewards{}, "earnings": []WalletTransactionResponse{}})},
+	"GET /api/dust":                        {Summary: "The signed-in user's dust", Response: paged(fields{"balance": 0, "rates": DustRatesResponse{}, "history": []DustEntryResponse{}})},
+	"POST /api/dust/convert":               {Summary: "Convert the signed-in user's spare copies into dust", Response: fields{"converted": 0, "dust": 0, "balance": 0}},
+	"POST /api/dust/exchange":              {Summary: "Exchange dust for a pull", Response: PullResponse{}},
+	"GET /api/collection":                  {Summary: "The signed-in user's collection", Response: paged(fields{"wallpapers": []CollectionEntryResponse{}})},
+	"GET /api/collection/download":         {Summary: "Download wallpapers in the signed-in user's collection as a zip", Response: file("application/zip")},
+	"GET /api/collection/progress":         {Summary: "How much of each tag and banner the signed-in user has collected", Response: fields{"overall": CompletionResponse{}, "tags": []TagCompletionResponse{}, "banners": []BannerCompletionResponse{}}},
+	"GET /api/wishlist":                    {Summary: "The signed-in user's wishlist", Response: fields{"wallpapers": []WishlistEntryResponse{}, "max": 0, "rate_up": 0.0}},
+	"PUT /api/wishlist/{id:[0-9]+}":        {Summary: "Add a wallpaper to the wishlist", Response: fields{"wallpapers": []WishlistEntryResponse{}, "max": 0, "rate_up": 0.0}},
+	"DELETE /api/wishlist/{id:[0-9]+}":     {Summary: "Remove a wallpaper from the wishlist", Response: fields{"wallpapers": []WishlistEntryResponse{}, "max": 0, "rate_up": 0.0}},
+	"GET /api/trades":                      {Summary: "Trades the signed-in user has offered", Response: paged(fields{"trades": []TradeResponse{}})},
+	"POST /api/trades":                     {Summary: "Offer a trade", Status: http.StatusCreated, Response: TradeResponse{}},
+	"GET /api/trades/inbox":                {Summary: "Trades offered to the signed-in user", Response: paged(fields{"trades": []TradeResponse{}})},
+	"GET /api/trades/{id:[0-9]+}":          {Summary: "A trade", Response: TradeResponse{}},
+	"POST /api/trades/{id:[0-9]+}/accept":  {Summary: "Accept a trade", Response: TradeResponse{}},
+	"POST /api/trades/{id:[0-9]+}/decline": {Summary: "Decline a trade", Response: TradeResponse{}},
+	"POST /api/trades/{id:[0-9]+}/cancel":  {Summary: "Cancel a trade", Response: TradeResponse{}},
+	"GET /api/leaderboard":                 {Summary: "The leaderboards", Response: fields{"period": "", "boards": map[string][]LeaderboardEntryResponse{}, "computed_at": time.Time{}}},
+	"GET /api/stats/timeseries":            {Summary: "A daily statistic over a period, for charts", Response: TimeSeriesResponse{}},
+	"GET /api/banners":                     {Summary: "The banners running now", Response: fields{"banners": []BannerResponse{}}},
+	"GET /api/seasons":                     {Summary: "The current guild's seasons, past and upcoming included", Response: fields{"seasons": []SeasonResponse{}}},
+
+	"GET /api/notifications":                   {Summary: "The signed-in user's notifications", Response: paged(fields{"notifications": []NotificationResponse{}, "unread": 0})},
+	"GET /api/notifications/unread":            {Summary: "How many of the signed-in user's notifications are unread", Response: fields{"unread": 0}},
+	"POST /api/notifications/read":             {Summary: "Mark every notification as read", Response: fields{"marked": 0}},
+	"POST /api/notifications/{id:[0-9]+}/read": {Summary: "Mark a notification as read", Status: http.StatusNoContent},
+
+	"POST /api/admin/uploads/bulk":                 {Summary: "Act on many uploads at once", Response: fields{"action": "", "updated": 0, "results": []BulkResultResponse{}}},
+	"GET /api/admin/uploads/{id:[0-9]+}":           {Summary: "An upload with moderation details", Response: UploadDetailResponse{}},
+	"PUT /api/admin/uploads/{id:[0-9]+}/tags":      {Summary: "Replace an upload's tags", Response: WallpaperResponse{}},
+	"POST /api/admin/uploads/{id:[0-9]+}/owner":    {Summary: "Transfer an upload to another user", Response: ReassignUploadResponse{}},
+	"POST /api/admin/uploads/{id:[0-9]+}/merge":    {Summary: "Merge a duplicated upload into another", Response: MergeUploadResponse{}},
+	"GET /api/admin/takedowns":                     {Summary: "Takedown requests", Response: fields{"takedowns": []AdminTakedownResponse{}, "page": 0, "per_page": 0}},
+	"POST /api/admin/takedowns/{id:[0-9]+}":        {Summary: "Resolve a takedown request", Response: TakedownResponse{}},
+	"GET /api/admin/reports":                       {Summary: "Open reports", Response: paged(fields{"reports": []ReportResponse{}})},
+	"POST /api/admin/uploads/{id:[0-9]+}/reports":  {Summary: "Review an upload's reports", Response: WallpaperResponse{}},
+	"GET /api/admin/stats":                         {Summary: "Site statistics", Response: SiteStatsResponse{}},
+	"GET /api/admin/trash":                         {Summary: "Deleted uploads", Response: GalleryResponse{}},
+	"POST /api/admin/trash/{id:[0-9]+}/restore":    {Summary: "Restore a deleted upload", Response: WallpaperResponse{}},
+	"DELETE /api/admin/trash/{id:[0-9]+}":          {Summary: "Purge a deleted upload", Status: http.StatusNoContent},
+	"GET /api/admin/quarantine":                    {Summary: "Quarantined files", Response: paged(fields{"files": []QuarantinedFileResponse{}})},
+	"GET /api/admin/quarantine/{id:[0-9]+}/file":   {Summary: "A quarantined file", Response: file("application/octet-stream")},
+	"DELETE /api/admin/quarantine/{id:[0-9]+}":     {Summary: "Delete a quarantined file", Status: http.StatusNoContent},
+	"GET /api/admin/integrity":                     {Summary: "The last storage integrity check", Response: jobs.IntegrityReport{}},
+	"POST /api/admin/integrity":                    {Summary: "Check storage integrity now", Response: jobs.IntegrityReport{}},
+	"GET /api/admin/orphans":                       {Summary: "The last orphaned file scan", Response: jobs.OrphanReport{}},
+	"POST /api/admin/orphans":                      {Summary: "Scan for orphaned files now", Response: jobs.OrphanReport{}},
+	"GET /api/admin/scheduler":                     {Summary: "Scheduled tasks and their last runs", Response: fields{"tasks": []scheduler.Status{}}},
+	"POST /api/admin/scheduler/{name:[a-z_]+}/run": {Summary: "Run a scheduled task now", Status: http.StatusAccepted},
+	"GET /api/admin/bans":                          {Summary: "Banned users", Response: paged(fields{"bans": []BanResponse{}})},
+	"POST /api/admin/bans":                         {Summary: "Ban a user", Status: http.StatusCreated, Response: BanResponse{}},
+	"DELETE /api/admin/bans/{id}":                  {Summary: "Unban a user", Status: http.StatusNoContent},
+	"GET /api/admin/storage":                       {Summary: "Users by the storage their uploads use, largest first", Response: paged(fields{"users": []UserStorageResponse{}})},
+	"GET /api/admin/users/{id}/sessions":           {Summary: "A user's sessions", Response: fields{"sessions": []SessionResponse{}}},
+	"DELETE /api/admin/users/{id}/sessions":        {Summary: "Sign a user out everywhere", Response: fields{"terminated": 0}},
+	"GET /api/admin/links":                         {Summary: "Account links by status", Response: paged(fields{"links": []LinkResponse{}})},
+	"POST /api/admin/links/{id:[0-9]+}":            {Summary: "Approve or reject a pending account link", Response: LinkResponse{}},
+	"GET /api/admin/alts":                          {Summary: "Suspected alt accounts, grouped by shared device fingerprints", Response: paged(fields{"clusters": []AltClusterResponse{}})},
+	"GET /api/admin/users/{id}/names":              {Summary: "A user's current and past names", Response: fields{"discord_id": "", "username": "", "display_name": "", "past_names": []PastNameResponse{}}},
+	"GET /api/admin/audit":                         {Summary: "The audit log", Response: paged(fields{"entries": []AuditEntryResponse{}})},
+	"POST /api/admin/wallets/adjustments":          {Summary: "Grant or revoke bonus pulls", Response: fields{"type": "", "amount": 0, "users_changed": 0}},
+	"GET /api/admin/wallets/{id}":                  {Summary: "A user's bonus pulls", Response: paged(fields{"discord_id": "", "bonus_pulls": 0, "transactions": []WalletTransactionResponse{}})},
+	"GET /api/admin/banners":                       {Summary: "All banners", Response: fields{"banners": []BannerResponse{}}},
+	"POST /api/admin/banners":                      {Summary: "Create a banner", Status: http.StatusCreated, Response: BannerResponse{}},
+	"PUT /api/admin/banners/{id:[0-9]+}":           {Summary: "Edit a banner", Response: BannerResponse{}},
+	"DELETE /api/admin/banners/{id:[0-9]+}":        {Summary: "Delete a banner", Status: http.StatusNoContent},
+	"GET /api/admin/gacha/rates":                   {Summary: "The rarity rates and banner rate-ups pulls use", Response: GachaRatesResponse{}},
+	"PUT /api/admin/gacha/rates":                   {Summary: "Change rarity rates and banner rate-ups", Response: GachaRatesResponse{}},
+	"GET /api/admin/gacha/pool":                    {Summary: "How many wallpapers of each rarity a guild's pull pool holds", Response: PoolResponse{}},
+	"GET /api/admin/gacha/pool/{rarity:[a-z]+}":    {Summary: "The wallpapers of a rarity in a guild's pull pool", Response: GalleryResponse{}},
+	"POST /api/admin/gacha/pool/uploads":           {Summary: "Move uploads to another rarity or in or out of the pull pool", Response: fields{"updated": 0, "results": []BulkResultResponse{}}},
+	"GET /api/admin/maintenance":                   {Summary: "Whether the site is in maintenance mode", Response: MaintenanceResponse{}},
+	"PUT /api/admin/maintenance":                   {Summary: "Start or end maintenance mode", Response: MaintenanceResponse{}},
+	"POST /api/admin/config/reload":                {Summary: "Reload the settings in the config file that can change at runtime", Response: config.ReloadResult{}},
+	"GET /api/admin/upload-rules":                  {Summary: "The upload rules in the config and those added at runtime", Response: fields{"configured": []UploadRuleResponse{}, "rules": []UploadRuleResponse{}}},
+	"POST /api/admin/upload-rules":                 {Summary: "Add an upload rule", Status: http.StatusCreated, Response: UploadRuleResponse{}},
+	"DELETE /api/admin/upload-rules/{id:[0-9]+}":   {Summary: "Remove an upload rule added at runtime", Status: http.StatusNoContent},
+	"GET /api/admin/seasons":                       {Summary: "All seasons", Response: fields{"seasons": []SeasonResponse{}}},
+	"POST /api/admin/seasons":                      {Summary: "Create a season", Status: http.StatusCreated, Response: SeasonResponse{}},
+	"PUT /api/admin/seasons/{id:[0-9]+}":           {Summary: "Edit a season", Response: SeasonResponse{}},
+	"DELETE /api/admin/seasons/{id:[0-9]+}":        {Summary: "Delete a season", Status: http.StatusNoContent},
+	"GET /api/admin/deliveries":                    {Summary: "Webhook deliveries", Response: paged(fields{"deliveries": []DeliveryResponse{}})},
+	"POST /api/admin/deliveries/{id:[0-9]+}/retry": {Summary: "Retry a webhook delivery", Response: DeliveryResponse{}},
+	"GET /api/admin/policy":                        {Summary: "The authorization policy being enforced", Response: fields{"policy": []PolicyEntryResponse{}}},
+	"POST /api/admin/impersonate/{id}":             {Summary: "View the site as another user", Response: fields{"impersonating": "", "username": "", "write": false, "expires_at": time.Time{}}},
+	"DELETE /api/admin/impersonate":                {Summary: "Stop viewing as another user", Status: http.StatusNoContent},
+}
+
+var openAPIDocument []byte
+
+// OpenAPIHandler serves the OpenAPI document of the versioned API
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// MountVersionedAPI serves every /api route registered so far under
+// /api/v1 as well, and builds the OpenAPI document describing them. It is
+// called once all routes are registered.
+func MountVersionedAPI(r *mux.Router) error {
+	type apiRoute struct {
+		template string
+		methods  []string
+		handler  http.Handler
+	}
+	var routes []apiRoute
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/") {
+			return nil
+		}
+		// Routes of the content host serve files, not the API
+		if _, err := route.GetHostTemplate(); err == nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		routes = append(routes, apiRoute{template, methods, route.GetHandler()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	doc := newOpenAPIBuilder()
+	var undocumented []string
+	for _, route := range routes {
+		versioned := middleware.APIv1Prefix + strings.TrimPrefix(route.template, "/api")
+		r.Handle(versioned, route.handler).Methods(route.methods...)
+		for _, method := range route.methods {
+			d, ok := apiDocs[method+" "+route.template]
+			if !ok {
+				undocumented = append(undocumented, method+" "+route.template)
+				continue
+			}
+			doc.addOperation(method, route.template, versioned, d)
+		}
+	}
+	if len(undocumented) > 0 {
+		sort.Strings(undocumented)
+		return fmt.Errorf("API routes missing from the OpenAPI document: %s", strings.Join(undocumented, ", "))
+	}
+
+	openAPIDocument, err = json.MarshalIndent(doc.document(), "", "  ")
+	return err
+}
+
+// schema is a JSON Schema object of the OpenAPI document
+type schema = map[string]interface{}
+
+// openAPIBuilder collects the operations and named schemas of the document
+type openAPIBuilder struct {
+	paths   map[string]map[string]interface{}
+	schemas map[string]schema
+}
+
+func newOpenAPIBuilder() *openAPIBuilder {
+	b := &openAPIBuilder{paths: map[string]map[string]interface{}{}, schemas: map[string]schema{}}
+	b.schemaOf(reflect.TypeOf(middleware.ErrorResponse{}))
+	return b
+}
+
+func (b *openAPIBuilder) document() interface{} {
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Wallpaper Gacha API",
+			"version": "1",
+		},
+		"paths": b.paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"cookieAuth": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "cookie",
+					"name":        middleware.SessionName,
+					"description": "The session of a signed-in browser. Requests other than GET also need the session's CSRF token in the " + middleware.CSRFHeader + " header.",
+				},
+				"bearerAuth": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An API token created at /api/v1/tokens. Tokens act with the permission their user had when creating them.",
+				},
+			},
+		},
+	}
+}
+
+// pathParam matches a variable in a route template, and its pattern if any
+var pathParam = regexp.MustCompile(`\{([a-z]+)(?::([^{}]*(?:\{[^{}]*\}[^{}]*)*))?\}`)
+
+// addOperation documents a route of the versioned API, served at versioned
+// for the /api route template
+func (b *openAPIBuilder) addOperation(method, template, versioned string, d apiDoc) {
+	var params []interface{}
+	path := pathParam.ReplaceAllStringFunc(versioned, func(m string) string {
+		sub := pathParam.FindStringSubmatch(m)
+		s := schema{"type": "string"}
+		if sub[2] == "[0-9]+" {
+			s = schema{"type": "integer", "format": "int64"}
+		} else if sub[2] != "" {
+			s["pattern"] = "^" + sub[2] + "$"
+		}
+		params = append(params, map[string]interface{}{"name": sub[1], "in": "path", "required": true, "schema": s})
+		return "{" + sub[1] + "}"
+	})
+
+	status := d.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	switch resp := d.Response.(type) {
+	case nil:
+	case file:
+		success["content"] = map[string]interface{}{string(resp): map[string]interface{}{"schema": schema{"type": "string", "format": "binary"}}}
+	case fields:
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": b.fieldsSchema(resp)}}
+	default:
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schemaOf(reflect.TypeOf(resp))}}
+	}
+
+	op := map[string]interface{}{
+		"summary":     d.Summary,
+		"operationId": strings.ToLower(method) + strings.NewReplacer("/", "_", "{", "", "}", "", ".", "_").Replace(path),
+		"responses": map[string]interface{}{
+			fmt.Sprint(status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema{"$ref": "#/components/schemas/ErrorResponse"}}},
+			},
+		},
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	// Who may call the route; deployments can change this with
+	// authorization_policy
+	role := middleware.EffectivePolicy()[method+" "+template]
+	if role == middleware.RolePublic {
+		op["security"] = []interface{}{}
+	} else {
+		security := []interface{}{map[string]interface{}{"cookieAuth": []string{}}}
+		if middleware.TokensAllowed(template) {
+			security = append(security, map[string]interface{}{"bearerAuth": []string{}})
+		}
+		op["security"] = security
+		op["x-required-role"] = role
+	}
+
+	if b.paths[path] == nil {
+		b.paths[path] = map[string]interface{}{}
+	}
+	b.paths[path][strings.ToLower(method)] = op
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf describes a Go type as encoding/json writes it. Named structs
+// become components referred to by name.
+func (b *openAPIBuilder) schemaOf(t reflect.Type) schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schemaOf(t.Elem())
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": b.schemaOf(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": b.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return schema{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// Placeholder for types that refer to themselves
+			b.schemas[t.Name()] = schema{}
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return schema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return schema{}
+}
+
+// fieldsSchema describes a map response from its example values
+func (b *openAPIBuilder) fieldsSchema(f fields) schema {
+	props := schema{}
+	for name, v := range f {
+		props[name] = b.schemaOf(reflect.TypeOf(v))
+	}
+	return schema{"type": "object", "properties": props}
+}
+
+// structSchema describes a struct's JSON fields. Fields without omitempty
+// are always present; those of embedded structs are merged in.
+func (b *openAPIBuilder) structSchema(t reflect.Type) schema {
+	props := schema{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			embedded := b.structSchema(ft)
+			for k, v := range embedded["properties"].(schema) {
+				props[k] = v
+			}
+			if req, ok := embedded["required"].([]string); ok {
+				required = append(required, req...)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := schema{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
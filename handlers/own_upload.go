@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// Actions an uploader can take on one of their uploads
+const (
+	uploadActionEdit   = "edit"
+	uploadActionDelete = "delete"
+)
+
+// MyUploadResponse is one of the signed-in user's uploads with its status,
+// counters, every time it was rejected and what the user can do with it
+type MyUploadResponse struct {
+	WallpaperResponse
+	Status     string              `json:"status"`
+	Stats      UploadStatsResponse `json:"stats"`
+	Rejections []RejectionResponse `json:"rejections"`
+	Actions    []string            `json:"actions"`
+}
+
+// How far back the pace of each queue is measured for wait estimates. Safety
+// checks run around the clock while admins review in bursts, so reviews are
+// measured over a longer stretch.
+var queueWindows = map[string]time.Duration{
+	models.QueueContentCheck: 24 * time.Hour,
+	models.QueueReview:       7 * 24 * time.Hour,
+}
+
+// QueueResponse is where an upload stands in the queue it waits in before it
+// is shown. The estimate is left out while nothing has left the queue
+// recently.
+type QueueResponse struct {
+	Queue             string     `json:"queue"`
+	Position          int        `json:"position"`
+	Length            int        `json:"length"`
+	Since             time.Time  `json:"since"`
+	ReviewedRecently  int        `json:"reviewed_recently"`
+	WindowHours       int        `json:"window_hours"`
+	EstimatedWaitSecs int64      `json:"estimated_wait_seconds,omitempty"`
+	EstimatedAt       *time.Time `json:"estimated_review_at,omitempty"`
+}
+
+// uploadQueue returns where an upload stands in its queue, or nil if it isn't
+// waiting in one
+func uploadQueue(ctx context.Context, upload *models.Upload) (*QueueResponse, error) {
+	var window time.Duration
+	switch {
+	case upload.SafetyStatus == models.SafetyPending:
+		window = queueWindows[models.QueueContentCheck]
+	case upload.ReportHidden:
+		window = queueWindows[models.QueueReview]
+	default:
+		return nil, nil
+	}
+	status, err := models.GetQueueStatus(ctx, upload, window)
+	if err != nil || status == nil {
+		return nil, err
+	}
+
+	resp := &QueueResponse{
+		Queue:            status.Queue,
+		Position:         status.Position,
+		Length:           status.Length,
+		Since:            status.Since,
+		ReviewedRecently: status.Reviewed,
+		WindowHours:      int(status.Window / time.Hour),
+	}
+	if wait, ok := status.EstimatedWait(); ok {
+		at := time.Now().UTC().Add(wait).Truncate(time.Second)
+		resp.EstimatedWaitSecs = int64(wait / time.Second)
+		resp.EstimatedAt = &at
+	}
+	return resp, nil
+}
+
+// UploadStatusResponse is where one of the signed-in user's uploads stands
+type UploadStatusResponse struct {
+	ID     int64          `json:"id"`
+	Status string         `json:"status"`
+	Queue  *QueueResponse `json:"queue,omitempty"`
+}
+
+// MyUploadStatusHandler tells the signed-in user the status of one of their
+// uploads and, while it waits for its content check or a review, where it
+// stands in that queue and about when its turn comes
+func MyUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows || (err == nil && upload.DiscordID != discordID) {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload status")
+		return
+	}
+
+	rejections, err := models.ListUploadRejections(r.Context(), []int64{upload.ID})
+	if err != nil {
+		log.Printf("Failed to list rejections of upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload status")
+		return
+	}
+	queue, err := uploadQueue(r.Context(), upload)
+	if err != nil {
+		log.Printf("Failed to get queue position of upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload status")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UploadStatusResponse{
+		ID:     upload.ID,
+		Status: models.OwnUploadStatus(upload, rejections[upload.ID]),
+		Queue:  queue,
+	})
+}
+
+// MyUploadsHandler lists the signed-in user's uploads in every guild, newest
+// first, including hidden and trashed ones, optionally narrowed by status
+func MyUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	page, perPage, offset := parsePagination(r)
+
+	status := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("status")))
+	if status != "" && !slices.Contains(models.UploadStatuses, status) {
+		respondError(w, http.StatusBadRequest, "status must be one of: "+strings.Join(models.UploadStatuses, ", "))
+		return
+	}
+
+	uploads, total, err := models.ListOwnUploads(r.Context(), discordID, status, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list uploads of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list uploads")
+		return
+	}
+
+	ids := make([]int64, 0, len(uploads))
+	for _, u := range uploads {
+		ids = append(ids, u.ID)
+	}
+	rejections, err := models.ListUploadRejections(r.Context(), ids)
+	if err != nil {
+		log.Printf("Failed to list rejections of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list uploads")
+		return
+	}
+	stats, err := models.ListUploadStats(r.Context(), ids)
+	if err != nil {
+		log.Printf("Failed to get upload stats of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list uploads")
+		return
+	}
+
+	items := make([]MyUploadResponse, 0, len(uploads))
+	for _, u := range uploads {
+		s := stats[u.ID]
+		item := MyUploadResponse{
+			WallpaperResponse: newWallpaperResponse(r, u),
+			Status:            models.OwnUploadStatus(&u, rejections[u.ID]),
+			Stats:             UploadStatsResponse{Views: s.Views, Downloads: s.Downloads, Pulls: s.Pulls},
+			Rejections:        []RejectionResponse{},
+			Actions:           []string{},
+		}
+		for _, rej := range rejections[u.ID] {
+			item.Rejections = append(item.Rejections, RejectionResponse{Reason: rej.Reason, Note: rej.Note, CreatedAt: rej.CreatedAt})
+		}
+		if !u.DeletedAt.Valid {
+			item.Actions = append(item.Actions, uploadActionEdit, uploadActionDelete)
+		}
+		items = append(items, item)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uploads":  items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// EditUploadHandler lets a user change the title, description and tags of
+// one of their own uploads. Fields left out of the request keep their value.
+func EditUploadHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	var req struct {
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Tags        *[]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows || (err == nil && upload.DeletedAt.Valid) {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update upload")
+		return
+	}
+
+	if upload.DiscordID != discordID {
+		log.Printf("Edit denied: user %s (ID: %s) does not own upload %d", username, discordID, uploadID)
+		apiError(w, http.StatusForbidden, codeNotOwner, "You can only edit your own uploads")
+		return
+	}
+
+	title, description, rawTags := upload.Title, upload.Description, upload.Tags
+	if req.Title != nil {
+		title = *req.Title
+	}
+	if req.Description != nil {
+		description = *req.Description
+	}
+	if req.Tags != nil {
+		rawTags = *req.Tags
+	}
+	title, description, tags, err := validateUploadMetadata(title, description, rawTags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = models.EditUpload(r.Context(), upload.ID, title, description, tags)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to edit upload %d for user %s (ID: %s): %v", upload.ID, username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update upload")
+		return
+	}
+
+	log.Printf("Upload edited: user %s (ID: %s) updated upload %d", username, discordID, upload.ID)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditEditUpload, uploadTarget(upload.ID), strings.Join(tags, ","))
+
+	upload.Title, upload.Description, upload.Tags = title, description, tags
+	writeJSON(w, http.StatusOK, newWallpaperResponse(r, *upload))
+}
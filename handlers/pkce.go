@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// How long a login may take between redirecting to Discord and the callback
+const pkceVerifierTTL = 10 * time.Minute
+
+type pendingVerifier struct {
+	verifier string
+	expires  time.Time
+}
+
+// pkceVerifiers holds the PKCE code verifier of each login in progress, keyed
+// by its OAuth state, so the verifier never leaves the server
+var pkceVerifiers = struct {
+	sync.Mutex
+	byState map[string]pendingVerifier
+}{byState: make(map[string]pendingVerifier)}
+
+// storePKCEVerifier remembers the verifier for a login started with state
+func storePKCEVerifier(state, verifier string) {
+	pkceVerifiers.Lock()
+	defer pkceVerifiers.Unlock()
+
+	now := time.Now()
+	for s, p := range pkceVerifiers.byState {
+		if now.After(p.expires) {
+			delete(pkceVerifiers.byState, s)
+		}
+	}
+	pkceVerifiers.byState[state] = pendingVerifier{verifier: verifier, expires: now.Add(pkceVerifierTTL)}
+}
+
+// takePKCEVerifier returns and forgets the verifier for state. It reports
+// false when the login is unknown or took too long.
+func takePKCEVerifier(state string) (string, bool) {
+	pkceVerifiers.Lock()
+	defer pkceVerifiers.Unlock()
+
+	p, ok := pkceVerifiers.byState[state]
+	delete(pkceVerifiers.byState, state)
+	if !ok || time.Now().After(p.expires) {
+		return "", false
+	}
+	return p.verifier, true
+}
+
+// pkceChallenge derives the S256 code challenge sent with the authorization
+// request from a verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
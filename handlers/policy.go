@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+)
+
+// PolicyEntryResponse is one route in the effective authorization policy
+type PolicyEntryResponse struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Role   string `json:"role"`
+}
+
+// AdminPolicyHandler dumps the authorization policy currently being enforced
+func AdminPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	policy := middleware.EffectivePolicy()
+
+	entries := make([]PolicyEntryResponse, 0, len(policy))
+	for route, role := range policy {
+		method, path, _ := strings.Cut(route, " ")
+		entries = append(entries, PolicyEntryResponse{Method: method, Path: path, Role: role})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Path != entries[j].Path {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Method < entries[j].Method
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"policy": entries,
+	})
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// PoolTierResponse is a rarity tier of a guild's standard pull pool: its
+// rate in effect, how many wallpapers pulls can draw from it and how many
+// admins took out of the pool
+type PoolTierResponse struct {
+	Rarity   string  `json:"rarity"`
+	Rate     float64 `json:"rate"`
+	Pullable int     `json:"pullable"`
+	Disabled int     `json:"disabled"`
+}
+
+// PoolResponse is the composition of a guild's standard pull pool. Warnings
+// name the tiers pulls skip because they have a rate but no wallpapers.
+type PoolResponse struct {
+	GuildID  string             `json:"guild_id"`
+	Pullable int                `json:"pullable"`
+	Tiers    []PoolTierResponse `json:"tiers"`
+	Warnings []string           `json:"warnings"`
+}
+
+// poolGuild returns the guild named by ?guild_id=, or the admin's current
+// guild, writing an error response and returning "" if it isn't configured
+func poolGuild(w http.ResponseWriter, r *http.Request) string {
+	guildID := r.URL.Query().Get("guild_id")
+	if guildID == "" {
+		guildID = middleware.GetGuildID(r)
+	}
+	if !config.AppConfig.IsAllowedGuild(guildID) {
+		respondError(w, http.StatusBadRequest, "guild_id must be one of the configured guilds")
+		return ""
+	}
+	return guildID
+}
+
+// AdminPoolHandler shows how many wallpapers of each rarity are in a guild's
+// standard pull pool, and warns of tiers with a rate that pulls can't draw
+// because they are empty
+func AdminPoolHandler(w http.ResponseWriter, r *http.Request) {
+	guildID := poolGuild(w, r)
+	if guildID == "" {
+		return
+	}
+
+	tiers, err := models.PoolComposition(r.Context(), guildID)
+	if err != nil {
+		log.Printf("Failed to get pool of guild %s: %v", guildID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get pool")
+		return
+	}
+
+	rates := config.AppConfig.EffectiveRarityRates()
+	resp := PoolResponse{GuildID: guildID, Tiers: make([]PoolTierResponse, 0, len(tiers)), Warnings: []string{}}
+	for _, t := range tiers {
+		resp.Pullable += t.Pullable
+		resp.Tiers = append(resp.Tiers, PoolTierResponse{Rarity: t.Rarity, Rate: rates[t.Rarity], Pullable: t.Pullable, Disabled: t.Disabled})
+		if rates[t.Rarity] > 0 && t.Pullable == 0 {
+			resp.Warnings = append(resp.Warnings, fmt.Sprintf("No %s wallpapers can be pulled; pulls skip the tier despite its rate", t.Rarity))
+		}
+	}
+	if resp.Pullable == 0 {
+		resp.Warnings = append(resp.Warnings, "The pool is empty, so every pull fails")
+	}
+	resp.Warnings = translateAll(w, resp.Warnings)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminPoolTierHandler lists the wallpapers of a rarity in a guild's
+// standard pull pool, including those taken out of it, oldest first
+func AdminPoolTierHandler(w http.ResponseWriter, r *http.Request) {
+	rarity, err := models.ParseRarity(mux.Vars(r)["rarity"])
+	if err != nil || rarity == "" {
+		respondError(w, http.StatusNotFound, "Unknown rarity")
+		return
+	}
+	guildID := poolGuild(w, r)
+	if guildID == "" {
+		return
+	}
+	page, perPage, offset := parsePagination(r)
+
+	uploads, total, err := models.ListPoolTier(r.Context(), guildID, rarity, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list %s wallpapers of guild %s: %v", rarity, guildID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list pool")
+		return
+	}
+
+	items := make([]WallpaperResponse, 0, len(uploads))
+	for _, u := range uploads {
+		items = append(items, newWallpaperResponse(r, u))
+	}
+	writeJSON(w, http.StatusOK, GalleryResponse{Uploads: items, Page: page, PerPage: perPage, Total: total})
+}
+
+// AdminUpdatePoolHandler moves uploads to another rarity and takes them out
+// of the pull pool or puts them back, without deleting them. A change that
+// would leave a tier with a rate, or the whole pool, without wallpapers in a
+// guild is refused with 409 unless force is set.
+func AdminUpdatePoolHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs         []int64 `json:"ids"`
+		Rarity      string  `json:"rarity"`
+		PoolEnabled *bool   `json:"pool_enabled"`
+		Force       bool    `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	rarity, err := models.ParseRarity(req.Rarity)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rarity == "" && req.PoolEnabled == nil {
+		respondError(w, http.StatusBadRequest, "rarity or pool_enabled is required")
+		return
+	}
+
+	seen := make(map[int64]bool, len(req.IDs))
+	var ids []int64
+	for _, id := range req.IDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		respondError(w, http.StatusBadRequest, "ids must list at least one upload")
+		return
+	}
+	if len(ids) > models.MaxBulkUploads {
+		respondError(w, http.StatusBadRequest, "ids may list at most "+strconv.Itoa(models.MaxBulkUploads)+" uploads")
+		return
+	}
+
+	change := models.PoolChange{Rarity: rarity, Enabled: req.PoolEnabled}
+	results, err := models.UpdatePoolUploads(r.Context(), ids, change, config.AppConfig.EffectiveRarityRates(), req.Force)
+	var emptyTier *models.EmptyTierError
+	if errors.As(err, &emptyTier) {
+		apiError(w, http.StatusConflict, codeEmptyPoolTier, "Not changed: "+emptyTier.Error()+"; set force to change it anyway")
+		return
+	} else if err != nil {
+		log.Printf("Failed to update pool uploads %v: %v", ids, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update uploads")
+		return
+	}
+
+	adminID := middleware.GetRealDiscordID(r)
+	resp := make([]BulkResultResponse, 0, len(results))
+	var done int
+	for _, res := range results {
+		resp = append(resp, BulkResultResponse{UploadID: res.UploadID, Status: res.Status, Reason: res.Reason})
+		if res.Status != models.BulkDone {
+			continue
+		}
+		done++
+		if rarity != "" {
+			recordAudit(r, adminID, models.AuditPoolRarity, uploadTarget(res.UploadID), rarity)
+		}
+		if req.PoolEnabled != nil && *req.PoolEnabled {
+			recordAudit(r, adminID, models.AuditPoolEnable, uploadTarget(res.UploadID), "")
+		} else if req.PoolEnabled != nil {
+			recordAudit(r, adminID, models.AuditPoolDisable, uploadTarget(res.UploadID), "")
+		}
+	}
+
+	log.Printf("Admin %s (ID: %s) changed the pool entries of %d of %d uploads", middleware.GetUsername(r), adminID, done, len(ids))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"updated": done,
+		"results": resp,
+	})
+}
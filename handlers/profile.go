@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/assets"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/oauth"
+	"github.com/gorilla/mux"
+)
+
+// ProfileResponse is a user's profile as other users see it. Collected counts
+// wallpapers from every guild; Completion is the percentage of the
+// wallpapers currently in the current guild's pool the user owns.
+// Duplicates counts the copies they hold beyond the first of each wallpaper.
+type ProfileResponse struct {
+	DiscordID    string                  `json:"discord_id"`
+	Username     string                  `json:"username"`
+	DisplayName  string                  `json:"display_name"`
+	AvatarURL    string                  `json:"avatar_url"`
+	JoinedAt     time.Time               `json:"joined_at"`
+	Private      bool                    `json:"private"`
+	TotalPulls   int                     `json:"total_pulls"`
+	Collected    int                     `json:"collected"`
+	PoolSize     int                     `json:"pool_size"`
+	Completion   float64                 `json:"completion"`
+	Duplicates   int                     `json:"duplicates"`
+	Badges       []AchievementResponse   `json:"badges"`
+	Showcase     []ShowcaseEntryResponse `json:"showcase"`
+	Uploads      []WallpaperResponse     `json:"uploads"`
+	UploadsTotal int                     `json:"uploads_total"`
+	Page         int                     `json:"page"`
+	PerPage      int                     `json:"per_page"`
+}
+
+// profileError is why a profile can't be shown
+type profileError struct {
+	status  int
+	message string
+}
+
+// loadProfile gathers a user's profile for the signed-in viewer. Private
+// profiles are only shown to their owner and to admins.
+func loadProfile(r *http.Request, discordID string) (*ProfileResponse, *profileError) {
+	user, err := models.GetUser(r.Context(), discordID)
+	if err == sql.ErrNoRows {
+		return nil, &profileError{http.StatusNotFound, "User not found"}
+	} else if err != nil {
+		log.Printf("Failed to get user %s: %v", discordID, err)
+		return nil, &profileError{http.StatusInternalServerError, "Failed to get profile"}
+	}
+	viewer := middleware.GetDiscordID(r)
+	// Owners and admins also see the user's unlisted and private uploads
+	privileged := viewer == user.DiscordID || config.AppConfig.IsAdmin(middleware.GetRealDiscordID(r))
+	if user.ProfilePrivate && !privileged {
+		return nil, &profileError{http.StatusForbidden, "This profile is private"}
+	}
+
+	page, perPage, offset := parsePagination(r)
+	guildID := middleware.GetGuildID(r)
+	uploads, total, err := models.ListUploads(r.Context(), models.UploadFilter{GuildID: guildID, DiscordID: user.DiscordID, AllVisibilities: privileged, Limit: perPage, Offset: offset})
+	if err != nil {
+		log.Printf("Failed to list uploads of user %s: %v", discordID, err)
+		return nil, &profileError{http.StatusInternalServerError, "Failed to get profile"}
+	}
+	pulls, collected, err := models.PullStats(r.Context(), user.DiscordID)
+	if err != nil {
+		log.Printf("Failed to get pull stats of user %s: %v", discordID, err)
+		return nil, &profileError{http.StatusInternalServerError, "Failed to get profile"}
+	}
+	pool, err := models.PoolCompletion(r.Context(), user.DiscordID, guildID)
+	if err != nil {
+		log.Printf("Failed to get pool completion of user %s: %v", discordID, err)
+		return nil, &profileError{http.StatusInternalServerError, "Failed to get profile"}
+	}
+	duplicates, err := models.CountHeldDuplicates(r.Context(), user.DiscordID)
+	if err != nil {
+		log.Printf("Failed to count duplicates of user %s: %v", discordID, err)
+		return nil, &profileError{http.StatusInternalServerError, "Failed to get profile"}
+	}
+	showcase, err := models.ListShowcase(r.Context(), user.DiscordID, privileged)
+	if err != nil {
+		log.Printf("Failed to list showcase of user %s: %v", discordID, err)
+		return nil, &profileError{http.StatusInternalServerError, "Failed to get profile"}
+	}
+	achievements, err := gacha.UserAchievements(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to get achievements of user %s: %v", discordID, err)
+		return nil, &profileError{http.StatusInternalServerError, "Failed to get profile"}
+	}
+
+	profile := &ProfileResponse{
+		DiscordID:    user.DiscordID,
+		Username:     user.Username,
+		DisplayName:  user.DisplayName,
+		AvatarURL:    oauth.AvatarURL(user.DiscordID, user.Avatar),
+		JoinedAt:     user.CreatedAt,
+		Private:      user.ProfilePrivate,
+		TotalPulls:   pulls,
+		Collected:    collected,
+		PoolSize:     pool.Total,
+		Duplicates:   duplicates,
+		Badges:       []AchievementResponse{},
+		Showcase:     newShowcaseResponse(r, showcase),
+		Uploads:      make([]WallpaperResponse, 0, len(uploads)),
+		UploadsTotal: total,
+		Page:         page,
+		PerPage:      perPage,
+	}
+	if pool.Total > 0 {
+		profile.Completion = math.Round(float64(pool.Owned)/float64(pool.Total)*1000) / 10
+	}
+	for _, a := range achievements {
+		if !a.UnlockedAt.IsZero() {
+			profile.Badges = append(profile.Badges, newAchievementResponse(a))
+		}
+	}
+	for _, u := range uploads {
+		profile.Uploads = append(profile.Uploads, newWallpaperResponse(r, u))
+	}
+	return profile, nil
+}
+
+// UserProfileHandler returns a user's profile: join date, pull stats,
+// collection completion, badges, showcased wallpapers and a page of their
+// public uploads
+func UserProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, perr := loadProfile(r, mux.Vars(r)["id"])
+	if perr != nil {
+		respondError(w, perr.status, perr.message)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+var profilePage = assets.Page("profile.html")
+
+// ProfilePageHandler renders a user's profile page
+func ProfilePageHandler(w http.ResponseWriter, r *http.Request) {
+	profile, perr := loadProfile(r, mux.Vars(r)["id"])
+	if perr != nil {
+		title := "Profile unavailable"
+		if perr.status == http.StatusNotFound {
+			title = "User not found"
+		}
+		renderErrorPage(w, perr.status, title, perr.message)
+		return
+	}
+	// The owner's page can toggle privacy, which needs a CSRF token
+	own := profile.DiscordID == middleware.GetDiscordID(r)
+	var token string
+	if own {
+		var err error
+		if token, err = middleware.CSRFToken(w, r); err != nil {
+			log.Printf("Failed to get CSRF token for user %s (ID: %s): %v", middleware.GetUsername(r), middleware.GetRealDiscordID(r), err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := profilePage.Execute(w, struct {
+		*ProfileResponse
+		Own       bool
+		CSRFToken string
+	}{profile, own, token}); err != nil {
+		log.Printf("Failed to render profile page: %v", err)
+	}
+}
+
+// ProfilePrivacyHandler makes the signed-in user's profile private or public
+func ProfilePrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Private *bool `json:"private"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Private == nil {
+		respondError(w, http.StatusBadRequest, "Request body must set private to true or false")
+		return
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+	if err := user.SetProfilePrivate(r.Context(), *body.Private); err != nil {
+		log.Printf("Failed to set profile privacy for user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save profile privacy")
+		return
+	}
+	visibility := "public"
+	if user.ProfilePrivate {
+		visibility = "private"
+	}
+	log.Printf("User %s (ID: %s) made their profile %s", user.Username, user.DiscordID, visibility)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"private": user.ProfilePrivate})
+}
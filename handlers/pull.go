@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// PullAllowanceResponse reports how many pulls the user has left today.
+// Limit and remaining are -1 when pulls are unlimited; bonus pulls are used
+// once the remaining pulls run out.
+type PullAllowanceResponse struct {
+	Used       int       `json:"used"`
+	Limit      int       `json:"limit"`
+	Remaining  int       `json:"remaining"`
+	BonusPulls int       `json:"bonus_pulls"`
+	ResetsAt   time.Time `json:"resets_at"`
+}
+
+func newPullAllowanceResponse(a gacha.Allowance) PullAllowanceResponse {
+	return PullAllowanceResponse{Used: a.Used, Limit: a.Limit, Remaining: a.Remaining, BonusPulls: a.Bonus, ResetsAt: a.ResetsAt}
+}
+
+type PullResponse struct {
+	ID           int64                 `json:"id"`
+	Duplicate    bool                  `json:"duplicate"`
+	Dust         int                   `json:"dust,omitempty"`
+	Wishlisted   bool                  `json:"wishlisted"`
+	RerolledFrom *int64                `json:"rerolled_from,omitempty"`
+	BannerID     *int64                `json:"banner_id,omitempty"`
+	PulledAt     time.Time             `json:"pulled_at"`
+	Wallpaper    WallpaperResponse     `json:"wallpaper"`
+	Allowance    PullAllowanceResponse `json:"allowance"`
+	Unlocked     []AchievementResponse `json:"unlocked_achievements"`
+}
+
+func newPullResponse(r *http.Request, result *gacha.Result) PullResponse {
+	return pullResponse(result, newWallpaperResponse(r, *result.Upload))
+}
+
+// pullResponse builds the response to a pull given its wallpaper's
+func pullResponse(result *gacha.Result, wallpaper WallpaperResponse) PullResponse {
+	resp := PullResponse{
+		ID:         result.Pull.ID,
+		Duplicate:  result.Pull.Duplicate,
+		Dust:       result.Pull.Dust,
+		Wishlisted: result.Pull.Wishlisted,
+		PulledAt:   result.Pull.PulledAt,
+		Wallpaper:  wallpaper,
+		Allowance:  newPullAllowanceResponse(result.Allowance),
+		Unlocked:   make([]AchievementResponse, 0, len(result.Unlocked)),
+	}
+	if result.Pull.RerolledFrom.Valid {
+		resp.RerolledFrom = &result.Pull.RerolledFrom.Int64
+	}
+	if result.Pull.BannerID.Valid {
+		resp.BannerID = &result.Pull.BannerID.Int64
+	}
+	for _, a := range result.Unlocked {
+		resp.Unlocked = append(resp.Unlocked, newAchievementResponse(gacha.UnlockedAchievement{Achievement: a, UnlockedAt: result.Pull.PulledAt, Progress: a.Goal}))
+	}
+	return resp
+}
+
+type CollectionEntryResponse struct {
+	Wallpaper     WallpaperResponse `json:"wallpaper"`
+	Copies        int               `json:"copies"`
+	FirstPulledAt time.Time         `json:"first_pulled_at"`
+}
+
+// PullHandler draws a random wallpaper into the signed-in user's collection,
+// on the running banner named by ?banner= if given, from the archive pool
+// with ?pool=archive, and only from wallpapers of the device class named by
+// ?class= if given
+func PullHandler(w http.ResponseWriter, r *http.Request) {
+	if result := makePull(w, r, time.Time{}); result != nil {
+		writeJSON(w, http.StatusOK, newPullResponse(r, result))
+	}
+}
+
+// PullStartResponse is a pull made but not yet revealed: enough to play the
+// animation for its rarity, and the token that reveals the wallpaper
+type PullStartResponse struct {
+	RevealToken string                `json:"reveal_token"`
+	Rarity      string                `json:"rarity"`
+	BannerID    *int64                `json:"banner_id,omitempty"`
+	ExpiresAt   time.Time             `json:"expires_at"`
+	Allowance   PullAllowanceResponse `json:"allowance"`
+}
+
+// PullStartHandler makes a pull like PullHandler, but only tells the client
+// the rarity drawn, so the wallpaper can't be read from the response before
+// the animation has played. The pull counts straight away, but is held back
+// from the live feed, pull history and collection until it is revealed with
+// PullRevealHandler, which can be called at once to skip the animation, or
+// the reveal token expires.
+func PullStartHandler(w http.ResponseWriter, r *http.Request) {
+	expires := time.Now().Add(gacha.RevealTokenLifetime)
+	result := makePull(w, r, expires)
+	if result == nil {
+		return
+	}
+
+	resp := PullStartResponse{
+		RevealToken: gacha.RevealToken(result, expires),
+		Rarity:      result.Upload.Rarity,
+		ExpiresAt:   expires.UTC().Truncate(time.Second),
+		Allowance:   newPullAllowanceResponse(result.Allowance),
+	}
+	if result.Pull.BannerID.Valid {
+		resp.BannerID = &result.Pull.BannerID.Int64
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// PullRevealHandler reveals the wallpaper of a pull made with
+// PullStartHandler, given its reveal token
+func PullRevealHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RevealToken string `json:"reveal_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RevealToken == "" {
+		respondError(w, http.StatusBadRequest, "reveal_token is required")
+		return
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	result, err := gacha.Reveal(r.Context(), user, body.RevealToken)
+	if err == gacha.ErrInvalidRevealToken {
+		apiError(w, http.StatusBadRequest, codeInvalidRevealToken, "This pull can no longer be revealed; it is in your pull history")
+		return
+	} else if err != nil {
+		log.Printf("Failed to reveal pull for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reveal pull")
+		return
+	}
+	writeJSON(w, http.StatusOK, newPullResponse(r, result))
+}
+
+// makePull makes the pull a pull request asks for, held back until revealAt
+// unless that is zero, responding with the reason and returning nil when it
+// can't be made
+func makePull(w http.ResponseWriter, r *http.Request, revealAt time.Time) *gacha.Result {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	var banner *models.Banner
+	if raw := r.URL.Query().Get("banner"); raw != "" {
+		if banner = loadActiveBanner(w, r, raw, middleware.GetGuildID(r)); banner == nil {
+			return nil
+		}
+	}
+	class, err := models.ParseDeviceClass(r.URL.Query().Get("class"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	var archive bool
+	switch r.URL.Query().Get("pool") {
+	case "", models.PoolStandard:
+	case models.PoolArchive:
+		archive = true
+	default:
+		respondError(w, http.StatusBadRequest, "pool must be one of: standard, archive")
+		return nil
+	}
+	if archive && banner != nil {
+		respondError(w, http.StatusBadRequest, "Banners feature wallpapers in the standard pool")
+		return nil
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return nil
+	}
+
+	var result *gacha.Result
+	if revealAt.IsZero() {
+		result, err = gacha.Pull(r.Context(), user, middleware.GetGuildID(r), models.PullSourceWeb, banner, archive, class)
+	} else {
+		result, err = gacha.StartPull(r.Context(), user, middleware.GetGuildID(r), models.PullSourceWeb, banner, archive, class, revealAt)
+	}
+	switch err {
+	case nil:
+	case gacha.ErrNoPullsLeft:
+		allowance, _ := gacha.PullAllowance(r.Context(), user)
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"success":   false,
+			"message":   middleware.Translate(w, "You have used all of today's pulls"),
+			"allowance": newPullAllowanceResponse(allowance),
+		})
+		return nil
+	case gacha.ErrEmptyPool:
+		if archive {
+			apiError(w, http.StatusNotFound, codeNothingToPull, "There are no out-of-season wallpapers to pull")
+			return nil
+		}
+		if class != "" {
+			apiError(w, http.StatusNotFound, codeNothingToPull, "There are no "+class+" wallpapers to pull")
+			return nil
+		}
+		apiError(w, http.StatusNotFound, codeNothingToPull, "There are no wallpapers to pull yet")
+		return nil
+	default:
+		log.Printf("Pull failed for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to pull")
+		return nil
+	}
+
+	log.Printf("User %s (ID: %s) pulled upload %d (duplicate: %t)", username, discordID, result.Upload.ID, result.Pull.Duplicate)
+	return result
+}
+
+// PullStatusHandler reports how many pulls the signed-in user has left today
+func PullStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	allowance, err := gacha.PullAllowance(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to get pull allowance for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get pull status")
+		return
+	}
+	writeJSON(w, http.StatusOK, newPullAllowanceResponse(allowance))
+}
+
+// CollectionHandler lists the wallpapers the signed-in user has pulled
+func CollectionHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+	if notModified(w, r, collectionTables...) {
+		return
+	}
+
+	entries, total, err := models.ListCollection(r.Context(), middleware.GetDiscordID(r), perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list collection: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list collection")
+		return
+	}
+
+	items := make([]CollectionEntryResponse, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, CollectionEntryResponse{
+			Wallpaper:     newWallpaperResponse(r, e.Upload),
+			Copies:        e.Copies,
+			FirstPulledAt: e.FirstPulledAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"wallpapers": items,
+		"page":       page,
+		"per_page":   perPage,
+		"total":      total,
+	})
+}
+
+// CompletionResponse reports how much of a set of pullable wallpapers the
+// user has collected, as a percentage with one decimal place
+type CompletionResponse struct {
+	Owned      int     `json:"owned"`
+	Total      int     `json:"total"`
+	Percent    float64 `json:"percent"`
+	MissingIDs []int64 `json:"missing_ids"`
+}
+
+func newCompletionResponse(c models.Completion) CompletionResponse {
+	resp := CompletionResponse{Owned: c.Owned, Total: c.Total, MissingIDs: c.Missing}
+	if c.Total > 0 {
+		resp.Percent = math.Round(float64(c.Owned)/float64(c.Total)*1000) / 10
+	}
+	return resp
+}
+
+type TagCompletionResponse struct {
+	Tag string `json:"tag"`
+	CompletionResponse
+}
+
+type BannerCompletionResponse struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	CompletionResponse
+}
+
+// CollectionProgressHandler reports the signed-in user's completion of the
+// current guild's whole pull pool, of each tag and of each running banner
+func CollectionProgressHandler(w http.ResponseWriter, r *http.Request) {
+	discordID, guildID := middleware.GetDiscordID(r), middleware.GetGuildID(r)
+
+	overall, err := models.PoolCompletion(r.Context(), discordID, guildID)
+	if err != nil {
+		log.Printf("Failed to get pool completion for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get collection progress")
+		return
+	}
+	tags, err := models.ListTagCompletion(r.Context(), discordID, guildID)
+	if err != nil {
+		log.Printf("Failed to get tag completion for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get collection progress")
+		return
+	}
+	banners, err := models.ListBanners(r.Context(), guildID, true)
+	if err != nil {
+		log.Printf("Failed to list banners: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get collection progress")
+		return
+	}
+
+	tagItems := make([]TagCompletionResponse, 0, len(tags))
+	for _, t := range tags {
+		tagItems = append(tagItems, TagCompletionResponse{Tag: t.Tag, CompletionResponse: newCompletionResponse(t.Completion)})
+	}
+	bannerItems := make([]BannerCompletionResponse, 0, len(banners))
+	for _, b := range banners {
+		c, err := models.BannerCompletion(r.Context(), discordID, b.ID)
+		if err != nil {
+			log.Printf("Failed to get banner %d completion for user %s: %v", b.ID, discordID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to get collection progress")
+			return
+		}
+		bannerItems = append(bannerItems, BannerCompletionResponse{ID: b.ID, Name: b.Name, CompletionResponse: newCompletionResponse(c)})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"overall": newCompletionResponse(overall),
+		"tags":    tagItems,
+		"banners": bannerItems,
+	})
+}
+
+// PullHistoryEntryResponse is one pull in a user's history. Wallpaper is left
+// out if the wallpaper no longer exists.
+type PullHistoryEntryResponse struct {
+	ID           int64              `json:"id"`
+	Source       string             `json:"source"`
+	Duplicate    bool               `json:"duplicate"`
+	Discarded    bool               `json:"discarded"`
+	Dust         int                `json:"dust,omitempty"`
+	RerolledFrom *int64             `json:"rerolled_from,omitempty"`
+	BannerID     *int64             `json:"banner_id,omitempty"`
+	PulledAt     time.Time          `json:"pulled_at"`
+	Wallpaper    *WallpaperResponse `json:"wallpaper,omitempty"`
+}
+
+// LuckResponse is the JSON representation of gacha.Luck
+type LuckResponse struct {
+	Pulls       int            `json:"pulls"`
+	Draws       int            `json:"draws"`
+	New         int            `json:"new"`
+	Duplicates  int            `json:"duplicates"`
+	ExpectedNew float64        `json:"expected_new"`
+	Luck        float64        `json:"luck"`
+	PoolSize    int            `json:"pool_size"`
+	BySource    map[string]int `json:"by_source"`
+	ByBanner    map[int64]int  `json:"by_banner"`
+}
+
+// PullHistoryHandler pages through every pull the signed-in user has made,
+// along with how lucky their draws have been
+func PullHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	entries, total, err := models.ListPullHistory(r.Context(), user.DiscordID, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list pull history for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list pull history")
+		return
+	}
+	luck, err := gacha.PullLuck(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to get pull stats for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list pull history")
+		return
+	}
+
+	items := make([]PullHistoryEntryResponse, 0, len(entries))
+	for _, e := range entries {
+		item := PullHistoryEntryResponse{
+			ID:        e.ID,
+			Source:    e.Source,
+			Duplicate: e.Duplicate,
+			Discarded: e.Discarded,
+			Dust:      e.Dust,
+			PulledAt:  e.PulledAt,
+		}
+		if e.RerolledFrom.Valid {
+			item.RerolledFrom = &e.RerolledFrom.Int64
+		}
+		if e.BannerID.Valid {
+			item.BannerID = &e.BannerID.Int64
+		}
+		if e.Upload != nil {
+			wallpaper := newWallpaperResponse(r, *e.Upload)
+			item.Wallpaper = &wallpaper
+		}
+		items = append(items, item)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pulls":    items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+		"stats": LuckResponse{
+			Pulls:       luck.Pulls,
+			Draws:       luck.Draws,
+			New:         luck.New,
+			Duplicates:  luck.Duplicates,
+			ExpectedNew: math.Round(luck.ExpectedNew*100) / 100,
+			Luck:        math.Round(luck.Luck*100) / 100,
+			PoolSize:    luck.PoolSize,
+			BySource:    luck.BySource,
+			ByBanner:    luck.ByBanner,
+		},
+	})
+}
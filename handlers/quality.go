@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// reportLowQuality files a low_quality report against an upload that scored
+// below quality_check.min_score, naming what brought its score down, so it
+// waits in the moderation queue. The upload stays visible; failures are only
+// logged, as they shouldn't fail the upload.
+func reportLowQuality(ctx context.Context, upload *models.Upload, q imaging.Quality) {
+	report := &models.Report{
+		UploadID:   upload.ID,
+		ReporterID: models.QualityReporterID,
+		Category:   models.ReportLowQuality,
+		Details:    describeQuality(q),
+	}
+	if _, err := models.CreateReport(ctx, report, 0); err != nil {
+		log.Printf("Warning: Failed to report low quality upload %d: %v", upload.ID, err)
+		return
+	}
+	log.Printf("Upload %d reported for low quality: %s", upload.ID, report.Details)
+}
+
+// describeQuality explains a quality score to reviewers, e.g. "Quality score
+// 38/100: heavy JPEG artifacts; upscaled about 3x from 1280x720"
+func describeQuality(q imaging.Quality) string {
+	var reasons []string
+	switch {
+	case q.Blocking >= imaging.HeavyBlocking:
+		reasons = append(reasons, "heavy JPEG artifacts")
+	case q.Blocking > 0:
+		reasons = append(reasons, "JPEG artifacts")
+	}
+	if q.Upscale > 1 {
+		reasons = append(reasons, fmt.Sprintf("upscaled about %dx from %dx%d", q.Upscale, q.EffectiveWidth, q.EffectiveHeight))
+	} else if q.LowResolution() {
+		reasons = append(reasons, fmt.Sprintf("low resolution of %dx%d", q.EffectiveWidth, q.EffectiveHeight))
+	}
+	details := fmt.Sprintf("Quality score %d/100", q.Score)
+	if len(reasons) > 0 {
+		details += ": " + strings.Join(reasons, "; ")
+	}
+	return details
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/gorilla/mux"
+)
+
+type QuarantinedFileResponse struct {
+	ID               int64     `json:"id"`
+	UploaderID       string    `json:"uploader_id"`
+	OriginalFilename string    `json:"original_filename"`
+	FileSize         int64     `json:"file_size"`
+	SHA256           string    `json:"sha256"`
+	Signature        string    `json:"signature"`
+	CreatedAt        time.Time `json:"created_at"`
+	FileURL          string    `json:"file_url"`
+}
+
+func newQuarantinedFileResponse(f *models.QuarantinedFile) QuarantinedFileResponse {
+	return QuarantinedFileResponse{
+		ID:               f.ID,
+		UploaderID:       f.DiscordID,
+		OriginalFilename: f.OriginalFilename,
+		FileSize:         f.FileSize,
+		SHA256:           f.SHA256,
+		Signature:        f.Signature,
+		CreatedAt:        f.CreatedAt,
+		FileURL:          fmt.Sprintf("/api/admin/quarantine/%d/file", f.ID),
+	}
+}
+
+func quarantineTarget(id int64) string {
+	return fmt.Sprintf("quarantine:%d", id)
+}
+
+// loadQuarantinedFile returns the quarantined file named in the URL, or
+// responds with an error and returns nil
+func loadQuarantinedFile(w http.ResponseWriter, r *http.Request) *models.QuarantinedFile {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid quarantine ID")
+		return nil
+	}
+
+	f, err := models.GetQuarantinedFile(r.Context(), id)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Quarantined file not found")
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to get quarantined file %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get quarantined file")
+		return nil
+	}
+	return f
+}
+
+// AdminQuarantineHandler lists uploads the malware scanner refused, newest
+// first
+func AdminQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	files, total, err := models.ListQuarantinedFiles(r.Context(), perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list quarantined files: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list quarantined files")
+		return
+	}
+
+	list := make([]QuarantinedFileResponse, 0, len(files))
+	for i := range files {
+		list = append(list, newQuarantinedFileResponse(&files[i]))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"files":    list,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// AdminQuarantineFileHandler downloads a quarantined file for inspection. It
+// is always sent as an opaque attachment so browsers never render or run it.
+func AdminQuarantineFileHandler(w http.ResponseWriter, r *http.Request) {
+	f := loadQuarantinedFile(w, r)
+	if f == nil {
+		return
+	}
+
+	file, err := os.Open(storage.QuarantinePath(f.Filename))
+	if os.IsNotExist(err) {
+		respondError(w, http.StatusNotFound, "Quarantined file is missing from disk")
+		return
+	} else if err != nil {
+		log.Printf("Failed to open quarantined file %d: %v", f.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to read quarantined file")
+		return
+	}
+	defer file.Close()
+
+	log.Printf("Admin %s (ID: %s) downloaded quarantined file %d", middleware.GetUsername(r), middleware.GetRealDiscordID(r), f.ID)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.OriginalFilename + ".quarantined"}))
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "", f.CreatedAt, file)
+}
+
+// AdminDeleteQuarantinedHandler permanently deletes a quarantined file
+func AdminDeleteQuarantinedHandler(w http.ResponseWriter, r *http.Request) {
+	f := loadQuarantinedFile(w, r)
+	if f == nil {
+		return
+	}
+
+	if err := models.DeleteQuarantinedFile(r.Context(), f.ID); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Quarantined file not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete quarantined file %d: %v", f.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete quarantined file")
+		return
+	}
+	if err := os.Remove(storage.QuarantinePath(f.Filename)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove quarantined file %s: %v", f.Filename, err)
+	}
+
+	log.Printf("Admin %s (ID: %s) deleted quarantined file %d", middleware.GetUsername(r), middleware.GetRealDiscordID(r), f.ID)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditQuarantineDelete, quarantineTarget(f.ID), f.OriginalFilename+": "+f.Signature)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Share of the global upload slots in use at which clients are warned that
+// uploads may be turned away
+const busyWarningRatio = 0.75
+
+// Share of the storage quota in use at which users are warned
+const storageWarningRatio = 0.9
+
+// UploadQuota describes where a user stands against the upload limits, with
+// advisory warnings for limits they are about to hit
+type UploadQuota struct {
+	CanUpload         bool     `json:"can_upload"`
+	Remaining         int      `json:"uploads_remaining"`
+	CooldownSecs      int      `json:"cooldown_seconds"`
+	NextUploadAt      string   `json:"next_upload_at,omitempty"`
+	UploadsToday      int      `json:"uploads_today"`
+	MaxUploadsPerDay  int      `json:"max_uploads_per_day,omitempty"`
+	DailyResetAt      string   `json:"daily_reset_at"`
+	StorageUsedBytes  int64    `json:"storage_used_bytes"`
+	StorageLimitBytes int64    `json:"storage_limit_bytes,omitempty"`
+	Warnings          []string `json:"warnings"`
+
+	// reason explains why CanUpload is false
+	reason string
+}
+
+// storageLimitBytes returns the per-user storage quota, or 0 for no limit
+func storageLimitBytes() int64 {
+	if config.AppConfig.MaxStorageMB <= 0 {
+		return 0
+	}
+	return int64(config.AppConfig.MaxStorageMB) * 1024 * 1024
+}
+
+// maxFileSizeMB returns the largest file the user may upload, in MB: the
+// larger of max_file_size_mb and what their Discord roles allow
+func maxFileSizeMB(user *models.User) int {
+	if len(config.AppConfig.RoleMaxFileSizeMB) == 0 {
+		return config.AppConfig.MaxFileSizeMB
+	}
+	return max(config.AppConfig.MaxFileSizeMB, user.MaxFileSizeMB)
+}
+
+// uploadCooldownMinutes returns the minutes the user must wait between
+// uploads: the shortest of the upload_cooldown_tiers that apply to them, as an
+// admin or through their Discord roles, or upload_cooldown_minutes when none
+// do. Negative means no cooldown.
+func uploadCooldownMinutes(user *models.User) int {
+	minutes, tiered := config.AppConfig.UploadCooldownTiers[config.AdminCooldownTier]
+	tiered = tiered && config.AppConfig.IsAdmin(user.DiscordID)
+
+	// The role tier is remembered from the last sign-in, so it is ignored
+	// once role tiers are taken out of the config
+	role := user.RoleCooldownMinutes
+	if role.Valid && config.AppConfig.RoleCooldownsConfigured() && (!tiered || int(role.Int64) < minutes) {
+		minutes, tiered = int(role.Int64), true
+	}
+	if !tiered {
+		return config.AppConfig.UploadCooldownMinutes
+	}
+	return minutes
+}
+
+// uploadLimits returns the limits the user's next upload is recorded under
+func uploadLimits(user *models.User) *models.UploadLimits {
+	dayStart, _ := models.DailyWindow(time.Now(), userResetLocation(user))
+	return &models.UploadLimits{
+		Cooldown:  time.Duration(max(uploadCooldownMinutes(user), 0)) * time.Minute,
+		MaxPerDay: config.AppConfig.MaxUploadsPerDay,
+		DayStart:  dayStart,
+	}
+}
+
+// uploadLimitReached is the error for an upload that passed the quota check
+// but lost the race against another upload of the user to be recorded
+func uploadLimitReached(ctx context.Context, user *models.User, username string) *uploadError {
+	uerr := &uploadError{status: http.StatusTooManyRequests, message: "Upload limit reached, please try again later", reason: "quota"}
+	fresh, err := models.GetUser(ctx, user.DiscordID)
+	if err != nil {
+		log.Printf("Failed to get user %s (ID: %s): %v", username, user.DiscordID, err)
+		return uerr
+	}
+	user.LastUploadAt = fresh.LastUploadAt
+	quota, err := uploadQuota(ctx, user, 1)
+	if err != nil {
+		log.Printf("Failed to get upload quota for user %s (ID: %s): %v", username, user.DiscordID, err)
+		return uerr
+	}
+	if !quota.CanUpload {
+		uerr.message = quota.reason
+		uerr.retryAfter = quota.CooldownSecs
+	}
+	log.Printf("Upload denied for user %s (ID: %s): %s", username, user.DiscordID, uerr.message)
+	return uerr
+}
+
+// uploadQuota computes the user's current upload allowance. holding is the
+// number of upload slots the current request itself occupies, which are not
+// counted against the user.
+func uploadQuota(ctx context.Context, user *models.User, holding int) (UploadQuota, error) {
+	cooldownMinutes := uploadCooldownMinutes(user)
+	maxPerDay := config.AppConfig.MaxUploadsPerDay
+	quota := UploadQuota{Warnings: []string{}, MaxUploadsPerDay: max(maxPerDay, 0), StorageLimitBytes: storageLimitBytes()}
+
+	loc := userResetLocation(user)
+	dayStart, dayEnd := models.DailyWindow(time.Now(), loc)
+	quota.DailyResetAt = dayEnd.Format(time.RFC3339)
+
+	var err error
+	if quota.UploadsToday, err = models.CountUploadsSince(ctx, user.DiscordID, dayStart); err != nil {
+		return quota, err
+	}
+	usage, err := models.GetStorageUsage(ctx, user.DiscordID)
+	if err != nil {
+		return quota, err
+	}
+	quota.StorageUsedBytes = usage.Bytes
+
+	canUpload, cooldown := user.CanUpload(cooldownMinutes)
+	quota.CanUpload = canUpload
+	switch {
+	case !canUpload:
+		quota.CooldownSecs = int(cooldown.Seconds())
+		quota.NextUploadAt = time.Now().Add(cooldown).In(loc).Format(time.RFC3339)
+		quota.reason = fmt.Sprintf("Please wait %s before uploading again", formatDuration(cooldown))
+	case maxPerDay > 0 && quota.UploadsToday >= maxPerDay:
+		quota.CanUpload = false
+		quota.CooldownSecs = int(time.Until(dayEnd).Seconds())
+		quota.NextUploadAt = quota.DailyResetAt
+		quota.reason = fmt.Sprintf("You have reached the limit of %d uploads per day; it resets at %s", maxPerDay, quota.DailyResetAt)
+	case quota.StorageLimitBytes > 0 && quota.StorageUsedBytes >= quota.StorageLimitBytes:
+		quota.CanUpload = false
+		quota.reason = fmt.Sprintf("You have used your storage quota of %s; delete some uploads to make room", formatBytes(quota.StorageLimitBytes))
+	case cooldownMinutes > 0:
+		quota.Remaining = 1
+		quota.Warnings = append(quota.Warnings, fmt.Sprintf(
+			"You have 1 upload left; after it you must wait %s",
+			formatDuration(time.Duration(cooldownMinutes)*time.Minute)))
+	case maxPerDay > 0:
+		quota.Remaining = maxPerDay - quota.UploadsToday
+	default:
+		quota.Remaining = 1
+	}
+
+	if quota.CanUpload && maxPerDay > 0 && quota.UploadsToday == maxPerDay-1 {
+		quota.Warnings = append(quota.Warnings, "This is your last upload for today")
+	}
+	if quota.CanUpload && quota.StorageLimitBytes > 0 && float64(quota.StorageUsedBytes) >= float64(quota.StorageLimitBytes)*storageWarningRatio {
+		quota.Warnings = append(quota.Warnings, fmt.Sprintf("You have used %s of your %s storage quota",
+			formatBytes(quota.StorageUsedBytes), formatBytes(quota.StorageLimitBytes)))
+	}
+
+	inFlight, maxGlobal, userInFlight, maxPerUser := limiter.load(user.DiscordID)
+	if userInFlight-holding >= maxPerUser {
+		quota.Warnings = append(quota.Warnings, "You already have the maximum number of uploads in progress")
+	}
+	if float64(inFlight-holding) >= float64(maxGlobal)*busyWarningRatio {
+		quota.Warnings = append(quota.Warnings, "The server is busy; uploads may be briefly turned away")
+	}
+	return quota, nil
+}
+
+// formatBytes renders a size in the largest whole unit that fits
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// setQuotaHeaders adds advisory quota headers so clients can warn users before
+// they run into a hard limit
+func setQuotaHeaders(w http.ResponseWriter, quota UploadQuota) {
+	w.Header().Set("X-Upload-Remaining", strconv.Itoa(quota.Remaining))
+	if quota.NextUploadAt != "" {
+		w.Header().Set("X-Upload-Next-At", quota.NextUploadAt)
+	}
+	if len(quota.Warnings) > 0 {
+		w.Header().Set("X-Upload-Warning", strings.Join(quota.Warnings, "; "))
+	}
+}
+
+// localized returns a copy of the quota with its warnings in the response's
+// locale
+func (q *UploadQuota) localized(w http.ResponseWriter) *UploadQuota {
+	if q == nil {
+		return nil
+	}
+	localized := *q
+	localized.Warnings = translateAll(w, q.Warnings)
+	return &localized
+}
+
+// UploadStatusHandler lets clients check the user's upload allowance before
+// sending a file
+func UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+
+	user, err := models.GetOrCreateUser(r.Context(), discordID, middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user %s for upload status: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	quota, err := uploadQuota(r.Context(), user, 0)
+	if err != nil {
+		log.Printf("Failed to get upload quota for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload quota")
+		return
+	}
+	setQuotaHeaders(w, quota)
+	writeJSON(w, http.StatusOK, quota.localized(w))
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// RandomWallpaperResponse is a random wallpaper for wallpaper-rotation
+// scripts. DirectURL serves the original file under /api so API tokens can
+// fetch it, or on the content host, signed for the token's user, when there
+// is one; its v parameter changes whenever the file does.
+type RandomWallpaperResponse struct {
+	WallpaperResponse
+	DirectURL string `json:"direct_url"`
+}
+
+// directImageURL returns the URL of the upload's original file, versioned by
+// its content so caches never serve a stale copy
+func directImageURL(r *http.Request, u models.Upload) string {
+	version := u.SHA256
+	if len(version) > 12 {
+		version = version[:12]
+	} else if version == "" {
+		version = strconv.FormatInt(u.UploadedAt.Unix(), 10)
+	}
+	if config.AppConfig.ContentHost() != "" {
+		return middleware.ContentURL(r, imagePath(u.ID), url.Values{"v": {version}})
+	}
+	return "/api/uploads/" + strconv.FormatInt(u.ID, 10) + "/image?v=" + version
+}
+
+// RandomWallpaperHandler returns a random wallpaper from the gallery, filtered
+// by the same parameters as the gallery listing
+func RandomWallpaperHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseUploadFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	upload, err := models.RandomUpload(r.Context(), filter)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "No wallpapers match")
+		return
+	} else if err != nil {
+		log.Printf("Failed to pick a random upload: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to pick a wallpaper")
+		return
+	}
+
+	// Every request should draw again rather than hit a cached answer
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, RandomWallpaperResponse{
+		WallpaperResponse: newWallpaperResponse(r, *upload),
+		DirectURL:         directImageURL(r, *upload),
+	})
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// RarityVoteResponse is a wallpaper's rarity vote: whether it is running and
+// until when, the votes for each tier so far and the signed-in user's vote
+type RarityVoteResponse struct {
+	Open     bool           `json:"open"`
+	EndsAt   *time.Time     `json:"ends_at,omitempty"`
+	Rarity   string         `json:"rarity"`
+	Votes    map[string]int `json:"votes"`
+	YourVote string         `json:"your_vote,omitempty"`
+}
+
+func writeRarityVote(w http.ResponseWriter, r *http.Request, upload *models.Upload) {
+	tally, own, err := models.RarityVoteTally(r.Context(), upload.ID, middleware.GetDiscordID(r))
+	if err != nil {
+		log.Printf("Failed to count rarity votes of upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to count votes")
+		return
+	}
+	resp := RarityVoteResponse{Rarity: upload.Rarity, Votes: tally, YourVote: own}
+	if upload.RarityVotingEndsAt.Valid {
+		resp.EndsAt = &upload.RarityVotingEndsAt.Time
+		resp.Open = time.Now().Before(upload.RarityVotingEndsAt.Time)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// RarityVoteStatusHandler reports a wallpaper's rarity vote
+func RarityVoteStatusHandler(w http.ResponseWriter, r *http.Request) {
+	upload := loadVisibleUpload(w, r)
+	if upload == nil {
+		return
+	}
+	writeRarityVote(w, r, upload)
+}
+
+// RarityVoteHandler records the signed-in user's vote on a new wallpaper's
+// rarity while its vote runs. Each user votes once, and not on their own
+// uploads.
+func RarityVoteHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+
+	upload := loadVisibleUpload(w, r)
+	if upload == nil {
+		return
+	}
+	if upload.DiscordID == discordID {
+		apiError(w, http.StatusBadRequest, codeOwnResource, "You cannot vote on your own upload")
+		return
+	}
+
+	var body struct {
+		Rarity string `json:"rarity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	rarity, err := models.ParseRarity(body.Rarity)
+	if err != nil || rarity == "" {
+		respondError(w, http.StatusBadRequest, "rarity must be one of: "+strings.Join(models.Rarities, ", "))
+		return
+	}
+
+	// Votes reference the user, so they must exist
+	if _, err = models.GetOrCreateUser(r.Context(), discordID, middleware.GetUsername(r)); err == nil {
+		err = models.CastRarityVote(r.Context(), upload.ID, discordID, rarity, time.Now())
+	}
+	switch err {
+	case nil:
+	case models.ErrVotingClosed:
+		apiError(w, http.StatusConflict, codeVotingClosed, "Voting on this wallpaper's rarity has closed")
+		return
+	case models.ErrAlreadyVoted:
+		apiError(w, http.StatusConflict, codeAlreadyVoted, "You have already voted on this wallpaper's rarity")
+		return
+	default:
+		log.Printf("Failed to record rarity vote on upload %d for user %s (ID: %s): %v", upload.ID, middleware.GetUsername(r), discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save vote")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) voted %s for upload %d", middleware.GetUsername(r), discordID, rarity, upload.ID)
+	writeRarityVote(w, r, upload)
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// GachaRatesResponse is the drop rates pulls use: the rarity rates in
+// effect, those in the config, the ones admins set at runtime, and the
+// rate-up of each banner that hasn't ended
+type GachaRatesResponse struct {
+	RarityRates           map[string]float64           `json:"rarity_rates"`
+	ConfiguredRarityRates map[string]float64           `json:"configured_rarity_rates"`
+	Overrides             []RarityRateOverrideResponse `json:"overrides"`
+	Banners               []BannerRateResponse         `json:"banners"`
+}
+
+// RarityRateOverrideResponse is a rarity rate set at runtime
+type RarityRateOverrideResponse struct {
+	Rarity    string    `json:"rarity"`
+	Rate      float64   `json:"rate"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// BannerRateResponse is a banner's rate-up
+type BannerRateResponse struct {
+	ID       int64     `json:"id"`
+	GuildID  string    `json:"guild_id"`
+	Name     string    `json:"name"`
+	RateUp   float64   `json:"rate_up"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Active   bool      `json:"active"`
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'g', -1, 64)
+}
+
+func writeGachaRates(w http.ResponseWriter, r *http.Request) {
+	overrides, err := models.ListRarityRateOverrides(r.Context())
+	if err != nil {
+		log.Printf("Failed to list rarity rate overrides: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get rates")
+		return
+	}
+	banners, err := models.ListBanners(r.Context(), "", false)
+	if err != nil {
+		log.Printf("Failed to list banners: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get rates")
+		return
+	}
+
+	resp := GachaRatesResponse{
+		RarityRates:           config.AppConfig.EffectiveRarityRates(),
+		ConfiguredRarityRates: config.AppConfig.RarityRates,
+		Overrides:             make([]RarityRateOverrideResponse, 0, len(overrides)),
+		Banners:               []BannerRateResponse{},
+	}
+	for _, o := range overrides {
+		resp.Overrides = append(resp.Overrides, RarityRateOverrideResponse(o))
+	}
+	now := time.Now()
+	for _, b := range banners {
+		if !b.EndsAt.After(now) {
+			continue
+		}
+		resp.Banners = append(resp.Banners, BannerRateResponse{
+			ID: b.ID, GuildID: b.GuildID, Name: b.Name, RateUp: b.RateUp,
+			StartsAt: b.StartsAt, EndsAt: b.EndsAt, Active: b.Active(now),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminGachaRatesHandler shows the drop rates pulls use
+func AdminGachaRatesHandler(w http.ResponseWriter, r *http.Request) {
+	writeGachaRates(w, r)
+}
+
+// AdminUpdateGachaRatesHandler changes rarity rates and banner rate-ups
+// without a restart. Rarity rates are stored as overrides of rarity_rates; a
+// null rate removes the override. Changes apply to the next pull, and each
+// is recorded in the audit log.
+func AdminUpdateGachaRatesHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RarityRates   map[string]*float64 `json:"rarity_rates"`
+		BannerRateUps map[int64]float64   `json:"banner_rate_ups"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(body.RarityRates) == 0 && len(body.BannerRateUps) == 0 {
+		respondError(w, http.StatusBadRequest, "rarity_rates or banner_rate_ups is required")
+		return
+	}
+
+	before := config.AppConfig.EffectiveRarityRates()
+	after := config.AppConfig.EffectiveRarityRates()
+	for rarity, rate := range body.RarityRates {
+		if !slices.Contains(models.Rarities, rarity) {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Unknown rarity %q", rarity))
+			return
+		}
+		if rate == nil {
+			after[rarity] = config.AppConfig.RarityRates[rarity]
+			continue
+		}
+		if *rate < 0 {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("The rate of %s must not be negative", rarity))
+			return
+		}
+		after[rarity] = *rate
+	}
+	var total float64
+	for _, rate := range after {
+		total += rate
+	}
+	if total == 0 {
+		respondError(w, http.StatusBadRequest, "At least one rarity needs a rate above 0")
+		return
+	}
+
+	banners := make(map[int64]*models.Banner, len(body.BannerRateUps))
+	for id, rateUp := range body.BannerRateUps {
+		if rateUp < 1 || rateUp > maxBannerRateUp {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("rate_up must be between 1 and %d", maxBannerRateUp))
+			return
+		}
+		banner, err := models.GetBanner(r.Context(), id)
+		if err == sql.ErrNoRows {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Banner %d does not exist", id))
+			return
+		} else if err != nil {
+			log.Printf("Failed to get banner %d: %v", id, err)
+			respondError(w, http.StatusInternalServerError, "Failed to save rates")
+			return
+		}
+		banners[id] = banner
+	}
+
+	actorID := middleware.GetRealDiscordID(r)
+	if err := models.UpdateGachaRates(r.Context(), body.RarityRates, body.BannerRateUps, actorID); err == sql.ErrNoRows {
+		respondError(w, http.StatusBadRequest, "A banner was deleted while its rate-up was changed")
+		return
+	} else if err != nil {
+		log.Printf("Failed to update gacha rates: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to save rates")
+		return
+	}
+	if err := jobs.LoadRarityRateOverrides(); err != nil {
+		log.Printf("Failed to apply gacha rates: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to apply rates")
+		return
+	}
+
+	for rarity, rate := range body.RarityRates {
+		details := formatRate(before[rarity]) + " -> " + formatRate(after[rarity])
+		if rate == nil {
+			details += " (config)"
+		}
+		recordAudit(r, actorID, models.AuditRarityRate, "rarity:"+rarity, details)
+	}
+	for id, rateUp := range body.BannerRateUps {
+		recordAudit(r, actorID, models.AuditBannerRateUp, bannerTarget(id), formatRate(banners[id].RateUp)+" -> "+formatRate(rateUp))
+	}
+	log.Printf("Admin %s (ID: %s) changed %d rarity rates and %d banner rate-ups", middleware.GetUsername(r), actorID, len(body.RarityRates), len(body.BannerRateUps))
+	writeGachaRates(w, r)
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/diskspace"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// How long the database may take to answer a readiness probe
+const readyTimeout = 2 * time.Second
+
+// ReadyResponse is whether the server can serve requests, with the free
+// space left on the volumes it writes to. Status is "ok", "degraded" while
+// disk space is low and uploads are refused, or "unavailable" when the
+// database doesn't answer.
+type ReadyResponse struct {
+	Status   string             `json:"status"`
+	Database bool               `json:"database"`
+	Disk     []diskspace.Volume `json:"disk"`
+}
+
+// ReadyHandler answers readiness probes: 503 when the database doesn't
+// answer, otherwise 200, with the disk headroom either way. Low disk space
+// doesn't fail the probe, since everything but uploads still works.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	resp := ReadyResponse{Status: "ok", Database: true, Disk: diskspace.Status()}
+	if resp.Disk == nil {
+		resp.Disk = []diskspace.Volume{}
+	}
+	for _, v := range resp.Disk {
+		if v.Low {
+			resp.Status = "degraded"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	status := http.StatusOK
+	if err := models.DB.PingContext(ctx); err != nil {
+		log.Printf("Readiness check: database did not answer: %v", err)
+		resp.Status, resp.Database = "unavailable", false
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Maximum length of the note explaining a rejection, in characters
+const maxRejectionNoteLength = 500
+
+// RejectionResponse is why an upload was rejected, as shown to its uploader
+type RejectionResponse struct {
+	Reason    string    `json:"reason"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newRejection validates the reason and note an admin gave for rejecting
+// uploads. Errors are suitable for showing to the admin.
+func newRejection(r *http.Request, reason, note string) (*models.Rejection, error) {
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	if !slices.Contains(models.RejectionReasons, reason) {
+		return nil, errors.New("reason must be one of: " + strings.Join(models.RejectionReasons, ", "))
+	}
+	note = sanitizeText(note)
+	if note == "" {
+		return nil, errors.New("note must explain the rejection to the uploader")
+	}
+	if utf8.RuneCountInString(note) > maxRejectionNoteLength {
+		return nil, fmt.Errorf("note must be at most %d characters", maxRejectionNoteLength)
+	}
+	return &models.Rejection{Reason: reason, Note: note, RejectedBy: middleware.GetRealDiscordID(r)}, nil
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// ReloadConfig reloads the configuration file on behalf of actorID, from a
+// SIGHUP or an admin's request, and records what changed in the audit log
+func ReloadConfig(ctx context.Context, actorID, ip string) (*config.ReloadResult, error) {
+	result, err := config.Reload()
+	if err != nil {
+		log.Printf("Config reload by %s failed, keeping the running configuration: %v", actorID, err)
+		return nil, err
+	}
+
+	details := "changed: " + strings.Join(result.Changed, ", ")
+	if len(result.Changed) == 0 {
+		details = "no changes"
+	}
+	if len(result.RestartRequired) > 0 {
+		details += "; restart required: " + strings.Join(result.RestartRequired, ", ")
+	}
+	log.Printf("Config reloaded by %s, %s", actorID, details)
+
+	entry := &models.AuditEntry{ActorID: actorID, Action: models.AuditConfigReload, Details: details, IP: ip}
+	if err := models.RecordAudit(context.WithoutCancel(ctx), entry); err != nil {
+		log.Printf("Failed to record audit entry %s by %s: %v", models.AuditConfigReload, actorID, err)
+	}
+	return result, nil
+}
+
+// AdminReloadConfigHandler reloads the configuration file like a SIGHUP
+// does. A file that doesn't pass validation is refused with the reason, and
+// the running configuration is kept.
+func AdminReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := ReloadConfig(r.Context(), middleware.GetRealDiscordID(r), middleware.ClientIP(r))
+	if err != nil {
+		respondError(w, http.StatusUnprocessableEntity, "Config not reloaded: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
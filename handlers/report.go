@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+	"github.com/gorilla/mux"
+)
+
+// Maximum length of the optional free-text part of a report, in characters
+const maxReportDetailsLength = 1000
+
+// ReportResponse is the JSON representation of a report
+type ReportResponse struct {
+	ID         int64      `json:"id"`
+	UploadID   int64      `json:"upload_id"`
+	ReporterID string     `json:"reporter_id,omitempty"`
+	Category   string     `json:"category"`
+	Details    string     `json:"details"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	// QualityScore is the reported upload's image quality score, for
+	// reviewers judging low_quality reports
+	QualityScore *int64 `json:"quality_score,omitempty"`
+}
+
+func newReportResponse(r *models.Report) ReportResponse {
+	resp := ReportResponse{
+		ID:         r.ID,
+		UploadID:   r.UploadID,
+		ReporterID: r.ReporterID,
+		Category:   r.Category,
+		Details:    r.Details,
+		Status:     r.Status,
+		CreatedAt:  r.CreatedAt,
+	}
+	if r.ResolvedAt.Valid {
+		resp.ResolvedAt = &r.ResolvedAt.Time
+	}
+	if r.QualityScore.Valid {
+		resp.QualityScore = &r.QualityScore.Int64
+	}
+	return resp
+}
+
+// ReportHandler lets a user flag a wallpaper for admin review. Uploads that
+// collect enough unreviewed reports are hidden from the gallery until reviewed.
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	upload := loadVisibleUpload(w, r)
+	if upload == nil {
+		return
+	}
+
+	var body struct {
+		Category string `json:"category"`
+		Details  string `json:"details"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	category := strings.ToLower(strings.TrimSpace(body.Category))
+	if !slices.Contains(models.ReportCategories, category) {
+		respondError(w, http.StatusBadRequest, "category must be one of: "+strings.Join(models.ReportCategories, ", "))
+		return
+	}
+	details := sanitizeText(body.Details)
+	if utf8.RuneCountInString(details) > maxReportDetailsLength {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Details must be at most %d characters", maxReportDetailsLength))
+		return
+	}
+
+	if upload.DiscordID == discordID {
+		apiError(w, http.StatusBadRequest, codeOwnResource, "You cannot report your own upload")
+		return
+	}
+
+	report := &models.Report{
+		UploadID:   upload.ID,
+		ReporterID: discordID,
+		Category:   category,
+		Details:    details,
+	}
+	hidden, err := models.CreateReport(r.Context(), report, config.AppConfig.ReportHideThreshold)
+	if err == models.ErrAlreadyReported {
+		apiError(w, http.StatusConflict, codeAlreadyReported, "You have already reported this wallpaper")
+		return
+	} else if err != nil {
+		log.Printf("Failed to report upload %d for user %s (ID: %s): %v", upload.ID, username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to submit report")
+		return
+	}
+
+	log.Printf("Upload %d reported as %s by user %s (ID: %s)", upload.ID, category, username, discordID)
+	if hidden && !upload.ReportHidden {
+		log.Printf("Upload %d hidden pending review after reaching %d reports", upload.ID, config.AppConfig.ReportHideThreshold)
+	}
+
+	resp := newReportResponse(report)
+	webhooks.Notify(webhooks.EventReportCreated, resp)
+	resp.ReporterID = ""
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// AdminReportsHandler lists reports by status (pending by default)
+func AdminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.ReportPending
+	}
+	page, perPage, offset := parsePagination(r)
+
+	reports, total, err := models.ListReports(r.Context(), status, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list reports: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list reports")
+		return
+	}
+
+	items := make([]ReportResponse, 0, len(reports))
+	for i := range reports {
+		items = append(items, newReportResponse(&reports[i]))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"reports":  items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// AdminReviewReportsHandler resolves every pending report against an upload:
+// "dismiss" unhides the upload, "uphold" rejects it for the given reason and
+// note and moves it to the trash
+func AdminReviewReportsHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	var body struct {
+		Action string `json:"action"`
+		Reason string `json:"reason"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var status, action, details string
+	var rejection *models.Rejection
+	switch body.Action {
+	case "dismiss":
+		status, action = models.ReportDismissed, models.AuditReportDismiss
+	case "uphold":
+		status, action = models.ReportUpheld, models.AuditReportUphold
+		if rejection, err = newRejection(r, body.Reason, body.Note); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		details = rejection.Reason
+	default:
+		respondError(w, http.StatusBadRequest, "action must be dismiss or uphold")
+		return
+	}
+
+	err = models.ResolveReports(r.Context(), uploadID, status, rejection)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "No pending reports for that upload")
+		return
+	} else if err != nil {
+		log.Printf("Failed to resolve reports for upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to resolve reports")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) marked reports on upload %d as %s", middleware.GetUsername(r), middleware.GetRealDiscordID(r), uploadID, status)
+	recordAudit(r, middleware.GetRealDiscordID(r), action, uploadTarget(uploadID), details)
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		log.Printf("Failed to reload upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to resolve reports")
+		return
+	}
+	if status == models.ReportUpheld {
+		notify.UploadRejected(upload, rejection.Summary())
+	}
+	writeJSON(w, http.StatusOK, newWallpaperResponse(r, *upload))
+}
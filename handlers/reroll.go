@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// RerollWalletResponse describes the user's reroll tokens. per_day and
+// remaining_today are -1 when rerolls are not limited per day.
+type RerollWalletResponse struct {
+	Balance        int `json:"balance"`
+	Max            int `json:"max"`
+	UsedToday      int `json:"used_today"`
+	PerDay         int `json:"per_day"`
+	RemainingToday int `json:"remaining_today"`
+}
+
+func newRerollWalletResponse(w gacha.Wallet) RerollWalletResponse {
+	return RerollWalletResponse{Balance: w.Balance, Max: w.Max, UsedToday: w.UsedToday, PerDay: w.PerDay, RemainingToday: w.RemainingToday}
+}
+
+type AchievementResponse struct {
+	Key         string     `json:"key"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Rerolls     int        `json:"rerolls"`
+	Metric      string     `json:"metric"`
+	Progress    int        `json:"progress"`
+	Goal        int        `json:"goal"`
+	UnlockedAt  *time.Time `json:"unlocked_at"`
+}
+
+func newAchievementResponse(a gacha.UnlockedAchievement) AchievementResponse {
+	resp := AchievementResponse{Key: a.Key, Name: a.Name, Description: a.Description, Rerolls: a.Rerolls, Metric: a.Metric, Progress: a.Progress, Goal: a.Goal}
+	if !a.UnlockedAt.IsZero() {
+		resp.UnlockedAt = &a.UnlockedAt
+	}
+	return resp
+}
+
+type RerollEntryResponse struct {
+	Delta     int       `json:"delta"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RerollHandler spends a reroll token to redraw one of the user's duplicate pulls
+func RerollHandler(w http.ResponseWriter, r *http.Request) {
+	pullID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid pull ID")
+		return
+	}
+
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	result, err := gacha.Reroll(r.Context(), user, pullID)
+	switch err {
+	case nil:
+	case gacha.ErrPullNotFound:
+		respondError(w, http.StatusNotFound, "Pull not found")
+		return
+	case models.ErrNotRerollable:
+		apiError(w, http.StatusConflict, codeNotRerollable, "Only duplicate pulls that haven't been rerolled can be rerolled")
+		return
+	case models.ErrNoRerolls:
+		apiError(w, http.StatusConflict, codeNoRerollTokens, "You have no reroll tokens")
+		return
+	case models.ErrRerollLimit:
+		apiError(w, http.StatusTooManyRequests, codeRerollLimitReached, "You have used all of today's rerolls")
+		return
+	case gacha.ErrEmptyPool:
+		apiError(w, http.StatusNotFound, codeNothingToPull, "There are no other wallpapers to pull")
+		return
+	default:
+		log.Printf("Reroll of pull %d failed for user %s (ID: %s): %v", pullID, username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reroll")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) rerolled pull %d into upload %d", username, discordID, pullID, result.Upload.ID)
+	writeJSON(w, http.StatusOK, newPullResponse(r, result))
+}
+
+// AchievementsHandler lists every achievement, earned and locked, with the
+// signed-in user's progress towards each
+func AchievementsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	achievements, err := gacha.UserAchievements(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to get achievements for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get achievements")
+		return
+	}
+
+	items := make([]AchievementResponse, 0, len(achievements))
+	earned := 0
+	for _, a := range achievements {
+		if !a.UnlockedAt.IsZero() {
+			earned++
+		}
+		items = append(items, newAchievementResponse(a))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"achievements": items,
+		"earned":       earned,
+		"total":        len(items),
+	})
+}
+
+// RerollsHandler shows the user's reroll tokens, achievements and ledger
+func RerollsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	wallet, err := gacha.RerollWallet(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to get reroll wallet for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get rerolls")
+		return
+	}
+	achievements, err := gacha.UserAchievements(r.Context(), user)
+	if err != nil {
+		log.Printf("Failed to get achievements for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get rerolls")
+		return
+	}
+	page, perPage, offset := parsePagination(r)
+	entries, total, err := models.ListRerollLedger(r.Context(), user.DiscordID, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list reroll ledger for user %s: %v", user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get rerolls")
+		return
+	}
+
+	achievementItems := make([]AchievementResponse, 0, len(achievements))
+	for _, a := range achievements {
+		achievementItems = append(achievementItems, newAchievementResponse(a))
+	}
+	history := make([]RerollEntryResponse, 0, len(entries))
+	for _, e := range entries {
+		history = append(history, RerollEntryResponse{Delta: e.Delta, Reason: e.Reason, Reference: e.Reference, CreatedAt: e.CreatedAt})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"wallet":       newRerollWalletResponse(wallet),
+		"achievements": achievementItems,
+		"history":      history,
+		"page":         page,
+		"per_page":     perPage,
+		"total":        total,
+	})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+)
+
+const (
+	defaultPageSize = 24
+	maxPageSize     = 100
+)
+
+// writeJSON encodes data as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// respondError writes a JSON error response with the code of its status, for
+// failures with no more specific cause
+func respondError(w http.ResponseWriter, status int, message string) {
+	apiError(w, status, middleware.StatusCode(status), message)
+}
+
+// apiError writes a JSON error response with the given error code
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	middleware.WriteError(w, status, code, message)
+}
+
+// translateAll returns messages in the response's locale
+func translateAll(w http.ResponseWriter, messages []string) []string {
+	if messages == nil {
+		return nil
+	}
+	translated := make([]string, len(messages))
+	for i, m := range messages {
+		translated[i] = middleware.Translate(w, m)
+	}
+	return translated
+}
+
+// parsePagination reads the page and per_page query parameters, returning the
+// 1-based page, the page size and the row offset
+func parsePagination(r *http.Request) (page, perPage, offset int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	perPage, _ = strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = defaultPageSize
+	}
+	if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+
+	return page, perPage, (page - 1) * perPage
+}
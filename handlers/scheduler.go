@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/scheduler"
+	"github.com/gorilla/mux"
+)
+
+// AdminSchedulerHandler lists the scheduled tasks with their schedules and
+// how their last run went
+func AdminSchedulerHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tasks": scheduler.Statuses()})
+}
+
+// AdminRunTaskHandler starts a run of a scheduled task in the background.
+// The run shows up in the scheduler status once it finishes.
+func AdminRunTaskHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	switch err := scheduler.RunNow(name); err {
+	case nil:
+	case scheduler.ErrUnknownTask:
+		respondError(w, http.StatusNotFound, "Scheduled task not found")
+		return
+	case scheduler.ErrRunning:
+		respondError(w, http.StatusConflict, "Task is already running")
+		return
+	default:
+		log.Printf("Failed to run scheduled task %s: %v", name, err)
+		respondError(w, http.StatusInternalServerError, "Failed to run task")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) started scheduled task %s", middleware.GetUsername(r), middleware.GetDiscordID(r), name)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditSchedulerRun, "task:"+name, "")
+	w.WriteHeader(http.StatusAccepted)
+}
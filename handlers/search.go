@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// SearchHandler performs a full-text search over the filenames, titles,
+// descriptions and tags of the current guild's uploads
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if !models.SearchEnabled {
+		apiError(w, http.StatusServiceUnavailable, codeSearchUnavailable, "Search is not available on this server")
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		respondError(w, http.StatusBadRequest, "Query parameter q is required")
+		return
+	}
+	page, perPage, offset := parsePagination(r)
+
+	uploads, total, err := models.SearchUploads(r.Context(), middleware.GetGuildID(r), query, perPage, offset)
+	if err != nil {
+		log.Printf("Search for %q failed: %v", query, err)
+		respondError(w, http.StatusInternalServerError, "Search failed")
+		return
+	}
+
+	resp := GalleryResponse{
+		Uploads: make([]WallpaperResponse, 0, len(uploads)),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	for _, u := range uploads {
+		resp.Uploads = append(resp.Uploads, newWallpaperResponse(r, u))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxSeasonNameLength = 100
+	maxSeasonUploads    = 500
+)
+
+// SeasonResponse is the JSON representation of a season. CreatedBy is only
+// shown to admins.
+type SeasonResponse struct {
+	ID        int64     `json:"id"`
+	GuildID   string    `json:"guild_id"`
+	Name      string    `json:"name"`
+	UploadIDs []int64   `json:"upload_ids"`
+	Tags      []string  `json:"tags"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Active    bool      `json:"active"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newSeasonResponse(s *models.Season, admin bool) SeasonResponse {
+	resp := SeasonResponse{
+		ID:        s.ID,
+		GuildID:   s.GuildID,
+		Name:      s.Name,
+		UploadIDs: s.UploadIDs,
+		Tags:      s.Tags,
+		StartsAt:  s.StartsAt,
+		EndsAt:    s.EndsAt,
+		Active:    s.Active(time.Now()),
+		CreatedAt: s.CreatedAt,
+	}
+	if admin {
+		resp.CreatedBy = s.CreatedBy
+	}
+	return resp
+}
+
+func seasonTarget(id int64) string {
+	return fmt.Sprintf("season:%d", id)
+}
+
+// rotateSeasons applies a season change to the pools right away rather than
+// at the next scheduled rotation
+func rotateSeasons() {
+	if err := jobs.RotateSeasons(); err != nil {
+		log.Printf("Failed to rotate seasons: %v", err)
+	}
+}
+
+// SeasonsHandler lists the current guild's seasons, past and upcoming
+// included
+func SeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	writeSeasons(w, r, middleware.GetGuildID(r), false)
+}
+
+// AdminSeasonsHandler lists every season of every guild, or only those of
+// the guild named by ?guild=
+func AdminSeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	writeSeasons(w, r, r.URL.Query().Get("guild"), true)
+}
+
+func writeSeasons(w http.ResponseWriter, r *http.Request, guildID string, admin bool) {
+	seasons, err := models.ListSeasons(r.Context(), guildID)
+	if err != nil {
+		log.Printf("Failed to list seasons: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list seasons")
+		return
+	}
+	items := make([]SeasonResponse, 0, len(seasons))
+	for _, s := range seasons {
+		items = append(items, newSeasonResponse(s, admin))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"seasons": items})
+}
+
+// parseSeason reads and validates a season from the request body, writing a
+// 400 response and returning nil if it is invalid. The season runs in
+// guildID unless the body names another guild.
+func parseSeason(w http.ResponseWriter, r *http.Request, guildID string) *models.Season {
+	var body struct {
+		GuildID   string    `json:"guild_id"`
+		Name      string    `json:"name"`
+		UploadIDs []int64   `json:"upload_ids"`
+		Tags      []string  `json:"tags"`
+		StartsAt  time.Time `json:"starts_at"`
+		EndsAt    time.Time `json:"ends_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return nil
+	}
+
+	if body.GuildID != "" {
+		guildID = body.GuildID
+	}
+	if !config.AppConfig.IsAllowedGuild(guildID) {
+		respondError(w, http.StatusBadRequest, "guild_id must be one of the configured guilds")
+		return nil
+	}
+
+	s := &models.Season{
+		GuildID:   guildID,
+		Name:      strings.TrimSpace(body.Name),
+		StartsAt:  body.StartsAt.UTC().Truncate(time.Second),
+		EndsAt:    body.EndsAt.UTC().Truncate(time.Second),
+		UploadIDs: []int64{},
+	}
+	if s.Name == "" || len([]rune(s.Name)) > maxSeasonNameLength {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("name is required and must be at most %d characters", maxSeasonNameLength))
+		return nil
+	}
+	if s.StartsAt.IsZero() || !s.EndsAt.After(s.StartsAt) {
+		respondError(w, http.StatusBadRequest, "starts_at and ends_at are required, and ends_at must be after starts_at")
+		return nil
+	}
+
+	tags, err := models.NormalizeTags(body.Tags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	s.Tags = append([]string{}, tags...)
+	if len(body.UploadIDs) > maxSeasonUploads {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("A season can list at most %d uploads", maxSeasonUploads))
+		return nil
+	}
+	for _, id := range body.UploadIDs {
+		if upload, err := models.GetUpload(r.Context(), id); err == sql.ErrNoRows || (err == nil && upload.GuildID != s.GuildID) {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Upload %d does not exist in the season's guild", id))
+			return nil
+		} else if err != nil {
+			log.Printf("Failed to get upload %d: %v", id, err)
+			respondError(w, http.StatusInternalServerError, "Failed to save season")
+			return nil
+		}
+		s.UploadIDs = append(s.UploadIDs, id)
+	}
+	if len(s.UploadIDs) == 0 && len(s.Tags) == 0 {
+		respondError(w, http.StatusBadRequest, "A season must list at least one upload or tag")
+		return nil
+	}
+	return s
+}
+
+// AdminCreateSeasonHandler creates a season, in the admin's current guild
+// unless the body names another
+func AdminCreateSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	season := parseSeason(w, r, middleware.GetGuildID(r))
+	if season == nil {
+		return
+	}
+	season.CreatedBy = middleware.GetRealDiscordID(r)
+
+	if err := models.CreateSeason(r.Context(), season); err != nil {
+		log.Printf("Failed to create season: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to save season")
+		return
+	}
+	rotateSeasons()
+
+	log.Printf("Admin %s (ID: %s) created season %d (%s)", middleware.GetUsername(r), season.CreatedBy, season.ID, season.Name)
+	recordAudit(r, season.CreatedBy, models.AuditSeasonCreate, seasonTarget(season.ID), season.Name)
+	writeJSON(w, http.StatusCreated, newSeasonResponse(season, true))
+}
+
+// AdminUpdateSeasonHandler replaces a season's dates and wallpapers. It stays
+// in its guild unless the body names another.
+func AdminUpdateSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid season ID")
+		return
+	}
+	existing, err := models.GetSeason(r.Context(), id)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Season not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get season %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save season")
+		return
+	}
+	season := parseSeason(w, r, existing.GuildID)
+	if season == nil {
+		return
+	}
+	season.ID = id
+
+	if err := models.UpdateSeason(r.Context(), season); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Season not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to update season %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save season")
+		return
+	}
+	rotateSeasons()
+
+	actorID := middleware.GetRealDiscordID(r)
+	log.Printf("Admin %s (ID: %s) updated season %d (%s)", middleware.GetUsername(r), actorID, id, season.Name)
+	recordAudit(r, actorID, models.AuditSeasonUpdate, seasonTarget(id), season.Name)
+	writeJSON(w, http.StatusOK, newSeasonResponse(season, true))
+}
+
+// AdminDeleteSeasonHandler removes a season, returning its wallpapers to the
+// standard pool unless another season lists them
+func AdminDeleteSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid season ID")
+		return
+	}
+
+	if err := models.DeleteSeason(r.Context(), id); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Season not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete season %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete season")
+		return
+	}
+	rotateSeasons()
+
+	actorID := middleware.GetRealDiscordID(r)
+	log.Printf("Admin %s (ID: %s) deleted season %d", middleware.GetUsername(r), actorID, id)
+	recordAudit(r, actorID, models.AuditSeasonDelete, seasonTarget(id), "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/sessionstore"
+)
+
+// Backend is what the Server's handlers read, write and draw through. In
+// production it is the database, through the models package, and the gacha
+// package; tests can hand the Server a fake instead.
+type Backend interface {
+	GetOrCreateUser(ctx context.Context, discordID, username string) (*models.User, error)
+	DustBalance(ctx context.Context, discordID string) (int, error)
+	ListDustLedger(ctx context.Context, discordID string, limit, offset int) ([]models.DustEntry, int, error)
+	ConvertSpareCopies(ctx context.Context, discordID string, uploadID int64, rates map[string]int) (int, int, error)
+	ExchangeDust(ctx context.Context, user *models.User, guildID string, uploadID int64, rarity string) (*gacha.Result, error)
+	RecordAudit(ctx context.Context, entry *models.AuditEntry) error
+}
+
+// SessionManager lists and ends users' sign-in sessions. The session store's
+// backend is one.
+type SessionManager interface {
+	List(discordID string) ([]sessionstore.Record, error)
+	Delete(id string) (bool, error)
+	DeleteUser(discordID string) (int, error)
+}
+
+// Server holds what its handlers depend on, so they can be tested with fakes
+// rather than a database, a configuration file and a session store. Config
+// returns the running configuration, which may be replaced by a reload.
+type Server struct {
+	Backend  Backend
+	Config   func() *config.Config
+	Sessions SessionManager
+}
+
+// NewServer returns a Server backed by the database and the gacha package,
+// the loaded configuration and the session store, which must be initialized
+// first
+func NewServer() *Server {
+	return &Server{
+		Backend:  dbBackend{},
+		Config:   func() *config.Config { return config.AppConfig },
+		Sessions: middleware.Store.Backend,
+	}
+}
+
+// dbBackend is the Backend of the database and the gacha package
+type dbBackend struct{}
+
+func (dbBackend) GetOrCreateUser(ctx context.Context, discordID, username string) (*models.User, error) {
+	return models.GetOrCreateUser(ctx, discordID, username)
+}
+
+func (dbBackend) DustBalance(ctx context.Context, discordID string) (int, error) {
+	return models.DustBalance(ctx, discordID)
+}
+
+func (dbBackend) ListDustLedger(ctx context.Context, discordID string, limit, offset int) ([]models.DustEntry, int, error) {
+	return models.ListDustLedger(ctx, discordID, limit, offset)
+}
+
+func (dbBackend) ConvertSpareCopies(ctx context.Context, discordID string, uploadID int64, rates map[string]int) (int, int, error) {
+	return models.ConvertSpareCopies(ctx, discordID, uploadID, rates)
+}
+
+func (dbBackend) ExchangeDust(ctx context.Context, user *models.User, guildID string, uploadID int64, rarity string) (*gacha.Result, error) {
+	return gacha.ExchangeDust(ctx, user, guildID, uploadID, rarity)
+}
+
+func (dbBackend) RecordAudit(ctx context.Context, entry *models.AuditEntry) error {
+	return models.RecordAudit(ctx, entry)
+}
+
+// recordAudit is recordAudit through the Server's Backend
+func (s *Server) recordAudit(r *http.Request, actorID, action, target, details string) {
+	saveAudit(r, s.Backend.RecordAudit, actorID, action, target, details)
+}
+
+// newPullResponse is newPullResponse under the Server's configuration
+func (s *Server) newPullResponse(r *http.Request, result *gacha.Result) PullResponse {
+	return pullResponse(result, wallpaperResponseWith(s.Config(), r, *result.Upload))
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/sessionstore"
+	"github.com/gorilla/mux"
+)
+
+type fakeBackend struct {
+	balance   int
+	ledger    []models.DustEntry
+	converted map[int64]int
+	rates     map[string]int
+	uploads   map[int64]*models.Upload
+	audit     []*models.AuditEntry
+}
+
+func (f *fakeBackend) GetOrCreateUser(ctx context.Context, discordID, username string) (*models.User, error) {
+	return &models.User{DiscordID: discordID, Username: username}, nil
+}
+
+func (f *fakeBackend) DustBalance(ctx context.Context, discordID string) (int, error) {
+	return f.balance, nil
+}
+
+func (f *fakeBackend) ListDustLedger(ctx context.Context, discordID string, limit, offset int) ([]models.DustEntry, int, error) {
+	return f.ledger, len(f.ledger), nil
+}
+
+func (f *fakeBackend) ConvertSpareCopies(ctx context.Context, discordID string, uploadID int64, rates map[string]int) (int, int, error) {
+	f.rates = rates
+	copies := f.converted[uploadID]
+	f.balance += copies * rates["common"]
+	return copies, copies * rates["common"], nil
+}
+
+func (f *fakeBackend) ExchangeDust(ctx context.Context, user *models.User, guildID string, uploadID int64, rarity string) (*gacha.Result, error) {
+	upload, ok := f.uploads[uploadID]
+	if !ok {
+		return nil, gacha.ErrNotInPool
+	}
+	if f.balance < 150 {
+		return nil, models.ErrNotEnoughDust
+	}
+	f.balance -= 150
+	pull := &models.Pull{ID: 1, DiscordID: user.DiscordID, UploadID: uploadID, Source: models.PullSourceDust}
+	return &gacha.Result{Pull: pull, Upload: upload}, nil
+}
+
+func (f *fakeBackend) RecordAudit(ctx context.Context, entry *models.AuditEntry) error {
+	f.audit = append(f.audit, entry)
+	return nil
+}
+
+type fakeSessions struct {
+	records []sessionstore.Record
+	deleted []string
+}
+
+func (f *fakeSessions) List(discordID string) ([]sessionstore.Record, error) {
+	var own []sessionstore.Record
+	for _, rec := range f.records {
+		if rec.DiscordID == discordID {
+			own = append(own, rec)
+		}
+	}
+	return own, nil
+}
+
+func (f *fakeSessions) Delete(id string) (bool, error) {
+	f.deleted = append(f.deleted, id)
+	return true, nil
+}
+
+func (f *fakeSessions) DeleteUser(discordID string) (int, error) {
+	recs, _ := f.List(discordID)
+	return len(recs), nil
+}
+
+func newTestServer(backend Backend, sessions SessionManager) *Server {
+	cfg := &config.Config{
+		DustRates:         map[string]int{"common": 5},
+		DustPullCost:      50,
+		DustRarityCosts:   map[string]int{"common": 25},
+		DustWallpaperCost: 150,
+	}
+	return &Server{Backend: backend, Config: func() *config.Config { return cfg }, Sessions: sessions}
+}
+
+// signedIn returns a request made by the given user in a guild, as the
+// routes' middleware would pass it on
+func signedIn(method, target, body, discordID string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	ctx := context.WithValue(r.Context(), middleware.DiscordIDKey, discordID)
+	ctx = context.WithValue(ctx, middleware.GuildIDKey, "100")
+	ctx = context.WithValue(ctx, middleware.ClientIPKey, "192.0.2.1")
+	return r.WithContext(context.WithValue(ctx, middleware.UsernameKey, "tester"))
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+}
+
+func TestDustHandlerReportsBalanceAndRates(t *testing.T) {
+	store := &fakeBackend{balance: 40, ledger: []models.DustEntry{{Amount: 5, Reason: models.DustDuplicate}}}
+	srv := newTestServer(store, &fakeSessions{})
+
+	w := httptest.NewRecorder()
+	srv.DustHandler(w, signedIn("GET", "/api/dust", "", "1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var resp struct {
+		Balance int                 `json:"balance"`
+		Rates   DustRatesResponse   `json:"rates"`
+		History []DustEntryResponse `json:"history"`
+		Total   int                 `json:"total"`
+	}
+	decode(t, w, &resp)
+	if resp.Balance != 40 || resp.Total != 1 || len(resp.History) != 1 {
+		t.Errorf("balance %d, total %d, history %d; want 40, 1, 1", resp.Balance, resp.Total, len(resp.History))
+	}
+	if resp.Rates.PullCost != 50 || resp.Rates.Duplicate["common"] != 5 || resp.Rates.AutoConvert {
+		t.Errorf("rates = %+v, want the configured ones", resp.Rates)
+	}
+}
+
+func TestDustConvertHandler(t *testing.T) {
+	store := &fakeBackend{balance: 10, converted: map[int64]int{0: 3, 7: 1}}
+	srv := newTestServer(store, &fakeSessions{})
+
+	w := httptest.NewRecorder()
+	srv.DustConvertHandler(w, signedIn("POST", "/api/dust/convert", `{"upload_id": 7}`, "1"))
+	var resp map[string]int
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp["converted"] != 1 || resp["dust"] != 5 || resp["balance"] != 15 {
+		t.Errorf("status %d, response %v; want 200 with 1 converted for 5 dust, balance 15", w.Code, resp)
+	}
+	if store.rates["common"] != 5 {
+		t.Errorf("converted at %v, want the configured dust_rates", store.rates)
+	}
+
+	w = httptest.NewRecorder()
+	srv.DustConvertHandler(w, signedIn("POST", "/api/dust/convert", `{"upload_id": -1}`, "1"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("negative upload_id: status = %d, want 400", w.Code)
+	}
+}
+
+func TestDustExchangeHandlerRejectsBadRequests(t *testing.T) {
+	srv := newTestServer(&fakeBackend{}, &fakeSessions{})
+	for _, body := range []string{`{"rarity": "mythic"}`, `{"rarity": "epic", "upload_id": 3}`, `{`} {
+		w := httptest.NewRecorder()
+		srv.DustExchangeHandler(w, signedIn("POST", "/api/dust/exchange", body, "1"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestDustExchangeHandler(t *testing.T) {
+	backend := &fakeBackend{balance: 200, uploads: map[int64]*models.Upload{4: {ID: 4, Title: "Dunes"}}}
+	srv := newTestServer(backend, &fakeSessions{})
+
+	w := httptest.NewRecorder()
+	srv.DustExchangeHandler(w, signedIn("POST", "/api/dust/exchange", `{"upload_id": 4}`, "1"))
+	var resp PullResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Wallpaper.ID != 4 || resp.Wallpaper.ImageURL == "" {
+		t.Errorf("status %d, response %+v; want 200 with wallpaper 4", w.Code, resp)
+	}
+
+	for body, want := range map[string]int{`{"upload_id": 4}`: http.StatusConflict, `{"upload_id": 5}`: http.StatusNotFound} {
+		w = httptest.NewRecorder()
+		srv.DustExchangeHandler(w, signedIn("POST", "/api/dust/exchange", body, "1"))
+		if w.Code != want {
+			t.Errorf("%s: status = %d, want %d", body, w.Code, want)
+		}
+	}
+}
+
+func TestSessionHandlers(t *testing.T) {
+	current := "cookie-value"
+	sessions := &fakeSessions{records: []sessionstore.Record{
+		{ID: sessionstore.HashID(current), DiscordID: "1"},
+		{ID: "aa", DiscordID: "1"},
+		{ID: "bb", DiscordID: "2"},
+	}}
+	backend := &fakeBackend{}
+	srv := newTestServer(backend, sessions)
+	withCookie := func(r *http.Request) *http.Request {
+		r.AddCookie(&http.Cookie{Name: middleware.SessionName, Value: current})
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	srv.SessionsHandler(w, withCookie(signedIn("GET", "/api/me/sessions", "", "1")))
+	var list struct {
+		Sessions []SessionResponse `json:"sessions"`
+	}
+	decode(t, w, &list)
+	if len(list.Sessions) != 2 || !list.Sessions[0].Current || list.Sessions[1].Current {
+		t.Fatalf("sessions = %+v, want the user's two with the first current", list.Sessions)
+	}
+
+	// Another user's session can't be revoked
+	w = httptest.NewRecorder()
+	r := signedIn("DELETE", "/api/me/sessions/bb", "", "1")
+	srv.RevokeSessionHandler(w, mux.SetURLVars(r, map[string]string{"id": "bb"}))
+	if w.Code != http.StatusNotFound || len(sessions.deleted) != 0 {
+		t.Errorf("revoking another user's session: status %d, deleted %v; want 404 and nothing deleted", w.Code, sessions.deleted)
+	}
+
+	// An admin viewing the site as the user would end all of the user's
+	// sessions, their own not being among them
+	w = httptest.NewRecorder()
+	r = signedIn("DELETE", "/api/me/sessions", "", "1")
+	srv.RevokeOtherSessionsHandler(w, r.WithContext(context.WithValue(r.Context(), middleware.ImpersonatorIDKey, "9")))
+	if w.Code != http.StatusForbidden || len(sessions.deleted) != 0 {
+		t.Errorf("revoking while impersonating: status %d, deleted %v; want 403 and nothing deleted", w.Code, sessions.deleted)
+	}
+
+	w = httptest.NewRecorder()
+	srv.RevokeOtherSessionsHandler(w, withCookie(signedIn("DELETE", "/api/me/sessions", "", "1")))
+	var revoked map[string]int
+	decode(t, w, &revoked)
+	if revoked["revoked"] != 1 || len(sessions.deleted) != 1 || sessions.deleted[0] != "aa" {
+		t.Errorf("revoked %v, deleted %v; want only the other session", revoked, sessions.deleted)
+	}
+
+	// Admins signing a user out everywhere are audited
+	w = httptest.NewRecorder()
+	r = signedIn("DELETE", "/api/admin/users/2/sessions", "", "9")
+	srv.AdminTerminateSessionsHandler(w, mux.SetURLVars(r, map[string]string{"id": "2"}))
+	if w.Code != http.StatusOK || len(backend.audit) != 1 || backend.audit[0].Action != models.AuditSessionsTerminate {
+		t.Errorf("terminating: status %d, audit %+v; want 200 and one sessions entry", w.Code, backend.audit)
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/sessionstore"
+	"github.com/gorilla/mux"
+)
+
+// SessionResponse describes one signed-in browser
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	Current    bool      `json:"current"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func newSessionResponses(r *http.Request, records []sessionstore.Record) []SessionResponse {
+	current := sessionstore.CurrentID(r, middleware.SessionName)
+	items := make([]SessionResponse, 0, len(records))
+	for _, rec := range records {
+		items = append(items, SessionResponse{
+			ID:         rec.ID,
+			Current:    rec.ID == current,
+			IPAddress:  rec.IPAddress,
+			UserAgent:  rec.UserAgent,
+			CreatedAt:  rec.CreatedAt,
+			LastSeenAt: rec.LastSeenAt,
+			ExpiresAt:  rec.ExpiresAt,
+		})
+	}
+	return items
+}
+
+// SessionsHandler lists the browsers the signed-in user is signed in on
+func (s *Server) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := s.Sessions.List(middleware.GetDiscordID(r))
+	if err != nil {
+		log.Printf("Failed to list sessions: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list sessions")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": newSessionResponses(r, records)})
+}
+
+// RevokeSessionHandler signs the user out of one of their sessions
+func (s *Server) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	id := mux.Vars(r)["id"]
+
+	// Only the user's own sessions can be revoked here
+	records, err := s.Sessions.List(discordID)
+	if err != nil {
+		log.Printf("Failed to list sessions for user %s (ID: %s): %v", middleware.GetUsername(r), discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	found := false
+	for _, rec := range records {
+		found = found || rec.ID == id
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	if _, err := s.Sessions.Delete(id); err != nil {
+		log.Printf("Failed to revoke session for user %s (ID: %s): %v", middleware.GetUsername(r), discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	log.Printf("User %s (ID: %s) revoked one of their sessions", middleware.GetUsername(r), discordID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessionsHandler signs the user out of every session but the one
+// making the request, such as one left signed in on a shared computer. An
+// admin viewing the site as the user is refused, as their session isn't one
+// of the user's and every one of those would be ended.
+func (s *Server) RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if middleware.GetImpersonatorID(r) != "" {
+		respondImpersonating(w, "Other sessions cannot be signed out while viewing as another user")
+		return
+	}
+	discordID := middleware.GetDiscordID(r)
+	records, err := s.Sessions.List(discordID)
+	if err != nil {
+		log.Printf("Failed to list sessions for user %s (ID: %s): %v", middleware.GetUsername(r), discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
+	}
+
+	current := sessionstore.CurrentID(r, middleware.SessionName)
+	var revoked int
+	for _, rec := range records {
+		if rec.ID == current {
+			continue
+		}
+		deleted, err := s.Sessions.Delete(rec.ID)
+		if err != nil {
+			log.Printf("Failed to revoke session for user %s (ID: %s): %v", middleware.GetUsername(r), discordID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to revoke sessions")
+			return
+		}
+		if deleted {
+			revoked++
+		}
+	}
+	log.Printf("User %s (ID: %s) revoked %d of their other sessions", middleware.GetUsername(r), discordID, revoked)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"revoked": revoked})
+}
+
+// AdminUserSessionsHandler lists a user's sessions
+func (s *Server) AdminUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := mux.Vars(r)["id"]
+	records, err := s.Sessions.List(discordID)
+	if err != nil {
+		log.Printf("Failed to list sessions for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to list sessions")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": newSessionResponses(r, records)})
+}
+
+// AdminTerminateSessionsHandler signs a user out of every browser
+func (s *Server) AdminTerminateSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := mux.Vars(r)["id"]
+	n, err := s.Sessions.DeleteUser(discordID)
+	if err != nil {
+		log.Printf("Failed to terminate sessions for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to terminate sessions")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) terminated %d sessions of user %s", middleware.GetUsername(r), middleware.GetRealDiscordID(r), n, discordID)
+	s.recordAudit(r, middleware.GetRealDiscordID(r), models.AuditSessionsTerminate, userTarget(discordID), "")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"terminated": n})
+}
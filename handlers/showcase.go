@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// ShowcaseEntryResponse is a wallpaper shown off on a profile. Duplicates is
+// how many copies the user holds beyond the first.
+type ShowcaseEntryResponse struct {
+	Wallpaper  WallpaperResponse `json:"wallpaper"`
+	Copies     int               `json:"copies"`
+	Duplicates int               `json:"duplicates"`
+}
+
+func newShowcaseResponse(r *http.Request, entries []models.ShowcaseEntry) []ShowcaseEntryResponse {
+	items := make([]ShowcaseEntryResponse, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, ShowcaseEntryResponse{Wallpaper: newWallpaperResponse(r, e.Upload), Copies: e.Copies, Duplicates: e.Copies - 1})
+	}
+	return items
+}
+
+// ShowcaseHandler replaces the wallpapers the signed-in user shows on their
+// profile with up to showcase_size wallpapers from their collection, in the
+// order given. An empty list clears the showcase.
+func ShowcaseHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		UploadIDs []int64 `json:"upload_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UploadIDs == nil {
+		respondError(w, http.StatusBadRequest, "Request body must list upload_ids")
+		return
+	}
+	if len(body.UploadIDs) > config.AppConfig.ShowcaseSize {
+		apiError(w, http.StatusBadRequest, codeLimitReached, fmt.Sprintf("You can showcase at most %d wallpapers", config.AppConfig.ShowcaseSize))
+		return
+	}
+	for i, id := range body.UploadIDs {
+		if slices.Contains(body.UploadIDs[:i], id) {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Wallpaper %d is listed twice", id))
+			return
+		}
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+	if err := models.SetShowcase(r.Context(), user.DiscordID, body.UploadIDs); err == models.ErrNotInCollection {
+		apiError(w, http.StatusBadRequest, codeNotInCollection, "You can only showcase wallpapers in your collection")
+		return
+	} else if err != nil {
+		log.Printf("Failed to set showcase of user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save showcase")
+		return
+	}
+
+	entries, err := models.ListShowcase(r.Context(), user.DiscordID, true)
+	if err != nil {
+		log.Printf("Failed to list showcase of user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get showcase")
+		return
+	}
+	log.Printf("User %s (ID: %s) showcased %d wallpapers", user.Username, user.DiscordID, len(body.UploadIDs))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"showcase": newShowcaseResponse(r, entries),
+		"max":      config.AppConfig.ShowcaseSize,
+	})
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// StorageResponse is how much storage a user's uploads take up against the
+// per-user quota. LimitBytes is 0 and RemainingBytes null when there is no
+// quota.
+type StorageResponse struct {
+	UsedBytes      int64  `json:"used_bytes"`
+	Files          int    `json:"files"`
+	LimitBytes     int64  `json:"limit_bytes"`
+	RemainingBytes *int64 `json:"remaining_bytes"`
+}
+
+func newStorageResponse(usage models.StorageUsage) StorageResponse {
+	resp := StorageResponse{UsedBytes: usage.Bytes, Files: usage.Files, LimitBytes: storageLimitBytes()}
+	if resp.LimitBytes > 0 {
+		remaining := max(resp.LimitBytes-usage.Bytes, 0)
+		resp.RemainingBytes = &remaining
+	}
+	return resp
+}
+
+// UserStorageResponse is a user's line in the admin storage report
+type UserStorageResponse struct {
+	DiscordID string `json:"discord_id"`
+	Username  string `json:"username"`
+	StorageResponse
+}
+
+// MyStorageHandler reports how much storage the signed-in user's uploads
+// take up and how much of their quota is left. Uploads in the trash don't
+// count.
+func MyStorageHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	usage, err := models.GetStorageUsage(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to get storage usage of user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get storage usage")
+		return
+	}
+	writeJSON(w, http.StatusOK, newStorageResponse(usage))
+}
+
+// AdminStorageHandler lists users by the storage their uploads take up,
+// largest first
+func AdminStorageHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	users, total, err := models.ListStorageUsage(r.Context(), perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list storage usage: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list storage usage")
+		return
+	}
+
+	items := make([]UserStorageResponse, 0, len(users))
+	for _, u := range users {
+		items = append(items, UserStorageResponse{DiscordID: u.DiscordID, Username: u.Username, StorageResponse: newStorageResponse(u.StorageUsage)})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"users":    items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxTakedownReasonLength = 2000
+	maxTakedownProofLinks   = 10
+)
+
+type TakedownRequestBody struct {
+	UploadID   int64    `json:"upload_id"`
+	Name       string   `json:"name"`
+	Email      string   `json:"email"`
+	Reason     string   `json:"reason"`
+	ProofLinks []string `json:"proof_links"`
+}
+
+type TakedownResponse struct {
+	ID         int64      `json:"id"`
+	UploadID   int64      `json:"upload_id"`
+	Status     string     `json:"status"`
+	AdminNote  string     `json:"admin_note,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	StatusURL  string     `json:"status_url,omitempty"`
+}
+
+// AdminTakedownResponse includes requester details visible only to admins
+type AdminTakedownResponse struct {
+	TakedownResponse
+	RequesterName  string   `json:"requester_name"`
+	RequesterEmail string   `json:"requester_email"`
+	Reason         string   `json:"reason"`
+	ProofLinks     []string `json:"proof_links"`
+}
+
+func newTakedownResponse(t *models.TakedownRequest) TakedownResponse {
+	resp := TakedownResponse{
+		ID:        t.ID,
+		UploadID:  t.UploadID,
+		Status:    t.Status,
+		AdminNote: t.AdminNote,
+		CreatedAt: t.CreatedAt,
+	}
+	if t.ResolvedAt.Valid {
+		resp.ResolvedAt = &t.ResolvedAt.Time
+	}
+	return resp
+}
+
+func hashTakedownToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TakedownHandler lets anyone request removal of a wallpaper. The upload is
+// frozen pending admin review and the requester receives a status link.
+func TakedownHandler(w http.ResponseWriter, r *http.Request) {
+	var body TakedownRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	body.Email = strings.TrimSpace(body.Email)
+	body.Reason = strings.TrimSpace(body.Reason)
+
+	switch {
+	case body.UploadID <= 0:
+		respondError(w, http.StatusBadRequest, "upload_id is required")
+		return
+	case body.Name == "":
+		respondError(w, http.StatusBadRequest, "name is required")
+		return
+	case !strings.Contains(body.Email, "@"):
+		respondError(w, http.StatusBadRequest, "A valid email address is required")
+		return
+	case body.Reason == "" || len(body.Reason) > maxTakedownReasonLength:
+		respondError(w, http.StatusBadRequest, "reason is required and must be at most 2000 characters")
+		return
+	case len(body.ProofLinks) > maxTakedownProofLinks:
+		respondError(w, http.StatusBadRequest, "Too many proof links")
+		return
+	}
+
+	for _, link := range body.ProofLinks {
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			respondError(w, http.StatusBadRequest, "Proof links must be http(s) URLs")
+			return
+		}
+	}
+
+	upload, err := models.GetUpload(r.Context(), body.UploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d for takedown request: %v", body.UploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to submit takedown request")
+		return
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		log.Printf("Failed to generate takedown token: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to submit takedown request")
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	req := &models.TakedownRequest{
+		UploadID:       upload.ID,
+		RequesterName:  body.Name,
+		RequesterEmail: body.Email,
+		Reason:         body.Reason,
+		ProofLinks:     strings.Join(body.ProofLinks, "\n"),
+		TokenHash:      hashTakedownToken(token),
+	}
+	if err := models.CreateTakedownRequest(r.Context(), req); err != nil {
+		log.Printf("Failed to create takedown request for upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to submit takedown request")
+		return
+	}
+
+	log.Printf("Takedown request %d filed for upload %d (uploader ID: %s) by %s from IP: %s; upload frozen pending review",
+		req.ID, upload.ID, upload.DiscordID, body.Email, r.RemoteAddr)
+
+	created, err := models.GetTakedownRequest(r.Context(), req.ID)
+	if err != nil {
+		log.Printf("Failed to reload takedown request %d: %v", req.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to submit takedown request")
+		return
+	}
+
+	resp := newTakedownResponse(created)
+	webhooks.Notify(webhooks.EventTakedownRequested, resp)
+	resp.StatusURL = "/api/takedown/" + token
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// TakedownStatusHandler reports the status of a takedown request by its token
+func TakedownStatusHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := models.GetTakedownRequestByToken(r.Context(), hashTakedownToken(mux.Vars(r)["token"]))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Takedown request not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to look up takedown request: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to look up takedown request")
+		return
+	}
+
+	resp := newTakedownResponse(req)
+	webhooks.Notify(webhooks.EventTakedownResolved, resp)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminTakedownsHandler lists takedown requests by status (pending by default)
+func AdminTakedownsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.TakedownPending
+	}
+	page, perPage, offset := parsePagination(r)
+
+	requests, err := models.ListTakedownRequests(r.Context(), status, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list takedown requests: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list takedown requests")
+		return
+	}
+
+	items := make([]AdminTakedownResponse, 0, len(requests))
+	for i := range requests {
+		t := &requests[i]
+		links := []string{}
+		if t.ProofLinks != "" {
+			links = strings.Split(t.ProofLinks, "\n")
+		}
+		items = append(items, AdminTakedownResponse{
+			TakedownResponse: newTakedownResponse(t),
+			RequesterName:    t.RequesterName,
+			RequesterEmail:   t.RequesterEmail,
+			Reason:           t.Reason,
+			ProofLinks:       links,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"takedowns": items,
+		"page":      page,
+		"per_page":  perPage,
+	})
+}
+
+// AdminResolveTakedownHandler approves (keeping the upload frozen) or rejects
+// (unfreezing it) a pending takedown request
+func AdminResolveTakedownHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid takedown request ID")
+		return
+	}
+
+	var body struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var status string
+	switch body.Action {
+	case "approve":
+		status = models.TakedownApproved
+	case "reject":
+		status = models.TakedownRejected
+	default:
+		respondError(w, http.StatusBadRequest, "action must be approve or reject")
+		return
+	}
+
+	err = models.ResolveTakedownRequest(r.Context(), id, status, strings.TrimSpace(body.Note))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "No pending takedown request with that ID")
+		return
+	} else if err != nil {
+		log.Printf("Failed to resolve takedown request %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to resolve takedown request")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) marked takedown request %d as %s", middleware.GetUsername(r), middleware.GetDiscordID(r), id, status)
+	action := models.AuditTakedownApprove
+	if status == models.TakedownRejected {
+		action = models.AuditTakedownReject
+	}
+	recordAudit(r, middleware.GetRealDiscordID(r), action, fmt.Sprintf("takedown:%d", id), strings.TrimSpace(body.Note))
+
+	req, err := models.GetTakedownRequest(r.Context(), id)
+	if err != nil {
+		log.Printf("Failed to reload takedown request %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to resolve takedown request")
+		return
+	}
+	writeJSON(w, http.StatusOK, newTakedownResponse(req))
+}
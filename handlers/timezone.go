@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// userResetLocation returns the time zone in which the user's daily limits
+// reset: their own preference if set, otherwise the server-wide setting
+func userResetLocation(user *models.User) *time.Location {
+	return user.ResetLocation(config.AppConfig.ResetLocation())
+}
+
+// nextDailyReset returns when daily limits next reset for the user
+func nextDailyReset(user *models.User) time.Time {
+	_, end := models.DailyWindow(time.Now(), userResetLocation(user))
+	return end
+}
+
+// TimezoneHandler sets or clears the current user's time zone preference
+func TimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	name := strings.TrimSpace(body.Timezone)
+	if name != "" {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Unknown time zone")
+			return
+		}
+		name = loc.String()
+	}
+
+	user, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	if err := user.SetTimezone(r.Context(), name); err != nil {
+		log.Printf("Failed to set time zone for user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save time zone")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"timezone":         userResetLocation(user).String(),
+		"next_daily_reset": nextDailyReset(user),
+	})
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+	"github.com/gorilla/mux"
+)
+
+// TradeUserResponse is one side of a trade
+type TradeUserResponse struct {
+	DiscordID string `json:"discord_id"`
+	Username  string `json:"username"`
+}
+
+// TradeResponse is the JSON representation of a trade offer. Requested is
+// left out when the sender asks for nothing in return.
+type TradeResponse struct {
+	ID         int64              `json:"id"`
+	Sender     TradeUserResponse  `json:"sender"`
+	Recipient  TradeUserResponse  `json:"recipient"`
+	Offered    WallpaperResponse  `json:"offered"`
+	Requested  *WallpaperResponse `json:"requested,omitempty"`
+	Status     string             `json:"status"`
+	CreatedAt  time.Time          `json:"created_at"`
+	ExpiresAt  time.Time          `json:"expires_at"`
+	ResolvedAt *time.Time         `json:"resolved_at,omitempty"`
+}
+
+func newTradeResponse(r *http.Request, t *models.Trade) TradeResponse {
+	resp := TradeResponse{
+		ID:        t.ID,
+		Sender:    TradeUserResponse{DiscordID: t.SenderID, Username: t.SenderName},
+		Recipient: TradeUserResponse{DiscordID: t.RecipientID, Username: t.RecipientName},
+		Offered:   newWallpaperResponse(r, t.Offered),
+		Status:    t.CurrentStatus(),
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+	}
+	if t.Requested != nil {
+		requested := newWallpaperResponse(r, *t.Requested)
+		resp.Requested = &requested
+	}
+	if t.ResolvedAt.Valid {
+		resp.ResolvedAt = &t.ResolvedAt.Time
+	}
+	return resp
+}
+
+// CreateTradeHandler offers a spare copy of a wallpaper to another user,
+// optionally asking for a spare copy of one of theirs in return
+func CreateTradeHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RecipientID       string `json:"recipient_id"`
+		OfferedUploadID   int64  `json:"offered_upload_id"`
+		RequestedUploadID *int64 `json:"requested_upload_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RecipientID == "" || body.OfferedUploadID == 0 {
+		respondError(w, http.StatusBadRequest, "Request body must set recipient_id and offered_upload_id")
+		return
+	}
+
+	sender, err := models.GetOrCreateUser(r.Context(), middleware.GetDiscordID(r), middleware.GetUsername(r))
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+	if body.RecipientID == sender.DiscordID {
+		apiError(w, http.StatusBadRequest, codeOwnResource, "You cannot trade with yourself")
+		return
+	}
+	if _, err := models.GetUser(r.Context(), body.RecipientID); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get user %s: %v", body.RecipientID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	trade := &models.Trade{SenderID: sender.DiscordID, RecipientID: body.RecipientID, OfferedUploadID: body.OfferedUploadID}
+	if body.RequestedUploadID != nil {
+		trade.RequestedUploadID = sql.NullInt64{Int64: *body.RequestedUploadID, Valid: true}
+	}
+	switch err := models.CreateTrade(r.Context(), trade, time.Duration(config.AppConfig.TradeOfferHours)*time.Hour); err {
+	case nil:
+	case models.ErrNoSpareCopy:
+		apiError(w, http.StatusConflict, codeNoSpareCopy, "You can only offer wallpapers you have more than one copy of")
+		return
+	case models.ErrNoSpareRequested:
+		apiError(w, http.StatusConflict, codeNoSpareCopy, "The other user has no spare copy of the wallpaper you asked for")
+		return
+	default:
+		log.Printf("Failed to create trade for user %s (ID: %s): %v", sender.Username, sender.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to create trade")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) offered upload %d to user %s in trade %d", sender.Username, sender.DiscordID, trade.OfferedUploadID, trade.RecipientID, trade.ID)
+	notify.TradeReceived(trade, sender.Username)
+	respondTrade(w, r, http.StatusCreated, trade.ID)
+}
+
+// respondTrade writes the trade as the signed-in user sees it
+func respondTrade(w http.ResponseWriter, r *http.Request, status int, id int64) {
+	trade, err := models.GetTrade(r.Context(), id, middleware.GetDiscordID(r))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Trade not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get trade %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get trade")
+		return
+	}
+	writeJSON(w, status, newTradeResponse(r, trade))
+}
+
+// TradeHandler returns one of the signed-in user's trades
+func TradeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid trade ID")
+		return
+	}
+	respondTrade(w, r, http.StatusOK, id)
+}
+
+// TradesHandler lists every trade the signed-in user sent or received
+func TradesHandler(w http.ResponseWriter, r *http.Request) {
+	listTrades(w, r, false)
+}
+
+// TradeInboxHandler lists the trade offers waiting for the signed-in user's answer
+func TradeInboxHandler(w http.ResponseWriter, r *http.Request) {
+	listTrades(w, r, true)
+}
+
+func listTrades(w http.ResponseWriter, r *http.Request, inbox bool) {
+	page, perPage, offset := parsePagination(r)
+
+	trades, total, err := models.ListTrades(r.Context(), middleware.GetDiscordID(r), inbox, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list trades: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list trades")
+		return
+	}
+
+	items := make([]TradeResponse, 0, len(trades))
+	for _, t := range trades {
+		items = append(items, newTradeResponse(r, t))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"trades":   items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// AcceptTradeHandler accepts a trade offered to the signed-in user, swapping
+// the wallpapers between the two collections
+func AcceptTradeHandler(w http.ResponseWriter, r *http.Request) {
+	answerTrade(w, r, "accept", models.AcceptTrade)
+}
+
+// DeclineTradeHandler turns down a trade offered to the signed-in user
+func DeclineTradeHandler(w http.ResponseWriter, r *http.Request) {
+	answerTrade(w, r, "decline", models.DeclineTrade)
+}
+
+// CancelTradeHandler withdraws a trade the signed-in user offered
+func CancelTradeHandler(w http.ResponseWriter, r *http.Request) {
+	answerTrade(w, r, "cancel", models.CancelTrade)
+}
+
+// answerTrade applies an answer to a pending trade and responds with the
+// trade as it now stands
+func answerTrade(w http.ResponseWriter, r *http.Request, action string, answer func(ctx context.Context, id int64, discordID string) error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid trade ID")
+		return
+	}
+
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+	switch err := answer(r.Context(), id, discordID); err {
+	case nil:
+	case sql.ErrNoRows:
+		respondError(w, http.StatusNotFound, "Trade not found")
+		return
+	case models.ErrTradeClosed:
+		apiError(w, http.StatusConflict, codeTradeNotPending, "This trade is no longer pending")
+		return
+	case models.ErrNoSpareCopy:
+		apiError(w, http.StatusConflict, codeNoSpareCopy, "The sender no longer has a spare copy of the offered wallpaper")
+		return
+	case models.ErrNoSpareRequested:
+		apiError(w, http.StatusConflict, codeNoSpareCopy, "You no longer have a spare copy of the requested wallpaper")
+		return
+	default:
+		log.Printf("Failed to %s trade %d for user %s (ID: %s): %v", action, id, username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to "+action+" trade")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) chose to %s trade %d", username, discordID, action, id)
+	trade, err := models.GetTrade(r.Context(), id, discordID)
+	if err != nil {
+		log.Printf("Failed to get trade %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get trade")
+		return
+	}
+	if trade.Status == models.TradeAccepted {
+		gacha.QueueAchievementCheck(trade.SenderID)
+		gacha.QueueAchievementCheck(trade.RecipientID)
+	}
+	writeJSON(w, http.StatusOK, newTradeResponse(r, trade))
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/gorilla/mux"
+)
+
+// AdminTrashHandler lists trashed uploads, most recently deleted first
+func AdminTrashHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	uploads, total, err := models.ListTrash(r.Context(), perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list trash: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list trash")
+		return
+	}
+
+	resp := GalleryResponse{
+		Uploads: make([]WallpaperResponse, 0, len(uploads)),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	for _, u := range uploads {
+		resp.Uploads = append(resp.Uploads, newWallpaperResponse(r, u))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminRestoreHandler takes an upload out of the trash
+func AdminRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	err = models.RestoreUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "No trashed upload with that ID")
+		return
+	} else if err != nil {
+		log.Printf("Failed to restore upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to restore upload")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) restored upload %d from the trash", middleware.GetUsername(r), middleware.GetRealDiscordID(r), uploadID)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditRestore, uploadTarget(uploadID), "")
+
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		log.Printf("Failed to reload upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to restore upload")
+		return
+	}
+	writeJSON(w, http.StatusOK, newWallpaperResponse(r, *upload))
+}
+
+// AdminPurgeHandler permanently deletes a trashed upload
+func AdminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	orphaned, err := models.PurgeUpload(r.Context(), uploadID)
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "No trashed upload with that ID")
+		return
+	} else if err != nil {
+		log.Printf("Failed to purge upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to purge upload")
+		return
+	}
+	storage.Remove(orphaned)
+
+	log.Printf("Admin %s (ID: %s) purged upload %d", middleware.GetUsername(r), middleware.GetRealDiscordID(r), uploadID)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditPurge, uploadTarget(uploadID), "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// TrendingWallpaperResponse is a wallpaper in the trending listing with the
+// score it is ranked by
+type TrendingWallpaperResponse struct {
+	WallpaperResponse
+	TrendingScore float64 `json:"trending_score"`
+}
+
+// TrendingHandler lists the current guild's wallpapers viewed or downloaded
+// lately, ranked by a score in which each view and download counts for less
+// the longer ago it was made, for the gallery's hot tab
+func TrendingHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage, offset := parsePagination(r)
+
+	trending, total, err := models.ListTrending(r.Context(), middleware.GetGuildID(r), perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list trending wallpapers: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list trending wallpapers")
+		return
+	}
+
+	items := make([]TrendingWallpaperResponse, 0, len(trending))
+	for _, t := range trending {
+		items = append(items, TrendingWallpaperResponse{WallpaperResponse: newWallpaperResponse(r, t.Upload), TrendingScore: t.Score})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uploads":  items,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
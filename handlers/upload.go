@@ -1,49 +1,136 @@
 package handlers
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/Zinbhe/wallpaper-gacha/clamav"
 	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/diskspace"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/hooks"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/live"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
 	"github.com/Zinbhe/wallpaper-gacha/middleware"
 	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+	"github.com/Zinbhe/wallpaper-gacha/processing"
+	"github.com/Zinbhe/wallpaper-gacha/safety"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
 	"github.com/google/uuid"
 )
 
-var allowedExtensions = map[string]bool{
-	".png":  true,
-	".jpg":  true,
-	".jpeg": true,
-	".jxl":  true,
-	".webp": true,
+// invalidFileTypeMessage is the error for files with an extension outside
+// upload_formats
+func invalidFileTypeMessage() string {
+	exts := config.AppConfig.UploadExtensions()
+	for i, ext := range exts {
+		exts[i] = strings.TrimPrefix(ext, ".")
+	}
+	return "Invalid file type. Allowed: " + strings.Join(exts, ", ")
+}
+
+// JPEG XL signatures: a bare codestream, or the ISO BMFF container box
+var (
+	jxlCodestream = []byte{0xFF, 0x0A}
+	jxlContainer  = []byte{0x00, 0x00, 0x00, 0x0C, 'J', 'X', 'L', ' ', 0x0D, 0x0A, 0x87, 0x0A}
+)
+
+// HEIF brands of HEVC-coded images, as produced by phone cameras
+var heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx"}
+
+// detectContentType identifies an image from its leading bytes. It knows the
+// JPEG XL, WebP and HEIF (AVIF and HEIC) signatures itself and leaves the rest
+// to http.DetectContentType, which doesn't recognize JPEG XL or HEIF.
+func detectContentType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, jxlCodestream), bytes.HasPrefix(header, jxlContainer):
+		return "image/jxl"
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return "image/webp"
+	}
+	if brands := ftypBrands(header); len(brands) > 0 {
+		switch {
+		case slices.Contains(brands, "avif"), slices.Contains(brands, "avis"):
+			return "image/avif"
+		case slices.ContainsFunc(brands, func(b string) bool { return slices.Contains(heicBrands, b) }):
+			return "image/heic"
+		case slices.Contains(brands, "mif1"), slices.Contains(brands, "msf1"):
+			return "image/heif"
+		}
+	}
+	return http.DetectContentType(header)
 }
 
-var allowedMimeTypes = map[string]bool{
-	"image/png":  true,
-	"image/jpeg": true,
-	"image/jxl":  true,
-	"image/webp": true,
+// ftypBrands returns the major and compatible brands of an ISO BMFF file's
+// leading ftyp box, or nil when the header doesn't start with one
+func ftypBrands(header []byte) []string {
+	if len(header) < 16 || string(header[4:8]) != "ftyp" {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint32(header))
+	if size < 16 || size > len(header) {
+		size = len(header)
+	}
+	brands := []string{string(header[8:12])}
+	// Skip the minor version after the major brand
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(header[i:i+4]))
+	}
+	return brands
 }
 
+const (
+	maxTitleLength       = 100
+	maxDescriptionLength = 1000
+)
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
 type UploadResponse struct {
-	Success      bool   `json:"success"`
-	Message      string `json:"message"`
-	Filename     string `json:"filename,omitempty"`
-	UploadCount  int    `json:"upload_count,omitempty"`
-	CooldownSecs int    `json:"cooldown_seconds,omitempty"`
+	Success      bool               `json:"success"`
+	Code         string             `json:"code,omitempty"`
+	Message      string             `json:"message"`
+	Filename     string             `json:"filename,omitempty"`
+	UploadCount  int                `json:"upload_count,omitempty"`
+	CooldownSecs int                `json:"cooldown_seconds,omitempty"`
+	Rule         string             `json:"rule,omitempty"`
+	DuplicateOf  int64              `json:"duplicate_of,omitempty"`
+	Duplicate    *DuplicateResponse `json:"duplicate,omitempty"`
+	NextUploadAt string             `json:"next_upload_at,omitempty"`
+	Warnings     []string           `json:"warnings,omitempty"`
+	Quota        *UploadQuota       `json:"quota,omitempty"`
+	Queue        *QueueResponse     `json:"queue,omitempty"`
 }
 
 // UploadHandler handles image uploads
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		log.Printf("Invalid upload attempt with method %s from IP: %s", r.Method, r.RemoteAddr)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		respondError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
@@ -52,47 +139,68 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	if discordID == "" {
 		log.Printf("Upload attempt without authentication from IP: %s", r.RemoteAddr)
-		respondJSON(w, http.StatusUnauthorized, UploadResponse{
-			Success: false,
-			Message: "Not authenticated",
-		})
+		respondError(w, http.StatusUnauthorized, "Not authenticated")
 		return
 	}
 
 	log.Printf("Upload attempt by user %s (ID: %s) from IP: %s", username, discordID, r.RemoteAddr)
 
 	// Get user from database
-	user, err := models.GetOrCreateUser(discordID, middleware.GetUsername(r))
+	user, err := models.GetOrCreateUser(r.Context(), discordID, middleware.GetUsername(r))
 	if err != nil {
 		log.Printf("Failed to get user: %v", err)
-		respondJSON(w, http.StatusInternalServerError, UploadResponse{
-			Success: false,
-			Message: "Failed to get user information",
-		})
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
 		return
 	}
 
-	// Check rate limit
-	canUpload, cooldown := user.CanUpload(config.AppConfig.UploadCooldownMinutes)
-	if !canUpload {
-		log.Printf("Upload denied for user %s (ID: %s): rate limit exceeded, cooldown: %v", username, discordID, cooldown)
-		respondJSON(w, http.StatusTooManyRequests, UploadResponse{
-			Success:      false,
-			Message:      fmt.Sprintf("Please wait %s before uploading again", formatDuration(cooldown)),
-			CooldownSecs: int(cooldown.Seconds()),
-		})
+	retryKey, ok := uploadRetryKey(w, r)
+	if !ok {
+		return
+	}
+	// A retry of an upload that was stored gets the original result, rather
+	// than the cooldown the upload started
+	if retryKey != "" && replayUpload(w, r, user, username, retryKey) {
 		return
 	}
 
+	if !admitUpload(w, r, user, username) {
+		return
+	}
+	defer limiter.release(discordID)
+
+	progress := trackUploadProgress(r)
+	defer progress.finish()
+
 	// Parse multipart form with max memory
-	maxSize := int64(config.AppConfig.MaxFileSizeMB * 1024 * 1024)
+	maxMB := maxFileSizeMB(user)
+	maxSize := int64(maxMB) * 1024 * 1024
 	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 	if err := r.ParseMultipartForm(maxSize); err != nil {
-		log.Printf("Upload failed for user %s (ID: %s): file too large (max %dMB)", username, discordID, config.AppConfig.MaxFileSizeMB)
-		respondJSON(w, http.StatusBadRequest, UploadResponse{
-			Success: false,
-			Message: fmt.Sprintf("File too large (max %dMB)", config.AppConfig.MaxFileSizeMB),
-		})
+		log.Printf("Upload failed for user %s (ID: %s): file too large (max %dMB)", username, discordID, maxMB)
+		apiError(w, http.StatusBadRequest, codeFileTooLarge, fmt.Sprintf("File too large (max %dMB)", maxMB))
+		return
+	}
+	progress.setStatus(progressProcessing)
+
+	// Validate optional tags (comma-separated), title and description
+	title, description, tags, err := validateUploadMetadata(r.FormValue("title"), r.FormValue("description"), strings.Split(r.FormValue("tags"), ","))
+	if err != nil {
+		log.Printf("Upload failed for user %s (ID: %s): invalid metadata - %v", username, discordID, err)
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	license, err := models.NormalizeLicense(r.FormValue("license"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visibility, err := models.NormalizeVisibility(r.FormValue("visibility"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	force, ok := forceUpload(w, r)
+	if !ok {
 		return
 	}
 
@@ -100,50 +208,651 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	file, header, err := r.FormFile("wallpaper")
 	if err != nil {
 		log.Printf("Upload failed for user %s (ID: %s): no file provided - %v", username, discordID, err)
-		respondJSON(w, http.StatusBadRequest, UploadResponse{
-			Success: false,
-			Message: "No file provided",
-		})
+		respondError(w, http.StatusBadRequest, "No file provided")
 		return
 	}
 	defer file.Close()
 
-	// Validate file extension
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	if !allowedExtensions[ext] {
-		log.Printf("Upload failed for user %s (ID: %s): invalid file extension '%s' for file '%s'", username, discordID, ext, header.Filename)
-		respondJSON(w, http.StatusBadRequest, UploadResponse{
-			Success: false,
-			Message: "Invalid file type. Allowed: png, jpg, jpeg, jxl, webp",
+	upload, uerr := storeUpload(user, username, uploadInput{
+		ctx:         r.Context(),
+		file:        file,
+		filename:    header.Filename,
+		title:       title,
+		description: description,
+		tags:        tags,
+		license:     license,
+		visibility:  visibility,
+		guildID:     middleware.GetGuildID(r),
+		source:      models.SourceWeb,
+		limits:      uploadLimits(user),
+		force:       force,
+		retryKey:    retryKey,
+	})
+	if uerr != nil {
+		// A retry sent while the original request was still running is
+		// refused once the original is recorded
+		if retryKey != "" && replayUpload(w, r, user, username, retryKey) {
+			return
+		}
+		respondUploadError(w, r, uerr)
+		return
+	}
+
+	respondUploaded(w, r, user, username, upload)
+}
+
+// Longest Idempotency-Key accepted with an upload
+const maxRetryKeyLength = 255
+
+// uploadRetryKey reads the optional Idempotency-Key header a client sends to
+// mark retries of the same upload, responding with 400 and returning false
+// if it is malformed
+func uploadRetryKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	valid := len(key) <= maxRetryKeyLength
+	for i := 0; i < len(key) && valid; i++ {
+		valid = key[i] > ' ' && key[i] < 0x7f
+	}
+	if !valid {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d printable ASCII characters", maxRetryKeyLength))
+		return "", false
+	}
+	return key, true
+}
+
+// replayUpload answers a retried upload request with the upload made by the
+// original request, returning false if there is none and the upload should
+// go ahead
+func replayUpload(w http.ResponseWriter, r *http.Request, user *models.User, username, retryKey string) bool {
+	upload, err := models.FindRetriedUpload(r.Context(), user.DiscordID, retryKey)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		log.Printf("Failed to look up upload retry of user %s (ID: %s): %v", username, user.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to check for an earlier upload")
+		return true
+	}
+
+	log.Printf("Upload retry by user %s (ID: %s) answered with their upload %d", username, user.DiscordID, upload.ID)
+	uploadCount, _ := models.GetUserUploadCount(r.Context(), user.DiscordID)
+	w.Header().Set("Idempotent-Replayed", "true")
+	writeUploaded(w, r, user, username, upload, uploadCount, 0)
+	return true
+}
+
+// admitUpload checks there is disk space and the user's rate limit, and
+// reserves a concurrent upload slot, responding with the reason when the
+// upload can't proceed. Callers that get true must release the slot.
+func admitUpload(w http.ResponseWriter, r *http.Request, user *models.User, username string) bool {
+	discordID := user.DiscordID
+
+	if refuseLowDisk(w, username, discordID) {
+		return false
+	}
+
+	// Check the cooldown and quotas
+	quota, err := uploadQuota(r.Context(), user, 0)
+	if err != nil {
+		log.Printf("Failed to get upload quota for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to check upload quota")
+		return false
+	}
+	setQuotaHeaders(w, quota)
+	if !quota.CanUpload {
+		uploadRejections.Inc("quota")
+		log.Printf("Upload denied for user %s (ID: %s): %s", username, discordID, quota.reason)
+		respondJSON(w, http.StatusTooManyRequests, UploadResponse{
+			Success:      false,
+			Code:         codeUploadLimitReached,
+			Message:      quota.reason,
+			CooldownSecs: quota.CooldownSecs,
+			NextUploadAt: quota.NextUploadAt,
+			Quota:        &quota,
+		})
+		return false
+	}
+
+	// Bound concurrent uploads so bursts can't exhaust disk I/O and memory
+	if !limiter.acquire(discordID) {
+		uploadRejections.Inc("busy")
+		log.Printf("Upload deferred for user %s (ID: %s): concurrent upload limit reached", username, discordID)
+		w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfterSeconds))
+		respondJSON(w, http.StatusServiceUnavailable, UploadResponse{
+			Success:      false,
+			Code:         codeServerBusy,
+			Message:      "The server is busy processing other uploads, please try again shortly",
+			CooldownSecs: uploadRetryAfterSeconds,
 		})
+		return false
+	}
+
+	return true
+}
+
+// lowDiskMessage refuses uploads while the server is short of disk space
+const lowDiskMessage = "The server is running out of disk space, so uploads are paused. Please try again later"
+
+// refuseLowDisk answers 507 and returns true while a volume the server writes
+// to is below disk_space.min_free_mb, before any of the upload is stored
+func refuseLowDisk(w http.ResponseWriter, username, discordID string) bool {
+	if !diskspace.Low() {
+		return false
+	}
+	uploadRejections.Inc("disk_space")
+	respondLowDisk(w, username, discordID)
+	return true
+}
+
+// respondLowDisk refuses an upload for low disk space without counting the
+// rejection, for callers that count it themselves
+func respondLowDisk(w http.ResponseWriter, username, discordID string) {
+	log.Printf("Upload refused for user %s (ID: %s): disk space is low", username, discordID)
+	apiError(w, http.StatusInsufficientStorage, codeInsufficientStorage, lowDiskMessage)
+}
+
+// validateUploadMetadata sanitizes and checks the optional title, description
+// and tags of an upload. Errors are suitable for showing to the user.
+func validateUploadMetadata(title, description string, rawTags []string) (string, string, []string, error) {
+	tags, err := models.NormalizeTags(rawTags)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	title = sanitizeText(title)
+	description = sanitizeText(description)
+	if utf8.RuneCountInString(title) > maxTitleLength || utf8.RuneCountInString(description) > maxDescriptionLength {
+		return "", "", nil, fmt.Errorf("Title must be at most %d characters and description at most %d characters", maxTitleLength, maxDescriptionLength)
+	}
+	return title, description, tags, nil
+}
+
+// DuplicateResponse is the existing wallpaper an upload was refused as a
+// duplicate of
+type DuplicateResponse struct {
+	ID           int64  `json:"id"`
+	Title        string `json:"title"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	UploaderID   string `json:"uploader_id"`
+	UploaderName string `json:"uploader_name"`
+}
+
+// duplicateResponse describes the wallpaper an upload duplicates, or returns
+// nil when there is none or the user may not see it, such as when it is
+// someone else's private upload
+func duplicateResponse(r *http.Request, uploadID int64) *DuplicateResponse {
+	if uploadID == 0 {
+		return nil
+	}
+	upload, err := models.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to get duplicated upload %d: %v", uploadID, err)
+		}
+		return nil
+	}
+	if !config.AppConfig.IsAdmin(middleware.GetRealDiscordID(r)) && upload.DiscordID != middleware.GetDiscordID(r) &&
+		(upload.Frozen || upload.DeletedAt.Valid || upload.ReportHidden || upload.SafetyStatus == models.SafetyPending ||
+			upload.Visibility == models.VisibilityPrivate || upload.GuildID != middleware.GetGuildID(r)) {
+		return nil
+	}
+	return &DuplicateResponse{
+		ID:           upload.ID,
+		Title:        upload.Title,
+		ThumbnailURL: thumbnailURL(r, upload.ID),
+		UploaderID:   upload.DiscordID,
+		UploaderName: upload.UploaderName,
+	}
+}
+
+// id returns the ID of the duplicated wallpaper, or 0 when there is none or
+// the user may not see it, so duplicate_of doesn't reveal private or trashed
+// uploads
+func (d *DuplicateResponse) id() int64 {
+	if d == nil {
+		return 0
+	}
+	return d.ID
+}
+
+// forceUpload reads the force parameter, which lets admins store uploads
+// the duplicate check would refuse. It responds with 403 and returns false
+// for anyone else asking for it.
+func forceUpload(w http.ResponseWriter, r *http.Request) (force, ok bool) {
+	if r.FormValue("force") != "true" {
+		return false, true
+	}
+	if !config.AppConfig.IsAdmin(middleware.GetRealDiscordID(r)) {
+		respondError(w, http.StatusForbidden, "Only admins can force an upload past the duplicate check")
+		return false, false
+	}
+	return true, true
+}
+
+// respondUploadError reports a rejected or failed upload to the client
+func respondUploadError(w http.ResponseWriter, r *http.Request, uerr *uploadError) {
+	if uerr.status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfterSeconds))
+	}
+	duplicate := duplicateResponse(r, uerr.duplicateOf)
+	respondJSON(w, uerr.status, UploadResponse{
+		Success:      false,
+		Code:         uerr.code(),
+		Message:      uerr.message,
+		Rule:         uerr.rule,
+		DuplicateOf:  duplicate.id(),
+		Duplicate:    duplicate,
+		CooldownSecs: uerr.retryAfter,
+	})
+}
+
+// respondUploaded records the upload in the audit log and reports it to the
+// client along with the allowance left
+func respondUploaded(w http.ResponseWriter, r *http.Request, user *models.User, username string, upload *models.Upload) {
+	discordID := user.DiscordID
+
+	// Get total upload count
+	uploadCount, _ := models.GetUserUploadCount(r.Context(), discordID)
+
+	log.Printf("Upload successful: user %s (ID: %s) uploaded '%s' as '%s', size: %d bytes, total uploads: %d",
+		username, discordID, upload.OriginalFilename, upload.Filename, upload.FileSize, uploadCount)
+	recordAudit(r, middleware.GetRealDiscordID(r), models.AuditUpload, uploadTarget(upload.ID), upload.OriginalFilename)
+	notifyUploaded(r, upload, username)
+	gacha.QueueAchievementCheck(upload.DiscordID)
+	gacha.RewardUploaded(r.Context(), upload)
+	writeUploaded(w, r, user, username, upload, uploadCount, 1)
+}
+
+// writeUploaded reports a stored upload to the client along with the
+// allowance left. holding is the number of upload slots the request holds.
+func writeUploaded(w http.ResponseWriter, r *http.Request, user *models.User, username string, upload *models.Upload, uploadCount, holding int) {
+	discordID := user.DiscordID
+
+	// Report the allowance left after this upload
+	quota, err := uploadQuota(r.Context(), user, holding)
+	if err != nil {
+		log.Printf("Warning: Failed to get upload quota for user %s (ID: %s): %v", username, discordID, err)
+	}
+	setQuotaHeaders(w, quota)
+
+	// Tell the uploader how long the content check is likely to take
+	queue, err := uploadQueue(r.Context(), upload)
+	if err != nil {
+		log.Printf("Warning: Failed to get queue position of upload %d: %v", upload.ID, err)
+	}
+
+	respondJSON(w, http.StatusOK, UploadResponse{
+		Success:      true,
+		Message:      uploadedMessage(upload),
+		Filename:     upload.Filename,
+		UploadCount:  uploadCount,
+		DuplicateOf:  duplicateResponse(r, upload.DuplicateOf.Int64).id(),
+		CooldownSecs: quota.CooldownSecs,
+		NextUploadAt: quota.NextUploadAt,
+		Warnings:     quota.Warnings,
+		Queue:        queue,
+	})
+}
+
+// uploadedMessage tells the uploader their upload was stored, and whether it
+// still has to pass the content safety check before it is shown
+func uploadedMessage(upload *models.Upload) string {
+	if upload.SafetyStatus == models.SafetyPending {
+		if upload.Visibility != models.VisibilityPublic {
+			return "Upload successful! It will be available once it has passed the content check."
+		}
+		return "Upload successful! It will appear in the gallery once it has passed the content check."
+	}
+	return "Upload successful!"
+}
+
+// notifyUploaded queues the upload.created webhook for a new public upload
+// and announces it on the live feed. Uploads waiting for the content safety check
+// are queued for it instead and announced once they pass.
+func notifyUploaded(r *http.Request, upload *models.Upload, username string) {
+	if upload.SafetyStatus == models.SafetyPending {
+		safety.Queue(upload.ID)
 		return
 	}
+	u := *upload
+	u.UploaderName = username
+	// Announcements reach everyone, so they can't carry content URLs signed
+	// for the uploader
+	announceUpload(wallpaperResponse(u, config.AppConfig.IsAdmin(middleware.GetRealDiscordID(r))))
+}
+
+// AnnounceUpload queues the upload.approved and upload.created webhooks for
+// an upload that has just passed the content safety check or been approved
+// by an admin, announces it on the live feed and tells the uploader
+func AnnounceUpload(upload *models.Upload) {
+	resp := wallpaperResponse(*upload, false)
+	if resp.Visibility == models.VisibilityPublic {
+		webhooks.Notify(webhooks.EventUploadApproved, resp)
+	}
+	announceUpload(resp)
+	notify.UploadApproved(upload)
+}
+
+// announceUpload publishes a new upload, unless it is unlisted or private
+func announceUpload(resp WallpaperResponse) {
+	if resp.Visibility != models.VisibilityPublic {
+		return
+	}
+	webhooks.Notify(webhooks.EventUploadCreated, resp)
+	live.Publish(resp.GuildID, live.EventUploadCreated, resp)
+}
+
+// uploadInput is one image to run through the upload pipeline
+type uploadInput struct {
+	// ctx carries the trace the upload's spans belong to
+	ctx         context.Context
+	file        io.ReadSeeker
+	filename    string
+	title       string
+	description string
+	tags        []string
+	license     string
+	visibility  string
+	guildID     string
+	source      string
+	externalID  sql.NullString
+	// rarity is the tier given by an import; uploads are otherwise common
+	rarity string
+	// retryKey is the client's Idempotency-Key, stored with the upload so
+	// retries of the request find it
+	retryKey string
+	// limits are the rate limits the upload is recorded under, checked again
+	// as it is recorded; imports have none
+	limits *models.UploadLimits
+	// force stores an admin's upload that the duplicate check would refuse,
+	// flagged as a duplicate instead
+	force bool
+}
+
+// uploadError is a rejected or failed upload with the status and message to
+// report to the client
+type uploadError struct {
+	status      int
+	message     string
+	reason      string // metrics label for rejected uploads
+	rule        string // name of the upload rule that refused the upload
+	duplicateOf int64
+	retryAfter  int
+}
+
+var (
+	uploadSizes = metrics.NewHistogramVec("upload_size_bytes",
+		"Size of stored uploads, by source", metrics.SizeBuckets, "source")
+	uploadRejections = metrics.NewCounterVec("upload_rejections_total",
+		"Uploads refused, by reason", "reason")
+)
+
+// storeUpload validates, analyzes and stores a single image for the user and
+// records it in the database. Rate limits and concurrency slots are the
+// caller's responsibility.
+func storeUpload(user *models.User, username string, in uploadInput) (*models.Upload, *uploadError) {
+	ctx, span := tracing.StartSpan(in.ctx, "upload", tracing.KindInternal)
+	defer span.End()
+	span.SetAttribute("upload.source", in.source)
+	in.ctx = ctx
+
+	upload, uerr := processUpload(user, username, in)
+	if uerr != nil {
+		reason := uerr.reason
+		if reason == "" {
+			reason = "error"
+			if uerr.status == http.StatusServiceUnavailable {
+				reason = "busy"
+			}
+		}
+		uploadRejections.Inc(reason)
+		span.SetAttribute("upload.rejection", reason)
+		span.SetError(errors.New(uerr.message))
+		return nil, uerr
+	}
+	uploadSizes.Observe(float64(upload.FileSize), in.source)
+	span.SetAttribute("upload.id", upload.ID)
+	span.SetAttribute("upload.size", upload.FileSize)
+	return upload, nil
+}
+
+// uploadStage starts the span for one step of processUpload, so a slow upload
+// shows whether the time went to the disk, the database or image work.
+// Callers must End it.
+func uploadStage(in uploadInput, name string) *tracing.Span {
+	_, span := tracing.StartSpan(in.ctx, "upload."+name, tracing.KindInternal)
+	return span
+}
+
+func processUpload(user *models.User, username string, in uploadInput) (*models.Upload, *uploadError) {
+	discordID := user.DiscordID
+
+	// Checked again here for imports, and for uploads whose space ran out
+	// while they were sent
+	if diskspace.Low() {
+		log.Printf("Upload refused for user %s (ID: %s): disk space is low", username, discordID)
+		return nil, &uploadError{status: http.StatusInsufficientStorage, reason: "disk_space", message: lowDiskMessage}
+	}
 
 	// Read first 512 bytes to detect content type
 	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
+	n, err := in.file.Read(buffer)
 	if err != nil {
-		log.Printf("Upload failed for user %s (ID: %s): failed to read file '%s' - %v", username, discordID, header.Filename, err)
-		respondJSON(w, http.StatusInternalServerError, UploadResponse{
-			Success: false,
-			Message: "Failed to read file",
-		})
-		return
+		log.Printf("Upload failed for user %s (ID: %s): failed to read file '%s' - %v", username, discordID, in.filename, err)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to read file"}
 	}
+	contentType := detectContentType(buffer[:n])
+	size, _ := in.file.Seek(0, io.SeekEnd)
 
 	// Reset file pointer
-	file.Seek(0, 0)
-
-	// Validate MIME type
-	contentType := http.DetectContentType(buffer)
-	// JXL might not be detected properly, so we allow it if extension is .jxl
-	if !allowedMimeTypes[contentType] && ext != ".jxl" {
-		log.Printf("Upload failed for user %s (ID: %s): invalid MIME type '%s' for file '%s'", username, discordID, contentType, header.Filename)
-		respondJSON(w, http.StatusBadRequest, UploadResponse{
-			Success: false,
-			Message: "Invalid file content type",
+	in.file.Seek(0, io.SeekStart)
+
+	// Read the dimensions from the header before anything decodes the pixels,
+	// so a small file claiming a huge image can't exhaust memory
+	if cfg, _, err := image.DecodeConfig(in.file); err == nil {
+		if limit := config.AppConfig.MaxImagePixels; int64(cfg.Width)*int64(cfg.Height) > int64(limit) {
+			log.Printf("Upload rejected for user %s (ID: %s): '%s' is %dx%d, more than %d pixels", username, discordID, in.filename, cfg.Width, cfg.Height, limit)
+			return nil, &uploadError{
+				status:  http.StatusBadRequest,
+				message: fmt.Sprintf("Image must have at most %d pixels; this one is %dx%d", limit, cfg.Width, cfg.Height),
+				reason:  "resolution",
+			}
+		}
+	}
+	in.file.Seek(0, io.SeekStart)
+
+	// Operator checks see the upload before any of ours
+	hook := &hooks.Upload{
+		DiscordID:   discordID,
+		Username:    username,
+		Source:      in.source,
+		Filename:    in.filename,
+		Title:       in.title,
+		Description: in.description,
+		Tags:        in.tags,
+		License:     in.license,
+		ContentType: contentType,
+		Size:        size,
+		Image:       in.file,
+	}
+	if uerr := runHooks(in.ctx, hooks.PreValidate, hook); uerr != nil {
+		return nil, uerr
+	}
+
+	// Validate file extension
+	ext := strings.ToLower(filepath.Ext(in.filename))
+	contentTypes, ok := config.AppConfig.UploadFormats[ext]
+	if !ok {
+		log.Printf("Upload failed for user %s (ID: %s): invalid file extension '%s' for file '%s'", username, discordID, ext, in.filename)
+		return nil, &uploadError{status: http.StatusBadRequest, message: invalidFileTypeMessage(), reason: "extension"}
+	}
+
+	// The content must be the format its extension claims
+	if !slices.Contains(contentTypes, contentType) {
+		log.Printf("Upload failed for user %s (ID: %s): content type '%s' does not match extension '%s' for file '%s'", username, discordID, contentType, ext, in.filename)
+		if slices.Contains(slices.Concat(slices.Collect(maps.Values(config.AppConfig.UploadFormats))...), contentType) {
+			return nil, &uploadError{
+				status:  http.StatusBadRequest,
+				message: fmt.Sprintf("File content doesn't match its %s extension (it looks like %s)", ext, contentType),
+				reason:  "content_mismatch",
+			}
+		}
+		return nil, &uploadError{status: http.StatusBadRequest, message: "Invalid file content type", reason: "content_type"}
+	}
+
+	// Admins' upload rules judge the name and tags now, and the size once the
+	// image is decoded
+	rules, err := activeUploadRules(in.ctx)
+	if err != nil {
+		log.Printf("Upload failed for user %s (ID: %s): failed to list upload rules - %v", username, discordID, err)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to check upload rules"}
+	}
+	ruleSubject := uploadRuleSubject{discordID: discordID, guildID: in.guildID, filename: in.filename, tags: in.tags}
+	if uerr := checkUploadRules(in.ctx, rules, ruleSubject, false); uerr != nil {
+		return nil, uerr
+	}
+
+	// The file must fit in what is left of the user's storage quota
+	span := uploadStage(in, "check_quota")
+	uerr := checkStorageRoom(in.ctx, discordID, username, in.filename, size)
+	span.End()
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	// Scan the file as uploaded, before any of our image code touches it
+	if clamav.Enabled() {
+		if uerr := scanForMalware(user, username, in); uerr != nil {
+			return nil, uerr
+		}
+	}
+
+	// Strip location and camera details from JPEGs before anything else sees
+	// the pixels, turning rotated photos upright
+	if contentType == "image/jpeg" {
+		span := uploadStage(in, "clean_jpeg")
+		data, err := io.ReadAll(in.file)
+		if err != nil {
+			span.SetError(err)
+			span.End()
+			log.Printf("Upload failed for user %s (ID: %s): failed to read file '%s' - %v", username, discordID, in.filename, err)
+			return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to read file"}
+		}
+		var cleaned []byte
+		err = processing.Run(func() error {
+			var err error
+			cleaned, err = imaging.CleanJPEG(data)
+			return err
 		})
-		return
+		span.SetError(err)
+		span.End()
+		if err == processing.ErrBusy {
+			return nil, processingBusy(username, discordID)
+		} else if err != nil {
+			log.Printf("Upload failed for user %s (ID: %s): could not clean JPEG '%s' - %v", username, discordID, in.filename, err)
+			return nil, &uploadError{status: http.StatusBadRequest, message: "Invalid or corrupt JPEG file", reason: "corrupt"}
+		}
+		in.file = bytes.NewReader(cleaned)
+		hook.Image = in.file
+		hook.Size = int64(len(cleaned))
+	}
+
+	// Decode once for the perceptual hash, the placeholder, the palette and
+	// the quality score. Formats without a decoder (e.g. JXL) are stored
+	// without them.
+	var analyzed bool
+	var blurHash string
+	var palette []string
+	var hash uint64
+	var width, height int
+	var quality *imaging.Quality
+	span = uploadStage(in, "analyze")
+	err = processing.Run(func() error {
+		img, _, err := image.Decode(in.file)
+		if err != nil {
+			return err
+		}
+		analyzed = true
+		width, height = img.Bounds().Dx(), img.Bounds().Dy()
+		blurHash = imaging.BlurHash(img)
+		palette = imaging.Palette(img)
+		hash = imaging.DifferenceHashImage(img)
+		if config.AppConfig.QualityCheck.Enabled {
+			q := imaging.AssessQuality(img)
+			quality = &q
+		}
+		return nil
+	})
+	in.file.Seek(0, io.SeekStart)
+	span.SetAttribute("image.analyzed", analyzed)
+	span.End()
+	if err == processing.ErrBusy {
+		return nil, processingBusy(username, discordID)
+	} else if err != nil {
+		log.Printf("Skipping image analysis for user %s (ID: %s), file '%s': %v", username, discordID, in.filename, err)
+	}
+
+	// Enforce the minimum resolution and allowed shapes; files we can't
+	// decode have no known size and are let through
+	if analyzed {
+		var short string
+		if width < config.AppConfig.MinWidth {
+			short = fmt.Sprintf("at least %d pixels wide", config.AppConfig.MinWidth)
+		} else if height < config.AppConfig.MinHeight {
+			short = fmt.Sprintf("at least %d pixels tall", config.AppConfig.MinHeight)
+		}
+		if short != "" {
+			log.Printf("Upload rejected for user %s (ID: %s): '%s' is %dx%d, not %s", username, discordID, in.filename, width, height, short)
+			return nil, &uploadError{
+				status:  http.StatusBadRequest,
+				message: fmt.Sprintf("Image must be %s; this one is %dx%d", short, width, height),
+				reason:  "resolution",
+			}
+		}
+		if !config.AppConfig.AspectRatioAllowed(width, height) {
+			log.Printf("Upload rejected for user %s (ID: %s): '%s' is %dx%d, not an allowed aspect ratio", username, discordID, in.filename, width, height)
+			return nil, &uploadError{
+				status: http.StatusBadRequest,
+				message: fmt.Sprintf("Images of %dx%d don't have an allowed aspect ratio. Allowed: %s",
+					width, height, strings.Join(config.AppConfig.AllowedAspectRatios, ", ")),
+				reason: "aspect_ratio",
+			}
+		}
+		ruleSubject.width, ruleSubject.height = width, height
+		if uerr := checkUploadRules(in.ctx, rules, ruleSubject, true); uerr != nil {
+			return nil, uerr
+		}
+	}
+
+	// Check for near-duplicates of existing wallpapers
+	var phash, duplicateOf sql.NullInt64
+	if config.AppConfig.DuplicateAction != "off" && analyzed {
+		phash = sql.NullInt64{Int64: int64(hash), Valid: true}
+
+		span := uploadStage(in, "find_duplicates")
+		similar, err := models.FindSimilarUpload(in.ctx, hash, config.AppConfig.DuplicateHashDistance, in.guildID)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			log.Printf("Upload failed for user %s (ID: %s): failed to check for duplicates - %v", username, discordID, err)
+			return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to check for duplicates"}
+		}
+
+		if similar != nil {
+			if config.AppConfig.DuplicateAction == "reject" && !in.force {
+				log.Printf("Upload rejected for user %s (ID: %s): '%s' is a near-duplicate of upload %d (distance %d)",
+					username, discordID, in.filename, similar.UploadID, similar.Distance)
+				return nil, &uploadError{
+					status:      http.StatusConflict,
+					message:     "This wallpaper is too similar to an existing upload",
+					duplicateOf: similar.UploadID,
+					reason:      "duplicate",
+				}
+			}
+
+			log.Printf("Upload flagged for user %s (ID: %s): '%s' is a near-duplicate of upload %d (distance %d)",
+				username, discordID, in.filename, similar.UploadID, similar.Distance)
+			duplicateOf = sql.NullInt64{Int64: similar.UploadID, Valid: true}
+		}
 	}
 
 	// Generate unique filename
@@ -151,14 +860,12 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	newFilename := uniqueID + ext
 
 	// Create upload directory if it doesn't exist
+	span = uploadStage(in, "write_file")
+	defer span.End()
 	uploadDir := config.AppConfig.UploadDirectory
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		log.Printf("Upload failed for user %s (ID: %s): failed to create upload directory - %v", username, discordID, err)
-		respondJSON(w, http.StatusInternalServerError, UploadResponse{
-			Success: false,
-			Message: "Failed to create upload directory",
-		})
-		return
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to create upload directory"}
 	}
 
 	// Save the file
@@ -166,60 +873,313 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	destFile, err := os.Create(destPath)
 	if err != nil {
 		log.Printf("Upload failed for user %s (ID: %s): failed to create destination file - %v", username, discordID, err)
-		respondJSON(w, http.StatusInternalServerError, UploadResponse{
-			Success: false,
-			Message: "Failed to save file",
-		})
-		return
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to save file"}
 	}
 	defer destFile.Close()
 
-	// Copy file contents
-	written, err := io.Copy(destFile, file)
+	// Copy file contents, hashing them on the way
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(destFile, hasher), in.file)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		log.Printf("Upload failed for user %s (ID: %s): failed to copy file - %v", username, discordID, err)
 		os.Remove(destPath) // Clean up partial file
-		respondJSON(w, http.StatusInternalServerError, UploadResponse{
-			Success: false,
-			Message: "Failed to save file",
-		})
-		return
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to save file"}
+	}
+
+	// Check for exact copies of existing wallpapers, which also catches
+	// formats the near-duplicate check can't decode
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+	if config.AppConfig.DuplicateAction != "off" && !duplicateOf.Valid {
+		identical, err := models.FindIdenticalUpload(in.ctx, contentHash, in.guildID)
+		if err != nil {
+			log.Printf("Upload failed for user %s (ID: %s): failed to check for duplicates - %v", username, discordID, err)
+			os.Remove(destPath)
+			return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to check for duplicates"}
+		}
+		if identical != 0 {
+			if config.AppConfig.DuplicateAction == "reject" && !in.force {
+				log.Printf("Upload rejected for user %s (ID: %s): '%s' is identical to upload %d", username, discordID, in.filename, identical)
+				os.Remove(destPath)
+				return nil, &uploadError{
+					status:      http.StatusConflict,
+					message:     "This wallpaper has already been uploaded",
+					duplicateOf: identical,
+					reason:      "duplicate",
+				}
+			}
+			log.Printf("Upload flagged for user %s (ID: %s): '%s' is identical to upload %d", username, discordID, in.filename, identical)
+			duplicateOf = sql.NullInt64{Int64: identical, Valid: true}
+		}
+	}
+
+	// Store identical content only once
+	span = uploadStage(in, "acquire_blob")
+	storedFilename, err := models.AcquireBlob(in.ctx, contentHash, newFilename, written)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("Upload failed for user %s (ID: %s): failed to register blob - %v", username, discordID, err)
+		os.Remove(destPath)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to save file"}
+	}
+	if storedFilename != newFilename {
+		log.Printf("Upload by user %s (ID: %s): '%s' matches existing blob %s, reusing stored file", username, discordID, in.filename, storedFilename)
+		os.Remove(destPath)
+		newFilename = storedFilename
+	}
+
+	hook.SHA256 = contentHash
+	hook.Width, hook.Height = width, height
+	if phash.Valid {
+		hook.PHash = fmt.Sprintf("%016x", uint64(phash.Int64))
+	}
+	hook.DuplicateOf = duplicateOf.Int64
+	if uerr := runHooks(in.ctx, hooks.PostStore, hook); uerr != nil {
+		releaseBlob(contentHash)
+		return nil, uerr
+	}
+	if uerr := runHooks(in.ctx, hooks.PreApprove, hook); uerr != nil {
+		releaseBlob(contentHash)
+		return nil, uerr
 	}
 
 	// Record upload in database
-	if err := models.CreateUpload(discordID, newFilename, header.Filename, written); err != nil {
+	upload := &models.Upload{
+		DiscordID:        discordID,
+		Filename:         newFilename,
+		OriginalFilename: in.filename,
+		Title:            in.title,
+		Description:      in.description,
+		FileSize:         written,
+		PHash:            phash,
+		DuplicateOf:      duplicateOf,
+		SHA256:           contentHash,
+		Source:           in.source,
+		ExternalID:       in.externalID,
+		RetryKey:         sql.NullString{String: in.retryKey, Valid: in.retryKey != ""},
+		BlurHash:         blurHash,
+		License:          in.license,
+		Visibility:       in.visibility,
+		GuildID:          in.guildID,
+		Width:            width,
+		Height:           height,
+		Rarity:           in.rarity,
+	}
+	if quality != nil {
+		upload.QualityScore = sql.NullInt64{Int64: int64(quality.Score), Valid: true}
+	}
+	// Users vote on the rarity of uploads an import didn't give one
+	if in.rarity == "" && config.AppConfig.RarityVotingHours > 0 {
+		upload.RarityVotingEndsAt = sql.NullTime{Time: time.Now().Add(time.Duration(config.AppConfig.RarityVotingHours) * time.Hour), Valid: true}
+	}
+	if safety.Enabled() {
+		upload.SafetyStatus = models.SafetyPending
+	}
+	span = uploadStage(in, "record")
+	defer span.End()
+	if in.limits != nil {
+		err = user.RecordUpload(in.ctx, upload, *in.limits)
+	} else {
+		err = models.CreateUpload(in.ctx, upload)
+	}
+	if errors.Is(err, models.ErrUploadCooldown) || errors.Is(err, models.ErrUploadDailyLimit) {
+		// Another upload by the user was recorded since the quota was checked
+		releaseBlob(contentHash)
+		return nil, uploadLimitReached(in.ctx, user, username)
+	} else if err != nil {
+		span.SetError(err)
 		log.Printf("Upload failed for user %s (ID: %s): failed to record upload in database - %v", username, discordID, err)
-		os.Remove(destPath) // Clean up file since DB record failed
-		respondJSON(w, http.StatusInternalServerError, UploadResponse{
-			Success: false,
-			Message: "Failed to record upload",
-		})
+		releaseBlob(contentHash) // Clean up file since DB record failed
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to record upload"}
+	}
+
+	if len(in.tags) > 0 {
+		if err := models.SetUploadTags(in.ctx, upload.ID, in.tags); err != nil {
+			log.Printf("Warning: Failed to tag upload %d for user %s (ID: %s): %v", upload.ID, username, discordID, err)
+		}
+	}
+	if len(palette) > 0 {
+		if err := models.SetUploadPalette(in.ctx, upload.ID, palette); err != nil {
+			log.Printf("Warning: Failed to store palette of upload %d for user %s (ID: %s): %v", upload.ID, username, discordID, err)
+		} else {
+			upload.Palette = palette
+		}
+	}
+	if quality != nil && quality.Score < config.AppConfig.QualityCheck.MinScore {
+		reportLowQuality(in.ctx, upload, *quality)
+	}
+
+	return upload, nil
+}
+
+// processingBusy is the error for an upload turned away because the image
+// processing queue is full
+func processingBusy(username, discordID string) *uploadError {
+	log.Printf("Upload deferred for user %s (ID: %s): image processing queue is full", username, discordID)
+	return &uploadError{
+		status:     http.StatusServiceUnavailable,
+		message:    "The server is busy processing other uploads, please try again shortly",
+		retryAfter: uploadRetryAfterSeconds,
+	}
+}
+
+// scanForMalware has clamd scan the upload. Infected files are refused and a
+// copy is kept in the quarantine directory for admins to inspect. When clamd
+// can't scan the file the upload is refused too, unless clamav.fail_open is
+// set.
+func scanForMalware(user *models.User, username string, in uploadInput) *uploadError {
+	span := uploadStage(in, "malware_scan")
+	signature, err := clamav.Scan(in.ctx, in.file)
+	in.file.Seek(0, io.SeekStart)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("Malware scan failed for '%s' by user %s (ID: %s): %v", in.filename, username, user.DiscordID, err)
+		if config.AppConfig.ClamAV.FailOpen {
+			return nil
+		}
+		return &uploadError{
+			status:     http.StatusServiceUnavailable,
+			message:    "Uploads can't be scanned for malware right now, please try again shortly",
+			reason:     "scan_unavailable",
+			retryAfter: uploadRetryAfterSeconds,
+		}
+	}
+	if signature == "" {
+		return nil
+	}
+
+	log.Printf("Upload rejected for user %s (ID: %s): '%s' matched malware signature %s", username, user.DiscordID, in.filename, signature)
+	quarantineUpload(user, username, in, signature)
+	return &uploadError{
+		status:  http.StatusUnprocessableEntity,
+		message: "This file was flagged by the malware scanner and can't be uploaded",
+		reason:  "malware",
+	}
+}
+
+// quarantineUpload keeps a copy of an infected upload for admins to inspect.
+// The copy gets no extension so nothing treats it as an image or a program.
+func quarantineUpload(user *models.User, username string, in uploadInput, signature string) {
+	defer in.file.Seek(0, io.SeekStart)
+
+	if err := os.MkdirAll(config.AppConfig.ClamAV.QuarantineDirectory, 0700); err != nil {
+		log.Printf("Failed to quarantine '%s' by user %s (ID: %s): %v", in.filename, username, user.DiscordID, err)
+		return
+	}
+	filename := uuid.New().String()
+	path := storage.QuarantinePath(filename)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to quarantine '%s' by user %s (ID: %s): %v", in.filename, username, user.DiscordID, err)
+		return
+	}
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(f, hasher), in.file)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Failed to quarantine '%s' by user %s (ID: %s): %v", in.filename, username, user.DiscordID, err)
+		os.Remove(path)
 		return
 	}
 
-	// Update user's last upload time
-	if err := user.UpdateLastUpload(); err != nil {
-		log.Printf("Warning: Failed to update last upload time for user %s (ID: %s): %v", username, discordID, err)
+	record := &models.QuarantinedFile{
+		DiscordID:        user.DiscordID,
+		OriginalFilename: in.filename,
+		Filename:         filename,
+		FileSize:         written,
+		SHA256:           hex.EncodeToString(hasher.Sum(nil)),
+		Signature:        signature,
+	}
+	if err := models.CreateQuarantinedFile(context.WithoutCancel(in.ctx), record); err != nil {
+		log.Printf("Failed to record quarantined file %s for user %s (ID: %s): %v", filename, username, user.DiscordID, err)
+		os.Remove(path)
+		return
 	}
+	log.Printf("Quarantined '%s' by user %s (ID: %s) as %d", in.filename, username, user.DiscordID, record.ID)
+}
 
-	// Get total upload count
-	uploadCount, _ := models.GetUserUploadCount(discordID)
+// checkStorageRoom refuses a file of the given size that would take the user
+// past their storage quota
+func checkStorageRoom(ctx context.Context, discordID, username, filename string, size int64) *uploadError {
+	limit := storageLimitBytes()
+	// Wallpapers imported for the site itself have no quota
+	if limit <= 0 || discordID == models.SystemUserID {
+		return nil
+	}
+	usage, err := models.GetStorageUsage(ctx, discordID)
+	if err != nil {
+		log.Printf("Upload failed for user %s (ID: %s): failed to check storage quota - %v", username, discordID, err)
+		return &uploadError{status: http.StatusInternalServerError, message: "Failed to check storage quota"}
+	}
+	used := usage.Bytes
+	if used+size > limit {
+		log.Printf("Upload rejected for user %s (ID: %s): '%s' (%d bytes) exceeds storage quota, %d of %d bytes used", username, discordID, filename, size, used, limit)
+		return &uploadError{
+			status:  http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("Not enough storage left: %s of your %s quota is free", formatBytes(max(limit-used, 0)), formatBytes(limit)),
+			reason:  "storage_quota",
+		}
+	}
+	return nil
+}
 
-	log.Printf("Upload successful: user %s (ID: %s) uploaded '%s' as '%s', size: %d bytes, total uploads: %d",
-		username, discordID, header.Filename, newFilename, written, uploadCount)
+// runHooks runs the upload hooks for a stage, turning a rejection or an
+// unavailable hook into the error reported to the uploader
+func runHooks(ctx context.Context, stage string, u *hooks.Upload) *uploadError {
+	err := hooks.Run(ctx, stage, u)
+	var rejection *hooks.Rejection
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &rejection):
+		return &uploadError{status: http.StatusUnprocessableEntity, message: rejection.Reason, reason: "hook_rejected"}
+	default:
+		log.Printf("Upload failed for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+		return &uploadError{
+			status:     http.StatusServiceUnavailable,
+			message:    "Upload checks are unavailable, please try again shortly",
+			retryAfter: uploadRetryAfterSeconds,
+		}
+	}
+}
 
-	respondJSON(w, http.StatusOK, UploadResponse{
-		Success:     true,
-		Message:     "Upload successful!",
-		Filename:    newFilename,
-		UploadCount: uploadCount,
-	})
+// sanitizeText strips HTML tags and control characters from user-supplied text
+func sanitizeText(s string) string {
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// releaseBlob drops a reference to stored content and deletes the file once
+// unreferenced. It runs after an upload failed, which may have been because
+// the request was cancelled, so it doesn't use the request's context.
+func releaseBlob(contentHash string) {
+	filename, err := models.ReleaseBlob(context.Background(), contentHash)
+	if err != nil {
+		log.Printf("Failed to release blob %s: %v", contentHash, err)
+		return
+	}
+	storage.Remove(filename)
 }
 
 func respondJSON(w http.ResponseWriter, status int, data UploadResponse) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
+	data.Message = middleware.Translate(w, data.Message)
+	data.Warnings = translateAll(w, data.Warnings)
+	data.Quota = data.Quota.localized(w)
+	writeJSON(w, status, data)
 }
 
 func formatDuration(d interface{}) string {
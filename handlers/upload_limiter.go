@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Seconds clients are asked to wait when the upload limiter is saturated
+const uploadRetryAfterSeconds = 10
+
+var (
+	uploadsInFlight = expvar.NewInt("uploads_in_flight")
+	uploadsRejected = expvar.NewInt("uploads_rejected_busy")
+)
+
+// uploadLimiter bounds the number of uploads processed at once, globally and per user
+type uploadLimiter struct {
+	mu         sync.Mutex
+	global     int
+	perUser    map[string]int
+	maxGlobal  int
+	maxPerUser int
+}
+
+var limiter *uploadLimiter
+
+// InitUploadLimiter configures the global and per-user concurrent upload limits
+func InitUploadLimiter(maxGlobal, maxPerUser int) {
+	limiter = &uploadLimiter{
+		perUser:    make(map[string]int),
+		maxGlobal:  maxGlobal,
+		maxPerUser: maxPerUser,
+	}
+}
+
+// acquire reserves an upload slot for the user without blocking. It returns
+// false when either the global or the user's limit is reached.
+func (l *uploadLimiter) acquire(discordID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.global >= l.maxGlobal || l.perUser[discordID] >= l.maxPerUser {
+		uploadsRejected.Add(1)
+		return false
+	}
+
+	l.global++
+	l.perUser[discordID]++
+	uploadsInFlight.Set(int64(l.global))
+	return true
+}
+
+// release frees a slot previously reserved with acquire
+func (l *uploadLimiter) release(discordID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.global--
+	if l.perUser[discordID] <= 1 {
+		delete(l.perUser, discordID)
+	} else {
+		l.perUser[discordID]--
+	}
+	uploadsInFlight.Set(int64(l.global))
+}
+
+// load reports the number of uploads in progress globally and for the user,
+// alongside the respective limits
+func (l *uploadLimiter) load(discordID string) (global, maxGlobal, user, maxPerUser int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.global, l.maxGlobal, l.perUser[discordID], l.maxPerUser
+}
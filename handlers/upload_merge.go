@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// ReassignUploadResponse is the owner an upload was, or with DryRun would be,
+// moved to
+type ReassignUploadResponse struct {
+	UploadID      int64  `json:"upload_id"`
+	PreviousOwner string `json:"previous_owner"`
+	Owner         string `json:"owner"`
+	DryRun        bool   `json:"dry_run"`
+}
+
+// MergeUploadResponse is what merging an upload into another moved, or with
+// DryRun would move
+type MergeUploadResponse struct {
+	UploadID   int64 `json:"upload_id"`
+	MergedInto int64 `json:"merged_into"`
+	DryRun     bool  `json:"dry_run"`
+	Pulls      int64 `json:"pulls"`
+	Likes      int64 `json:"likes"`
+	Wishlists  int64 `json:"wishlists"`
+	Showcases  int64 `json:"showcases"`
+	Banners    int64 `json:"banners"`
+	Seasons    int64 `json:"seasons"`
+	Trades     int64 `json:"trades"`
+	Tags       int64 `json:"tags"`
+}
+
+// AdminReassignUploadHandler transfers an upload to another user, who must
+// have signed in before. With dry_run the transfer is only checked.
+func AdminReassignUploadHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	var body struct {
+		DiscordID string `json:"discord_id"`
+		DryRun    bool   `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.DiscordID == "" {
+		respondError(w, http.StatusBadRequest, "discord_id is required")
+		return
+	}
+
+	previous, err := models.ReassignUpload(r.Context(), uploadID, body.DiscordID, body.DryRun)
+	switch {
+	case err == sql.ErrNoRows:
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	case errors.Is(err, models.ErrUnknownUser):
+		respondError(w, http.StatusNotFound, "No user with that Discord ID has signed in")
+		return
+	case errors.Is(err, models.ErrLinkedUser):
+		respondError(w, http.StatusConflict, "That user is linked to another account; give the upload to that account instead")
+		return
+	case err != nil:
+		log.Printf("Failed to reassign upload %d to user %s: %v", uploadID, body.DiscordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to reassign upload")
+		return
+	}
+
+	if !body.DryRun {
+		adminID := middleware.GetRealDiscordID(r)
+		log.Printf("Admin %s (ID: %s) reassigned upload %d from user %s to user %s", middleware.GetUsername(r), adminID, uploadID, previous, body.DiscordID)
+		recordAudit(r, adminID, models.AuditReassignUpload, uploadTarget(uploadID), fmt.Sprintf("from %s to %s", previous, body.DiscordID))
+	}
+	writeJSON(w, http.StatusOK, ReassignUploadResponse{UploadID: uploadID, PreviousOwner: previous, Owner: body.DiscordID, DryRun: body.DryRun})
+}
+
+// AdminMergeUploadHandler merges an accidentally duplicated upload into the
+// canonical one given as into, repointing collections, likes and the rest to
+// it and moving the duplicate to the trash. With dry_run it reports what
+// would move without changing anything.
+func AdminMergeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	var body struct {
+		Into   int64 `json:"into"`
+		DryRun bool  `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Into <= 0 {
+		respondError(w, http.StatusBadRequest, "into must be the ID of the upload to merge into")
+		return
+	}
+
+	merge, err := models.MergeUploads(r.Context(), uploadID, body.Into, body.DryRun)
+	switch {
+	case err == sql.ErrNoRows:
+		respondError(w, http.StatusNotFound, "Upload not found")
+		return
+	case errors.Is(err, models.ErrMergeSelf):
+		respondError(w, http.StatusBadRequest, "An upload can't be merged into itself")
+		return
+	case errors.Is(err, models.ErrMergeTarget):
+		respondError(w, http.StatusConflict, "The upload to merge into is in the trash")
+		return
+	case err != nil:
+		log.Printf("Failed to merge upload %d into upload %d: %v", uploadID, body.Into, err)
+		respondError(w, http.StatusInternalServerError, "Failed to merge uploads")
+		return
+	}
+
+	if !body.DryRun {
+		adminID := middleware.GetRealDiscordID(r)
+		log.Printf("Admin %s (ID: %s) merged upload %d into upload %d, moving %d pulls", middleware.GetUsername(r), adminID, uploadID, body.Into, merge.Pulls)
+		recordAudit(r, adminID, models.AuditMergeUpload, uploadTarget(uploadID), fmt.Sprintf("into %d", body.Into))
+	}
+	writeJSON(w, http.StatusOK, MergeUploadResponse{
+		UploadID:   uploadID,
+		MergedInto: body.Into,
+		DryRun:     body.DryRun,
+		Pulls:      merge.Pulls,
+		Likes:      merge.Likes,
+		Wishlists:  merge.Wishlists,
+		Showcases:  merge.Showcases,
+		Banners:    merge.Banners,
+		Seasons:    merge.Seasons,
+		Trades:     merge.Trades,
+		Tags:       merge.Tags,
+	})
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/gorilla/mux"
+)
+
+// Stages of an upload whose progress is tracked
+const (
+	progressReceiving  = "receiving"
+	progressProcessing = "processing"
+	progressComplete   = "complete"
+)
+
+// progressRetention is how long the progress of a finished upload can still
+// be read, so a client polling slowly sees it complete
+const progressRetention = 5 * time.Minute
+
+// uploadTicketPattern is what clients may use as upload tickets: something
+// random they pick themselves, such as a UUID
+var uploadTicketPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+// UploadProgressResponse is how far the server has got with an upload
+type UploadProgressResponse struct {
+	Ticket        string `json:"ticket"`
+	Status        string `json:"status"`
+	ReceivedBytes int64  `json:"received_bytes"`
+	TotalBytes    int64  `json:"total_bytes"`
+}
+
+// uploadProgress is the progress of one upload, updated as its body is read
+type uploadProgress struct {
+	received atomic.Int64
+	total    int64
+	status   atomic.Value
+	finished atomic.Int64
+}
+
+// uploadProgresses holds the progress of uploads in flight or recently
+// finished, by the uploader's Discord ID and the ticket they chose
+var uploadProgresses = struct {
+	sync.Mutex
+	byKey map[string]*uploadProgress
+}{byKey: make(map[string]*uploadProgress)}
+
+// trackUploadProgress starts counting the bytes of the request body when the
+// client passed a ticket, returning nil otherwise. Callers move it through the
+// stages with setStatus and must call finish.
+func trackUploadProgress(r *http.Request) *uploadProgress {
+	ticket := r.URL.Query().Get("ticket")
+	if !uploadTicketPattern.MatchString(ticket) {
+		return nil
+	}
+
+	p := &uploadProgress{total: r.ContentLength}
+	p.status.Store(progressReceiving)
+	now := time.Now()
+	uploadProgresses.Lock()
+	for key, old := range uploadProgresses.byKey {
+		if finished := old.finished.Load(); finished != 0 && now.Sub(time.Unix(finished, 0)) > progressRetention {
+			delete(uploadProgresses.byKey, key)
+		}
+	}
+	uploadProgresses.byKey[middleware.GetDiscordID(r)+" "+ticket] = p
+	uploadProgresses.Unlock()
+
+	r.Body = &countingBody{ReadCloser: r.Body, progress: p}
+	return p
+}
+
+func (p *uploadProgress) setStatus(status string) {
+	if p != nil {
+		p.status.Store(status)
+	}
+}
+
+func (p *uploadProgress) finish() {
+	if p != nil {
+		p.status.Store(progressComplete)
+		p.finished.Store(time.Now().Unix())
+	}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	progress *uploadProgress
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.progress.received.Add(int64(n))
+	return n, err
+}
+
+// UploadProgressHandler reports how much of an upload made with
+// ?ticket={ticket} the server has received, and whether it is still being
+// processed. Only the uploader can see it. total_bytes is -1 when the client
+// didn't say how large the upload is.
+func UploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	ticket := mux.Vars(r)["ticket"]
+	uploadProgresses.Lock()
+	p, ok := uploadProgresses.byKey[middleware.GetDiscordID(r)+" "+ticket]
+	uploadProgresses.Unlock()
+	if !ok {
+		respondError(w, http.StatusNotFound, "No upload with this ticket")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UploadProgressResponse{
+		Ticket:        ticket,
+		Status:        p.status.Load().(string),
+		ReceivedBytes: p.received.Load(),
+		TotalBytes:    p.total,
+	})
+}
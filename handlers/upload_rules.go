@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+// Upload rules are content policy checks admins set in upload_rules or add
+// at runtime through /api/admin/upload-rules. processUpload runs them in
+// order, those in the config first, and the first rule an upload breaks
+// refuses it with that rule's message.
+
+// UploadRuleResponse is an upload rule. ID, CreatedBy and CreatedAt are only
+// set for rules added at runtime.
+type UploadRuleResponse struct {
+	ID int64 `json:"id,omitempty"`
+	config.UploadRule
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+func newUploadRuleResponse(r models.UploadRule) UploadRuleResponse {
+	return UploadRuleResponse{ID: r.ID, UploadRule: configUploadRule(r), CreatedBy: r.CreatedBy, CreatedAt: &r.CreatedAt}
+}
+
+func configUploadRule(r models.UploadRule) config.UploadRule {
+	return config.UploadRule{
+		Name:       r.Name,
+		Type:       r.Type,
+		Pattern:    r.Pattern,
+		Tag:        r.Tag,
+		MinWidth:   r.MinWidth,
+		MinHeight:  r.MinHeight,
+		BannerID:   r.BannerID,
+		MaxUploads: r.MaxUploads,
+		Message:    r.Message,
+	}
+}
+
+func uploadRuleTarget(id int64) string {
+	return fmt.Sprintf("upload_rule:%d", id)
+}
+
+// activeUploadRules returns the rules in upload_rules followed by those added
+// at runtime
+func activeUploadRules(ctx context.Context) ([]config.UploadRule, error) {
+	stored, err := models.ListUploadRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rules := slices.Clone(config.AppConfig.UploadRules)
+	for _, r := range stored {
+		rules = append(rules, configUploadRule(r))
+	}
+	return rules, nil
+}
+
+// uploadRuleSubject is what upload rules judge an upload by. Width and height
+// are only known once the image is decoded.
+type uploadRuleSubject struct {
+	discordID string
+	guildID   string
+	filename  string
+	tags      []string
+	width     int
+	height    int
+}
+
+// ruleNeedsSize reports whether a rule judges the image's size, and so runs
+// after it is decoded
+func ruleNeedsSize(rule config.UploadRule) bool {
+	return rule.Type == config.UploadRuleTagMinDimensions
+}
+
+// checkUploadRules runs the rules that judge the image's size when sized is
+// set, and the others when it isn't, refusing the upload with the first rule
+// it breaks
+func checkUploadRules(ctx context.Context, rules []config.UploadRule, s uploadRuleSubject, sized bool) *uploadError {
+	for _, rule := range rules {
+		if ruleNeedsSize(rule) != sized {
+			continue
+		}
+		broken, explanation, err := breaksUploadRule(ctx, rule, s)
+		if err != nil {
+			log.Printf("Upload failed for user %s: failed to check upload rule %q - %v", s.discordID, rule.Name, err)
+			return &uploadError{status: http.StatusInternalServerError, message: "Failed to check upload rules"}
+		}
+		if !broken {
+			continue
+		}
+		if rule.Message != "" {
+			explanation = rule.Message
+		}
+		log.Printf("Upload rejected for user %s: '%s' breaks upload rule %q", s.discordID, s.filename, rule.Name)
+		return &uploadError{
+			status:  http.StatusUnprocessableEntity,
+			message: fmt.Sprintf("Upload rule %q: %s", rule.Name, explanation),
+			reason:  "upload_rule",
+			rule:    rule.Name,
+		}
+	}
+	return nil
+}
+
+// breaksUploadRule reports whether an upload breaks a rule, and why
+func breaksUploadRule(ctx context.Context, rule config.UploadRule, s uploadRuleSubject) (bool, string, error) {
+	switch rule.Type {
+	case config.UploadRuleFilenamePattern:
+		// Rules are checked when they are set, so the pattern compiles
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return false, "", err
+		}
+		return pattern.MatchString(s.filename), fmt.Sprintf("file names may not match %s", rule.Pattern), nil
+
+	case config.UploadRuleTagMinDimensions:
+		if !slices.Contains(s.tags, rule.Tag) || (s.width >= rule.MinWidth && s.height >= rule.MinHeight) {
+			return false, "", nil
+		}
+		return true, fmt.Sprintf("wallpapers tagged %q must be at least %dx%d; this one is %dx%d",
+			rule.Tag, rule.MinWidth, rule.MinHeight, s.width, s.height), nil
+
+	case config.UploadRuleBannerLimit:
+		// New uploads aren't listed in banners, so only a banner's tags can
+		// feature them
+		if len(s.tags) == 0 {
+			return false, "", nil
+		}
+		banners, err := models.ListBanners(ctx, s.guildID, true)
+		if err != nil {
+			return false, "", err
+		}
+		for _, b := range banners {
+			if (rule.BannerID != 0 && b.ID != rule.BannerID) || !slices.ContainsFunc(b.Tags, func(tag string) bool { return slices.Contains(s.tags, tag) }) {
+				continue
+			}
+			n, err := models.CountBannerUploads(ctx, b, s.discordID)
+			if err != nil {
+				return false, "", err
+			}
+			if n >= rule.MaxUploads {
+				return true, fmt.Sprintf("you can have at most %d uploads in the %q banner", rule.MaxUploads, b.Name), nil
+			}
+		}
+		return false, "", nil
+	}
+	return false, "", nil
+}
+
+// AdminUploadRulesHandler lists the upload rules in upload_rules and those
+// added at runtime, in the order they run
+func AdminUploadRulesHandler(w http.ResponseWriter, r *http.Request) {
+	stored, err := models.ListUploadRules(r.Context())
+	if err != nil {
+		log.Printf("Failed to list upload rules: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to list upload rules")
+		return
+	}
+
+	configured := make([]UploadRuleResponse, 0, len(config.AppConfig.UploadRules))
+	for _, rule := range config.AppConfig.UploadRules {
+		configured = append(configured, UploadRuleResponse{UploadRule: rule})
+	}
+	rules := make([]UploadRuleResponse, 0, len(stored))
+	for _, rule := range stored {
+		rules = append(rules, newUploadRuleResponse(rule))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"configured": configured,
+		"rules":      rules,
+	})
+}
+
+// AdminCreateUploadRuleHandler adds an upload rule, which applies from the
+// next upload on
+func AdminCreateUploadRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var body config.UploadRule
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := body.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Type == config.UploadRuleBannerLimit && body.BannerID != 0 {
+		if _, err := models.GetBanner(r.Context(), body.BannerID); err == sql.ErrNoRows {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Banner %d does not exist", body.BannerID))
+			return
+		} else if err != nil {
+			log.Printf("Failed to get banner %d: %v", body.BannerID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to save upload rule")
+			return
+		}
+	}
+
+	actorID := middleware.GetRealDiscordID(r)
+	rule := &models.UploadRule{
+		Name:       body.Name,
+		Type:       body.Type,
+		Pattern:    body.Pattern,
+		Tag:        body.Tag,
+		MinWidth:   body.MinWidth,
+		MinHeight:  body.MinHeight,
+		BannerID:   body.BannerID,
+		MaxUploads: body.MaxUploads,
+		Message:    body.Message,
+		CreatedBy:  actorID,
+	}
+	if err := models.CreateUploadRule(r.Context(), rule); err != nil {
+		log.Printf("Failed to create upload rule: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to save upload rule")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) added %s upload rule %d %q", middleware.GetUsername(r), actorID, rule.Type, rule.ID, rule.Name)
+	recordAudit(r, actorID, models.AuditUploadRuleCreate, uploadRuleTarget(rule.ID), rule.Type+": "+rule.Name)
+	writeJSON(w, http.StatusCreated, newUploadRuleResponse(*rule))
+}
+
+// AdminDeleteUploadRuleHandler removes an upload rule added at runtime;
+// those in upload_rules can only be removed from the config
+func AdminDeleteUploadRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload rule ID")
+		return
+	}
+
+	if err := models.DeleteUploadRule(r.Context(), id); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload rule not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete upload rule %d: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to delete upload rule")
+		return
+	}
+
+	actorID := middleware.GetRealDiscordID(r)
+	log.Printf("Admin %s (ID: %s) deleted upload rule %d", middleware.GetUsername(r), actorID, id)
+	recordAudit(r, actorID, models.AuditUploadRuleDelete, uploadRuleTarget(id), "")
+	w.WriteHeader(http.StatusNoContent)
+}
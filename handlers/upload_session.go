@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/diskspace"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Maximum number of unfinished resumable uploads a user may have at once
+const maxUploadSessionsPerUser = 3
+
+// uploadSessionBusy holds the IDs of sessions currently receiving a chunk or
+// being completed, so two requests never write the same file
+var uploadSessionBusy sync.Map
+
+// uploadSessionsLowDisk holds the IDs of sessions already counted as refused
+// for low disk space while it is low, so a client retrying its chunks is
+// counted once
+var uploadSessionsLowDisk sync.Map
+
+func init() {
+	// Sessions abandoned while disk space was low expire unfinished
+	jobs.UploadSessionsExpired = func(ids []int64) {
+		for _, id := range ids {
+			uploadSessionsLowDisk.Delete(id)
+		}
+	}
+}
+
+// UploadSessionResponse describes a resumable upload and how much of it the
+// server has received
+type UploadSessionResponse struct {
+	ID               int64     `json:"id"`
+	OriginalFilename string    `json:"original_filename"`
+	Title            string    `json:"title"`
+	Description      string    `json:"description"`
+	Tags             []string  `json:"tags"`
+	License          string    `json:"license,omitempty"`
+	Visibility       string    `json:"visibility"`
+	FileSize         int64     `json:"file_size"`
+	Offset           int64     `json:"offset"`
+	UploadURL        string    `json:"upload_url"`
+	CompleteURL      string    `json:"complete_url"`
+	CreatedAt        time.Time `json:"created_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+func newUploadSessionResponse(s models.UploadSession) UploadSessionResponse {
+	if s.Tags == nil {
+		s.Tags = []string{}
+	}
+	return UploadSessionResponse{
+		ID:               s.ID,
+		OriginalFilename: s.OriginalFilename,
+		Title:            s.Title,
+		Description:      s.Description,
+		Tags:             s.Tags,
+		License:          s.License,
+		Visibility:       s.Visibility,
+		FileSize:         s.FileSize,
+		Offset:           s.Received,
+		UploadURL:        fmt.Sprintf("/api/upload/sessions/%d", s.ID),
+		CompleteURL:      fmt.Sprintf("/api/upload/sessions/%d/complete", s.ID),
+		CreatedAt:        s.CreatedAt,
+		ExpiresAt:        s.ExpiresAt,
+	}
+}
+
+// writeUploadSession responds with the session, reporting its progress in
+// the Upload-Offset and Upload-Length headers as tus clients expect
+func writeUploadSession(w http.ResponseWriter, status int, s *models.UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.FileSize, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, newUploadSessionResponse(*s))
+}
+
+// loadUploadSession fetches the signed-in user's upload session named in the
+// URL, writing an error response and returning nil when it can't be used
+func loadUploadSession(w http.ResponseWriter, r *http.Request) *models.UploadSession {
+	sessionID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload session ID")
+		return nil
+	}
+
+	s, err := models.GetUploadSession(r.Context(), sessionID, middleware.GetDiscordID(r))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload session not found or expired")
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to get upload session %d: %v", sessionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get upload session")
+		return nil
+	}
+	return s
+}
+
+// lockUploadSession claims the session for the request, responding with a
+// conflict and returning false if another request holds it. Callers that get
+// true must call unlockUploadSession.
+func lockUploadSession(w http.ResponseWriter, s *models.UploadSession) bool {
+	if _, busy := uploadSessionBusy.LoadOrStore(s.ID, struct{}{}); busy {
+		apiError(w, http.StatusConflict, codeUploadInProgress, "This upload is already receiving data in another request")
+		return false
+	}
+	return true
+}
+
+func unlockUploadSession(s *models.UploadSession) {
+	uploadSessionBusy.Delete(s.ID)
+}
+
+// refuseLowDiskSession is refuseLowDisk for the requests of a resumable
+// upload, which count as one rejection however many of them are refused
+// until disk space recovers
+func refuseLowDiskSession(w http.ResponseWriter, r *http.Request, s *models.UploadSession) bool {
+	if !diskspace.Low() {
+		uploadSessionsLowDisk.Delete(s.ID)
+		return false
+	}
+	if _, counted := uploadSessionsLowDisk.LoadOrStore(s.ID, struct{}{}); !counted {
+		uploadRejections.Inc("disk_space")
+	}
+	respondLowDisk(w, middleware.GetUsername(r), s.DiscordID)
+	return true
+}
+
+// CreateUploadSessionHandler starts a resumable upload. The file is then sent
+// in chunks with PATCH and published with a final POST to complete_url.
+func CreateUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	var req struct {
+		Filename    string   `json:"filename"`
+		Size        int64    `json:"size"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		License     string   `json:"license"`
+		Visibility  string   `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	filename := filepath.Base(strings.TrimSpace(req.Filename))
+	ext := strings.ToLower(filepath.Ext(filename))
+	if _, ok := config.AppConfig.UploadFormats[ext]; !ok {
+		apiError(w, http.StatusBadRequest, codeInvalidFileType, invalidFileTypeMessage())
+		return
+	}
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+	maxMB := maxFileSizeMB(user)
+	if req.Size <= 0 || req.Size > int64(maxMB)*1024*1024 {
+		apiError(w, http.StatusBadRequest, codeFileTooLarge, fmt.Sprintf("size must be between 1 byte and %dMB", maxMB))
+		return
+	}
+	title, description, tags, err := validateUploadMetadata(req.Title, req.Description, req.Tags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	license, err := models.NormalizeLicense(req.License)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visibility, err := models.NormalizeVisibility(req.Visibility)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	count, err := models.CountUploadSessions(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to count upload sessions for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to start upload")
+		return
+	}
+	if count >= maxUploadSessionsPerUser {
+		apiError(w, http.StatusConflict, codeLimitReached, fmt.Sprintf("You can have at most %d unfinished uploads; complete or cancel one first", maxUploadSessionsPerUser))
+		return
+	}
+
+	// Don't let a file that can never fit be sent in the first place
+	if uerr := checkStorageRoom(r.Context(), discordID, username, filename, req.Size); uerr != nil {
+		apiError(w, uerr.status, uerr.code(), uerr.message)
+		return
+	}
+	if refuseLowDisk(w, username, discordID) {
+		return
+	}
+
+	partial := uuid.New().String() + ext
+	path := storage.PartialPath(partial)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("Failed to create partial upload directory: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to start upload")
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Failed to create partial upload for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to start upload")
+		return
+	}
+	f.Close()
+
+	s := &models.UploadSession{
+		DiscordID:        discordID,
+		Filename:         partial,
+		OriginalFilename: filename,
+		Title:            title,
+		Description:      description,
+		Tags:             tags,
+		License:          license,
+		Visibility:       visibility,
+		FileSize:         req.Size,
+	}
+	if err := models.CreateUploadSession(r.Context(), s, draftTTL()); err != nil {
+		log.Printf("Failed to record upload session for user %s (ID: %s): %v", username, discordID, err)
+		storage.RemovePartial(partial)
+		respondError(w, http.StatusInternalServerError, "Failed to start upload")
+		return
+	}
+
+	log.Printf("User %s (ID: %s) started resumable upload %d of '%s' (%d bytes)", username, discordID, s.ID, filename, s.FileSize)
+	w.Header().Set("Location", fmt.Sprintf("/api/upload/sessions/%d", s.ID))
+	writeUploadSession(w, http.StatusCreated, s)
+}
+
+// UploadSessionHandler reports how much of a resumable upload has been
+// received, so an interrupted client knows where to resume
+func UploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	s := loadUploadSession(w, r)
+	if s == nil {
+		return
+	}
+	writeUploadSession(w, http.StatusOK, s)
+}
+
+// UploadChunkHandler appends the request body to a resumable upload. The
+// Upload-Offset header must match the bytes received so far; after a failed
+// chunk, clients check the session and resend from its offset. Each chunk
+// extends the session's expiry.
+func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	s := loadUploadSession(w, r)
+	if s == nil {
+		return
+	}
+	if !lockUploadSession(w, s) {
+		return
+	}
+	defer unlockUploadSession(s)
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Upload-Offset header is required")
+		return
+	}
+	if offset != s.Received {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(s.Received, 10))
+		apiError(w, http.StatusConflict, codeUploadOffset, fmt.Sprintf("Upload-Offset must be %d, the number of bytes received so far", s.Received))
+		return
+	}
+	if refuseLowDiskSession(w, r, s) {
+		return
+	}
+	if s.Received == s.FileSize {
+		respondError(w, http.StatusConflict, "All bytes have been received; complete the upload")
+		return
+	}
+
+	remaining := s.FileSize - s.Received
+	if r.ContentLength > remaining {
+		respondError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Chunk goes past the declared size of %d bytes", s.FileSize))
+		return
+	}
+
+	f, err := os.OpenFile(storage.PartialPath(s.Filename), os.O_WRONLY, 0)
+	if err != nil {
+		log.Printf("Failed to open partial upload %d: %v", s.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save chunk")
+		return
+	}
+	if _, err := f.Seek(s.Received, io.SeekStart); err != nil {
+		f.Close()
+		log.Printf("Failed to seek partial upload %d: %v", s.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to save chunk")
+		return
+	}
+	written, copyErr := io.Copy(f, http.MaxBytesReader(w, r.Body, remaining))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	// A chunk running past the declared size is discarded; the next chunk
+	// overwrites what it wrote
+	var tooLarge *http.MaxBytesError
+	if errors.As(copyErr, &tooLarge) {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(s.Received, 10))
+		respondError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Chunk goes past the declared size of %d bytes", s.FileSize))
+		return
+	}
+
+	// Keep whatever arrived, even from a chunk cut short, so the client can
+	// resume right after it
+	if written > 0 {
+		if err := models.AdvanceUploadSession(r.Context(), s, offset, offset+written, draftTTL()); err == sql.ErrNoRows {
+			respondError(w, http.StatusNotFound, "Upload session not found or expired")
+			return
+		} else if err != nil {
+			log.Printf("Failed to record progress of upload session %d: %v", s.ID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to save chunk")
+			return
+		}
+	}
+
+	if copyErr != nil {
+		log.Printf("Chunk of upload session %d cut short after %d bytes: %v", s.ID, written, copyErr)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(s.Received, 10))
+		respondError(w, http.StatusBadRequest, "Chunk was not received completely; resume from Upload-Offset")
+		return
+	}
+
+	writeUploadSession(w, http.StatusOK, s)
+}
+
+// CompleteUploadSessionHandler runs a fully received resumable upload
+// through the upload pipeline with the same limits as a direct upload, then
+// discards the session
+func CompleteUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	s := loadUploadSession(w, r)
+	if s == nil {
+		return
+	}
+	if s.Received != s.FileSize {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(s.Received, 10))
+		apiError(w, http.StatusConflict, codeUploadIncomplete, fmt.Sprintf("Upload incomplete: %d of %d bytes received", s.Received, s.FileSize))
+		return
+	}
+	if !lockUploadSession(w, s) {
+		return
+	}
+	defer unlockUploadSession(s)
+
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	// Checked before admitUpload, so a session refused for its chunks isn't
+	// counted again
+	if refuseLowDiskSession(w, r, s) {
+		return
+	}
+	if !admitUpload(w, r, user, username) {
+		return
+	}
+	defer limiter.release(discordID)
+
+	file, err := os.Open(storage.PartialPath(s.Filename))
+	if err != nil {
+		log.Printf("Failed to open partial upload %d: %v", s.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to read uploaded file")
+		return
+	}
+	defer file.Close()
+
+	upload, uerr := storeUpload(user, username, uploadInput{
+		ctx:         r.Context(),
+		file:        file,
+		filename:    s.OriginalFilename,
+		title:       s.Title,
+		description: s.Description,
+		tags:        s.Tags,
+		license:     s.License,
+		visibility:  s.Visibility,
+		guildID:     middleware.GetGuildID(r),
+		source:      models.SourceWeb,
+		limits:      uploadLimits(user),
+	})
+	if uerr != nil {
+		// The session is kept so the user can retry once e.g. a cooldown ends
+		respondUploadError(w, r, uerr)
+		return
+	}
+
+	if _, err := models.DeleteUploadSession(r.Context(), s.ID, discordID); err != nil && err != sql.ErrNoRows {
+		log.Printf("Warning: Failed to delete completed upload session %d: %v", s.ID, err)
+	} else {
+		storage.RemovePartial(s.Filename)
+	}
+	uploadSessionsLowDisk.Delete(s.ID)
+
+	respondUploaded(w, r, user, username, upload)
+}
+
+// DeleteUploadSessionHandler cancels a resumable upload and discards what it
+// received
+func DeleteUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upload session ID")
+		return
+	}
+
+	if _, busy := uploadSessionBusy.Load(sessionID); busy {
+		apiError(w, http.StatusConflict, codeUploadInProgress, "This upload is receiving data in another request")
+		return
+	}
+
+	filename, err := models.DeleteUploadSession(r.Context(), sessionID, middleware.GetDiscordID(r))
+	if err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Upload session not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete upload session %d: %v", sessionID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to cancel upload")
+		return
+	}
+	storage.RemovePartial(filename)
+	uploadSessionsLowDisk.Delete(sessionID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Maximum number of files processed from a single archive
+const maxZipEntries = 100
+
+// ZipEntryResult reports what happened to one file in an uploaded archive
+type ZipEntryResult struct {
+	Name        string             `json:"name"`
+	Success     bool               `json:"success"`
+	Code        string             `json:"code,omitempty"`
+	Message     string             `json:"message"`
+	Rule        string             `json:"rule,omitempty"`
+	UploadID    int64              `json:"upload_id,omitempty"`
+	Filename    string             `json:"filename,omitempty"`
+	DuplicateOf int64              `json:"duplicate_of,omitempty"`
+	Duplicate   *DuplicateResponse `json:"duplicate,omitempty"`
+}
+
+type ZipUploadResponse struct {
+	Success      bool             `json:"success"`
+	Code         string           `json:"code,omitempty"`
+	Message      string           `json:"message"`
+	Uploaded     int              `json:"uploaded"`
+	Results      []ZipEntryResult `json:"results"`
+	CooldownSecs int              `json:"cooldown_seconds,omitempty"`
+	NextUploadAt string           `json:"next_upload_at,omitempty"`
+	Warnings     []string         `json:"warnings,omitempty"`
+	Quota        *UploadQuota     `json:"quota,omitempty"`
+}
+
+// ZipUploadHandler accepts a ZIP archive of wallpapers and runs each image
+// through the regular upload pipeline, reporting a result per entry. Entries
+// beyond the user's remaining upload allowance are skipped.
+func ZipUploadHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	log.Printf("ZIP upload attempt by user %s (ID: %s) from IP: %s", username, discordID, r.RemoteAddr)
+
+	user, err := models.GetOrCreateUser(r.Context(), discordID, username)
+	if err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	// Check the cooldown and quotas
+	quota, err := uploadQuota(r.Context(), user, 0)
+	if err != nil {
+		log.Printf("Failed to get upload quota for user %s (ID: %s): %v", username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to check upload quota")
+		return
+	}
+	setQuotaHeaders(w, quota)
+	if !quota.CanUpload {
+		log.Printf("ZIP upload denied for user %s (ID: %s): %s", username, discordID, quota.reason)
+		respondZipJSON(w, http.StatusTooManyRequests, ZipUploadResponse{
+			Success:      false,
+			Code:         codeUploadLimitReached,
+			Message:      quota.reason,
+			Results:      []ZipEntryResult{},
+			CooldownSecs: quota.CooldownSecs,
+			NextUploadAt: quota.NextUploadAt,
+			Quota:        &quota,
+		})
+		return
+	}
+
+	if refuseLowDisk(w, username, discordID) {
+		return
+	}
+	// The whole archive occupies a single upload slot
+	if !limiter.acquire(discordID) {
+		log.Printf("ZIP upload deferred for user %s (ID: %s): concurrent upload limit reached", username, discordID)
+		w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfterSeconds))
+		apiError(w, http.StatusServiceUnavailable, codeServerBusy, "The server is busy processing other uploads, please try again shortly")
+		return
+	}
+	defer limiter.release(discordID)
+
+	progress := trackUploadProgress(r)
+	defer progress.finish()
+
+	// Large archives spill to disk rather than being held in memory
+	maxZipSize := int64(config.AppConfig.MaxZipSizeMB) * 1024 * 1024
+	r.Body = http.MaxBytesReader(w, r.Body, maxZipSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		log.Printf("ZIP upload failed for user %s (ID: %s): archive too large (max %dMB)", username, discordID, config.AppConfig.MaxZipSizeMB)
+		apiError(w, http.StatusBadRequest, codeFileTooLarge, fmt.Sprintf("Archive too large (max %dMB)", config.AppConfig.MaxZipSizeMB))
+		return
+	}
+	progress.setStatus(progressProcessing)
+
+	// Tags, the license and the visibility apply to every wallpaper in the archive
+	tags, err := models.NormalizeTags(strings.Split(r.FormValue("tags"), ","))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	license, err := models.NormalizeLicense(r.FormValue("license"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	visibility, err := models.NormalizeVisibility(r.FormValue("visibility"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	force, ok := forceUpload(w, r)
+	if !ok {
+		return
+	}
+
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		log.Printf("ZIP upload failed for user %s (ID: %s): no archive provided - %v", username, discordID, err)
+		respondError(w, http.StatusBadRequest, "No archive provided")
+		return
+	}
+	defer file.Close()
+
+	archive, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		log.Printf("ZIP upload failed for user %s (ID: %s): unreadable archive '%s' - %v", username, discordID, header.Filename, err)
+		respondError(w, http.StatusBadRequest, "Invalid ZIP archive")
+		return
+	}
+
+	allowance := quota.Remaining
+	if uploadCooldownMinutes(user) <= 0 && config.AppConfig.MaxUploadsPerDay <= 0 {
+		allowance = maxZipEntries // no cooldown or daily limit, so no per-batch limit beyond the entry cap
+	}
+
+	resp := ZipUploadResponse{Results: []ZipEntryResult{}}
+	processed := 0
+	limits := uploadLimits(user)
+	guildID := middleware.GetGuildID(r)
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() || skipZipEntry(entry.Name) {
+			continue
+		}
+
+		result := ZipEntryResult{Name: entry.Name}
+		switch {
+		case processed >= maxZipEntries:
+			result.Code = codeSkipped
+			result.Message = fmt.Sprintf("Skipped: archives may contain at most %d files", maxZipEntries)
+		case resp.Uploaded >= allowance:
+			result.Code = codeSkipped
+			result.Message = "Skipped: upload limit reached"
+		default:
+			processed++
+			upload, uerr := storeZipEntry(r.Context(), user, username, entry, tags, license, visibility, guildID, limits, force)
+			if uerr != nil {
+				result.Code = uerr.code()
+				result.Message = uerr.message
+				result.Rule = uerr.rule
+				result.Duplicate = duplicateResponse(r, uerr.duplicateOf)
+				result.DuplicateOf = result.Duplicate.id()
+			} else {
+				resp.Uploaded++
+				// The cooldown starts with the first file; the rest of the
+				// archive is part of the same upload
+				limits.Cooldown = 0
+				result.Success = true
+				result.Message = uploadedMessage(upload)
+				result.UploadID = upload.ID
+				result.Filename = upload.Filename
+				result.DuplicateOf = duplicateResponse(r, upload.DuplicateOf.Int64).id()
+				recordAudit(r, middleware.GetRealDiscordID(r), models.AuditUpload, uploadTarget(upload.ID), header.Filename+": "+entry.Name)
+				notifyUploaded(r, upload, username)
+				gacha.RewardUploaded(r.Context(), upload)
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	if resp.Uploaded > 0 {
+		gacha.QueueAchievementCheck(discordID)
+	}
+
+	log.Printf("ZIP upload by user %s (ID: %s): '%s' stored %d of %d files",
+		username, discordID, header.Filename, resp.Uploaded, len(resp.Results))
+
+	quota, err = uploadQuota(r.Context(), user, 1)
+	if err != nil {
+		log.Printf("Warning: Failed to get upload quota for user %s (ID: %s): %v", username, discordID, err)
+	}
+	setQuotaHeaders(w, quota)
+	resp.Success = resp.Uploaded > 0
+	resp.Message = fmt.Sprintf("Uploaded %d of %d files", resp.Uploaded, len(resp.Results))
+	resp.CooldownSecs = quota.CooldownSecs
+	resp.NextUploadAt = quota.NextUploadAt
+	resp.Warnings = quota.Warnings
+
+	status := http.StatusOK
+	if len(resp.Results) == 0 {
+		resp.Code = middleware.CodeInvalidRequest
+		resp.Message = "The archive contains no files"
+		status = http.StatusBadRequest
+	}
+	respondZipJSON(w, status, resp)
+}
+
+// respondZipJSON writes the response to a ZIP upload, its messages in the
+// response's locale
+func respondZipJSON(w http.ResponseWriter, status int, resp ZipUploadResponse) {
+	resp.Message = middleware.Translate(w, resp.Message)
+	results := make([]ZipEntryResult, len(resp.Results))
+	for i, result := range resp.Results {
+		result.Message = middleware.Translate(w, result.Message)
+		results[i] = result
+	}
+	resp.Results = results
+	resp.Warnings = translateAll(w, resp.Warnings)
+	resp.Quota = resp.Quota.localized(w)
+	writeJSON(w, status, resp)
+}
+
+// skipZipEntry reports whether an archive entry is metadata added by archivers
+// rather than a file the user meant to upload
+func skipZipEntry(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".") || base == "Thumbs.db"
+}
+
+// storeZipEntry extracts one archive entry to a temporary file and stores it.
+// Entry names are never used as paths on disk, but names that would escape the
+// archive root are rejected outright.
+func storeZipEntry(ctx context.Context, user *models.User, username string, entry *zip.File, tags []string, license, visibility, guildID string, limits *models.UploadLimits, force bool) (*models.Upload, *uploadError) {
+	name := strings.ReplaceAll(entry.Name, "\\", "/")
+	if path.IsAbs(name) || strings.HasPrefix(path.Clean(name), "../") || path.Clean(name) == ".." {
+		log.Printf("ZIP upload by user %s (ID: %s): rejected unsafe entry name '%s'", username, user.DiscordID, entry.Name)
+		return nil, &uploadError{status: http.StatusBadRequest, message: "Invalid file name"}
+	}
+
+	maxMB := maxFileSizeMB(user)
+	maxSize := int64(maxMB) * 1024 * 1024
+	if entry.UncompressedSize64 > uint64(maxSize) {
+		return nil, &uploadError{status: http.StatusBadRequest, message: fmt.Sprintf("File too large (max %dMB)", maxMB), reason: "too_large"}
+	}
+
+	src, err := entry.Open()
+	if err != nil {
+		log.Printf("ZIP upload by user %s (ID: %s): failed to open entry '%s' - %v", username, user.DiscordID, entry.Name, err)
+		return nil, &uploadError{status: http.StatusBadRequest, message: "Failed to read file"}
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "wallpaper-zip-*")
+	if err != nil {
+		log.Printf("ZIP upload by user %s (ID: %s): failed to create temporary file - %v", username, user.DiscordID, err)
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to save file"}
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// The declared size can lie, so cap what is actually extracted
+	written, err := io.Copy(tmp, io.LimitReader(src, maxSize+1))
+	if err != nil {
+		log.Printf("ZIP upload by user %s (ID: %s): failed to extract entry '%s' - %v", username, user.DiscordID, entry.Name, err)
+		return nil, &uploadError{status: http.StatusBadRequest, message: "Failed to read file"}
+	}
+	if written > maxSize {
+		return nil, &uploadError{status: http.StatusBadRequest, message: fmt.Sprintf("File too large (max %dMB)", maxMB), reason: "too_large"}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, &uploadError{status: http.StatusInternalServerError, message: "Failed to read file"}
+	}
+
+	return storeUpload(user, username, uploadInput{
+		ctx:        ctx,
+		file:       tmp,
+		filename:   path.Base(name),
+		tags:       tags,
+		license:    license,
+		visibility: visibility,
+		guildID:    guildID,
+		source:     models.SourceWeb,
+		limits:     limits,
+		force:      force,
+	})
+}
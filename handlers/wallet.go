@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxWalletAdjustment   = 1000
+	maxWalletReasonLength = 200
+)
+
+type WalletTransactionResponse struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// writeWallet responds with a user's bonus pull balance and a page of their
+// wallet history
+func writeWallet(w http.ResponseWriter, r *http.Request, discordID string) {
+	balance, err := models.WalletBalance(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to get wallet balance for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get wallet")
+		return
+	}
+
+	page, perPage, offset := parsePagination(r)
+	txs, total, err := models.ListWalletTransactions(r.Context(), discordID, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list wallet transactions for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get wallet")
+		return
+	}
+
+	items := make([]WalletTransactionResponse, 0, len(txs))
+	for _, t := range txs {
+		items = append(items, WalletTransactionResponse{
+			ID:        t.ID,
+			Type:      t.Type,
+			Amount:    t.Amount,
+			Reason:    t.Reason,
+			Reference: t.Reference,
+			CreatedAt: t.CreatedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"discord_id":   discordID,
+		"bonus_pulls":  balance,
+		"transactions": items,
+		"page":         page,
+		"per_page":     perPage,
+		"total":        total,
+	})
+}
+
+// WalletHandler shows the signed-in user's bonus pulls and wallet history
+func WalletHandler(w http.ResponseWriter, r *http.Request) {
+	writeWallet(w, r, middleware.GetDiscordID(r))
+}
+
+// EarningsHandler shows the bonus pulls the signed-in user has earned by
+// taking part in the community, in total and by action, a page of the
+// rewards themselves and what each action is worth
+func EarningsHandler(w http.ResponseWriter, r *http.Request) {
+	discordID := middleware.GetDiscordID(r)
+	totals, err := models.RewardTotals(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to get reward totals for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get earnings")
+		return
+	}
+
+	page, perPage, offset := parsePagination(r)
+	txs, total, err := models.ListWalletRewards(r.Context(), discordID, perPage, offset)
+	if err != nil {
+		log.Printf("Failed to list rewards for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get earnings")
+		return
+	}
+
+	byAction := make(map[string]int, len(gacha.RewardActions))
+	earned := 0
+	for _, action := range gacha.RewardActions {
+		byAction[action] = totals[action]
+	}
+	for _, amount := range totals {
+		earned += amount
+	}
+	items := make([]WalletTransactionResponse, 0, len(txs))
+	for _, t := range txs {
+		items = append(items, WalletTransactionResponse{
+			ID:        t.ID,
+			Type:      t.Type,
+			Amount:    t.Amount,
+			Reason:    t.Reason,
+			Reference: t.Reference,
+			CreatedAt: t.CreatedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total_earned": earned,
+		"by_action":    byAction,
+		"rewards":      config.AppConfig.Rewards,
+		"earnings":     items,
+		"page":         page,
+		"per_page":     perPage,
+		"total":        total,
+	})
+}
+
+// AdminWalletHandler shows a user's bonus pulls and wallet history
+func AdminWalletHandler(w http.ResponseWriter, r *http.Request) {
+	writeWallet(w, r, mux.Vars(r)["id"])
+}
+
+// AdminAdjustWalletHandler grants or deducts bonus pulls for one user, or for
+// every user last seen in an allowed guild. Deductions stop at a zero balance.
+func AdminAdjustWalletHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Type      string `json:"type"`
+		Amount    int    `json:"amount"`
+		Reason    string `json:"reason"`
+		DiscordID string `json:"discord_id"`
+		GuildID   string `json:"guild_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if body.Type != models.WalletGrant && body.Type != models.WalletDeduct {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("type must be %s or %s", models.WalletGrant, models.WalletDeduct))
+		return
+	}
+	if body.Amount < 1 || body.Amount > maxWalletAdjustment {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("amount must be between 1 and %d", maxWalletAdjustment))
+		return
+	}
+	reason := strings.TrimSpace(body.Reason)
+	if reason == "" {
+		respondError(w, http.StatusBadRequest, "reason is required")
+		return
+	}
+	if len([]rune(reason)) > maxWalletReasonLength {
+		respondError(w, http.StatusBadRequest, "Reason is too long")
+		return
+	}
+
+	discordID := strings.TrimSpace(body.DiscordID)
+	guildID := strings.TrimSpace(body.GuildID)
+	var recipients []string
+	var target, reference string
+	switch {
+	case (discordID == "") == (guildID == ""):
+		respondError(w, http.StatusBadRequest, "Exactly one of discord_id and guild_id is required")
+		return
+	case discordID != "":
+		if _, err := models.GetUser(r.Context(), discordID); err == sql.ErrNoRows {
+			respondError(w, http.StatusNotFound, "User not found")
+			return
+		} else if err != nil {
+			log.Printf("Failed to get user %s: %v", discordID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to adjust wallet")
+			return
+		}
+		recipients = []string{discordID}
+		target = userTarget(discordID)
+	default:
+		if !config.AppConfig.IsAllowedGuild(guildID) {
+			respondError(w, http.StatusBadRequest, "guild_id must be one of the allowed servers")
+			return
+		}
+		members, err := models.GuildMemberIDs(r.Context(), guildID)
+		if err != nil {
+			log.Printf("Failed to list members of guild %s: %v", guildID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to adjust wallet")
+			return
+		}
+		recipients = members
+		target = "guild:" + guildID
+		reference = target
+	}
+
+	actorID := middleware.GetRealDiscordID(r)
+	changed, err := models.AdjustWallets(r.Context(), recipients, body.Type, body.Amount, reason, actorID, reference)
+	if err != nil {
+		log.Printf("Failed to %s %d bonus pulls for %s: %v", body.Type, body.Amount, target, err)
+		respondError(w, http.StatusInternalServerError, "Failed to adjust wallet")
+		return
+	}
+
+	log.Printf("Admin %s (ID: %s) made a %s of %d bonus pulls for %s (%d users): %s", middleware.GetUsername(r), actorID, body.Type, body.Amount, target, changed, reason)
+	action := models.AuditWalletGrant
+	if body.Type == models.WalletDeduct {
+		action = models.AuditWalletDeduct
+	}
+	recordAudit(r, actorID, action, target, fmt.Sprintf("%d: %s", body.Amount, reason))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"type":          body.Type,
+		"amount":        body.Amount,
+		"users_changed": changed,
+	})
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// relatedLimit is how many related wallpapers the detail of a wallpaper lists
+const relatedLimit = 12
+
+// RelatedWallpaperResponse is a wallpaper related to another, with the tags
+// they share and the score it is ranked by
+type RelatedWallpaperResponse struct {
+	WallpaperResponse
+	SharedTags   []string `json:"shared_tags"`
+	RelatedScore float64  `json:"related_score"`
+}
+
+// WallpaperDetailResponse is a wallpaper with how many times it was pulled
+// and the wallpapers related to it
+type WallpaperDetailResponse struct {
+	WallpaperResponse
+	Pulls   int                        `json:"pulls"`
+	Related []RelatedWallpaperResponse `json:"related"`
+}
+
+// WallpaperDetailHandler returns a wallpaper with its pull count and the
+// public wallpapers of its guild sharing tags or dominant colors with it,
+// for the detail page and Discord embeds
+func WallpaperDetailHandler(w http.ResponseWriter, r *http.Request) {
+	upload := loadVisibleUpload(w, r)
+	if upload == nil {
+		return
+	}
+
+	pulls, err := models.CountUploadPulls(r.Context(), upload.ID)
+	if err != nil {
+		log.Printf("Failed to count pulls of upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get wallpaper")
+		return
+	}
+	related, err := models.RelatedUploads(r.Context(), upload, relatedLimit)
+	if err != nil {
+		log.Printf("Failed to list wallpapers related to upload %d: %v", upload.ID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get wallpaper")
+		return
+	}
+
+	resp := WallpaperDetailResponse{
+		WallpaperResponse: newWallpaperResponse(r, *upload),
+		Pulls:             pulls,
+		Related:           make([]RelatedWallpaperResponse, 0, len(related)),
+	}
+	for _, rel := range related {
+		resp.Related = append(resp.Related, RelatedWallpaperResponse{
+			WallpaperResponse: newWallpaperResponse(r, rel.Upload),
+			SharedTags:        rel.SharedTags,
+			RelatedScore:      rel.Score,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/mux"
+)
+
+type WishlistEntryResponse struct {
+	Wallpaper WallpaperResponse `json:"wallpaper"`
+	AddedAt   time.Time         `json:"added_at"`
+}
+
+// writeWishlist responds with the user's wishlist
+func writeWishlist(w http.ResponseWriter, r *http.Request, discordID string) {
+	entries, err := models.ListWishlist(r.Context(), discordID)
+	if err != nil {
+		log.Printf("Failed to list wishlist for user %s: %v", discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to get wishlist")
+		return
+	}
+
+	items := make([]WishlistEntryResponse, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, WishlistEntryResponse{Wallpaper: newWallpaperResponse(r, e.Upload), AddedAt: e.AddedAt})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"wallpapers": items,
+		"max":        config.AppConfig.WishlistSize,
+		"rate_up":    max(config.AppConfig.WishlistRateUp, 1),
+	})
+}
+
+// WishlistHandler lists the wallpapers on the signed-in user's wishlist
+func WishlistHandler(w http.ResponseWriter, r *http.Request) {
+	writeWishlist(w, r, middleware.GetDiscordID(r))
+}
+
+// WishlistItemHandler pins a wallpaper to the signed-in user's wishlist on
+// PUT and unpins it on DELETE, responding with the resulting wishlist
+func WishlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid wallpaper ID")
+		return
+	}
+	discordID := middleware.GetDiscordID(r)
+	username := middleware.GetUsername(r)
+
+	if r.Method == http.MethodDelete {
+		if err := models.RemoveFromWishlist(r.Context(), discordID, uploadID); err != nil {
+			log.Printf("Failed to remove upload %d from wishlist of user %s (ID: %s): %v", uploadID, username, discordID, err)
+			respondError(w, http.StatusInternalServerError, "Failed to update wishlist")
+			return
+		}
+		writeWishlist(w, r, discordID)
+		return
+	}
+
+	// Only wallpapers that can be drawn are worth wishing for
+	if _, err := models.GetPoolUpload(r.Context(), uploadID, middleware.GetGuildID(r)); err == sql.ErrNoRows {
+		respondError(w, http.StatusNotFound, "Wallpaper not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get upload %d: %v", uploadID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update wishlist")
+		return
+	}
+	if _, err := models.GetOrCreateUser(r.Context(), discordID, username); err != nil {
+		log.Printf("Failed to get user: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to get user information")
+		return
+	}
+
+	switch err := models.AddToWishlist(r.Context(), discordID, uploadID, config.AppConfig.WishlistSize); err {
+	case nil:
+	case models.ErrAlreadyOwned:
+		apiError(w, http.StatusConflict, codeAlreadyOwned, "You already have this wallpaper")
+		return
+	case models.ErrWishlistFull:
+		apiError(w, http.StatusConflict, codeLimitReached, "Your wishlist is full")
+		return
+	default:
+		log.Printf("Failed to add upload %d to wishlist of user %s (ID: %s): %v", uploadID, username, discordID, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update wishlist")
+		return
+	}
+	writeWishlist(w, r, discordID)
+}
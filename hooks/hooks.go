@@ -0,0 +1,166 @@
+// Package hooks lets operators add their own checks to the upload pipeline
+// without changing handler code. Checks run at three stages: before the
+// built-in validation, after the file is stored, and just before the upload
+// is published. They are either plugins compiled into the binary, registered
+// with Register, or external HTTP endpoints listed in upload_hooks.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+)
+
+// Pipeline stages hooks can run at
+const (
+	// PreValidate runs before the file type and content checks
+	PreValidate = "pre_validate"
+	// PostStore runs once the file is written to storage, before the upload
+	// is recorded
+	PostStore = "post_store"
+	// PreApprove runs last, with the duplicate check done, right before the
+	// upload is recorded and shown in the gallery
+	PreApprove = "pre_approve"
+)
+
+// Time allowed for a compiled-in plugin to decide
+const pluginTimeout = 10 * time.Second
+
+// ErrUnavailable is returned when a hook failed to give a verdict and isn't
+// configured to fail open
+var ErrUnavailable = errors.New("upload hook unavailable")
+
+// Upload describes the upload being checked. Fields that aren't known yet at
+// a stage are left empty.
+type Upload struct {
+	Stage       string   `json:"stage"`
+	DiscordID   string   `json:"discord_id"`
+	Username    string   `json:"username"`
+	Source      string   `json:"source"`
+	Filename    string   `json:"filename"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	License     string   `json:"license"`
+	ContentType string   `json:"content_type"`
+	Size        int64    `json:"size"`
+	Width       int      `json:"width,omitempty"`
+	Height      int      `json:"height,omitempty"`
+	SHA256      string   `json:"sha256,omitempty"`
+	PHash       string   `json:"phash,omitempty"`
+	DuplicateOf int64    `json:"duplicate_of,omitempty"`
+
+	// Image holds the file contents. It is rewound before each hook runs.
+	Image io.ReadSeeker `json:"-"`
+}
+
+// Verdict is a hook's decision on an upload. Reason is shown to the uploader
+// when the upload is rejected.
+type Verdict struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// Plugin is a check compiled into the binary
+type Plugin interface {
+	Name() string
+	Check(ctx context.Context, u *Upload) (Verdict, error)
+}
+
+// Rejection is returned by Run when a hook turned the upload down
+type Rejection struct {
+	Hook   string
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("rejected by upload hook %s: %s", r.Hook, r.Reason)
+}
+
+var plugins = map[string][]Plugin{}
+
+// Register adds a compiled-in plugin at a stage. It is meant to be called
+// from an init function, before the server starts handling uploads.
+func Register(stage string, p Plugin) {
+	if stage != PreValidate && stage != PostStore && stage != PreApprove {
+		panic("hooks: unknown stage " + stage)
+	}
+	plugins[stage] = append(plugins[stage], p)
+}
+
+// Run passes the upload through every hook for the stage, compiled-in
+// plugins first and then the configured HTTP hooks in order. It stops at the
+// first rejection, returning a *Rejection, or at the first hook that fails
+// without fail_open, returning an error wrapping ErrUnavailable. Spans for
+// each hook are recorded under the trace in ctx.
+func Run(ctx context.Context, stage string, u *Upload) error {
+	u.Stage = stage
+	defer rewind(u)
+
+	for _, p := range plugins[stage] {
+		rewind(u)
+		verdict, err := check(ctx, p, u)
+		if err != nil {
+			log.Printf("Upload hook %s failed at %s for '%s' by user %s (ID: %s): %v", p.Name(), stage, u.Filename, u.Username, u.DiscordID, err)
+			return fmt.Errorf("%w: %s: %v", ErrUnavailable, p.Name(), err)
+		}
+		if !verdict.Allow {
+			return reject(p.Name(), u, verdict)
+		}
+	}
+
+	for _, h := range config.AppConfig.UploadHooks {
+		if h.Stage != stage {
+			continue
+		}
+		rewind(u)
+		verdict, err := call(ctx, h, u)
+		if err != nil {
+			log.Printf("Upload hook %s failed at %s for '%s' by user %s (ID: %s): %v", h.URL, stage, u.Filename, u.Username, u.DiscordID, err)
+			if h.FailOpen {
+				continue
+			}
+			return fmt.Errorf("%w: %s: %v", ErrUnavailable, h.URL, err)
+		}
+		if !verdict.Allow {
+			return reject(h.URL, u, verdict)
+		}
+	}
+	return nil
+}
+
+// check asks a compiled-in plugin for its verdict. The plugin keeps its full
+// time even if the request that triggered the upload has gone away.
+func check(ctx context.Context, p Plugin, u *Upload) (Verdict, error) {
+	ctx, span := tracing.StartSpan(ctx, "hook "+p.Name(), tracing.KindInternal)
+	defer span.End()
+	span.SetAttribute("hook.stage", u.Stage)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pluginTimeout)
+	defer cancel()
+	verdict, err := p.Check(ctx, u)
+	span.SetError(err)
+	span.SetAttribute("hook.allow", verdict.Allow)
+	return verdict, err
+}
+
+func reject(hook string, u *Upload, verdict Verdict) error {
+	reason := verdict.Reason
+	if reason == "" {
+		reason = "This wallpaper was not accepted"
+	}
+	log.Printf("Upload hook %s rejected '%s' by user %s (ID: %s) at %s: %s", hook, u.Filename, u.Username, u.DiscordID, u.Stage, reason)
+	return &Rejection{Hook: hook, Reason: reason}
+}
+
+func rewind(u *Upload) {
+	if u.Image != nil {
+		u.Image.Seek(0, io.SeekStart)
+	}
+}
@@ -0,0 +1,93 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+)
+
+// Largest verdict read from a hook's response
+const maxVerdictBytes = 64 << 10
+
+// call posts the upload to an HTTP hook as multipart/form-data, with the
+// upload's details in payload_json and the image in file, signed like webhook
+// deliveries. The hook answers 2xx with a JSON Verdict; an empty body allows
+// the upload.
+func call(ctx context.Context, h config.UploadHook, u *Upload) (verdict Verdict, err error) {
+	ctx, span := tracing.StartSpan(ctx, "hook "+h.URL, tracing.KindClient)
+	defer func() {
+		span.SetError(err)
+		span.SetAttribute("hook.allow", verdict.Allow)
+		span.End()
+	}()
+	span.SetAttribute("hook.stage", u.Stage)
+
+	payload, err := json.Marshal(u)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("payload_json", string(payload)); err != nil {
+		return Verdict{}, err
+	}
+	if u.Image != nil {
+		part, err := mw.CreateFormFile("file", u.Filename)
+		if err != nil {
+			return Verdict{}, err
+		}
+		if _, err := io.Copy(part, u.Image); err != nil {
+			return Verdict{}, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return Verdict{}, err
+	}
+
+	// The hook's own timeout applies rather than the uploader's connection
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "POST", h.URL, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-Wallpaper-Hook-Stage", u.Stage)
+	tracing.Inject(ctx, req.Header)
+	if sig := webhooks.Signature(body.Bytes()); sig != "" {
+		req.Header.Set("X-Wallpaper-Signature", sig)
+	}
+
+	client := &http.Client{Timeout: time.Duration(h.TimeoutSeconds) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxVerdictBytes))
+		return Verdict{}, fmt.Errorf("hook responded %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxVerdictBytes))
+	if err != nil {
+		return Verdict{}, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return Verdict{Allow: true}, nil
+	}
+	if err := json.Unmarshal(data, &verdict); err != nil {
+		return Verdict{}, fmt.Errorf("invalid verdict: %w", err)
+	}
+	return verdict, nil
+}
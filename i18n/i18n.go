@@ -0,0 +1,201 @@
+// Package i18n translates the messages users see: API errors, upload
+// responses, notifications and the Discord bot's replies. Messages are
+// written in English in the code, and the English text is the key they are
+// looked up by in the catalog of each other locale, locales/<locale>.json.
+// Catalog keys may hold the fmt verbs %s, %q, %d and %v, so a message made
+// with fmt.Sprintf is found from its format: "Upload %d does not exist" is
+// the key for "Upload 42 does not exist". Their translations take the values
+// back by the same verbs, in the same order or numbered as in %[2]s.
+// Values taken by %s and %v are translated in turn, so a message may be built
+// from others. Messages missing from a catalog stay in English.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Locales messages are available in
+const (
+	English  = "en"
+	Japanese = "ja"
+)
+
+// Supported lists the locales there are messages in, English first
+var Supported = []string{English, Japanese}
+
+//go:embed locales/*.json
+var catalogFiles embed.FS
+
+// catalog holds a locale's translations by their keys, and those of formats
+// again as patterns matching the messages made from them
+type catalog struct {
+	messages map[string]string
+	formats  []format
+}
+
+type format struct {
+	pattern *regexp.Regexp
+	// nested holds, for each verb, whether its value may be a message itself
+	nested      []bool
+	translation string
+}
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]*catalog {
+	catalogs := make(map[string]*catalog)
+	for _, locale := range Supported[1:] {
+		data, err := catalogFiles.ReadFile(path.Join("locales", locale+".json"))
+		if err != nil {
+			panic(fmt.Sprintf("i18n: no catalog for %s: %v", locale, err))
+		}
+		var entries map[string]string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			panic(fmt.Sprintf("i18n: invalid catalog for %s: %v", locale, err))
+		}
+
+		c := &catalog{messages: entries}
+		var keys []string
+		for key := range entries {
+			if verbPattern.MatchString(key) {
+				keys = append(keys, key)
+			}
+		}
+		// Longer formats are more specific, so they are tried first
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) > len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		for _, key := range keys {
+			pattern, nested := formatPattern(key)
+			c.formats = append(c.formats, format{pattern: pattern, nested: nested, translation: entries[key]})
+		}
+		catalogs[locale] = c
+	}
+	return catalogs
+}
+
+// verbPattern matches the fmt verbs catalog keys and translations may hold,
+// with an optional argument index in translations
+var verbPattern = regexp.MustCompile(`%(?:\[(\d+)\])?[sqdv]`)
+
+// formatPattern turns a catalog key into a pattern matching the messages made
+// from it, capturing the value of each verb, and reports which of the values
+// are strings that may be messages too
+func formatPattern(key string) (*regexp.Regexp, []bool) {
+	var b strings.Builder
+	var nested []bool
+	b.WriteString("^")
+	last := 0
+	for _, loc := range verbPattern.FindAllStringIndex(key, -1) {
+		b.WriteString(regexp.QuoteMeta(key[last:loc[0]]))
+		verb := key[loc[1]-1]
+		switch verb {
+		case 'd':
+			b.WriteString(`(-?\d+)`)
+		case 'q':
+			b.WriteString(`("(?:[^"\\]|\\.)*")`)
+		default:
+			b.WriteString(`(.+?)`)
+		}
+		nested = append(nested, verb == 's' || verb == 'v')
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(key[last:]))
+	b.WriteString("$")
+	return regexp.MustCompile(b.String()), nested
+}
+
+// Translate returns message in the given locale, or unchanged when it is in
+// English or the locale's catalog doesn't have it
+func Translate(locale, message string) string {
+	c, ok := catalogs[locale]
+	if !ok || message == "" {
+		return message
+	}
+	if translation, ok := c.messages[message]; ok {
+		return translation
+	}
+	for _, f := range c.formats {
+		if values := f.pattern.FindStringSubmatch(message); values != nil {
+			values = values[1:]
+			for i, v := range values {
+				if f.nested[i] {
+					values[i] = Translate(locale, v)
+				}
+			}
+			return fill(f.translation, values)
+		}
+	}
+	return message
+}
+
+// Sprintf formats a message after translating its format, for messages put
+// together from parts
+func Sprintf(locale, format string, args ...interface{}) string {
+	if c, ok := catalogs[locale]; ok {
+		if translation, ok := c.messages[format]; ok {
+			format = translation
+		}
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// fill puts the values captured from a message into the verbs of its
+// translation, in order or by their index
+func fill(translation string, values []string) string {
+	next := 0
+	return verbPattern.ReplaceAllStringFunc(translation, func(verb string) string {
+		i := next
+		if m := verbPattern.FindStringSubmatch(verb); m[1] != "" {
+			n, _ := strconv.Atoi(m[1])
+			i = n - 1
+		}
+		next = i + 1
+		if i < 0 || i >= len(values) {
+			return verb
+		}
+		return values[i]
+	})
+}
+
+// IsSupported reports whether there are messages in a locale
+func IsSupported(locale string) bool {
+	return slices.Contains(Supported, locale)
+}
+
+// Negotiate picks the supported locale an Accept-Language header prefers
+// most, by language and ignoring region, so "ja-JP" picks Japanese. It
+// returns fallback when the header names none of them.
+func Negotiate(acceptLanguage, fallback string) string {
+	best, bestQ := fallback, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if language == "*" {
+			language = fallback
+		}
+		if q > bestQ && IsSupported(language) {
+			best, bestQ = language, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,137 @@
+package imaging
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Images are reduced to at most this many pixels per side before encoding;
+// the handful of cosine components a BlurHash keeps makes finer detail pointless
+const blurHashSampleSize = 64
+
+// Components along the long and short axes of the image
+const (
+	blurHashLongComponents  = 4
+	blurHashShortComponents = 3
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash encodes a compact BlurHash (https://blurha.sh) string for img that
+// clients can decode into a blurred placeholder while the real image loads
+func BlurHash(img image.Image) string {
+	small := Fit(img, blurHashSampleSize, blurHashSampleSize)
+	if _, ok := small.(*image.RGBA); !ok {
+		b := small.Bounds()
+		rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), small, b.Min, draw.Src)
+		small = rgba
+	}
+	pixels := small.(*image.RGBA)
+
+	b := pixels.Bounds()
+	width, height := b.Dx(), b.Dy()
+	componentsX, componentsY := blurHashLongComponents, blurHashShortComponents
+	if height > width {
+		componentsX, componentsY = componentsY, componentsX
+	}
+
+	// Convert once to linear light
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			o := pixels.PixOffset(b.Min.X+x, b.Min.Y+y)
+			linear[y*width+x] = [3]float64{
+				sRGBToLinear(pixels.Pix[o]),
+				sRGBToLinear(pixels.Pix[o+1]),
+				sRGBToLinear(pixels.Pix[o+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					px := linear[y*width+x]
+					factor[0] += basis * px[0]
+					factor[1] += basis * px[1]
+					factor[2] += basis * px[2]
+				}
+			}
+
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encodeBase83(&sb, (componentsX-1)+(componentsY-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := clampInt(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maximumValue = float64(quantisedMax+1) / 166
+		encodeBase83(&sb, quantisedMax, 1)
+	} else {
+		encodeBase83(&sb, 0, 1)
+	}
+
+	encodeBase83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		encodeBase83(&sb, quantiseAC(f[0], maximumValue)*19*19+quantiseAC(f[1], maximumValue)*19+quantiseAC(f[2], maximumValue), 2)
+	}
+	return sb.String()
+}
+
+func quantiseAC(v, maximumValue float64) int {
+	return clampInt(int(math.Floor(signPow(v/maximumValue, 0.5)*9+9.5)), 0, 18)
+}
+
+func encodeBase83(sb *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+}
+
+func sRGBToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func clampInt(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
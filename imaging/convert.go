@@ -0,0 +1,237 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoConverter is returned for work that needs an external converter when
+// none is configured
+var ErrNoConverter = errors.New("no image converter configured")
+
+// Converter runs an external program, such as ImageMagick or libvips, for the
+// images Go can't handle itself: it decodes AVIF and HEIC/HEIF, and encodes
+// WebP. Command reads an image on stdin and writes it to stdout, with every
+// "{format}" in its arguments replaced by the format wanted, png or webp.
+type Converter struct {
+	Command []string
+	Timeout time.Duration
+}
+
+var (
+	converter    atomic.Pointer[Converter]
+	registerHEIF sync.Once
+)
+
+// Major brands of the ftyp box AVIF and HEIF files start with, after the
+// box's size
+var (
+	avifBrands = []string{"avif", "avis"}
+	heifBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+)
+
+// UseConverter makes c the converter, or turns conversion off when c is nil.
+// The first converter registers AVIF and HEIF decoders with the image
+// package, so thumbnails, previews and the upload checks work for those
+// formats wherever images are decoded.
+func UseConverter(c *Converter) {
+	if c == nil || len(c.Command) == 0 {
+		converter.Store(nil)
+		return
+	}
+	converter.Store(c)
+	registerHEIF.Do(func() {
+		for name, brands := range map[string][]string{"avif": avifBrands, "heif": heifBrands} {
+			for _, brand := range brands {
+				image.RegisterFormat(name, "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+			}
+		}
+	})
+}
+
+// HasConverter reports whether an external converter is configured
+func HasConverter() bool {
+	return converter.Load() != nil
+}
+
+// convert runs the converter on the image read from r, returning it in format
+func convert(r io.Reader, format string) ([]byte, error) {
+	c := converter.Load()
+	if c == nil {
+		return nil, ErrNoConverter
+	}
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	args := make([]string, len(c.Command)-1)
+	for i, arg := range c.Command[1:] {
+		args[i] = strings.ReplaceAll(arg, "{format}", format)
+	}
+	cmd := exec.CommandContext(ctx, c.Command[0], args...)
+	cmd.Stdin = r
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("image converter: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("image converter: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// decodeHEIF decodes an AVIF or HEIF image by having the converter turn it
+// into a PNG
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	data, err := convert(r, "png")
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(data))
+}
+
+// decodeHEIFConfig reads the size of an AVIF or HEIF image from its ispe
+// boxes without running the converter, so the pixel limit is checked before
+// anything decodes the image. Files holding several images, such as
+// thumbnails or the tiles of a grid, report the largest.
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	if converter.Load() == nil {
+		return image.Config{}, ErrNoConverter
+	}
+	var width, height uint32
+	err := walkBoxes(r, func(typ string, body []byte) {
+		if typ != "ispe" || len(body) < 12 {
+			return
+		}
+		// A full box: version and flags, then the width and height
+		w, h := binary.BigEndian.Uint32(body[4:8]), binary.BigEndian.Uint32(body[8:12])
+		if uint64(w)*uint64(h) > uint64(width)*uint64(height) {
+			width, height = w, h
+		}
+	})
+	if err != nil {
+		return image.Config{}, err
+	}
+	if width == 0 || height == 0 {
+		return image.Config{}, errors.New("heif: no image size found")
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+// Boxes holding the boxes walkBoxes looks into, by type, with the size of
+// the fields before their children
+var containerBoxes = map[string]int{"meta": 4, "iprp": 0, "ipco": 0}
+
+// Largest box walkBoxes reads into memory; the boxes it looks for are small,
+// and it skips over the image data
+const maxBoxSize = 1 << 20
+
+// walkBoxes calls fn with the type and body of each ISO BMFF box in r,
+// descending into the boxes that hold image properties
+func walkBoxes(r io.Reader, fn func(typ string, body []byte)) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := uint64(binary.BigEndian.Uint32(header[:4]))
+		typ := string(header[4:8])
+		headerSize := uint64(8)
+		if size == 1 {
+			var large [8]byte
+			if _, err := io.ReadFull(r, large[:]); err != nil {
+				return err
+			}
+			size, headerSize = binary.BigEndian.Uint64(large[:]), 16
+		}
+		if size == 0 {
+			// The box runs to the end of the file; it holds the image data
+			return nil
+		}
+		if size < headerSize {
+			return fmt.Errorf("heif: bad size for %q box", typ)
+		}
+		bodySize := size - headerSize
+
+		skip, isContainer := containerBoxes[typ]
+		if !isContainer && typ != "ispe" {
+			if _, err := io.CopyN(io.Discard, r, int64(bodySize)); err != nil {
+				return err
+			}
+			continue
+		}
+		if bodySize > maxBoxSize {
+			return fmt.Errorf("heif: %q box is too large", typ)
+		}
+		body := make([]byte, bodySize)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		if !isContainer {
+			fn(typ, body)
+			continue
+		}
+		if len(body) < skip {
+			return fmt.Errorf("heif: %q box is too short", typ)
+		}
+		if err := walkBoxes(bytes.NewReader(body[skip:]), fn); err != nil {
+			return err
+		}
+	}
+}
+
+// GenerateWebP converts the image at srcPath to WebP with the converter and
+// writes it to destPath. Like thumbnails, the file only appears at destPath
+// once fully written.
+func GenerateWebP(srcPath, destPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	data, err := convert(src, "webp")
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte("RIFF")) || len(data) < 12 || string(data[8:12]) != "WEBP" {
+		return errors.New("image converter didn't write a WebP image")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), ".webp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destPath)
+}
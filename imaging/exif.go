@@ -0,0 +1,204 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// JPEG quality used when a photo has to be re-encoded to turn it upright
+const orientedQuality = 92
+
+// ErrInvalidJPEG is returned for JPEGs whose segment structure can't be parsed
+var ErrInvalidJPEG = errors.New("invalid JPEG structure")
+
+// JPEG markers
+const (
+	markerSOI   = 0xD8
+	markerSOS   = 0xDA
+	markerAPP1  = 0xE1
+	markerAPP2  = 0xE2
+	markerAPP13 = 0xED
+	markerCOM   = 0xFE
+)
+
+// CleanJPEG removes EXIF, XMP, IPTC and comment segments from a JPEG, which
+// can carry GPS coordinates and camera serial numbers. When the EXIF
+// orientation tag says the photo is stored rotated or mirrored, the pixels are
+// turned upright and re-encoded, since the tag that told viewers how to display
+// it is gone. Otherwise the image data is kept byte for byte. ICC colour
+// profiles are kept either way.
+func CleanJPEG(data []byte) ([]byte, error) {
+	segments, scan, err := splitJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := 1
+	var kept, profiles [][]byte
+	for _, seg := range segments {
+		switch seg[1] {
+		case markerAPP1:
+			if o := exifOrientation(seg[4:]); o != 0 {
+				orientation = o
+			}
+		case markerAPP13, markerCOM:
+		case markerAPP2:
+			if bytes.HasPrefix(seg[4:], []byte("ICC_PROFILE\x00")) {
+				profiles = append(profiles, seg)
+			}
+			kept = append(kept, seg)
+		default:
+			kept = append(kept, seg)
+		}
+	}
+
+	if orientation < 2 || orientation > 8 {
+		out := make([]byte, 0, len(data))
+		out = append(out, 0xFF, markerSOI)
+		for _, seg := range kept {
+			out = append(out, seg...)
+		}
+		return append(out, scan...), nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, Orient(img, orientation), &jpeg.Options{Quality: orientedQuality}); err != nil {
+		return nil, err
+	}
+	encoded := buf.Bytes()
+
+	// Carry the colour profile over, right after the encoder's SOI marker
+	out := make([]byte, 0, len(encoded))
+	out = append(out, encoded[:2]...)
+	for _, seg := range profiles {
+		out = append(out, seg...)
+	}
+	return append(out, encoded[2:]...), nil
+}
+
+// splitJPEG returns the marker segments of a JPEG up to its first scan, each
+// including its marker and length, and the remaining data from the scan on
+func splitJPEG(data []byte) ([][]byte, []byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, nil, ErrInvalidJPEG
+	}
+
+	var segments [][]byte
+	pos := 2
+	for {
+		// Markers may be preceded by any number of fill bytes
+		for pos+1 < len(data) && data[pos] == 0xFF && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, nil, ErrInvalidJPEG
+		}
+		marker := data[pos+1]
+		if marker == markerSOS {
+			return segments, data[pos:], nil
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// Standalone markers have no length
+			segments = append(segments, data[pos:pos+2])
+			pos += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, nil, ErrInvalidJPEG
+		}
+		segments = append(segments, data[pos:pos+2+length])
+		pos += 2 + length
+	}
+}
+
+// exifOrientation reads the orientation tag from the payload of an APP1
+// segment, returning 0 when it isn't EXIF or has no orientation
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// Orientation is a SHORT, stored in the first two bytes of the value
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// Orient applies an EXIF orientation (2-8) to img, returning the image as it
+// is meant to be displayed. Other values return img unchanged.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // needs a 90° clockwise turn
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // needs a 90° anticlockwise turn
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			copy(dst.Pix[dst.PixOffset(dx, dy):], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
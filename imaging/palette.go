@@ -0,0 +1,85 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"sort"
+)
+
+const (
+	// Images are reduced to at most this many pixels per side before their
+	// colors are counted
+	paletteSampleSize = 64
+	// Most colors kept in a palette
+	paletteSize = 5
+	// Pixels are grouped by the top bits of each channel
+	paletteBits = 4
+	// Colors closer than this (Euclidean RGB distance) to one already in the
+	// palette are skipped, so shades of one color don't crowd out the rest
+	paletteMinDistance = 48
+)
+
+// Palette returns the dominant colors of img as lowercase hex strings such as
+// "2b2d42", most common first. Pixels are grouped into coarse buckets and
+// each color is the average of a bucket.
+func Palette(img image.Image) []string {
+	small := Fit(img, paletteSampleSize, paletteSampleSize)
+	b := small.Bounds()
+
+	type bucket struct{ key, r, g, b, n int }
+	buckets := make(map[int]*bucket)
+	shift := 16 - paletteBits
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := small.At(x, y).RGBA()
+			if a < 0x8000 {
+				// Mostly transparent pixels don't show on a desktop
+				continue
+			}
+			key := int(r>>shift)<<(2*paletteBits) | int(g>>shift)<<paletteBits | int(bl>>shift)
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{key: key}
+				buckets[key] = bk
+			}
+			bk.r += int(r >> 8)
+			bk.g += int(g >> 8)
+			bk.b += int(bl >> 8)
+			bk.n++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].n != sorted[j].n {
+			return sorted[i].n > sorted[j].n
+		}
+		return sorted[i].key < sorted[j].key
+	})
+
+	var picked [][3]int
+	palette := []string{}
+	for _, bk := range sorted {
+		c := [3]int{bk.r / bk.n, bk.g / bk.n, bk.b / bk.n}
+		distinct := true
+		for _, p := range picked {
+			dr, dg, db := c[0]-p[0], c[1]-p[1], c[2]-p[2]
+			if dr*dr+dg*dg+db*db < paletteMinDistance*paletteMinDistance {
+				distinct = false
+				break
+			}
+		}
+		if !distinct {
+			continue
+		}
+		picked = append(picked, c)
+		palette = append(palette, fmt.Sprintf("%02x%02x%02x", c[0], c[1], c[2]))
+		if len(palette) == paletteSize {
+			break
+		}
+	}
+	return palette
+}
@@ -0,0 +1,92 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Difference hash grid: 9 columns produce 8 comparisons per row, 8 rows
+const (
+	hashWidth  = 9
+	hashHeight = 8
+)
+
+// Maximum samples taken along each axis of a grid cell when averaging
+const maxCellSamples = 16
+
+// DifferenceHash computes a 64-bit perceptual difference hash (dHash) of the
+// image read from r. Visually similar images produce hashes with a small
+// Hamming distance.
+func DifferenceHash(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return DifferenceHashImage(img), nil
+}
+
+// DifferenceHashImage computes the difference hash of an already decoded image
+func DifferenceHashImage(img image.Image) uint64 {
+	var grid [hashHeight][hashWidth]float64
+
+	bounds := img.Bounds()
+	cellW := float64(bounds.Dx()) / hashWidth
+	cellH := float64(bounds.Dy()) / hashHeight
+
+	for gy := 0; gy < hashHeight; gy++ {
+		for gx := 0; gx < hashWidth; gx++ {
+			grid[gy][gx] = cellLuminance(img, bounds,
+				float64(gx)*cellW, float64(gy)*cellH, cellW, cellH)
+		}
+	}
+
+	var hash uint64
+	for gy := 0; gy < hashHeight; gy++ {
+		for gx := 0; gx < hashWidth-1; gx++ {
+			hash <<= 1
+			if grid[gy][gx] > grid[gy][gx+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// cellLuminance returns the average luminance of a sampled region of the image
+func cellLuminance(img image.Image, bounds image.Rectangle, x0, y0, w, h float64) float64 {
+	stepsX := clampSamples(w)
+	stepsY := clampSamples(h)
+
+	var total float64
+	for sy := 0; sy < stepsY; sy++ {
+		y := bounds.Min.Y + int(y0+(float64(sy)+0.5)*h/float64(stepsY))
+		for sx := 0; sx < stepsX; sx++ {
+			x := bounds.Min.X + int(x0+(float64(sx)+0.5)*w/float64(stepsX))
+			r, g, b, _ := img.At(x, y).RGBA()
+			total += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+	return total / float64(stepsX*stepsY)
+}
+
+func clampSamples(size float64) int {
+	n := int(size)
+	if n < 1 {
+		return 1
+	}
+	if n > maxCellSamples {
+		return maxCellSamples
+	}
+	return n
+}
+
+// HammingDistance returns the number of differing bits between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
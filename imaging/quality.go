@@ -0,0 +1,179 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Quality sampling: the image is judged from up to qualityGrid×qualityGrid
+// tiles of qualityTile pixels, which the block size and every tested
+// upscaling factor, doubled, divide, so large images cost no more than small
+// ones
+const (
+	qualityTile = 240
+	qualityGrid = 5
+	jpegBlock   = 8
+)
+
+// Upscaling factors tested, smallest first
+var upscaleFactors = []int{2, 3, 4}
+
+// Thresholds of the quality heuristics. Blocking below blockingClean is
+// normal; at blockingHeavy and above the artifacts are as bad as they get.
+// Tiles with steps between pixels smaller than flatSteps on average, or
+// losing less than flatDetail when shrunk, are too flat to judge. An image
+// that loses less than upscaleTolerance as much detail when shrunk by a
+// factor as when shrunk by twice that was enlarged by it.
+const (
+	blockingClean    = 1.5
+	blockingHeavy    = 3.0
+	flatSteps        = 0.25
+	flatDetail       = 0.5
+	upscaleTolerance = 0.5
+	referencePixels  = 1920 * 1080
+)
+
+// HeavyBlocking is the Blocking from which JPEG artifacts are heavy
+const HeavyBlocking = 0.5
+
+// Quality is an estimate of how good an image looks at its size
+type Quality struct {
+	// Score runs from 0 to 100, 100 being a clean image that wasn't upscaled
+	// and has at least 1920×1080 pixels of detail
+	Score int
+	// Blocking runs from 0, no visible JPEG blocks, to 1, heavy ones
+	Blocking float64
+	// Upscale is how many times the image was enlarged from its source, 1
+	// when it wasn't
+	Upscale int
+	// EffectiveWidth and EffectiveHeight are the size of the source before
+	// it was upscaled
+	EffectiveWidth, EffectiveHeight int
+}
+
+// LowResolution reports whether the image has less detail than 1920×1080
+// pixels, which brings its score down
+func (q Quality) LowResolution() bool {
+	return q.EffectiveWidth*q.EffectiveHeight < referencePixels
+}
+
+// AssessQuality estimates an image's quality from the JPEG blocking in it and
+// the resolution its detail really has, which is lower than its size when a
+// small image was enlarged, e.g. a 4K canvas from a 720p source. Both are
+// heuristics: they are meant to pick out uploads worth a look, not to decide
+// on their own.
+func AssessQuality(img image.Image) Quality {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	q := Quality{Upscale: 1, EffectiveWidth: w, EffectiveHeight: h}
+
+	tiles := qualityTiles(img)
+	if len(tiles) > 0 {
+		q.Blocking = blocking(tiles)
+		// Compression heavy enough to leave blocks also throws away the fine
+		// detail upscaling is judged by, so such images are judged by the
+		// blocks alone
+		if q.Blocking < HeavyBlocking {
+			q.Upscale = upscale(tiles)
+			q.EffectiveWidth, q.EffectiveHeight = w/q.Upscale, h/q.Upscale
+		}
+	}
+
+	// Resolution is judged by side length, so 1280×720 scores two thirds
+	resolution := math.Min(1, math.Sqrt(float64(q.EffectiveWidth*q.EffectiveHeight)/referencePixels))
+	q.Score = int(math.Round(100 * (1 - q.Blocking) * resolution / float64(q.Upscale)))
+	return q
+}
+
+// qualityTiles samples the brightness of tiles spread evenly over the image.
+// Their origins are multiples of the JPEG block size, so block edges fall
+// where they would in the whole image. Images smaller than a tile give none.
+func qualityTiles(img image.Image) []*image.Gray {
+	b := img.Bounds()
+	cols := min(qualityGrid, b.Dx()/qualityTile)
+	rows := min(qualityGrid, b.Dy()/qualityTile)
+
+	var tiles []*image.Gray
+	for ty := 0; ty < rows; ty++ {
+		for tx := 0; tx < cols; tx++ {
+			origin := b.Min.Add(image.Pt(gridOrigin(tx, cols, b.Dx()), gridOrigin(ty, rows, b.Dy())))
+			tile := image.NewGray(image.Rect(0, 0, qualityTile, qualityTile))
+			draw.Draw(tile, tile.Bounds(), img, origin, draw.Src)
+			tiles = append(tiles, tile)
+		}
+	}
+	return tiles
+}
+
+// gridOrigin returns where the i-th of n tiles along a side of the given
+// length starts, rounded down to a block edge
+func gridOrigin(i, n, length int) int {
+	if n <= 1 {
+		return (length - qualityTile) / 2 / jpegBlock * jpegBlock
+	}
+	return i * (length - qualityTile) / (n - 1) / jpegBlock * jpegBlock
+}
+
+// blocking compares the steps between neighbouring pixels across JPEG block
+// edges with those inside blocks. Compression that throws away too much
+// leaves each block flat and the steps pile up on the edges.
+func blocking(tiles []*image.Gray) float64 {
+	var edge, inner float64
+	var edges, inners int
+	for _, t := range tiles {
+		for i := 0; i < qualityTile; i++ {
+			for j := 0; j+1 < qualityTile; j++ {
+				// Steps from pixel j to j+1 along row i and down column i
+				across := math.Abs(float64(t.Pix[i*qualityTile+j+1]) - float64(t.Pix[i*qualityTile+j]))
+				down := math.Abs(float64(t.Pix[(j+1)*qualityTile+i]) - float64(t.Pix[j*qualityTile+i]))
+				if (j+1)%jpegBlock == 0 {
+					edge += across + down
+					edges += 2
+				} else {
+					inner += across + down
+					inners += 2
+				}
+			}
+		}
+	}
+	if edges == 0 || inner/float64(inners) < flatSteps {
+		return 0
+	}
+	ratio := (edge / float64(edges)) / (inner / float64(inners))
+	return math.Max(0, math.Min(1, (ratio-blockingClean)/(blockingHeavy-blockingClean)))
+}
+
+// upscale returns the largest factor the image's detail survives shrinking
+// by and enlarging again, which is how many times it was enlarged, or 1
+func upscale(tiles []*image.Gray) int {
+	factor := 1
+	for _, f := range upscaleFactors {
+		coarse := resampleLoss(tiles, 2*f)
+		if coarse < flatDetail || resampleLoss(tiles, f)/coarse >= upscaleTolerance {
+			break
+		}
+		factor = f
+	}
+	return factor
+}
+
+// resampleLoss returns the mean difference between the tiles and the tiles
+// shrunk by factor and enlarged back, which is the detail finer than factor
+// pixels that they hold
+func resampleLoss(tiles []*image.Gray, factor int) float64 {
+	n := qualityTile / factor
+	small := image.NewGray(image.Rect(0, 0, n, n))
+	back := image.NewGray(image.Rect(0, 0, qualityTile, qualityTile))
+	var loss float64
+	for _, t := range tiles {
+		xdraw.CatmullRom.Scale(small, small.Bounds(), t, t.Bounds(), draw.Src, nil)
+		xdraw.CatmullRom.Scale(back, back.Bounds(), small, small.Bounds(), draw.Src, nil)
+		for i, v := range t.Pix {
+			loss += math.Abs(float64(v) - float64(back.Pix[i]))
+		}
+	}
+	return loss / float64(len(tiles)*qualityTile*qualityTile)
+}
@@ -0,0 +1,124 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// JPEG quality used for generated previews
+const thumbnailQuality = 85
+
+// GenerateThumbnail decodes the image at srcPath, scales it to fit within
+// maxDim x maxDim and writes it to destPath as a JPEG, stamped with watermark
+// unless it is empty. The file is written to a temporary path first so
+// readers never observe a partial thumbnail.
+func GenerateThumbnail(srcPath, destPath string, maxDim int, watermark string) error {
+	return GenerateResized(srcPath, destPath, maxDim, maxDim, false, watermark)
+}
+
+// GenerateResized decodes the image at srcPath and writes it to destPath as a
+// JPEG scaled down to fit within width x height or, with cover, to fill it
+// exactly, cropping the overflow from the centre. Images are never enlarged.
+// A non-empty watermark is stamped on the result. Like thumbnails, the file
+// only appears at destPath once fully written.
+func GenerateResized(srcPath, destPath string, width, height int, cover bool, watermark string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	if cover {
+		img = Cover(img, width, height)
+	} else {
+		img = Fit(img, width, height)
+	}
+	if watermark != "" {
+		if img, err = Watermark(img, watermark); err != nil {
+			return fmt.Errorf("failed to watermark image: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := jpeg.Encode(tmp, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode image: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), destPath)
+}
+
+// Fit scales img down to fit within maxW x maxH, preserving aspect ratio.
+// Images already small enough are returned unchanged.
+func Fit(img image.Image, maxW, maxH int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= maxW && b.Dy() <= maxH {
+		return img
+	}
+
+	dstW, dstH := FitSize(b.Dx(), b.Dy(), maxW, maxH)
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// FitSize returns the size Fit scales a w x h image to
+func FitSize(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	scale := float64(maxW) / float64(w)
+	if s := float64(maxH) / float64(h); s < scale {
+		scale = s
+	}
+	return max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+}
+
+// Cover scales and centre-crops img to fill width x height. When img is
+// smaller than that, the crop keeps the requested aspect ratio at the largest
+// size img allows instead of enlarging it.
+func Cover(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	scale := float64(width) / float64(w)
+	if s := float64(height) / float64(h); s > scale {
+		scale = s
+	}
+	if scale > 1 {
+		width = max(1, int(float64(width)/scale))
+		height = max(1, int(float64(height)/scale))
+		scale = 1
+	}
+
+	// The region of img that ends up in the result
+	cropW := min(w, int(float64(width)/scale+0.5))
+	cropH := min(h, int(float64(height)/scale+0.5))
+	x0 := b.Min.X + (w-cropW)/2
+	y0 := b.Min.Y + (h-cropH)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, image.Rect(x0, y0, x0+cropW, y0+cropH), draw.Src, nil)
+	return dst
+}
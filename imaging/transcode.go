@@ -0,0 +1,64 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// Canonical formats stored files can be transcoded to
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+// Errors returned for images that can't be transcoded
+var (
+	ErrUndecodable = errors.New("image can't be decoded")
+	ErrTransparent = errors.New("image has transparency, which JPEG can't keep")
+)
+
+// FormatExtension returns the extension files in a canonical format are
+// stored with
+func FormatExtension(format string) string {
+	if format == FormatJPEG {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+// InFormat reports whether a file is already in a canonical format, judging
+// by its extension as the upload checks matched it to its content
+func InFormat(ext, format string) bool {
+	ext = strings.ToLower(ext)
+	if format == FormatJPEG {
+		return ext == ".jpg" || ext == ".jpeg"
+	}
+	return ext == FormatExtension(format)
+}
+
+// Transcode decodes an image and writes it to w in a canonical format, JPEG
+// at the given quality or PNG at its best compression. Only the first frame
+// of animated images is kept, so callers leave those alone.
+func Transcode(r io.Reader, w io.Writer, format string, quality int) error {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUndecodable, err)
+	}
+	switch format {
+	case FormatJPEG:
+		if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+			return ErrTransparent
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case FormatPNG:
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		return enc.Encode(w, img)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
@@ -0,0 +1,72 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// Opacity of the watermark text, out of 255; its shadow is half as opaque
+	watermarkAlpha = 150
+	// Text height as a fraction of the image's shorter side, and the smallest
+	// height in pixels, so it stays legible on thumbnails
+	watermarkScale   = 0.05
+	watermarkMinSize = 10
+	// Most of the image's width the text may take up
+	watermarkMaxWidth = 0.6
+)
+
+var watermarkFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+// Watermark returns a copy of img with text stamped in its bottom-right
+// corner, scaled to the size of the image
+func Watermark(img image.Image, text string) (image.Image, error) {
+	f, err := watermarkFont()
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	size := max(float64(min(b.Dx(), b.Dy()))*watermarkScale, watermarkMinSize)
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	// Long text is shrunk to fit rather than running off the image
+	if width := font.MeasureString(face, text).Ceil(); float64(width) > float64(b.Dx())*watermarkMaxWidth {
+		face.Close()
+		size *= float64(b.Dx()) * watermarkMaxWidth / float64(width)
+		if face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull}); err != nil {
+			return nil, err
+		}
+	}
+	defer face.Close()
+
+	margin := int(size / 2)
+	width := font.MeasureString(face, text).Ceil()
+	descent := face.Metrics().Descent.Ceil()
+	x := b.Dx() - width - margin
+	y := b.Dy() - margin - descent
+	shadow := max(1, int(size/16))
+
+	d := &font.Drawer{Dst: dst, Face: face}
+	d.Src = image.NewUniform(color.NRGBA{A: watermarkAlpha / 2})
+	d.Dot = fixed.P(x+shadow, y+shadow)
+	d.DrawString(text)
+	d.Src = image.NewUniform(color.NRGBA{R: 255, G: 255, B: 255, A: watermarkAlpha})
+	d.Dot = fixed.P(x, y)
+	d.DrawString(text)
+	return dst, nil
+}
@@ -0,0 +1,186 @@
+package discordtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/Zinbhe/wallpaper-gacha/handlers"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+)
+
+// Client is a browser-like client of an Env: it keeps the session cookie and
+// sends the session's CSRF token with every request that changes something.
+// Requests that can't be made at all fail the test; the responses are left
+// for the test to judge.
+type Client struct {
+	HTTP *http.Client
+
+	env  *Env
+	csrf string
+}
+
+// NewClient returns a signed-out client of the server
+func (e *Env) NewClient() *Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		e.t.Fatalf("discordtest: failed to create cookie jar: %v", err)
+	}
+	return &Client{HTTP: &http.Client{Jar: jar}, env: e}
+}
+
+// Login signs in as the account with the given ID through the server's OAuth
+// flow and the stub provider, as a browser would, and returns the status the
+// flow ended with: 200 once signed in, or the server's refusal, such as 403
+// for an account outside the allowed guilds
+func (c *Client) Login(accountID string) int {
+	c.env.t.Helper()
+
+	// The server redirects to the provider's authorize page, which signs in
+	// as the account named by ?user= instead of asking
+	noRedirect := *c.HTTP
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := noRedirect.Get(c.env.URL + "/auth/login")
+	if err != nil {
+		c.env.t.Fatalf("discordtest: login failed: %v", err)
+	}
+	resp.Body.Close()
+	authorize, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusTemporaryRedirect {
+		c.env.t.Fatalf("discordtest: login answered %s without a redirect to the provider", resp.Status)
+	}
+	q := authorize.Query()
+	q.Set("user", accountID)
+	authorize.RawQuery = q.Encode()
+
+	resp, err = c.HTTP.Get(authorize.String())
+	if err != nil {
+		c.env.t.Fatalf("discordtest: login failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode
+	}
+	c.csrf = c.csrfToken()
+	return resp.StatusCode
+}
+
+var csrfMeta = regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`)
+
+// csrfToken reads the session's CSRF token from the upload page, where the
+// site's own scripts find it
+func (c *Client) csrfToken() string {
+	resp := c.Do("GET", "/upload", nil, "")
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	m := csrfMeta.FindSubmatch(body)
+	if m == nil {
+		c.env.t.Fatalf("discordtest: no CSRF token on the upload page (%s)", resp.Status)
+	}
+	return string(m[1])
+}
+
+// Do sends a request to path on the server, with the CSRF token once signed
+// in. The caller closes the response body.
+func (c *Client) Do(method, path string, body io.Reader, contentType string) *http.Response {
+	c.env.t.Helper()
+	req, err := http.NewRequest(method, c.env.URL+path, body)
+	if err != nil {
+		c.env.t.Fatalf("discordtest: invalid request %s %s: %v", method, path, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.csrf != "" {
+		req.Header.Set(middleware.CSRFHeader, c.csrf)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		c.env.t.Fatalf("discordtest: %s %s failed: %v", method, path, err)
+	}
+	return resp
+}
+
+// JSON sends in, unless nil, as a JSON request body and decodes the response
+// into out, unless nil, returning the response's status
+func (c *Client) JSON(method, path string, in, out interface{}) int {
+	c.env.t.Helper()
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			c.env.t.Fatalf("discordtest: invalid request body for %s %s: %v", method, path, err)
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+	resp := c.Do(method, path, body, contentType)
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.env.t.Fatalf("discordtest: invalid response to %s %s (%s): %v", method, path, resp.Status, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Upload uploads an image through /api/upload with the given form fields,
+// such as title and tags, returning the response and its status
+func (c *Client) Upload(filename string, data []byte, fields map[string]string) (handlers.UploadResponse, int) {
+	c.env.t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, err := form.CreateFormFile("wallpaper", filename)
+	if err != nil {
+		c.env.t.Fatalf("discordtest: failed to build upload: %v", err)
+	}
+	part.Write(data)
+	form.Close()
+
+	resp := c.Do("POST", "/api/upload", &body, form.FormDataContentType())
+	defer resp.Body.Close()
+	var out handlers.UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		c.env.t.Fatalf("discordtest: invalid upload response (%s): %v", resp.Status, err)
+	}
+	return out, resp.StatusCode
+}
+
+// PNG returns a width by height PNG of blocks shaded at random from seed, so
+// images with different seeds aren't refused as duplicates of each other
+func PNG(t testing.TB, width, height int, seed uint64) []byte {
+	t.Helper()
+	const blocks = 8
+	rng := rand.New(rand.NewPCG(seed, seed))
+	var shades [blocks][blocks]color.RGBA
+	for i := range shades {
+		for j := range shades[i] {
+			shades[i][j] = color.RGBA{uint8(rng.IntN(256)), uint8(rng.IntN(256)), uint8(rng.IntN(256)), 255}
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, shades[y*blocks/height][x*blocks/width])
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("discordtest: failed to encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
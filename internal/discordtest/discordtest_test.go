@@ -0,0 +1,233 @@
+package discordtest_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/handlers"
+	"github.com/Zinbhe/wallpaper-gacha/internal/discordtest"
+)
+
+const (
+	aliceID    = "200000000000000002"
+	bobID      = "200000000000000003"
+	outsiderID = "200000000000000009"
+)
+
+func TestLogin(t *testing.T) {
+	env := discordtest.Start(t, nil)
+
+	c := env.NewClient()
+	if status := c.Login(aliceID); status != http.StatusOK {
+		t.Fatalf("login: %d, want 200", status)
+	}
+	var user struct {
+		DiscordID string `json:"discord_id"`
+		Username  string `json:"username"`
+		GuildID   string `json:"guild_id"`
+		CanUpload bool   `json:"can_upload"`
+	}
+	if status := c.JSON("GET", "/api/user", nil, &user); status != http.StatusOK {
+		t.Fatalf("GET /api/user: %d, want 200", status)
+	}
+	if user.DiscordID != aliceID || user.Username != "test-alice" || user.GuildID != config.TestGuildID || !user.CanUpload {
+		t.Errorf("signed in as %+v, want test-alice in the test guild, allowed to upload", user)
+	}
+
+	// Accounts outside the allowed guilds are refused
+	if status := env.NewClient().Login(outsiderID); status != http.StatusForbidden {
+		t.Errorf("outsider login: %d, want 403", status)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	env := discordtest.Start(t, nil)
+	c := env.NewClient()
+	c.Login(aliceID)
+
+	resp, status := c.Upload("mountains.png", discordtest.PNG(t, 1920, 1080, 1), map[string]string{"title": "Mountains"})
+	if status != http.StatusOK || !resp.Success {
+		t.Fatalf("upload: %d %+v, want 200", status, resp)
+	}
+
+	var mine struct {
+		Uploads []handlers.MyUploadResponse `json:"uploads"`
+	}
+	if status := c.JSON("GET", "/api/me/uploads", nil, &mine); status != http.StatusOK {
+		t.Fatalf("GET /api/me/uploads: %d, want 200", status)
+	}
+	if len(mine.Uploads) != 1 || mine.Uploads[0].Title != "Mountains" || mine.Uploads[0].Filename != resp.Filename {
+		t.Errorf("uploads = %+v, want the one just made", mine.Uploads)
+	}
+
+	// Files that aren't images are refused, whatever they are called
+	bob := env.NewClient()
+	bob.Login(bobID)
+	resp, status = bob.Upload("fake.png", []byte("plain text, not a picture at all"), nil)
+	if status != http.StatusBadRequest || resp.Code == "" {
+		t.Errorf("upload of text: %d %+v, want 400 with a code", status, resp)
+	}
+}
+
+func TestUploadCooldown(t *testing.T) {
+	env := discordtest.Start(t, map[string]interface{}{"upload_cooldown_minutes": 5})
+	c := env.NewClient()
+	if status := c.Login(config.TestAdminID); status != http.StatusOK {
+		t.Fatalf("login: %d", status)
+	}
+	if _, status := c.Upload("a.png", discordtest.PNG(t, 1920, 1080, 1), nil); status != http.StatusOK {
+		t.Fatalf("first upload: %d", status)
+	}
+
+	resp, status := c.Upload("b.png", discordtest.PNG(t, 1920, 1080, 2), nil)
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("second upload: %d, want 429", status)
+	}
+	if resp.CooldownSecs <= 0 || resp.CooldownSecs > 5*60 {
+		t.Errorf("cooldown = %ds, want up to 5 minutes", resp.CooldownSecs)
+	}
+
+	// The cooldown is the uploader's own
+	alice := env.NewClient()
+	alice.Login(aliceID)
+	if _, status := alice.Upload("c.png", discordtest.PNG(t, 1920, 1080, 3), nil); status != http.StatusOK {
+		t.Errorf("another user's upload: %d, want 200", status)
+	}
+}
+
+// heic returns the leading boxes of a HEIC file of the given size: enough
+// for the upload checks to recognize it and read its size
+func heic(width, height uint32) []byte {
+	box := func(typ string, body ...[]byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(8+len(bytes.Join(body, nil))))
+		return append(append(b, typ...), bytes.Join(body, nil)...)
+	}
+	fullBox := []byte{0, 0, 0, 0}
+	ispe := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(fullBox, width), height)
+	return append(
+		box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")),
+		box("meta", fullBox, box("iprp", box("ipco", box("ispe", ispe))))...,
+	)
+}
+
+func TestHEICWithImageConverter(t *testing.T) {
+	// The converter stands in for ImageMagick, writing a fixed PNG or WebP
+	dir := t.TempDir()
+	pngPath, webpPath := filepath.Join(dir, "out.png"), filepath.Join(dir, "out.webp")
+	os.WriteFile(pngPath, discordtest.PNG(t, 1920, 1080, 1), 0644)
+	os.WriteFile(webpPath, []byte("RIFF\x04\x00\x00\x00WEBP"), 0644)
+	script := `cat >/dev/null; if [ "$0" = webp ]; then cat "$1"; else cat "$2"; fi`
+	env := discordtest.Start(t, map[string]interface{}{
+		"image_converter":  map[string]interface{}{"command": []string{"sh", "-c", script, "{format}", webpPath, pngPath}, "webp": true},
+		"max_image_pixels": 10_000_000,
+	})
+	c := env.NewClient()
+	c.Login(aliceID)
+
+	// The size in the file is checked before the converter runs
+	if resp, status := c.Upload("huge.heic", heic(10000, 10000), nil); status != http.StatusBadRequest || resp.Code == "" {
+		t.Errorf("upload of 10000x10000 HEIC: %d %+v, want 400", status, resp)
+	}
+	if resp, status := c.Upload("phone.heic", heic(1920, 1080), nil); status != http.StatusOK {
+		t.Fatalf("upload: %d %+v, want 200", status, resp)
+	}
+	var mine struct {
+		Uploads []handlers.MyUploadResponse `json:"uploads"`
+	}
+	c.JSON("GET", "/api/me/uploads", nil, &mine)
+	if len(mine.Uploads) != 1 {
+		t.Fatalf("uploads = %+v, want the HEIC one", mine.Uploads)
+	}
+	path := fmt.Sprintf("/images/%d", mine.Uploads[0].ID)
+
+	resp := c.Do("GET", path+"/thumb", nil, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("thumbnail: %d %s, want a JPEG", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	for accept, want := range map[string]string{"image/webp,*/*": "image/webp", "image/heic,image/webp": "image/heic"} {
+		req, _ := http.NewRequest("GET", env.URL+path, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != want {
+			t.Errorf("original with Accept %s: %d %s, want %s", accept, resp.StatusCode, resp.Header.Get("Content-Type"), want)
+		}
+	}
+}
+
+func TestFeedWithAPIToken(t *testing.T) {
+	env := discordtest.Start(t, nil)
+	c := env.NewClient()
+	c.Login(aliceID)
+	var created struct {
+		Token string `json:"token"`
+	}
+	if status := c.JSON("POST", "/api/tokens", map[string]string{"name": "rss bot"}, &created); status != http.StatusCreated {
+		t.Fatalf("creating token: %d, want 201", status)
+	}
+
+	// A bot has the token but no session
+	for path, want := range map[string]int{"/api/feed.xml": http.StatusOK, "/feed.xml": http.StatusUnauthorized} {
+		req, _ := http.NewRequest("GET", env.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+created.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s with a token: %d, want %d", path, resp.StatusCode, want)
+		} else if want == http.StatusOK && !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/rss+xml") {
+			t.Errorf("%s content type = %s, want RSS", path, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestTwoStepPullHiddenUntilRevealed(t *testing.T) {
+	env := discordtest.Start(t, nil)
+	admin := env.NewClient()
+	admin.Login(config.TestAdminID)
+	if _, status := admin.Upload("a.png", discordtest.PNG(t, 1920, 1080, 1), nil); status != http.StatusOK {
+		t.Fatalf("upload: %d", status)
+	}
+
+	c := env.NewClient()
+	c.Login(aliceID)
+	var started struct {
+		RevealToken string `json:"reveal_token"`
+	}
+	if status := c.JSON("POST", "/api/pulls/start", nil, &started); status != http.StatusOK {
+		t.Fatalf("POST /api/pulls/start: %d, want 200", status)
+	}
+	var history struct {
+		Pulls []handlers.PullHistoryEntryResponse `json:"pulls"`
+		Total int                                 `json:"total"`
+	}
+	if status := c.JSON("GET", "/api/pulls/history", nil, &history); status != http.StatusOK {
+		t.Fatalf("GET /api/pulls/history: %d, want 200", status)
+	}
+	if history.Total != 0 || len(history.Pulls) != 0 {
+		t.Errorf("history before the reveal = %+v, want it empty", history)
+	}
+
+	var revealed handlers.PullResponse
+	if status := c.JSON("POST", "/api/pulls/reveal", map[string]string{"reveal_token": started.RevealToken}, &revealed); status != http.StatusOK {
+		t.Fatalf("POST /api/pulls/reveal: %d, want 200", status)
+	}
+	c.JSON("GET", "/api/pulls/history", nil, &history)
+	if history.Total != 1 || len(history.Pulls) != 1 || history.Pulls[0].ID != revealed.ID {
+		t.Errorf("history after the reveal = %+v, want pull %d", history, revealed.ID)
+	}
+}
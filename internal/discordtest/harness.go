@@ -0,0 +1,164 @@
+// Package discordtest runs the whole server in-process for end-to-end tests:
+// the routes and middleware of production, a temporary SQLite database and
+// upload directory, and a stub of Discord's OAuth and API that signs in as
+// any of Accounts. Tests drive it over HTTP with a Client, through sign-in,
+// uploads, cooldowns and pulls.
+//
+// The server keeps its state in package variables, such as the loaded
+// configuration and the database, so only one Env can run at a time and
+// tests using it must not call t.Parallel.
+package discordtest
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/processing"
+	"github.com/Zinbhe/wallpaper-gacha/routes"
+)
+
+// Env is a running server and the stub provider it signs in with
+type Env struct {
+	// URL is the server's base URL, such as http://127.0.0.1:41234
+	URL string
+	// ProviderURL is the base URL of the stub Discord API
+	ProviderURL string
+	// Dir holds the configuration, database and uploads, and is removed
+	// when the test ends
+	Dir string
+
+	t        testing.TB
+	server   *httptest.Server
+	provider *httptest.Server
+}
+
+// processingOnce starts the image processing workers, which can't be
+// stopped, once for every Env of the process
+var processingOnce sync.Once
+
+// Start configures and starts the server for a test, stopping it when the
+// test ends. It runs with test mode's settings: a Discord application only
+// the stub knows, its two guilds and config.TestAdminID as the admin. The
+// settings in cfg, keyed as in the config file, are applied first, so
+// {"upload_cooldown_minutes": 5} tests cooldowns. Background jobs such as
+// the scheduler, webhooks and the content safety checker don't run.
+func Start(t testing.TB, cfg map[string]interface{}) *Env {
+	t.Helper()
+	dir := t.TempDir()
+
+	// The redirect URI names the server's address, so it is known before
+	// the configuration is loaded
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("discordtest: failed to listen: %v", err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	settings := maps.Clone(cfg)
+	if settings == nil {
+		settings = make(map[string]interface{})
+	}
+	settings["server_host"], settings["server_port"] = addr.IP.String(), addr.Port
+
+	configFile := filepath.Join(dir, "config.json")
+	data, err := json.Marshal(settings)
+	if err != nil {
+		listener.Close()
+		t.Fatalf("discordtest: invalid settings: %v", err)
+	}
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		listener.Close()
+		t.Fatalf("discordtest: failed to write config: %v", err)
+	}
+	if err := config.LoadTestMode(configFile, filepath.Join(dir, "uploads")); err != nil {
+		listener.Close()
+		t.Fatalf("discordtest: invalid config: %v", err)
+	}
+	// A file rather than test mode's in-memory database, so it can be
+	// inspected after a failure
+	config.AppConfig.DatabasePath = filepath.Join(dir, "wallpapers.db")
+
+	env := &Env{Dir: dir, t: t}
+	env.provider = httptest.NewServer(NewProvider())
+	env.ProviderURL = env.provider.URL + "/api"
+	discord.UseAPI(env.ProviderURL)
+
+	if err := env.init(); err != nil {
+		listener.Close()
+		env.provider.Close()
+		t.Fatalf("discordtest: %v", err)
+	}
+	handler, err := routes.New()
+	if err != nil {
+		listener.Close()
+		env.close()
+		t.Fatalf("discordtest: failed to set up routes: %v", err)
+	}
+
+	env.server = httptest.NewUnstartedServer(handler)
+	env.server.Listener.Close()
+	env.server.Listener = listener
+	env.server.Start()
+	env.URL = env.server.URL
+	t.Cleanup(env.close)
+	return env
+}
+
+// init opens the database and session store and loads the settings admins
+// keep in the database, as the server does as it starts
+func (e *Env) init() error {
+	cfg := config.AppConfig
+	err := models.InitDatabase(context.Background(), cfg.DatabaseDriver, cfg.DatabaseDSN(), models.PoolOptions{
+		BusyTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	if err := models.AssignDefaultGuild(context.Background(), cfg.DefaultGuildID); err != nil {
+		return err
+	}
+	if err := middleware.InitSessionStore(); err != nil {
+		return err
+	}
+	// Clients talk plain HTTP to localhost
+	middleware.Store.Options.Secure = false
+	if err := os.MkdirAll(cfg.UploadDirectory, 0755); err != nil {
+		return err
+	}
+	processingOnce.Do(func() {
+		processing.Init(cfg.ProcessingWorkers, cfg.ProcessingQueueSize, 0)
+	})
+	// These also clear what an earlier Env left behind
+	if ic := cfg.ImageConverter; len(ic.Command) > 0 {
+		imaging.UseConverter(&imaging.Converter{Command: ic.Command, Timeout: time.Duration(ic.TimeoutSeconds) * time.Second})
+	} else {
+		imaging.UseConverter(nil)
+	}
+	if err := jobs.LoadRarityRateOverrides(); err != nil {
+		return err
+	}
+	return jobs.LoadMaintenanceMode()
+}
+
+func (e *Env) close() {
+	if e.server != nil {
+		e.server.Close()
+	}
+	e.provider.Close()
+	if err := models.Close(); err != nil {
+		e.t.Logf("discordtest: failed to close database: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package discordtest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
+)
+
+// Account is an identity the fake provider can sign in as
+type Account struct {
+	ID          string
+	Username    string
+	DisplayName string
+	InGuild     bool
+	OtherGuilds []string
+	Roles       []string
+}
+
+// Accounts lists every identity offered by the fake provider. The outsider is
+// not a member of the allowed guild, for testing rejected logins; bob lacks
+// the uploader role, for testing role-restricted uploads. Alice is in the
+// second guild too, without its uploader role, for testing guild switching.
+var Accounts = []Account{
+	{ID: config.TestAdminID, Username: "test-admin", DisplayName: "Test Admin", InGuild: true, Roles: []string{config.TestUploaderRoleID}},
+	{ID: "200000000000000002", Username: "test-alice", DisplayName: "Test Alice", InGuild: true, OtherGuilds: []string{config.TestSecondGuildID}, Roles: []string{config.TestUploaderRoleID}},
+	{ID: "200000000000000003", Username: "test-bob", DisplayName: "Test Bob", InGuild: true, Roles: []string{}},
+	{ID: "200000000000000009", Username: "test-outsider", DisplayName: "Test Outsider", InGuild: false, Roles: []string{}},
+}
+
+func findAccount(id string) (Account, bool) {
+	for _, a := range Accounts {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Account{}, false
+}
+
+// Token handed out for an account; deterministic so tests can call the
+// provider directly
+func accessToken(id string) string {
+	return "test-token-" + id
+}
+
+type authorization struct {
+	accountID string
+	challenge string
+}
+
+// provider imitates the subset of Discord's OAuth and API used by the server
+type provider struct {
+	mu      sync.Mutex
+	codes   map[string]authorization
+	refresh map[string]string // refresh token -> account ID
+	members map[string]bool   // account ID -> in the allowed guild
+}
+
+// NewProvider returns a stub of Discord's OAuth, token, user and guild
+// endpoints under /api, signing in as any of Accounts. It answers for the
+// Discord application in config.AppConfig, so the configuration must be
+// loaded before it takes requests.
+func NewProvider() http.Handler {
+	p := &provider{
+		codes:   make(map[string]authorization),
+		refresh: make(map[string]string),
+		members: make(map[string]bool),
+	}
+	for _, a := range Accounts {
+		p.members[a.ID] = a.InGuild
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/oauth2/authorize", p.authorize)
+	mux.HandleFunc("POST /api/oauth2/token", p.token)
+	mux.HandleFunc("GET /api/users/@me", p.user)
+	mux.HandleFunc("GET /api/users/@me/guilds", p.guilds)
+	mux.HandleFunc("GET /api/users/@me/guilds/{guild}/member", p.member)
+	mux.HandleFunc("POST /api/test/guild/{action}", p.setMembership)
+	mux.HandleFunc("POST /api/test/membership-check", p.runMembershipCheck)
+	return mux
+}
+
+var chooserPage = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html><head><title>Fake Discord login</title></head>
+<body>
+<h1>Fake Discord login</h1>
+<ul>
+{{range .}}<li><a id="login-{{.Username}}" href="{{.URL}}">{{.Username}}</a></li>
+{{end}}</ul>
+</body></html>`))
+
+// authorize signs in as the account named by ?user=, or shows a page listing
+// the accounts for browser tests to pick from
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != config.AppConfig.DiscordClientID || q.Get("redirect_uri") != config.AppConfig.DiscordRedirectURI {
+		http.Error(w, "unknown client or redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE S256 challenge required", http.StatusBadRequest)
+		return
+	}
+
+	userID := q.Get("user")
+	if userID == "" {
+		type choice struct{ Username, URL string }
+		var choices []choice
+		for _, a := range Accounts {
+			q.Set("user", a.ID)
+			choices = append(choices, choice{a.Username, r.URL.Path + "?" + q.Encode()})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		chooserPage.Execute(w, choices)
+		return
+	}
+	if _, ok := findAccount(userID); !ok {
+		http.Error(w, "unknown user", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+	p.mu.Lock()
+	p.codes[code] = authorization{accountID: userID, challenge: q.Get("code_challenge")}
+	p.mu.Unlock()
+
+	redirect, _ := url.Parse(config.AppConfig.DiscordRedirectURI)
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges a single-use code or refresh token for an access token and
+// a new refresh token, checking the client credentials and the PKCE verifier
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("client_id") != config.AppConfig.DiscordClientID || r.PostForm.Get("client_secret") != config.AppConfig.DiscordClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var accountID string
+	p.mu.Lock()
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		auth, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if ok && base64.RawURLEncoding.EncodeToString(sum[:]) == auth.challenge {
+			accountID = auth.accountID
+		}
+	case "refresh_token":
+		// Refresh tokens are single-use, as they are on Discord
+		accountID = p.refresh[r.PostForm.Get("refresh_token")]
+		delete(p.refresh, r.PostForm.Get("refresh_token"))
+	}
+	if accountID == "" {
+		p.mu.Unlock()
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	refreshToken := "test-refresh-" + hex.EncodeToString(b)
+	p.refresh[refreshToken] = accountID
+	p.mu.Unlock()
+
+	writeProviderJSON(w, map[string]interface{}{
+		"access_token":  accessToken(accountID),
+		"token_type":    "Bearer",
+		"refresh_token": refreshToken,
+		"expires_in":    604800,
+	})
+}
+
+// bearerAccount resolves the account behind the request's access token
+func bearerAccount(r *http.Request) (Account, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return findAccount(strings.TrimPrefix(token, "test-token-"))
+}
+
+func (p *provider) user(w http.ResponseWriter, r *http.Request) {
+	account, ok := bearerAccount(r)
+	if !ok {
+		http.Error(w, `{"message":"401: Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	writeProviderJSON(w, map[string]string{"id": account.ID, "username": account.Username, "global_name": account.DisplayName})
+}
+
+func (p *provider) guilds(w http.ResponseWriter, r *http.Request) {
+	account, ok := bearerAccount(r)
+	if !ok {
+		http.Error(w, `{"message":"401: Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	p.mu.Lock()
+	inGuild := p.members[account.ID]
+	p.mu.Unlock()
+
+	guilds := []map[string]string{}
+	if inGuild {
+		guilds = append(guilds, map[string]string{"id": config.TestGuildID, "name": config.AppConfig.GuildName(config.TestGuildID)})
+		for _, id := range account.OtherGuilds {
+			guilds = append(guilds, map[string]string{"id": id, "name": config.AppConfig.GuildName(id)})
+		}
+	}
+	writeProviderJSON(w, guilds)
+}
+
+func (p *provider) member(w http.ResponseWriter, r *http.Request) {
+	account, ok := bearerAccount(r)
+	if !ok {
+		http.Error(w, `{"message":"401: Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	p.mu.Lock()
+	inGuild := p.members[account.ID]
+	p.mu.Unlock()
+
+	guild := r.PathValue("guild")
+	if !inGuild || (guild != config.TestGuildID && !slices.Contains(account.OtherGuilds, guild)) {
+		http.Error(w, `{"message":"Unknown Guild"}`, http.StatusNotFound)
+		return
+	}
+	// Roles are only held in the first guild
+	roles := account.Roles
+	if guild != config.TestGuildID {
+		roles = []string{}
+	}
+	writeProviderJSON(w, map[string]interface{}{"roles": roles})
+}
+
+// setMembership makes the account named by ?user= join or leave the allowed
+// guild, for testing what happens to users who leave after signing in
+func (p *provider) setMembership(w http.ResponseWriter, r *http.Request) {
+	account, ok := findAccount(r.URL.Query().Get("user"))
+	if !ok {
+		http.Error(w, "unknown user", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch r.PathValue("action") {
+	case "join":
+		p.members[account.ID] = true
+	case "leave":
+		p.members[account.ID] = false
+	default:
+		http.Error(w, "action must be join or leave", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runMembershipCheck re-verifies every signed-in user's guild membership now
+// rather than waiting for the background schedule
+func (p *provider) runMembershipCheck(w http.ResponseWriter, r *http.Request) {
+	// Verification times have one-second resolution; look a second ahead so
+	// users who signed in just now are included
+	if err := jobs.VerifyGuildMembership(-time.Second); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeProviderJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
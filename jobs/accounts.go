@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// DeleteRequestedAccounts deletes accounts whose deletion was requested more
+// than grace ago. Their uploads are purged straight away rather than waiting
+// out the trash retention. Accounts that fail to delete are logged and
+// retried on the next run.
+func DeleteRequestedAccounts(grace time.Duration) error {
+	ctx := context.Background()
+	ids, err := models.ListAccountsDueForDeletion(ctx, time.Now().Add(-grace))
+	if err != nil {
+		return fmt.Errorf("failed to list accounts: %w", err)
+	}
+
+	failed := 0
+	for _, id := range ids {
+		deleted, err := models.DeleteAccount(ctx, id)
+		if err != nil {
+			log.Printf("Account deletion: failed to delete account %s: %v", id, err)
+			failed++
+			continue
+		}
+
+		if _, err := middleware.Store.Backend.DeleteUser(id); err != nil {
+			log.Printf("Account deletion: failed to delete sessions of account %s: %v", id, err)
+		}
+		for _, uploadID := range deleted.Uploads {
+			orphaned, err := models.PurgeUpload(ctx, uploadID)
+			if err != nil {
+				log.Printf("Account deletion: failed to purge upload %d of account %s: %v", uploadID, id, err)
+				continue
+			}
+			storage.Remove(orphaned)
+		}
+		for _, filename := range deleted.Drafts {
+			storage.RemoveDraft(filename)
+		}
+		for _, filename := range deleted.Partials {
+			storage.RemovePartial(filename)
+		}
+
+		entry := &models.AuditEntry{
+			ActorID: "system",
+			Action:  models.AuditAccountDelete,
+			Target:  "user:" + id,
+		}
+		if err := models.RecordAudit(ctx, entry); err != nil {
+			log.Printf("Account deletion: failed to record audit entry for account %s: %v", id, err)
+		}
+		log.Printf("Account deletion: deleted account %s and %d uploads", id, len(deleted.Uploads))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d of %d accounts", failed, len(ids))
+	}
+	return nil
+}
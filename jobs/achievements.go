@@ -0,0 +1,25 @@
+package jobs
+
+import (
+	"context"
+	"log"
+
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+)
+
+// StartAchievementChecker evaluates the achievements of users queued by
+// gacha.QueueAchievementCheck until stop is closed
+func StartAchievementChecker(stop <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case discordID := <-gacha.AchievementChecks():
+				if err := gacha.CheckAchievements(context.Background(), discordID); err != nil {
+					log.Printf("Achievements: failed to check user %s: %v", discordID, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,32 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// FlushImageAccess writes the image views and downloads counted in memory
+// to the database
+func FlushImageAccess() error {
+	if err := models.FlushImageAccess(context.Background()); err != nil {
+		return fmt.Errorf("failed to record image views and downloads: %w", err)
+	}
+	return nil
+}
+
+// PurgeUploadActivity deletes the hourly activity that has left the
+// trending window
+func PurgeUploadActivity() error {
+	n, err := models.DeleteUploadActivityBefore(context.Background(), time.Now().Add(-models.TrendingWindow))
+	if err != nil {
+		return fmt.Errorf("failed to delete old upload activity: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Activity purge: deleted %d hours of upload activity", n)
+	}
+	return nil
+}
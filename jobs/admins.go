@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// How often administrator grants made from the command line are reloaded
+const adminGrantReloadInterval = time.Minute
+
+// StartAdminGrantLoader loads the granted administrators now and reloads them
+// every minute until stop is closed, so grants made with "admin grant" while
+// the server runs take effect without a restart
+func StartAdminGrantLoader(stop <-chan struct{}) {
+	LoadAdminGrants()
+
+	go func() {
+		ticker := time.NewTicker(adminGrantReloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				LoadAdminGrants()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// LoadAdminGrants replaces the granted administrators with those in the
+// database, keeping the previous set if they can't be read
+func LoadAdminGrants() {
+	grants, err := models.ListAdminGrants(context.Background())
+	if err != nil {
+		log.Printf("Admin grants: failed to load: %v", err)
+		return
+	}
+
+	ids := make([]string, len(grants))
+	for i, g := range grants {
+		ids[i] = g.DiscordID
+	}
+	config.SetGrantedAdmins(ids)
+}
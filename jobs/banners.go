@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/live"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+)
+
+// How long before a banner ends the users who pulled on it are told
+const bannerReminderLead = 24 * time.Hour
+
+// BannerEvent is the data of the live feed's banner.started and banner.ended
+// events
+type BannerEvent struct {
+	BannerID int64     `json:"banner_id"`
+	Name     string    `json:"name"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
+
+// When banner transitions were last looked for; banners that started or
+// ended before the server did aren't announced
+var (
+	bannerTransitionMu      sync.Mutex
+	bannersTransitionedUpTo = time.Now()
+)
+
+// AnnounceBannerTransitions tells live clients about banners that started or
+// ended since it last ran
+func AnnounceBannerTransitions() error {
+	bannerTransitionMu.Lock()
+	defer bannerTransitionMu.Unlock()
+
+	now := time.Now()
+	banners, err := models.ListBanners(context.Background(), "", false)
+	if err != nil {
+		return fmt.Errorf("failed to list banners: %w", err)
+	}
+
+	since := bannersTransitionedUpTo
+	for _, b := range banners {
+		event := BannerEvent{BannerID: b.ID, Name: b.Name, StartsAt: b.StartsAt, EndsAt: b.EndsAt}
+		if b.StartsAt.After(since) && !b.StartsAt.After(now) {
+			live.Publish(b.GuildID, live.EventBannerStarted, event)
+			log.Printf("Banner transitions: banner %d started", b.ID)
+		}
+		if b.EndsAt.After(since) && !b.EndsAt.After(now) {
+			live.Publish(b.GuildID, live.EventBannerEnded, event)
+			log.Printf("Banner transitions: banner %d ended", b.ID)
+		}
+	}
+	bannersTransitionedUpTo = now
+	return nil
+}
+
+// RemindEndingBanners tells the users who pulled on a banner when it has a
+// day left to run. Each banner's users are told once.
+func RemindEndingBanners() error {
+	ctx := context.Background()
+	banners, err := models.ListBannersEndingBefore(ctx, time.Now().Add(bannerReminderLead))
+	if err != nil {
+		return fmt.Errorf("failed to list ending banners: %w", err)
+	}
+
+	for _, b := range banners {
+		users, err := models.BannerPullers(ctx, b.ID)
+		if err != nil {
+			log.Printf("Banner reminder: failed to list users who pulled on banner %d: %v", b.ID, err)
+			continue
+		}
+		// Marked first, so a failure can't remind the same users twice
+		if err := models.MarkBannerEndingNotified(ctx, b.ID); err != nil {
+			log.Printf("Banner reminder: failed to mark banner %d as reminded: %v", b.ID, err)
+			continue
+		}
+		for _, discordID := range users {
+			notify.BannerEnding(discordID, b)
+		}
+		log.Printf("Banner reminder: told %d users banner %d ends at %s", len(users), b.ID, b.EndsAt.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package jobs
+
+import (
+	"context"
+	"image"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/processing"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// StartBlurHashBackfill generates placeholders for uploads stored before
+// BlurHash support existed. It runs once in the background.
+func StartBlurHashBackfill() {
+	go BackfillBlurHashes()
+}
+
+// BackfillBlurHashes computes and stores the BlurHash of every upload that lacks one.
+// Uploads in formats without a decoder (e.g. JXL) are skipped.
+func BackfillBlurHashes() {
+	ctx := context.Background()
+	uploads, err := models.UploadsMissingBlurHash(ctx)
+	if err != nil {
+		log.Printf("BlurHash backfill: failed to list uploads: %v", err)
+		return
+	}
+
+	filled, skipped := 0, 0
+	for id, filename := range uploads {
+		var hash string
+		generate := func() error {
+			var err error
+			hash, err = blurHashFile(storage.Path(filename))
+			return err
+		}
+		err := processing.Run(generate)
+		for err == processing.ErrBusy {
+			// Background work yields to user requests
+			time.Sleep(time.Second)
+			err = processing.Run(generate)
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		if err := models.SetUploadBlurHash(ctx, id, hash); err != nil {
+			log.Printf("BlurHash backfill: failed to store hash for upload %d: %v", id, err)
+			continue
+		}
+		filled++
+	}
+
+	if filled > 0 || skipped > 0 {
+		log.Printf("BlurHash backfill: generated %d placeholders, skipped %d undecodable uploads", filled, skipped)
+	}
+}
+
+func blurHashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", err
+	}
+	return imaging.BlurHash(img), nil
+}
@@ -0,0 +1,18 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// OptimizeDatabase refreshes the database's query planner statistics and
+// gives space freed by deleted rows back to the file system where the
+// database supports it
+func OptimizeDatabase() error {
+	if err := models.OptimizeDatabase(context.Background()); err != nil {
+		return fmt.Errorf("failed to optimize the database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package jobs
+
+import (
+	"context"
+	"image"
+	"log"
+	"os"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// StartDimensionBackfill records the pixel size of uploads stored before
+// dimensions were tracked. It runs once in the background.
+func StartDimensionBackfill() {
+	go BackfillDimensions()
+}
+
+// BackfillDimensions reads the size of every upload that lacks one from its
+// image header. Uploads in formats without a decoder (e.g. JXL) are skipped
+// and keep a size of 0, which resolution filters treat as unknown.
+func BackfillDimensions() {
+	ctx := context.Background()
+	uploads, err := models.UploadsMissingDimensions(ctx)
+	if err != nil {
+		log.Printf("Dimension backfill: failed to list uploads: %v", err)
+		return
+	}
+
+	filled, skipped := 0, 0
+	for id, filename := range uploads {
+		cfg, err := imageConfig(storage.Path(filename))
+		if err != nil || cfg.Width == 0 {
+			skipped++
+			continue
+		}
+		if err := models.SetUploadDimensions(ctx, id, cfg.Width, cfg.Height); err != nil {
+			log.Printf("Dimension backfill: failed to store size of upload %d: %v", id, err)
+			continue
+		}
+		filled++
+	}
+
+	if filled > 0 || skipped > 0 {
+		log.Printf("Dimension backfill: recorded %d sizes, skipped %d undecodable uploads", filled, skipped)
+	}
+}
+
+func imageConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	return cfg, err
+}
@@ -0,0 +1,58 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// CleanUpDrafts deletes expired upload drafts, abandoned resumable uploads
+// and their files
+func CleanUpDrafts() error {
+	return errors.Join(DeleteExpiredDrafts(), DeleteExpiredUploadSessions())
+}
+
+// DeleteExpiredDrafts removes drafts past their expiry along with their files
+func DeleteExpiredDrafts() error {
+	filenames, err := models.DeleteExpiredDrafts(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired drafts: %w", err)
+	}
+
+	for _, filename := range filenames {
+		storage.RemoveDraft(filename)
+	}
+
+	if len(filenames) > 0 {
+		log.Printf("Draft cleanup: deleted %d expired drafts", len(filenames))
+	}
+	return nil
+}
+
+// UploadSessionsExpired is called with the IDs of the resumable uploads
+// DeleteExpiredUploadSessions removes, so what is kept about them in memory
+// can be dropped
+var UploadSessionsExpired = func(ids []int64) {}
+
+// DeleteExpiredUploadSessions removes resumable uploads that stopped
+// receiving chunks, along with what they had received
+func DeleteExpiredUploadSessions() error {
+	ids, filenames, err := models.DeleteExpiredUploadSessions(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired upload sessions: %w", err)
+	}
+
+	for _, filename := range filenames {
+		storage.RemovePartial(filename)
+	}
+	UploadSessionsExpired(ids)
+
+	if len(filenames) > 0 {
+		log.Printf("Upload session cleanup: deleted %d expired sessions", len(filenames))
+	}
+	return nil
+}
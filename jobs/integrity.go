@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// IntegrityRepair describes a missing blob restored from a mirror
+type IntegrityRepair struct {
+	SHA256   string `json:"sha256"`
+	Filename string `json:"filename"`
+	Source   string `json:"source"`
+}
+
+// IntegrityReport summarizes one run of the storage integrity check
+type IntegrityReport struct {
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  time.Time         `json:"finished_at"`
+	Checked     int               `json:"checked"`
+	Restored    []IntegrityRepair `json:"restored"`
+	Recovered   []string          `json:"recovered"`
+	Unavailable []string          `json:"unavailable"`
+	Error       string            `json:"error,omitempty"`
+}
+
+var (
+	integrityMu   sync.Mutex
+	lastIntegrity *IntegrityReport
+)
+
+// LastIntegrityReport returns the most recent integrity report, or nil if none has run
+func LastIntegrityReport() *IntegrityReport {
+	integrityMu.Lock()
+	defer integrityMu.Unlock()
+	return lastIntegrity
+}
+
+// RunIntegrityCheck verifies that every blob's file exists in uploadDir. Missing
+// files are restored from the first mirror directory holding a copy with the
+// expected SHA-256; blobs that cannot be recovered are marked unavailable so
+// their uploads drop out of listings. Only one check runs at a time.
+func RunIntegrityCheck(uploadDir string, mirrorDirs []string) *IntegrityReport {
+	ctx := context.Background()
+	integrityMu.Lock()
+	defer integrityMu.Unlock()
+
+	report := &IntegrityReport{
+		StartedAt:   time.Now(),
+		Restored:    []IntegrityRepair{},
+		Recovered:   []string{},
+		Unavailable: []string{},
+	}
+	defer func() {
+		report.FinishedAt = time.Now()
+		lastIntegrity = report
+		logIntegrityReport(report)
+	}()
+
+	blobs, err := models.ListBlobs(ctx)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	for _, blob := range blobs {
+		report.Checked++
+		path := filepath.Join(uploadDir, blob.Filename)
+
+		if _, err := os.Stat(path); err == nil {
+			if blob.Unavailable {
+				if err := models.SetBlobUnavailable(ctx, blob.SHA256, false); err != nil {
+					log.Printf("Integrity check: failed to mark blob %s available: %v", blob.SHA256, err)
+					continue
+				}
+				report.Recovered = append(report.Recovered, blob.Filename)
+			}
+			continue
+		}
+
+		source, err := restoreFromMirrors(blob, path, mirrorDirs)
+		if err == nil {
+			log.Printf("Integrity check: restored %s from %s", blob.Filename, source)
+			report.Restored = append(report.Restored, IntegrityRepair{SHA256: blob.SHA256, Filename: blob.Filename, Source: source})
+			if blob.Unavailable {
+				if err := models.SetBlobUnavailable(ctx, blob.SHA256, false); err != nil {
+					log.Printf("Integrity check: failed to mark blob %s available: %v", blob.SHA256, err)
+				}
+			}
+			continue
+		}
+
+		report.Unavailable = append(report.Unavailable, blob.Filename)
+		if !blob.Unavailable {
+			if err := models.SetBlobUnavailable(ctx, blob.SHA256, true); err != nil {
+				log.Printf("Integrity check: failed to mark blob %s unavailable: %v", blob.SHA256, err)
+			}
+		}
+	}
+
+	return report
+}
+
+// restoreFromMirrors copies the blob's file from the first mirror holding
+// content with the expected hash, returning the mirror path used
+func restoreFromMirrors(blob models.Blob, destPath string, mirrorDirs []string) (string, error) {
+	for _, dir := range mirrorDirs {
+		candidate := filepath.Join(dir, blob.Filename)
+		if err := copyVerified(candidate, destPath, blob.SHA256); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Integrity check: mirror copy %s unusable: %v", candidate, err)
+			}
+			continue
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("no mirror holds %s", blob.Filename)
+}
+
+// copyVerified copies src to dest via a temporary file, only renaming it into
+// place if the content hashes to expectedSHA256
+func copyVerified(src, dest, expectedSHA256 string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if got := hex.EncodeToString(hasher.Sum(nil)); got != expectedSHA256 {
+		return fmt.Errorf("checksum mismatch: got %s", got)
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func logIntegrityReport(r *IntegrityReport) {
+	if r.Error != "" {
+		log.Printf("Integrity check failed: %s", r.Error)
+		return
+	}
+	if len(r.Restored) == 0 && len(r.Unavailable) == 0 && len(r.Recovered) == 0 {
+		log.Printf("Integrity check: %d blobs OK", r.Checked)
+		return
+	}
+	log.Printf("Integrity check report for admins: %d checked, %d restored from mirrors, %d recovered, %d unavailable %v",
+		r.Checked, len(r.Restored), len(r.Recovered), len(r.Unavailable), r.Unavailable)
+}
@@ -0,0 +1,25 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// LoadMaintenanceMode applies the maintenance mode admins set at runtime on
+// top of maintenance, keeping the previous one if it can't be read
+func LoadMaintenanceMode() error {
+	override, err := models.GetMaintenanceOverride(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load maintenance mode: %w", err)
+	}
+
+	if override == nil {
+		config.SetMaintenanceOverride(nil, "")
+		return nil
+	}
+	config.SetMaintenanceOverride(&override.Enabled, override.Message)
+	return nil
+}
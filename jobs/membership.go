@@ -0,0 +1,115 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// How many users the membership checker checks per pass, to stay well inside
+// Discord's rate limits
+const guildCheckBatchSize = 50
+
+// VerifyGuildMembership checks users whose membership was last confirmed more
+// than interval ago. Users who left every allowed guild or deauthorized the
+// application are signed out everywhere; Discord errors leave the user alone
+// and they are retried on the next pass.
+func VerifyGuildMembership(interval time.Duration) error {
+	users, err := models.UsersDueForGuildCheck(context.Background(), time.Now().Add(-interval), guildCheckBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to list users: %w", err)
+	}
+
+	revoked := 0
+	for _, u := range users {
+		if !verifyMember(u) {
+			revoked++
+		}
+	}
+
+	if len(users) > 0 {
+		log.Printf("Membership check: checked %d users, signed out %d", len(users), revoked)
+	}
+	return nil
+}
+
+// verifyMember checks one user, returning false when their sessions were revoked
+func verifyMember(u models.MembershipCheck) bool {
+	refreshToken, err := discord.OpenToken(u.RefreshToken)
+	if err != nil {
+		// Sealed under a different session secret; the user has to sign in
+		// again before they can be checked
+		log.Printf("Membership check: unreadable refresh token for user %s (ID: %s), signing out: %v", u.Username, u.DiscordID, err)
+		return !revokeMember(u, "unreadable refresh token")
+	}
+
+	ctx := context.Background()
+	token, err := discord.RefreshToken(ctx, refreshToken)
+	if err == discord.ErrRevoked {
+		log.Printf("Membership check: user %s (ID: %s) deauthorized the application", u.Username, u.DiscordID)
+		return !revokeMember(u, "authorization revoked")
+	} else if err != nil {
+		log.Printf("Membership check: failed to refresh token for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+		return true
+	}
+
+	// The old refresh token is spent, so store the rotated one even if the
+	// guild lookup fails
+	sealed, err := discord.SealToken(token.RefreshToken)
+	if err != nil {
+		log.Printf("Membership check: failed to seal refresh token for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+		return true
+	}
+
+	guilds, err := discord.GetGuilds(ctx, token.AccessToken)
+	if err != nil {
+		log.Printf("Membership check: failed to get guilds for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+		if err := models.UpdateRefreshToken(ctx, u.DiscordID, sealed); err != nil {
+			log.Printf("Membership check: failed to store refresh token for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+		}
+		return true
+	}
+
+	if err := models.SetUserGuilds(ctx, u.DiscordID, discord.AllowedGuildIDs(guilds)); err != nil {
+		log.Printf("Membership check: failed to record guilds for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+	}
+
+	if !discord.InAllowedGuild(guilds) {
+		log.Printf("Membership check: user %s (ID: %s) is no longer in an allowed Discord server", u.Username, u.DiscordID)
+		return !revokeMember(u, "left allowed servers")
+	}
+
+	if err := models.SetGuildVerified(ctx, u.DiscordID, sealed); err != nil {
+		log.Printf("Membership check: failed to record verification for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+	}
+	return true
+}
+
+// revokeMember signs the user out everywhere and records why in the audit log,
+// reporting whether it succeeded
+func revokeMember(u models.MembershipCheck, reason string) bool {
+	ctx := context.Background()
+	if err := models.RevokeSessions(ctx, u.DiscordID); err != nil {
+		log.Printf("Membership check: failed to revoke sessions for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+		return false
+	}
+	if _, err := middleware.Store.Backend.DeleteUser(u.DiscordID); err != nil {
+		log.Printf("Membership check: failed to delete sessions for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+	}
+
+	entry := &models.AuditEntry{
+		ActorID: "system",
+		Action:  models.AuditMembershipRevoked,
+		Target:  "user:" + u.DiscordID,
+		Details: reason,
+	}
+	if err := models.RecordAudit(ctx, entry); err != nil {
+		log.Printf("Membership check: failed to record audit entry for user %s (ID: %s): %v", u.Username, u.DiscordID, err)
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// PurgeNotifications deletes notifications older than retention
+func PurgeNotifications(retention time.Duration) error {
+	n, err := models.DeleteNotificationsBefore(context.Background(), time.Now().Add(-retention))
+	if err != nil {
+		return fmt.Errorf("failed to delete old notifications: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Notification purge: deleted %d notifications", n)
+	}
+	return nil
+}
+
+// PurgeFingerprints deletes device fingerprints last seen longer ago than
+// retention
+func PurgeFingerprints(retention time.Duration) error {
+	n, err := models.DeleteFingerprintsBefore(context.Background(), time.Now().Add(-retention))
+	if err != nil {
+		return fmt.Errorf("failed to delete old device fingerprints: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Fingerprint purge: deleted %d device fingerprints", n)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// OrphanFile is a file in the upload directory that nothing in the database
+// refers to
+type OrphanFile struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Deleted    bool      `json:"deleted"`
+}
+
+// OrphanReport summarizes one scan of the upload directory
+type OrphanReport struct {
+	StartedAt    time.Time    `json:"started_at"`
+	FinishedAt   time.Time    `json:"finished_at"`
+	Scanned      int          `json:"scanned"`
+	Orphans      []OrphanFile `json:"orphans"`
+	Missing      []string     `json:"missing"`
+	DeletedBytes int64        `json:"deleted_bytes"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// Thumbnails and resized variants are named after their upload's file:
+// <base>.jpg and <base>-<w>x<h>-<fit>.jpg, with -wm<hash> before .jpg when
+// watermarked. WebP copies are <base>.webp among the variants.
+var (
+	thumbnailPattern = regexp.MustCompile(`^(.+?)(?:-wm[0-9a-f]{8})?\.jpg$`)
+	variantPattern   = regexp.MustCompile(`^(.+)(?:-\d+x\d+-[a-z]+(?:-wm[0-9a-f]{8})?\.jpg|\.webp)$`)
+)
+
+var (
+	orphanMu   sync.Mutex
+	lastOrphan *OrphanReport
+)
+
+// LastOrphanReport returns the most recent orphan scan, or nil if none has run
+func LastOrphanReport() *OrphanReport {
+	orphanMu.Lock()
+	defer orphanMu.Unlock()
+	return lastOrphan
+}
+
+// RunOrphanCheck compares the upload directory with the database. Files no
+// upload, draft or resumable upload refers to, thumbnails, resized copies and
+// kept originals of files that are gone, and temporary files left by crashes
+// are orphans; records whose file is missing are listed too. Files younger
+// than minAge are ignored, as they may belong to an upload still in
+// progress. Orphans are only deleted when deleteOrphans is set. Only one scan
+// runs at a time.
+func RunOrphanCheck(uploadDir string, minAge time.Duration, deleteOrphans bool) *OrphanReport {
+	orphanMu.Lock()
+	defer orphanMu.Unlock()
+
+	report := &OrphanReport{
+		StartedAt: time.Now(),
+		Orphans:   []OrphanFile{},
+		Missing:   []string{},
+	}
+	defer func() {
+		report.FinishedAt = time.Now()
+		lastOrphan = report
+		logOrphanReport(report, deleteOrphans)
+	}()
+
+	refs, err := models.ListReferencedFiles(context.Background())
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	// Thumbnails, variants and kept originals belong to whichever upload file
+	// shares their base name
+	bases := make(map[string]bool, len(refs.Uploads))
+	for filename := range refs.Uploads {
+		bases[strings.TrimSuffix(filename, filepath.Ext(filename))] = true
+	}
+
+	referenced := map[string]func(name string) bool{
+		"": func(name string) bool { return refs.Uploads[name] },
+		storage.ThumbnailDirectory: func(name string) bool {
+			m := thumbnailPattern.FindStringSubmatch(name)
+			return m != nil && bases[m[1]]
+		},
+		storage.VariantDirectory: func(name string) bool {
+			m := variantPattern.FindStringSubmatch(name)
+			return m != nil && bases[m[1]]
+		},
+		storage.DraftDirectory:   func(name string) bool { return refs.Drafts[name] },
+		storage.PartialDirectory: func(name string) bool { return refs.Partials[name] },
+		storage.OriginalDirectory: func(name string) bool {
+			return bases[strings.TrimSuffix(name, filepath.Ext(name))]
+		},
+	}
+
+	cutoff := time.Now().Add(-minAge)
+	for dir, isReferenced := range referenced {
+		entries, err := os.ReadDir(filepath.Join(uploadDir, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+
+		for _, entry := range entries {
+			// Only the known subdirectories are scanned
+			if entry.IsDir() {
+				continue
+			}
+			report.Scanned++
+			if isReferenced(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+
+			orphan := OrphanFile{
+				Path:       filepath.Join(dir, entry.Name()),
+				Size:       info.Size(),
+				ModifiedAt: info.ModTime(),
+			}
+			if deleteOrphans {
+				if err := os.Remove(filepath.Join(uploadDir, orphan.Path)); err != nil && !os.IsNotExist(err) {
+					log.Printf("Orphan cleanup: failed to delete %s: %v", orphan.Path, err)
+				} else {
+					orphan.Deleted = true
+					report.DeletedBytes += orphan.Size
+				}
+			}
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}
+
+	for dir, filenames := range map[string]map[string]bool{
+		"":                       refs.Uploads,
+		storage.DraftDirectory:   refs.Drafts,
+		storage.PartialDirectory: refs.Partials,
+	} {
+		for filename := range filenames {
+			path := filepath.Join(dir, filename)
+			if _, err := os.Stat(filepath.Join(uploadDir, path)); os.IsNotExist(err) {
+				report.Missing = append(report.Missing, path)
+			}
+		}
+	}
+
+	return report
+}
+
+func logOrphanReport(r *OrphanReport, deleteOrphans bool) {
+	if r.Error != "" {
+		log.Printf("Orphan cleanup failed: %s", r.Error)
+		return
+	}
+	for _, orphan := range r.Orphans {
+		if orphan.Deleted {
+			log.Printf("Orphan cleanup: deleted %s (%d bytes, modified %s)", orphan.Path, orphan.Size, orphan.ModifiedAt.Format(time.RFC3339))
+		} else {
+			log.Printf("Orphan cleanup: %s (%d bytes, modified %s) has no database record", orphan.Path, orphan.Size, orphan.ModifiedAt.Format(time.RFC3339))
+		}
+	}
+	for _, path := range r.Missing {
+		log.Printf("Orphan cleanup: %s is recorded in the database but missing from disk", path)
+	}
+	if len(r.Orphans) == 0 && len(r.Missing) == 0 {
+		log.Printf("Orphan cleanup: %d files OK", r.Scanned)
+		return
+	}
+	action := "left in place"
+	if deleteOrphans {
+		action = "deleted"
+	}
+	log.Printf("Orphan cleanup report for admins: %d files scanned, %d orphaned (%s, %d bytes freed), %d missing",
+		r.Scanned, len(r.Orphans), action, r.DeletedBytes, len(r.Missing))
+}
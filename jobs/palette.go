@@ -0,0 +1,74 @@
+package jobs
+
+import (
+	"context"
+	"image"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/processing"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// StartPaletteBackfill extracts the dominant colors of uploads stored before
+// palettes existed. It runs once in the background.
+func StartPaletteBackfill() {
+	go BackfillPalettes()
+}
+
+// BackfillPalettes computes and stores the palette of every upload that lacks
+// one. Uploads in formats without a decoder (e.g. JXL) are skipped.
+func BackfillPalettes() {
+	ctx := context.Background()
+	uploads, err := models.UploadsMissingPalette(ctx)
+	if err != nil {
+		log.Printf("Palette backfill: failed to list uploads: %v", err)
+		return
+	}
+
+	filled, skipped := 0, 0
+	for id, filename := range uploads {
+		var palette []string
+		generate := func() error {
+			var err error
+			palette, err = paletteFile(storage.Path(filename))
+			return err
+		}
+		err := processing.Run(generate)
+		for err == processing.ErrBusy {
+			// Background work yields to user requests
+			time.Sleep(time.Second)
+			err = processing.Run(generate)
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		if err := models.SetUploadPalette(ctx, id, palette); err != nil {
+			log.Printf("Palette backfill: failed to store palette for upload %d: %v", id, err)
+			continue
+		}
+		filled++
+	}
+
+	if filled > 0 || skipped > 0 {
+		log.Printf("Palette backfill: extracted %d palettes, skipped %d undecodable uploads", filled, skipped)
+	}
+}
+
+func paletteFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Palette(img), nil
+}
@@ -0,0 +1,294 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/backup"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// Layout of a pool export: the wallpapers' files named by the SHA-256 of
+// their content under files/, the manifest describing them and a copy of the
+// last manifest published to S3
+const (
+	poolManifestName  = "manifest.json"
+	poolFilesDir      = "files"
+	poolPublishedName = ".s3-manifest.json"
+)
+
+// PoolManifest describes every wallpaper in a pool export. Path is relative
+// to the manifest.
+type PoolManifest struct {
+	GeneratedAt time.Time           `json:"generated_at"`
+	Count       int                 `json:"count"`
+	Wallpapers  []PoolManifestEntry `json:"wallpapers"`
+}
+
+// PoolManifestEntry is one wallpaper of a pool export
+type PoolManifestEntry struct {
+	SHA256      string    `json:"sha256"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Rarity      string    `json:"rarity"`
+	License     string    `json:"license,omitempty"`
+	Uploader    string    `json:"uploader,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// ExportPool writes the wallpapers of the public pools to
+// pool_export.directory in a content-addressed layout, for community
+// mirrors: each file once under files/, named by its SHA-256, and a
+// manifest.json listing them with their titles, tags and licenses. Files
+// already exported are kept and ones that left the pool are deleted. With
+// pool_export.s3 set the changes are also published to the bucket, the
+// manifest last, so mirrors never see it name a missing file.
+func ExportPool() error {
+	if config.AppConfig.Watermark.Enabled {
+		return errors.New("the pool is not exported while watermarks are enabled, as that would publish original files")
+	}
+	cfg := config.AppConfig.PoolExport
+	dir := cfg.Directory
+	if err := os.MkdirAll(filepath.Join(dir, poolFilesDir), 0755); err != nil {
+		return err
+	}
+
+	uploads, err := models.ListPoolUploads(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to list the pool: %w", err)
+	}
+
+	manifest := PoolManifest{GeneratedAt: time.Now().UTC(), Wallpapers: []PoolManifestEntry{}}
+	current := make(map[string]bool)
+	failed := 0
+	for _, u := range uploads {
+		entry, err := exportPoolFile(dir, &u)
+		if err != nil {
+			log.Printf("Pool export: skipping upload %d: %v", u.ID, err)
+			failed++
+			continue
+		}
+		manifest.Wallpapers = append(manifest.Wallpapers, entry)
+		current[entry.Path] = true
+	}
+	manifest.Count = len(manifest.Wallpapers)
+
+	manifestPath := filepath.Join(dir, poolManifestName)
+	tmp := manifestPath + ".part"
+	if err := writePoolManifest(tmp, &manifest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if cfg.S3.Bucket != "" {
+		if err := publishPool(cfg.S3, dir, tmp, current); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("publishing to S3: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, manifestPath); err != nil {
+		return err
+	}
+
+	removed, err := removeStalePoolFiles(dir, current)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pool export: exported %d wallpapers to %s, deleting %d files no longer in the pool", manifest.Count, dir, removed)
+	if failed > 0 {
+		return fmt.Errorf("failed to export %d of %d wallpapers", failed, len(uploads))
+	}
+	return nil
+}
+
+// exportPoolFile copies an upload's file into the export under its hash,
+// unless it is there already, and returns its manifest entry
+func exportPoolFile(dir string, u *models.Upload) (PoolManifestEntry, error) {
+	src := storage.Path(u.Filename)
+	hash := u.SHA256
+	if hash == "" {
+		var err error
+		if hash, err = hashFile(src); err != nil {
+			return PoolManifestEntry{}, err
+		}
+	}
+	rel := path.Join(poolFilesDir, hash+strings.ToLower(filepath.Ext(u.Filename)))
+
+	dst := filepath.Join(dir, filepath.FromSlash(rel))
+	stat, err := os.Stat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := copyPoolFile(src, dst); err != nil {
+			return PoolManifestEntry{}, err
+		}
+		stat, err = os.Stat(dst)
+	}
+	if err != nil {
+		return PoolManifestEntry{}, err
+	}
+
+	tags := u.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return PoolManifestEntry{
+		SHA256:      hash,
+		Path:        rel,
+		Size:        stat.Size(),
+		Width:       u.Width,
+		Height:      u.Height,
+		Title:       u.Title,
+		Description: u.Description,
+		Tags:        tags,
+		Rarity:      u.Rarity,
+		License:     u.License,
+		Uploader:    u.UploaderName,
+		UploadedAt:  u.UploadedAt.UTC(),
+	}, nil
+}
+
+// hashFile returns the hex SHA-256 of a file's content
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyPoolFile copies a file into the export. The copy only appears once it
+// is complete.
+func copyPoolFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".part"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func readPoolManifest(name string) (*PoolManifest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m PoolManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func writePoolManifest(name string, m *PoolManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// publishPool uploads the files the last manifest published to the bucket
+// didn't name, then the manifest, then deletes the files that left the pool
+// from the bucket. A copy of the manifest is kept to compare the next export
+// with.
+func publishPool(bucket config.S3, dir, manifest string, current map[string]bool) error {
+	key := func(rel string) string { return strings.TrimPrefix(bucket.Prefix+rel, "/") }
+
+	publishedPath := filepath.Join(dir, poolPublishedName)
+	published := make(map[string]bool)
+	if previous, err := readPoolManifest(publishedPath); err == nil {
+		for _, w := range previous.Wallpapers {
+			published[w.Path] = true
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Pool export: republishing everything, as the record of the last upload is unreadable: %v", err)
+	}
+
+	for rel := range current {
+		if published[rel] {
+			continue
+		}
+		contentType := mime.TypeByExtension(path.Ext(rel))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		if err := backup.PutFile(bucket, key(rel), filepath.Join(dir, filepath.FromSlash(rel)), contentType); err != nil {
+			return fmt.Errorf("uploading %s: %w", rel, err)
+		}
+	}
+	if err := backup.PutFile(bucket, key(poolManifestName), manifest, "application/json"); err != nil {
+		return fmt.Errorf("uploading the manifest: %w", err)
+	}
+	for rel := range published {
+		if current[rel] {
+			continue
+		}
+		if err := backup.DeleteObject(bucket, key(rel)); err != nil {
+			log.Printf("Pool export: failed to delete %s from S3: %v", rel, err)
+		}
+	}
+
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(publishedPath, data, 0644)
+}
+
+// removeStalePoolFiles deletes the exported files the manifest no longer
+// names, along with copies left unfinished, and returns how many it deleted
+func removeStalePoolFiles(dir string, current map[string]bool) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, poolFilesDir))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || current[path.Join(poolFilesDir, e.Name())] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, poolFilesDir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,32 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// FinalizeRarityVotes settles the rarity votes that have ended, giving each
+// wallpaper with at least minVotes votes the rarity they settled on
+func FinalizeRarityVotes(minVotes int) error {
+	ctx := context.Background()
+	ids, err := models.RarityVotesDue(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to list ended rarity votes: %w", err)
+	}
+
+	for _, id := range ids {
+		rarity, changed, err := models.FinalizeRarityVote(ctx, id, minVotes)
+		if err != nil {
+			log.Printf("Rarity votes: failed to settle the vote on upload %d: %v", id, err)
+			continue
+		}
+		if changed {
+			log.Printf("Rarity votes: upload %d is now %s", id, rarity)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// LoadRarityRateOverrides applies the rarity rates admins set at runtime on
+// top of rarity_rates, keeping the previous ones if they can't be read
+func LoadRarityRateOverrides() error {
+	overrides, err := models.ListRarityRateOverrides(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load rarity rate overrides: %w", err)
+	}
+
+	rates := make(map[string]float64, len(overrides))
+	for _, o := range overrides {
+		rates[o.Rarity] = o.Rate
+	}
+	config.SetRarityRateOverrides(rates)
+	return nil
+}
@@ -0,0 +1,17 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Zinbhe/wallpaper-gacha/gacha"
+)
+
+// AnnounceUnrevealedPulls announces the two-step pulls whose reveal token
+// expired before the user revealed them
+func AnnounceUnrevealedPulls() error {
+	if err := gacha.AnnounceDuePulls(context.Background()); err != nil {
+		return fmt.Errorf("failed to list unrevealed pulls: %w", err)
+	}
+	return nil
+}
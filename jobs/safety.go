@@ -0,0 +1,124 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+	"github.com/Zinbhe/wallpaper-gacha/safety"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// How often uploads whose check failed or didn't fit in the queue are retried
+const safetySweepInterval = 5 * time.Minute
+
+// StartSafetyChecker runs the content safety check on uploads queued by
+// safety.Queue until stop is closed. Uploads left pending, whether by a
+// restart, a full queue or an unreachable classifier, are retried every five
+// minutes. announce is called with each upload that passes, so it can be
+// announced as new only once it is public.
+func StartSafetyChecker(announce func(*models.Upload), stop <-chan struct{}) {
+	if !safety.Enabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(safetySweepInterval)
+		defer ticker.Stop()
+
+		sweepSafetyChecks(announce, stop)
+		for {
+			select {
+			case id := <-safety.Queued():
+				checkUploadSafety(id, announce)
+			case <-ticker.C:
+				sweepSafetyChecks(announce, stop)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// sweepSafetyChecks checks every upload still pending
+func sweepSafetyChecks(announce func(*models.Upload), stop <-chan struct{}) {
+	ids, err := models.ListPendingSafetyChecks(context.Background())
+	if err != nil {
+		log.Printf("Content safety: failed to list pending uploads: %v", err)
+		return
+	}
+	for _, id := range ids {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		checkUploadSafety(id, announce)
+	}
+}
+
+// checkUploadSafety checks one upload and publishes, reports or trashes it
+// according to the verdict. Failed checks leave it pending for the next sweep.
+func checkUploadSafety(id int64, announce func(*models.Upload)) {
+	ctx := context.Background()
+	upload, err := models.GetUpload(ctx, id)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Printf("Content safety: failed to get upload %d: %v", id, err)
+		return
+	}
+	if upload.SafetyStatus != models.SafetyPending {
+		// Already handled, e.g. by a sweep while it was still queued
+		return
+	}
+
+	verdict, err := safety.Check(ctx, upload.ID, storage.Path(upload.Filename))
+	if err != nil {
+		log.Printf("Content safety: failed to check upload %d, will retry: %v", upload.ID, err)
+		return
+	}
+
+	if !verdict.Flagged() {
+		if err := models.PassSafetyCheck(ctx, upload.ID); err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Content safety: failed to publish upload %d: %v", upload.ID, err)
+			}
+			return
+		}
+		announce(upload)
+		return
+	}
+
+	details := fmt.Sprintf("Flagged by the content safety check with score %.2f", verdict.Score)
+	if verdict.Label != "" {
+		details += " (" + verdict.Label + ")"
+	}
+	if config.AppConfig.ContentSafety.Action == "reject" {
+		if err := models.RejectUnsafeUpload(ctx, upload.ID); err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Content safety: failed to reject upload %d: %v", upload.ID, err)
+			}
+			return
+		}
+		entry := &models.AuditEntry{ActorID: models.SafetyReporterID, Action: models.AuditSafetyReject, Target: fmt.Sprintf("upload:%d", upload.ID), Details: details}
+		if err := models.RecordAudit(ctx, entry); err != nil {
+			log.Printf("Content safety: failed to record rejection of upload %d in the audit log: %v", upload.ID, err)
+		}
+		log.Printf("Content safety: moved upload %d by user %s to the trash: %s", upload.ID, upload.DiscordID, details)
+		notify.UploadRejected(upload, "the content safety check flagged it")
+		return
+	}
+
+	if err := models.FlagUnsafeUpload(ctx, upload.ID, details); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Content safety: failed to flag upload %d: %v", upload.ID, err)
+		}
+		return
+	}
+	log.Printf("Content safety: upload %d by user %s held for review: %s", upload.ID, upload.DiscordID, details)
+}
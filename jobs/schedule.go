@@ -0,0 +1,205 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/backup"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/diskspace"
+	"github.com/Zinbhe/wallpaper-gacha/scheduler"
+	"github.com/Zinbhe/wallpaper-gacha/sessionstore"
+)
+
+// RegisterTasks adds the periodic maintenance jobs to the scheduler with
+// their default schedules. Jobs that catch up on work left from before a
+// restart also run at startup. Sessions are purged from store.
+func RegisterTasks(store *sessionstore.Store) {
+	cfg := config.AppConfig
+
+	scheduler.Register(scheduler.Task{
+		Name:       "trash_purge",
+		Schedule:   "@hourly",
+		RunAtStart: true,
+		Run: func() error {
+			return PurgeExpiredTrash(time.Duration(cfg.TrashRetentionDays) * 24 * time.Hour)
+		},
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "account_deletion",
+		Schedule:   "@hourly",
+		RunAtStart: true,
+		Run: func() error {
+			return DeleteRequestedAccounts(time.Duration(cfg.DeletionGraceDays) * 24 * time.Hour)
+		},
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "draft_cleanup",
+		Schedule:   "@every 10m",
+		RunAtStart: true,
+		Run:        CleanUpDrafts,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "session_purge",
+		Schedule:   "@hourly",
+		RunAtStart: true,
+		Run:        func() error { return PurgeExpiredSessions(store) },
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "notification_purge",
+		Schedule:   "@hourly",
+		RunAtStart: true,
+		Run: func() error {
+			return PurgeNotifications(time.Duration(cfg.NotificationDays) * 24 * time.Hour)
+		},
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "fingerprint_purge",
+		Schedule:   "@daily",
+		RunAtStart: true,
+		Run: func() error {
+			return PurgeFingerprints(time.Duration(cfg.FingerprintDays) * 24 * time.Hour)
+		},
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "trade_expiry",
+		Schedule:   "@every 10m",
+		RunAtStart: true,
+		Run:        ExpireTrades,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:     "banner_transitions",
+		Schedule: "@every 1m",
+		Run:      AnnounceBannerTransitions,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "banner_reminder",
+		Schedule:   "@every 10m",
+		RunAtStart: true,
+		Run:        RemindEndingBanners,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "rarity_votes",
+		Schedule:   "@every 5m",
+		RunAtStart: true,
+		Run:        func() error { return FinalizeRarityVotes(cfg.RarityVoteMinVotes) },
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "pull_reveals",
+		Schedule:   "@every 1m",
+		RunAtStart: true,
+		Run:        AnnounceUnrevealedPulls,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:     "access_flush",
+		Schedule: "@every 1m",
+		Run:      FlushImageAccess,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "activity_purge",
+		Schedule:   "@daily",
+		RunAtStart: true,
+		Run:        PurgeUploadActivity,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "disk_check",
+		Schedule:   "@every 1m",
+		RunAtStart: true,
+		Run: func() error {
+			diskspace.Check()
+			return nil
+		},
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "stats_rollup",
+		Schedule:   "@hourly",
+		RunAtStart: true,
+		Run:        RollUpStats,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:     "database_optimize",
+		Schedule: "@daily",
+		Run:      OptimizeDatabase,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "season_rotation",
+		Schedule:   "@every 1m",
+		RunAtStart: true,
+		Run:        RotateSeasons,
+	})
+
+	// The first backup is made a schedule after startup, so restarts don't
+	// each make one
+	scheduler.Register(scheduler.Task{
+		Name:     "backup",
+		Schedule: everyHours(cfg.Backup.IntervalHours),
+		Run: func() error {
+			_, err := backup.Run()
+			return err
+		},
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "pool_export",
+		Schedule:   everyHours(cfg.PoolExport.IntervalHours),
+		RunAtStart: true,
+		Run:        ExportPool,
+	})
+	transcodeSchedule := ""
+	if cfg.Transcode.Format != "" {
+		transcodeSchedule = "@every 10m"
+	}
+	scheduler.Register(scheduler.Task{
+		Name:       "transcode",
+		Schedule:   transcodeSchedule,
+		RunAtStart: true,
+		Run:        TranscodeUploads,
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "integrity_check",
+		Schedule:   everyHours(cfg.IntegrityCheckHours),
+		RunAtStart: true,
+		Run: func() error {
+			if report := RunIntegrityCheck(cfg.UploadDirectory, cfg.MirrorDirectories); report.Error != "" {
+				return errors.New(report.Error)
+			}
+			return nil
+		},
+	})
+	scheduler.Register(scheduler.Task{
+		Name:       "orphan_check",
+		Schedule:   everyHours(cfg.OrphanCheckHours),
+		RunAtStart: true,
+		Run: func() error {
+			minAge := time.Duration(cfg.OrphanMinAgeHours) * time.Hour
+			if report := RunOrphanCheck(cfg.UploadDirectory, minAge, cfg.DeleteOrphans); report.Error != "" {
+				return errors.New(report.Error)
+			}
+			return nil
+		},
+	})
+
+	// Users are rechecked once their last check is guild_recheck_minutes old;
+	// the schedule only decides how often that is looked at
+	guildSchedule := ""
+	if cfg.GuildRecheckMinutes > 0 {
+		guildSchedule = "@every 5m"
+	}
+	scheduler.Register(scheduler.Task{
+		Name:       "guild_check",
+		Schedule:   guildSchedule,
+		RunAtStart: true,
+		Run: func() error {
+			return VerifyGuildMembership(time.Duration(cfg.GuildRecheckMinutes) * time.Minute)
+		},
+	})
+}
+
+// everyHours is the schedule of a job configured by an interval in hours,
+// where 0 turns it off
+func everyHours(hours int) string {
+	if hours <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("@every %dh", hours)
+}
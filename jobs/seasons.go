@@ -0,0 +1,30 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Serializes rotations, which run on a schedule and after each season change
+var seasonRotationMu sync.Mutex
+
+// RotateSeasons moves seasonal wallpapers between the standard and archive
+// pools as their seasons start and end
+func RotateSeasons() error {
+	seasonRotationMu.Lock()
+	defer seasonRotationMu.Unlock()
+
+	archived, restored, err := models.RotateSeasonalPool(context.Background(), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to rotate seasonal wallpapers: %w", err)
+	}
+	if archived > 0 || restored > 0 {
+		log.Printf("Season rotation: archived %d wallpapers and returned %d to the standard pool", archived, restored)
+	}
+	return nil
+}
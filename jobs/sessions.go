@@ -0,0 +1,20 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Zinbhe/wallpaper-gacha/sessionstore"
+)
+
+// PurgeExpiredSessions deletes expired sessions from store
+func PurgeExpiredSessions(store *sessionstore.Store) error {
+	n, err := store.Backend.PurgeExpired()
+	if err != nil {
+		return fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Session cleanup: deleted %d expired sessions", n)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// RollUpStats brings the daily statistics rollup up to date, recomputing the
+// last day rolled up, which may have been partial, and every day since. The
+// first run backfills from the day of the first user or upload.
+func RollUpStats() error {
+	ctx := context.Background()
+	from, ok, err := models.DailyStatsStart(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find where the statistics rollup left off: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+	if err := models.RollUpDailyStats(ctx, from, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to roll up daily statistics: %w", err)
+	}
+	return nil
+}
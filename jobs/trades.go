@@ -0,0 +1,23 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// ExpireTrades marks unanswered trade offers past their expiry as expired.
+// Expired offers can't be answered even before they are swept; this keeps
+// their status accurate in trade listings.
+func ExpireTrades() error {
+	n, err := models.ExpireTrades(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to expire trade offers: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Trade expiry: expired %d trade offers", n)
+	}
+	return nil
+}
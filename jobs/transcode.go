@@ -0,0 +1,155 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/processing"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+	"github.com/google/uuid"
+)
+
+// errNotTranscodable marks files that are left in their format, such as ones
+// without a decoder, animated GIFs and, for JPEG, transparent images
+var errNotTranscodable = errors.New("not transcodable")
+
+// TranscodeUploads converts the stored files that aren't in transcode.format
+// to it, so the pool is stored in one format. Uploads sharing a file move to
+// the converted one together. Files that can't be converted are remembered
+// and left as they are. With transcode.keep_originals the files converted
+// from are moved to the originals directory; otherwise they are deleted.
+func TranscodeUploads() error {
+	ctx := context.Background()
+	cfg := config.AppConfig.Transcode
+	if cfg.Format == "" {
+		return nil
+	}
+
+	blobs, err := models.ListTranscodeCandidates(ctx, cfg.Format)
+	if err != nil {
+		return err
+	}
+
+	converted, skipped, failed := 0, 0, 0
+	var saved int64
+	for _, b := range blobs {
+		if imaging.InFormat(filepath.Ext(b.Filename), cfg.Format) {
+			continue
+		}
+		var size int64
+		transcode := func() error {
+			var err error
+			size, err = transcodeBlob(ctx, b, cfg)
+			return err
+		}
+		err := processing.Run(transcode)
+		for err == processing.ErrBusy {
+			// Background work yields to user requests
+			time.Sleep(time.Second)
+			err = processing.Run(transcode)
+		}
+		switch {
+		case errors.Is(err, errNotTranscodable):
+			if err := models.SkipTranscode(ctx, b.SHA256, cfg.Format); err != nil {
+				log.Printf("Transcode: failed to record %s as not transcodable: %v", b.Filename, err)
+			}
+			skipped++
+		case err != nil:
+			log.Printf("Transcode: failed to convert %s: %v", b.Filename, err)
+			failed++
+		default:
+			converted++
+			saved += b.FileSize - size
+		}
+	}
+
+	if converted > 0 || skipped > 0 || failed > 0 {
+		log.Printf("Transcode: converted %d files to %s, saving %d bytes, left %d that can't be converted, %d failed", converted, cfg.Format, saved, skipped, failed)
+	}
+	return nil
+}
+
+// transcodeBlob converts a blob's file, moves its uploads to the result and
+// keeps or deletes the file it was converted from. It returns the size of
+// the converted file.
+func transcodeBlob(ctx context.Context, b models.Blob, cfg config.Transcode) (int64, error) {
+	// Only the first frame of an animation would be kept
+	if filepath.Ext(b.Filename) == ".gif" {
+		return 0, errNotTranscodable
+	}
+	src, err := os.Open(storage.Path(b.Filename))
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	filename := uuid.New().String() + imaging.FormatExtension(cfg.Format)
+	path := storage.Path(filename)
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	hasher := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(dst, hasher)}
+	err = imaging.Transcode(src, counter, cfg.Format, cfg.Quality)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		if errors.Is(err, imaging.ErrUndecodable) || errors.Is(err, imaging.ErrTransparent) {
+			return 0, errNotTranscodable
+		}
+		return 0, err
+	}
+
+	stored, err := models.ReplaceBlob(ctx, b.SHA256, hex.EncodeToString(hasher.Sum(nil)), filename, counter.n)
+	if err != nil {
+		os.Remove(path)
+		if err == sql.ErrNoRows {
+			// Its uploads were purged in the meantime
+			return 0, nil
+		}
+		return 0, err
+	}
+	if stored != filename {
+		os.Remove(path)
+	}
+
+	if cfg.KeepOriginals {
+		original := storage.OriginalPath(stored, filepath.Ext(b.Filename))
+		if err := os.MkdirAll(filepath.Dir(original), 0755); err != nil {
+			return 0, err
+		}
+		if _, err := os.Stat(original); errors.Is(err, os.ErrNotExist) {
+			if err := os.Rename(storage.Path(b.Filename), original); err != nil {
+				return 0, err
+			}
+		}
+	}
+	storage.Remove(b.Filename)
+	return counter.n, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,40 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+// PurgeExpiredTrash permanently deletes uploads trashed more than retention
+// ago. Uploads that fail to purge are logged and retried on the next run.
+func PurgeExpiredTrash(retention time.Duration) error {
+	ctx := context.Background()
+	ids, err := models.ListExpiredTrash(ctx, time.Now().Add(-retention))
+	if err != nil {
+		return fmt.Errorf("failed to list expired uploads: %w", err)
+	}
+
+	failed := 0
+	for _, id := range ids {
+		orphaned, err := models.PurgeUpload(ctx, id)
+		if err != nil {
+			log.Printf("Trash purge: failed to purge upload %d: %v", id, err)
+			failed++
+			continue
+		}
+		storage.Remove(orphaned)
+	}
+
+	if purged := len(ids) - failed; purged > 0 {
+		log.Printf("Trash purge: permanently deleted %d uploads past the retention window", purged)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to purge %d of %d uploads", failed, len(ids))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// listenUnix listens on a Unix domain socket at path, removing a stale socket
+// file left behind by a previous run and applying the given permissions
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix_socket_mode %q: %w", mode, err)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket deletes a socket file nobody is listening on. It refuses
+// to remove regular files or sockets that still accept connections.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is already listening on %s", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to probe existing socket %s: %w", path, err)
+	}
+
+	log.Printf("Removing stale socket file %s", path)
+	return os.Remove(path)
+}
+
+// newServer builds the HTTP server with the timeouts, header limits and
+// protocol settings from the configuration
+func newServer(handler http.Handler) *http.Server {
+	cfg := config.AppConfig
+	seconds := func(n int) time.Duration { return time.Duration(n) * time.Second }
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       seconds(cfg.ReadTimeoutSeconds),
+		ReadHeaderTimeout: seconds(cfg.ReadHeaderTimeoutSecs),
+		WriteTimeout:      seconds(cfg.WriteTimeoutSeconds),
+		IdleTimeout:       seconds(cfg.IdleTimeoutSeconds),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+
+	// HTTP/2 over TLS is negotiated automatically; behind a reverse proxy the
+	// connection is cleartext, so HTTP/2 must be enabled explicitly (h2c)
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if cfg.HTTP2Enabled {
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	server.Protocols = protocols
+
+	server.SetKeepAlivesEnabled(!cfg.DisableKeepAlives)
+
+	log.Printf("Server timeouts: read %v, read header %v, write %v, idle %v; HTTP/2: %t; keep-alives: %t",
+		server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout, cfg.HTTP2Enabled, !cfg.DisableKeepAlives)
+	return server
+}
+
+// newRedirectServer builds the plain HTTP server that runs beside the HTTPS
+// one. Its requests are tiny, so it gets short timeouts.
+func newRedirectServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		MaxHeaderBytes:    config.AppConfig.MaxHeaderBytes,
+	}
+}
@@ -0,0 +1,176 @@
+// Package live pushes events such as new uploads and pulls to browsers over
+// WebSocket, so pages can update without polling. Clients only receive the
+// events of the guild they are browsing. Events are only kept in
+// memory: clients that connect later or fall behind simply miss them.
+package live
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events sent to live clients
+const (
+	EventUploadCreated = "upload.created"
+	EventPullCreated   = "pull.created"
+	EventBannerStarted = "banner.started"
+	EventBannerEnded   = "banner.ended"
+)
+
+const (
+	// Most clients connected at once; further connections are turned away
+	maxClients = 1000
+	// Events queued per client before it is considered too slow and dropped
+	clientBuffer = 16
+	// How often clients are pinged; one that stays silent for two intervals
+	// is disconnected
+	pingInterval = 30 * time.Second
+	writeWait    = 10 * time.Second
+)
+
+// Message is the JSON body of each text frame sent to clients
+type Message struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type client struct {
+	discordID string
+	guildID   string
+	admin     bool
+	send      chan []byte
+}
+
+var hub = struct {
+	sync.Mutex
+	clients map[*client]struct{}
+}{clients: make(map[*client]struct{})}
+
+// Serve upgrades the request to a WebSocket and streams events to it until
+// the client disconnects. guildID is the guild whose events the client
+// receives; discordID and admin decide which version of private events.
+func Serve(w http.ResponseWriter, r *http.Request, discordID, guildID string, admin bool) {
+	hub.Lock()
+	full := len(hub.clients) >= maxClients
+	hub.Unlock()
+	if full {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many live connections, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, err := upgrade(w, r)
+	if err != nil {
+		log.Printf("Live: upgrade failed for user %s from IP %s: %v", discordID, r.RemoteAddr, err)
+		return
+	}
+
+	cl := &client{discordID: discordID, guildID: guildID, admin: admin, send: make(chan []byte, clientBuffer)}
+	hub.Lock()
+	hub.clients[cl] = struct{}{}
+	hub.Unlock()
+
+	done := make(chan struct{})
+	go writePump(c, cl, done)
+	c.readLoop(2 * pingInterval)
+
+	hub.Lock()
+	if _, ok := hub.clients[cl]; ok {
+		delete(hub.clients, cl)
+		close(cl.send)
+	}
+	hub.Unlock()
+	<-done
+	c.close()
+}
+
+// writePump sends queued events and pings to the client until its queue is
+// closed or a write fails
+func writePump(c *conn, cl *client, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-cl.send:
+			if !ok {
+				// Closing the connection also ends the read loop if the
+				// client was dropped for being too slow
+				c.writeFrame(opClose, nil, writeWait)
+				c.close()
+				return
+			}
+			if err := c.writeFrame(opText, msg, writeWait); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.writeFrame(opPing, nil, writeWait); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// Publish sends an event to every client connected in the guild
+func Publish(guildID, event string, data interface{}) {
+	msg, err := json.Marshal(Message{Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Printf("Live: failed to encode %s event: %v", event, err)
+		return
+	}
+	broadcast(guildID, "", msg, msg)
+}
+
+// PublishPrivate sends an event about the user actorID to the clients
+// connected in the guild. The user themselves and admins receive data;
+// everyone else receives redacted instead, or nothing if it is nil.
+func PublishPrivate(guildID, event, actorID string, data, redacted interface{}) {
+	now := time.Now().UTC()
+	full, err := json.Marshal(Message{Event: event, CreatedAt: now, Data: data})
+	if err != nil {
+		log.Printf("Live: failed to encode %s event: %v", event, err)
+		return
+	}
+	var partial []byte
+	if redacted != nil {
+		if partial, err = json.Marshal(Message{Event: event, CreatedAt: now, Data: redacted}); err != nil {
+			log.Printf("Live: failed to encode %s event: %v", event, err)
+			return
+		}
+	}
+
+	broadcast(guildID, actorID, full, partial)
+}
+
+// broadcast queues full for actorID and admins and partial for everyone
+// else in the guild, skipping clients whose message is nil
+func broadcast(guildID, actorID string, full, partial []byte) {
+	hub.Lock()
+	defer hub.Unlock()
+	for cl := range hub.clients {
+		if cl.guildID != guildID {
+			continue
+		}
+		msg := partial
+		if cl.admin || (actorID != "" && cl.discordID == actorID) {
+			msg = full
+		}
+		if msg == nil {
+			continue
+		}
+		select {
+		case cl.send <- msg:
+		default:
+			// The client isn't keeping up; drop it rather than block everyone
+			delete(hub.clients, cl)
+			close(cl.send)
+		}
+	}
+}
@@ -1,68 +1,302 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	_ "time/tzdata" // embed the time zone database for reset_timezone on minimal hosts
 
+	"github.com/Zinbhe/wallpaper-gacha/acme"
+	"github.com/Zinbhe/wallpaper-gacha/bot"
 	"github.com/Zinbhe/wallpaper-gacha/config"
 	"github.com/Zinbhe/wallpaper-gacha/handlers"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/jobs"
 	"github.com/Zinbhe/wallpaper-gacha/middleware"
 	"github.com/Zinbhe/wallpaper-gacha/models"
-	"github.com/gorilla/mux"
+	"github.com/Zinbhe/wallpaper-gacha/notify"
+	"github.com/Zinbhe/wallpaper-gacha/processing"
+	"github.com/Zinbhe/wallpaper-gacha/routes"
+	"github.com/Zinbhe/wallpaper-gacha/scheduler"
+	"github.com/Zinbhe/wallpaper-gacha/testmode"
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
 )
 
 func main() {
+	// Without a command the arguments are the server's, as before commands
+	// existed
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			cmd.run(args[1:])
+			return
+		}
+	}
+	serve(args)
+}
+
+// serve runs the web server until it receives SIGINT or SIGTERM
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = commandUsage(flags)
+	testMode := flags.Bool("test-mode", false, "run against a fake Discord provider with an in-memory database, temporary storage and seeded data")
+	flags.Parse(args)
+
 	// Load configuration
 	configFile := "config.json"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+	if flags.NArg() > 0 {
+		configFile = flags.Arg(0)
 	}
 
-	log.Printf("Loading configuration from %s", configFile)
-	if err := config.Load(configFile); err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+	if *testMode {
+		env, err := testmode.Start(configFile)
+		if err != nil {
+			log.Fatalf("Failed to start test mode: %v", err)
+		}
+		defer env.Close()
+	} else {
+		log.Printf("Loading configuration from %s", configFile)
+		if err := config.Load(configFile); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
 	}
 
 	// Initialize database
-	log.Printf("Initializing database at %s", config.AppConfig.DatabasePath)
-	if err := models.InitDatabase(config.AppConfig.DatabasePath); err != nil {
+	log.Printf("Initializing %s database", config.AppConfig.DatabaseDriver)
+	if err := initDatabase(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer models.Close()
+	if err := models.AssignDefaultGuild(context.Background(), config.AppConfig.DefaultGuildID); err != nil {
+		log.Fatalf("Failed to assign wallpapers to the default guild: %v", err)
+	}
 
 	// Initialize session store
-	middleware.InitSessionStore(config.AppConfig.SessionSecret)
+	if err := middleware.InitSessionStore(); err != nil {
+		log.Fatalf("Failed to initialize session store: %v", err)
+	}
 
 	// Create upload directory if it doesn't exist
 	if err := os.MkdirAll(config.AppConfig.UploadDirectory, 0755); err != nil {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
-	// Setup router
-	r := mux.NewRouter()
+	if *testMode {
+		// Test clients talk plain HTTP to localhost
+		middleware.Store.Options.Secure = false
+		if err := testmode.Seed(); err != nil {
+			log.Fatalf("Failed to seed test data: %v", err)
+		}
+	}
+
+	// Bound CPU-heavy image work
+	processing.Init(config.AppConfig.ProcessingWorkers, config.AppConfig.ProcessingQueueSize, config.AppConfig.ProcessingNice)
+
+	// Decode AVIF and HEIC with the external converter, when one is configured
+	if ic := config.AppConfig.ImageConverter; len(ic.Command) > 0 {
+		imaging.UseConverter(&imaging.Converter{Command: ic.Command, Timeout: time.Duration(ic.TimeoutSeconds) * time.Second})
+		log.Printf("Image converter: %s decodes AVIF and HEIC", ic.Command[0])
+	}
+
+	// Closed on shutdown to stop background jobs
+	stop := make(chan struct{})
+
+	// Administrators granted with "admin grant" join those in the config
+	jobs.StartAdminGrantLoader(stop)
+
+	// Rarity rates set with /api/admin/gacha/rates take precedence over the
+	// config
+	if err := jobs.LoadRarityRateOverrides(); err != nil {
+		log.Fatalf("Failed to load gacha rates: %v", err)
+	}
+
+	// So does maintenance mode set with /api/admin/maintenance
+	if err := jobs.LoadMaintenanceMode(); err != nil {
+		log.Fatalf("Failed to load maintenance mode: %v", err)
+	}
+
+	// Export spans to an OTLP collector, when one is configured
+	tracing.Start(stop)
+
+	// Generate placeholders for uploads stored before BlurHash support
+	jobs.StartBlurHashBackfill()
+	jobs.StartDimensionBackfill()
+	jobs.StartPaletteBackfill()
+
+	// Unlock achievements for users whose pulls or uploads may have earned one
+	jobs.StartAchievementChecker(stop)
+
+	// Check new uploads with the content safety classifier, including ones
+	// still pending from before a restart
+	jobs.StartSafetyChecker(handlers.AnnounceUpload, stop)
+
+	// Run the periodic maintenance jobs on their schedules: purging the trash,
+	// deleted accounts, drafts, sessions and old notifications, expiring
+	// trades, banner transitions and reminders, season rotation, leaderboards,
+	// backups, storage checks, Discord membership checks and the Discord
+	// channel import
+	jobs.RegisterTasks(middleware.Store)
+	scheduler.Register(scheduler.Task{
+		Name:       "leaderboard_refresh",
+		Schedule:   "@every 1m",
+		RunAtStart: true,
+		Run:        handlers.RefreshLeaderboards,
+	})
+	discordImportSchedule := ""
+	if config.AppConfig.DiscordImport.ChannelID != "" {
+		discordImportSchedule = fmt.Sprintf("@every %dh", config.AppConfig.DiscordImport.IntervalHours)
+	}
+	scheduler.Register(scheduler.Task{
+		Name:       "discord_import",
+		Schedule:   discordImportSchedule,
+		RunAtStart: true,
+		Run:        handlers.ImportDiscordChannel,
+	})
+	if err := scheduler.Start(stop); err != nil {
+		log.Fatalf("Failed to start scheduler: %v", err)
+	}
+
+	// Send queued webhook notifications, including ones left from before a restart
+	webhooks.Start(config.AppConfig.WebhookWorkers, stop)
+
+	// Send notifications by direct message from the Discord bot
+	notify.Start(stop)
 
-	// Public routes
-	r.HandleFunc("/", handlers.HomeHandler).Methods("GET")
-	r.HandleFunc("/auth/login", handlers.LoginHandler).Methods("GET")
-	r.HandleFunc("/auth/callback", handlers.CallbackHandler).Methods("GET")
-	r.HandleFunc("/auth/logout", handlers.LogoutHandler).Methods("GET")
+	// Install the bot's slash commands; a failure leaves the previously
+	// registered ones in place
+	if config.AppConfig.DiscordBotToken != "" {
+		if err := bot.RegisterCommands(context.Background()); err != nil {
+			log.Printf("Failed to register Discord slash commands: %v", err)
+		}
+	}
 
-	// Protected routes
-	r.HandleFunc("/upload", middleware.RequireAuth(handlers.UploadPageHandler)).Methods("GET")
-	r.HandleFunc("/api/user", middleware.RequireAuth(handlers.UserInfoHandler)).Methods("GET")
-	r.HandleFunc("/api/config", middleware.RequireAuth(handlers.ConfigHandler)).Methods("GET")
-	r.HandleFunc("/api/upload", middleware.RequireAuth(handlers.UploadHandler)).Methods("POST")
+	// Route every request; see package routes
+	handler, err := routes.New()
+	if err != nil {
+		log.Fatalf("Failed to set up routes: %v", err)
+	}
 
 	// Start server
-	addr := fmt.Sprintf("%s:%d", config.AppConfig.ServerHost, config.AppConfig.ServerPort)
-	log.Printf("Starting server on %s", addr)
 	log.Printf("Upload cooldown: %d minutes", config.AppConfig.UploadCooldownMinutes)
 	log.Printf("Max file size: %dMB", config.AppConfig.MaxFileSizeMB)
-	log.Printf("Allowed Discord servers: %v", config.AppConfig.AllowedServerIDs)
+	log.Printf("Daily reset time zone: %s", config.AppConfig.ResetLocation())
+	log.Printf("Concurrent uploads: %d global, %d per user", config.AppConfig.MaxConcurrentUploads, config.AppConfig.MaxUploadsPerUser)
+	log.Printf("Allowed Discord servers: %v (default %s)", config.AppConfig.GuildIDs(), config.AppConfig.DefaultGuildID)
+
+	// With tls.domains set the server gets its own certificates and serves
+	// HTTPS itself, without a reverse proxy in front
+	var certs *acme.Manager
+	if tlsConfig := config.AppConfig.TLS; len(tlsConfig.Domains) > 0 {
+		certs = &acme.Manager{
+			Domains:      tlsConfig.Domains,
+			CacheDir:     tlsConfig.CacheDir,
+			Email:        tlsConfig.Email,
+			DirectoryURL: tlsConfig.DirectoryURL,
+		}
+		if err := certs.Load(); err != nil {
+			log.Fatalf("Failed to load TLS certificate cache %s: %v", tlsConfig.CacheDir, err)
+		}
+	}
+
+	var listeners []net.Listener
+	if !config.AppConfig.DisableTCP {
+		addr := fmt.Sprintf("%s:%d", config.AppConfig.ServerHost, config.AppConfig.ServerPort)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", addr, err)
+		}
+		if certs != nil {
+			tlsConfig := certs.TLSConfig()
+			tlsConfig.NextProtos = []string{"http/1.1"}
+			if config.AppConfig.HTTP2Enabled {
+				tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+			}
+			listener = tls.NewListener(listener, tlsConfig)
+			log.Printf("Starting HTTPS server on %s for %v", addr, certs.Domains)
+		} else {
+			log.Printf("Starting server on %s", addr)
+		}
+		listeners = append(listeners, listener)
+	}
+	if config.AppConfig.UnixSocketPath != "" {
+		listener, err := listenUnix(config.AppConfig.UnixSocketPath, config.AppConfig.UnixSocketMode)
+		if err != nil {
+			log.Fatalf("Failed to listen on unix socket %s: %v", config.AppConfig.UnixSocketPath, err)
+		}
+		log.Printf("Starting server on unix socket %s (mode %s)", config.AppConfig.UnixSocketPath, config.AppConfig.UnixSocketMode)
+		listeners = append(listeners, listener)
+	}
+
+	server := newServer(handler)
+	errs := make(chan error, len(listeners)+1)
+	for _, listener := range listeners {
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(listener)
+	}
+
+	// Plain HTTP only answers certificate challenges and redirects to HTTPS
+	var redirectServer *http.Server
+	if certs != nil {
+		addr := fmt.Sprintf("%s:%d", config.AppConfig.ServerHost, config.AppConfig.TLS.HTTPPort)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", addr, err)
+		}
+		log.Printf("Redirecting HTTP on %s to HTTPS", addr)
+		redirectServer = newRedirectServer(certs.HTTPHandler(config.AppConfig.ServerPort))
+		go func() {
+			errs <- redirectServer.Serve(listener)
+		}()
+		certs.Start(stop)
+	}
+
+	// Reload the settings that can change at runtime on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			log.Printf("Received SIGHUP, reloading configuration")
+			handlers.ReloadConfig(context.Background(), "system", "")
+		}
+	}()
+
+	// Stop accepting connections on SIGINT/SIGTERM and let in-flight requests,
+	// such as large uploads, finish before closing the database
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	if err := http.ListenAndServe(addr, r); err != nil {
+	select {
+	case err := <-errs:
 		log.Fatalf("Server failed: %v", err)
+	case sig := <-signals:
+		timeout := time.Duration(config.AppConfig.ShutdownTimeoutSeconds) * time.Second
+		log.Printf("Received %s, shutting down (waiting up to %v for in-flight requests)", sig, timeout)
+
+		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Graceful shutdown incomplete: %v", err)
+		}
+		if redirectServer != nil {
+			redirectServer.Shutdown(ctx)
+		}
+		// Views and downloads counted since the last flush
+		if err := models.FlushImageAccess(ctx); err != nil {
+			log.Printf("Failed to record image views and downloads: %v", err)
+		}
+		tracing.Flush(ctx)
 	}
+
+	log.Printf("Server stopped")
 }
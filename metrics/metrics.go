@@ -0,0 +1,269 @@
+// Package metrics keeps counters, gauges and histograms and serves them, together
+// with the expvar counters published elsewhere, in the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of every exported metric name
+const namespace = "wallpaper_"
+
+// Bucket upper bounds for durations in seconds and for file sizes in bytes
+var (
+	DurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	SizeBuckets     = []float64{64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// series is one combination of label values of a metric
+type series[T any] struct {
+	labels []string
+	value  T
+}
+
+// family holds the series of one metric, keyed by their label values
+type family[T any] struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series[T]
+}
+
+// get returns the series for the label values, creating it with init
+func (f *family[T]) get(values []string, init func() T) *series[T] {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series[T]{labels: slices.Clone(values), value: init()}
+		f.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series in a stable order for output
+func (f *family[T]) sorted() []*series[T] {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	out := make([]*series[T], len(keys))
+	for i, key := range keys {
+		out[i] = f.series[key]
+	}
+	return out
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	family[float64]
+}
+
+// NewCounterVec registers a counter. Label values are passed in the order
+// of labels whenever it is incremented.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family[float64]{name: namespace + name, help: help, labels: labels, series: map[string]*series[float64]{}}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter with the given label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(values, func() float64 { return 0 }).value += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// GaugeVec is a set of gauges partitioned by label values
+type GaugeVec struct {
+	family[float64]
+}
+
+// NewGaugeVec registers a gauge. Label values are passed in the order of
+// labels whenever it is set.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{family[float64]{name: namespace + name, help: help, labels: labels, series: map[string]*series[float64]{}}}
+	register(g)
+	return g
+}
+
+// Set sets the gauge with the given label values to v
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(values, func() float64 { return 0 }).value = v
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, s := range g.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatValue(s.value))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	family[*histogram]
+	buckets []float64
+}
+
+// NewHistogramVec registers a histogram with the given bucket upper bounds
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		family:  family[*histogram]{name: namespace + name, help: help, labels: labels, series: map[string]*series[*histogram]{}},
+		buckets: buckets,
+	}
+	register(h)
+	return h
+}
+
+// Observe records a value in the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(values, func() *histogram { return &histogram{counts: make([]uint64, len(h.buckets))} }).value
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *HistogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	bucketLabels := append(slices.Clone(h.labels), "le")
+	for _, s := range h.sorted() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(slices.Clone(s.labels), formatValue(bound))), s.value.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(slices.Clone(s.labels), "+Inf")), s.value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.value.count)
+	}
+}
+
+// Handler serves every registered metric, the integer expvar counters and a
+// few runtime gauges
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		registryMu.Lock()
+		metrics := slices.Clone(registry)
+		registryMu.Unlock()
+		for _, m := range metrics {
+			m.write(w)
+		}
+
+		writeHeader(w, namespace+"goroutines", "Number of goroutines", "gauge")
+		fmt.Fprintf(w, "%sgoroutines %d\n", namespace, runtime.NumGoroutine())
+
+		writeExpvars(w)
+	})
+}
+
+// writeExpvars exports integer expvar variables, and maps of them labelled
+// by key, as untyped metrics
+func writeExpvars(w io.Writer) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := namespace + kv.Key
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			writeHeader(w, name, "expvar "+kv.Key, "untyped")
+			fmt.Fprintf(w, "%s %d\n", name, v.Value())
+		case *expvar.Map:
+			writeHeader(w, name, "expvar "+kv.Key, "untyped")
+			v.Do(func(entry expvar.KeyValue) {
+				if n, ok := entry.Value.(*expvar.Int); ok {
+					fmt.Fprintf(w, "%s%s %d\n", name, formatLabels([]string{"key"}, []string{entry.Key}), n.Value())
+				}
+			})
+		}
+	})
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// APIv1Prefix is where the versioned API is served. Every /api route is also
+// served under it and shares the unversioned route's policy entry.
+const APIv1Prefix = "/api/v1"
+
+// unversionedPath returns the /api path of the route a versioned API path
+// belongs to, and other paths unchanged
+func unversionedPath(p string) string {
+	if rest, ok := strings.CutPrefix(p, APIv1Prefix+"/"); ok {
+		return "/api/" + rest
+	}
+	return p
+}
+
+// jsonErrorWriter holds back a plain-text error response so it can be sent
+// as JSON instead
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	if status >= 400 && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *jsonErrorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a held-back error as an ErrorResponse, with the code of its
+// status
+func (w *jsonErrorWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+	w.Header().Del("Content-Length")
+	WriteError(w.ResponseWriter, w.status, StatusCode(w.status), strings.TrimSpace(w.body.String()))
+}
+
+// JSONErrors makes every error from the versioned API a JSON body, including
+// those written with http.Error by handlers and by the middleware that
+// checks authentication and access
+func JSONErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, APIv1Prefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		jw := &jsonErrorWriter{ResponseWriter: w}
+		defer jw.finish()
+		next.ServeHTTP(jw, r)
+	})
+}
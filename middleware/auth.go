@@ -2,55 +2,117 @@ package middleware
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/sessionstore"
 	"github.com/gorilla/sessions"
 )
 
 type contextKey string
 
 const (
-	DiscordIDKey contextKey = "discord_id"
-	UsernameKey  contextKey = "username"
+	DiscordIDKey      contextKey = "discord_id"
+	UsernameKey       contextKey = "username"
+	ImpersonatorIDKey contextKey = "impersonator_id"
+	PermissionKey     contextKey = "permission"
 )
 
-var Store *sessions.CookieStore
+// Session keys used while an admin is viewing the site as another user
+const (
+	ImpersonateIDSessionKey       = "impersonate_id"
+	ImpersonateUsernameSessionKey = "impersonate_username"
+	ImpersonateExpiresSessionKey  = "impersonate_expires"
+	ImpersonateWriteSessionKey    = "impersonate_write"
+)
+
+// Session key holding the Unix time the session signed in, compared against
+// the user's session revocation time
+const LoginAtSessionKey = "login_at"
+
+// Session key holding the permission level granted at sign-in: RoleUploader
+// for users allowed to upload, RoleUser for everyone else
+const PermissionSessionKey = "permission"
+
+// ImpersonationPath is exempt from the read-only restriction so admins can always end impersonation
+const ImpersonationPath = "/api/admin/impersonate"
 
-// InitSessionStore initializes the session store with a secret key
-func InitSessionStore(secret string) {
-	Store = sessions.NewCookieStore([]byte(secret))
-	Store.Options = &sessions.Options{
+// SessionName is the name of the session cookie
+const SessionName = "wallpaper-session"
+
+var Store *sessionstore.Store
+
+// InitSessionStore sets up server-side session storage in the configured
+// backend
+func InitSessionStore() error {
+	var backend sessionstore.Backend = sessionstore.Database{}
+	if config.AppConfig.SessionStore == "redis" {
+		redis, err := sessionstore.NewRedis(config.AppConfig.RedisURL)
+		if err != nil {
+			return err
+		}
+		backend = redis
+	}
+
+	Store = sessionstore.New(backend, &sessions.Options{
 		Path:     "/",
 		MaxAge:   86400 * 7, // 7 days
 		HttpOnly: true,
 		Secure:   true, // Only send cookie over HTTPS
 		SameSite: http.SameSiteLaxMode,
+	})
+	Store.ClientIP = ClientIP
+	return nil
+}
+
+// signInRequired sends a visitor who isn't signed in to the home page to sign
+// in. Clients of the versioned API get a 401 instead.
+func signInRequired(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, APIv1Prefix+"/") {
+		Error(w, r, http.StatusUnauthorized, CodeUnauthenticated, "Authentication required")
+		return
 	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// RequireAuth is middleware that requires a valid session
+// RequireAuth is middleware that requires a valid session, or an API token
+// for /api routes. On the content host, a signed URL takes the place of both.
 func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session, err := Store.Get(r, "wallpaper-session")
+		if OnContentHost(r) {
+			authenticateContentURL(next, w, r)
+			return
+		}
+		if token, ok := bearerToken(r); ok {
+			authenticateToken(next, w, r, token)
+			return
+		}
+
+		session, err := Store.Get(r, SessionName)
 		if err != nil {
 			// Invalid/stale session cookie - redirect to login (new login will overwrite with valid cookie)
 			log.Printf("Authentication required: invalid session cookie for %s %s from IP: %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			signInRequired(w, r)
 			return
 		}
 
 		auth, ok := session.Values["authenticated"].(bool)
 		if !ok || !auth {
 			log.Printf("Authentication required: unauthenticated access attempt to %s %s from IP: %s", r.Method, r.URL.Path, r.RemoteAddr)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			signInRequired(w, r)
 			return
 		}
 
 		discordID, ok := session.Values["discord_id"].(string)
 		if !ok {
 			log.Printf("Authentication required: missing discord_id for %s %s from IP: %s", r.Method, r.URL.Path, r.RemoteAddr)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			signInRequired(w, r)
 			return
 		}
 
@@ -59,14 +121,142 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 			username = "Unknown"
 		}
 
+		if denyBanned(w, r, discordID, username) {
+			return
+		}
+
+		loginAt, _ := session.Values[LoginAtSessionKey].(int64)
+		revoked, err := models.SessionRevoked(r.Context(), discordID, time.Unix(loginAt, 0))
+		if err != nil {
+			log.Printf("Failed to check session revocation for user %s (ID: %s): %v", username, discordID, err)
+			Error(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+			return
+		}
+		if revoked {
+			log.Printf("Revoked session of user %s (ID: %s) signed out on %s %s from IP: %s", username, discordID, r.Method, r.URL.Path, r.RemoteAddr)
+			session.Options.MaxAge = -1
+			session.Save(r, w)
+			signInRequired(w, r)
+			return
+		}
+
+		// The session cookie is sent on cross-site form posts too, so writes
+		// must prove they came from our own pages
+		if !validCSRF(r, session) {
+			log.Printf("CSRF check failed: %s %s by user %s (ID: %s) from IP: %s", r.Method, r.URL.Path, username, discordID, r.RemoteAddr)
+			Error(w, r, http.StatusForbidden, CodeInvalidCSRFToken, "Invalid or missing CSRF token, reload the page and try again")
+			return
+		}
+
+		// Upload access is granted per guild, for the one being browsed
+		guildID, guilds, uploader := sessionGuilds(session, discordID)
+		permission := RoleUser
+		if uploader {
+			permission = RoleUploader
+		}
+		ctx := withGuild(r.Context(), guildID, guilds)
+
+		// Admins viewing as another user act with that user's identity
+		if targetID, ok := session.Values[ImpersonateIDSessionKey].(string); ok && targetID != "" {
+			expires, _ := session.Values[ImpersonateExpiresSessionKey].(int64)
+			if time.Now().Unix() >= expires || !config.AppConfig.IsAdmin(discordID) {
+				log.Printf("Impersonation of %s by %s (ID: %s) expired", targetID, username, discordID)
+				ClearImpersonation(session)
+				session.Save(r, w)
+			} else {
+				writeAllowed, _ := session.Values[ImpersonateWriteSessionKey].(bool)
+				readOnlyMethod := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+				if !writeAllowed && !readOnlyMethod && !strings.HasPrefix(unversionedPath(r.URL.Path), ImpersonationPath) {
+					log.Printf("Impersonation: blocked %s %s by %s (ID: %s) viewing as %s (read-only)", r.Method, r.URL.Path, username, discordID, targetID)
+					Error(w, r, http.StatusForbidden, CodeReadOnly, "Read-only impersonation: write actions are disabled")
+					return
+				}
+
+				targetName, _ := session.Values[ImpersonateUsernameSessionKey].(string)
+				w.Header().Set("X-Impersonating", fmt.Sprintf("%s (ID: %s) until %s", targetName, targetID, time.Unix(expires, 0).UTC().Format(time.RFC3339)))
+
+				ctx = context.WithValue(ctx, ImpersonatorIDKey, discordID)
+				discordID, username = targetID, targetName
+			}
+		}
+
 		// Add user info to request context
-		ctx := context.WithValue(r.Context(), DiscordIDKey, discordID)
+		ctx = context.WithValue(ctx, DiscordIDKey, discordID)
 		ctx = context.WithValue(ctx, UsernameKey, username)
+		ctx = context.WithValue(ctx, PermissionKey, permission)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// denyBanned responds with the ban and returns true if the user is banned
+func denyBanned(w http.ResponseWriter, r *http.Request, discordID, username string) bool {
+	ban, err := models.GetActiveBan(r.Context(), discordID)
+	if err == nil {
+		log.Printf("Banned user %s (ID: %s) denied %s %s from IP: %s", username, discordID, r.Method, r.URL.Path, r.RemoteAddr)
+		Error(w, r, http.StatusForbidden, CodeBanned, BanMessage(ban))
+		return true
+	} else if err != sql.ErrNoRows {
+		log.Printf("Failed to check ban status for user %s (ID: %s): %v", username, discordID, err)
+		Error(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		return true
+	}
+	return false
+}
+
+// RequireAdmin is middleware that requires a valid session belonging to a configured admin.
+// While impersonating, the admin's own identity is checked rather than the impersonated user's.
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		discordID := GetRealDiscordID(r)
+		if !config.AppConfig.IsAdmin(discordID) {
+			log.Printf("Admin access denied: user %s (ID: %s) attempted %s %s from IP: %s", GetUsername(r), discordID, r.Method, r.URL.Path, r.RemoteAddr)
+			Error(w, r, http.StatusForbidden, CodeForbidden, "Forbidden")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireUploader is middleware that requires a valid session allowed to
+// upload. While impersonating, the admin's own permission applies.
+func RequireUploader(next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !CanUpload(r) {
+			log.Printf("Upload access denied: user %s (ID: %s) lacks an uploader role for %s %s from IP: %s", GetUsername(r), GetRealDiscordID(r), r.Method, r.URL.Path, r.RemoteAddr)
+			Error(w, r, http.StatusForbidden, CodeUploadRoleRequired, "You need an uploader role in the Discord server to upload")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CanUpload reports whether the signed-in user may upload to the current
+// guild. Everyone can when it has no upload roles configured, and admins
+// always can.
+func CanUpload(r *http.Request) bool {
+	return canUpload(config.AppConfig, r)
+}
+
+func canUpload(cfg *config.Config, r *http.Request) bool {
+	guild := cfg.Guilds[GetGuildID(r)]
+	if len(guild.UploadRoleIDs) == 0 || cfg.IsAdmin(GetRealDiscordID(r)) {
+		return true
+	}
+	permission, _ := r.Context().Value(PermissionKey).(string)
+	return permission == RoleUploader
+}
+
+// BanMessage explains a ban to the banned user
+func BanMessage(ban *models.Ban) string {
+	if ban.Permanent() {
+		return fmt.Sprintf("You are banned: %s", ban.Reason)
+	}
+	return fmt.Sprintf("You are banned until %s: %s", ban.ExpiresAt.Time.UTC().Format(time.RFC3339), ban.Reason)
+}
+
 // GetDiscordID retrieves the Discord ID from request context
 func GetDiscordID(r *http.Request) string {
 	if discordID, ok := r.Context().Value(DiscordIDKey).(string); ok {
@@ -75,6 +265,32 @@ func GetDiscordID(r *http.Request) string {
 	return ""
 }
 
+// GetImpersonatorID returns the admin's Discord ID when the request is made while
+// impersonating another user, or "" otherwise
+func GetImpersonatorID(r *http.Request) string {
+	if id, ok := r.Context().Value(ImpersonatorIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// GetRealDiscordID returns the Discord ID of the person actually signed in,
+// which differs from GetDiscordID while an admin is impersonating
+func GetRealDiscordID(r *http.Request) string {
+	if id := GetImpersonatorID(r); id != "" {
+		return id
+	}
+	return GetDiscordID(r)
+}
+
+// ClearImpersonation removes impersonation state from a session
+func ClearImpersonation(session *sessions.Session) {
+	delete(session.Values, ImpersonateIDSessionKey)
+	delete(session.Values, ImpersonateUsernameSessionKey)
+	delete(session.Values, ImpersonateExpiresSessionKey)
+	delete(session.Values, ImpersonateWriteSessionKey)
+}
+
 // GetUsername retrieves the username from request context
 func GetUsername(r *http.Request) string {
 	if username, ok := r.Context().Value(UsernameKey).(string); ok {
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/gorilla/mux"
+)
+
+// largeBodyRoutes take files and bound their bodies themselves, by the
+// upload size limits. Like the policy, entries cover the versioned API too.
+var largeBodyRoutes = map[string]bool{
+	"POST /api/upload":                       true,
+	"POST /api/upload/zip":                   true,
+	"PATCH /api/upload/sessions/{id:[0-9]+}": true,
+	"POST /api/drafts":                       true,
+}
+
+// LimitBody is router middleware that caps request bodies at max_body_bytes
+// and gives clients body_read_timeout_seconds to send them, so an oversized
+// or trickled body can't tie up the server. Upload routes are left to their
+// own limits and to read_timeout_seconds.
+func LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || largeBody(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, config.AppConfig.MaxBodyBytes)
+		if timeout := config.AppConfig.BodyReadTimeoutSecs; timeout > 0 {
+			rc := http.NewResponseController(w)
+			// Not every connection supports deadlines; those keep
+			// read_timeout_seconds alone
+			if rc.SetReadDeadline(time.Now().Add(time.Duration(timeout)*time.Second)) == nil {
+				r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func largeBody(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	template, err := route.GetPathTemplate()
+	return err == nil && largeBodyRoutes[policyKey(r.Method, template)]
+}
+
+// deadlineBody lifts the read deadline once the whole body has arrived. The
+// server keeps reading the connection in the background after that, to
+// notice clients going away, and a deadline passing then would cancel
+// handlers that run longer than it.
+type deadlineBody struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	done bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
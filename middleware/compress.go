@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Zinbhe/wallpaper-gacha/assets"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// compressor is a gzip or zlib writer that can be reused for another
+// response
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Compressors are kept for reuse, as each holds a few hundred kilobytes of
+// state
+var compressors = map[string]*sync.Pool{
+	"gzip":    {New: func() any { return gzip.NewWriter(io.Discard) }},
+	"deflate": {New: func() any { return zlib.NewWriter(io.Discard) }},
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// it is worth compressing: text of at least compress_min_bytes that the
+// handler hasn't encoded itself
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+	status   int
+	buf      []byte
+	decided  bool
+	cw       compressor
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minBytes {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressing the response when it is text that
+// has reached compress_min_bytes, and then what was held back
+func (w *compressWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if assets.Compressible(h.Get("Content-Type")) && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusPartialContent && w.status != http.StatusNotModified {
+		h.Add("Vary", "Accept-Encoding")
+		if len(w.buf) >= w.minBytes {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", w.encoding)
+			// The compressed bytes differ from the ones a strong ETag vouches for
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			w.cw = compressors[w.encoding].Get().(compressor)
+			w.cw.Reset(w.ResponseWriter)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.cw != nil {
+		_, err = w.cw.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Flush sends what has been written so far, compressed or not depending on
+// whether it had reached compress_min_bytes
+func (w *compressWriter) Flush() error {
+	if !w.decided && w.status != 0 {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.cw != nil {
+		if err := w.cw.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a response that stayed under compress_min_bytes and ends the
+// compressed stream of one that didn't
+func (w *compressWriter) finish() {
+	if !w.decided {
+		if w.status != 0 {
+			w.decide()
+		}
+		return
+	}
+	if w.cw != nil {
+		w.cw.Close()
+		compressors[w.encoding].Put(w.cw)
+	}
+}
+
+// Compress is router middleware that gzip or deflate compresses JSON, HTML
+// and other text responses of at least compress_min_bytes for clients that
+// accept it. Images and other media, which are compressed already, and
+// responses a handler encoded itself, such as static files, are sent as
+// they are.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		minBytes := config.AppConfig.CompressMinBytes
+		encoding := ""
+		switch {
+		case minBytes < 0 || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "":
+		case assets.AcceptsEncoding(r, "gzip"):
+			encoding = "gzip"
+		case assets.AcceptsEncoding(r, "deflate"):
+			encoding = "deflate"
+		}
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minBytes: minBytes}
+		defer cw.finish()
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Query parameters of a signed content URL: the user, guild and permission
+// it was signed for, when it expires and the signature over all of them
+const (
+	contentUserParam       = "u"
+	contentGuildParam      = "g"
+	contentPermissionParam = "p"
+	contentExpiresParam    = "e"
+	contentSignatureParam  = "s"
+)
+
+// contentURLLifetime is how long a signed content URL is valid at least.
+// Expiry is rounded up to the next multiple of it, so URLs stay the same,
+// and cached by browsers, for that long.
+const contentURLLifetime = 12 * time.Hour
+
+// OnContentHost reports whether the request was made to the content host
+// rather than the site itself
+func OnContentHost(r *http.Request) bool {
+	contentHost := config.AppConfig.ContentHost()
+	if contentHost == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.EqualFold(host, contentHost)
+}
+
+// ContentURL returns the URL the current user fetches the uploaded file at
+// path from, with query added. With content_url set it points at the content
+// host and carries a signature that stands in for the user's session there,
+// unless nobody is signed in; otherwise it is a path on the site itself.
+func ContentURL(r *http.Request, path string, query url.Values) string {
+	return ContentURLWith(config.AppConfig, r, path, query)
+}
+
+// ContentURLWith is ContentURL under the given configuration rather than the
+// loaded one
+func ContentURLWith(cfg *config.Config, r *http.Request, path string, query url.Values) string {
+	if cfg.ContentHost() == "" {
+		return withQuery(path, query)
+	}
+	if GetDiscordID(r) == "" {
+		return withQuery(cfg.ContentURL+path, query)
+	}
+
+	signed := url.Values{}
+	for k, v := range query {
+		signed[k] = v
+	}
+	permission := RoleUser
+	if canUpload(cfg, r) {
+		permission = RoleUploader
+	}
+	expires := time.Now().Truncate(contentURLLifetime).Add(2 * contentURLLifetime).Unix()
+	signed.Set(contentUserParam, GetDiscordID(r))
+	signed.Set(contentGuildParam, GetGuildID(r))
+	signed.Set(contentPermissionParam, permission)
+	signed.Set(contentExpiresParam, strconv.FormatInt(expires, 10))
+	signed.Set(contentSignatureParam, contentSignature(cfg.SessionSecret.Current(), path, signed))
+	return cfg.ContentURL + path + "?" + signed.Encode()
+}
+
+func withQuery(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+// contentSignature signs the path and identity of a content URL with a key
+// derived from a session secret
+func contentSignature(secret, path string, query url.Values) string {
+	key := sha256.Sum256([]byte("wallpaper-gacha content URL:" + secret))
+	mac := hmac.New(sha256.New, key[:])
+	for _, part := range []string{
+		path,
+		query.Get(contentUserParam),
+		query.Get(contentGuildParam),
+		query.Get(contentPermissionParam),
+		query.Get(contentExpiresParam),
+	} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validContentSignature reports whether a content URL was signed with any of
+// the configured session secrets and hasn't expired
+func validContentSignature(path string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get(contentExpiresParam), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	signature := query.Get(contentSignatureParam)
+	for _, secret := range config.AppConfig.SessionSecret {
+		if hmac.Equal([]byte(signature), []byte(contentSignature(secret, path, query))) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateContentURL serves a request to the content host, which never
+// sees the session cookie, as the user its signed URL was made for
+func authenticateContentURL(next http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !validContentSignature(r.URL.Path, query) {
+		log.Printf("Invalid or expired content URL for %s %s from IP: %s", r.Method, r.URL.Path, r.RemoteAddr)
+		Error(w, r, http.StatusForbidden, CodeInvalidContentURL, "This link has expired, reload the page to get a new one")
+		return
+	}
+
+	user, err := models.GetUser(r.Context(), query.Get(contentUserParam))
+	if err == sql.ErrNoRows {
+		Error(w, r, http.StatusForbidden, CodeInvalidContentURL, "This link has expired, reload the page to get a new one")
+		return
+	} else if err != nil {
+		log.Printf("Failed to get user %s for content URL: %v", query.Get(contentUserParam), err)
+		Error(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		return
+	}
+	if denyBanned(w, r, user.DiscordID, user.Username) {
+		return
+	}
+
+	guildID := query.Get(contentGuildParam)
+	ctx := withGuild(r.Context(), guildID, []string{guildID})
+	ctx = context.WithValue(ctx, DiscordIDKey, user.DiscordID)
+	ctx = context.WithValue(ctx, UsernameKey, user.Username)
+	ctx = context.WithValue(ctx, PermissionKey, query.Get(contentPermissionParam))
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
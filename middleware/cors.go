@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// corsRequestHeaders are the request headers cross-origin API calls may send
+var corsRequestHeaders = []string{"Authorization", "Content-Type", CSRFHeader, GuildHeader, "Idempotency-Key", "If-None-Match", "Range", "Upload-Offset"}
+
+// corsResponseHeaders are the response headers beyond the basic ones that
+// pages on other origins may read
+var corsResponseHeaders = []string{
+	"ETag", "Idempotent-Replayed", "Location", "Retry-After", "Upload-Length", "Upload-Offset",
+	"X-Impersonating", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+	"X-Upload-Next-At", "X-Upload-Remaining", "X-Upload-Warning",
+}
+
+// CORS lets pages on the origins allowed by the cors setting call the /api
+// routes. It answers their preflight OPTIONS requests itself, since the
+// router has no OPTIONS routes. Requests from other origins pass through
+// untouched, so browsers keep them from reading the response.
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(config.AppConfig.CORS.AllowedOrigins) == 0 || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		allowed := config.AppConfig.CORSOrigin(origin)
+		if allowed == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Origin", allowed)
+		if config.AppConfig.CORS.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", strings.Join(config.AppConfig.CORS.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(corsRequestHeaders, ", "))
+			h.Set("Access-Control-Max-Age", strconv.Itoa(config.AppConfig.CORS.MaxAgeSeconds))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", strings.Join(corsResponseHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Error codes API failures carry, so clients can tell causes apart without
+// matching messages. Codes are stable; messages may change.
+const (
+	CodeInvalidRequest   = "INVALID_REQUEST"
+	CodeUnauthenticated  = "UNAUTHENTICATED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeNotFound         = "NOT_FOUND"
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	CodeConflict         = "CONFLICT"
+	CodeTooLarge         = "TOO_LARGE"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeUnavailable      = "UNAVAILABLE"
+	CodeInternal         = "INTERNAL_ERROR"
+
+	CodeInvalidCSRFToken   = "INVALID_CSRF_TOKEN"
+	CodeInvalidAPIToken    = "INVALID_API_TOKEN"
+	CodeSessionRequired    = "SESSION_REQUIRED"
+	CodeBanned             = "BANNED"
+	CodeNotInGuild         = "NOT_IN_GUILD"
+	CodeUploadRoleRequired = "UPLOAD_ROLE_REQUIRED"
+	CodeReadOnly           = "IMPERSONATION_READ_ONLY"
+	CodeInvalidContentURL  = "INVALID_CONTENT_URL"
+	CodeMaintenance        = "MAINTENANCE"
+)
+
+// ErrorResponse is the JSON body returned by API endpoints on failure
+type ErrorResponse struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// StatusCode returns the error code of a failure with no more specific cause
+func StatusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthenticated
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
+
+// WriteError writes an ErrorResponse, its message in the response's locale
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	message = Translate(w, message)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Success: false, Code: code, Message: message})
+}
+
+// Error reports a failure on a route that may be a page or part of the API: as
+// an ErrorResponse to /api routes, and as plain text otherwise
+func Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, Translate(w, message), status)
+		return
+	}
+	WriteError(w, status, code, message)
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// GuildIDKey holds the guild the request acts in
+	GuildIDKey contextKey = "guild_id"
+	// guildsKey holds the guilds the user may switch between
+	guildsKey contextKey = "guilds"
+)
+
+// Session keys holding the guild the user is browsing, the allowed guilds
+// they were in at sign-in and the ones of those they may upload to, the
+// latter two comma-separated
+const (
+	GuildSessionKey        = "guild_id"
+	GuildsSessionKey       = "guilds"
+	UploadGuildsSessionKey = "upload_guilds"
+)
+
+// GuildHeader picks the guild an API token request acts in; without it the
+// request acts in the default guild
+const GuildHeader = "X-Guild-ID"
+
+// sessionGuilds returns the current guild of a session, the guilds it may
+// switch between, and whether it may upload to the current guild. Sessions
+// from before guilds were tracked are in the default guild only.
+func sessionGuilds(session *sessions.Session, discordID string) (string, []string, bool) {
+	permission, _ := session.Values[PermissionSessionKey].(string)
+	joined, ok := session.Values[GuildsSessionKey].(string)
+	if !ok {
+		return config.AppConfig.DefaultGuildID, []string{config.AppConfig.DefaultGuildID}, permission == RoleUploader
+	}
+
+	var guilds []string
+	for _, id := range strings.Split(joined, ",") {
+		if config.AppConfig.IsAllowedGuild(id) {
+			guilds = append(guilds, id)
+		}
+	}
+	if config.AppConfig.IsAdmin(discordID) {
+		guilds = config.AppConfig.GuildIDs()
+	}
+	if len(guilds) == 0 {
+		guilds = []string{config.AppConfig.DefaultGuildID}
+	}
+
+	current, _ := session.Values[GuildSessionKey].(string)
+	if !slices.Contains(guilds, current) {
+		current = guilds[0]
+	}
+	uploadGuilds, _ := session.Values[UploadGuildsSessionKey].(string)
+	return current, guilds, slices.Contains(strings.Split(uploadGuilds, ","), current)
+}
+
+// tokenGuilds returns the guild an API token request asked for with
+// GuildHeader and the guilds its user may act in, or "" if they may not act
+// in the one asked for
+func tokenGuilds(r *http.Request, discordID string) (string, []string, error) {
+	guilds := []string{config.AppConfig.DefaultGuildID}
+	if config.AppConfig.IsAdmin(discordID) {
+		guilds = config.AppConfig.GuildIDs()
+	} else {
+		ids, err := models.UserGuilds(r.Context(), discordID)
+		if err != nil {
+			return "", nil, err
+		}
+		if ids = slices.DeleteFunc(ids, func(id string) bool { return !config.AppConfig.IsAllowedGuild(id) }); len(ids) > 0 {
+			guilds = ids
+		}
+	}
+
+	requested := r.Header.Get(GuildHeader)
+	if requested == "" {
+		requested = config.AppConfig.DefaultGuildID
+		if !slices.Contains(guilds, requested) {
+			requested = guilds[0]
+		}
+	}
+	if !slices.Contains(guilds, requested) {
+		return "", guilds, nil
+	}
+	return requested, guilds, nil
+}
+
+// withGuild adds the current guild and the guilds the user may switch
+// between to the request context
+func withGuild(ctx context.Context, guildID string, guilds []string) context.Context {
+	ctx = context.WithValue(ctx, GuildIDKey, guildID)
+	return context.WithValue(ctx, guildsKey, guilds)
+}
+
+// GetGuildID returns the guild the request acts in, the default guild for
+// requests that aren't signed in
+func GetGuildID(r *http.Request) string {
+	if id, ok := r.Context().Value(GuildIDKey).(string); ok && id != "" {
+		return id
+	}
+	return config.AppConfig.DefaultGuildID
+}
+
+// GetGuilds returns the guilds the signed-in user may switch between
+func GetGuilds(r *http.Request) []string {
+	if guilds, ok := r.Context().Value(guildsKey).([]string); ok {
+		return guilds
+	}
+	return []string{GetGuildID(r)}
+}
+
+// SelectGuild makes guildID the guild the session browses
+func SelectGuild(session *sessions.Session, guildID string) {
+	session.Values[GuildSessionKey] = guildID
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/i18n"
+)
+
+// localeWriter carries the locale negotiated for a request to the helpers
+// that write its messages, which see only the response writer
+type localeWriter struct {
+	http.ResponseWriter
+	locale     string
+	translated bool
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *localeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Localize picks the locale of a request's messages from its Accept-Language
+// header, falling back to default_locale
+func Localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := i18n.Negotiate(r.Header.Get("Accept-Language"), config.AppConfig.DefaultLocale)
+		next.ServeHTTP(&localeWriter{ResponseWriter: w, locale: locale}, r)
+	})
+}
+
+// localeOf finds the localeWriter among the writers wrapping a response
+func localeOf(w http.ResponseWriter) *localeWriter {
+	for w != nil {
+		if lw, ok := w.(*localeWriter); ok {
+			return lw
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+	return nil
+}
+
+// Locale returns the locale negotiated for the response, or default_locale
+// outside of Localize
+func Locale(w http.ResponseWriter) string {
+	if lw := localeOf(w); lw != nil {
+		return lw.locale
+	}
+	return config.AppConfig.DefaultLocale
+}
+
+// Translate returns a message in the response's locale. The response is
+// marked as depending on Accept-Language, and as being in the locale when the
+// message has a translation.
+func Translate(w http.ResponseWriter, message string) string {
+	lw := localeOf(w)
+	if lw == nil {
+		return message
+	}
+	if !lw.translated {
+		lw.translated = true
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	translated := i18n.Translate(lw.locale, message)
+	if translated != message {
+		w.Header().Set("Content-Language", lw.locale)
+	}
+	return translated
+}
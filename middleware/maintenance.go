@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/assets"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// maintenanceExemptPaths stay reachable during maintenance: signing in, so
+// admins can get to the site, static files for the pages they see, metrics
+// and readiness probes, signed file URLs already handed out, and Discord
+// interactions, which the bot answers itself
+var maintenanceExemptPaths = []string{"/auth", strings.TrimSuffix(assets.Prefix, "/"), "/metrics", "/debug/vars", "/readyz", "/files", "/discord/interactions"}
+
+var maintenancePage = assets.Page("error.html")
+
+// Maintenance is router middleware that answers everyone but admins with a
+// 503 while the site is in maintenance mode, so nothing can be uploaded or
+// pulled until it ends
+func Maintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled, message := config.AppConfig.InMaintenance()
+		if !enabled || maintenanceExempt(r.URL.Path) || requestedByAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			Error(w, r, http.StatusServiceUnavailable, CodeMaintenance, message)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := maintenancePage.Execute(w, struct{ Title, Message string }{"Down for maintenance", message}); err != nil {
+			log.Printf("Failed to render maintenance page: %v", err)
+		}
+	})
+}
+
+func maintenanceExempt(path string) bool {
+	for _, p := range maintenanceExemptPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedByAdmin reports whether the request comes from a signed-in admin,
+// going by the real user of an admin viewing the site as someone else. API
+// tokens never act as admins. Sessions are checked in full by RequireAuth
+// afterwards; this only decides who sees the maintenance page.
+func requestedByAdmin(r *http.Request) bool {
+	if OnContentHost(r) {
+		query := r.URL.Query()
+		return validContentSignature(r.URL.Path, query) && config.AppConfig.IsAdmin(query.Get(contentUserParam))
+	}
+	if _, ok := bearerToken(r); ok {
+		return false
+	}
+	session, err := Store.Get(r, SessionName)
+	if err != nil {
+		return false
+	}
+	auth, _ := session.Values["authenticated"].(bool)
+	discordID, _ := session.Values["discord_id"].(string)
+	return auth && discordID != "" && config.AppConfig.IsAdmin(discordID)
+}
@@ -0,0 +1,308 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles a route may require, from least to most privileged
+const (
+	RolePublic   = "public"
+	RoleUser     = "user"
+	RoleUploader = "uploader"
+	RoleAdmin    = "admin"
+)
+
+var validRoles = map[string]bool{RolePublic: true, RoleUser: true, RoleUploader: true, RoleAdmin: true}
+
+// Policy maps a route, written as "METHOD /path/template" exactly as it is
+// registered on the router, to the role required to call it
+type Policy map[string]string
+
+// DefaultPolicy is the built-in authorization policy. Deployments may override
+// individual entries with authorization_policy in the config file.
+var DefaultPolicy = Policy{
+	"GET /":                                RolePublic,
+	"GET /auth/login":                      RolePublic,
+	"GET /auth/callback":                   RolePublic,
+	"GET /auth/login/{provider:[a-z]+}":    RolePublic,
+	"GET /auth/callback/{provider:[a-z]+}": RolePublic,
+	"GET /auth/logout":                     RolePublic,
+	"POST /api/takedown":                   RolePublic,
+	"GET /api/takedown/{token}":            RolePublic,
+	"GET /api/openapi.json":                RolePublic,
+	"GET /static/{name}":                   RolePublic,
+	"GET /files/{name:.+}":                 RolePublic,
+	"GET /debug/vars":                      RolePublic,
+	"GET /metrics":                         RolePublic,
+	"POST /discord/interactions":           RolePublic,
+	"GET /wallpapers/{id:[0-9]+}":          RolePublic,
+	"GET /wallpapers/{id:[0-9]+}/preview":  RolePublic,
+	"GET /oembed":                          RolePublic,
+	"GET /readyz":                          RolePublic,
+
+	"GET /upload":                                    RoleUser,
+	"GET /api/user":                                  RoleUser,
+	"PUT /api/user/timezone":                         RoleUser,
+	"PUT /api/user/privacy":                          RoleUser,
+	"PUT /api/user/showcase":                         RoleUser,
+	"PUT /api/user/notifications":                    RoleUser,
+	"GET /api/guilds":                                RoleUser,
+	"PUT /api/guilds/current":                        RoleUser,
+	"GET /api/me/uploads":                            RoleUser,
+	"GET /api/me/uploads/{id:[0-9]+}/status":         RoleUser,
+	"GET /api/me/storage":                            RoleUser,
+	"GET /api/me/export":                             RoleUser,
+	"POST /api/me/delete":                            RoleUser,
+	"DELETE /api/me/delete":                          RoleUser,
+	"GET /api/me/links":                              RoleUser,
+	"POST /api/me/links":                             RoleUser,
+	"POST /api/me/links/code":                        RoleUser,
+	"GET /api/me/sessions":                           RoleUser,
+	"DELETE /api/me/sessions":                        RoleUser,
+	"DELETE /api/me/sessions/{id:[0-9a-f]+}":         RoleUser,
+	"GET /api/users/{id:(?:[a-z]+:)?[0-9]+}":         RoleUser,
+	"GET /users/{id:(?:[a-z]+:)?[0-9]+}":             RoleUser,
+	"GET /feed.xml":                                  RoleUser,
+	"GET /ws/live":                                   RoleUser,
+	"GET /api/config":                                RoleUser,
+	"GET /api/feed.xml":                              RoleUser,
+	"GET /api/tokens":                                RoleUser,
+	"POST /api/tokens":                               RoleUser,
+	"DELETE /api/tokens/{id:[0-9]+}":                 RoleUser,
+	"GET /api/upload/status":                         RoleUser,
+	"GET /api/upload/progress/{ticket}":              RoleUploader,
+	"POST /api/upload":                               RoleUploader,
+	"POST /api/upload/zip":                           RoleUploader,
+	"POST /api/upload/sessions":                      RoleUploader,
+	"GET /api/upload/sessions/{id:[0-9]+}":           RoleUploader,
+	"PATCH /api/upload/sessions/{id:[0-9]+}":         RoleUploader,
+	"DELETE /api/upload/sessions/{id:[0-9]+}":        RoleUploader,
+	"POST /api/upload/sessions/{id:[0-9]+}/complete": RoleUploader,
+	"GET /api/drafts":                                RoleUploader,
+	"POST /api/drafts":                               RoleUploader,
+	"GET /api/drafts/{id:[0-9]+}":                    RoleUploader,
+	"PUT /api/drafts/{id:[0-9]+}":                    RoleUploader,
+	"DELETE /api/drafts/{id:[0-9]+}":                 RoleUploader,
+	"GET /api/drafts/{id:[0-9]+}/file":               RoleUploader,
+	"POST /api/drafts/{id:[0-9]+}/publish":           RoleUploader,
+	"GET /api/uploads":                               RoleUser,
+	"PATCH /api/uploads/{id:[0-9]+}":                 RoleUser,
+	"DELETE /api/uploads/{id:[0-9]+}":                RoleUser,
+	"GET /api/uploads/{id:[0-9]+}/rarity-vote":       RoleUser,
+	"POST /api/uploads/{id:[0-9]+}/rarity-vote":      RoleUser,
+	"POST /api/uploads/{id:[0-9]+}/report":           RoleUser,
+	"POST /api/uploads/{id:[0-9]+}/like":             RoleUser,
+	"DELETE /api/uploads/{id:[0-9]+}/like":           RoleUser,
+	"GET /api/uploads/{id:[0-9]+}/image":             RoleUser,
+	"GET /api/random":                                RoleUser,
+	"GET /api/wallpapers/trending":                   RoleUser,
+	"GET /api/wallpapers/{id:[0-9]+}":                RoleUser,
+	"GET /api/tags":                                  RoleUser,
+	"GET /api/search":                                RoleUser,
+	"POST /api/pulls":                                RoleUser,
+	"POST /api/pulls/start":                          RoleUser,
+	"POST /api/pulls/reveal":                         RoleUser,
+	"GET /api/pulls/status":                          RoleUser,
+	"GET /api/pulls/history":                         RoleUser,
+	"GET /api/pulls/seeds":                           RoleUser,
+	"GET /api/pulls/{id:[0-9]+}/verify":              RoleUser,
+	"POST /api/pulls/{id:[0-9]+}/reroll":             RoleUser,
+	"GET /api/rerolls":                               RoleUser,
+	"GET /api/achievements":                          RoleUser,
+	"GET /api/wallet":                                RoleUser,
+	"GET /api/wallet/earnings":                       RoleUser,
+	"GET /api/dust":                                  RoleUser,
+	"POST /api/dust/convert":                         RoleUser,
+	"POST /api/dust/exchange":                        RoleUser,
+	"GET /api/collection":                            RoleUser,
+	"GET /api/collection/progress":                   RoleUser,
+	"GET /api/collection/download":                   RoleUser,
+	"GET /api/wishlist":                              RoleUser,
+	"PUT /api/wishlist/{id:[0-9]+}":                  RoleUser,
+	"DELETE /api/wishlist/{id:[0-9]+}":               RoleUser,
+	"GET /api/trades":                                RoleUser,
+	"POST /api/trades":                               RoleUser,
+	"GET /api/trades/inbox":                          RoleUser,
+	"GET /api/trades/{id:[0-9]+}":                    RoleUser,
+	"POST /api/trades/{id:[0-9]+}/accept":            RoleUser,
+	"POST /api/trades/{id:[0-9]+}/decline":           RoleUser,
+	"POST /api/trades/{id:[0-9]+}/cancel":            RoleUser,
+	"GET /api/notifications":                         RoleUser,
+	"GET /api/notifications/unread":                  RoleUser,
+	"POST /api/notifications/read":                   RoleUser,
+	"POST /api/notifications/{id:[0-9]+}/read":       RoleUser,
+	"GET /api/leaderboard":                           RoleUser,
+	"GET /api/stats/timeseries":                      RoleUser,
+	"GET /api/banners":                               RoleUser,
+	"GET /api/seasons":                               RoleUser,
+	"GET /images/{id:[0-9]+}":                        RoleUser,
+	"GET /images/{id:[0-9]+}/thumb":                  RoleUser,
+
+	"POST /api/admin/uploads/bulk":                 RoleAdmin,
+	"GET /api/admin/uploads/{id:[0-9]+}":           RoleAdmin,
+	"PUT /api/admin/uploads/{id:[0-9]+}/tags":      RoleAdmin,
+	"POST /api/admin/uploads/{id:[0-9]+}/owner":    RoleAdmin,
+	"POST /api/admin/uploads/{id:[0-9]+}/merge":    RoleAdmin,
+	"GET /api/admin/takedowns":                     RoleAdmin,
+	"POST /api/admin/takedowns/{id:[0-9]+}":        RoleAdmin,
+	"GET /api/admin/reports":                       RoleAdmin,
+	"POST /api/admin/uploads/{id:[0-9]+}/reports":  RoleAdmin,
+	"GET /api/admin/stats":                         RoleAdmin,
+	"GET /api/admin/trash":                         RoleAdmin,
+	"POST /api/admin/trash/{id:[0-9]+}/restore":    RoleAdmin,
+	"DELETE /api/admin/trash/{id:[0-9]+}":          RoleAdmin,
+	"GET /api/admin/quarantine":                    RoleAdmin,
+	"GET /api/admin/quarantine/{id:[0-9]+}/file":   RoleAdmin,
+	"DELETE /api/admin/quarantine/{id:[0-9]+}":     RoleAdmin,
+	"GET /api/admin/integrity":                     RoleAdmin,
+	"POST /api/admin/integrity":                    RoleAdmin,
+	"GET /api/admin/orphans":                       RoleAdmin,
+	"POST /api/admin/orphans":                      RoleAdmin,
+	"GET /api/admin/scheduler":                     RoleAdmin,
+	"POST /api/admin/scheduler/{name:[a-z_]+}/run": RoleAdmin,
+	"GET /api/admin/bans":                          RoleAdmin,
+	"POST /api/admin/bans":                         RoleAdmin,
+	"DELETE /api/admin/bans/{id}":                  RoleAdmin,
+	"GET /api/admin/users/{id}/sessions":           RoleAdmin,
+	"GET /api/admin/users/{id}/names":              RoleAdmin,
+	"GET /api/admin/links":                         RoleAdmin,
+	"POST /api/admin/links/{id:[0-9]+}":            RoleAdmin,
+	"GET /api/admin/alts":                          RoleAdmin,
+	"GET /api/admin/storage":                       RoleAdmin,
+	"DELETE /api/admin/users/{id}/sessions":        RoleAdmin,
+	"GET /api/admin/audit":                         RoleAdmin,
+	"POST /api/admin/wallets/adjustments":          RoleAdmin,
+	"GET /api/admin/wallets/{id}":                  RoleAdmin,
+	"GET /api/admin/banners":                       RoleAdmin,
+	"POST /api/admin/banners":                      RoleAdmin,
+	"PUT /api/admin/banners/{id:[0-9]+}":           RoleAdmin,
+	"DELETE /api/admin/banners/{id:[0-9]+}":        RoleAdmin,
+	"GET /api/admin/gacha/rates":                   RoleAdmin,
+	"PUT /api/admin/gacha/rates":                   RoleAdmin,
+	"GET /api/admin/gacha/pool":                    RoleAdmin,
+	"GET /api/admin/gacha/pool/{rarity:[a-z]+}":    RoleAdmin,
+	"POST /api/admin/gacha/pool/uploads":           RoleAdmin,
+	"GET /api/admin/maintenance":                   RoleAdmin,
+	"PUT /api/admin/maintenance":                   RoleAdmin,
+	"POST /api/admin/config/reload":                RoleAdmin,
+	"GET /api/admin/upload-rules":                  RoleAdmin,
+	"POST /api/admin/upload-rules":                 RoleAdmin,
+	"DELETE /api/admin/upload-rules/{id:[0-9]+}":   RoleAdmin,
+	"GET /api/admin/seasons":                       RoleAdmin,
+	"POST /api/admin/seasons":                      RoleAdmin,
+	"PUT /api/admin/seasons/{id:[0-9]+}":           RoleAdmin,
+	"DELETE /api/admin/seasons/{id:[0-9]+}":        RoleAdmin,
+	"GET /api/admin/deliveries":                    RoleAdmin,
+	"POST /api/admin/deliveries/{id:[0-9]+}/retry": RoleAdmin,
+	"GET /api/admin/policy":                        RoleAdmin,
+	"POST /api/admin/impersonate/{id}":             RoleAdmin,
+	"DELETE /api/admin/impersonate":                RoleAdmin,
+}
+
+var activePolicy = DefaultPolicy
+
+// LoadPolicy makes the default policy, with overrides applied on top, the
+// policy enforced by Authorize
+func LoadPolicy(overrides map[string]string) error {
+	policy := make(Policy, len(DefaultPolicy)+len(overrides))
+	for route, role := range DefaultPolicy {
+		policy[route] = role
+	}
+	for route, role := range overrides {
+		if !validRoles[role] {
+			return fmt.Errorf("authorization policy for %q: unknown role %q", route, role)
+		}
+		if _, ok := DefaultPolicy[route]; !ok {
+			return fmt.Errorf("authorization policy: unknown route %q", route)
+		}
+		if policy[route] != role {
+			log.Printf("Authorization policy: %s requires %s (default %s)", route, role, policy[route])
+		}
+		policy[route] = role
+	}
+
+	activePolicy = policy
+	return nil
+}
+
+// EffectivePolicy returns a copy of the policy currently being enforced
+func EffectivePolicy() Policy {
+	policy := make(Policy, len(activePolicy))
+	for route, role := range activePolicy {
+		policy[route] = role
+	}
+	return policy
+}
+
+// policyKey returns the policy entry of a route. Routes of the versioned API
+// share the entries of their /api routes.
+func policyKey(method, template string) string {
+	return method + " " + unversionedPath(template)
+}
+
+// CheckPolicy verifies that every route registered on the router has a
+// policy entry, so a new route cannot be exposed by forgetting one
+func CheckPolicy(router *mux.Router) error {
+	var missing []string
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if _, ok := activePolicy[policyKey(method, template)]; !ok {
+				missing = append(missing, method+" "+template)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("routes without an authorization policy: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Authorize is router middleware that enforces the role the policy requires
+// for the matched route. Routes missing from the policy are denied.
+func Authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			Error(w, r, http.StatusForbidden, CodeForbidden, "Forbidden")
+			return
+		}
+
+		switch role := activePolicy[policyKey(r.Method, template)]; role {
+		case RolePublic:
+			next.ServeHTTP(w, r)
+		case RoleUser:
+			RequireAuth(next.ServeHTTP)(w, r)
+		case RoleUploader:
+			RequireUploader(next.ServeHTTP)(w, r)
+		case RoleAdmin:
+			RequireAdmin(next.ServeHTTP)(w, r)
+		default:
+			log.Printf("Authorization: no policy for %s %s, denying request from IP: %s", r.Method, template, r.RemoteAddr)
+			Error(w, r, http.StatusForbidden, CodeForbidden, "Forbidden")
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// How often idle buckets are dropped from a limiter
+const rateLimitSweepInterval = 5 * time.Minute
+
+var rateLimited = expvar.NewMap("rate_limited")
+
+// bucket is a token bucket; tokens refill continuously up to the burst size
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per client IP and per Discord ID
+type RateLimiter struct {
+	name      string
+	rate      float64 // tokens added per second
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter from its configuration. It returns nil,
+// which RateLimit treats as no limit, when the limit is turned off.
+func NewRateLimiter(name string, limit config.RateLimit) *RateLimiter {
+	if limit.PerMinute < 0 {
+		return nil
+	}
+	return &RateLimiter{
+		name:      name,
+		rate:      float64(limit.PerMinute) / 60,
+		burst:     float64(limit.Burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// take spends a token from each of the keys' buckets, or from none of them
+// if any is empty. It returns the tokens left in the emptiest bucket and how
+// long until that bucket is full again; when refused, retryAfter is how long
+// until every bucket holds a token.
+func (l *RateLimiter) take(keys []string, now time.Time) (ok bool, remaining float64, reset, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	buckets := make([]*bucket, len(keys))
+	ok = true
+	for i, key := range keys {
+		b := l.buckets[key]
+		if b == nil {
+			b = &bucket{tokens: l.burst, last: now}
+			l.buckets[key] = b
+		}
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+		buckets[i] = b
+		if b.tokens < 1 {
+			ok = false
+			retryAfter = max(retryAfter, l.refill(1-b.tokens))
+		}
+	}
+
+	remaining = l.burst
+	for _, b := range buckets {
+		if ok {
+			b.tokens--
+		}
+		remaining = math.Min(remaining, b.tokens)
+	}
+	return ok, remaining, l.refill(l.burst - remaining), retryAfter
+}
+
+// refill returns how long it takes to add the given number of tokens
+func (l *RateLimiter) refill(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, since a new bucket
+// starts out full anyway
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// RateLimit wraps a handler with the limiter. Requests are counted against
+// the client's IP address and, once signed in, against the user, so neither
+// switching accounts nor switching addresses gets around the limit. A nil
+// limiter lets every request through.
+func RateLimit(l *RateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		keys := []string{"ip:" + ip}
+		if id := GetRealDiscordID(r); id != "" {
+			keys = append(keys, "user:"+id)
+		}
+
+		now := time.Now()
+		ok, remaining, reset, retryAfter := l.take(keys, now)
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(l.burst)))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(reset).Unix(), 10))
+
+		if !ok {
+			rateLimited.Add(l.name, 1)
+			if id := GetRealDiscordID(r); id != "" {
+				log.Printf("Rate limit (%s) exceeded for %s %s by user %s (ID: %s) from IP: %s", l.name, r.Method, r.URL.Path, GetUsername(r), id, ip)
+			} else {
+				log.Printf("Rate limit (%s) exceeded for %s %s from IP: %s", l.name, r.Method, r.URL.Path, ip)
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			Error(w, r, http.StatusTooManyRequests, CodeRateLimited, "Too many requests, please slow down")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
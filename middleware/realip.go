@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// ClientIPKey holds the client address resolved by RealIP
+const ClientIPKey contextKey = "client_ip"
+
+// RealIP resolves the client address once per request and puts it in
+// r.RemoteAddr, so logs and rate limits see the client rather than the
+// reverse proxy in front of the server
+func RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r)
+		r.RemoteAddr = ip
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ClientIPKey, ip)))
+	})
+}
+
+// ClientIP returns the IP address of the client making the request
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(ClientIPKey).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r)
+}
+
+// resolveClientIP finds the client address. Behind a trusted reverse proxy,
+// or on the unix socket, which only a local proxy can reach, it comes from
+// X-Forwarded-For, or X-Real-IP when the proxy only sets that, instead of
+// the connection.
+func resolveClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err == nil && !config.AppConfig.TrustedProxy(peer) {
+		return peer.Unmap().String()
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return addr.Unmap().String()
+		}
+		return host
+	}
+
+	// Walk the chain from the nearest hop, skipping proxies we trust
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap().String()
+		if !config.AppConfig.TrustedProxy(addr) {
+			break
+		}
+	}
+	return client
+}
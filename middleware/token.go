@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// APITokenPrefix starts every API token, making leaked tokens easy to recognise
+const APITokenPrefix = "wg_"
+
+// APITokenIDKey holds the ID of the API token that authenticated the request
+const APITokenIDKey contextKey = "api_token_id"
+
+// sessionOnlyPaths cannot be reached with an API token, so a leaked token
+// can't mint further tokens, manage sign-ins, link accounts or act as an admin
+var sessionOnlyPaths = []string{"/api/tokens", "/api/me/sessions", "/api/me/links", "/api/admin"}
+
+// NewAPIToken generates a token, returning it along with the hash to store
+func NewAPIToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := APITokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAPIToken(token), nil
+}
+
+// HashAPIToken returns the hash a token is stored and looked up by. Tokens are
+// random, so a plain SHA-256 is enough.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokensAllowed reports whether an /api path can be called with an API token
+func TokensAllowed(path string) bool {
+	path = unversionedPath(path)
+	for _, p := range sessionOnlyPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authenticateToken serves an /api request authenticated by an API token
+// instead of a session
+func authenticateToken(next http.HandlerFunc, w http.ResponseWriter, r *http.Request, token string) {
+	path := unversionedPath(r.URL.Path)
+	if !strings.HasPrefix(path, "/api/") {
+		Error(w, r, http.StatusUnauthorized, CodeInvalidAPIToken, "API tokens can only be used for /api routes")
+		return
+	}
+	if !TokensAllowed(path) {
+		log.Printf("API token denied %s %s from IP: %s: session required", r.Method, r.URL.Path, r.RemoteAddr)
+		Error(w, r, http.StatusForbidden, CodeSessionRequired, "This endpoint requires signing in; API tokens cannot be used")
+		return
+	}
+
+	unauthorized := func() {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		Error(w, r, http.StatusUnauthorized, CodeInvalidAPIToken, "Invalid API token")
+	}
+
+	t, err := models.GetActiveAPIToken(r.Context(), HashAPIToken(token))
+	if err == sql.ErrNoRows {
+		log.Printf("Authentication required: invalid API token for %s %s from IP: %s", r.Method, r.URL.Path, r.RemoteAddr)
+		unauthorized()
+		return
+	} else if err != nil {
+		log.Printf("Failed to look up API token: %v", err)
+		Error(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		return
+	}
+
+	user, err := models.GetUser(r.Context(), t.DiscordID)
+	if err == sql.ErrNoRows {
+		unauthorized()
+		return
+	} else if err != nil {
+		log.Printf("Failed to get user %s for API token %d: %v", t.DiscordID, t.ID, err)
+		Error(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		return
+	}
+
+	if denyBanned(w, r, user.DiscordID, user.Username) {
+		return
+	}
+
+	// Signing a user out everywhere, e.g. after they leave the server, also
+	// invalidates the tokens they created before then
+	revoked, err := models.SessionRevoked(r.Context(), user.DiscordID, t.CreatedAt)
+	if err != nil {
+		log.Printf("Failed to check session revocation for user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		Error(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		return
+	}
+	if revoked {
+		log.Printf("Revoked API token %d of user %s (ID: %s) denied %s %s from IP: %s", t.ID, user.Username, user.DiscordID, r.Method, r.URL.Path, r.RemoteAddr)
+		unauthorized()
+		return
+	}
+
+	guildID, guilds, err := tokenGuilds(r, user.DiscordID)
+	if err != nil {
+		log.Printf("Failed to look up guilds of user %s (ID: %s): %v", user.Username, user.DiscordID, err)
+		Error(w, r, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		return
+	}
+	if guildID == "" {
+		Error(w, r, http.StatusForbidden, CodeNotInGuild, "You are not in the Discord server "+GuildHeader+" asks for")
+		return
+	}
+
+	if err := models.TouchAPIToken(r.Context(), t.ID); err != nil {
+		log.Printf("Failed to record use of API token %d: %v", t.ID, err)
+	}
+
+	ctx := withGuild(r.Context(), guildID, guilds)
+	ctx = context.WithValue(ctx, DiscordIDKey, user.DiscordID)
+	ctx = context.WithValue(ctx, UsernameKey, user.Username)
+	ctx = context.WithValue(ctx, PermissionKey, t.Permission)
+	ctx = context.WithValue(ctx, APITokenIDKey, t.ID)
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// GetAPITokenID returns the ID of the API token that authenticated the
+// request, or 0 for session requests
+func GetAPITokenID(r *http.Request) int64 {
+	if id, ok := r.Context().Value(APITokenIDKey).(int64); ok {
+		return id
+	}
+	return 0
+}
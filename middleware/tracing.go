@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+)
+
+// Tracing starts a server span for each request, continuing the caller's
+// trace when it sends a traceparent header. Handlers find the span in the
+// request context and hang their own spans off it.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx, span := tracing.StartSpan(tracing.Extract(r.Context(), r.Header), r.Method+" "+route, tracing.KindServer)
+		defer span.End()
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", rec.status)
+	})
+}
@@ -0,0 +1,298 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// exportTables lists the records a data export contains, by the name they
+// are exported under. Every ? is bound to the user's Discord ID. Secrets such
+// as token hashes, refresh tokens and session contents are left out.
+var exportTables = []struct {
+	name, query string
+}{
+	{"profile", "SELECT discord_id, username, display_name, avatar_hash, created_at, last_upload_at, timezone, profile_private, discord_dms, deletion_requested_at FROM users WHERE discord_id = ?"},
+	{"uploads", `SELECT id, original_filename, title, description, file_size, sha256, source, license, visibility, width, height,
+		like_count, view_count, download_count, safety_status, uploaded_at, deleted_at
+		FROM uploads WHERE discord_id = ? ORDER BY id`},
+	{"upload_tags", "SELECT ut.upload_id, t.name FROM upload_tags ut JOIN tags t ON t.id = ut.tag_id JOIN uploads u ON u.id = ut.upload_id WHERE u.discord_id = ? ORDER BY ut.upload_id, t.name"},
+	{"upload_rejections", "SELECT r.upload_id, r.reason, r.note, r.created_at FROM upload_rejections r JOIN uploads u ON u.id = r.upload_id WHERE u.discord_id = ? ORDER BY r.id"},
+	{"drafts", "SELECT id, original_filename, title, description, tags, license, visibility, file_size, created_at, expires_at FROM drafts WHERE discord_id = ? ORDER BY id"},
+	{"pulls", "SELECT id, upload_id, source, duplicate, discarded, rerolled_from, banner_id, pulled_at FROM pulls WHERE discord_id = ? ORDER BY id"},
+	{"likes", "SELECT upload_id, created_at FROM likes WHERE discord_id = ? ORDER BY created_at"},
+	{"wishlist", "SELECT upload_id, created_at FROM wishlists WHERE discord_id = ? ORDER BY created_at"},
+	{"showcase", "SELECT upload_id, position FROM showcases WHERE discord_id = ? ORDER BY position"},
+	{"rarity_votes", "SELECT upload_id, rarity, created_at FROM rarity_votes WHERE discord_id = ? ORDER BY created_at"},
+	{"trades", `SELECT id, sender_id, recipient_id, offered_upload_id, requested_upload_id, status, created_at, expires_at, resolved_at
+		FROM trades WHERE sender_id = ? OR recipient_id = ? ORDER BY id`},
+	{"dust_ledger", "SELECT amount, reason, reference, created_at FROM dust_ledger WHERE discord_id = ? ORDER BY id"},
+	{"reroll_ledger", "SELECT delta, reason, reference, created_at FROM reroll_ledger WHERE discord_id = ? ORDER BY id"},
+	{"wallet_ledger", "SELECT type, amount, reason, reference, created_at FROM wallet_ledger WHERE discord_id = ? ORDER BY id"},
+	{"notifications", "SELECT type, message, upload_id, trade_id, created_at, read_at FROM notifications WHERE discord_id = ? ORDER BY id"},
+	{"reports", "SELECT id, upload_id, category, details, status, created_at, resolved_at FROM reports WHERE reporter_id = ? ORDER BY id"},
+	{"api_tokens", "SELECT name, prefix, permission, created_at, last_used_at, revoked_at FROM api_tokens WHERE discord_id = ? ORDER BY id"},
+	{"sessions", "SELECT ip_address, user_agent, created_at, last_seen_at, expires_at FROM sessions WHERE discord_id = ? ORDER BY created_at"},
+	{"guilds", "SELECT guild_id FROM user_guilds WHERE discord_id = ? ORDER BY guild_id"},
+	{"bans", "SELECT reason, created_at, expires_at FROM bans WHERE discord_id = ?"},
+	{"activity", "SELECT action, target, details, ip, created_at FROM audit_log WHERE actor_id = ? ORDER BY id"},
+}
+
+// ExportUserData returns every record kept about a user, by table, with each
+// row as a map of column names to values
+func ExportUserData(ctx context.Context, discordID string) (map[string][]map[string]interface{}, error) {
+	data := make(map[string][]map[string]interface{}, len(exportTables))
+	for _, t := range exportTables {
+		args := make([]interface{}, strings.Count(t.query, "?"))
+		for i := range args {
+			args[i] = discordID
+		}
+
+		rows, err := exportRows(ctx, t.query, args...)
+		if err != nil {
+			return nil, err
+		}
+		data[t.name] = rows
+	}
+	return data, nil
+}
+
+// exportRows runs a query and returns its rows as maps, with text read as
+// strings rather than bytes
+func exportRows(ctx context.Context, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[column] = values[i]
+		}
+		list = append(list, row)
+	}
+	return list, rows.Err()
+}
+
+// ListUserUploads returns all of a user's uploads, trashed ones included,
+// oldest first
+func ListUserUploads(ctx context.Context, discordID string) ([]Upload, error) {
+	return queryUploads(ctx, uploadSelect+" WHERE u.discord_id = ? ORDER BY u.id", discordID)
+}
+
+// RequestAccountDeletion schedules the user's account for deletion and
+// returns when it was requested. Asking again keeps the original request;
+// created reports whether this call scheduled it.
+func RequestAccountDeletion(ctx context.Context, discordID string) (requestedAt time.Time, created bool, err error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	result, err := DB.Exec(
+		ctx, "UPDATE users SET deletion_requested_at = ? WHERE discord_id = ? AND deletion_requested_at IS NULL",
+		now.Format(timestampFormat), discordID,
+	)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if err := requireAffected(result); err == nil {
+		forgetUser(discordID)
+		return now, true, nil
+	} else if err != sql.ErrNoRows {
+		return time.Time{}, false, err
+	}
+
+	err = DB.QueryRow(ctx, "SELECT deletion_requested_at FROM users WHERE discord_id = ? AND deletion_requested_at IS NOT NULL", discordID).Scan(&requestedAt)
+	return requestedAt, false, err
+}
+
+// CancelAccountDeletion withdraws a scheduled deletion, returning
+// sql.ErrNoRows if none was scheduled
+func CancelAccountDeletion(ctx context.Context, discordID string) error {
+	result, err := DB.Exec(
+		ctx, "UPDATE users SET deletion_requested_at = NULL WHERE discord_id = ? AND deletion_requested_at IS NOT NULL",
+		discordID,
+	)
+	if err != nil {
+		return err
+	}
+	forgetUser(discordID)
+	return requireAffected(result)
+}
+
+// ListAccountsDueForDeletion returns the users who asked for their account to
+// be deleted before the given time
+func ListAccountsDueForDeletion(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT discord_id FROM users WHERE deletion_requested_at IS NOT NULL AND deletion_requested_at <= ? ORDER BY deletion_requested_at",
+		before.UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeletedAccount is what DeleteAccount leaves for the caller to clean up
+type DeletedAccount struct {
+	// Uploads are in the trash, ready to be purged
+	Uploads []int64
+	// Drafts and Partials are stored files of deleted drafts and resumable
+	// uploads
+	Drafts   []string
+	Partials []string
+}
+
+// DeleteAccount erases a user's personal data. Their uploads are moved to the
+// trash, their pulls, likes, wishlist, ledgers, notifications, API tokens,
+// drafts, guild memberships, past names and account links are deleted and
+// their pending trades cancelled. Reports they filed stay for moderation but
+// no longer name them, and their user record keeps only the Discord ID, so
+// bans and the audit log still apply. It returns sql.ErrNoRows if the user
+// has no pending deletion request.
+func DeleteAccount(ctx context.Context, discordID string) (*DeletedAccount, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(timestampFormat)
+	result, err := tx.Exec(
+		`UPDATE users SET username = '', display_name = '', avatar_hash = '', timezone = '', profile_private = 1, refresh_token = '', guild_verified_at = NULL,
+			sessions_revoked_at = ?, deletion_requested_at = NULL
+		WHERE discord_id = ? AND deletion_requested_at IS NOT NULL`,
+		now, discordID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireAffected(result); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE uploads SET deleted_at = ? WHERE discord_id = ? AND deleted_at IS NULL", now, discordID); err != nil {
+		return nil, err
+	}
+	deleted := &DeletedAccount{}
+	if deleted.Uploads, err = int64Column(tx, "SELECT id FROM uploads WHERE discord_id = ?", discordID); err != nil {
+		return nil, err
+	}
+	if deleted.Drafts, err = stringColumn(tx, "DELETE FROM drafts WHERE discord_id = ? RETURNING filename", discordID); err != nil {
+		return nil, err
+	}
+	if deleted.Partials, err = stringColumn(tx, "DELETE FROM upload_sessions WHERE discord_id = ? RETURNING filename", discordID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE uploads SET like_count = like_count - 1 WHERE id IN (SELECT upload_id FROM likes WHERE discord_id = ?) AND like_count > 0",
+		discordID,
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE trades SET status = ?, resolved_at = ? WHERE (sender_id = ? OR recipient_id = ?) AND status = ?",
+		TradeCancelled, now, discordID, discordID, TradePending,
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE reports SET reporter_id = 'deleted:' || CAST(id AS TEXT) WHERE reporter_id = ?",
+		discordID,
+	); err != nil {
+		return nil, err
+	}
+
+	// Accounts linked to this one start afresh, as their data went with it
+	if _, err := tx.Exec("UPDATE users SET linked_to = '' WHERE linked_to = ?", discordID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM account_links WHERE primary_id = ? OR alt_id = ?", discordID, discordID); err != nil {
+		return nil, err
+	}
+
+	// Draws stay under the account that drew them when its pulls move to a
+	// linked one, so they go by pull
+	if _, err := tx.Exec("DELETE FROM pull_draws WHERE pull_id IN (SELECT id FROM pulls WHERE discord_id = ?)", discordID); err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"pulls", "likes", "wishlists", "showcases", "rarity_votes", "dust_ledger", "reroll_ledger", "wallet_ledger", "notifications", "api_tokens", "user_guilds", "username_history", "link_codes", "device_fingerprints"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE discord_id = ?", discordID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	forgetUser(discordID)
+	forgetPools()
+	return deleted, nil
+}
+
+// int64Column runs a query returning one integer column
+func int64Column(tx *Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []int64
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// stringColumn runs a query returning one text column
+func stringColumn(tx *Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
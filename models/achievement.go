@@ -0,0 +1,38 @@
+package models
+
+import "context"
+
+// AchievementCounters are the totals achievements are measured against.
+// CompletedTags counts tags on at least the given number of pullable
+// wallpapers, all of which the user has collected.
+type AchievementCounters struct {
+	Pulls         int
+	Collected     int
+	Uploads       int
+	CompletedTags int
+}
+
+// GetAchievementCounters returns the user's achievement totals. Only tags on
+// at least minTagSize wallpapers in the pool count towards CompletedTags.
+func GetAchievementCounters(ctx context.Context, discordID string, minTagSize int) (AchievementCounters, error) {
+	var c AchievementCounters
+	var err error
+	if c.Pulls, c.Collected, err = PullStats(ctx, discordID); err != nil {
+		return c, err
+	}
+
+	err = DB.QueryRow(
+		ctx, `SELECT
+			(SELECT COUNT(*) FROM uploads WHERE discord_id = ? AND deleted_at IS NULL),
+			(SELECT COUNT(*) FROM (
+				SELECT ut.tag_id FROM upload_tags ut JOIN uploads u ON u.id = ut.upload_id
+				WHERE `+visibleUploadCondition+`
+				GROUP BY ut.tag_id
+				HAVING COUNT(*) >= ? AND COUNT(*) = SUM(CASE WHEN EXISTS (
+					SELECT 1 FROM pulls p WHERE p.discord_id = ? AND p.upload_id = u.id AND p.discarded = 0
+				) THEN 1 ELSE 0 END)
+			) completed)`,
+		discordID, minTagSize, discordID,
+	).Scan(&c.Uploads, &c.CompletedTags)
+	return c, err
+}
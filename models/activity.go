@@ -0,0 +1,208 @@
+package models
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fetches of full images are counted in memory and written in batches by
+// FlushImageAccess, so serving an image doesn't write to the database
+var (
+	accessMu      sync.Mutex
+	pendingAccess = make(map[int64]accessCounts)
+)
+
+type accessCounts struct {
+	views, downloads int64
+}
+
+// RecordImageAccess counts a fetch of an upload's full image, either as a
+// view or, when the client asked to save it, as a download. The count is
+// held in memory until the next FlushImageAccess.
+func RecordImageAccess(uploadID int64, download bool) {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	c := pendingAccess[uploadID]
+	if download {
+		c.downloads++
+	} else {
+		c.views++
+	}
+	pendingAccess[uploadID] = c
+}
+
+// FlushImageAccess writes the fetches counted since the last flush to the
+// uploads' view and download counts, and to the hour's activity that
+// trending is ranked by. If the write fails, the counts are kept for the
+// next flush.
+func FlushImageAccess(ctx context.Context) error {
+	accessMu.Lock()
+	pending := pendingAccess
+	pendingAccess = make(map[int64]accessCounts)
+	accessMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := writeImageAccess(ctx, pending); err != nil {
+		accessMu.Lock()
+		for id, c := range pending {
+			p := pendingAccess[id]
+			p.views += c.views
+			p.downloads += c.downloads
+			pendingAccess[id] = p
+		}
+		accessMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeImageAccess(ctx context.Context, pending map[int64]accessCounts) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hour := time.Now().UTC().Truncate(time.Hour).Format(timestampFormat)
+	for id, c := range pending {
+		if _, err := tx.Exec(
+			"UPDATE uploads SET view_count = view_count + ?, download_count = download_count + ? WHERE id = ?",
+			c.views, c.downloads, id,
+		); err != nil {
+			return err
+		}
+		// Uploads purged since they were fetched are skipped
+		if _, err := tx.Exec(
+			`INSERT INTO upload_activity (upload_id, hour, views, downloads)
+			SELECT id, ?, ?, ? FROM uploads WHERE id = ?
+			ON CONFLICT (upload_id, hour) DO UPDATE SET
+				views = upload_activity.views + excluded.views, downloads = upload_activity.downloads + excluded.downloads`,
+			hour, c.views, c.downloads, id,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteUploadActivityBefore deletes the hourly activity recorded before the
+// given time, returning how many rows were deleted
+func DeleteUploadActivityBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := DB.Exec(ctx, "DELETE FROM upload_activity WHERE hour < ?", before.UTC().Format(timestampFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Trending ranks wallpapers by their views and downloads over the last
+// TrendingWindow, each worth half as much for every TrendingHalfLife since
+// the hour it was made in. A download counts as trendingDownloadWeight views.
+const (
+	TrendingWindow         = 7 * 24 * time.Hour
+	TrendingHalfLife       = 24 * time.Hour
+	trendingDownloadWeight = 3
+)
+
+// TrendingUpload is an upload with its trending score
+type TrendingUpload struct {
+	Upload Upload
+	Score  float64
+}
+
+type trendingRank struct {
+	uploadID int64
+	score    float64
+}
+
+// ListTrending returns a page of the guild's public wallpapers with views or
+// downloads in the trending window, highest score first, along with the
+// total number. Rankings are cached for a minute.
+func ListTrending(ctx context.Context, guildID string, limit, offset int) ([]TrendingUpload, int, error) {
+	ranks, ok := trendingCache.Get(guildID)
+	if !ok {
+		var err error
+		if ranks, err = rankTrending(ctx, guildID, time.Now().UTC()); err != nil {
+			return nil, 0, err
+		}
+		trendingCache.Set(guildID, ranks)
+	}
+
+	trending := []TrendingUpload{}
+	if offset >= len(ranks) {
+		return trending, len(ranks), nil
+	}
+	page := ranks[offset:min(offset+limit, len(ranks))]
+
+	placeholders := make([]string, len(page))
+	args := make([]interface{}, len(page))
+	for i, r := range page {
+		placeholders[i] = "?"
+		args[i] = r.uploadID
+	}
+	// Uploads hidden since they were ranked are left out of the page
+	uploads, err := queryUploads(ctx, uploadSelect+" WHERE "+visibleUploadCondition+" AND u.id IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	byID := make(map[int64]Upload, len(uploads))
+	for _, u := range uploads {
+		byID[u.ID] = u
+	}
+	for _, r := range page {
+		if u, ok := byID[r.uploadID]; ok {
+			trending = append(trending, TrendingUpload{Upload: u, Score: r.score})
+		}
+	}
+	return trending, len(ranks), nil
+}
+
+// rankTrending scores the guild's public wallpapers by their activity in
+// the trending window before now, highest first
+func rankTrending(ctx context.Context, guildID string, now time.Time) ([]trendingRank, error) {
+	rows, err := DB.Query(
+		ctx, `SELECT a.upload_id, a.hour, a.views, a.downloads FROM upload_activity a JOIN uploads u ON u.id = a.upload_id
+		WHERE `+visibleUploadCondition+` AND u.guild_id = ? AND a.hour >= ?`,
+		guildID, now.Add(-TrendingWindow).Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := make(map[int64]float64)
+	for rows.Next() {
+		var id, views, downloads int64
+		var hour time.Time
+		if err := rows.Scan(&id, &hour, &views, &downloads); err != nil {
+			return nil, err
+		}
+		// Activity is dated to the middle of its hour
+		age := now.Sub(hour.Add(time.Hour / 2))
+		decay := math.Pow(0.5, max(age, 0).Hours()/TrendingHalfLife.Hours())
+		scores[id] += float64(views+trendingDownloadWeight*downloads) * decay
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ranks := make([]trendingRank, 0, len(scores))
+	for id, score := range scores {
+		ranks = append(ranks, trendingRank{uploadID: id, score: score})
+	}
+	slices.SortFunc(ranks, func(a, b trendingRank) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		// Newer uploads first among equals
+		return cmp.Compare(b.uploadID, a.uploadID)
+	})
+	return ranks, nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// AdminGrant is an administrator granted from the command line rather than
+// listed in admin_discord_ids
+type AdminGrant struct {
+	DiscordID string
+	GrantedBy string
+	CreatedAt time.Time
+}
+
+// GrantAdmin makes a user an administrator. Granting an existing
+// administrator again changes nothing.
+func GrantAdmin(ctx context.Context, discordID, grantedBy string) error {
+	_, err := DB.Exec(
+		ctx, "INSERT INTO admin_grants (discord_id, granted_by) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		discordID, grantedBy,
+	)
+	return err
+}
+
+// RevokeAdmin removes a granted administrator, returning sql.ErrNoRows if the
+// user had no grant
+func RevokeAdmin(ctx context.Context, discordID string) error {
+	result, err := DB.Exec(ctx, "DELETE FROM admin_grants WHERE discord_id = ?", discordID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// ListAdminGrants returns the granted administrators, oldest grant first
+func ListAdminGrants(ctx context.Context) ([]AdminGrant, error) {
+	rows, err := DB.Query(ctx, "SELECT discord_id, granted_by, created_at FROM admin_grants ORDER BY created_at, discord_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []AdminGrant
+	for rows.Next() {
+		var g AdminGrant
+		if err := rows.Scan(&g.DiscordID, &g.GrantedBy, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// APIToken lets a user call the API without a browser session. Only a hash
+// of the token is stored; Prefix keeps the start of it so users can tell
+// their tokens apart. Permission is the user's permission level when the
+// token was created.
+type APIToken struct {
+	ID         int64
+	DiscordID  string
+	Name       string
+	Prefix     string
+	Permission string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+const apiTokenColumns = `id, discord_id, name, prefix, permission, created_at, last_used_at, revoked_at`
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	t := &APIToken{}
+	err := row.Scan(&t.ID, &t.DiscordID, &t.Name, &t.Prefix, &t.Permission, &t.CreatedAt, &t.LastUsedAt, &t.RevokedAt)
+	return t, err
+}
+
+// CreateAPIToken stores a new token by its hash, setting its ID and creation time
+func CreateAPIToken(ctx context.Context, t *APIToken, hash string) error {
+	return DB.QueryRow(
+		ctx, `INSERT INTO api_tokens (discord_id, name, prefix, permission, token_hash) VALUES (?, ?, ?, ?, ?) RETURNING id, created_at`,
+		t.DiscordID, t.Name, t.Prefix, t.Permission, hash,
+	).Scan(&t.ID, &t.CreatedAt)
+}
+
+// GetActiveAPIToken returns the unrevoked token with the given hash, or
+// sql.ErrNoRows if there is none
+func GetActiveAPIToken(ctx context.Context, hash string) (*APIToken, error) {
+	return scanAPIToken(DB.QueryRow(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ? AND revoked_at IS NULL", hash))
+}
+
+// CountActiveAPITokens returns how many unrevoked tokens the user has
+func CountActiveAPITokens(ctx context.Context, discordID string) (int, error) {
+	var count int
+	err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM api_tokens WHERE discord_id = ? AND revoked_at IS NULL", discordID).Scan(&count)
+	return count, err
+}
+
+// ListAPITokens returns the user's unrevoked tokens, newest first
+func ListAPITokens(ctx context.Context, discordID string) ([]APIToken, error) {
+	rows, err := DB.Query(ctx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE discord_id = ? AND revoked_at IS NULL ORDER BY id DESC", discordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken revokes one of the user's tokens, returning sql.ErrNoRows if
+// they have no such unrevoked token
+func RevokeAPIToken(ctx context.Context, id int64, discordID string) error {
+	res, err := DB.Exec(
+		ctx, "UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND discord_id = ? AND revoked_at IS NULL",
+		time.Now().UTC().Format(timestampFormat), id, discordID,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TouchAPIToken records that a token was just used
+func TouchAPIToken(ctx context.Context, id int64) error {
+	_, err := DB.Exec(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE id = ?", time.Now().UTC().Format(timestampFormat), id)
+	return err
+}
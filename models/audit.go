@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditLogin             = "login"
+	AuditUpload            = "upload"
+	AuditDelete            = "delete"
+	AuditSetTags           = "set_tags"
+	AuditEditUpload        = "edit_upload"
+	AuditTakedownApprove   = "takedown_approve"
+	AuditTakedownReject    = "takedown_reject"
+	AuditRestore           = "restore"
+	AuditPurge             = "purge"
+	AuditBan               = "ban"
+	AuditUnban             = "unban"
+	AuditImpersonateStart  = "impersonate_start"
+	AuditImpersonateStop   = "impersonate_stop"
+	AuditIntegrityCheck    = "integrity_check"
+	AuditOrphanCheck       = "orphan_check"
+	AuditReportDismiss     = "report_dismiss"
+	AuditReportUphold      = "report_uphold"
+	AuditMembershipRevoked = "membership_revoked"
+	AuditTokenCreate       = "token_create"
+	AuditTokenRevoke       = "token_revoke"
+	AuditWalletGrant       = "wallet_grant"
+	AuditWalletDeduct      = "wallet_deduct"
+	AuditSessionsTerminate = "sessions_terminate"
+	AuditBannerCreate      = "banner_create"
+	AuditBannerUpdate      = "banner_update"
+	AuditBannerDelete      = "banner_delete"
+	AuditSeasonCreate      = "season_create"
+	AuditSeasonUpdate      = "season_update"
+	AuditSeasonDelete      = "season_delete"
+	AuditRarityRate        = "rarity_rate"
+	AuditBannerRateUp      = "banner_rate_up"
+	AuditMaintenance       = "maintenance"
+	AuditSafetyReject      = "safety_reject"
+	AuditQuarantineDelete  = "quarantine_delete"
+	AuditBulkApprove       = "bulk_approve"
+	AuditBulkReject        = "bulk_reject"
+	AuditBulkDelete        = "bulk_delete"
+	AuditBulkTag           = "bulk_tag"
+	AuditDataExport        = "data_export"
+	AuditDeletionRequest   = "deletion_request"
+	AuditDeletionCancel    = "deletion_cancel"
+	AuditAccountDelete     = "account_delete"
+	AuditAdminGrant        = "admin_grant"
+	AuditAdminRevoke       = "admin_revoke"
+	AuditSchedulerRun      = "scheduler_run"
+	AuditAccountLink       = "account_link"
+	AuditLinkApprove       = "link_approve"
+	AuditLinkReject        = "link_reject"
+	AuditReassignUpload    = "reassign_upload"
+	AuditMergeUpload       = "merge_upload"
+	AuditUploadRuleCreate  = "upload_rule_create"
+	AuditUploadRuleDelete  = "upload_rule_delete"
+	AuditConfigReload      = "config_reload"
+	AuditPoolRarity        = "pool_rarity"
+	AuditPoolEnable        = "pool_enable"
+	AuditPoolDisable       = "pool_disable"
+)
+
+// AuditEntry is one recorded action. Target identifies what was acted on, such
+// as "upload:12" or "user:1234"; it is empty when the action has no target.
+type AuditEntry struct {
+	ID        int64
+	ActorID   string
+	Action    string
+	Target    string
+	Details   string
+	IP        string
+	CreatedAt time.Time
+}
+
+// AuditFilter narrows an audit log listing
+type AuditFilter struct {
+	ActorID string
+	Action  string
+	Target  string
+	Limit   int
+	Offset  int
+}
+
+// RecordAudit appends an entry to the audit log
+func RecordAudit(ctx context.Context, entry *AuditEntry) error {
+	return DB.QueryRow(
+		ctx, `INSERT INTO audit_log (actor_id, action, target, details, ip) VALUES (?, ?, ?, ?, ?)
+		RETURNING id, created_at`,
+		entry.ActorID, entry.Action, entry.Target, entry.Details, entry.IP,
+	).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// ListAuditLog returns a page of audit entries, newest first, along with the
+// total number of entries matching the filter
+func ListAuditLog(ctx context.Context, filter AuditFilter) ([]AuditEntry, int, error) {
+	where := "1 = 1"
+	var args []interface{}
+	if filter.ActorID != "" {
+		where += " AND actor_id = ?"
+		args = append(args, filter.ActorID)
+	}
+	if filter.Action != "" {
+		where += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.Target != "" {
+		where += " AND target = ?"
+		args = append(args, filter.Target)
+	}
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM audit_log WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT id, actor_id, action, target, details, ip, created_at FROM audit_log WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, filter.Limit, filter.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.Target, &e.Details, &e.IP, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
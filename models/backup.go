@@ -0,0 +1,19 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// SnapshotDatabase writes a consistent copy of the database to path, which
+// must not exist yet, while the database stays in use. Only SQLite databases
+// can be copied this way; PostgreSQL has pg_dump for that.
+func SnapshotDatabase(ctx context.Context, path string) error {
+	if store.Name() != "sqlite" {
+		return fmt.Errorf("snapshots are only supported for sqlite databases, back up %s with its own tools", store.Name())
+	}
+	// Copying a large database can outlast the query timeout, so only ctx
+	// bounds it
+	_, err := DB.DB.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
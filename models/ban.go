@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Ban records that a Discord user is barred from signing in
+type Ban struct {
+	DiscordID string
+	Reason    string
+	BannedBy  string
+	CreatedAt time.Time
+	ExpiresAt sql.NullTime
+}
+
+// Permanent reports whether the ban never expires
+func (b *Ban) Permanent() bool {
+	return !b.ExpiresAt.Valid
+}
+
+// BanUser bans a Discord user, replacing any existing ban for them
+func BanUser(ctx context.Context, ban *Ban) error {
+	var expires interface{}
+	if ban.ExpiresAt.Valid {
+		expires = ban.ExpiresAt.Time.UTC().Format(timestampFormat)
+	}
+
+	return DB.QueryRow(
+		ctx, `INSERT INTO bans (discord_id, reason, banned_by, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(discord_id) DO UPDATE SET reason = excluded.reason, banned_by = excluded.banned_by,
+			expires_at = excluded.expires_at, created_at = CURRENT_TIMESTAMP
+		RETURNING created_at`,
+		ban.DiscordID, ban.Reason, ban.BannedBy, expires,
+	).Scan(&ban.CreatedAt)
+}
+
+// UnbanUser lifts a ban. It returns sql.ErrNoRows if the user was not banned.
+func UnbanUser(ctx context.Context, discordID string) error {
+	result, err := DB.Exec(ctx, "DELETE FROM bans WHERE discord_id = ?", discordID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+const banColumns = `discord_id, reason, banned_by, created_at, expires_at`
+
+// activeBanCondition matches bans that have not yet expired
+const activeBanCondition = `(expires_at IS NULL OR expires_at > ?)`
+
+func scanBan(row rowScanner) (*Ban, error) {
+	b := &Ban{}
+	err := row.Scan(&b.DiscordID, &b.Reason, &b.BannedBy, &b.CreatedAt, &b.ExpiresAt)
+	return b, err
+}
+
+// GetActiveBan returns the ban currently in effect for a user, or
+// sql.ErrNoRows if they are not banned
+func GetActiveBan(ctx context.Context, discordID string) (*Ban, error) {
+	return scanBan(DB.QueryRow(
+		ctx, "SELECT "+banColumns+" FROM bans WHERE discord_id = ? AND "+activeBanCondition,
+		discordID, time.Now().UTC().Format(timestampFormat),
+	))
+}
+
+// ListBans returns a page of active bans, newest first, along with the total
+// number of active bans
+func ListBans(ctx context.Context, limit, offset int) ([]Ban, int, error) {
+	now := time.Now().UTC().Format(timestampFormat)
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM bans WHERE "+activeBanCondition, now).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT "+banColumns+" FROM bans WHERE "+activeBanCondition+" ORDER BY created_at DESC LIMIT ? OFFSET ?",
+		now, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	bans := []Ban{}
+	for rows.Next() {
+		b, err := scanBan(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		bans = append(bans, *b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return bans, total, nil
+}
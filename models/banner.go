@@ -0,0 +1,281 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Banner is a limited-time event during which pulls made on it draw the
+// wallpapers it features RateUp times as often. A banner features the
+// uploads listed by ID and every upload carrying one of its tags. It runs in
+// the guild GuildID only.
+type Banner struct {
+	ID          int64
+	GuildID     string
+	Name        string
+	Description string
+	UploadIDs   []int64
+	Tags        []string
+	RateUp      float64
+	StartsAt    time.Time
+	EndsAt      time.Time
+	CreatedBy   string
+	CreatedAt   time.Time
+}
+
+// Active reports whether the banner is running at the given time
+func (b *Banner) Active(at time.Time) bool {
+	return !at.Before(b.StartsAt) && at.Before(b.EndsAt)
+}
+
+// bannerFeaturedCondition matches uploads u featured by the banner whose ID
+// is bound to both placeholders
+const bannerFeaturedCondition = `(EXISTS (SELECT 1 FROM banner_uploads bu WHERE bu.banner_id = ? AND bu.upload_id = u.id)
+	OR EXISTS (SELECT 1 FROM banner_tags bt JOIN tags t ON t.name = bt.tag JOIN upload_tags ut ON ut.tag_id = t.id
+		WHERE bt.banner_id = ? AND ut.upload_id = u.id))`
+
+const bannerColumns = `id, guild_id, name, description, rate_up, starts_at, ends_at, created_by, created_at`
+
+func scanBanner(row rowScanner) (*Banner, error) {
+	b := &Banner{}
+	err := row.Scan(&b.ID, &b.GuildID, &b.Name, &b.Description, &b.RateUp, &b.StartsAt, &b.EndsAt, &b.CreatedBy, &b.CreatedAt)
+	return b, err
+}
+
+// CreateBanner stores a new banner and sets its ID and creation time
+func CreateBanner(ctx context.Context, b *Banner) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO banners (guild_id, name, description, rate_up, starts_at, ends_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at`,
+		b.GuildID, b.Name, b.Description, b.RateUp, b.StartsAt.UTC().Format(timestampFormat), b.EndsAt.UTC().Format(timestampFormat), b.CreatedBy,
+	).Scan(&b.ID, &b.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := insertBannerMembers(tx, b); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateBanner replaces a banner's settings and featured wallpapers,
+// returning sql.ErrNoRows if there is no such banner
+func UpdateBanner(ctx context.Context, b *Banner) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`UPDATE banners SET guild_id = ?, name = ?, description = ?, rate_up = ?, starts_at = ?, ends_at = ?
+		WHERE id = ? RETURNING created_by, created_at`,
+		b.GuildID, b.Name, b.Description, b.RateUp, b.StartsAt.UTC().Format(timestampFormat), b.EndsAt.UTC().Format(timestampFormat), b.ID,
+	).Scan(&b.CreatedBy, &b.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM banner_uploads WHERE banner_id = ?", b.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM banner_tags WHERE banner_id = ?", b.ID); err != nil {
+		return err
+	}
+	if err := insertBannerMembers(tx, b); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertBannerMembers(tx *Tx, b *Banner) error {
+	for _, id := range b.UploadIDs {
+		if _, err := tx.Exec("INSERT INTO banner_uploads (banner_id, upload_id) VALUES (?, ?) ON CONFLICT DO NOTHING", b.ID, id); err != nil {
+			return err
+		}
+	}
+	for _, tag := range b.Tags {
+		if _, err := tx.Exec("INSERT INTO banner_tags (banner_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING", b.ID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteBanner removes a banner, returning sql.ErrNoRows if there is no such
+// banner. Pulls made on it keep its ID.
+func DeleteBanner(ctx context.Context, id int64) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM banner_uploads WHERE banner_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM banner_tags WHERE banner_id = ?", id); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM banners WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// GetBanner returns a banner with its featured wallpapers, or sql.ErrNoRows
+func GetBanner(ctx context.Context, id int64) (*Banner, error) {
+	b, err := scanBanner(DB.QueryRow(ctx, "SELECT "+bannerColumns+" FROM banners WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	if err := loadBannerMembers(ctx, []*Banner{b}); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ListBanners returns the guild's banners by start time, newest first, or
+// every guild's when guildID is empty. With activeOnly set it lists only
+// those running now.
+func ListBanners(ctx context.Context, guildID string, activeOnly bool) ([]*Banner, error) {
+	query := "SELECT " + bannerColumns + " FROM banners WHERE 1 = 1"
+	var args []interface{}
+	if guildID != "" {
+		query += " AND guild_id = ?"
+		args = append(args, guildID)
+	}
+	if activeOnly {
+		now := time.Now().UTC().Format(timestampFormat)
+		query += " AND starts_at <= ? AND ends_at > ?"
+		args = append(args, now, now)
+	}
+	rows, err := DB.Query(ctx, query+" ORDER BY starts_at DESC, id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	banners := []*Banner{}
+	for rows.Next() {
+		b, err := scanBanner(rows)
+		if err != nil {
+			return nil, err
+		}
+		banners = append(banners, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := loadBannerMembers(ctx, banners); err != nil {
+		return nil, err
+	}
+	return banners, nil
+}
+
+// loadBannerMembers fills in the featured upload IDs and tags of each banner
+func loadBannerMembers(ctx context.Context, banners []*Banner) error {
+	for _, b := range banners {
+		b.UploadIDs = []int64{}
+		b.Tags = []string{}
+
+		rows, err := DB.Query(ctx, "SELECT upload_id FROM banner_uploads WHERE banner_id = ? ORDER BY upload_id", b.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			b.UploadIDs = append(b.UploadIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = DB.Query(ctx, "SELECT tag FROM banner_tags WHERE banner_id = ? ORDER BY tag", b.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				rows.Close()
+				return err
+			}
+			b.Tags = append(b.Tags, tag)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBannersEndingBefore returns the running banners that end before cutoff
+// and haven't yet been marked with MarkBannerEndingNotified, soonest first
+func ListBannersEndingBefore(ctx context.Context, cutoff time.Time) ([]*Banner, error) {
+	now := time.Now().UTC().Format(timestampFormat)
+	rows, err := DB.Query(
+		ctx, "SELECT "+bannerColumns+" FROM banners WHERE ending_notified = 0 AND starts_at <= ? AND ends_at > ? AND ends_at <= ? ORDER BY ends_at, id",
+		now, now, cutoff.UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	banners := []*Banner{}
+	for rows.Next() {
+		b, err := scanBanner(rows)
+		if err != nil {
+			return nil, err
+		}
+		banners = append(banners, b)
+	}
+	return banners, rows.Err()
+}
+
+// MarkBannerEndingNotified records that users were told the banner is about
+// to end, so they are told only once
+func MarkBannerEndingNotified(ctx context.Context, id int64) error {
+	_, err := DB.Exec(ctx, "UPDATE banners SET ending_notified = 1 WHERE id = ?", id)
+	return err
+}
+
+// BannerPullers returns the users who have pulled on a banner
+func BannerPullers(ctx context.Context, id int64) ([]string, error) {
+	rows, err := DB.Query(ctx, "SELECT DISTINCT discord_id FROM pulls WHERE banner_id = ? ORDER BY discord_id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var discordID string
+		if err := rows.Scan(&discordID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, discordID)
+	}
+	return ids, rows.Err()
+}
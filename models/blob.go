@@ -0,0 +1,184 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// AcquireBlob registers a reference to the file content identified by sha256.
+// If the content is new, filename is recorded as its storage location. The
+// returned filename is where the content is actually stored, which differs from
+// the argument when identical bytes were uploaded before.
+func AcquireBlob(ctx context.Context, sha256, filename string, fileSize int64) (string, error) {
+	_, err := DB.Exec(
+		ctx, `INSERT INTO blobs (sha256, filename, file_size, ref_count) VALUES (?, ?, ?, 1)
+		ON CONFLICT(sha256) DO UPDATE SET ref_count = ref_count + 1`,
+		sha256, filename, fileSize,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	var stored string
+	err = DB.QueryRow(ctx, "SELECT filename FROM blobs WHERE sha256 = ?", sha256).Scan(&stored)
+	return stored, err
+}
+
+// ReleaseBlob drops a reference to the content identified by sha256. When the
+// last reference is released the blob record is removed and its filename is
+// returned so the caller can delete the file; otherwise the filename is empty.
+func ReleaseBlob(ctx context.Context, sha256 string) (string, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	filename, err := releaseBlobTx(tx, sha256)
+	if err != nil {
+		return "", err
+	}
+	return filename, tx.Commit()
+}
+
+func releaseBlobTx(tx *Tx, sha256 string) (string, error) {
+	var (
+		filename string
+		refCount int
+	)
+	err := tx.QueryRow(
+		"UPDATE blobs SET ref_count = ref_count - 1 WHERE sha256 = ? RETURNING filename, ref_count",
+		sha256,
+	).Scan(&filename, &refCount)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if refCount > 0 {
+		return "", nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM blobs WHERE sha256 = ?", sha256); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+type Blob struct {
+	SHA256      string
+	Filename    string
+	FileSize    int64
+	RefCount    int
+	Unavailable bool
+}
+
+// ListBlobs returns every stored blob
+func ListBlobs(ctx context.Context) ([]Blob, error) {
+	rows, err := DB.Query(ctx, "SELECT sha256, filename, file_size, ref_count, unavailable FROM blobs ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		var b Blob
+		if err := rows.Scan(&b.SHA256, &b.Filename, &b.FileSize, &b.RefCount, &b.Unavailable); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
+
+// SetBlobUnavailable marks whether a blob's file is missing from storage.
+// Uploads referencing an unavailable blob are hidden from listings.
+func SetBlobUnavailable(ctx context.Context, sha256 string, unavailable bool) error {
+	flag := 0
+	if unavailable {
+		flag = 1
+	}
+	if _, err := DB.Exec(ctx, "UPDATE blobs SET unavailable = ? WHERE sha256 = ?", flag, sha256); err != nil {
+		return err
+	}
+	forgetPools()
+	return nil
+}
+
+// ListTranscodeCandidates returns the available blobs that haven't been found
+// impossible to transcode to format. Which of them are in another format is
+// up to the caller, by their filename.
+func ListTranscodeCandidates(ctx context.Context, format string) ([]Blob, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT sha256, filename, file_size, ref_count, unavailable FROM blobs WHERE unavailable = 0 AND transcode_skipped <> ? ORDER BY created_at",
+		format,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		var b Blob
+		if err := rows.Scan(&b.SHA256, &b.Filename, &b.FileSize, &b.RefCount, &b.Unavailable); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
+
+// SkipTranscode records that a blob can't be transcoded to format, such as
+// when it can't be decoded, so it isn't tried again
+func SkipTranscode(ctx context.Context, sha256, format string) error {
+	_, err := DB.Exec(ctx, "UPDATE blobs SET transcode_skipped = ? WHERE sha256 = ?", format, sha256)
+	return err
+}
+
+// ReplaceBlob moves every upload of the blob identified by sha256 to a file
+// transcoded from it, stored as filename with the SHA-256 newSHA256, and
+// removes the old blob. The new blob remembers the old hash, so uploads of the
+// file it was transcoded from are still recognised as identical. The
+// returned filename is where the new content is actually stored, which
+// differs from the argument when identical bytes were stored before. It
+// returns sql.ErrNoRows when the old blob is gone.
+func ReplaceBlob(ctx context.Context, sha256, newSHA256, filename string, fileSize int64) (string, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var refCount int
+	if err := tx.QueryRow("SELECT ref_count FROM blobs WHERE sha256 = ?", sha256).Scan(&refCount); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO blobs (sha256, filename, file_size, ref_count, transcoded_from) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(sha256) DO UPDATE SET ref_count = blobs.ref_count + excluded.ref_count`,
+		newSHA256, filename, fileSize, refCount, sha256,
+	); err != nil {
+		return "", err
+	}
+	var stored string
+	if err := tx.QueryRow("SELECT filename FROM blobs WHERE sha256 = ?", newSHA256).Scan(&stored); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(
+		"UPDATE uploads SET sha256 = ?, filename = ?, file_size = ? WHERE sha256 = ?",
+		newSHA256, stored, fileSize, sha256,
+	); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM blobs WHERE sha256 = ?", sha256); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return stored, nil
+}
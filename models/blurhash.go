@@ -0,0 +1,30 @@
+package models
+
+import "context"
+
+// UploadsMissingBlurHash returns the IDs and stored filenames of uploads
+// recorded before placeholders were generated
+func UploadsMissingBlurHash(ctx context.Context) (map[int64]string, error) {
+	rows, err := DB.Query(ctx, "SELECT id, filename FROM uploads WHERE blurhash = '' AND deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			return nil, err
+		}
+		uploads[id] = filename
+	}
+	return uploads, rows.Err()
+}
+
+// SetUploadBlurHash stores the placeholder hash for an upload
+func SetUploadBlurHash(ctx context.Context, id int64, hash string) error {
+	_, err := DB.Exec(ctx, "UPDATE uploads SET blurhash = ? WHERE id = ?", hash, id)
+	return err
+}
@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// Actions an admin can apply to several uploads at once
+const (
+	BulkApprove = "approve"
+	BulkReject  = "reject"
+	BulkDelete  = "delete"
+	BulkTag     = "tag"
+)
+
+// Outcomes of a bulk action on one upload
+const (
+	BulkDone     = "done"
+	BulkNotFound = "not_found"
+	BulkSkipped  = "skipped"
+)
+
+// MaxBulkUploads is the most uploads one bulk action may name
+const MaxBulkUploads = 200
+
+// BulkResult is what a bulk action did to one upload. Published is set when
+// approving released an upload held for its content safety check.
+type BulkResult struct {
+	UploadID  int64
+	Status    string
+	Reason    string
+	Published bool
+}
+
+// BulkModerate applies an action to each upload in one transaction. Uploads
+// that don't exist or the action doesn't apply to are reported and left
+// alone; any other error rolls back the whole batch.
+//
+//   - approve dismisses pending reports, unhides the upload and passes a
+//     pending content safety check
+//   - reject upholds pending reports, rejects a pending content safety check,
+//     moves the upload to the trash and records rejection against it
+//   - delete moves the upload to the trash
+//   - tag adds tags, keeping existing ones, up to MaxTagsPerUpload
+func BulkModerate(ctx context.Context, ids []int64, action string, tags []string, rejection *Rejection) ([]BulkResult, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]BulkResult, 0, len(ids))
+	for _, id := range ids {
+		result := BulkResult{UploadID: id, Status: BulkDone}
+
+		var deleted bool
+		var safetyStatus string
+		err := tx.QueryRow("SELECT deleted_at IS NOT NULL, safety_status FROM uploads WHERE id = ?", id).Scan(&deleted, &safetyStatus)
+		if err == sql.ErrNoRows {
+			results = append(results, BulkResult{UploadID: id, Status: BulkNotFound})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if deleted {
+			results = append(results, BulkResult{UploadID: id, Status: BulkSkipped, Reason: "upload is in the trash"})
+			continue
+		}
+
+		switch action {
+		case BulkApprove:
+			err = bulkApprove(tx, id, safetyStatus, &result)
+		case BulkReject:
+			err = bulkReject(tx, id, safetyStatus, rejection)
+		case BulkDelete:
+			_, err = tx.Exec("UPDATE uploads SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+		case BulkTag:
+			err = bulkAddTags(tx, id, tags, &result)
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	forgetPools()
+
+	if action == BulkTag {
+		forgetTags()
+		for _, r := range results {
+			if r.Status != BulkDone {
+				continue
+			}
+			if err := IndexUpload(ctx, r.UploadID); err != nil {
+				log.Printf("Failed to index upload %d: %v", r.UploadID, err)
+			}
+		}
+	}
+	return results, nil
+}
+
+func bulkApprove(tx *Tx, id int64, safetyStatus string, result *BulkResult) error {
+	reports, err := tx.Exec(
+		"UPDATE reports SET status = ?, resolved_at = CURRENT_TIMESTAMP WHERE upload_id = ? AND status = ?",
+		ReportDismissed, id, ReportPending,
+	)
+	if err != nil {
+		return err
+	}
+	dismissed, err := reports.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if dismissed == 0 && safetyStatus != SafetyPending {
+		result.Status, result.Reason = BulkSkipped, "nothing to approve"
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE uploads SET report_count = 0, report_hidden = 0 WHERE id = ?", id); err != nil {
+		return err
+	}
+	if safetyStatus == SafetyPending {
+		if _, err := tx.Exec("UPDATE uploads SET safety_status = ?, safety_checked_at = CURRENT_TIMESTAMP WHERE id = ?", SafetyPassed, id); err != nil {
+			return err
+		}
+		result.Published = true
+	}
+	return nil
+}
+
+func bulkReject(tx *Tx, id int64, safetyStatus string, rejection *Rejection) error {
+	if _, err := tx.Exec(
+		"UPDATE reports SET status = ?, resolved_at = CURRENT_TIMESTAMP WHERE upload_id = ? AND status = ?",
+		ReportUpheld, id, ReportPending,
+	); err != nil {
+		return err
+	}
+
+	checkedAt := "safety_checked_at"
+	if safetyStatus == SafetyPending {
+		safetyStatus, checkedAt = SafetyRejected, "CURRENT_TIMESTAMP"
+	}
+	if _, err := tx.Exec(
+		"UPDATE uploads SET report_count = 0, report_hidden = 0, safety_status = ?, safety_checked_at = "+checkedAt+", deleted_at = CURRENT_TIMESTAMP WHERE id = ?",
+		safetyStatus, id,
+	); err != nil {
+		return err
+	}
+	return insertRejection(tx, id, rejection)
+}
+
+func bulkAddTags(tx *Tx, id int64, tags []string, result *BulkResult) error {
+	var existing int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM upload_tags WHERE upload_id = ?", id).Scan(&existing); err != nil {
+		return err
+	}
+
+	var added int
+	for _, name := range tags {
+		var present bool
+		if err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM upload_tags ut JOIN tags t ON t.id = ut.tag_id WHERE ut.upload_id = ? AND t.name = ?)",
+			id, name,
+		).Scan(&present); err != nil {
+			return err
+		}
+		if present {
+			continue
+		}
+		if existing+added >= MaxTagsPerUpload {
+			result.Status, result.Reason = BulkSkipped, "upload would have too many tags"
+			return nil
+		}
+		added++
+	}
+	if added == 0 {
+		result.Status, result.Reason = BulkSkipped, "upload already has these tags"
+		return nil
+	}
+
+	for _, name := range tags {
+		if _, err := tx.Exec("INSERT INTO tags (name) VALUES (?) ON CONFLICT DO NOTHING", name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO upload_tags (upload_id, tag_id) SELECT ?, id FROM tags WHERE name = ? ON CONFLICT DO NOTHING",
+			id, name,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
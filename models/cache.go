@@ -0,0 +1,59 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/cache"
+)
+
+// In-memory caches of the lookups made on most requests. Model functions
+// that write what a cache holds drop it once the write is committed; the
+// expiry bounds how stale a value can get when the database is changed from
+// elsewhere, such as by a command run while the server is up.
+var (
+	// userCache holds users by Discord ID, as GetUser returns them
+	userCache = cache.New[string, User]("users", 10000, time.Minute)
+	// poolRarityCache holds the rarities that have wallpapers in a pull
+	// pool, by the pool's condition and arguments
+	poolRarityCache = cache.New[string, []string]("pool_rarities", 1000, 30*time.Second)
+	// tagSearchCache holds tag autocomplete results by prefix and limit
+	tagSearchCache = cache.New[string, []Tag]("tags", 1000, time.Minute)
+	// trendingCache holds the trending ranking of each guild's wallpapers
+	trendingCache = cache.New[string, []trendingRank]("trending", 100, time.Minute)
+)
+
+// forgetUser drops the cached copy of a user after it was changed
+func forgetUser(discordID string) {
+	userCache.Remove(discordID)
+}
+
+// forgetPools drops the cached pull pools after uploads entered or left
+// them or changed rarity
+func forgetPools() {
+	poolRarityCache.Purge()
+}
+
+// forgetTags drops cached tag lists after tags were added to or removed
+// from uploads
+func forgetTags() {
+	tagSearchCache.Purge()
+}
+
+// forgetAll drops every cached value, and the image fetches waiting to be
+// counted, when a database is opened in place of another
+func forgetAll() {
+	userCache.Purge()
+	forgetPools()
+	forgetTags()
+	trendingCache.Purge()
+
+	accessMu.Lock()
+	clear(pendingAccess)
+	accessMu.Unlock()
+}
+
+// poolKey identifies a pull pool by its condition and arguments
+func poolKey(where string, args []interface{}) string {
+	return fmt.Sprintf("%s %v", where, args)
+}
@@ -0,0 +1,97 @@
+package models
+
+import "context"
+
+// ownedCondition matches uploads u in the collection of the user bound to
+// its placeholder
+const ownedCondition = `EXISTS (SELECT 1 FROM pulls p WHERE p.discord_id = ? AND p.upload_id = u.id AND p.discarded = 0)`
+
+// Completion is how much of a set of pullable wallpapers a user has
+// collected. Missing lists the IDs of those they don't have yet.
+type Completion struct {
+	Owned   int
+	Total   int
+	Missing []int64
+}
+
+func (c *Completion) add(uploadID int64, owned bool) {
+	c.Total++
+	if owned {
+		c.Owned++
+	} else {
+		c.Missing = append(c.Missing, uploadID)
+	}
+}
+
+// TagCompletion is the user's completion of the wallpapers with a tag
+type TagCompletion struct {
+	Tag string
+	Completion
+}
+
+// PoolCompletion returns how much of the guild's whole pull pool the user
+// has collected. Wallpapers they own that have since left the pool don't
+// count.
+func PoolCompletion(ctx context.Context, discordID, guildID string) (Completion, error) {
+	return completion(ctx, "u.guild_id = ?", discordID, guildID)
+}
+
+// BannerCompletion returns how much of the pullable wallpapers featured by
+// the banner the user has collected
+func BannerCompletion(ctx context.Context, discordID string, bannerID int64) (Completion, error) {
+	return completion(ctx, bannerFeaturedCondition, discordID, bannerID, bannerID)
+}
+
+// completion measures the user's completion of the pool uploads matching
+// where, whose placeholders are bound to args
+func completion(ctx context.Context, where string, discordID string, args ...interface{}) (Completion, error) {
+	c := Completion{Missing: []int64{}}
+	rows, err := DB.Query(
+		ctx, "SELECT u.id, CASE WHEN "+ownedCondition+" THEN 1 ELSE 0 END FROM uploads u WHERE "+poolUploadCondition+" AND "+where+" ORDER BY u.id",
+		append([]interface{}{discordID}, args...)...,
+	)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var owned bool
+		if err := rows.Scan(&id, &owned); err != nil {
+			return c, err
+		}
+		c.add(id, owned)
+	}
+	return c, rows.Err()
+}
+
+// ListTagCompletion returns the user's completion of every tag on at least
+// one wallpaper pullable in the guild, by tag name
+func ListTagCompletion(ctx context.Context, discordID, guildID string) ([]TagCompletion, error) {
+	rows, err := DB.Query(
+		ctx, `SELECT t.name, u.id, CASE WHEN `+ownedCondition+` THEN 1 ELSE 0 END
+		FROM uploads u JOIN upload_tags ut ON ut.upload_id = u.id JOIN tags t ON t.id = ut.tag_id
+		WHERE `+poolUploadCondition+` AND u.guild_id = ? ORDER BY t.name, u.id`,
+		discordID, guildID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCompletion{}
+	for rows.Next() {
+		var tag string
+		var id int64
+		var owned bool
+		if err := rows.Scan(&tag, &id, &owned); err != nil {
+			return nil, err
+		}
+		if len(tags) == 0 || tags[len(tags)-1].Tag != tag {
+			tags = append(tags, TagCompletion{Tag: tag, Completion: Completion{Missing: []int64{}}})
+		}
+		tags[len(tags)-1].add(id, owned)
+	}
+	return tags, rows.Err()
+}
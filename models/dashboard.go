@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// DailyCount is a count for one UTC day, given as YYYY-MM-DD
+type DailyCount struct {
+	Day   string
+	Count int
+}
+
+// NamedCount is a count for a tag or bucket
+type NamedCount struct {
+	Name  string
+	Count int
+}
+
+// SiteStats summarizes the site for the admin dashboard. Totals cover all
+// time; ActiveUsers and the daily series cover the period asked for. Users
+// count as active on days they uploaded or pulled.
+type SiteStats struct {
+	Uploads           int
+	TrashedUploads    int
+	Users             int
+	Pulls             int
+	ActiveUsers       int
+	PendingReports    int
+	StorageBytes      int64
+	UploadsPerDay     []DailyCount
+	PullsPerDay       []DailyCount
+	ActiveUsersPerDay []DailyCount
+	PullCounts        []NamedCount
+	TopTags           []NamedCount
+}
+
+// dayOf returns the SQL expression for the UTC day of a timestamp column.
+// Both SQLite's stored text and PostgreSQL's text cast begin with the date.
+func dayOf(column string) string {
+	return "SUBSTR(CAST(" + column + " AS TEXT), 1, 10)"
+}
+
+// activitySelect lists a row per upload and counted pull since the
+// placeholder, with the day and who made it
+var activitySelect = `SELECT ` + dayOf("uploaded_at") + ` AS day, discord_id FROM uploads WHERE uploaded_at >= ?
+	UNION ALL SELECT ` + dayOf("pulled_at") + ` AS day, discord_id FROM pulls WHERE pulled_at >= ? AND ` + countedPullCondition
+
+// pullCountBuckets groups pullable wallpapers by how often they have been
+// pulled, in the order they are reported
+var pullCountBuckets = []string{"0", "1-9", "10-99", "100+"}
+
+// GetSiteStats gathers the dashboard statistics for activity since the given
+// time, with the topTags most used tags. Daily series have an entry for every
+// day from since to today, including days without activity.
+func GetSiteStats(ctx context.Context, since time.Time, topTags int) (*SiteStats, error) {
+	stats := &SiteStats{}
+	from := since.UTC().Format(timestampFormat)
+
+	err := DB.QueryRow(ctx, `SELECT
+		(SELECT COUNT(*) FROM uploads u WHERE `+visibleUploadCondition+`),
+		(SELECT COUNT(*) FROM uploads WHERE deleted_at IS NOT NULL),
+		(SELECT COUNT(*) FROM users),
+		(SELECT COUNT(*) FROM pulls WHERE `+countedPullCondition+`),
+		(SELECT COUNT(*) FROM reports WHERE status = ?),
+		(SELECT COALESCE(SUM(file_size), 0) FROM blobs)`,
+		ReportPending,
+	).Scan(&stats.Uploads, &stats.TrashedUploads, &stats.Users, &stats.Pulls, &stats.PendingReports, &stats.StorageBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := DB.QueryRow(ctx, "SELECT COUNT(DISTINCT discord_id) FROM ("+activitySelect+") a", from, from).Scan(&stats.ActiveUsers); err != nil {
+		return nil, err
+	}
+
+	if stats.UploadsPerDay, err = dailyCounts(ctx, since,
+		"SELECT "+dayOf("uploaded_at")+" AS day, COUNT(*) FROM uploads WHERE uploaded_at >= ? GROUP BY day", from); err != nil {
+		return nil, err
+	}
+	if stats.PullsPerDay, err = dailyCounts(ctx, since,
+		"SELECT "+dayOf("pulled_at")+" AS day, COUNT(*) FROM pulls WHERE pulled_at >= ? AND "+countedPullCondition+" GROUP BY day", from); err != nil {
+		return nil, err
+	}
+	if stats.ActiveUsersPerDay, err = dailyCounts(ctx, since,
+		"SELECT day, COUNT(DISTINCT discord_id) FROM ("+activitySelect+") a GROUP BY day", from, from); err != nil {
+		return nil, err
+	}
+
+	buckets, err := namedCounts(ctx, `SELECT CASE WHEN c = 0 THEN '0' WHEN c < 10 THEN '1-9' WHEN c < 100 THEN '10-99' ELSE '100+' END AS bucket, COUNT(*)
+		FROM (SELECT (SELECT COUNT(*) FROM pulls p WHERE p.upload_id = u.id) AS c FROM uploads u WHERE `+visibleUploadCondition+`) x
+		GROUP BY bucket`)
+	if err != nil {
+		return nil, err
+	}
+	byBucket := make(map[string]int, len(buckets))
+	for _, b := range buckets {
+		byBucket[b.Name] = b.Count
+	}
+	for _, name := range pullCountBuckets {
+		stats.PullCounts = append(stats.PullCounts, NamedCount{Name: name, Count: byBucket[name]})
+	}
+
+	stats.TopTags, err = namedCounts(ctx, `SELECT t.name, COUNT(*) FROM upload_tags ut
+		JOIN tags t ON t.id = ut.tag_id
+		JOIN uploads u ON u.id = ut.upload_id
+		WHERE `+visibleUploadCondition+`
+		GROUP BY t.name ORDER BY COUNT(*) DESC, t.name LIMIT ?`, topTags)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// dailyCounts runs a query returning (day, count) rows and spreads them over
+// every day from since to today
+func dailyCounts(ctx context.Context, since time.Time, query string, args ...interface{}) ([]DailyCount, error) {
+	counts, err := namedCounts(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	byDay := make(map[string]int, len(counts))
+	for _, c := range counts {
+		byDay[c.Name] = c.Count
+	}
+
+	var series []DailyCount
+	today := time.Now().UTC().Format(time.DateOnly)
+	for day := since.UTC(); ; day = day.AddDate(0, 0, 1) {
+		d := day.Format(time.DateOnly)
+		series = append(series, DailyCount{Day: d, Count: byDay[d]})
+		if d >= today {
+			break
+		}
+	}
+	return series, nil
+}
+
+// namedCounts runs a query returning (name, count) rows
+func namedCounts(ctx context.Context, query string, args ...interface{}) ([]NamedCount, error) {
+	rows, err := DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []NamedCount{}
+	for rows.Next() {
+		var c NamedCount
+		if err := rows.Scan(&c.Name, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
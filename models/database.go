@@ -1,36 +1,49 @@
 package models
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
-var DB *sql.DB
+var DB *Database
+
+// timestampFormat matches SQLite's CURRENT_TIMESTAMP so computed times compare
+// correctly against stored ones
+const timestampFormat = "2006-01-02 15:04:05"
 
-// InitDatabase opens the SQLite database and creates tables if they don't exist
-func InitDatabase(dbPath string) error {
-	var err error
-	DB, err = sql.Open("sqlite3", dbPath)
+// InitDatabase opens the database with the named driver ("sqlite" or
+// "postgres") and creates tables if they don't exist
+func InitDatabase(ctx context.Context, driver, dsn string, opts PoolOptions) error {
+	s, err := lookupStore(driver)
+	if err != nil {
+		return err
+	}
+	store = s
+
+	db, err := store.Open(dsn, opts)
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
+	DB = &Database{db}
+	forgetAll()
 
 	// Test the connection
-	if err := DB.Ping(); err != nil {
+	if err := DB.PingContext(ctx); err != nil {
 		return fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Create tables
-	if err := createTables(); err != nil {
+	// Create tables. Migrations that backfill a large database may take
+	// longer than a query is allowed, so the timeout starts applying after.
+	queryTimeout = 0
+	if err := createTables(ctx); err != nil {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
+	queryTimeout = opts.QueryTimeout
 
 	return nil
 }
 
-func createTables() error {
+func createTables(ctx context.Context) error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS users (
 		discord_id TEXT PRIMARY KEY,
@@ -49,14 +62,621 @@ func createTables() error {
 		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
 	);
 
+	CREATE TABLE IF NOT EXISTS blobs (
+		sha256 TEXT PRIMARY KEY,
+		filename TEXT NOT NULL,
+		file_size INTEGER NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_tags (
+		upload_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (upload_id, tag_id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id),
+		FOREIGN KEY (tag_id) REFERENCES tags(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS quarantined_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		original_filename TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		file_size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_colors (
+		upload_id INTEGER NOT NULL,
+		rank INTEGER NOT NULL,
+		r INTEGER NOT NULL,
+		g INTEGER NOT NULL,
+		b INTEGER NOT NULL,
+		PRIMARY KEY (upload_id, rank),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS takedown_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		upload_id INTEGER NOT NULL,
+		requester_name TEXT NOT NULL,
+		requester_email TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		proof_links TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending',
+		admin_note TEXT NOT NULL DEFAULT '',
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		resolved_at DATETIME,
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS bans (
+		discord_id TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		banned_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS admin_grants (
+		discord_id TEXT PRIMARY KEY,
+		granted_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		details TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		upload_id INTEGER NOT NULL,
+		reporter_id TEXT NOT NULL,
+		category TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		resolved_at DATETIME,
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS drafts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		original_filename TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '',
+		file_size INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS pulls (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		upload_id INTEGER NOT NULL,
+		source TEXT NOT NULL DEFAULT 'web',
+		duplicate INTEGER NOT NULL DEFAULT 0,
+		pulled_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS banners (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		rate_up DOUBLE PRECISION NOT NULL,
+		starts_at DATETIME NOT NULL,
+		ends_at DATETIME NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS banner_uploads (
+		banner_id INTEGER NOT NULL,
+		upload_id INTEGER NOT NULL,
+		PRIMARY KEY (banner_id, upload_id),
+		FOREIGN KEY (banner_id) REFERENCES banners(id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS banner_tags (
+		banner_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (banner_id, tag),
+		FOREIGN KEY (banner_id) REFERENCES banners(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS rarity_rate_overrides (
+		rarity TEXT PRIMARY KEY,
+		rate DOUBLE PRECISION NOT NULL,
+		updated_by TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS maintenance_mode (
+		id INTEGER PRIMARY KEY,
+		enabled INTEGER NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		updated_by TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS rarity_votes (
+		upload_id INTEGER NOT NULL,
+		discord_id TEXT NOT NULL,
+		rarity TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (upload_id, discord_id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id),
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_rejections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		upload_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		note TEXT NOT NULL,
+		rejected_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS daily_stats (
+		day TEXT PRIMARY KEY,
+		uploads INTEGER NOT NULL DEFAULT 0,
+		pulls INTEGER NOT NULL DEFAULT 0,
+		new_users INTEGER NOT NULL DEFAULT 0,
+		bytes_stored INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS seasons (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		guild_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		starts_at DATETIME NOT NULL,
+		ends_at DATETIME NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS season_uploads (
+		season_id INTEGER NOT NULL,
+		upload_id INTEGER NOT NULL,
+		PRIMARY KEY (season_id, upload_id),
+		FOREIGN KEY (season_id) REFERENCES seasons(id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS season_tags (
+		season_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (season_id, tag),
+		FOREIGN KEY (season_id) REFERENCES seasons(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS showcases (
+		discord_id TEXT NOT NULL,
+		upload_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (discord_id, upload_id),
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS wishlists (
+		discord_id TEXT NOT NULL,
+		upload_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (discord_id, upload_id),
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS dust_ledger (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		reference TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS trades (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender_id TEXT NOT NULL,
+		recipient_id TEXT NOT NULL,
+		offered_upload_id INTEGER NOT NULL,
+		requested_upload_id INTEGER,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		resolved_at DATETIME,
+		FOREIGN KEY (sender_id) REFERENCES users(discord_id),
+		FOREIGN KEY (recipient_id) REFERENCES users(discord_id),
+		FOREIGN KEY (offered_upload_id) REFERENCES uploads(id),
+		FOREIGN KEY (requested_upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS reroll_ledger (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		delta INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		reference TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		permission TEXT NOT NULL DEFAULT '',
+		token_hash TEXT UNIQUE NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS user_guilds (
+		discord_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL,
+		PRIMARY KEY (discord_id, guild_id),
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS wallet_ledger (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		actor_id TEXT NOT NULL DEFAULT '',
+		reference TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		original_filename TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '',
+		license TEXT NOT NULL DEFAULT '',
+		file_size INTEGER NOT NULL,
+		received INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		discord_id TEXT NOT NULL DEFAULT '',
+		data TEXT NOT NULL,
+		ip_address TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_seen_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS likes (
+		discord_id TEXT NOT NULL,
+		upload_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (discord_id, upload_id),
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		delivered_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		message TEXT NOT NULL,
+		upload_id INTEGER,
+		trade_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		read_at DATETIME,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS username_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		discord_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		display_name TEXT NOT NULL DEFAULT '',
+		replaced_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS link_codes (
+		discord_id TEXT PRIMARY KEY,
+		code_hash TEXT UNIQUE NOT NULL,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS account_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		primary_id TEXT NOT NULL,
+		alt_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		uploads INTEGER NOT NULL DEFAULT 0,
+		pulls INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		resolved_at DATETIME,
+		resolved_by TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (primary_id) REFERENCES users(discord_id),
+		FOREIGN KEY (alt_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS discord_imports (
+		channel_id TEXT PRIMARY KEY,
+		last_message_id TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS device_fingerprints (
+		fingerprint TEXT NOT NULL,
+		discord_id TEXT NOT NULL,
+		first_seen_at DATETIME NOT NULL,
+		last_seen_at DATETIME NOT NULL,
+		PRIMARY KEY (fingerprint, discord_id),
+		FOREIGN KEY (discord_id) REFERENCES users(discord_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS pull_seeds (
+		day TEXT PRIMARY KEY,
+		seed TEXT NOT NULL,
+		commitment TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS pull_draws (
+		pull_id INTEGER PRIMARY KEY,
+		discord_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		nonce INTEGER NOT NULL,
+		upload_id INTEGER NOT NULL,
+		tiers TEXT NOT NULL DEFAULT '',
+		rarity TEXT NOT NULL DEFAULT '',
+		pool_total DOUBLE PRECISION NOT NULL,
+		range_start DOUBLE PRECISION NOT NULL,
+		range_end DOUBLE PRECISION NOT NULL,
+		FOREIGN KEY (pull_id) REFERENCES pulls(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_activity (
+		upload_id INTEGER NOT NULL,
+		hour DATETIME NOT NULL,
+		views INTEGER NOT NULL DEFAULT 0,
+		downloads INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (upload_id, hour),
+		FOREIGN KEY (upload_id) REFERENCES uploads(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		pattern TEXT NOT NULL DEFAULT '',
+		tag TEXT NOT NULL DEFAULT '',
+		min_width INTEGER NOT NULL DEFAULT 0,
+		min_height INTEGER NOT NULL DEFAULT 0,
+		banner_id INTEGER NOT NULL DEFAULT 0,
+		max_uploads INTEGER NOT NULL DEFAULT 0,
+		message TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_uploads_discord_id ON uploads(discord_id);
 	CREATE INDEX IF NOT EXISTS idx_uploads_uploaded_at ON uploads(uploaded_at);
+	CREATE INDEX IF NOT EXISTS idx_upload_tags_tag_id ON upload_tags(tag_id);
+	CREATE INDEX IF NOT EXISTS idx_takedown_requests_status ON takedown_requests(status);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_actor_id ON audit_log(actor_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action);
+	CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status);
+	CREATE INDEX IF NOT EXISTS idx_upload_rejections_upload_id ON upload_rejections(upload_id);
+	CREATE INDEX IF NOT EXISTS idx_drafts_discord_id ON drafts(discord_id);
+	CREATE INDEX IF NOT EXISTS idx_drafts_expires_at ON drafts(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_pulls_discord_id_pulled_at ON pulls(discord_id, pulled_at);
+	CREATE INDEX IF NOT EXISTS idx_pulls_discord_id_upload_id ON pulls(discord_id, upload_id);
+	CREATE INDEX IF NOT EXISTS idx_pulls_upload_id ON pulls(upload_id);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_status_next_attempt ON deliveries(status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_deliveries_url ON deliveries(url);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_reroll_ledger_entry ON reroll_ledger(discord_id, reason, reference);
+	CREATE INDEX IF NOT EXISTS idx_reroll_ledger_discord_id_created_at ON reroll_ledger(discord_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_discord_id ON api_tokens(discord_id);
+	CREATE INDEX IF NOT EXISTS idx_user_guilds_guild_id ON user_guilds(guild_id);
+	CREATE INDEX IF NOT EXISTS idx_wallet_ledger_discord_id ON wallet_ledger(discord_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_wallet_ledger_reward ON wallet_ledger(discord_id, reason, reference) WHERE type = 'reward';
+	CREATE INDEX IF NOT EXISTS idx_upload_sessions_discord_id ON upload_sessions(discord_id);
+	CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at ON upload_sessions(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_sessions_discord_id ON sessions(discord_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_likes_upload_id ON likes(upload_id);
+	CREATE INDEX IF NOT EXISTS idx_dust_ledger_discord_id ON dust_ledger(discord_id);
+	CREATE INDEX IF NOT EXISTS idx_banners_starts_at_ends_at ON banners(starts_at, ends_at);
+	CREATE INDEX IF NOT EXISTS idx_seasons_guild_id ON seasons(guild_id);
+	CREATE INDEX IF NOT EXISTS idx_trades_sender_id ON trades(sender_id);
+	CREATE INDEX IF NOT EXISTS idx_trades_recipient_id_status ON trades(recipient_id, status);
+	CREATE INDEX IF NOT EXISTS idx_trades_status_expires_at ON trades(status, expires_at);
+	CREATE INDEX IF NOT EXISTS idx_notifications_discord_id ON notifications(discord_id, read_at);
+	CREATE INDEX IF NOT EXISTS idx_notifications_created_at ON notifications(created_at);
+	CREATE INDEX IF NOT EXISTS idx_username_history_discord_id ON username_history(discord_id);
+	CREATE INDEX IF NOT EXISTS idx_account_links_primary_id ON account_links(primary_id);
+	CREATE INDEX IF NOT EXISTS idx_account_links_alt_id ON account_links(alt_id);
+	CREATE INDEX IF NOT EXISTS idx_account_links_status ON account_links(status, created_at);
+	CREATE INDEX IF NOT EXISTS idx_device_fingerprints_discord_id ON device_fingerprints(discord_id);
+	CREATE INDEX IF NOT EXISTS idx_device_fingerprints_last_seen_at ON device_fingerprints(last_seen_at);
+	CREATE INDEX IF NOT EXISTS idx_upload_activity_hour ON upload_activity(hour);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_reports_pending_reporter ON reports(upload_id, reporter_id) WHERE status = 'pending';
 	`
 
-	_, err := DB.Exec(schema)
+	if _, err := DB.Exec(ctx, store.TranslateDDL(schema)); err != nil {
+		return err
+	}
+
+	if err := migrateColumns(ctx); err != nil {
+		return err
+	}
+
+	// Indexes on migrated columns can only be created once the columns exist
+	if _, err := DB.Exec(ctx, `
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_uploads_source_external_id ON uploads(source, external_id) WHERE external_id IS NOT NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_uploads_retry_key ON uploads(discord_id, retry_key) WHERE retry_key IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS idx_uploads_license ON uploads(license);
+	CREATE INDEX IF NOT EXISTS idx_uploads_like_count ON uploads(like_count);
+	CREATE INDEX IF NOT EXISTS idx_uploads_guild ON uploads(guild_id);
+	CREATE INDEX IF NOT EXISTS idx_uploads_rarity_voting_ends_at ON uploads(rarity_voting_ends_at) WHERE rarity_voting_ends_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS idx_pulls_reveal_at ON pulls(reveal_at) WHERE reveal_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS idx_uploads_safety_pending ON uploads(id) WHERE safety_status = 'pending';
+	CREATE INDEX IF NOT EXISTS idx_uploads_sha256 ON uploads(sha256);
+	CREATE INDEX IF NOT EXISTS idx_blobs_transcoded_from ON blobs(transcoded_from) WHERE transcoded_from <> '';
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b0 ON uploads(((phash >> 0) & 255));
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b1 ON uploads(((phash >> 8) & 255));
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b2 ON uploads(((phash >> 16) & 255));
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b3 ON uploads(((phash >> 24) & 255));
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b4 ON uploads(((phash >> 32) & 255));
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b5 ON uploads(((phash >> 40) & 255));
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b6 ON uploads(((phash >> 48) & 255));
+	CREATE INDEX IF NOT EXISTS idx_uploads_phash_b7 ON uploads(((phash >> 56) & 255));
+	`); err != nil {
+		return err
+	}
+
+	return createSearchIndex(ctx)
+}
+
+// migrateColumns adds columns introduced after the initial schema to existing databases
+func migrateColumns(ctx context.Context) error {
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"uploads", "phash", "INTEGER"},
+		{"uploads", "duplicate_of", "INTEGER"},
+		{"uploads", "sha256", "TEXT"},
+		{"uploads", "frozen", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "timezone", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "title", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "description", "TEXT NOT NULL DEFAULT ''"},
+		{"blobs", "unavailable", "INTEGER NOT NULL DEFAULT 0"},
+		{"blobs", "transcoded_from", "TEXT NOT NULL DEFAULT ''"},
+		{"blobs", "transcode_skipped", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "deleted_at", "DATETIME"},
+		{"uploads", "blurhash", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "report_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"uploads", "report_hidden", "INTEGER NOT NULL DEFAULT 0"},
+		{"uploads", "source", "TEXT NOT NULL DEFAULT 'web'"},
+		{"uploads", "external_id", "TEXT"},
+		{"uploads", "view_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"uploads", "download_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "refresh_token", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "guild_verified_at", "DATETIME"},
+		{"users", "sessions_revoked_at", "DATETIME"},
+		{"uploads", "license", "TEXT NOT NULL DEFAULT ''"},
+		{"drafts", "license", "TEXT NOT NULL DEFAULT ''"},
+		{"pulls", "discarded", "INTEGER NOT NULL DEFAULT 0"},
+		{"pulls", "rerolled_from", "INTEGER"},
+		{"uploads", "width", "INTEGER NOT NULL DEFAULT 0"},
+		{"uploads", "height", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "profile_private", "INTEGER NOT NULL DEFAULT 0"},
+		{"uploads", "like_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"pulls", "banner_id", "INTEGER"},
+		{"pulls", "reveal_at", "DATETIME"},
+		{"uploads", "palette", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "safety_status", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "deletion_requested_at", "DATETIME"},
+		{"uploads", "rarity", "TEXT NOT NULL DEFAULT 'common'"},
+		{"users", "display_name", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "avatar_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "max_file_size_mb", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "discord_dms", "INTEGER NOT NULL DEFAULT 1"},
+		{"banners", "ending_notified", "INTEGER NOT NULL DEFAULT 0"},
+		{"uploads", "visibility", "TEXT NOT NULL DEFAULT 'public'"},
+		{"drafts", "visibility", "TEXT NOT NULL DEFAULT 'public'"},
+		{"upload_sessions", "visibility", "TEXT NOT NULL DEFAULT 'public'"},
+		{"uploads", "guild_id", "TEXT NOT NULL DEFAULT ''"},
+		{"banners", "guild_id", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "archived", "INTEGER NOT NULL DEFAULT 0"},
+		{"uploads", "rarity_voting_ends_at", "DATETIME"},
+		{"uploads", "quality_score", "INTEGER"},
+		{"users", "role_cooldown_minutes", "INTEGER"},
+		{"users", "linked_to", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "pull_nonce", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "pull_nonce_day", "TEXT NOT NULL DEFAULT ''"},
+		{"uploads", "safety_checked_at", "DATETIME"},
+		{"uploads", "pool_enabled", "INTEGER NOT NULL DEFAULT 1"},
+		{"uploads", "retry_key", "TEXT"},
+	}
+
+	for _, c := range columns {
+		if err := addColumnIfMissing(ctx, c.table, c.name, c.definition); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", c.table, c.name, err)
+		}
+	}
+
+	return nil
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists
+func addColumnIfMissing(ctx context.Context, table, column, definition string) error {
+	exists, err := store.ColumnExists(ctx, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = DB.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, store.TranslateDDL(definition)))
 	return err
 }
 
+// OptimizeDatabase does the periodic upkeep of the database, such as
+// refreshing query planner statistics
+func OptimizeDatabase(ctx context.Context) error {
+	return store.optimize(ctx)
+}
+
 // Close closes the database connection
 func Close() error {
 	if DB != nil {
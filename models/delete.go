@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SoftDeleteUpload moves an upload to the trash. Trashed uploads are hidden
+// everywhere but the admin trash listing until restored or purged.
+func SoftDeleteUpload(ctx context.Context, id int64) error {
+	result, err := DB.Exec(ctx, "UPDATE uploads SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	forgetPools()
+	return requireAffected(result)
+}
+
+// RestoreUpload takes an upload out of the trash
+func RestoreUpload(ctx context.Context, id int64) error {
+	result, err := DB.Exec(ctx, "UPDATE uploads SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if err != nil {
+		return err
+	}
+	forgetPools()
+	return requireAffected(result)
+}
+
+// ListTrash returns a page of trashed uploads, most recently deleted first,
+// along with the total number of trashed uploads
+func ListTrash(ctx context.Context, limit, offset int) ([]Upload, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads WHERE deleted_at IS NOT NULL").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	uploads, err := queryUploads(
+		ctx, uploadSelect+" WHERE u.deleted_at IS NOT NULL ORDER BY u.deleted_at DESC, u.id DESC LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return uploads, total, nil
+}
+
+// ListExpiredTrash returns the IDs of uploads trashed before the cutoff
+func ListExpiredTrash(ctx context.Context, cutoff time.Time) ([]int64, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT id FROM uploads WHERE deleted_at IS NOT NULL AND deleted_at < ?",
+		cutoff.UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// uploadReferences are the columns that refer to an upload. Rows referring
+// to a purged upload go with it, as foreign keys don't allow keeping them.
+var uploadReferences = []struct{ table, column string }{
+	{"upload_tags", "upload_id"},
+	{"upload_colors", "upload_id"},
+	{"upload_rejections", "upload_id"},
+	{"likes", "upload_id"},
+	{"pulls", "upload_id"},
+	{"wishlists", "upload_id"},
+	{"showcases", "upload_id"},
+	{"reports", "upload_id"},
+	{"takedown_requests", "upload_id"},
+	{"rarity_votes", "upload_id"},
+	{"banner_uploads", "upload_id"},
+	{"season_uploads", "upload_id"},
+	{"upload_activity", "upload_id"},
+	{"trades", "offered_upload_id"},
+	{"trades", "requested_upload_id"},
+}
+
+// PurgeUpload permanently removes a trashed upload along with its tags,
+// search entry and every other row referring to it, such as the pulls that
+// drew it, and releases its blob. It returns the stored filename when no
+// other upload references the same content, so the caller can delete the file;
+// uploads recorded before the blob store existed always return their own filename.
+func PurgeUpload(ctx context.Context, id int64) (string, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var filename, sha256 string
+	err = tx.QueryRow(
+		"SELECT filename, COALESCE(sha256, '') FROM uploads WHERE id = ? AND deleted_at IS NOT NULL",
+		id,
+	).Scan(&filename, &sha256)
+	if err != nil {
+		return "", err
+	}
+
+	// Draws go with their pulls, which may have been moved here from another
+	// upload by a merge
+	if _, err := tx.Exec("DELETE FROM pull_draws WHERE pull_id IN (SELECT id FROM pulls WHERE upload_id = ?)", id); err != nil {
+		return "", err
+	}
+	for _, ref := range uploadReferences {
+		if _, err := tx.Exec("DELETE FROM "+ref.table+" WHERE "+ref.column+" = ?", id); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM uploads WHERE id = ?", id); err != nil {
+		return "", err
+	}
+	if SearchEnabled {
+		if err := store.unindexUpload(tx, id); err != nil {
+			return "", err
+		}
+	}
+
+	orphaned := filename
+	if sha256 != "" {
+		if orphaned, err = releaseBlobTx(tx, sha256); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	forgetPools()
+	forgetTags()
+	return orphaned, nil
+}
+
+// requireAffected converts an UPDATE that matched no rows into sql.ErrNoRows
+func requireAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
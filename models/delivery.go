@@ -0,0 +1,184 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Delivery statuses. Deliveries are claimed as in flight while a worker sends
+// them; ones still in flight at startup were interrupted and are requeued.
+const (
+	DeliveryPending   = "pending"
+	DeliveryInFlight  = "in_flight"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Delivery is one outbound webhook notification
+type Delivery struct {
+	ID            int64
+	URL           string
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	DeliveredAt   sql.NullTime
+}
+
+const deliveryColumns = `id, url, event, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at`
+
+func scanDelivery(row rowScanner) (*Delivery, error) {
+	d := &Delivery{}
+	err := row.Scan(&d.ID, &d.URL, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// EnqueueDelivery queues a payload for delivery to url as soon as a worker is
+// free and returns its ID
+func EnqueueDelivery(ctx context.Context, url, event, payload string) (int64, error) {
+	var id int64
+	err := DB.QueryRow(
+		ctx, `INSERT INTO deliveries (url, event, payload, status, next_attempt_at) VALUES (?, ?, ?, ?, ?) RETURNING id`,
+		url, event, payload, DeliveryPending, time.Now().UTC().Format(timestampFormat),
+	).Scan(&id)
+	return id, err
+}
+
+// CountPendingDeliveries returns how many deliveries to url are waiting to be sent
+func CountPendingDeliveries(ctx context.Context, url string) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM deliveries WHERE url = ? AND status IN (?, ?)",
+		url, DeliveryPending, DeliveryInFlight,
+	).Scan(&count)
+	return count, err
+}
+
+// ClaimDelivery marks the most overdue pending delivery as in flight and
+// counts the attempt. It returns sql.ErrNoRows when nothing is due, including
+// when another worker claimed the same delivery first.
+func ClaimDelivery(ctx context.Context) (*Delivery, error) {
+	return scanDelivery(DB.QueryRow(
+		ctx, `UPDATE deliveries SET status = ?, attempts = attempts + 1
+		WHERE status = ? AND id = (
+			SELECT id FROM deliveries WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at, id LIMIT 1
+		)
+		RETURNING `+deliveryColumns,
+		DeliveryInFlight, DeliveryPending, DeliveryPending, time.Now().UTC().Format(timestampFormat),
+	))
+}
+
+// CompleteDelivery records a successful delivery
+func CompleteDelivery(ctx context.Context, id int64) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE deliveries SET status = ?, last_error = '', delivered_at = ? WHERE id = ?",
+		DeliveryDelivered, time.Now().UTC().Format(timestampFormat), id,
+	)
+	return err
+}
+
+// RetryDeliveryAt puts a failed delivery back in the queue until the given time
+func RetryDeliveryAt(ctx context.Context, id int64, lastError string, at time.Time) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE deliveries SET status = ?, last_error = ?, next_attempt_at = ? WHERE id = ?",
+		DeliveryPending, lastError, at.UTC().Format(timestampFormat), id,
+	)
+	return err
+}
+
+// DeadLetterDelivery gives up on a delivery; it stays dead until an admin
+// retries it
+func DeadLetterDelivery(ctx context.Context, id int64, lastError string) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE deliveries SET status = ?, last_error = ? WHERE id = ?",
+		DeliveryDead, lastError, id,
+	)
+	return err
+}
+
+// DeferDeliveries holds back every pending delivery to url until at least the
+// given time, for receivers that asked us to slow down
+func DeferDeliveries(ctx context.Context, url string, until time.Time) error {
+	at := until.UTC().Format(timestampFormat)
+	_, err := DB.Exec(
+		ctx, "UPDATE deliveries SET next_attempt_at = ? WHERE url = ? AND status = ? AND next_attempt_at < ?",
+		at, url, DeliveryPending, at,
+	)
+	return err
+}
+
+// RequeueInFlightDeliveries returns deliveries interrupted by a shutdown to
+// the queue. Call it before workers start.
+func RequeueInFlightDeliveries(ctx context.Context) (int64, error) {
+	result, err := DB.Exec(ctx, "UPDATE deliveries SET status = ? WHERE status = ?", DeliveryPending, DeliveryInFlight)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RetryDeadDelivery requeues a dead delivery with a fresh attempt budget. It
+// returns sql.ErrNoRows when the delivery doesn't exist or isn't dead.
+func RetryDeadDelivery(ctx context.Context, id int64) (*Delivery, error) {
+	return scanDelivery(DB.QueryRow(
+		ctx, `UPDATE deliveries SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ? AND status = ?
+		RETURNING `+deliveryColumns,
+		DeliveryPending, time.Now().UTC().Format(timestampFormat), id, DeliveryDead,
+	))
+}
+
+// ListDeliveries returns a page of deliveries with the given status, or all
+// deliveries when status is empty, newest first, along with the total count
+func ListDeliveries(ctx context.Context, status string, limit, offset int) ([]Delivery, int, error) {
+	where := "1 = 1"
+	var args []interface{}
+	if status != "" {
+		where = "status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM deliveries WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT "+deliveryColumns+" FROM deliveries WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, total, rows.Err()
+}
+
+// DeleteDeliveredBefore removes successful deliveries completed before the
+// given time and returns how many were removed
+func DeleteDeliveredBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := DB.Exec(
+		ctx, "DELETE FROM deliveries WHERE status = ? AND delivered_at < ?",
+		DeliveryDelivered, before.UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Device classes an upload listing or a pull can be narrowed to
+const (
+	DeviceClassPhone     = "phone"
+	DeviceClassDesktop   = "desktop"
+	DeviceClassUltrawide = "ultrawide"
+	DeviceClassDual      = "dual"
+)
+
+// deviceClass is the range of width/height ratios, in hundredths, that fit a
+// kind of screen. Max is exclusive.
+type deviceClass struct {
+	Name     string
+	Min, Max int
+}
+
+// deviceClasses lists every class. The ranges don't overlap, so an upload
+// belongs to at most one; square and 4:3 images belong to none.
+var deviceClasses = []deviceClass{
+	// 9:21 through 2:3 portrait phones, 9:16 and 9:19.5 included
+	{DeviceClassPhone, 40, 67},
+	// 3:2 through 16:9 and slightly wider desktop and laptop screens
+	{DeviceClassDesktop, 150, 200},
+	// 21:9 ultrawide monitors
+	{DeviceClassUltrawide, 200, 300},
+	// Two 16:9 or 16:10 monitors side by side, and 32:9 super-ultrawides
+	{DeviceClassDual, 300, 400},
+}
+
+// DeviceClassNames lists the device class names, for error messages
+func DeviceClassNames() []string {
+	names := make([]string, len(deviceClasses))
+	for i, c := range deviceClasses {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// ParseDeviceClass validates a device class name, returning "" for an empty
+// one
+func ParseDeviceClass(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", nil
+	}
+	for _, c := range deviceClasses {
+		if c.Name == s {
+			return s, nil
+		}
+	}
+	return "", errors.New("class must be one of: " + strings.Join(DeviceClassNames(), ", "))
+}
+
+// DeviceClass returns the class an image of the given size fits, or "" if it
+// fits none or its size is unknown
+func DeviceClass(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return ""
+	}
+	for _, c := range deviceClasses {
+		if width*100 >= height*c.Min && width*100 < height*c.Max {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+// deviceClassCondition returns the SQL condition matching uploads of the
+// named class. Names are checked by ParseDeviceClass first; an unknown one
+// matches nothing.
+func deviceClassCondition(name string) string {
+	for _, c := range deviceClasses {
+		if c.Name == name {
+			return "(u.height > 0 AND u.width * 100 >= u.height * " + strconv.Itoa(c.Min) +
+				" AND u.width * 100 < u.height * " + strconv.Itoa(c.Max) + ")"
+		}
+	}
+	return "1 = 0"
+}
@@ -0,0 +1,33 @@
+package models
+
+import "context"
+
+// UploadsMissingDimensions returns the IDs and stored filenames of uploads
+// recorded before image dimensions were stored
+func UploadsMissingDimensions(ctx context.Context) (map[int64]string, error) {
+	rows, err := DB.Query(ctx, "SELECT id, filename FROM uploads WHERE width = 0 AND deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			return nil, err
+		}
+		uploads[id] = filename
+	}
+	return uploads, rows.Err()
+}
+
+// SetUploadDimensions stores the pixel size of an upload
+func SetUploadDimensions(ctx context.Context, id int64, width, height int) error {
+	if _, err := DB.Exec(ctx, "UPDATE uploads SET width = ?, height = ? WHERE id = ?", width, height, id); err != nil {
+		return err
+	}
+	forgetPools()
+	return nil
+}
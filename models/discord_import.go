@@ -0,0 +1,29 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// GetDiscordImportCursor returns the ID of the last message of a Discord
+// channel that has been imported, or "0" when none has
+func GetDiscordImportCursor(ctx context.Context, channelID string) (string, error) {
+	var id string
+	err := DB.QueryRow(ctx, "SELECT last_message_id FROM discord_imports WHERE channel_id = ?", channelID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "0", nil
+	}
+	return id, err
+}
+
+// SetDiscordImportCursor records the ID of the last message of a Discord
+// channel that has been imported, so the next import starts after it
+func SetDiscordImportCursor(ctx context.Context, channelID, messageID string) error {
+	_, err := DB.Exec(
+		ctx, `INSERT INTO discord_imports (channel_id, last_message_id, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(channel_id) DO UPDATE SET last_message_id = excluded.last_message_id, updated_at = excluded.updated_at`,
+		channelID, messageID, time.Now().UTC().Format(timestampFormat),
+	)
+	return err
+}
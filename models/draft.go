@@ -0,0 +1,132 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Draft is an upload staged by a user but not yet published
+type Draft struct {
+	ID               int64
+	DiscordID        string
+	Filename         string
+	OriginalFilename string
+	Title            string
+	Description      string
+	Tags             []string
+	License          string
+	Visibility       string
+	FileSize         int64
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+}
+
+const draftColumns = `id, discord_id, filename, original_filename, title, description, tags, license, visibility, file_size, created_at, expires_at`
+
+func scanDraft(row rowScanner) (*Draft, error) {
+	d := &Draft{}
+	var tags string
+	err := row.Scan(&d.ID, &d.DiscordID, &d.Filename, &d.OriginalFilename, &d.Title, &d.Description, &tags, &d.License, &d.Visibility, &d.FileSize, &d.CreatedAt, &d.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Tags = splitDraftTags(tags)
+	return d, nil
+}
+
+// Normalized tags never contain commas, so they are stored comma-joined
+func splitDraftTags(tags string) []string {
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
+
+// CreateDraft stores a new draft that expires after ttl and sets its ID
+func CreateDraft(ctx context.Context, d *Draft, ttl time.Duration) error {
+	expires := time.Now().Add(ttl).UTC()
+	return DB.QueryRow(
+		ctx, `INSERT INTO drafts (discord_id, filename, original_filename, title, description, tags, license, visibility, file_size, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at, expires_at`,
+		d.DiscordID, d.Filename, d.OriginalFilename, d.Title, d.Description, strings.Join(d.Tags, ","), d.License, d.Visibility, d.FileSize,
+		expires.Format(timestampFormat),
+	).Scan(&d.ID, &d.CreatedAt, &d.ExpiresAt)
+}
+
+// GetDraft returns one of the user's unexpired drafts, or sql.ErrNoRows
+func GetDraft(ctx context.Context, id int64, discordID string) (*Draft, error) {
+	return scanDraft(DB.QueryRow(
+		ctx, `SELECT `+draftColumns+` FROM drafts WHERE id = ? AND discord_id = ? AND expires_at > ?`,
+		id, discordID, time.Now().UTC().Format(timestampFormat),
+	))
+}
+
+// ListDrafts returns the user's unexpired drafts, newest first
+func ListDrafts(ctx context.Context, discordID string) ([]Draft, error) {
+	rows, err := DB.Query(
+		ctx, `SELECT `+draftColumns+` FROM drafts WHERE discord_id = ? AND expires_at > ? ORDER BY id DESC`,
+		discordID, time.Now().UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drafts := []Draft{}
+	for rows.Next() {
+		d, err := scanDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, *d)
+	}
+	return drafts, rows.Err()
+}
+
+// UpdateDraft saves a draft's metadata and pushes its expiry ttl into the
+// future, so drafts being worked on don't expire. It returns sql.ErrNoRows
+// when the user has no such unexpired draft.
+func UpdateDraft(ctx context.Context, d *Draft, ttl time.Duration) error {
+	now := time.Now().UTC()
+	return DB.QueryRow(
+		ctx, `UPDATE drafts SET title = ?, description = ?, tags = ?, license = ?, visibility = ?, expires_at = ?
+		WHERE id = ? AND discord_id = ? AND expires_at > ? RETURNING expires_at`,
+		d.Title, d.Description, strings.Join(d.Tags, ","), d.License, d.Visibility, now.Add(ttl).Format(timestampFormat),
+		d.ID, d.DiscordID, now.Format(timestampFormat),
+	).Scan(&d.ExpiresAt)
+}
+
+// DeleteDraft removes one of the user's drafts and returns its stored
+// filename, or sql.ErrNoRows when there is no such draft
+func DeleteDraft(ctx context.Context, id int64, discordID string) (string, error) {
+	var filename string
+	err := DB.QueryRow(
+		ctx, `DELETE FROM drafts WHERE id = ? AND discord_id = ? RETURNING filename`,
+		id, discordID,
+	).Scan(&filename)
+	return filename, err
+}
+
+// DeleteExpiredDrafts removes drafts whose expiry has passed and returns
+// their stored filenames
+func DeleteExpiredDrafts(ctx context.Context) ([]string, error) {
+	rows, err := DB.Query(
+		ctx, `DELETE FROM drafts WHERE expires_at <= ? RETURNING filename`,
+		time.Now().UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, rows.Err()
+}
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reasons recorded in the dust ledger. Duplicates earn dust; exchanges
+// spend it on a wallpaper the user doesn't own yet, drawn at random, drawn
+// from a rarity of their choice or picked by them.
+const (
+	DustDuplicate = "duplicate"
+	DustPull      = "pull"
+	DustRarity    = "rarity"
+	DustWallpaper = "wallpaper"
+)
+
+var (
+	// ErrNotEnoughDust is returned when the user can't afford an exchange
+	ErrNotEnoughDust = errors.New("not enough dust")
+	// ErrAlreadyOwned is returned when exchanging dust for, or wishlisting, a
+	// wallpaper the user already has
+	ErrAlreadyOwned = errors.New("wallpaper already in collection")
+)
+
+// DustEntry is a change to a user's dust balance. Reference is the pull
+// that earned or was bought with the dust, as "pull:<id>".
+type DustEntry struct {
+	ID        int64
+	DiscordID string
+	Amount    int
+	Reason    string
+	Reference string
+	CreatedAt time.Time
+}
+
+const dustEntryColumns = `id, discord_id, amount, reason, reference, created_at`
+
+const dustBalanceQuery = "SELECT COALESCE(SUM(amount), 0) FROM dust_ledger WHERE discord_id = ?"
+
+// DustBalance returns how much dust the user holds
+func DustBalance(ctx context.Context, discordID string) (int, error) {
+	var balance int
+	err := DB.QueryRow(ctx, dustBalanceQuery, discordID).Scan(&balance)
+	return balance, err
+}
+
+// convertDuplicate turns a duplicate pull into dust: the copy leaves the
+// collection and the user is credited amount. Pulls that are not duplicates,
+// or an amount below 1, leave the pull as it is.
+func convertDuplicate(tx *Tx, p *Pull, amount int) error {
+	if !p.Duplicate || amount < 1 {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE pulls SET discarded = 1 WHERE id = ?", p.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO dust_ledger (discord_id, amount, reason, reference) VALUES (?, ?, ?, ?)",
+		p.DiscordID, amount, DustDuplicate, fmt.Sprintf("pull:%d", p.ID),
+	); err != nil {
+		return err
+	}
+	p.Discarded = true
+	p.Dust = amount
+	return nil
+}
+
+// ConvertSpareCopies turns the user's spare copies of a wallpaper, or of
+// every wallpaper when uploadID is zero, into dust at the rate of their
+// rarity in rates. The oldest copy of each stays in the collection, as do
+// copies of rarities without a rate. It returns how many copies were
+// converted and the dust they earned.
+func ConvertSpareCopies(ctx context.Context, discordID string, uploadID int64, rates map[string]int) (int, int, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT p.id, u.rarity FROM pulls p JOIN uploads u ON u.id = p.upload_id
+		WHERE p.discord_id = ? AND p.discarded = 0 AND u.deleted_at IS NULL
+		AND p.id > (SELECT MIN(k.id) FROM pulls k WHERE k.discord_id = p.discord_id AND k.upload_id = p.upload_id AND k.discarded = 0)`
+	args := []interface{}{discordID}
+	if uploadID != 0 {
+		query += " AND p.upload_id = ?"
+		args = append(args, uploadID)
+	}
+	rows, err := tx.Query(query+" ORDER BY p.id", args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	var spares []Pull
+	for rows.Next() {
+		var p Pull
+		var rarity string
+		if err := rows.Scan(&p.ID, &rarity); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		p.Dust = rates[rarity]
+		spares = append(spares, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	var copies, dust int
+	for _, p := range spares {
+		p.DiscordID, p.Duplicate = discordID, true
+		if err := convertDuplicate(tx, &p, p.Dust); err != nil {
+			return 0, 0, err
+		}
+		if p.Discarded {
+			copies++
+			dust += p.Dust
+		}
+	}
+	return copies, dust, tx.Commit()
+}
+
+// OwnedUploadIDs returns the IDs of the wallpapers in the user's collection
+func OwnedUploadIDs(ctx context.Context, discordID string) ([]int64, error) {
+	rows, err := DB.Query(ctx, "SELECT DISTINCT upload_id FROM pulls WHERE discord_id = ? AND discarded = 0", discordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// OwnsUpload reports whether the wallpaper is in the user's collection
+func OwnsUpload(ctx context.Context, discordID string, uploadID int64) (bool, error) {
+	var owned int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND upload_id = ? AND discarded = 0",
+		discordID, uploadID,
+	).Scan(&owned)
+	return owned > 0, err
+}
+
+// ExchangeDust spends cost dust on a pull of a wallpaper the user doesn't
+// own yet, recording reason in the ledger. It returns ErrAlreadyOwned if the
+// wallpaper is already in their collection and ErrNotEnoughDust if their
+// balance is short.
+func ExchangeDust(ctx context.Context, discordID string, uploadID int64, cost int, reason string) (*Pull, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	p := &Pull{DiscordID: discordID, UploadID: uploadID, Source: PullSourceDust}
+	duplicate, err := markDuplicate(tx, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Duplicate {
+		return nil, ErrAlreadyOwned
+	}
+	err = tx.QueryRow(
+		`INSERT INTO pulls (discord_id, upload_id, source, duplicate) VALUES (?, ?, ?, ?) RETURNING id, pulled_at`,
+		p.DiscordID, p.UploadID, p.Source, duplicate,
+	).Scan(&p.ID, &p.PulledAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := claimWishlist(tx, p); err != nil {
+		return nil, err
+	}
+
+	// Checking the balance in the insert itself keeps concurrent exchanges
+	// from overspending
+	var entryID int64
+	err = tx.QueryRow(
+		`INSERT INTO dust_ledger (discord_id, amount, reason, reference)
+		SELECT ?, ?, ?, ? WHERE (`+dustBalanceQuery+`) >= ? RETURNING id`,
+		discordID, -cost, reason, fmt.Sprintf("pull:%d", p.ID), discordID, cost,
+	).Scan(&entryID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotEnoughDust
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p, tx.Commit()
+}
+
+// ListDustLedger returns a page of the user's dust ledger, newest first,
+// along with the total number of entries
+func ListDustLedger(ctx context.Context, discordID string, limit, offset int) ([]DustEntry, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM dust_ledger WHERE discord_id = ?", discordID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT "+dustEntryColumns+" FROM dust_ledger WHERE discord_id = ? ORDER BY id DESC LIMIT ? OFFSET ?",
+		discordID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []DustEntry{}
+	for rows.Next() {
+		var e DustEntry
+		if err := rows.Scan(&e.ID, &e.DiscordID, &e.Amount, &e.Reason, &e.Reference, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
@@ -0,0 +1,264 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Pulls are provably fair: each UTC day has a secret seed, and every draw
+// made that day takes its random numbers from an HMAC of the seed. The seed's
+// SHA-256, its commitment, is published while the day runs and the seed
+// itself once the day is over, so users can check that their draws followed
+// from a seed fixed before they pulled.
+
+// seedDayFormat names the day a seed is for
+const seedDayFormat = "2006-01-02"
+
+// PullSeed is the secret a day's draws are derived from. Seed is hex-encoded
+// and Commitment is the hex SHA-256 of its bytes.
+type PullSeed struct {
+	Day        string
+	Seed       string
+	Commitment string
+}
+
+// RevealsAt returns when the day is over and its seed may be shown
+func (s *PullSeed) RevealsAt() time.Time {
+	day, _ := time.Parse(seedDayFormat, s.Day)
+	return day.AddDate(0, 0, 1)
+}
+
+// Revealed reports whether the seed may be shown at the given time
+func (s *PullSeed) Revealed(now time.Time) bool {
+	return !now.Before(s.RevealsAt())
+}
+
+// seedDay returns the day whose seed draws made at t use
+func seedDay(t time.Time) string {
+	return t.UTC().Format(seedDayFormat)
+}
+
+// currentPullSeed returns today's seed, making it on the first draw or look
+// of the day
+func currentPullSeed(ctx context.Context) (*PullSeed, error) {
+	day := seedDay(time.Now())
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	commitment := sha256.Sum256(secret)
+	if _, err := DB.Exec(
+		ctx, "INSERT INTO pull_seeds (day, seed, commitment) VALUES (?, ?, ?) ON CONFLICT (day) DO NOTHING",
+		day, hex.EncodeToString(secret), hex.EncodeToString(commitment[:]),
+	); err != nil {
+		return nil, err
+	}
+	return GetPullSeed(ctx, day)
+}
+
+// GetPullSeed returns a day's seed, or sql.ErrNoRows if nothing was drawn
+// or published that day
+func GetPullSeed(ctx context.Context, day string) (*PullSeed, error) {
+	s := &PullSeed{}
+	err := DB.QueryRow(ctx, "SELECT day, seed, commitment FROM pull_seeds WHERE day = ?", day).Scan(&s.Day, &s.Seed, &s.Commitment)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListPullSeeds returns a page of seeds, newest first, along with the total
+// number. Today's is made first, so its commitment is published before
+// anyone pulls.
+func ListPullSeeds(ctx context.Context, limit, offset int) ([]PullSeed, int, error) {
+	if _, err := currentPullSeed(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM pull_seeds").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := DB.Query(ctx, "SELECT day, seed, commitment FROM pull_seeds ORDER BY day DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	seeds := []PullSeed{}
+	for rows.Next() {
+		var s PullSeed
+		if err := rows.Scan(&s.Day, &s.Seed, &s.Commitment); err != nil {
+			return nil, 0, err
+		}
+		seeds = append(seeds, s)
+	}
+	return seeds, total, rows.Err()
+}
+
+// TierRate is a rarity tier a draw could land in and its rate
+type TierRate struct {
+	Rarity string  `json:"rarity"`
+	Rate   float64 `json:"rate"`
+}
+
+// pickTier walks the tiers to the one a roll in [0, 1) lands in
+func pickTier(tiers []TierRate, roll float64) string {
+	var total float64
+	for _, t := range tiers {
+		total += t.Rate
+	}
+	point := roll * total
+	for _, t := range tiers {
+		if point < t.Rate {
+			return t.Rarity
+		}
+		point -= t.Rate
+	}
+	if len(tiers) == 0 {
+		return ""
+	}
+	return tiers[len(tiers)-1].Rarity
+}
+
+// Draw is the randomness behind one pull and where it landed. Its random
+// numbers come from the HMAC-SHA256 of "<discord ID>:<nonce>" keyed with the
+// day's seed; the nonce counts the user's draws that day from 1. The rarity
+// roll picks among Tiers, and the pick roll, times the pool's total weight,
+// falls in the span from Start to End that the drawn upload covers.
+type Draw struct {
+	PullID    int64
+	DiscordID string
+	Day       string
+	Nonce     int64
+	UploadID  int64
+	// Tiers are the rarity tiers in the pool, in the order they were walked;
+	// empty when rarity rates are off
+	Tiers  []TierRate
+	Rarity string
+	Total  float64
+	Start  float64
+	End    float64
+
+	seed []byte
+}
+
+// NewDraw takes the user's next nonce under today's seed for a draw
+func NewDraw(ctx context.Context, discordID string) (*Draw, error) {
+	s, err := currentPullSeed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(s.Seed)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Draw{DiscordID: discordID, Day: s.Day, seed: seed}
+	err = DB.QueryRow(
+		ctx, `UPDATE users SET pull_nonce = CASE WHEN pull_nonce_day = ? THEN pull_nonce + 1 ELSE 1 END, pull_nonce_day = ?
+		WHERE discord_id = ? RETURNING pull_nonce`,
+		s.Day, s.Day, discordID,
+	).Scan(&d.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DrawRolls returns the rarity and pick rolls, both in [0, 1), of a user's
+// draw with the given nonce under a seed
+func DrawRolls(seed []byte, discordID string, nonce int64) (rarity, pick float64) {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte(discordID + ":" + strconv.FormatInt(nonce, 10)))
+	sum := mac.Sum(nil)
+	// The top 53 bits of each half give a float64 without bias
+	rarity = float64(binary.BigEndian.Uint64(sum[0:8])>>11) / (1 << 53)
+	pick = float64(binary.BigEndian.Uint64(sum[8:16])>>11) / (1 << 53)
+	return rarity, pick
+}
+
+// rolls returns the draw's rarity and pick rolls
+func (d *Draw) rolls() (rarity, pick float64) {
+	return DrawRolls(d.seed, d.DiscordID, d.Nonce)
+}
+
+// RecordDraw keeps a draw with the pull it made, for the user to verify
+func RecordDraw(ctx context.Context, pullID int64, d *Draw) error {
+	tiers := ""
+	if len(d.Tiers) > 0 {
+		data, err := json.Marshal(d.Tiers)
+		if err != nil {
+			return err
+		}
+		tiers = string(data)
+	}
+	d.PullID = pullID
+	_, err := DB.Exec(
+		ctx, `INSERT INTO pull_draws (pull_id, discord_id, day, nonce, upload_id, tiers, rarity, pool_total, range_start, range_end)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		pullID, d.DiscordID, d.Day, d.Nonce, d.UploadID, tiers, d.Rarity, d.Total, d.Start, d.End,
+	)
+	return err
+}
+
+// GetDraw returns the draw behind a pull, or sql.ErrNoRows for pulls that
+// weren't drawn, such as trades and wallpapers bought outright with dust, or
+// were made before draws were recorded
+func GetDraw(ctx context.Context, pullID int64) (*Draw, error) {
+	d := &Draw{}
+	var tiers string
+	err := DB.QueryRow(
+		ctx, `SELECT pull_id, discord_id, day, nonce, upload_id, tiers, rarity, pool_total, range_start, range_end
+		FROM pull_draws WHERE pull_id = ?`,
+		pullID,
+	).Scan(&d.PullID, &d.DiscordID, &d.Day, &d.Nonce, &d.UploadID, &tiers, &d.Rarity, &d.Total, &d.Start, &d.End)
+	if err != nil {
+		return nil, err
+	}
+	if tiers != "" {
+		if err := json.Unmarshal([]byte(tiers), &d.Tiers); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// ErrDrawMismatch is returned when a draw doesn't follow from its seed
+var ErrDrawMismatch = errors.New("draw does not follow from the seed")
+
+// VerifyDraw checks a draw against its day's revealed seed: that the seed
+// matches the commitment published for the day, that the rarity roll picks
+// the tier drawn, and that the pick roll falls in the drawn upload's span of
+// the pool. Mismatches are returned wrapping ErrDrawMismatch.
+func VerifyDraw(d *Draw, s *PullSeed) error {
+	seed, err := hex.DecodeString(s.Seed)
+	if err != nil {
+		return fmt.Errorf("%w: the seed is not hex", ErrDrawMismatch)
+	}
+	if sum := sha256.Sum256(seed); hex.EncodeToString(sum[:]) != s.Commitment {
+		return fmt.Errorf("%w: the seed doesn't match the day's commitment", ErrDrawMismatch)
+	}
+
+	rarity, pick := DrawRolls(seed, d.DiscordID, d.Nonce)
+	if len(d.Tiers) > 0 && pickTier(d.Tiers, rarity) != d.Rarity {
+		return fmt.Errorf("%w: the rarity roll picks %s, not %s", ErrDrawMismatch, pickTier(d.Tiers, rarity), d.Rarity)
+	}
+	// The span's start is computed from its end, so allow for rounding
+	point := pick * d.Total
+	slack := 1e-9 * math.Max(d.Total, 1)
+	if point < d.Start-slack || point >= d.End+slack {
+		return fmt.Errorf("%w: the pick roll lands at %g, outside %g to %g", ErrDrawMismatch, point, d.Start, d.End)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package models
+
+import "context"
+
+// ReferencedFiles lists the filenames the database refers to, by the
+// directory they are kept in
+type ReferencedFiles struct {
+	// Stored upload files, including trashed uploads
+	Uploads map[string]bool
+	// Files of unpublished drafts
+	Drafts map[string]bool
+	// Partially received resumable uploads
+	Partials map[string]bool
+}
+
+// ListReferencedFiles returns every filename recorded for blobs, uploads,
+// drafts and resumable uploads
+func ListReferencedFiles(ctx context.Context) (*ReferencedFiles, error) {
+	uploads, err := queryFilenames(ctx, "SELECT filename FROM blobs UNION SELECT filename FROM uploads")
+	if err != nil {
+		return nil, err
+	}
+	drafts, err := queryFilenames(ctx, "SELECT filename FROM drafts")
+	if err != nil {
+		return nil, err
+	}
+	partials, err := queryFilenames(ctx, "SELECT filename FROM upload_sessions")
+	if err != nil {
+		return nil, err
+	}
+	return &ReferencedFiles{Uploads: uploads, Drafts: drafts, Partials: partials}, nil
+}
+
+func queryFilenames(ctx context.Context, query string) (map[string]bool, error) {
+	rows, err := DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	filenames := make(map[string]bool)
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		filenames[filename] = true
+	}
+	return filenames, rows.Err()
+}
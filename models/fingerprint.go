@@ -0,0 +1,220 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// RecordFingerprint notes that a user signed in from a device with the given
+// fingerprint, updating when it was last seen if it was before. Users who
+// never signed in, such as banned ones turned away at their first sign-in,
+// have nothing recorded.
+func RecordFingerprint(ctx context.Context, discordID, fingerprint string) error {
+	now := time.Now().UTC().Format(timestampFormat)
+	_, err := DB.Exec(
+		ctx, `INSERT INTO device_fingerprints (fingerprint, discord_id, first_seen_at, last_seen_at)
+		SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM users WHERE discord_id = ?)
+		ON CONFLICT (fingerprint, discord_id) DO UPDATE SET last_seen_at = excluded.last_seen_at`,
+		fingerprint, discordID, now, now, discordID,
+	)
+	return err
+}
+
+// DeleteFingerprintsBefore deletes the fingerprints last seen before cutoff,
+// returning how many were deleted
+func DeleteFingerprintsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := DB.Exec(ctx, "DELETE FROM device_fingerprints WHERE last_seen_at < ?", cutoff.UTC().Format(timestampFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// AltCluster is a group of accounts that signed in from devices with the same
+// fingerprint, directly or through other accounts in the group, and so are
+// likely run by one person
+type AltCluster struct {
+	Members []AltClusterMember
+	// Fingerprints is how many fingerprints the members share
+	Fingerprints int
+	LastSeenAt   time.Time
+	// BannedMember is set when some members are banned and others aren't,
+	// as when a banned user comes back with a fresh account
+	BannedMember bool
+	// CooldownEvasion is set when members uploaded closer together than the
+	// upload cooldown allows one account to
+	CooldownEvasion bool
+}
+
+// Flagged reports whether the cluster shows signs of abuse
+func (c *AltCluster) Flagged() bool {
+	return c.BannedMember || c.CooldownEvasion
+}
+
+// AltClusterMember is one account of an AltCluster
+type AltClusterMember struct {
+	DiscordID  string
+	Username   string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Banned     bool
+	Uploads    int
+}
+
+// ListAltClusters groups the accounts sharing device fingerprints into
+// suspected alt clusters, flagged ones first and then the most recently
+// seen. Accounts linked to another count as that account, so a user's
+// declared alts don't make a cluster of their own. Uploads made since
+// `since` by different members less than cooldown apart flag a cluster as
+// evading the cooldown.
+func ListAltClusters(ctx context.Context, cooldown time.Duration, since time.Time) ([]AltCluster, error) {
+	rows, err := DB.Query(
+		ctx, `SELECT f.fingerprint, COALESCE(NULLIF(u.linked_to, ''), f.discord_id), f.last_seen_at
+		FROM device_fingerprints f JOIN users u ON u.discord_id = f.discord_id
+		WHERE f.fingerprint IN (SELECT fingerprint FROM device_fingerprints GROUP BY fingerprint HAVING COUNT(*) > 1)`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Accounts are joined into clusters by the fingerprints they share
+	parent := make(map[string]string)
+	var find func(id string) string
+	find = func(id string) string {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = find(p)
+			return parent[id]
+		}
+		parent[id] = id
+		return id
+	}
+	firstAccount := make(map[string]string)
+	accountsByFingerprint := make(map[string]map[string]bool)
+	lastSeen := make(map[string]time.Time)
+	for rows.Next() {
+		var fingerprint, discordID string
+		var seen time.Time
+		if err := rows.Scan(&fingerprint, &discordID, &seen); err != nil {
+			return nil, err
+		}
+		if first, ok := firstAccount[fingerprint]; ok {
+			parent[find(discordID)] = find(first)
+		} else {
+			firstAccount[fingerprint] = discordID
+			find(discordID)
+		}
+		if accountsByFingerprint[fingerprint] == nil {
+			accountsByFingerprint[fingerprint] = make(map[string]bool)
+		}
+		accountsByFingerprint[fingerprint][discordID] = true
+		if seen.After(lastSeen[discordID]) {
+			lastSeen[discordID] = seen
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	members := make(map[string][]string)
+	for id := range parent {
+		root := find(id)
+		members[root] = append(members[root], id)
+	}
+	shared := make(map[string]int)
+	for _, accounts := range accountsByFingerprint {
+		if len(accounts) < 2 {
+			continue
+		}
+		for id := range accounts {
+			shared[find(id)]++
+			break
+		}
+	}
+
+	clusters := []AltCluster{}
+	for root, ids := range members {
+		if len(ids) < 2 {
+			continue
+		}
+		cluster, err := loadAltCluster(ctx, ids, lastSeen, cooldown, since)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Fingerprints = shared[root]
+		clusters = append(clusters, *cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if a, b := clusters[i].Flagged(), clusters[j].Flagged(); a != b {
+			return a
+		}
+		return clusters[i].LastSeenAt.After(clusters[j].LastSeenAt)
+	})
+	return clusters, nil
+}
+
+// loadAltCluster fills in a cluster's members and flags
+func loadAltCluster(ctx context.Context, ids []string, lastSeen map[string]time.Time, cooldown time.Duration, since time.Time) (*AltCluster, error) {
+	now := time.Now().UTC().Format(timestampFormat)
+	cluster := &AltCluster{}
+	type memberUpload struct {
+		discordID  string
+		uploadedAt time.Time
+	}
+	var uploads []memberUpload
+	banned := 0
+	for _, id := range ids {
+		m := AltClusterMember{DiscordID: id, LastSeenAt: lastSeen[id]}
+		if err := DB.QueryRow(
+			ctx, `SELECT username, created_at,
+			(SELECT COUNT(*) FROM uploads WHERE discord_id = users.discord_id AND deleted_at IS NULL),
+			EXISTS (SELECT 1 FROM bans WHERE discord_id = users.discord_id AND `+activeBanCondition+`)
+			FROM users WHERE discord_id = ?`,
+			now, id,
+		).Scan(&m.Username, &m.CreatedAt, &m.Uploads, &m.Banned); err != nil {
+			return nil, err
+		}
+		if m.Banned {
+			banned++
+		}
+		if m.LastSeenAt.After(cluster.LastSeenAt) {
+			cluster.LastSeenAt = m.LastSeenAt
+		}
+		cluster.Members = append(cluster.Members, m)
+
+		rows, err := DB.Query(
+			ctx, "SELECT uploaded_at FROM uploads WHERE discord_id = ? AND uploaded_at >= ?",
+			id, since.UTC().Format(timestampFormat),
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			u := memberUpload{discordID: id}
+			if err := rows.Scan(&u.uploadedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			uploads = append(uploads, u)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cluster.BannedMember = banned > 0 && banned < len(ids)
+
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].uploadedAt.Before(uploads[j].uploadedAt) })
+	for i := 1; i < len(uploads); i++ {
+		if uploads[i].discordID != uploads[i-1].discordID && uploads[i].uploadedAt.Sub(uploads[i-1].uploadedAt) < cooldown {
+			cluster.CooldownEvasion = true
+			break
+		}
+	}
+
+	sort.Slice(cluster.Members, func(i, j int) bool { return cluster.Members[i].CreatedAt.Before(cluster.Members[j].CreatedAt) })
+	return cluster, nil
+}
@@ -0,0 +1,307 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"math/rand/v2"
+	"strings"
+)
+
+// uploadSelect selects every listing column of an upload along with the
+// uploader's name; callers append joins, WHERE and ORDER BY clauses
+const uploadSelect = `SELECT u.id, u.discord_id, COALESCE(us.username, ''), u.filename, u.original_filename,
+	u.title, u.description, u.file_size, u.uploaded_at, COALESCE(u.sha256, ''), u.frozen, u.phash, u.duplicate_of, u.deleted_at, u.blurhash,
+	u.report_count, u.report_hidden, u.source, u.external_id, u.license, u.visibility, u.guild_id, u.width, u.height, u.like_count, u.palette,
+	u.safety_status, u.rarity, u.rarity_voting_ends_at, u.archived, u.quality_score, u.pool_enabled
+	FROM uploads u LEFT JOIN users us ON us.discord_id = u.discord_id`
+
+// availableUploadCondition matches uploads that moderation, safety checks and
+// missing files haven't hidden
+const availableUploadCondition = `u.frozen = 0 AND u.deleted_at IS NULL AND u.report_hidden = 0 AND u.safety_status <> '` + SafetyPending + `'
+	AND NOT EXISTS (SELECT 1 FROM blobs b WHERE b.sha256 = u.sha256 AND b.unavailable = 1)`
+
+// visibleUploadCondition matches uploads that may appear in public listings
+// and, unless taken out of it, the pull pool
+const visibleUploadCondition = availableUploadCondition + ` AND u.visibility = '` + VisibilityPublic + `'`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUpload(row rowScanner) (*Upload, error) {
+	u := &Upload{}
+	var palette string
+	err := row.Scan(&u.ID, &u.DiscordID, &u.UploaderName, &u.Filename, &u.OriginalFilename,
+		&u.Title, &u.Description, &u.FileSize, &u.UploadedAt, &u.SHA256, &u.Frozen, &u.PHash, &u.DuplicateOf, &u.DeletedAt, &u.BlurHash,
+		&u.ReportCount, &u.ReportHidden, &u.Source, &u.ExternalID, &u.License, &u.Visibility, &u.GuildID, &u.Width, &u.Height, &u.LikeCount, &palette,
+		&u.SafetyStatus, &u.Rarity, &u.RarityVotingEndsAt, &u.Archived, &u.QualityScore, &u.PoolEnabled)
+	if palette != "" {
+		u.Palette = strings.Split(palette, ",")
+	}
+	return u, err
+}
+
+// queryUploads runs a query built on uploadSelect and loads each upload's tags
+func queryUploads(ctx context.Context, query string, args ...interface{}) ([]Upload, error) {
+	rows, err := DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []Upload{}
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, *u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := loadTags(ctx, uploads); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// uploadsByID loads the given uploads, keyed by ID
+func uploadsByID(ctx context.Context, ids []int64) (map[int64]Upload, error) {
+	byID := make(map[int64]Upload, len(ids))
+	if len(ids) == 0 {
+		return byID, nil
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	uploads, err := queryUploads(ctx, uploadSelect+" WHERE u.id IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range uploads {
+		byID[u.ID] = u
+	}
+	return byID, nil
+}
+
+// Orientations an upload listing can be narrowed to
+const (
+	OrientationLandscape = "landscape"
+	OrientationPortrait  = "portrait"
+	OrientationSquare    = "square"
+)
+
+// Orders an upload listing can be sorted in
+const (
+	SortNewest  = "newest"
+	SortPopular = "popular"
+)
+
+// UploadFilter narrows a gallery listing. Uploads of unknown size never match
+// a resolution, orientation or device class filter. Sort is SortNewest unless set to
+// SortPopular, most liked first.
+type UploadFilter struct {
+	// GuildID narrows the listing to one guild's wallpapers
+	GuildID string
+	// DiscordID narrows the listing to one uploader's wallpapers
+	DiscordID string
+	// AllVisibilities also lists unlisted and private wallpapers, for
+	// uploaders and admins looking at DiscordID's wallpapers
+	AllVisibilities bool
+	Tag             string
+	Licenses        []string
+	MinWidth        int
+	MinHeight       int
+	Orientation     string
+	// DeviceClass is one of the DeviceClass constants, or "" for any
+	DeviceClass string
+	// Pool is PoolStandard or PoolArchive, or "" for both
+	Pool string
+	// Color narrows the listing to uploads with a palette color within
+	// Tolerance of it; see ParseColor
+	Color     *Color
+	Tolerance int
+	Sort      string
+	Limit     int
+	Offset    int
+}
+
+// filterCondition builds the WHERE clause matching the visible uploads the
+// filter selects, along with its arguments
+func filterCondition(filter UploadFilter) (string, []interface{}) {
+	where := visibleUploadCondition
+	if filter.AllVisibilities {
+		where = availableUploadCondition
+	}
+	var args []interface{}
+	if filter.GuildID != "" {
+		where += " AND u.guild_id = ?"
+		args = append(args, filter.GuildID)
+	}
+	if filter.DiscordID != "" {
+		where += " AND u.discord_id = ?"
+		args = append(args, filter.DiscordID)
+	}
+	if filter.Tag != "" {
+		where += " AND u.id IN (SELECT ut.upload_id FROM upload_tags ut JOIN tags t ON t.id = ut.tag_id WHERE t.name = ?)"
+		args = append(args, filter.Tag)
+	}
+	if len(filter.Licenses) > 0 {
+		cond, licenseArgs := licenseCondition(filter.Licenses)
+		where += " AND " + cond
+		args = append(args, licenseArgs...)
+	}
+	if filter.MinWidth > 0 {
+		where += " AND u.width >= ?"
+		args = append(args, filter.MinWidth)
+	}
+	if filter.MinHeight > 0 {
+		where += " AND u.height >= ?"
+		args = append(args, filter.MinHeight)
+	}
+	switch filter.Orientation {
+	case OrientationLandscape:
+		where += " AND u.width > u.height AND u.height > 0"
+	case OrientationPortrait:
+		where += " AND u.height > u.width AND u.width > 0"
+	case OrientationSquare:
+		where += " AND u.width = u.height AND u.width > 0"
+	}
+	if filter.DeviceClass != "" {
+		where += " AND " + deviceClassCondition(filter.DeviceClass)
+	}
+	switch filter.Pool {
+	case PoolStandard:
+		where += " AND u.archived = 0"
+	case PoolArchive:
+		where += " AND u.archived = 1"
+	}
+	if filter.Color != nil {
+		where += " AND " + colorCondition
+		args = append(args, filter.Color.R, filter.Color.R, filter.Color.G, filter.Color.G, filter.Color.B, filter.Color.B,
+			filter.Tolerance*filter.Tolerance)
+	}
+	return where, args
+}
+
+// ListUploads returns a page of uploads, newest or most liked first, along
+// with the total number of uploads matching the filter
+func ListUploads(ctx context.Context, filter UploadFilter) ([]Upload, int, error) {
+	where, args := filterCondition(filter)
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads u WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	order := "u.uploaded_at DESC, u.id DESC"
+	if filter.Sort == SortPopular {
+		order = "u.like_count DESC, " + order
+	}
+	uploads, err := queryUploads(
+		ctx, uploadSelect+" WHERE "+where+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		append(args, filter.Limit, filter.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return uploads, total, nil
+}
+
+// RandomUpload returns an upload picked uniformly at random from those the
+// filter selects, ignoring its sort, limit and offset, or sql.ErrNoRows when
+// none match
+func RandomUpload(ctx context.Context, filter UploadFilter) (*Upload, error) {
+	where, args := filterCondition(filter)
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads u WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	u, err := scanUpload(DB.QueryRow(
+		ctx, uploadSelect+" WHERE "+where+" ORDER BY u.id LIMIT 1 OFFSET ?",
+		append(args, rand.IntN(total))...,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if u.Tags, err = GetUploadTags(ctx, u.ID); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetUpload returns a single upload by ID
+func GetUpload(ctx context.Context, id int64) (*Upload, error) {
+	u, err := scanUpload(DB.QueryRow(ctx, uploadSelect+" WHERE u.id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Tags, err = GetUploadTags(ctx, u.ID); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ListPoolUploads returns every upload in the public pools of all guilds,
+// oldest first, for publishing outside the site. Uploaders with private
+// profiles aren't named.
+func ListPoolUploads(ctx context.Context) ([]Upload, error) {
+	uploads, err := queryUploads(ctx, uploadSelect+" WHERE "+visibleUploadCondition+" ORDER BY u.id")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query(ctx, "SELECT discord_id FROM users WHERE profile_private = 1")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	private := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		private[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range uploads {
+		if private[uploads[i].DiscordID] {
+			uploads[i].UploaderName = ""
+		}
+	}
+	return uploads, nil
+}
+
+// GetPublicUpload returns an upload in the public pool of any guild, for
+// showing outside the site, or sql.ErrNoRows. Uploaders with private
+// profiles aren't named.
+func GetPublicUpload(ctx context.Context, id int64) (*Upload, error) {
+	u, err := scanUpload(DB.QueryRow(ctx, uploadSelect+" WHERE u.id = ? AND "+visibleUploadCondition, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var private bool
+	if err := DB.QueryRow(ctx, "SELECT COALESCE(MAX(profile_private), 0) FROM users WHERE discord_id = ?", u.DiscordID).Scan(&private); err != nil {
+		return nil, err
+	}
+	if private {
+		u.UploaderName = ""
+	}
+	return u, nil
+}
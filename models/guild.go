@@ -0,0 +1,15 @@
+package models
+
+import "context"
+
+// AssignDefaultGuild gives the wallpapers and banners stored before guilds
+// were tracked, which have none, to the default guild
+func AssignDefaultGuild(ctx context.Context, guildID string) error {
+	for _, table := range []string{"uploads", "banners"} {
+		if _, err := DB.Exec(ctx, "UPDATE "+table+" SET guild_id = ? WHERE guild_id = ''", guildID); err != nil {
+			return err
+		}
+	}
+	forgetPools()
+	return nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import "context"
+
+// PullHistoryEntry is one of a user's pulls along with the wallpaper it drew.
+// Upload is nil if the wallpaper no longer exists.
+type PullHistoryEntry struct {
+	Pull
+	Upload *Upload
+}
+
+// ListPullHistory returns a page of every pull the user has made, rerolls,
+// trades and exchanges included, newest first, along with the total number.
+// Dust is set on duplicates that were converted. Pulls held back for the user
+// to reveal are left out until they are revealed.
+func ListPullHistory(ctx context.Context, discordID string, limit, offset int) ([]PullHistoryEntry, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND reveal_at IS NULL", discordID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, `SELECT p.id, p.discord_id, p.upload_id, p.source, p.duplicate, p.discarded, p.rerolled_from, p.banner_id, p.pulled_at,
+			COALESCE(d.amount, 0)
+		FROM pulls p LEFT JOIN dust_ledger d ON d.reason = ? AND d.reference = 'pull:' || p.id
+		WHERE p.discord_id = ? AND p.reveal_at IS NULL ORDER BY p.id DESC LIMIT ? OFFSET ?`,
+		DustDuplicate, discordID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []PullHistoryEntry{}
+	for rows.Next() {
+		var e PullHistoryEntry
+		if err := rows.Scan(&e.ID, &e.DiscordID, &e.UploadID, &e.Source, &e.Duplicate, &e.Discarded,
+			&e.RerolledFrom, &e.BannerID, &e.PulledAt, &e.Dust); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	ids := make([]int64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.UploadID
+	}
+	byID, err := uploadsByID(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range entries {
+		if u, ok := byID[entries[i].UploadID]; ok {
+			entries[i].Upload = &u
+		}
+	}
+
+	return entries, total, nil
+}
+
+// PullOutcome is the part of a pull that luck statistics look at
+type PullOutcome struct {
+	Source    string
+	Duplicate bool
+	BannerID  int64
+}
+
+// ListPullOutcomes returns the outcome of every pull the user has made,
+// oldest first
+func ListPullOutcomes(ctx context.Context, discordID string) ([]PullOutcome, error) {
+	rows, err := DB.Query(ctx, "SELECT source, duplicate, COALESCE(banner_id, 0) FROM pulls WHERE discord_id = ? ORDER BY id", discordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outcomes []PullOutcome
+	for rows.Next() {
+		var o PullOutcome
+		if err := rows.Scan(&o.Source, &o.Duplicate, &o.BannerID); err != nil {
+			return nil, err
+		}
+		outcomes = append(outcomes, o)
+	}
+	return outcomes, rows.Err()
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Leaderboards, by what users are ranked on
+const (
+	// LeaderboardUploads ranks users by their uploads still in the gallery
+	LeaderboardUploads = "uploads"
+	// LeaderboardPulls ranks users by pulls made, not counting rerolls, trades
+	// or dust exchanges
+	LeaderboardPulls = "pulls"
+	// LeaderboardCollectors ranks users by distinct wallpapers collected
+	LeaderboardCollectors = "collectors"
+)
+
+// Leaderboards lists every leaderboard
+var Leaderboards = []string{LeaderboardUploads, LeaderboardPulls, LeaderboardCollectors}
+
+// LeaderboardEntry is a user's place on a leaderboard. Users with the same
+// score share a rank.
+type LeaderboardEntry struct {
+	Rank      int
+	DiscordID string
+	Username  string
+	// DisplayName and Avatar are as of the user's last sign-in
+	DisplayName string
+	Avatar      string
+	Score       int
+}
+
+// leaderboardQueries count each user's score from the wallpapers of one
+// guild. The placeholders are the guild and the start of the period; the
+// zero time covers all time.
+var leaderboardQueries = map[string]string{
+	LeaderboardUploads: `SELECT u.discord_id AS discord_id, COUNT(*) AS score FROM uploads u
+		WHERE ` + visibleUploadCondition + ` AND u.guild_id = ? AND u.uploaded_at >= ?
+		GROUP BY u.discord_id`,
+	LeaderboardPulls: `SELECT p.discord_id AS discord_id, COUNT(*) AS score FROM pulls p
+		JOIN uploads u ON u.id = p.upload_id
+		WHERE p.` + countedPullCondition + ` AND u.guild_id = ? AND p.pulled_at >= ?
+		GROUP BY p.discord_id`,
+	LeaderboardCollectors: `SELECT p.discord_id AS discord_id, COUNT(DISTINCT p.upload_id) AS score FROM pulls p
+		JOIN uploads u ON u.id = p.upload_id
+		WHERE p.discarded = 0 AND u.deleted_at IS NULL AND u.guild_id = ? AND p.pulled_at >= ?
+		GROUP BY p.discord_id`,
+}
+
+// GetLeaderboard returns the top users of a guild's leaderboard for activity
+// since the given time, leaving out banned users and those with private
+// profiles
+func GetLeaderboard(ctx context.Context, board, guildID string, since time.Time, limit int) ([]LeaderboardEntry, error) {
+	scores, ok := leaderboardQueries[board]
+	if !ok {
+		return nil, fmt.Errorf("unknown leaderboard %q", board)
+	}
+	now := time.Now().UTC().Format(timestampFormat)
+
+	rows, err := DB.Query(
+		ctx, `SELECT s.discord_id, us.username, us.display_name, us.avatar_hash, s.score
+		FROM (`+scores+`) s
+		JOIN users us ON us.discord_id = s.discord_id
+		WHERE us.profile_private = 0 AND NOT EXISTS (SELECT 1 FROM bans b WHERE b.discord_id = s.discord_id AND (b.expires_at IS NULL OR b.expires_at > ?))
+		ORDER BY s.score DESC, s.discord_id
+		LIMIT ?`,
+		guildID, since.UTC().Format(timestampFormat), now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LeaderboardEntry{}
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.DiscordID, &e.Username, &e.DisplayName, &e.Avatar, &e.Score); err != nil {
+			return nil, err
+		}
+		e.Rank = len(entries) + 1
+		if n := len(entries); n > 0 && entries[n-1].Score == e.Score {
+			e.Rank = entries[n-1].Rank
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
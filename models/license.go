@@ -0,0 +1,49 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Licenses an uploader may choose for a wallpaper. Uploads without a license
+// are stored with an empty one and are never matched by a license filter.
+var Licenses = []string{"cc0", "cc-by", "cc-by-sa", "cc-by-nc", "cc-by-nc-sa", "all-rights-reserved"}
+
+// NormalizeLicense lowercases and checks a license chosen by an uploader. An
+// empty license is allowed and means none was given.
+func NormalizeLicense(license string) (string, error) {
+	license = strings.ToLower(strings.TrimSpace(license))
+	if license != "" && !slices.Contains(Licenses, license) {
+		return "", fmt.Errorf("license must be one of: %s", strings.Join(Licenses, ", "))
+	}
+	return license, nil
+}
+
+// ParseLicenseFilter parses a comma-separated list of licenses, as taken by
+// the license query parameter. It returns nil when the list is empty.
+func ParseLicenseFilter(raw string) ([]string, error) {
+	var licenses []string
+	for _, part := range strings.Split(raw, ",") {
+		license, err := NormalizeLicense(part)
+		if err != nil {
+			return nil, err
+		}
+		if license != "" && !slices.Contains(licenses, license) {
+			licenses = append(licenses, license)
+		}
+	}
+	return licenses, nil
+}
+
+// licenseCondition returns a WHERE fragment matching uploads with one of the
+// licenses, and its arguments
+func licenseCondition(licenses []string) (string, []interface{}) {
+	placeholders := make([]string, len(licenses))
+	args := make([]interface{}, len(licenses))
+	for i, license := range licenses {
+		placeholders[i] = "?"
+		args[i] = license
+	}
+	return "u.license IN (" + strings.Join(placeholders, ", ") + ")", args
+}
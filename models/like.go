@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// LikeUpload records the user's like of an upload, returning the upload's
+// like count and whether the like is new. Liking an upload twice changes
+// nothing.
+func LikeUpload(ctx context.Context, discordID string, uploadID int64) (int, bool, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(
+		`INSERT INTO likes (discord_id, upload_id) VALUES (?, ?)
+		ON CONFLICT DO NOTHING RETURNING upload_id`,
+		discordID, uploadID,
+	).Scan(&uploadID)
+	added := err == nil
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("SELECT like_count FROM uploads WHERE id = ?", uploadID).Scan(&count)
+	} else if err == nil {
+		err = tx.QueryRow("UPDATE uploads SET like_count = like_count + 1 WHERE id = ? RETURNING like_count", uploadID).Scan(&count)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return count, added, tx.Commit()
+}
+
+// UnlikeUpload removes the user's like of an upload, returning the upload's
+// like count
+func UnlikeUpload(ctx context.Context, discordID string, uploadID int64) (int, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM likes WHERE discord_id = ? AND upload_id = ?", discordID, uploadID)
+	if err != nil {
+		return 0, err
+	}
+	query := "SELECT like_count FROM uploads WHERE id = ?"
+	if n, _ := result.RowsAffected(); n > 0 {
+		query = "UPDATE uploads SET like_count = like_count - 1 WHERE id = ? RETURNING like_count"
+	}
+	var count int
+	if err := tx.QueryRow(query, uploadID).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
@@ -0,0 +1,351 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Account link statuses
+const (
+	LinkPending  = "pending"
+	LinkMerged   = "merged"
+	LinkRejected = "rejected"
+)
+
+// LinkCodeLifetime is how long a link code can be used for after it is
+// issued
+const LinkCodeLifetime = 15 * time.Minute
+
+// Errors returned when two accounts can't be linked
+var (
+	ErrInvalidLinkCode = errors.New("invalid or expired link code")
+	ErrLinkSelf        = errors.New("account linked to itself")
+	ErrPrimaryLinked   = errors.New("account to link to is itself linked")
+	ErrAltLinked       = errors.New("account already linked")
+	ErrAltHasLinks     = errors.New("account has linked accounts of its own")
+)
+
+// AccountLink is an alt account attached to a user's primary one. Once merged,
+// the alt's collection, balances and uploads belong to the primary account
+// and signing in with the alt signs in to the primary.
+type AccountLink struct {
+	ID              int64
+	PrimaryID       string
+	PrimaryUsername string
+	AltID           string
+	AltUsername     string
+	Status          string
+	// Uploads and Pulls are how much the alt brought with it when linking
+	// was asked for
+	Uploads    int
+	Pulls      int
+	CreatedAt  time.Time
+	ResolvedAt sql.NullTime
+	ResolvedBy string
+}
+
+// CreateLinkCode stores the hash of a new link code for the user, replacing
+// any code they had before
+func CreateLinkCode(ctx context.Context, discordID, codeHash string) (time.Time, error) {
+	expires := time.Now().Add(LinkCodeLifetime).UTC()
+	_, err := DB.Exec(
+		ctx, `INSERT INTO link_codes (discord_id, code_hash, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(discord_id) DO UPDATE SET code_hash = excluded.code_hash, expires_at = excluded.expires_at`,
+		discordID, codeHash, expires.Format(timestampFormat),
+	)
+	return expires, err
+}
+
+// LinkAccount links altID to the account that issued the link code with
+// codeHash, using up the code. Alts bringing more uploads and pulls than
+// approvalThreshold wait for an admin's approval; the others are merged
+// straight away. The returned link's Status says which happened.
+func LinkAccount(ctx context.Context, codeHash, altID string, approvalThreshold int) (*AccountLink, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	link := &AccountLink{AltID: altID}
+	err = tx.QueryRow(
+		"DELETE FROM link_codes WHERE code_hash = ? AND expires_at > ? RETURNING discord_id",
+		codeHash, time.Now().UTC().Format(timestampFormat),
+	).Scan(&link.PrimaryID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidLinkCode
+	} else if err != nil {
+		return nil, err
+	}
+	if err := checkLinkable(tx, link.PrimaryID, altID, 0); err != nil {
+		return nil, err
+	}
+
+	if err := tx.QueryRow("SELECT COUNT(*) FROM uploads WHERE discord_id = ? AND deleted_at IS NULL", altID).Scan(&link.Uploads); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pulls WHERE discord_id = ?", altID).Scan(&link.Pulls); err != nil {
+		return nil, err
+	}
+
+	link.Status = LinkMerged
+	if link.Uploads+link.Pulls > approvalThreshold {
+		link.Status = LinkPending
+	}
+	err = tx.QueryRow(
+		`INSERT INTO account_links (primary_id, alt_id, status, uploads, pulls) VALUES (?, ?, ?, ?, ?)
+		RETURNING id, created_at`,
+		link.PrimaryID, altID, link.Status, link.Uploads, link.Pulls,
+	).Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := linkUsernames(tx, link); err != nil {
+		return nil, err
+	}
+	if link.Status == LinkMerged {
+		now := time.Now().UTC()
+		if _, err := tx.Exec("UPDATE account_links SET resolved_at = ? WHERE id = ?", now.Format(timestampFormat), link.ID); err != nil {
+			return nil, err
+		}
+		if err := mergeAccounts(tx, link.PrimaryID, altID, now); err != nil {
+			return nil, err
+		}
+		link.ResolvedAt = sql.NullTime{Time: now, Valid: true}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if link.Status == LinkMerged {
+		forgetMerged(link.PrimaryID, altID)
+	}
+	return link, nil
+}
+
+// ResolveLink approves or rejects a pending link on behalf of an admin,
+// merging the accounts when approving. It returns sql.ErrNoRows if there is
+// no such pending link, and the errors of LinkAccount if the accounts can no
+// longer be linked.
+func ResolveLink(ctx context.Context, id int64, approve bool, adminID string) (*AccountLink, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	status := LinkRejected
+	if approve {
+		status = LinkMerged
+	}
+	now := time.Now().UTC()
+	link := &AccountLink{ID: id}
+	err = tx.QueryRow(
+		`UPDATE account_links SET status = ?, resolved_at = ?, resolved_by = ? WHERE id = ? AND status = ?
+		RETURNING primary_id, alt_id, status, uploads, pulls, created_at, resolved_at, resolved_by`,
+		status, now.Format(timestampFormat), adminID, id, LinkPending,
+	).Scan(&link.PrimaryID, &link.AltID, &link.Status, &link.Uploads, &link.Pulls, &link.CreatedAt, &link.ResolvedAt, &link.ResolvedBy)
+	if err != nil {
+		return nil, err
+	}
+	if err := linkUsernames(tx, link); err != nil {
+		return nil, err
+	}
+	if approve {
+		// The pending link itself doesn't stand in the way
+		if err := checkLinkable(tx, link.PrimaryID, link.AltID, link.ID); err != nil {
+			return nil, err
+		}
+		if err := mergeAccounts(tx, link.PrimaryID, link.AltID, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if approve {
+		forgetMerged(link.PrimaryID, link.AltID)
+	}
+	return link, nil
+}
+
+// linkUsernames fills in the usernames of a link's accounts
+func linkUsernames(tx *Tx, link *AccountLink) error {
+	return tx.QueryRow(
+		`SELECT COALESCE((SELECT username FROM users WHERE discord_id = ?), ''), COALESCE((SELECT username FROM users WHERE discord_id = ?), '')`,
+		link.PrimaryID, link.AltID,
+	).Scan(&link.PrimaryUsername, &link.AltUsername)
+}
+
+// checkLinkable returns an error if altID can't be linked to primaryID:
+// accounts are linked one level deep, and an alt to only one primary account.
+// The link with ID except, if any, is left out of the check.
+func checkLinkable(tx *Tx, primaryID, altID string, except int64) error {
+	if primaryID == altID {
+		return ErrLinkSelf
+	}
+
+	var n int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM account_links WHERE alt_id = ? AND status <> ? AND id <> ?",
+		primaryID, LinkRejected, except,
+	).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrPrimaryLinked
+	}
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM account_links WHERE alt_id = ? AND status <> ? AND id <> ?",
+		altID, LinkRejected, except,
+	).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrAltLinked
+	}
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM account_links WHERE primary_id = ? AND status <> ?",
+		altID, LinkRejected,
+	).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrAltHasLinks
+	}
+	return nil
+}
+
+// mergeAccounts moves the alt's uploads, pulls, ledgers and other records to
+// the primary account and points the alt at it. Likes, wishlist entries and
+// rarity votes both accounts have are kept once; the alt's showcase and API
+// tokens are deleted and its pending trades cancelled. The alt's sessions are
+// revoked, so it signs in to the primary account from now on.
+func mergeAccounts(tx *Tx, primaryID, altID string, now time.Time) error {
+	stamp := now.Format(timestampFormat)
+
+	// Likes both accounts gave would be counted twice
+	if _, err := tx.Exec(
+		`UPDATE uploads SET like_count = like_count - 1
+		WHERE id IN (SELECT upload_id FROM likes WHERE discord_id = ?) AND id IN (SELECT upload_id FROM likes WHERE discord_id = ?) AND like_count > 0`,
+		altID, primaryID,
+	); err != nil {
+		return err
+	}
+	for _, table := range []string{"likes", "wishlists", "rarity_votes"} {
+		if _, err := tx.Exec(
+			"DELETE FROM "+table+" WHERE discord_id = ? AND upload_id IN (SELECT upload_id FROM "+table+" WHERE discord_id = ?)",
+			altID, primaryID,
+		); err != nil {
+			return err
+		}
+	}
+
+	// Reroll entries are unique per reason and reference, as for
+	// achievements both accounts earned; the alt's are kept under a
+	// reference of their own so the balance adds up
+	if _, err := tx.Exec(
+		`UPDATE reroll_ledger SET reference = reference || ?
+		WHERE discord_id = ? AND EXISTS (
+			SELECT 1 FROM reroll_ledger p WHERE p.discord_id = ? AND p.reason = reroll_ledger.reason AND p.reference = reroll_ledger.reference
+		)`,
+		" (linked "+altID+")", altID, primaryID,
+	); err != nil {
+		return err
+	}
+	// Likewise for rewards both accounts earned, such as the same day's
+	// daily login
+	if _, err := tx.Exec(
+		`UPDATE wallet_ledger SET reference = reference || ?
+		WHERE discord_id = ? AND type = ? AND EXISTS (
+			SELECT 1 FROM wallet_ledger p WHERE p.discord_id = ? AND p.type = wallet_ledger.type AND p.reason = wallet_ledger.reason AND p.reference = wallet_ledger.reference
+		)`,
+		" (linked "+altID+")", altID, WalletReward, primaryID,
+	); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"uploads", "pulls", "dust_ledger", "reroll_ledger", "wallet_ledger", "likes", "wishlists", "rarity_votes", "notifications", "drafts", "upload_sessions"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET discord_id = ? WHERE discord_id = ?", primaryID, altID); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"showcases", "api_tokens"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE discord_id = ?", altID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO user_guilds (discord_id, guild_id) SELECT ?, guild_id FROM user_guilds WHERE discord_id = ? ON CONFLICT DO NOTHING",
+		primaryID, altID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"UPDATE trades SET status = ?, resolved_at = ? WHERE (sender_id = ? OR recipient_id = ?) AND status = ?",
+		TradeCancelled, stamp, altID, altID, TradePending,
+	); err != nil {
+		return err
+	}
+
+	// The upload cooldown runs from the later of the two accounts' uploads
+	if _, err := tx.Exec(
+		`UPDATE users SET last_upload_at = (SELECT last_upload_at FROM users WHERE discord_id = ?)
+		WHERE discord_id = ? AND (last_upload_at IS NULL OR last_upload_at < (SELECT last_upload_at FROM users WHERE discord_id = ?))`,
+		altID, primaryID, altID,
+	); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE users SET linked_to = ?, sessions_revoked_at = ? WHERE discord_id = ?", primaryID, stamp, altID)
+	return err
+}
+
+// forgetMerged drops the cached state of two accounts that were merged
+func forgetMerged(primaryID, altID string) {
+	forgetUser(primaryID)
+	forgetUser(altID)
+	forgetPools()
+}
+
+const linkSelect = `SELECT l.id, l.primary_id, COALESCE(p.username, ''), l.alt_id, COALESCE(a.username, ''), l.status,
+	l.uploads, l.pulls, l.created_at, l.resolved_at, l.resolved_by
+	FROM account_links l LEFT JOIN users p ON p.discord_id = l.primary_id LEFT JOIN users a ON a.discord_id = l.alt_id`
+
+// ListLinks returns links with the given status, oldest first, along with
+// the total number of links with that status
+func ListLinks(ctx context.Context, status string, limit, offset int) ([]AccountLink, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM account_links WHERE status = ?", status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	links, err := queryLinks(ctx, linkSelect+" WHERE l.status = ? ORDER BY l.created_at, l.id LIMIT ? OFFSET ?", status, limit, offset)
+	return links, total, err
+}
+
+// ListUserLinks returns the links made to the user's account, whatever their
+// status, newest first
+func ListUserLinks(ctx context.Context, discordID string) ([]AccountLink, error) {
+	return queryLinks(ctx, linkSelect+" WHERE l.primary_id = ? ORDER BY l.created_at DESC, l.id DESC", discordID)
+}
+
+func queryLinks(ctx context.Context, query string, args ...interface{}) ([]AccountLink, error) {
+	rows, err := DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []AccountLink{}
+	for rows.Next() {
+		var l AccountLink
+		if err := rows.Scan(&l.ID, &l.PrimaryID, &l.PrimaryUsername, &l.AltID, &l.AltUsername, &l.Status,
+			&l.Uploads, &l.Pulls, &l.CreatedAt, &l.ResolvedAt, &l.ResolvedBy); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// MaintenanceOverride is the maintenance mode an admin set at runtime in
+// place of the one in the config. There is at most one.
+type MaintenanceOverride struct {
+	Enabled   bool
+	Message   string
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// GetMaintenanceOverride returns the maintenance mode set at runtime, or nil
+// when the config's applies
+func GetMaintenanceOverride(ctx context.Context) (*MaintenanceOverride, error) {
+	var o MaintenanceOverride
+	var enabled int
+	err := DB.QueryRow(ctx, "SELECT enabled, message, updated_by, updated_at FROM maintenance_mode WHERE id = 1").
+		Scan(&enabled, &o.Message, &o.UpdatedBy, &o.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	o.Enabled = enabled != 0
+	return &o, nil
+}
+
+// SetMaintenanceOverride stores the maintenance mode set at runtime. A nil
+// enabled removes it, going back to the config.
+func SetMaintenanceOverride(ctx context.Context, enabled *bool, message, updatedBy string) error {
+	if enabled == nil {
+		_, err := DB.Exec(ctx, "DELETE FROM maintenance_mode WHERE id = 1")
+		return err
+	}
+	flag := 0
+	if *enabled {
+		flag = 1
+	}
+	_, err := DB.Exec(
+		ctx, `INSERT INTO maintenance_mode (id, enabled, message, updated_by) VALUES (1, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET enabled = excluded.enabled, message = excluded.message,
+		updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		flag, message, updatedBy,
+	)
+	return err
+}
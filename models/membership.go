@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// MembershipCheck is a user whose guild membership can be re-verified with a
+// stored refresh token
+type MembershipCheck struct {
+	DiscordID    string
+	Username     string
+	RefreshToken string
+}
+
+// SetGuildVerified stores the user's sealed refresh token and records that
+// their guild membership was just confirmed
+func SetGuildVerified(ctx context.Context, discordID, sealedRefreshToken string) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE users SET refresh_token = ?, guild_verified_at = CURRENT_TIMESTAMP WHERE discord_id = ?",
+		sealedRefreshToken, discordID,
+	)
+	return err
+}
+
+// RecentUserGuilds returns the allowed guilds the user was seen in when their
+// membership was last confirmed, if that was after since. It returns none
+// when the membership wasn't confirmed since then.
+func RecentUserGuilds(ctx context.Context, discordID string, since time.Time) ([]string, error) {
+	rows, err := DB.Query(
+		ctx, `SELECT ug.guild_id FROM user_guilds ug JOIN users u ON u.discord_id = ug.discord_id
+		WHERE ug.discord_id = ? AND u.guild_verified_at >= ? ORDER BY ug.guild_id`,
+		discordID, since.UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpdateRefreshToken replaces the user's sealed refresh token without marking
+// their membership as confirmed
+func UpdateRefreshToken(ctx context.Context, discordID, sealedRefreshToken string) error {
+	_, err := DB.Exec(ctx, "UPDATE users SET refresh_token = ? WHERE discord_id = ?", sealedRefreshToken, discordID)
+	return err
+}
+
+// UsersDueForGuildCheck returns up to limit users with a stored refresh token
+// whose membership was last confirmed before the given time, stalest first
+func UsersDueForGuildCheck(ctx context.Context, before time.Time, limit int) ([]MembershipCheck, error) {
+	rows, err := DB.Query(
+		ctx, `SELECT discord_id, username, refresh_token FROM users
+		WHERE refresh_token <> '' AND (guild_verified_at IS NULL OR guild_verified_at < ?)
+		ORDER BY guild_verified_at LIMIT ?`,
+		before.UTC().Format(timestampFormat), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checks []MembershipCheck
+	for rows.Next() {
+		var c MembershipCheck
+		if err := rows.Scan(&c.DiscordID, &c.Username, &c.RefreshToken); err != nil {
+			return nil, err
+		}
+		checks = append(checks, c)
+	}
+	return checks, rows.Err()
+}
+
+// RevokeSessions signs the user out everywhere: sessions created up to now
+// stop being accepted, the stored refresh token is dropped and their guild
+// membership has to be confirmed again at the next sign-in
+func RevokeSessions(ctx context.Context, discordID string) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE users SET sessions_revoked_at = ?, refresh_token = '', guild_verified_at = NULL WHERE discord_id = ?",
+		time.Now().UTC().Format(timestampFormat), discordID,
+	)
+	return err
+}
+
+// SessionRevoked reports whether a session that signed in at loginAt has
+// since been revoked
+func SessionRevoked(ctx context.Context, discordID string, loginAt time.Time) (bool, error) {
+	var revokedAt sql.NullTime
+	err := DB.QueryRow(ctx, "SELECT sessions_revoked_at FROM users WHERE discord_id = ?", discordID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// Timestamps have one-second resolution, so a login in the same second
+	// as the revocation counts as revoked
+	return revokedAt.Valid && !loginAt.After(revokedAt.Time), nil
+}
+
+// SetUserGuilds replaces the allowed guilds the user was last seen in
+func SetUserGuilds(ctx context.Context, discordID string, guildIDs []string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_guilds WHERE discord_id = ?", discordID); err != nil {
+		return err
+	}
+	for _, id := range guildIDs {
+		if _, err := tx.Exec("INSERT INTO user_guilds (discord_id, guild_id) VALUES (?, ?)", discordID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UserGuilds returns the allowed guilds the user was last seen in
+func UserGuilds(ctx context.Context, discordID string) ([]string, error) {
+	rows, err := DB.Query(ctx, "SELECT guild_id FROM user_guilds WHERE discord_id = ? ORDER BY guild_id", discordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GuildMemberIDs returns the users last seen in the guild
+func GuildMemberIDs(ctx context.Context, guildID string) ([]string, error) {
+	rows, err := DB.Query(ctx, "SELECT discord_id FROM user_guilds WHERE guild_id = ? ORDER BY discord_id", guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
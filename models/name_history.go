@@ -0,0 +1,38 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// PastName is a name a user had until they renamed themselves with their
+// sign-in provider
+type PastName struct {
+	Username    string
+	DisplayName string
+	// ReplacedAt is when the rename was seen, at the user's next sign-in
+	ReplacedAt time.Time
+}
+
+// ListPastNames returns the names the user has gone by before their current
+// one, most recent first
+func ListPastNames(ctx context.Context, discordID string) ([]PastName, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT username, display_name, replaced_at FROM username_history WHERE discord_id = ? ORDER BY id DESC",
+		discordID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []PastName{}
+	for rows.Next() {
+		var n PastName
+		if err := rows.Scan(&n.Username, &n.DisplayName, &n.ReplacedAt); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	return names, rows.Err()
+}
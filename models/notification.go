@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Kinds of notification
+const (
+	NotificationUploadApproved = "upload_approved"
+	NotificationUploadRejected = "upload_rejected"
+	NotificationUploadLiked    = "upload_liked"
+	NotificationTradeReceived  = "trade_received"
+	NotificationLegendaryPull  = "legendary_pull"
+	NotificationBannerEnding   = "banner_ending"
+)
+
+// Notification tells a user about something that happened to them while
+// they may not have been looking. UploadID and TradeID point at what it is
+// about, when there is one.
+type Notification struct {
+	ID        int64
+	DiscordID string
+	Type      string
+	Message   string
+	UploadID  sql.NullInt64
+	TradeID   sql.NullInt64
+	CreatedAt time.Time
+	ReadAt    sql.NullTime
+}
+
+const notificationColumns = `id, discord_id, type, message, upload_id, trade_id, created_at, read_at`
+
+func scanNotification(row rowScanner) (*Notification, error) {
+	n := &Notification{}
+	err := row.Scan(&n.ID, &n.DiscordID, &n.Type, &n.Message, &n.UploadID, &n.TradeID, &n.CreatedAt, &n.ReadAt)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// CreateNotification records an unread notification and sets its ID and
+// creation time
+func CreateNotification(ctx context.Context, n *Notification) error {
+	return DB.QueryRow(
+		ctx, `INSERT INTO notifications (discord_id, type, message, upload_id, trade_id)
+		VALUES (?, ?, ?, ?, ?) RETURNING id, created_at`,
+		n.DiscordID, n.Type, n.Message, n.UploadID, n.TradeID,
+	).Scan(&n.ID, &n.CreatedAt)
+}
+
+// ListNotifications returns a page of the user's notifications, newest
+// first, along with the total number. With unreadOnly set it lists only
+// those not yet marked as read.
+func ListNotifications(ctx context.Context, discordID string, unreadOnly bool, limit, offset int) ([]*Notification, int, error) {
+	where := " WHERE discord_id = ?"
+	if unreadOnly {
+		where += " AND read_at IS NULL"
+	}
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM notifications"+where, discordID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(ctx, "SELECT "+notificationColumns+" FROM notifications"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", discordID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	notifications := []*Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, total, rows.Err()
+}
+
+// CountUnreadNotifications returns how many of the user's notifications
+// haven't been marked as read
+func CountUnreadNotifications(ctx context.Context, discordID string) (int, error) {
+	var count int
+	err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM notifications WHERE discord_id = ? AND read_at IS NULL", discordID).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationRead marks one of the user's notifications as read.
+// Marking it again changes nothing. It returns sql.ErrNoRows if the user has
+// no such notification.
+func MarkNotificationRead(ctx context.Context, id int64, discordID string) error {
+	result, err := DB.Exec(
+		ctx, "UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP) WHERE id = ? AND discord_id = ?",
+		id, discordID,
+	)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user as
+// read, returning how many there were
+func MarkAllNotificationsRead(ctx context.Context, discordID string) (int64, error) {
+	result, err := DB.Exec(ctx, "UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE discord_id = ? AND read_at IS NULL", discordID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteNotificationsBefore deletes notifications, read or not, created
+// before cutoff, returning how many were deleted
+func DeleteNotificationsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := DB.Exec(ctx, "DELETE FROM notifications WHERE created_at < ?", cutoff.UTC().Format(timestampFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
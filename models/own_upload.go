@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Where an upload stands, as its uploader sees it
+const (
+	// UploadPublished uploads are listed and can be pulled, subject to their
+	// visibility
+	UploadPublished = "published"
+	// UploadPending uploads wait for their content safety check
+	UploadPending = "pending"
+	// UploadHidden uploads were frozen or hidden by reports until reviewed
+	UploadHidden = "hidden"
+	// UploadRejected uploads were moved to the trash by a moderator
+	UploadRejected = "rejected"
+	// UploadDeleted uploads were moved to the trash by their uploader
+	UploadDeleted = "deleted"
+)
+
+// UploadStatuses lists the valid upload statuses
+var UploadStatuses = []string{UploadPublished, UploadPending, UploadHidden, UploadRejected, UploadDeleted}
+
+// rejectedCondition matches trashed uploads u that were trashed by being
+// rejected, rather than by their uploader
+const rejectedCondition = `u.deleted_at IS NOT NULL AND (u.safety_status = '` + SafetyRejected + `'
+	OR EXISTS (SELECT 1 FROM upload_rejections r WHERE r.upload_id = u.id AND r.created_at >= u.deleted_at))`
+
+// uploadStatusConditions matches the uploads u of each status
+var uploadStatusConditions = map[string]string{
+	UploadPublished: "u.deleted_at IS NULL AND u.frozen = 0 AND u.report_hidden = 0 AND u.safety_status <> '" + SafetyPending + "'",
+	UploadPending:   "u.deleted_at IS NULL AND u.safety_status = '" + SafetyPending + "'",
+	UploadHidden:    "u.deleted_at IS NULL AND u.safety_status <> '" + SafetyPending + "' AND (u.frozen = 1 OR u.report_hidden = 1)",
+	UploadRejected:  rejectedCondition,
+	UploadDeleted:   "u.deleted_at IS NOT NULL AND NOT (" + rejectedCondition + ")",
+}
+
+// OwnUploadStatus returns the status of an upload, given its rejections
+// oldest first
+func OwnUploadStatus(u *Upload, rejections []Rejection) string {
+	switch {
+	case u.DeletedAt.Valid:
+		if u.SafetyStatus == SafetyRejected {
+			return UploadRejected
+		}
+		if n := len(rejections); n > 0 && !rejections[n-1].CreatedAt.Before(u.DeletedAt.Time) {
+			return UploadRejected
+		}
+		return UploadDeleted
+	case u.SafetyStatus == SafetyPending:
+		return UploadPending
+	case u.Frozen || u.ReportHidden:
+		return UploadHidden
+	}
+	return UploadPublished
+}
+
+// ListOwnUploads returns a page of the user's uploads in every guild,
+// newest first, along with the total number. Unlike the gallery it includes
+// hidden, private and trashed uploads, so uploaders can see what happened to
+// each of them. A status narrows it to uploads with that status.
+func ListOwnUploads(ctx context.Context, discordID, status string, limit, offset int) ([]Upload, int, error) {
+	where := " WHERE u.discord_id = ?"
+	if status != "" {
+		cond, ok := uploadStatusConditions[status]
+		if !ok {
+			return nil, 0, errors.New("status must be one of: " + strings.Join(UploadStatuses, ", "))
+		}
+		where += " AND " + cond
+	}
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads u"+where, discordID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	uploads, err := queryUploads(
+		ctx, uploadSelect+where+" ORDER BY u.uploaded_at DESC, u.id DESC LIMIT ? OFFSET ?",
+		discordID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return uploads, total, nil
+}
+
+// EditUpload replaces the title, description and tags of an upload that
+// isn't in the trash, returning sql.ErrNoRows if there is no such upload
+func EditUpload(ctx context.Context, id int64, title, description string, tags []string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE uploads SET title = ?, description = ? WHERE id = ? AND deleted_at IS NULL", title, description, id)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+	if err := replaceUploadTags(tx, id, tags); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetTags()
+
+	return IndexUpload(ctx, id)
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Color is an RGB color a listing can be narrowed to
+type Color struct {
+	R, G, B int
+}
+
+// ParseColor reads a six-digit hex color such as "2b2d42", with or without a
+// leading "#"
+func ParseColor(s string) (*Color, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) != 6 {
+		return nil, errors.New("color must be a six-digit hex color such as 2b2d42")
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, errors.New("color must be a six-digit hex color such as 2b2d42")
+	}
+	return &Color{R: int(v >> 16), G: int(v >> 8 & 0xFF), B: int(v & 0xFF)}, nil
+}
+
+// colorCondition matches uploads u with a palette color within a Euclidean
+// RGB distance of the color bound to its placeholders (each channel twice,
+// then the squared distance)
+const colorCondition = `EXISTS (SELECT 1 FROM upload_colors uc WHERE uc.upload_id = u.id
+	AND (uc.r - ?) * (uc.r - ?) + (uc.g - ?) * (uc.g - ?) + (uc.b - ?) * (uc.b - ?) <= ?)`
+
+// SetUploadPalette stores the dominant colors of an upload, most common
+// first, replacing any it had
+func SetUploadPalette(ctx context.Context, id int64, palette []string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE uploads SET palette = ? WHERE id = ?", strings.Join(palette, ","), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM upload_colors WHERE upload_id = ?", id); err != nil {
+		return err
+	}
+	for rank, hex := range palette {
+		c, err := ParseColor(hex)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO upload_colors (upload_id, rank, r, g, b) VALUES (?, ?, ?, ?, ?)",
+			id, rank, c.R, c.G, c.B,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UploadsMissingPalette returns the IDs and stored filenames of uploads
+// recorded before palettes were extracted
+func UploadsMissingPalette(ctx context.Context) (map[int64]string, error) {
+	rows, err := DB.Query(ctx, "SELECT id, filename FROM uploads WHERE palette = '' AND deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			return nil, err
+		}
+		uploads[id] = filename
+	}
+	return uploads, rows.Err()
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+)
+
+type SimilarUpload struct {
+	UploadID int64
+	Distance int
+}
+
+// phashBands is how many bytes of a perceptual hash are indexed on their own
+// (see the idx_uploads_phash_b* indexes). Hashes fewer than phashBands bits
+// apart agree on at least one byte, so lookups only compare the uploads
+// sharing a byte with the hash instead of every upload.
+const phashBands = 8
+
+// phashCondition returns the condition selecting the uploads that may be
+// within maxDistance bits of hash, with its arguments. Distances too large
+// for the bands to rule anything out compare every hashed upload.
+func phashCondition(hash uint64, maxDistance int) (string, []interface{}) {
+	if maxDistance >= phashBands {
+		return "phash IS NOT NULL", nil
+	}
+	bands := make([]string, phashBands)
+	args := make([]interface{}, phashBands)
+	for i := range bands {
+		bands[i] = fmt.Sprintf("((phash >> %d) & 255) = ?", 8*i)
+		args[i] = int64(hash>>(8*i)) & 255
+	}
+	return "phash IS NOT NULL AND (" + strings.Join(bands, " OR ") + ")", args
+}
+
+// FindSimilarUpload returns the guild's upload outside the trash whose
+// perceptual hash is closest to hash, or nil if none is within maxDistance
+// bits
+func FindSimilarUpload(ctx context.Context, hash uint64, maxDistance int, guildID string) (*SimilarUpload, error) {
+	where, args := phashCondition(hash, maxDistance)
+	rows, err := DB.Query(ctx, "SELECT id, phash FROM uploads WHERE "+where+" AND deleted_at IS NULL AND guild_id = ?", append(args, guildID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var best *SimilarUpload
+	for rows.Next() {
+		var id, stored int64
+		if err := rows.Scan(&id, &stored); err != nil {
+			return nil, err
+		}
+
+		distance := imaging.HammingDistance(hash, uint64(stored))
+		if distance > maxDistance {
+			continue
+		}
+		if best == nil || distance < best.Distance {
+			best = &SimilarUpload{UploadID: id, Distance: distance}
+		}
+	}
+
+	return best, rows.Err()
+}
+
+// FindIdenticalUpload returns the ID of the guild's oldest upload outside the
+// trash whose file has the given SHA-256, or was transcoded from a file that
+// had, or 0 if there is none
+func FindIdenticalUpload(ctx context.Context, sha256, guildID string) (int64, error) {
+	var id int64
+	err := DB.QueryRow(
+		ctx, `SELECT id FROM uploads WHERE (sha256 = ? OR sha256 IN (SELECT sha256 FROM blobs WHERE transcoded_from = ?))
+		AND deleted_at IS NULL AND guild_id = ? ORDER BY id LIMIT 1`,
+		sha256, sha256, guildID,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// FindSimilarUploads returns up to limit other uploads of the guild outside
+// the trash whose perceptual hash is within maxDistance of hash, closest
+// first
+func FindSimilarUploads(ctx context.Context, hash uint64, maxDistance int, excludeID int64, guildID string, limit int) ([]SimilarUpload, error) {
+	where, args := phashCondition(hash, maxDistance)
+	rows, err := DB.Query(ctx, "SELECT id, phash FROM uploads WHERE "+where+" AND id <> ? AND deleted_at IS NULL AND guild_id = ?", append(args, excludeID, guildID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []SimilarUpload{}
+	for rows.Next() {
+		var id, stored int64
+		if err := rows.Scan(&id, &stored); err != nil {
+			return nil, err
+		}
+
+		distance := imaging.HammingDistance(hash, uint64(stored))
+		if distance <= maxDistance {
+			matches = append(matches, SimilarUpload{UploadID: id, Distance: distance})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].UploadID < matches[j].UploadID
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+)
+
+// poolUploadCondition matches uploads u that pulls can draw: those that may
+// appear in public listings, unless an admin took them out of the pool
+const poolUploadCondition = visibleUploadCondition + ` AND u.pool_enabled = 1`
+
+// poolTierQuery counts the wallpapers of each rarity in the standard pool of
+// the guild bound to its placeholder, and those admins took out of it
+const poolTierQuery = `SELECT u.rarity,
+	COALESCE(SUM(CASE WHEN u.pool_enabled = 1 THEN 1 ELSE 0 END), 0),
+	COALESCE(SUM(CASE WHEN u.pool_enabled = 0 THEN 1 ELSE 0 END), 0)
+	FROM uploads u WHERE ` + visibleUploadCondition + ` AND u.archived = 0 AND u.guild_id = ? GROUP BY u.rarity`
+
+// PoolTier is how many wallpapers of a rarity a guild's standard pull pool
+// holds, and how many more admins took out of it
+type PoolTier struct {
+	Rarity   string
+	Pullable int
+	Disabled int
+}
+
+// PoolComposition returns the tiers of the guild's standard pull pool, from
+// most to least common, including the empty ones
+func PoolComposition(ctx context.Context, guildID string) ([]PoolTier, error) {
+	rows, err := DB.Query(ctx, poolTierQuery, guildID)
+	if err != nil {
+		return nil, err
+	}
+	return scanPoolTiers(rows)
+}
+
+func scanPoolTiers(rows *Rows) ([]PoolTier, error) {
+	defer rows.Close()
+	tiers := make([]PoolTier, len(Rarities))
+	for i, r := range Rarities {
+		tiers[i].Rarity = r
+	}
+	for rows.Next() {
+		var t PoolTier
+		if err := rows.Scan(&t.Rarity, &t.Pullable, &t.Disabled); err != nil {
+			return nil, err
+		}
+		if i := slices.Index(Rarities, t.Rarity); i >= 0 {
+			tiers[i] = t
+		}
+	}
+	return tiers, rows.Err()
+}
+
+// ListPoolTier returns a page of the wallpapers of a rarity in the guild's
+// standard pull pool, taken out of it or not, oldest first, along with the
+// total number
+func ListPoolTier(ctx context.Context, guildID, rarity string, limit, offset int) ([]Upload, int, error) {
+	const where = visibleUploadCondition + ` AND u.archived = 0 AND u.guild_id = ? AND u.rarity = ?`
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads u WHERE "+where, guildID, rarity).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	uploads, err := queryUploads(ctx, uploadSelect+" WHERE "+where+" ORDER BY u.id LIMIT ? OFFSET ?", guildID, rarity, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return uploads, total, nil
+}
+
+// PoolChange is what UpdatePoolUploads changes: the rarity, unless empty,
+// and whether pulls can draw the uploads, unless Enabled is nil
+type PoolChange struct {
+	Rarity  string
+	Enabled *bool
+}
+
+// EmptyTierError is returned by UpdatePoolUploads for a change that would
+// leave a tier with a drop rate without wallpapers in a guild's pool, so
+// pulls would never draw it. Rarity is empty when the whole pool would be
+// left empty.
+type EmptyTierError struct {
+	GuildID string
+	Rarity  string
+}
+
+func (e *EmptyTierError) Error() string {
+	if e.Rarity == "" {
+		return fmt.Sprintf("this would leave the pull pool of guild %s empty", e.GuildID)
+	}
+	return fmt.Sprintf("this would leave no %s wallpapers in the pull pool of guild %s", e.Rarity, e.GuildID)
+}
+
+// UpdatePoolUploads applies a change to each upload in one transaction,
+// reporting uploads that don't exist or are in the trash and leaving them
+// alone, as BulkModerate does. Moving an upload to a rarity ends its rarity
+// vote. Unless force is set, a change that would empty a tier of a guild's
+// standard pool that had wallpapers and has a rate in rates is refused with
+// an *EmptyTierError, as is one that would empty the whole pool.
+func UpdatePoolUploads(ctx context.Context, ids []int64, change PoolChange, rates map[string]float64, force bool) ([]BulkResult, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]BulkResult, 0, len(ids))
+	before := make(map[string][]PoolTier)
+	for _, id := range ids {
+		var deleted bool
+		var guildID string
+		err := tx.QueryRow("SELECT deleted_at IS NOT NULL, guild_id FROM uploads WHERE id = ?", id).Scan(&deleted, &guildID)
+		if err == sql.ErrNoRows {
+			results = append(results, BulkResult{UploadID: id, Status: BulkNotFound})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if deleted {
+			results = append(results, BulkResult{UploadID: id, Status: BulkSkipped, Reason: "upload is in the trash"})
+			continue
+		}
+
+		if _, ok := before[guildID]; !ok {
+			if before[guildID], err = txPoolComposition(tx, guildID); err != nil {
+				return nil, err
+			}
+		}
+		if change.Rarity != "" {
+			if _, err := tx.Exec("UPDATE uploads SET rarity = ?, rarity_voting_ends_at = NULL WHERE id = ?", change.Rarity, id); err != nil {
+				return nil, err
+			}
+		}
+		if change.Enabled != nil {
+			enabled := 0
+			if *change.Enabled {
+				enabled = 1
+			}
+			if _, err := tx.Exec("UPDATE uploads SET pool_enabled = ? WHERE id = ?", enabled, id); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, BulkResult{UploadID: id, Status: BulkDone})
+	}
+
+	if !force {
+		for guildID, tiers := range before {
+			after, err := txPoolComposition(tx, guildID)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkPoolTiers(guildID, tiers, after, rates); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	forgetPools()
+	return results, nil
+}
+
+func txPoolComposition(tx *Tx, guildID string) ([]PoolTier, error) {
+	rows, err := tx.Query(poolTierQuery, guildID)
+	if err != nil {
+		return nil, err
+	}
+	return scanPoolTiers(rows)
+}
+
+// checkPoolTiers returns an *EmptyTierError if a guild's pool went from
+// before to after by emptying a tier pulls draw from, or the whole pool
+func checkPoolTiers(guildID string, before, after []PoolTier, rates map[string]float64) error {
+	var had, has int
+	for i := range before {
+		had += before[i].Pullable
+		has += after[i].Pullable
+		if rates[before[i].Rarity] > 0 && before[i].Pullable > 0 && after[i].Pullable == 0 {
+			return &EmptyTierError{GuildID: guildID, Rarity: before[i].Rarity}
+		}
+	}
+	if had > 0 && has == 0 {
+		return &EmptyTierError{GuildID: guildID}
+	}
+	return nil
+}
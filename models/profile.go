@@ -0,0 +1,38 @@
+package models
+
+import "context"
+
+// SetProfilePrivate hides or shows the user's profile to other users
+func (u *User) SetProfilePrivate(ctx context.Context, private bool) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE users SET profile_private = ? WHERE discord_id = ?",
+		private, u.DiscordID,
+	)
+	if err == nil {
+		forgetUser(u.DiscordID)
+		u.ProfilePrivate = private
+	}
+	return err
+}
+
+// SetDiscordDMs opts the user in to or out of notifications by direct
+// message from the Discord bot
+func (u *User) SetDiscordDMs(ctx context.Context, enabled bool) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE users SET discord_dms = ? WHERE discord_id = ?",
+		enabled, u.DiscordID,
+	)
+	if err == nil {
+		forgetUser(u.DiscordID)
+		u.DiscordDMs = enabled
+	}
+	return err
+}
+
+// CountPoolUploads returns how many wallpapers can currently be pulled in the
+// guild, or in every guild when guildID is empty
+func CountPoolUploads(ctx context.Context, guildID string) (int, error) {
+	var count int
+	err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads u WHERE "+poolUploadCondition+" AND (? = '' OR u.guild_id = ?)", guildID, guildID).Scan(&count)
+	return count, err
+}
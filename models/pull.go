@@ -0,0 +1,445 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where a pull was made
+const (
+	PullSourceWeb     = "web"
+	PullSourceDiscord = "discord"
+	// PullSourceReroll marks a redraw paid for with a reroll token; it does
+	// not count against the daily pull allowance
+	PullSourceReroll = "reroll"
+	// PullSourceTrade marks a copy received in a trade; it is not a draw and
+	// does not count as a pull
+	PullSourceTrade = "trade"
+	// PullSourceDust marks a wallpaper bought with dust; it does not count
+	// against the daily pull allowance
+	PullSourceDust = "dust"
+)
+
+// Pull is one wallpaper drawn by a user. Duplicate is set when the user
+// already had the wallpaper in their collection. Discarded pulls were
+// rerolled, traded away or converted to dust and no longer count towards
+// the collection. Dust is set on a pull just converted, to the amount it
+// earned, and Wishlisted on one that drew a wallpaper off the user's
+// wishlist. RevealAt is set on a pull held back for the user to reveal,
+// until they do or that time passes; until then it is left out of their pull
+// history and collection.
+type Pull struct {
+	ID           int64
+	DiscordID    string
+	UploadID     int64
+	Source       string
+	Duplicate    bool
+	Discarded    bool
+	RerolledFrom sql.NullInt64
+	BannerID     sql.NullInt64
+	PulledAt     time.Time
+	RevealAt     sql.NullTime
+	Dust         int
+	Wishlisted   bool
+}
+
+// CollectionEntry is a wallpaper in a user's collection
+type CollectionEntry struct {
+	Upload        Upload
+	Copies        int
+	FirstPulledAt time.Time
+}
+
+// A liked wallpaper is drawn at most this many times as often as one without
+// likes, however many likes it gets
+const maxPullWeight = 5
+
+// PoolWeights sets how likely each upload is to be drawn, relative to 1 for
+// an upload without likes. Each like adds Like, up to maxPullWeight. Uploads
+// on the wishlist of the user named by Wishlist are then multiplied by
+// WishlistRateUp, and those featured by the banner with ID Banner by
+// BannerRateUp. A non-empty DeviceClass leaves uploads of any other class out
+// of the pool altogether, and a non-empty Guild those of any other guild.
+// Archive draws from the archive pool of out-of-season wallpapers (see
+// Season) instead of the standard pool.
+type PoolWeights struct {
+	Guild          string
+	Archive        bool
+	Like           float64
+	Wishlist       string
+	WishlistRateUp float64
+	Banner         int64
+	BannerRateUp   float64
+	DeviceClass    string
+	// RarityRates sets how likely each tier is to be drawn; a wallpaper is
+	// then drawn from the tier by the weights above
+	RarityRates map[string]float64
+}
+
+// RandomPoolUpload returns a random upload from those that may appear in
+// public listings, other than the excluded ones, weighted by w, or
+// sql.ErrNoRows when there are none. The draw's rolls decide it, and the
+// draw is filled in with where it landed.
+func RandomPoolUpload(ctx context.Context, w PoolWeights, d *Draw, exclude ...int64) (*Upload, error) {
+	where := poolUploadCondition
+	var args []interface{}
+	if len(exclude) > 0 {
+		placeholders := make([]string, len(exclude))
+		for i, id := range exclude {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		where += " AND u.id NOT IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	if w.Guild != "" {
+		where += " AND u.guild_id = ?"
+		args = append(args, w.Guild)
+	}
+	if w.Archive {
+		where += " AND u.archived = 1"
+	} else {
+		where += " AND u.archived = 0"
+	}
+	if w.DeviceClass != "" {
+		where += " AND " + deviceClassCondition(w.DeviceClass)
+	}
+	rarityRoll, pickRoll := d.rolls()
+	rarity, tiers, err := drawRarity(ctx, w.RarityRates, where, args, rarityRoll)
+	if err != nil {
+		return nil, err
+	}
+	d.Tiers, d.Rarity = tiers, rarity
+	if rarity != "" {
+		where += " AND u.rarity = ?"
+		args = append(args, rarity)
+	}
+
+	// Walk the running total of weights to a random point along it
+	weight := `(CASE WHEN 1 + u.like_count * CAST(? AS DOUBLE PRECISION) > ` + strconv.Itoa(maxPullWeight) + `
+		THEN ` + strconv.Itoa(maxPullWeight) + ` ELSE 1 + u.like_count * CAST(? AS DOUBLE PRECISION) END)
+		* (CASE WHEN EXISTS (SELECT 1 FROM wishlists wl WHERE wl.discord_id = ? AND wl.upload_id = u.id)
+		THEN CAST(? AS DOUBLE PRECISION) ELSE 1 END)
+		* (CASE WHEN ` + bannerFeaturedCondition + ` THEN CAST(? AS DOUBLE PRECISION) ELSE 1 END)`
+	query := `WITH pool AS (SELECT u.id, ` + weight + ` AS weight FROM uploads u WHERE ` + where + `)
+		SELECT id, upto - weight, upto, (SELECT SUM(weight) FROM pool)
+		FROM (SELECT id, weight, SUM(weight) OVER (ORDER BY id) AS upto FROM pool) p
+		WHERE upto > CAST(? AS DOUBLE PRECISION) * (SELECT SUM(weight) FROM pool)
+		ORDER BY upto LIMIT 1`
+	args = append([]interface{}{w.Like, w.Like, w.Wishlist, w.WishlistRateUp, w.Banner, w.Banner, w.BannerRateUp}, args...)
+	args = append(args, pickRoll)
+	if err := DB.QueryRow(ctx, query, args...).Scan(&d.UploadID, &d.Start, &d.End, &d.Total); err != nil {
+		return nil, err
+	}
+
+	u, err := scanUpload(DB.QueryRow(ctx, uploadSelect+" WHERE u.id = ?", d.UploadID))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Tags, err = GetUploadTags(ctx, u.ID); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetPoolUpload returns an upload that may be pulled in the guild, or
+// sql.ErrNoRows if there is no such upload in its pool
+func GetPoolUpload(ctx context.Context, id int64, guildID string) (*Upload, error) {
+	u, err := scanUpload(DB.QueryRow(ctx, uploadSelect+" WHERE u.id = ? AND u.guild_id = ? AND "+poolUploadCondition, id, guildID))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Tags, err = GetUploadTags(ctx, u.ID); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// countedPullCondition selects the pulls that use up the daily allowance
+const countedPullCondition = "source NOT IN ('" + PullSourceReroll + "', '" + PullSourceTrade + "', '" + PullSourceDust + "')"
+
+// drawnPullCondition selects the pulls that drew their wallpaper from a
+// pool, leaving out copies received in trades or bought with dust
+const drawnPullCondition = "source NOT IN ('" + PullSourceTrade + "', '" + PullSourceDust + "')"
+
+// CountUploadPulls returns how many times an upload has been drawn by pulls
+// and rerolls
+func CountUploadPulls(ctx context.Context, uploadID int64) (int, error) {
+	var count int
+	err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM pulls WHERE upload_id = ? AND "+drawnPullCondition, uploadID).Scan(&count)
+	return count, err
+}
+
+// CountPullsSince returns how many pulls the user has made since the given
+// time, not counting rerolls
+func CountPullsSince(ctx context.Context, discordID string, since time.Time) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND pulled_at >= ? AND "+countedPullCondition,
+		discordID, since.UTC().Format(timestampFormat),
+	).Scan(&count)
+	return count, err
+}
+
+// CreatePull records a pull unless the user has already made limit pulls
+// since the given time. Past the limit it spends one of the user's bonus
+// pulls instead, returning sql.ErrNoRows when they have none. A negative
+// limit means no limit. A duplicate is converted into dust, when positive.
+// It sets the pull's ID, duplicate flag and time.
+func CreatePull(ctx context.Context, p *Pull, since time.Time, limit, dust int) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	duplicate, err := markDuplicate(tx, p)
+	if err != nil {
+		return err
+	}
+
+	if limit < 0 {
+		err = tx.QueryRow(
+			`INSERT INTO pulls (discord_id, upload_id, source, duplicate, banner_id, reveal_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id, pulled_at`,
+			p.DiscordID, p.UploadID, p.Source, duplicate, p.BannerID, revealAt(p),
+		).Scan(&p.ID, &p.PulledAt)
+	} else {
+		// Checking the limit in the insert itself keeps concurrent pulls
+		// from overshooting it
+		err = tx.QueryRow(
+			`INSERT INTO pulls (discord_id, upload_id, source, duplicate, banner_id, reveal_at)
+			SELECT ?, ?, ?, ?, ?, ? WHERE (SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND pulled_at >= ? AND `+countedPullCondition+`) < ?
+			RETURNING id, pulled_at`,
+			p.DiscordID, p.UploadID, p.Source, duplicate, p.BannerID, revealAt(p),
+			p.DiscordID, since.UTC().Format(timestampFormat), limit,
+		).Scan(&p.ID, &p.PulledAt)
+		if err == sql.ErrNoRows {
+			err = createBonusPull(tx, p, duplicate)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := claimWishlist(tx, p); err != nil {
+		return err
+	}
+	if err := convertDuplicate(tx, p, dust); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// createBonusPull records a pull paid for with a bonus pull from the user's
+// wallet, returning sql.ErrNoRows if their balance is empty. The caller rolls
+// the transaction back on error, undoing the pull.
+func createBonusPull(tx *Tx, p *Pull, duplicate int) error {
+	err := tx.QueryRow(
+		`INSERT INTO pulls (discord_id, upload_id, source, duplicate, banner_id, reveal_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id, pulled_at`,
+		p.DiscordID, p.UploadID, p.Source, duplicate, p.BannerID, revealAt(p),
+	).Scan(&p.ID, &p.PulledAt)
+	if err != nil {
+		return err
+	}
+
+	var entryID int64
+	return tx.QueryRow(
+		`INSERT INTO wallet_ledger (discord_id, type, amount, reference)
+		SELECT ?, ?, -1, ? WHERE (`+walletBalanceQuery+`) > 0 RETURNING id`,
+		p.DiscordID, WalletPull, fmt.Sprintf("pull:%d", p.ID), p.DiscordID,
+	).Scan(&entryID)
+}
+
+// revealAt returns the pull's reveal time as stored in the database, or nil
+// for a pull that isn't held back
+func revealAt(p *Pull) interface{} {
+	if !p.RevealAt.Valid {
+		return nil
+	}
+	return p.RevealAt.Time.UTC().Format(timestampFormat)
+}
+
+// markDuplicate sets the pull's duplicate flag from the user's collection,
+// returning it as the integer stored in the database
+func markDuplicate(tx *Tx, p *Pull) (int, error) {
+	var owned int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND upload_id = ? AND discarded = 0",
+		p.DiscordID, p.UploadID,
+	).Scan(&owned); err != nil {
+		return 0, err
+	}
+
+	p.Duplicate = owned > 0
+	if p.Duplicate {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+const pullColumns = `id, discord_id, upload_id, source, duplicate, discarded, rerolled_from, banner_id, pulled_at`
+
+func scanPull(row rowScanner) (*Pull, error) {
+	p := &Pull{}
+	err := row.Scan(&p.ID, &p.DiscordID, &p.UploadID, &p.Source, &p.Duplicate, &p.Discarded, &p.RerolledFrom, &p.BannerID, &p.PulledAt)
+	return p, err
+}
+
+// GetPull returns one of the user's pulls, or sql.ErrNoRows if they have no
+// pull with that ID
+func GetPull(ctx context.Context, id int64, discordID string) (*Pull, error) {
+	return scanPull(DB.QueryRow(ctx, "SELECT "+pullColumns+" FROM pulls WHERE id = ? AND discord_id = ?", id, discordID))
+}
+
+// ClaimPullReveal marks a pull held back for the user to reveal as revealed.
+// It reports whether the pull was still held back, so of concurrent callers
+// exactly one gets true.
+func ClaimPullReveal(ctx context.Context, id int64) (bool, error) {
+	res, err := DB.Exec(ctx, "UPDATE pulls SET reveal_at = NULL WHERE id = ? AND reveal_at IS NOT NULL", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// PullRevealsDue returns the pulls still held back for their users to reveal
+// whose reveal time has passed at the given time, oldest first
+func PullRevealsDue(ctx context.Context, at time.Time) ([]*Pull, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT "+pullColumns+" FROM pulls WHERE reveal_at <= ? ORDER BY reveal_at, id",
+		at.UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pulls []*Pull
+	for rows.Next() {
+		p, err := scanPull(rows)
+		if err != nil {
+			return nil, err
+		}
+		pulls = append(pulls, p)
+	}
+	return pulls, rows.Err()
+}
+
+// PullStats returns how many pulls the user has made, not counting rerolls,
+// and how many distinct wallpapers they have collected
+func PullStats(ctx context.Context, discordID string) (pulls, collected int, err error) {
+	err = DB.QueryRow(
+		ctx, `SELECT
+			(SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND `+countedPullCondition+`),
+			(SELECT COUNT(DISTINCT upload_id) FROM pulls WHERE discord_id = ? AND discarded = 0)`,
+		discordID, discordID,
+	).Scan(&pulls, &collected)
+	return pulls, collected, err
+}
+
+// ListCollection returns a page of the distinct wallpapers the user has
+// pulled, most recently acquired first, along with the total number. Deleted
+// wallpapers, discarded pulls and pulls still held back for the user to
+// reveal are left out.
+func ListCollection(ctx context.Context, discordID string, limit, offset int) ([]CollectionEntry, int, error) {
+	const owned = `FROM pulls p JOIN uploads u ON u.id = p.upload_id
+		WHERE p.discord_id = ? AND p.discarded = 0 AND p.reveal_at IS NULL AND u.deleted_at IS NULL`
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(DISTINCT p.upload_id) "+owned, discordID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT p.upload_id, COUNT(*), MIN(p.pulled_at) "+owned+`
+		GROUP BY p.upload_id ORDER BY MIN(p.pulled_at) DESC, p.upload_id DESC LIMIT ? OFFSET ?`,
+		discordID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []CollectionEntry{}
+	for rows.Next() {
+		var e CollectionEntry
+		var firstPulledAt interface{}
+		if err := rows.Scan(&e.Upload.ID, &e.Copies, &firstPulledAt); err != nil {
+			return nil, 0, err
+		}
+		if e.FirstPulledAt, err = parseAggregateTime(firstPulledAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	if len(entries) == 0 {
+		return entries, total, nil
+	}
+
+	// Load the uploads once the pull rows are closed; SQLite in-memory
+	// databases have a single connection
+	ids := make([]int64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.Upload.ID
+	}
+	byID, err := uploadsByID(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range entries {
+		entries[i].Upload = byID[entries[i].Upload.ID]
+	}
+
+	return entries, total, nil
+}
+
+// CollectionUploads returns the wallpapers in the user's collection, by ID,
+// narrowed to ids when any are given. IDs the user doesn't own are left out.
+func CollectionUploads(ctx context.Context, discordID string, ids []int64) ([]Upload, error) {
+	owned, err := OwnedUploadIDs(ctx, discordID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		owned = slices.DeleteFunc(owned, func(id int64) bool { return !slices.Contains(ids, id) })
+	}
+	slices.Sort(owned)
+
+	byID, err := uploadsByID(ctx, owned)
+	if err != nil {
+		return nil, err
+	}
+	uploads := make([]Upload, 0, len(owned))
+	for _, id := range owned {
+		if u, ok := byID[id]; ok && !u.DeletedAt.Valid {
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads, nil
+}
+
+// parseAggregateTime reads a timestamp produced by an aggregate such as MIN,
+// which SQLite returns as text rather than a typed DATETIME
+func parseAggregateTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		return time.Parse(timestampFormat, t)
+	case []byte:
+		return time.Parse(timestampFormat, string(t))
+	}
+	return time.Time{}, fmt.Errorf("unexpected timestamp value %T", v)
+}
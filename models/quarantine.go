@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// QuarantinedFile is an upload the malware scanner refused. Filename names
+// the copy kept in the quarantine directory.
+type QuarantinedFile struct {
+	ID               int64
+	DiscordID        string
+	OriginalFilename string
+	Filename         string
+	FileSize         int64
+	SHA256           string
+	Signature        string
+	CreatedAt        time.Time
+}
+
+const quarantineColumns = `id, discord_id, original_filename, filename, file_size, sha256, signature, created_at`
+
+func scanQuarantinedFile(row rowScanner) (*QuarantinedFile, error) {
+	f := &QuarantinedFile{}
+	err := row.Scan(&f.ID, &f.DiscordID, &f.OriginalFilename, &f.Filename, &f.FileSize, &f.SHA256, &f.Signature, &f.CreatedAt)
+	return f, err
+}
+
+// CreateQuarantinedFile records a file the malware scanner refused and sets
+// its ID
+func CreateQuarantinedFile(ctx context.Context, f *QuarantinedFile) error {
+	return DB.QueryRow(
+		ctx, `INSERT INTO quarantined_files (discord_id, original_filename, filename, file_size, sha256, signature)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING id, created_at`,
+		f.DiscordID, f.OriginalFilename, f.Filename, f.FileSize, f.SHA256, f.Signature,
+	).Scan(&f.ID, &f.CreatedAt)
+}
+
+// ListQuarantinedFiles returns a page of quarantined files, newest first,
+// along with the total number of quarantined files
+func ListQuarantinedFiles(ctx context.Context, limit, offset int) ([]QuarantinedFile, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM quarantined_files").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT "+quarantineColumns+" FROM quarantined_files ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	files := []QuarantinedFile{}
+	for rows.Next() {
+		f, err := scanQuarantinedFile(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		files = append(files, *f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return files, total, nil
+}
+
+// GetQuarantinedFile returns a quarantined file, or sql.ErrNoRows
+func GetQuarantinedFile(ctx context.Context, id int64) (*QuarantinedFile, error) {
+	return scanQuarantinedFile(DB.QueryRow(ctx, "SELECT "+quarantineColumns+" FROM quarantined_files WHERE id = ?", id))
+}
+
+// DeleteQuarantinedFile removes the record of a quarantined file; the caller
+// deletes the file itself. It returns sql.ErrNoRows if there is no such
+// record.
+func DeleteQuarantinedFile(ctx context.Context, id int64) error {
+	result, err := DB.Exec(ctx, "DELETE FROM quarantined_files WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
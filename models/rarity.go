@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Rarity tiers of a wallpaper. Uploads are common unless an import or a
+// rarity vote says otherwise.
+const (
+	RarityCommon    = "common"
+	RarityRare      = "rare"
+	RarityEpic      = "epic"
+	RarityLegendary = "legendary"
+)
+
+// Rarities lists the tiers from most to least common
+var Rarities = []string{RarityCommon, RarityRare, RarityEpic, RarityLegendary}
+
+// ParseRarity validates a tier name, returning "" for an empty one
+func ParseRarity(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", nil
+	}
+	for _, r := range Rarities {
+		if r == s {
+			return s, nil
+		}
+	}
+	return "", errors.New("rarity must be one of: " + strings.Join(Rarities, ", "))
+}
+
+// SetUploadRarity changes an upload's tier, returning sql.ErrNoRows if there
+// is no such upload
+func SetUploadRarity(ctx context.Context, id int64, rarity string) error {
+	result, err := DB.Exec(ctx, "UPDATE uploads SET rarity = ? WHERE id = ?", rarity, id)
+	if err != nil {
+		return err
+	}
+	forgetPools()
+	return requireAffected(result)
+}
+
+// drawRarity picks the tier a pull draws from with a roll in [0, 1), by the
+// given rates, among the tiers that have wallpapers matching the pool
+// condition, and returns the tiers it picked from. Tiers without a rate are
+// never drawn. It returns "" when no rates are set, leaving tiers out of the
+// draw, and sql.ErrNoRows when no tier in the pool can be drawn.
+func drawRarity(ctx context.Context, rates map[string]float64, where string, args []interface{}, roll float64) (string, []TierRate, error) {
+	if len(rates) == 0 {
+		return "", nil, nil
+	}
+
+	inPool, err := poolRarities(ctx, where, args)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var present []TierRate
+	for _, r := range inPool {
+		if rates[r] > 0 {
+			present = append(present, TierRate{Rarity: r, Rate: rates[r]})
+		}
+	}
+	if len(present) == 0 {
+		return "", nil, sql.ErrNoRows
+	}
+	return pickTier(present, roll), present, nil
+}
+
+// poolRarities returns the rarities that have at least one wallpaper in the
+// pull pool selected by where
+func poolRarities(ctx context.Context, where string, args []interface{}) ([]string, error) {
+	key := poolKey(where, args)
+	if rarities, ok := poolRarityCache.Get(key); ok {
+		return rarities, nil
+	}
+
+	rows, err := DB.Query(ctx, "SELECT DISTINCT u.rarity FROM uploads u WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rarities []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		rarities = append(rarities, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	poolRarityCache.Set(key, rarities)
+	return rarities, nil
+}
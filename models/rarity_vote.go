@@ -0,0 +1,165 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrVotingClosed is returned when voting on a wallpaper whose rarity
+	// vote has ended or never ran
+	ErrVotingClosed = errors.New("rarity voting has closed")
+	// ErrAlreadyVoted is returned when a user votes twice on one wallpaper
+	ErrAlreadyVoted = errors.New("already voted on this wallpaper's rarity")
+)
+
+// CastRarityVote records the user's vote for the upload's rarity. Each user
+// votes once per wallpaper. It returns ErrVotingClosed unless the upload's
+// vote is running at the given time, and ErrAlreadyVoted for a second vote.
+func CastRarityVote(ctx context.Context, uploadID int64, discordID, rarity string, at time.Time) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var open int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM uploads WHERE id = ? AND rarity_voting_ends_at > ?",
+		uploadID, at.UTC().Format(timestampFormat),
+	).Scan(&open)
+	if err != nil {
+		return err
+	}
+	if open == 0 {
+		return ErrVotingClosed
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO rarity_votes (upload_id, discord_id, rarity) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		uploadID, discordID, rarity,
+	)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err == sql.ErrNoRows {
+		return ErrAlreadyVoted
+	} else if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RarityVoteTally counts the votes for each rarity of an upload, along with
+// the tier the given user voted for, or "" if they haven't
+func RarityVoteTally(ctx context.Context, uploadID int64, discordID string) (map[string]int, string, error) {
+	rows, err := DB.Query(ctx, "SELECT rarity, discord_id FROM rarity_votes WHERE upload_id = ?", uploadID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	tally := make(map[string]int, len(Rarities))
+	for _, r := range Rarities {
+		tally[r] = 0
+	}
+	var own string
+	for rows.Next() {
+		var rarity, voter string
+		if err := rows.Scan(&rarity, &voter); err != nil {
+			return nil, "", err
+		}
+		tally[rarity]++
+		if voter == discordID {
+			own = rarity
+		}
+	}
+	return tally, own, rows.Err()
+}
+
+// AggregateRarity is the rarity a tally of votes settles on: the median vote,
+// counting tiers from most to least common, or the more common of the two
+// middle votes when there is an even number. It returns "" without votes.
+func AggregateRarity(tally map[string]int) string {
+	total := 0
+	for _, n := range tally {
+		total += n
+	}
+	if total == 0 {
+		return ""
+	}
+	middle := (total + 1) / 2
+	for _, r := range Rarities {
+		middle -= tally[r]
+		if middle <= 0 {
+			return r
+		}
+	}
+	return ""
+}
+
+// RarityVotesDue returns the uploads whose rarity vote ended before the
+// given time and hasn't been settled by FinalizeRarityVote
+func RarityVotesDue(ctx context.Context, at time.Time) ([]int64, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT id FROM uploads WHERE rarity_voting_ends_at <= ? ORDER BY rarity_voting_ends_at, id",
+		at.UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// FinalizeRarityVote closes an upload's rarity vote, giving it the
+// aggregated rarity if it got at least minVotes votes. It returns the
+// upload's rarity afterwards and whether the vote changed it.
+func FinalizeRarityVote(ctx context.Context, uploadID int64, minVotes int) (string, bool, error) {
+	tally, _, err := RarityVoteTally(ctx, uploadID, "")
+	if err != nil {
+		return "", false, err
+	}
+	total := 0
+	for _, n := range tally {
+		total += n
+	}
+	voted := ""
+	if total >= minVotes {
+		voted = AggregateRarity(tally)
+	}
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var rarity string
+	if err := tx.QueryRow("SELECT rarity FROM uploads WHERE id = ?", uploadID).Scan(&rarity); err != nil {
+		return "", false, err
+	}
+	changed := voted != "" && voted != rarity
+	if changed {
+		rarity = voted
+	}
+	if _, err := tx.Exec("UPDATE uploads SET rarity = ?, rarity_voting_ends_at = NULL WHERE id = ?", rarity, uploadID); err != nil {
+		return "", false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+	forgetPools()
+	return rarity, changed, nil
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// RarityRateOverride is a rarity rate an admin set at runtime in place of
+// the one in rarity_rates
+type RarityRateOverride struct {
+	Rarity    string
+	Rate      float64
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// ListRarityRateOverrides returns the rarity rates set at runtime, by tier
+func ListRarityRateOverrides(ctx context.Context) ([]RarityRateOverride, error) {
+	rows, err := DB.Query(ctx, "SELECT rarity, rate, updated_by, updated_at FROM rarity_rate_overrides ORDER BY rarity")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []RarityRateOverride{}
+	for rows.Next() {
+		var o RarityRateOverride
+		if err := rows.Scan(&o.Rarity, &o.Rate, &o.UpdatedBy, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// UpdateGachaRates stores rarity rate overrides and banner rate-ups in one
+// transaction. A nil rate removes the tier's override, going back to
+// rarity_rates. It returns sql.ErrNoRows if one of the banners doesn't exist.
+func UpdateGachaRates(ctx context.Context, rarityRates map[string]*float64, bannerRateUps map[int64]float64, updatedBy string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for rarity, rate := range rarityRates {
+		if rate == nil {
+			if _, err := tx.Exec("DELETE FROM rarity_rate_overrides WHERE rarity = ?", rarity); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO rarity_rate_overrides (rarity, rate, updated_by) VALUES (?, ?, ?)
+			ON CONFLICT (rarity) DO UPDATE SET rate = excluded.rate, updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`,
+			rarity, *rate, updatedBy,
+		); err != nil {
+			return err
+		}
+	}
+	for id, rateUp := range bannerRateUps {
+		result, err := tx.Exec("UPDATE banners SET rate_up = ? WHERE id = ?", rateUp, id)
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(result); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Reasons an admin can give for rejecting an upload
+const (
+	RejectDuplicate  = "duplicate"
+	RejectLowQuality = "low_quality"
+	RejectOffTopic   = "off_topic"
+	RejectNSFW       = "nsfw"
+)
+
+// RejectionReasons lists the valid rejection reasons
+var RejectionReasons = []string{RejectDuplicate, RejectLowQuality, RejectOffTopic, RejectNSFW}
+
+// rejectionLabels is how each rejection reason is worded for the uploader
+var rejectionLabels = map[string]string{
+	RejectDuplicate:  "duplicate",
+	RejectLowQuality: "low quality",
+	RejectOffTopic:   "off-topic",
+	RejectNSFW:       "NSFW",
+}
+
+// Rejection records why an admin rejected an upload, so its uploader can
+// learn from it. An upload restored from the trash and rejected again has
+// one for each time.
+type Rejection struct {
+	ID         int64
+	UploadID   int64
+	Reason     string
+	Note       string
+	RejectedBy string
+	CreatedAt  time.Time
+}
+
+// Summary words the rejection for its uploader, such as
+// "low quality (the image is blurry)"
+func (r *Rejection) Summary() string {
+	label, ok := rejectionLabels[r.Reason]
+	if !ok {
+		label = r.Reason
+	}
+	if r.Note == "" {
+		return label
+	}
+	return label + " (" + r.Note + ")"
+}
+
+// insertRejection records a rejection of the upload as part of tx
+func insertRejection(tx *Tx, uploadID int64, rejection *Rejection) error {
+	_, err := tx.Exec(
+		"INSERT INTO upload_rejections (upload_id, reason, note, rejected_by) VALUES (?, ?, ?, ?)",
+		uploadID, rejection.Reason, rejection.Note, rejection.RejectedBy,
+	)
+	return err
+}
+
+// ListUploadRejections returns the rejections of each of the given uploads,
+// oldest first, keyed by upload ID. Uploads never rejected are left out.
+func ListUploadRejections(ctx context.Context, uploadIDs []int64) (map[int64][]Rejection, error) {
+	rejections := make(map[int64][]Rejection)
+	if len(uploadIDs) == 0 {
+		return rejections, nil
+	}
+	placeholders := make([]string, len(uploadIDs))
+	args := make([]interface{}, len(uploadIDs))
+	for i, id := range uploadIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT id, upload_id, reason, note, rejected_by, created_at FROM upload_rejections WHERE upload_id IN ("+strings.Join(placeholders, ", ")+") ORDER BY id",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Rejection
+		if err := rows.Scan(&r.ID, &r.UploadID, &r.Reason, &r.Note, &r.RejectedBy, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rejections[r.UploadID] = append(rejections[r.UploadID], r)
+	}
+	return rejections, rows.Err()
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+)
+
+// Related wallpapers share tags or dominant colors with an upload. Each
+// shared tag scores one, and a palette matching the upload's scores up to
+// one more, by the share of the upload's colors with a color within
+// relatedColorDistance in it. At most relatedCandidates wallpapers, most
+// liked first, are scored.
+const (
+	relatedColorDistance = 30
+	relatedCandidates    = 200
+)
+
+// RelatedUpload is a wallpaper related to another, with the tags they share
+// and the score it is ranked by
+type RelatedUpload struct {
+	Upload     Upload
+	SharedTags []string
+	Score      float64
+}
+
+// RelatedUploads returns up to limit public wallpapers of the upload's guild
+// that share tags or dominant colors with it, most related first
+func RelatedUploads(ctx context.Context, upload *Upload, limit int) ([]RelatedUpload, error) {
+	palette := parsePalette(upload.Palette)
+	conditions := []string{`EXISTS (SELECT 1 FROM upload_tags ut JOIN upload_tags st ON st.tag_id = ut.tag_id
+		WHERE ut.upload_id = u.id AND st.upload_id = ?)`}
+	args := []interface{}{upload.GuildID, upload.ID, upload.ID}
+	for _, c := range palette {
+		conditions = append(conditions, colorCondition)
+		args = append(args, c.R, c.R, c.G, c.G, c.B, c.B, relatedColorDistance*relatedColorDistance)
+	}
+	args = append(args, relatedCandidates)
+
+	candidates, err := queryUploads(ctx, uploadSelect+" WHERE "+visibleUploadCondition+
+		" AND u.guild_id = ? AND u.id <> ? AND ("+strings.Join(conditions, " OR ")+
+		") ORDER BY u.like_count DESC, u.id DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	related := make([]RelatedUpload, 0, len(candidates))
+	for _, u := range candidates {
+		r := RelatedUpload{Upload: u, SharedTags: []string{}}
+		for _, tag := range u.Tags {
+			if slices.Contains(upload.Tags, tag) {
+				r.SharedTags = append(r.SharedTags, tag)
+			}
+		}
+		r.Score = float64(len(r.SharedTags)) + paletteSimilarity(palette, parsePalette(u.Palette))
+		related = append(related, r)
+	}
+	// Candidates are already most liked first, which the stable sort keeps
+	// among equal scores
+	slices.SortStableFunc(related, func(a, b RelatedUpload) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	return related[:min(limit, len(related))], nil
+}
+
+// parsePalette reads a stored palette, skipping colors that don't parse
+func parsePalette(palette []string) []Color {
+	colors := make([]Color, 0, len(palette))
+	for _, s := range palette {
+		if c, err := ParseColor(s); err == nil {
+			colors = append(colors, *c)
+		}
+	}
+	return colors
+}
+
+// paletteSimilarity returns the share of the colors in a that have a color
+// within relatedColorDistance in b
+func paletteSimilarity(a, b []Color) float64 {
+	if len(a) == 0 {
+		return 0
+	}
+	var matched int
+	for _, x := range a {
+		for _, y := range b {
+			dr, dg, db := x.R-y.R, x.G-y.G, x.B-y.B
+			if dr*dr+dg*dg+db*db <= relatedColorDistance*relatedColorDistance {
+				matched++
+				break
+			}
+		}
+	}
+	return float64(matched) / float64(len(a))
+}
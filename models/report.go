@@ -0,0 +1,190 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Report categories users can choose from
+const (
+	ReportSpam       = "spam"
+	ReportNSFW       = "nsfw"
+	ReportCopyright  = "copyright"
+	ReportOffensive  = "offensive"
+	ReportLowQuality = "low_quality"
+	ReportOther      = "other"
+)
+
+// ReportCategories lists the valid report categories
+var ReportCategories = []string{ReportSpam, ReportNSFW, ReportCopyright, ReportOffensive, ReportLowQuality, ReportOther}
+
+// QualityReporterID is the reporter recorded on reports filed by the image
+// quality check
+const QualityReporterID = "quality-check"
+
+// Report statuses
+const (
+	ReportPending   = "pending"
+	ReportDismissed = "dismissed"
+	ReportUpheld    = "upheld"
+)
+
+// ErrAlreadyReported is returned when a user reports an upload they already
+// have a pending report against
+var ErrAlreadyReported = errors.New("upload already reported by this user")
+
+type Report struct {
+	ID         int64
+	UploadID   int64
+	ReporterID string
+	Category   string
+	Details    string
+	Status     string
+	CreatedAt  time.Time
+	ResolvedAt sql.NullTime
+	// QualityScore is the reported upload's image quality score, when listed
+	QualityScore sql.NullInt64
+}
+
+// CreateReport files a report against an upload and bumps its count of
+// unreviewed reports. Once the count reaches hideThreshold (when positive)
+// the upload is hidden until an admin reviews it. It reports whether the
+// upload is now hidden.
+func CreateReport(ctx context.Context, report *Report, hideThreshold int) (bool, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO reports (upload_id, reporter_id, category, details) VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING RETURNING id, status, created_at`,
+		report.UploadID, report.ReporterID, report.Category, report.Details,
+	).Scan(&report.ID, &report.Status, &report.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, ErrAlreadyReported
+	} else if err != nil {
+		return false, err
+	}
+
+	var count int
+	var hidden bool
+	err = tx.QueryRow(
+		`UPDATE uploads SET report_count = report_count + 1,
+			report_hidden = CASE WHEN ? > 0 AND report_count + 1 >= ? THEN 1 ELSE report_hidden END
+		WHERE id = ? RETURNING report_count, report_hidden`,
+		hideThreshold, hideThreshold, report.UploadID,
+	).Scan(&count, &hidden)
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	if hidden {
+		forgetPools()
+	}
+	return hidden, nil
+}
+
+const reportColumns = `id, upload_id, reporter_id, category, details, status, created_at, resolved_at,
+	(SELECT quality_score FROM uploads WHERE uploads.id = reports.upload_id)`
+
+// ListReports returns reports with the given status, oldest first, along
+// with the total number of reports with that status
+func ListReports(ctx context.Context, status string, limit, offset int) ([]Report, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM reports WHERE status = ?", status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT "+reportColumns+" FROM reports WHERE status = ? ORDER BY created_at, id LIMIT ? OFFSET ?",
+		status, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		var r Report
+		if err := rows.Scan(&r.ID, &r.UploadID, &r.ReporterID, &r.Category, &r.Details, &r.Status, &r.CreatedAt, &r.ResolvedAt, &r.QualityScore); err != nil {
+			return nil, 0, err
+		}
+		reports = append(reports, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return reports, total, nil
+}
+
+// ListUploadReports returns every report filed against an upload, whatever
+// its status, newest first
+func ListUploadReports(ctx context.Context, uploadID int64) ([]Report, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT "+reportColumns+" FROM reports WHERE upload_id = ? ORDER BY created_at DESC, id DESC",
+		uploadID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		var r Report
+		if err := rows.Scan(&r.ID, &r.UploadID, &r.ReporterID, &r.Category, &r.Details, &r.Status, &r.CreatedAt, &r.ResolvedAt, &r.QualityScore); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// ResolveReports closes every pending report against an upload with the given
+// status, resets its report count and unhides it. Upholding reports also moves
+// the upload to the trash and records rejection against it. It returns
+// sql.ErrNoRows if the upload has no pending reports.
+func ResolveReports(ctx context.Context, uploadID int64, status string, rejection *Rejection) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE reports SET status = ?, resolved_at = CURRENT_TIMESTAMP WHERE upload_id = ? AND status = ?",
+		status, uploadID, ReportPending,
+	)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE uploads SET report_count = 0, report_hidden = 0 WHERE id = ?", uploadID); err != nil {
+		return err
+	}
+	if status == ReportUpheld {
+		if _, err := tx.Exec("UPDATE uploads SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL", uploadID); err != nil {
+			return err
+		}
+		if err := insertRejection(tx, uploadID, rejection); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetPools()
+	return nil
+}
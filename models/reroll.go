@@ -0,0 +1,232 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Reasons recorded in the reroll ledger
+const (
+	RerollReasonAchievement = "achievement"
+	RerollReasonSpent       = "reroll"
+)
+
+var (
+	// ErrNotRerollable is returned for pulls that are not duplicates, were
+	// already rerolled, or are themselves rerolls
+	ErrNotRerollable = errors.New("pull cannot be rerolled")
+	// ErrNoRerolls is returned when the user has no reroll tokens
+	ErrNoRerolls = errors.New("no reroll tokens left")
+	// ErrRerollLimit is returned when the user has used today's rerolls
+	ErrRerollLimit = errors.New("daily reroll limit reached")
+)
+
+// RerollEntry is a change to a user's reroll token balance. Reference is the
+// achievement key for grants and the discarded pull's ID for rerolls; each
+// can appear only once per user.
+type RerollEntry struct {
+	ID        int64
+	DiscordID string
+	Delta     int
+	Reason    string
+	Reference string
+	CreatedAt time.Time
+}
+
+const rerollEntryColumns = `id, discord_id, delta, reason, reference, created_at`
+
+// RerollBalance returns how many reroll tokens the user holds
+func RerollBalance(ctx context.Context, discordID string) (int, error) {
+	var balance int
+	err := DB.QueryRow(ctx, "SELECT COALESCE(SUM(delta), 0) FROM reroll_ledger WHERE discord_id = ?", discordID).Scan(&balance)
+	return balance, err
+}
+
+// CountRerollsSince returns how many rerolls the user has made since the given time
+func CountRerollsSince(ctx context.Context, discordID string, since time.Time) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM reroll_ledger WHERE discord_id = ? AND reason = ? AND created_at >= ?",
+		discordID, RerollReasonSpent, since.UTC().Format(timestampFormat),
+	).Scan(&count)
+	return count, err
+}
+
+// GrantAchievement records that the user unlocked an achievement and grants
+// its reroll tokens, topping the balance up to at most maxBalance. It reports
+// false if the user had already unlocked it.
+func GrantAchievement(ctx context.Context, discordID, key string, rerolls, maxBalance int) (bool, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var balance int
+	if err := tx.QueryRow("SELECT COALESCE(SUM(delta), 0) FROM reroll_ledger WHERE discord_id = ?", discordID).Scan(&balance); err != nil {
+		return false, err
+	}
+	delta := max(min(rerolls, maxBalance-balance), 0)
+
+	var id int64
+	err = tx.QueryRow(
+		`INSERT INTO reroll_ledger (discord_id, delta, reason, reference) VALUES (?, ?, ?, ?)
+		ON CONFLICT DO NOTHING RETURNING id`,
+		discordID, delta, RerollReasonAchievement, key,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// UnlockedAchievements returns when the user unlocked each of their
+// achievements, keyed by achievement
+func UnlockedAchievements(ctx context.Context, discordID string) (map[string]time.Time, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT reference, created_at FROM reroll_ledger WHERE discord_id = ? AND reason = ?",
+		discordID, RerollReasonAchievement,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unlocked := make(map[string]time.Time)
+	for rows.Next() {
+		var key string
+		var at time.Time
+		if err := rows.Scan(&key, &at); err != nil {
+			return nil, err
+		}
+		unlocked[key] = at
+	}
+	return unlocked, rows.Err()
+}
+
+// ListRerollLedger returns a page of the user's ledger, newest first, along
+// with the total number of entries
+func ListRerollLedger(ctx context.Context, discordID string, limit, offset int) ([]RerollEntry, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM reroll_ledger WHERE discord_id = ?", discordID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT "+rerollEntryColumns+" FROM reroll_ledger WHERE discord_id = ? ORDER BY id DESC LIMIT ? OFFSET ?",
+		discordID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []RerollEntry{}
+	for rows.Next() {
+		var e RerollEntry
+		if err := rows.Scan(&e.ID, &e.DiscordID, &e.Delta, &e.Reason, &e.Reference, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+// RerollPull spends one of the user's reroll tokens to discard a duplicate
+// pull and replace it with a pull of the given upload. At most perDay rerolls
+// may be made since the given time; a negative perDay means no limit. A
+// duplicate redraw is converted into dust, when positive. It returns
+// sql.ErrNoRows if the user has no such pull, and ErrNotRerollable,
+// ErrNoRerolls or ErrRerollLimit when the reroll is not allowed.
+func RerollPull(ctx context.Context, discordID string, pullID, uploadID int64, since time.Time, perDay, dust int) (*Pull, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanPull(tx.QueryRow("SELECT "+pullColumns+" FROM pulls WHERE id = ? AND discord_id = ?", pullID, discordID))
+	if err != nil {
+		return nil, err
+	}
+	if !old.Duplicate || old.Discarded || old.Source == PullSourceReroll {
+		return nil, ErrNotRerollable
+	}
+
+	// Checking the balance and limit in the insert itself keeps concurrent
+	// rerolls from overspending
+	reference := strconv.FormatInt(pullID, 10)
+	var entryID int64
+	err = tx.QueryRow(
+		`INSERT INTO reroll_ledger (discord_id, delta, reason, reference)
+		SELECT ?, -1, ?, ?
+		WHERE (SELECT COALESCE(SUM(delta), 0) FROM reroll_ledger WHERE discord_id = ?) > 0
+		AND (? < 0 OR (SELECT COUNT(*) FROM reroll_ledger WHERE discord_id = ? AND reason = ? AND created_at >= ?) < ?)
+		ON CONFLICT DO NOTHING RETURNING id`,
+		discordID, RerollReasonSpent, reference,
+		discordID,
+		perDay, discordID, RerollReasonSpent, since.UTC().Format(timestampFormat), perDay,
+	).Scan(&entryID)
+	if err == sql.ErrNoRows {
+		return nil, rerollRefusal(tx, discordID, reference)
+	} else if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec("UPDATE pulls SET discarded = 1 WHERE id = ? AND discarded = 0", pullID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotRerollable
+	}
+
+	p := &Pull{DiscordID: discordID, UploadID: uploadID, Source: PullSourceReroll, RerolledFrom: sql.NullInt64{Int64: pullID, Valid: true}}
+	duplicate, err := markDuplicate(tx, p)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(
+		`INSERT INTO pulls (discord_id, upload_id, source, duplicate, rerolled_from) VALUES (?, ?, ?, ?, ?) RETURNING id, pulled_at`,
+		p.DiscordID, p.UploadID, p.Source, duplicate, pullID,
+	).Scan(&p.ID, &p.PulledAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := claimWishlist(tx, p); err != nil {
+		return nil, err
+	}
+	if err := convertDuplicate(tx, p, dust); err != nil {
+		return nil, err
+	}
+
+	return p, tx.Commit()
+}
+
+// rerollRefusal works out why the ledger refused a reroll
+func rerollRefusal(tx *Tx, discordID, reference string) error {
+	var spent, balance int
+	err := tx.QueryRow(
+		`SELECT
+			(SELECT COUNT(*) FROM reroll_ledger WHERE discord_id = ? AND reason = ? AND reference = ?),
+			(SELECT COALESCE(SUM(delta), 0) FROM reroll_ledger WHERE discord_id = ?)`,
+		discordID, RerollReasonSpent, reference, discordID,
+	).Scan(&spent, &balance)
+	switch {
+	case err != nil:
+		return err
+	case spent > 0:
+		return ErrNotRerollable
+	case balance <= 0:
+		return ErrNoRerolls
+	}
+	return ErrRerollLimit
+}
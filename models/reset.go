@@ -0,0 +1,39 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// DailyWindow returns the start and end of the calendar day containing t in
+// loc. Daily limits reset at the start of each window.
+func DailyWindow(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	local := t.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// ResetLocation returns the time zone in which the user's daily limits reset:
+// their own preference if set, otherwise fallback. A nil user gets fallback.
+func (u *User) ResetLocation(fallback *time.Location) *time.Location {
+	if u != nil && u.Timezone != "" {
+		if loc, err := time.LoadLocation(u.Timezone); err == nil {
+			return loc
+		}
+	}
+	return fallback
+}
+
+// SetTimezone stores the user's preferred IANA time zone name; an empty name
+// clears the preference
+func (u *User) SetTimezone(ctx context.Context, name string) error {
+	_, err := DB.Exec(
+		ctx, "UPDATE users SET timezone = ? WHERE discord_id = ?",
+		name, u.DiscordID,
+	)
+	if err == nil {
+		forgetUser(u.DiscordID)
+		u.Timezone = name
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Queues an upload can wait in before it is shown
+const (
+	// QueueContentCheck holds uploads waiting for their content safety
+	// check, which runs them oldest first
+	QueueContentCheck = "content_check"
+	// QueueReview holds uploads hidden by reports until an admin reviews
+	// them. Admins work through reports oldest first, so uploads are queued
+	// by their oldest pending report, along with those reported but not
+	// hidden.
+	QueueReview = "review"
+)
+
+// QueueStatus is where an upload stands in its queue, and how many uploads
+// left that queue recently
+type QueueStatus struct {
+	Queue string
+	// Position is 1 for the upload reviewed next
+	Position int
+	Length   int
+	// Since is when the upload entered the queue
+	Since time.Time
+	// Reviewed is how many uploads left the queue in the window before now
+	Reviewed int
+	Window   time.Duration
+}
+
+// reviewQueue matches the uploads with pending reports and when their oldest
+// report was filed
+const reviewQueue = `SELECT r.upload_id, MIN(r.created_at) AS since FROM reports r
+	JOIN uploads u ON u.id = r.upload_id
+	WHERE r.status = '` + ReportPending + `' AND u.deleted_at IS NULL GROUP BY r.upload_id`
+
+// GetQueueStatus returns where an upload waiting for its content safety check
+// or hidden by reports stands in its queue, counting the uploads that left
+// that queue within window. It returns nil for uploads that aren't waiting.
+func GetQueueStatus(ctx context.Context, u *Upload, window time.Duration) (*QueueStatus, error) {
+	if u.DeletedAt.Valid {
+		return nil, nil
+	}
+	since := time.Now().UTC().Add(-window).Format(timestampFormat)
+
+	status := &QueueStatus{Window: window}
+	switch {
+	case u.SafetyStatus == SafetyPending:
+		// The safety check sweep runs uploads in the order they were stored
+		status.Queue, status.Since = QueueContentCheck, u.UploadedAt
+		err := DB.QueryRow(
+			ctx, "SELECT COUNT(CASE WHEN id <= ? THEN 1 END), COUNT(*) FROM uploads WHERE safety_status = ?",
+			u.ID, SafetyPending,
+		).Scan(&status.Position, &status.Length)
+		if err != nil {
+			return nil, err
+		}
+		if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads WHERE safety_checked_at >= ?", since).Scan(&status.Reviewed); err != nil {
+			return nil, err
+		}
+
+	case u.ReportHidden:
+		status.Queue = QueueReview
+		var entered interface{}
+		err := DB.QueryRow(
+			ctx, `WITH queued AS (`+reviewQueue+`)
+			SELECT q.since,
+				(SELECT COUNT(*) FROM queued o WHERE o.since < q.since OR (o.since = q.since AND o.upload_id <= q.upload_id)),
+				(SELECT COUNT(*) FROM queued)
+			FROM queued q WHERE q.upload_id = ?`,
+			u.ID,
+		).Scan(&entered, &status.Position, &status.Length)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if status.Since, err = parseAggregateTime(entered); err != nil {
+			return nil, err
+		}
+		if err := DB.QueryRow(ctx, "SELECT COUNT(DISTINCT upload_id) FROM reports WHERE resolved_at >= ?", since).Scan(&status.Reviewed); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, nil
+	}
+	return status, nil
+}
+
+// EstimatedWait returns how long the upload is likely to wait from now, were
+// the queue to keep the pace it had over the window. ok is false when no
+// upload left the queue in that time.
+func (s *QueueStatus) EstimatedWait() (wait time.Duration, ok bool) {
+	if s.Reviewed == 0 {
+		return 0, false
+	}
+	return s.Window * time.Duration(s.Position) / time.Duration(s.Reviewed), true
+}
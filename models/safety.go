@@ -0,0 +1,99 @@
+package models
+
+import "context"
+
+// Content safety check states of an upload. Uploads stored while no check was
+// configured have an empty status.
+const (
+	SafetyPending  = "pending"
+	SafetyPassed   = "passed"
+	SafetyFlagged  = "flagged"
+	SafetyRejected = "rejected"
+)
+
+// SafetyReporterID is the reporter recorded on reports filed by the content
+// safety check
+const SafetyReporterID = "content-safety"
+
+// ListPendingSafetyChecks returns the IDs of uploads still waiting for their
+// content safety check, oldest first
+func ListPendingSafetyChecks(ctx context.Context) ([]int64, error) {
+	rows, err := DB.Query(ctx, "SELECT id FROM uploads WHERE safety_status = ? ORDER BY id", SafetyPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// PassSafetyCheck publishes an upload that passed its content safety check.
+// It returns sql.ErrNoRows if the upload was not waiting for one.
+func PassSafetyCheck(ctx context.Context, id int64) error {
+	result, err := DB.Exec(ctx, "UPDATE uploads SET safety_status = ?, safety_checked_at = CURRENT_TIMESTAMP WHERE id = ? AND safety_status = ?", SafetyPassed, id, SafetyPending)
+	if err != nil {
+		return err
+	}
+	forgetPools()
+	return requireAffected(result)
+}
+
+// FlagUnsafeUpload files an NSFW report against an upload that failed its
+// content safety check and keeps it hidden until an admin resolves the
+// report: dismissing it publishes the upload and upholding it moves the
+// upload to the trash. It returns sql.ErrNoRows if the upload was not waiting
+// for a check.
+func FlagUnsafeUpload(ctx context.Context, id int64, details string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE uploads SET safety_status = ?, safety_checked_at = CURRENT_TIMESTAMP, report_count = report_count + 1, report_hidden = 1 WHERE id = ? AND safety_status = ?",
+		SafetyFlagged, id, SafetyPending,
+	)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO reports (upload_id, reporter_id, category, details) VALUES (?, ?, ?, ?)",
+		id, SafetyReporterID, ReportNSFW, details,
+	); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetPools()
+	return nil
+}
+
+// RejectUnsafeUpload moves an upload that failed its content safety check to
+// the trash. It returns sql.ErrNoRows if the upload was not waiting for a
+// check.
+func RejectUnsafeUpload(ctx context.Context, id int64) error {
+	result, err := DB.Exec(
+		ctx, "UPDATE uploads SET safety_status = ?, safety_checked_at = CURRENT_TIMESTAMP, deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND safety_status = ?",
+		SafetyRejected, id, SafetyPending,
+	)
+	if err != nil {
+		return err
+	}
+	forgetPools()
+	return requireAffected(result)
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// SearchEnabled reports whether the database supports full-text search
+var SearchEnabled bool
+
+// createSearchIndex prepares the active store's search index
+func createSearchIndex(ctx context.Context) error {
+	enabled, err := store.createSearchIndex(ctx)
+	SearchEnabled = enabled
+	return err
+}
+
+// RebuildSearchIndex re-indexes every upload
+func RebuildSearchIndex(ctx context.Context) error {
+	if !SearchEnabled {
+		return nil
+	}
+	return store.rebuildSearchIndex(ctx)
+}
+
+// IndexUpload refreshes the search index entry for one upload
+func IndexUpload(ctx context.Context, uploadID int64) error {
+	if !SearchEnabled {
+		return nil
+	}
+	return store.indexUpload(ctx, uploadID)
+}
+
+// SearchUploads returns a page of the guild's visible uploads matching the
+// free-text query, best matches first, along with the total number of matches. Every word must
+// match, and the last word matches as a prefix so search-as-you-type works.
+func SearchUploads(ctx context.Context, guildID, query string, limit, offset int) ([]Upload, int, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []Upload{}, 0, nil
+	}
+	return store.searchUploads(ctx, guildID, terms, limit, offset)
+}
+
+// searchTerms splits free text into words, dropping punctuation and any
+// query syntax
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
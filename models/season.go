@@ -0,0 +1,266 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Season is a date range during which the wallpapers it lists, by ID and by
+// tag, are in its guild's standard pull pool. A wallpaper listed by any
+// season is seasonal: outside all of its seasons it is archived, leaving the
+// standard pool for the archive pool until one of them runs again.
+type Season struct {
+	ID        int64
+	GuildID   string
+	Name      string
+	UploadIDs []int64
+	Tags      []string
+	StartsAt  time.Time
+	EndsAt    time.Time
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// Active reports whether the season is running at the given time
+func (s *Season) Active(at time.Time) bool {
+	return !at.Before(s.StartsAt) && at.Before(s.EndsAt)
+}
+
+// Which pool a listing is limited to
+const (
+	PoolStandard = "standard"
+	PoolArchive  = "archive"
+)
+
+// seasonalCondition matches uploads u listed by a season of their guild. With
+// running set it only matches those listed by a season running at the time
+// bound to both of its placeholders.
+func seasonalCondition(running bool) string {
+	cond := `EXISTS (SELECT 1 FROM seasons s WHERE s.guild_id = u.guild_id
+		AND (EXISTS (SELECT 1 FROM season_uploads su WHERE su.season_id = s.id AND su.upload_id = u.id)
+		OR EXISTS (SELECT 1 FROM season_tags st JOIN tags t ON t.name = st.tag JOIN upload_tags ut ON ut.tag_id = t.id
+			WHERE st.season_id = s.id AND ut.upload_id = u.id))`
+	if running {
+		cond += " AND s.starts_at <= ? AND s.ends_at > ?"
+	}
+	return cond + ")"
+}
+
+const seasonColumns = `id, guild_id, name, starts_at, ends_at, created_by, created_at`
+
+func scanSeason(row rowScanner) (*Season, error) {
+	s := &Season{}
+	err := row.Scan(&s.ID, &s.GuildID, &s.Name, &s.StartsAt, &s.EndsAt, &s.CreatedBy, &s.CreatedAt)
+	return s, err
+}
+
+// CreateSeason stores a new season and sets its ID and creation time
+func CreateSeason(ctx context.Context, s *Season) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO seasons (guild_id, name, starts_at, ends_at, created_by) VALUES (?, ?, ?, ?, ?) RETURNING id, created_at`,
+		s.GuildID, s.Name, s.StartsAt.UTC().Format(timestampFormat), s.EndsAt.UTC().Format(timestampFormat), s.CreatedBy,
+	).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := insertSeasonMembers(tx, s); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateSeason replaces a season's dates and wallpapers, returning
+// sql.ErrNoRows if there is no such season
+func UpdateSeason(ctx context.Context, s *Season) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`UPDATE seasons SET guild_id = ?, name = ?, starts_at = ?, ends_at = ? WHERE id = ? RETURNING created_by, created_at`,
+		s.GuildID, s.Name, s.StartsAt.UTC().Format(timestampFormat), s.EndsAt.UTC().Format(timestampFormat), s.ID,
+	).Scan(&s.CreatedBy, &s.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := deleteSeasonMembers(tx, s.ID); err != nil {
+		return err
+	}
+	if err := insertSeasonMembers(tx, s); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertSeasonMembers(tx *Tx, s *Season) error {
+	for _, id := range s.UploadIDs {
+		if _, err := tx.Exec("INSERT INTO season_uploads (season_id, upload_id) VALUES (?, ?) ON CONFLICT DO NOTHING", s.ID, id); err != nil {
+			return err
+		}
+	}
+	for _, tag := range s.Tags {
+		if _, err := tx.Exec("INSERT INTO season_tags (season_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING", s.ID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteSeasonMembers(tx *Tx, id int64) error {
+	if _, err := tx.Exec("DELETE FROM season_uploads WHERE season_id = ?", id); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM season_tags WHERE season_id = ?", id)
+	return err
+}
+
+// DeleteSeason removes a season, returning sql.ErrNoRows if there is no such
+// season. Its wallpapers stay archived until the pool is next rotated.
+func DeleteSeason(ctx context.Context, id int64) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteSeasonMembers(tx, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM seasons WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// GetSeason returns a season with its wallpapers, or sql.ErrNoRows
+func GetSeason(ctx context.Context, id int64) (*Season, error) {
+	s, err := scanSeason(DB.QueryRow(ctx, "SELECT "+seasonColumns+" FROM seasons WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	if err := loadSeasonMembers(ctx, []*Season{s}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListSeasons returns the guild's seasons by start time, newest first, or
+// every guild's when guildID is empty
+func ListSeasons(ctx context.Context, guildID string) ([]*Season, error) {
+	query := "SELECT " + seasonColumns + " FROM seasons"
+	var args []interface{}
+	if guildID != "" {
+		query += " WHERE guild_id = ?"
+		args = append(args, guildID)
+	}
+	rows, err := DB.Query(ctx, query+" ORDER BY starts_at DESC, id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seasons := []*Season{}
+	for rows.Next() {
+		s, err := scanSeason(rows)
+		if err != nil {
+			return nil, err
+		}
+		seasons = append(seasons, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := loadSeasonMembers(ctx, seasons); err != nil {
+		return nil, err
+	}
+	return seasons, nil
+}
+
+// loadSeasonMembers fills in the upload IDs and tags of each season
+func loadSeasonMembers(ctx context.Context, seasons []*Season) error {
+	for _, s := range seasons {
+		s.UploadIDs = []int64{}
+		s.Tags = []string{}
+
+		rows, err := DB.Query(ctx, "SELECT upload_id FROM season_uploads WHERE season_id = ? ORDER BY upload_id", s.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			s.UploadIDs = append(s.UploadIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = DB.Query(ctx, "SELECT tag FROM season_tags WHERE season_id = ? ORDER BY tag", s.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				rows.Close()
+				return err
+			}
+			s.Tags = append(s.Tags, tag)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateSeasonalPool archives the seasonal wallpapers none of whose seasons
+// are running at the given time and brings back those with a running
+// season, or that are no longer seasonal. It returns how many were archived
+// and restored.
+func RotateSeasonalPool(ctx context.Context, at time.Time) (archived, restored int64, err error) {
+	now := at.UTC().Format(timestampFormat)
+	outOfSeason := seasonalCondition(false) + " AND NOT " + seasonalCondition(true)
+
+	res, err := DB.Exec(ctx, "UPDATE uploads SET archived = 1 WHERE id IN (SELECT u.id FROM uploads u WHERE u.archived = 0 AND "+outOfSeason+")", now, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if archived, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+
+	res, err = DB.Exec(ctx, "UPDATE uploads SET archived = 0 WHERE id IN (SELECT u.id FROM uploads u WHERE u.archived = 1 AND NOT ("+outOfSeason+"))", now, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if restored, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+	if archived > 0 || restored > 0 {
+		forgetPools()
+	}
+	return archived, restored, nil
+}
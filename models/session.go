@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Session is a browser session kept server-side. ID is a hash of the random
+// value in the session cookie, so the table can't be used to take sessions
+// over. DiscordID is empty until the browser signs in.
+type Session struct {
+	ID         string
+	DiscordID  string
+	Data       string
+	IPAddress  string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+const sessionColumns = `id, discord_id, data, ip_address, user_agent, created_at, last_seen_at, expires_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	s := &Session{}
+	err := row.Scan(&s.ID, &s.DiscordID, &s.Data, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+	return s, err
+}
+
+// GetSession returns the unexpired session with the given ID, or
+// sql.ErrNoRows if there is none
+func GetSession(ctx context.Context, id string) (*Session, error) {
+	return scanSession(DB.QueryRow(
+		ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = ? AND expires_at > ?",
+		id, time.Now().UTC().Format(timestampFormat),
+	))
+}
+
+// SaveSession creates or replaces a session, keeping the creation time of an
+// existing one
+func SaveSession(ctx context.Context, s *Session) error {
+	_, err := DB.Exec(
+		ctx, `INSERT INTO sessions (id, discord_id, data, ip_address, user_agent, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET discord_id = excluded.discord_id, data = excluded.data,
+			ip_address = excluded.ip_address, user_agent = excluded.user_agent,
+			last_seen_at = excluded.last_seen_at, expires_at = excluded.expires_at`,
+		s.ID, s.DiscordID, s.Data, s.IPAddress, s.UserAgent,
+		s.CreatedAt.UTC().Format(timestampFormat), s.LastSeenAt.UTC().Format(timestampFormat), s.ExpiresAt.UTC().Format(timestampFormat),
+	)
+	return err
+}
+
+// DeleteSession removes a session, returning sql.ErrNoRows if it doesn't exist
+func DeleteSession(ctx context.Context, id string) error {
+	res, err := DB.Exec(ctx, "DELETE FROM sessions WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListUserSessions returns the user's unexpired sessions, most recently used
+// first
+func ListUserSessions(ctx context.Context, discordID string) ([]Session, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT "+sessionColumns+" FROM sessions WHERE discord_id = ? AND expires_at > ? ORDER BY last_seen_at DESC",
+		discordID, time.Now().UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteUserSessions removes every session of the user, returning how many
+// there were
+func DeleteUserSessions(ctx context.Context, discordID string) (int64, error) {
+	res, err := DB.Exec(ctx, "DELETE FROM sessions WHERE discord_id = ?", discordID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions removes sessions past their expiry, returning how
+// many were removed
+func DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	res, err := DB.Exec(ctx, "DELETE FROM sessions WHERE expires_at <= ?", time.Now().UTC().Format(timestampFormat))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotInCollection is returned when showcasing a wallpaper the user
+// doesn't hold
+var ErrNotInCollection = errors.New("wallpaper not in collection")
+
+// ShowcaseEntry is a wallpaper a user shows off on their profile, with how
+// many copies of it they hold
+type ShowcaseEntry struct {
+	Upload Upload
+	Copies int
+}
+
+// SetShowcase replaces the wallpapers the user shows on their profile with
+// uploadIDs, in that order. It returns ErrNotInCollection when the user
+// doesn't hold one of them.
+func SetShowcase(ctx context.Context, discordID string, uploadIDs []int64) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM showcases WHERE discord_id = ?", discordID); err != nil {
+		return err
+	}
+	for i, id := range uploadIDs {
+		var owned int
+		if err := tx.QueryRow(
+			"SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND upload_id = ? AND discarded = 0",
+			discordID, id,
+		).Scan(&owned); err != nil {
+			return err
+		}
+		if owned == 0 {
+			return ErrNotInCollection
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO showcases (discord_id, upload_id, position) VALUES (?, ?, ?)",
+			discordID, id, i,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListShowcase returns the wallpapers the user shows on their profile, in
+// the order they chose. Wallpapers they no longer hold, such as ones traded
+// away, and ones that left the gallery are left out; private and unlisted
+// ones too, unless allVisibilities is set.
+func ListShowcase(ctx context.Context, discordID string, allVisibilities bool) ([]ShowcaseEntry, error) {
+	condition := visibleUploadCondition
+	if allVisibilities {
+		condition = availableUploadCondition
+	}
+	rows, err := DB.Query(
+		ctx, `SELECT s.upload_id, COUNT(p.id) FROM showcases s
+		JOIN uploads u ON u.id = s.upload_id
+		JOIN pulls p ON p.discord_id = s.discord_id AND p.upload_id = s.upload_id AND p.discarded = 0
+		WHERE s.discord_id = ? AND `+condition+`
+		GROUP BY s.upload_id, s.position ORDER BY s.position`,
+		discordID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ShowcaseEntry{}
+	for rows.Next() {
+		var e ShowcaseEntry
+		if err := rows.Scan(&e.Upload.ID, &e.Copies); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ids := make([]int64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.Upload.ID
+	}
+	byID, err := uploadsByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Upload = byID[entries[i].Upload.ID]
+	}
+	return entries, nil
+}
+
+// CountHeldDuplicates returns how many copies the user holds beyond the
+// first of each wallpaper in their collection
+func CountHeldDuplicates(ctx context.Context, discordID string) (int, error) {
+	var duplicates int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) - COUNT(DISTINCT upload_id) FROM pulls WHERE discord_id = ? AND discarded = 0",
+		discordID,
+	).Scan(&duplicates)
+	return duplicates, err
+}
@@ -0,0 +1,26 @@
+package models
+
+import "context"
+
+// Where an upload came from
+const (
+	SourceWeb     = "web"
+	SourceFolder  = "folder"
+	SourceDiscord = "discord"
+	SourceWebhook = "webhook"
+)
+
+// FindImportedUpload returns the upload previously imported from source with
+// the given external ID, or sql.ErrNoRows if it has not been imported. Importers
+// use it to make re-imports idempotent.
+func FindImportedUpload(ctx context.Context, source, externalID string) (*Upload, error) {
+	u, err := scanUpload(DB.QueryRow(ctx, uploadSelect+" WHERE u.source = ? AND u.external_id = ?", source, externalID))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Tags, err = GetUploadTags(ctx, u.ID); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// UploadStats counts how often an upload's full image has been fetched, and
+// how often it has been pulled
+type UploadStats struct {
+	Views     int64
+	Downloads int64
+	Pulls     int64
+}
+
+// uploadStatsSelect selects an upload's ID and UploadStats; callers append
+// a WHERE clause on u
+const uploadStatsSelect = `SELECT u.id, u.view_count, u.download_count,
+	(SELECT COUNT(*) FROM pulls p WHERE p.upload_id = u.id) FROM uploads u`
+
+// GetUploadStats returns the counters of an upload
+func GetUploadStats(ctx context.Context, uploadID int64) (*UploadStats, error) {
+	stats := &UploadStats{}
+	var id int64
+	err := DB.QueryRow(ctx, uploadStatsSelect+" WHERE u.id = ?", uploadID).Scan(&id, &stats.Views, &stats.Downloads, &stats.Pulls)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ListUploadStats returns the counters of each of the given uploads, keyed
+// by upload ID
+func ListUploadStats(ctx context.Context, uploadIDs []int64) (map[int64]UploadStats, error) {
+	stats := make(map[int64]UploadStats, len(uploadIDs))
+	if len(uploadIDs) == 0 {
+		return stats, nil
+	}
+	placeholders := make([]string, len(uploadIDs))
+	args := make([]interface{}, len(uploadIDs))
+	for i, id := range uploadIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := DB.Query(ctx, uploadStatsSelect+" WHERE u.id IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var s UploadStats
+		if err := rows.Scan(&id, &s.Views, &s.Downloads, &s.Pulls); err != nil {
+			return nil, err
+		}
+		stats[id] = s
+	}
+	return stats, rows.Err()
+}
+
+// UploaderReputation summarizes a user's moderation history
+type UploaderReputation struct {
+	DiscordID         string
+	Uploads           int
+	DeletedUploads    int
+	ReportsReceived   int
+	ReportsUpheld     int
+	TakedownsApproved int
+	Banned            bool
+}
+
+// GetUploaderReputation gathers the moderation history of a user's uploads
+func GetUploaderReputation(ctx context.Context, discordID string) (*UploaderReputation, error) {
+	rep := &UploaderReputation{DiscordID: discordID}
+	err := DB.QueryRow(ctx, `SELECT
+		(SELECT COUNT(*) FROM uploads WHERE discord_id = ?),
+		(SELECT COUNT(*) FROM uploads WHERE discord_id = ? AND deleted_at IS NOT NULL),
+		(SELECT COUNT(*) FROM reports r JOIN uploads u ON u.id = r.upload_id WHERE u.discord_id = ?),
+		(SELECT COUNT(*) FROM reports r JOIN uploads u ON u.id = r.upload_id WHERE u.discord_id = ? AND r.status = ?),
+		(SELECT COUNT(*) FROM takedown_requests t JOIN uploads u ON u.id = t.upload_id WHERE u.discord_id = ? AND t.status = ?)`,
+		discordID, discordID, discordID, discordID, ReportUpheld, discordID, TakedownApproved,
+	).Scan(&rep.Uploads, &rep.DeletedUploads, &rep.ReportsReceived, &rep.ReportsUpheld, &rep.TakedownsApproved)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := GetActiveBan(ctx, discordID); err == nil {
+		rep.Banned = true
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	return rep, nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import "context"
+
+// StorageUsage is how much space a user's uploads take up. Uploads in the
+// trash don't count.
+type StorageUsage struct {
+	Bytes int64
+	Files int
+}
+
+// UserStorage is a user's storage usage, for the admin report
+type UserStorage struct {
+	DiscordID string
+	Username  string
+	StorageUsage
+}
+
+// GetStorageUsage returns the total size and number of the user's uploads
+// that are not in the trash
+func GetStorageUsage(ctx context.Context, discordID string) (StorageUsage, error) {
+	var usage StorageUsage
+	err := DB.QueryRow(
+		ctx, "SELECT COALESCE(SUM(file_size), 0), COUNT(*) FROM uploads WHERE discord_id = ? AND deleted_at IS NULL",
+		discordID,
+	).Scan(&usage.Bytes, &usage.Files)
+	return usage, err
+}
+
+// ListStorageUsage returns a page of the users with uploads, those using the
+// most storage first, along with the total number. Wallpapers imported for
+// the site itself are left out.
+func ListStorageUsage(ctx context.Context, limit, offset int) ([]UserStorage, int, error) {
+	var total int
+	if err := DB.QueryRow(
+		ctx, "SELECT COUNT(DISTINCT discord_id) FROM uploads WHERE deleted_at IS NULL AND discord_id <> ?",
+		SystemUserID,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, `SELECT u.discord_id, COALESCE(us.username, ''), SUM(u.file_size), COUNT(*)
+		FROM uploads u LEFT JOIN users us ON us.discord_id = u.discord_id
+		WHERE u.deleted_at IS NULL AND u.discord_id <> ?
+		GROUP BY u.discord_id, us.username
+		ORDER BY SUM(u.file_size) DESC, u.discord_id
+		LIMIT ? OFFSET ?`,
+		SystemUserID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []UserStorage{}
+	for rows.Next() {
+		var s UserStorage
+		if err := rows.Scan(&s.DiscordID, &s.Username, &s.Bytes, &s.Files); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, s)
+	}
+	return users, total, rows.Err()
+}
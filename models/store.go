@@ -0,0 +1,291 @@
+package models
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+)
+
+var queryDuration = metrics.NewHistogramVec("db_query_duration_seconds",
+	"Time taken by database statements, by kind of statement", metrics.DurationBuckets, "operation")
+
+// queryOperation returns the kind of statement a query is
+func queryOperation(query string) string {
+	op, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	switch op = strings.ToUpper(op); op {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH":
+		return op
+	}
+	return "OTHER"
+}
+
+// observeQuery records how long a statement took. For queries returning rows
+// that is the time until the first rows are available.
+func observeQuery(query string, start time.Time) {
+	queryDuration.ObserveSince(start, queryOperation(query))
+}
+
+// startQuerySpan starts the client span of a statement run as part of a
+// traced request or job. Statements outside a trace don't start their own.
+func startQuerySpan(ctx context.Context, query string) *tracing.Span {
+	if !tracing.Recording(ctx) {
+		return nil
+	}
+	_, span := tracing.StartSpan(ctx, "db "+queryOperation(query), tracing.KindClient)
+	span.SetAttribute("db.system", store.Name())
+	span.SetAttribute("db.statement", strings.TrimSpace(query))
+	return span
+}
+
+// endQuerySpan ends a statement's span, marking it failed by err unless
+// that is only the absence of a row
+func endQuerySpan(span *tracing.Span, err error) {
+	if err != sql.ErrNoRows {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// Store is a database backend. Model functions are written once in SQLite's
+// dialect with ? placeholders; the active Store adapts them to its database
+// and provides the pieces that cannot be expressed portably, such as schema
+// introspection and full-text search.
+type Store interface {
+	// Name is the value of database_driver that selects this store
+	Name() string
+	// Open connects to the database described by dsn
+	Open(dsn string, opts PoolOptions) (*sql.DB, error)
+	// Rebind rewrites ? placeholders into the driver's syntax
+	Rebind(query string) string
+	// TranslateDDL adapts SQLite schema statements and column definitions
+	TranslateDDL(ddl string) string
+	// ColumnExists reports whether table already has column
+	ColumnExists(ctx context.Context, table, column string) (bool, error)
+
+	// optimize does the periodic upkeep the database doesn't do by itself
+	optimize(ctx context.Context) error
+
+	searchIndex
+}
+
+// PoolOptions tunes the connection pool. Zero values keep database/sql's
+// defaults: no limit on open connections, two idle ones kept and no maximum
+// lifetime. BusyTimeout is how long a SQLite connection waits for another's
+// write lock before failing with "database is locked". QueryTimeout cancels
+// statements that run longer, with 0 for no limit.
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	BusyTimeout     time.Duration
+	QueryTimeout    time.Duration
+}
+
+// apply sets the pool limits on db
+func (o PoolOptions) apply(db *sql.DB) {
+	if o.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
+	if o.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+}
+
+// searchIndex is the full-text search support a Store provides
+type searchIndex interface {
+	// createSearchIndex prepares the index, reporting whether search is available
+	createSearchIndex(ctx context.Context) (bool, error)
+	rebuildSearchIndex(ctx context.Context) error
+	indexUpload(ctx context.Context, uploadID int64) error
+	unindexUpload(tx *Tx, uploadID int64) error
+	searchUploads(ctx context.Context, guildID string, terms []string, limit, offset int) ([]Upload, int, error)
+}
+
+var stores = map[string]Store{
+	"sqlite":   sqliteStore{},
+	"postgres": postgresStore{},
+}
+
+// store is the backend selected by InitDatabase
+var store Store = sqliteStore{}
+
+// Database is the connection pool, adapting every query to the active Store.
+// Statements run with the context of the request or job they serve, so they
+// stop when it is cancelled, and each is cancelled after the query timeout.
+type Database struct {
+	*sql.DB
+}
+
+// queryTimeout is how long a single statement may run before it is
+// cancelled, set from PoolOptions.QueryTimeout; 0 leaves statements bounded
+// only by their context
+var queryTimeout time.Duration
+
+// statementContext bounds ctx by the query timeout
+func statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, queryTimeout)
+}
+
+// Exec executes a query that returns no rows
+func (db *Database) Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(query, time.Now())
+	defer bumpTableVersions(writtenTable(query))
+	span := startQuerySpan(ctx, query)
+	ctx, cancel := statementContext(ctx)
+	defer cancel()
+	result, err := db.DB.ExecContext(ctx, store.Rebind(query), args...)
+	endQuerySpan(span, err)
+	return result, err
+}
+
+// Query executes a query that returns rows. The query timeout and the
+// statement's span cover reading the rows too, until they are closed.
+func (db *Database) Query(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	defer observeQuery(query, time.Now())
+	defer bumpTableVersions(writtenTable(query))
+	span := startQuerySpan(ctx, query)
+	ctx, cancel := statementContext(ctx)
+	rows, err := db.DB.QueryContext(ctx, store.Rebind(query), args...)
+	if err != nil {
+		endQuerySpan(span, err)
+		cancel()
+		return nil, err
+	}
+	return &Rows{rows, cancel, span}, nil
+}
+
+// QueryRow executes a query that returns at most one row. The statement's
+// span ends when the row is scanned.
+func (db *Database) QueryRow(ctx context.Context, query string, args ...interface{}) *Row {
+	defer observeQuery(query, time.Now())
+	defer bumpTableVersions(writtenTable(query))
+	span := startQuerySpan(ctx, query)
+	ctx, cancel := statementContext(ctx)
+	return &Row{db.DB.QueryRowContext(ctx, store.Rebind(query), args...), cancel, span}
+}
+
+// Begin starts a transaction, which is rolled back if ctx is cancelled
+// before it commits. Its statements run with ctx.
+func (db *Database) Begin(ctx context.Context) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, ctx: ctx}, nil
+}
+
+// Tx is a transaction, adapting every query to the active Store
+type Tx struct {
+	*sql.Tx
+	ctx context.Context
+	// written are the tables the transaction's statements write, whose
+	// versions change when it commits
+	written []string
+}
+
+// Commit commits the transaction
+func (tx *Tx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	bumpTableVersions(tx.written...)
+	return nil
+}
+
+// wrote notes the table a statement of the transaction writes
+func (tx *Tx) wrote(query string) {
+	if t := writtenTable(query); t != "" && !slices.Contains(tx.written, t) {
+		tx.written = append(tx.written, t)
+	}
+}
+
+// Exec executes a query that returns no rows
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(query, time.Now())
+	tx.wrote(query)
+	span := startQuerySpan(tx.ctx, query)
+	ctx, cancel := statementContext(tx.ctx)
+	defer cancel()
+	result, err := tx.Tx.ExecContext(ctx, store.Rebind(query), args...)
+	endQuerySpan(span, err)
+	return result, err
+}
+
+// Query executes a query that returns rows
+func (tx *Tx) Query(query string, args ...interface{}) (*Rows, error) {
+	defer observeQuery(query, time.Now())
+	tx.wrote(query)
+	span := startQuerySpan(tx.ctx, query)
+	ctx, cancel := statementContext(tx.ctx)
+	rows, err := tx.Tx.QueryContext(ctx, store.Rebind(query), args...)
+	if err != nil {
+		endQuerySpan(span, err)
+		cancel()
+		return nil, err
+	}
+	return &Rows{rows, cancel, span}, nil
+}
+
+// QueryRow executes a query that returns at most one row
+func (tx *Tx) QueryRow(query string, args ...interface{}) *Row {
+	defer observeQuery(query, time.Now())
+	tx.wrote(query)
+	span := startQuerySpan(tx.ctx, query)
+	ctx, cancel := statementContext(tx.ctx)
+	return &Row{tx.Tx.QueryRowContext(ctx, store.Rebind(query), args...), cancel, span}
+}
+
+// Rows is the result of a query, holding its statement's timeout and span
+// until closed
+type Rows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+	span   *tracing.Span
+}
+
+// Close closes the rows and releases the statement's timeout and span
+func (r *Rows) Close() error {
+	defer r.cancel()
+	err := r.Rows.Close()
+	endQuerySpan(r.span, cmp.Or(err, r.Rows.Err()))
+	return err
+}
+
+// Row is the result of a single-row query, holding its statement's timeout
+// and span until scanned
+type Row struct {
+	*sql.Row
+	cancel context.CancelFunc
+	span   *tracing.Span
+}
+
+// Scan copies the row's columns into dest and releases the statement's
+// timeout and span
+func (r *Row) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	err := r.Row.Scan(dest...)
+	endQuerySpan(r.span, err)
+	return err
+}
+
+// lookupStore returns the Store registered for a database_driver value
+func lookupStore(driver string) (Store, error) {
+	s, ok := stores[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	return s, nil
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresStore keeps the database in PostgreSQL, so several instances can
+// run behind a load balancer
+type postgresStore struct{}
+
+func (postgresStore) Name() string { return "postgres" }
+
+// Open connects with the session time zone pinned to UTC, so CURRENT_TIMESTAMP
+// matches the UTC timestamps the models compute
+func (postgresStore) Open(dsn string, opts PoolOptions) (*sql.DB, error) {
+	if !strings.Contains(dsn, "timezone") {
+		if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+			q := u.Query()
+			q.Set("timezone", "UTC")
+			u.RawQuery = q.Encode()
+			dsn = u.String()
+		} else {
+			dsn += " timezone=UTC"
+		}
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	opts.apply(db)
+	return db, nil
+}
+
+// Rebind rewrites ? placeholders to $1, $2, ..., leaving quoted text alone
+func (postgresStore) Rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(query) + 8)
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+			sb.WriteRune(r)
+		case r == '?' && !inString:
+			n++
+			sb.WriteByte('$')
+			sb.WriteString(strconv.Itoa(n))
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+var (
+	autoincrementPattern = regexp.MustCompile(`(?i)\bINTEGER PRIMARY KEY AUTOINCREMENT\b`)
+	integerPattern       = regexp.MustCompile(`(?i)\bINTEGER\b`)
+	datetimePattern      = regexp.MustCompile(`(?i)\bDATETIME\b`)
+)
+
+// TranslateDDL maps SQLite column types to PostgreSQL. SQLite integers are
+// 64-bit, so INTEGER becomes BIGINT; boolean flags stay integers so the
+// models' "= 0" comparisons work unchanged.
+func (postgresStore) TranslateDDL(ddl string) string {
+	ddl = autoincrementPattern.ReplaceAllString(ddl, "BIGSERIAL PRIMARY KEY")
+	ddl = integerPattern.ReplaceAllString(ddl, "BIGINT")
+	return datetimePattern.ReplaceAllString(ddl, "TIMESTAMP")
+}
+
+func (postgresStore) ColumnExists(ctx context.Context, table, column string) (bool, error) {
+	var exists bool
+	err := DB.QueryRow(
+		ctx, `SELECT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?)`,
+		table, column,
+	).Scan(&exists)
+	return exists, err
+}
+
+// pgDocument is the searchable text of an upload. It is computed at query
+// time, so there is no separate index to keep in sync.
+const pgDocument = `to_tsvector('simple', u.original_filename || ' ' || u.title || ' ' || u.description || ' ' ||
+	COALESCE((SELECT string_agg(t.name, ' ') FROM upload_tags ut JOIN tags t ON t.id = ut.tag_id WHERE ut.upload_id = u.id), ''))`
+
+// optimize leaves upkeep to PostgreSQL's autovacuum daemon, which also keeps
+// planner statistics current
+func (postgresStore) optimize(ctx context.Context) error { return nil }
+
+func (postgresStore) createSearchIndex(ctx context.Context) (bool, error) { return true, nil }
+
+func (postgresStore) rebuildSearchIndex(ctx context.Context) error { return nil }
+
+func (postgresStore) indexUpload(ctx context.Context, uploadID int64) error { return nil }
+
+func (postgresStore) unindexUpload(tx *Tx, uploadID int64) error { return nil }
+
+func (postgresStore) searchUploads(ctx context.Context, guildID string, terms []string, limit, offset int) ([]Upload, int, error) {
+	query := strings.Join(terms, " & ") + ":*"
+
+	var total int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM uploads u WHERE "+pgDocument+" @@ to_tsquery('simple', ?) AND u.guild_id = ? AND "+visibleUploadCondition,
+		query, guildID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	uploads, err := queryUploads(
+		ctx, uploadSelect+`
+		WHERE `+pgDocument+` @@ to_tsquery('simple', ?) AND u.guild_id = ? AND `+visibleUploadCondition+`
+		ORDER BY ts_rank(`+pgDocument+`, to_tsquery('simple', ?)) DESC, u.id DESC
+		LIMIT ? OFFSET ?`,
+		query, guildID, query, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return uploads, total, nil
+}
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps the database in a single SQLite file. It suits a single
+// instance; use postgresStore to run several instances against one database.
+type sqliteStore struct{}
+
+func (sqliteStore) Name() string { return "sqlite" }
+
+// Open sets up every connection for concurrent use: the write-ahead log lets
+// reads continue during a write, transactions take the write lock when they
+// begin so two of them can't deadlock upgrading their locks, and a
+// connection that finds the database locked waits up to opts.BusyTimeout for
+// it. Foreign keys are enforced, as they are by PostgreSQL. New databases
+// are created with incremental auto-vacuum, so optimize can hand freed pages
+// back to the file system.
+func (sqliteStore) Open(dsn string, opts PoolOptions) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", sqliteDSN(dsn, opts.BusyTimeout))
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to :memory: gets its own empty database, so keep
+	// exactly one open for the life of the process
+	if dsn == ":memory:" {
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		return db, nil
+	}
+	opts.apply(db)
+	return db, nil
+}
+
+// sqliteDSN adds the connection settings Open describes to dsn, leaving any
+// the DSN already sets alone
+func sqliteDSN(dsn string, busyTimeout time.Duration) string {
+	settings := [][2]string{
+		{"_journal_mode", "WAL"},
+		{"_synchronous", "NORMAL"},
+		{"_busy_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10)},
+		{"_foreign_keys", "1"},
+		{"_txlock", "immediate"},
+		{"_auto_vacuum", "incremental"},
+	}
+	path, query, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return dsn
+	}
+	for _, s := range settings {
+		if !params.Has(s[0]) {
+			params.Set(s[0], s[1])
+		}
+	}
+	return path + "?" + params.Encode()
+}
+
+// optimize refreshes the query planner's statistics and, for databases
+// created with incremental auto-vacuum, truncates the pages freed by deletes
+// from the end of the file
+func (sqliteStore) optimize(ctx context.Context) error {
+	if _, err := DB.Exec(ctx, "PRAGMA optimize"); err != nil {
+		return err
+	}
+	var mode int
+	if err := DB.QueryRow(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode != sqliteIncrementalVacuum {
+		return nil
+	}
+	_, err := DB.Exec(ctx, "PRAGMA incremental_vacuum")
+	return err
+}
+
+// sqliteIncrementalVacuum is the auto_vacuum pragma's value for incremental
+// mode
+const sqliteIncrementalVacuum = 2
+
+func (sqliteStore) Rebind(query string) string { return query }
+
+func (sqliteStore) TranslateDDL(ddl string) string { return ddl }
+
+func (sqliteStore) ColumnExists(ctx context.Context, table, column string) (bool, error) {
+	rows, err := DB.Query(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// createSearchIndex creates the FTS5 index over upload metadata, backfilling it
+// from existing uploads. Search is unavailable if SQLite was built without FTS5.
+func (s sqliteStore) createSearchIndex(ctx context.Context) (bool, error) {
+	_, err := DB.Exec(ctx, `CREATE VIRTUAL TABLE IF NOT EXISTS uploads_fts USING fts5(
+		original_filename, title, description, tags,
+		tokenize = 'unicode61 remove_diacritics 2'
+	)`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			log.Printf("Warning: SQLite was built without FTS5 (build with -tags sqlite_fts5); search is disabled")
+			return false, nil
+		}
+		return false, err
+	}
+
+	var indexed, total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads_fts").Scan(&indexed); err != nil {
+		return false, err
+	}
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM uploads").Scan(&total); err != nil {
+		return false, err
+	}
+	if indexed == 0 && total > 0 {
+		log.Printf("Building search index for %d uploads", total)
+		return true, s.rebuildSearchIndex(ctx)
+	}
+	return true, nil
+}
+
+// ftsDocumentQuery selects the indexed text for uploads; callers append a WHERE clause
+const ftsDocumentQuery = `SELECT u.id, u.original_filename, u.title, u.description,
+	COALESCE((SELECT group_concat(t.name, ' ') FROM upload_tags ut JOIN tags t ON t.id = ut.tag_id WHERE ut.upload_id = u.id), '')
+	FROM uploads u`
+
+func (sqliteStore) rebuildSearchIndex(ctx context.Context) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM uploads_fts"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO uploads_fts (rowid, original_filename, title, description, tags) " + ftsDocumentQuery); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sqliteStore) indexUpload(ctx context.Context, uploadID int64) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM uploads_fts WHERE rowid = ?", uploadID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO uploads_fts (rowid, original_filename, title, description, tags) "+ftsDocumentQuery+" WHERE u.id = ?",
+		uploadID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sqliteStore) unindexUpload(tx *Tx, uploadID int64) error {
+	_, err := tx.Exec("DELETE FROM uploads_fts WHERE rowid = ?", uploadID)
+	return err
+}
+
+func (sqliteStore) searchUploads(ctx context.Context, guildID string, terms []string, limit, offset int) ([]Upload, int, error) {
+	match := ftsMatchQuery(terms)
+
+	var total int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM uploads_fts f JOIN uploads u ON u.id = f.rowid WHERE uploads_fts MATCH ? AND u.guild_id = ? AND "+visibleUploadCondition,
+		match, guildID,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	uploads, err := queryUploads(
+		ctx, uploadSelect+`
+		JOIN uploads_fts f ON f.rowid = u.id
+		WHERE uploads_fts MATCH ? AND u.guild_id = ? AND `+visibleUploadCondition+`
+		ORDER BY bm25(uploads_fts), u.id DESC
+		LIMIT ? OFFSET ?`,
+		match, guildID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	return uploads, total, nil
+}
+
+// ftsMatchQuery builds an FTS5 query requiring every term, with the last
+// term matched as a prefix
+func ftsMatchQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + term + `"`
+	}
+	quoted[len(quoted)-1] += "*"
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	MaxTagsPerUpload = 10
+	MaxTagLength     = 32
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9 _-]*$`)
+
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTags lowercases, trims and de-duplicates tag names, rejecting
+// names that are too long or contain unsupported characters
+func NormalizeTags(raw []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var tags []string
+
+	for _, name := range raw {
+		name = strings.Join(strings.Fields(strings.ToLower(name)), " ")
+		if name == "" || seen[name] {
+			continue
+		}
+		if len(name) > MaxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", name, MaxTagLength)
+		}
+		if !tagPattern.MatchString(name) {
+			return nil, fmt.Errorf("tag %q may only contain letters, numbers, spaces, dashes and underscores", name)
+		}
+		seen[name] = true
+		tags = append(tags, name)
+	}
+
+	if len(tags) > MaxTagsPerUpload {
+		return nil, fmt.Errorf("at most %d tags are allowed", MaxTagsPerUpload)
+	}
+	return tags, nil
+}
+
+// SetUploadTags replaces the tags attached to an upload
+func SetUploadTags(ctx context.Context, uploadID int64, tags []string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceUploadTags(tx, uploadID, tags); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetTags()
+
+	return IndexUpload(ctx, uploadID)
+}
+
+// replaceUploadTags replaces the tags attached to an upload as part of tx
+func replaceUploadTags(tx *Tx, uploadID int64, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM upload_tags WHERE upload_id = ?", uploadID); err != nil {
+		return err
+	}
+
+	for _, name := range tags {
+		if _, err := tx.Exec("INSERT INTO tags (name) VALUES (?) ON CONFLICT DO NOTHING", name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO upload_tags (upload_id, tag_id) SELECT ?, id FROM tags WHERE name = ? ON CONFLICT DO NOTHING",
+			uploadID, name,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUploadTags returns the tag names attached to an upload
+func GetUploadTags(ctx context.Context, uploadID int64) ([]string, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT t.name FROM tags t JOIN upload_tags ut ON ut.tag_id = t.id WHERE ut.upload_id = ? ORDER BY t.name",
+		uploadID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, name)
+	}
+	return tags, rows.Err()
+}
+
+// SearchTags returns tags starting with prefix, most used first
+func SearchTags(ctx context.Context, prefix string, limit int) ([]Tag, error) {
+	prefix = strings.ToLower(prefix)
+	key := fmt.Sprintf("%s|%d", prefix, limit)
+	if tags, ok := tagSearchCache.Get(key); ok {
+		return slices.Clone(tags), nil
+	}
+
+	rows, err := DB.Query(
+		ctx, `SELECT t.name, COUNT(ut.upload_id) AS uses
+		FROM tags t LEFT JOIN upload_tags ut ON ut.tag_id = t.id
+		WHERE t.name LIKE ? ESCAPE '\'
+		GROUP BY t.id
+		ORDER BY uses DESC, t.name
+		LIMIT ?`,
+		escapeLike(prefix)+"%", limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	tagSearchCache.Set(key, slices.Clone(tags))
+	return tags, nil
+}
+
+// loadTags attaches tag names to each upload in the slice
+func loadTags(ctx context.Context, uploads []Upload) error {
+	for i := range uploads {
+		tags, err := GetUploadTags(ctx, uploads[i].ID)
+		if err != nil {
+			return err
+		}
+		uploads[i].Tags = tags
+	}
+	return nil
+}
+
+func escapeLike(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(s)
+}
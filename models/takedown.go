@@ -0,0 +1,137 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	TakedownPending  = "pending"
+	TakedownApproved = "approved"
+	TakedownRejected = "rejected"
+)
+
+type TakedownRequest struct {
+	ID             int64
+	UploadID       int64
+	RequesterName  string
+	RequesterEmail string
+	Reason         string
+	ProofLinks     string
+	Status         string
+	AdminNote      string
+	TokenHash      string
+	CreatedAt      time.Time
+	ResolvedAt     sql.NullTime
+}
+
+// CreateTakedownRequest records a takedown request and freezes the upload
+// until an admin reviews it
+func CreateTakedownRequest(ctx context.Context, req *TakedownRequest) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO takedown_requests (upload_id, requester_name, requester_email, reason, proof_links, status, token_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		req.UploadID, req.RequesterName, req.RequesterEmail, req.Reason, req.ProofLinks, TakedownPending, req.TokenHash,
+	).Scan(&req.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE uploads SET frozen = 1 WHERE id = ?", req.UploadID); err != nil {
+		return err
+	}
+
+	req.Status = TakedownPending
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetPools()
+	return nil
+}
+
+const takedownColumns = `id, upload_id, requester_name, requester_email, reason, proof_links, status, admin_note, token_hash, created_at, resolved_at`
+
+func scanTakedown(row rowScanner) (*TakedownRequest, error) {
+	t := &TakedownRequest{}
+	err := row.Scan(&t.ID, &t.UploadID, &t.RequesterName, &t.RequesterEmail, &t.Reason, &t.ProofLinks,
+		&t.Status, &t.AdminNote, &t.TokenHash, &t.CreatedAt, &t.ResolvedAt)
+	return t, err
+}
+
+// GetTakedownRequest returns a takedown request by ID
+func GetTakedownRequest(ctx context.Context, id int64) (*TakedownRequest, error) {
+	return scanTakedown(DB.QueryRow(ctx, "SELECT "+takedownColumns+" FROM takedown_requests WHERE id = ?", id))
+}
+
+// GetTakedownRequestByToken returns the takedown request whose status token hashes to tokenHash
+func GetTakedownRequestByToken(ctx context.Context, tokenHash string) (*TakedownRequest, error) {
+	return scanTakedown(DB.QueryRow(ctx, "SELECT "+takedownColumns+" FROM takedown_requests WHERE token_hash = ?", tokenHash))
+}
+
+// ListTakedownRequests returns takedown requests with the given status, oldest first
+func ListTakedownRequests(ctx context.Context, status string, limit, offset int) ([]TakedownRequest, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT "+takedownColumns+" FROM takedown_requests WHERE status = ? ORDER BY created_at, id LIMIT ? OFFSET ?",
+		status, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []TakedownRequest{}
+	for rows.Next() {
+		t, err := scanTakedown(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *t)
+	}
+	return requests, rows.Err()
+}
+
+// ResolveTakedownRequest marks a pending request approved or rejected. Approved
+// takedowns leave the upload frozen; rejected ones unfreeze it unless another
+// request for the same upload is still pending.
+func ResolveTakedownRequest(ctx context.Context, id int64, status, adminNote string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var uploadID int64
+	err = tx.QueryRow(
+		`UPDATE takedown_requests SET status = ?, admin_note = ?, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ? RETURNING upload_id`,
+		status, adminNote, id, TakedownPending,
+	).Scan(&uploadID)
+	if err != nil {
+		return err
+	}
+
+	if status == TakedownRejected {
+		_, err = tx.Exec(
+			`UPDATE uploads SET frozen = 0 WHERE id = ? AND NOT EXISTS (
+				SELECT 1 FROM takedown_requests WHERE upload_id = ? AND status IN (?, ?)
+			)`,
+			uploadID, uploadID, TakedownPending, TakedownApproved,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetPools()
+	return nil
+}
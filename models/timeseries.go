@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Metrics kept for every UTC day in the daily_stats rollup
+const (
+	MetricUploads     = "uploads"
+	MetricPulls       = "pulls"
+	MetricNewUsers    = "new_users"
+	MetricBytesStored = "bytes_stored"
+)
+
+// TimeSeriesMetrics lists the metrics a time series can be asked for
+var TimeSeriesMetrics = []string{MetricUploads, MetricPulls, MetricNewUsers, MetricBytesStored}
+
+// DailyValue is the value of a metric on one UTC day, given as YYYY-MM-DD
+type DailyValue struct {
+	Day   string
+	Value int64
+}
+
+// RollUpDailyStats recomputes the daily_stats row of each UTC day from from
+// to to, inclusive. Uploads, pulls and new users are counted from the raw
+// tables; bytes stored is the size of the stored files created by the end of
+// the day, so days rolled up after files were purged count less than they
+// held at the time.
+func RollUpDailyStats(ctx context.Context, from, to time.Time) error {
+	for day := truncateDay(from); !day.After(to); day = day.AddDate(0, 0, 1) {
+		start, end := day.Format(timestampFormat), day.AddDate(0, 0, 1).Format(timestampFormat)
+
+		var uploads, pulls, newUsers, bytesStored int64
+		err := DB.QueryRow(ctx, `SELECT
+			(SELECT COUNT(*) FROM uploads WHERE uploaded_at >= ? AND uploaded_at < ?),
+			(SELECT COUNT(*) FROM pulls WHERE pulled_at >= ? AND pulled_at < ? AND `+countedPullCondition+`),
+			(SELECT COUNT(*) FROM users WHERE created_at >= ? AND created_at < ?),
+			(SELECT COALESCE(SUM(file_size), 0) FROM blobs WHERE created_at < ?)`,
+			start, end, start, end, start, end, end,
+		).Scan(&uploads, &pulls, &newUsers, &bytesStored)
+		if err != nil {
+			return err
+		}
+
+		if _, err := DB.Exec(
+			ctx, `INSERT INTO daily_stats (day, uploads, pulls, new_users, bytes_stored, updated_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT (day) DO UPDATE SET uploads = excluded.uploads, pulls = excluded.pulls, new_users = excluded.new_users,
+			bytes_stored = excluded.bytes_stored, updated_at = excluded.updated_at`,
+			day.Format(time.DateOnly), uploads, pulls, newUsers, bytesStored,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DailyStatsStart returns the day the rollup should resume from: the last
+// day rolled up, which may have been partial, or the day of the first user
+// or upload when nothing has been rolled up yet. ok is false when there is
+// nothing to roll up at all.
+func DailyStatsStart(ctx context.Context) (day time.Time, ok bool, err error) {
+	var last sql.NullString
+	if err := DB.QueryRow(ctx, "SELECT MAX(day) FROM daily_stats").Scan(&last); err != nil {
+		return time.Time{}, false, err
+	}
+	if !last.Valid {
+		err := DB.QueryRow(ctx, `SELECT MIN(day) FROM (
+			SELECT MIN(`+dayOf("created_at")+`) AS day FROM users
+			UNION ALL SELECT MIN(`+dayOf("uploaded_at")+`) AS day FROM uploads) d`).Scan(&last)
+		if err != nil || !last.Valid {
+			return time.Time{}, false, err
+		}
+	}
+	day, err = time.Parse(time.DateOnly, last.String)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return day, true, nil
+}
+
+// ListDailyStats returns the rolled-up value of a metric, one of
+// TimeSeriesMetrics, for each day from from to to that has been rolled up,
+// oldest first
+func ListDailyStats(ctx context.Context, metric string, from, to time.Time) ([]DailyValue, error) {
+	if !slices.Contains(TimeSeriesMetrics, metric) {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+	rows, err := DB.Query(
+		ctx, "SELECT day, "+metric+" FROM daily_stats WHERE day >= ? AND day <= ? ORDER BY day",
+		from.UTC().Format(time.DateOnly), to.UTC().Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []DailyValue{}
+	for rows.Next() {
+		var v DailyValue
+		if err := rows.Scan(&v.Day, &v.Value); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// truncateDay returns the start of the UTC day of t
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,352 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Trade statuses
+const (
+	TradePending   = "pending"
+	TradeAccepted  = "accepted"
+	TradeDeclined  = "declined"
+	TradeCancelled = "cancelled"
+	TradeExpired   = "expired"
+)
+
+var (
+	// ErrTradeClosed is returned when answering a trade that was already
+	// accepted, declined, cancelled or has expired
+	ErrTradeClosed = errors.New("trade is no longer pending")
+	// ErrNoSpareCopy is returned when the sender doesn't hold a duplicate of
+	// the wallpaper they offer
+	ErrNoSpareCopy = errors.New("no spare copy of the offered wallpaper")
+	// ErrNoSpareRequested is returned when the recipient doesn't hold a
+	// duplicate of the wallpaper asked for in return
+	ErrNoSpareRequested = errors.New("no spare copy of the requested wallpaper")
+)
+
+// Trade is an offer of a spare copy of a wallpaper to another user,
+// optionally asking for a spare copy of one of theirs in return. Only
+// duplicates can be traded, so nobody trades away the last copy of a
+// wallpaper in their collection.
+type Trade struct {
+	ID                int64
+	SenderID          string
+	SenderName        string
+	RecipientID       string
+	RecipientName     string
+	OfferedUploadID   int64
+	RequestedUploadID sql.NullInt64
+	Status            string
+	CreatedAt         time.Time
+	ExpiresAt         time.Time
+	ResolvedAt        sql.NullTime
+
+	Offered   Upload
+	Requested *Upload
+}
+
+const tradeSelect = `SELECT t.id, t.sender_id, s.username, t.recipient_id, r.username, t.offered_upload_id, t.requested_upload_id,
+	t.status, t.created_at, t.expires_at, t.resolved_at
+	FROM trades t JOIN users s ON s.discord_id = t.sender_id JOIN users r ON r.discord_id = t.recipient_id`
+
+// pendingTradeCondition selects trades that can still be answered
+const pendingTradeCondition = "t.status = '" + TradePending + "' AND t.expires_at > ?"
+
+func scanTrade(row rowScanner) (*Trade, error) {
+	t := &Trade{}
+	err := row.Scan(&t.ID, &t.SenderID, &t.SenderName, &t.RecipientID, &t.RecipientName, &t.OfferedUploadID, &t.RequestedUploadID,
+		&t.Status, &t.CreatedAt, &t.ExpiresAt, &t.ResolvedAt)
+	return t, err
+}
+
+// CurrentStatus returns the trade's status, reporting pending trades past
+// their expiry as expired before they are swept
+func (t *Trade) CurrentStatus() string {
+	if t.Status == TradePending && !time.Now().Before(t.ExpiresAt) {
+		return TradeExpired
+	}
+	return t.Status
+}
+
+// spareCopies returns how many copies beyond the first the user holds of a
+// wallpaper still in the gallery
+func spareCopies(tx *Tx, discordID string, uploadID int64) (int, error) {
+	var copies int
+	err := tx.QueryRow(
+		`SELECT COUNT(*) FROM pulls p JOIN uploads u ON u.id = p.upload_id
+		WHERE p.discord_id = ? AND p.upload_id = ? AND p.discarded = 0 AND u.deleted_at IS NULL`,
+		discordID, uploadID,
+	).Scan(&copies)
+	return max(copies-1, 0), err
+}
+
+// CreateTrade records a trade offer that expires after ttl and sets its ID,
+// status and times. It returns ErrNoSpareCopy or ErrNoSpareRequested when
+// either side has no duplicate to give.
+func CreateTrade(ctx context.Context, t *Trade, ttl time.Duration) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if spare, err := spareCopies(tx, t.SenderID, t.OfferedUploadID); err != nil {
+		return err
+	} else if spare == 0 {
+		return ErrNoSpareCopy
+	}
+	if t.RequestedUploadID.Valid {
+		if spare, err := spareCopies(tx, t.RecipientID, t.RequestedUploadID.Int64); err != nil {
+			return err
+		} else if spare == 0 {
+			return ErrNoSpareRequested
+		}
+	}
+
+	expires := time.Now().Add(ttl).UTC()
+	err = tx.QueryRow(
+		`INSERT INTO trades (sender_id, recipient_id, offered_upload_id, requested_upload_id, expires_at)
+		VALUES (?, ?, ?, ?, ?) RETURNING id, status, created_at, expires_at`,
+		t.SenderID, t.RecipientID, t.OfferedUploadID, t.RequestedUploadID, expires.Format(timestampFormat),
+	).Scan(&t.ID, &t.Status, &t.CreatedAt, &t.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetTrade returns a trade the user sent or received along with its
+// wallpapers, or sql.ErrNoRows if there is no such trade
+func GetTrade(ctx context.Context, id int64, discordID string) (*Trade, error) {
+	t, err := scanTrade(DB.QueryRow(ctx, tradeSelect+" WHERE t.id = ? AND (t.sender_id = ? OR t.recipient_id = ?)", id, discordID, discordID))
+	if err != nil {
+		return nil, err
+	}
+	if err := loadTradeUploads(ctx, []*Trade{t}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTrades returns a page of the trades the user sent or received, newest
+// first, along with the total number. With inbox set it lists only offers
+// received that are still waiting for an answer.
+func ListTrades(ctx context.Context, discordID string, inbox bool, limit, offset int) ([]*Trade, int, error) {
+	where := " WHERE (t.sender_id = ? OR t.recipient_id = ?)"
+	args := []interface{}{discordID, discordID}
+	if inbox {
+		where = " WHERE t.recipient_id = ? AND " + pendingTradeCondition
+		args = []interface{}{discordID, time.Now().UTC().Format(timestampFormat)}
+	}
+
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM trades t"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(ctx, tradeSelect+where+" ORDER BY t.id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	trades := []*Trade{}
+	for rows.Next() {
+		t, err := scanTrade(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		trades = append(trades, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	if err := loadTradeUploads(ctx, trades); err != nil {
+		return nil, 0, err
+	}
+	return trades, total, nil
+}
+
+// loadTradeUploads fills in the wallpapers of each trade, including ones
+// deleted since the offer was made
+func loadTradeUploads(ctx context.Context, trades []*Trade) error {
+	var ids []int64
+	for _, t := range trades {
+		ids = append(ids, t.OfferedUploadID)
+		if t.RequestedUploadID.Valid {
+			ids = append(ids, t.RequestedUploadID.Int64)
+		}
+	}
+	byID, err := uploadsByID(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, t := range trades {
+		t.Offered = byID[t.OfferedUploadID]
+		if t.RequestedUploadID.Valid {
+			u := byID[t.RequestedUploadID.Int64]
+			t.Requested = &u
+		}
+	}
+	return nil
+}
+
+// AcceptTrade completes a pending trade offered to the user, moving a copy
+// of each traded wallpaper between the two collections in one transaction.
+// It returns sql.ErrNoRows if the user received no such trade,
+// ErrTradeClosed if it can no longer be answered, and ErrNoSpareCopy or
+// ErrNoSpareRequested if either side has since lost their spare copy.
+func AcceptTrade(ctx context.Context, id int64, recipientID string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(timestampFormat)
+	res, err := tx.Exec(
+		"UPDATE trades SET status = ?, resolved_at = ? WHERE id = ? AND recipient_id = ? AND status = ? AND expires_at > ?",
+		TradeAccepted, now, id, recipientID, TradePending, now,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return tradeRefusal(tx, id, "recipient_id", recipientID)
+	}
+
+	t, err := scanTrade(tx.QueryRow(tradeSelect+" WHERE t.id = ?", id))
+	if err != nil {
+		return err
+	}
+	if err := transferCopy(tx, t.SenderID, t.RecipientID, t.OfferedUploadID); err == ErrNoSpareCopy {
+		return ErrNoSpareCopy
+	} else if err != nil {
+		return err
+	}
+	if t.RequestedUploadID.Valid {
+		if err := transferCopy(tx, t.RecipientID, t.SenderID, t.RequestedUploadID.Int64); err == ErrNoSpareCopy {
+			return ErrNoSpareRequested
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// transferCopy discards the giver's most recent copy of a wallpaper and adds
+// one to the receiver's collection as a trade pull. It returns ErrNoSpareCopy
+// unless the giver holds a duplicate.
+func transferCopy(tx *Tx, from, to string, uploadID int64) error {
+	spare, err := spareCopies(tx, from, uploadID)
+	if err != nil {
+		return err
+	}
+	if spare == 0 {
+		return ErrNoSpareCopy
+	}
+
+	// Discarding only if the row is still held keeps two trades accepted at
+	// once from giving away the same copy
+	res, err := tx.Exec(
+		`UPDATE pulls SET discarded = 1 WHERE discarded = 0 AND id = (
+			SELECT id FROM pulls WHERE discord_id = ? AND upload_id = ? AND discarded = 0 ORDER BY id DESC LIMIT 1)`,
+		from, uploadID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNoSpareCopy
+	}
+
+	p := &Pull{DiscordID: to, UploadID: uploadID, Source: PullSourceTrade}
+	duplicate, err := markDuplicate(tx, p)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO pulls (discord_id, upload_id, source, duplicate) VALUES (?, ?, ?, ?)",
+		p.DiscordID, p.UploadID, p.Source, duplicate,
+	); err != nil {
+		return err
+	}
+	return claimWishlist(tx, p)
+}
+
+// DeclineTrade turns down a pending trade offered to the user. It returns
+// sql.ErrNoRows if the user received no such trade and ErrTradeClosed if it
+// can no longer be answered.
+func DeclineTrade(ctx context.Context, id int64, recipientID string) error {
+	return closeTrade(ctx, id, "recipient_id", recipientID, TradeDeclined)
+}
+
+// CancelTrade withdraws a pending trade the user offered. It returns
+// sql.ErrNoRows if the user sent no such trade and ErrTradeClosed if it can
+// no longer be withdrawn.
+func CancelTrade(ctx context.Context, id int64, senderID string) error {
+	return closeTrade(ctx, id, "sender_id", senderID, TradeCancelled)
+}
+
+// closeTrade moves a pending trade to status on behalf of the sender or
+// recipient, named by party
+func closeTrade(ctx context.Context, id int64, party, discordID, status string) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(timestampFormat)
+	res, err := tx.Exec(
+		"UPDATE trades SET status = ?, resolved_at = ? WHERE id = ? AND "+party+" = ? AND status = ? AND expires_at > ?",
+		status, now, id, discordID, TradePending, now,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return tradeRefusal(tx, id, party, discordID)
+	}
+	return tx.Commit()
+}
+
+// tradeRefusal works out why a trade couldn't be answered
+func tradeRefusal(tx *Tx, id int64, party, discordID string) error {
+	var exists int
+	err := tx.QueryRow("SELECT COUNT(*) FROM trades WHERE id = ? AND "+party+" = ?", id, discordID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+	return ErrTradeClosed
+}
+
+// ExpireTrades marks pending trades past their expiry as expired, returning
+// how many were
+func ExpireTrades(ctx context.Context) (int64, error) {
+	now := time.Now().UTC().Format(timestampFormat)
+	res, err := DB.Exec(
+		ctx, "UPDATE trades SET status = ?, resolved_at = ? WHERE status = ? AND expires_at <= ?",
+		TradeExpired, now, TradePending, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Errors returned when an upload can't be reassigned or merged
+var (
+	ErrUnknownUser = errors.New("user has never signed in")
+	ErrLinkedUser  = errors.New("user is linked to another account")
+	ErrMergeSelf   = errors.New("upload merged into itself")
+	ErrMergeTarget = errors.New("upload to merge into is in the trash")
+)
+
+// ReassignUpload makes another user the owner of an upload and returns its
+// previous owner. With dryRun the change is checked but rolled back. Users
+// linked to another account can't be given uploads, as they would disappear
+// from view.
+func ReassignUpload(ctx context.Context, id int64, toID string, dryRun bool) (string, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var fromID string
+	if err := tx.QueryRow("SELECT discord_id FROM uploads WHERE id = ?", id).Scan(&fromID); err != nil {
+		return "", err
+	}
+	var linkedTo sql.NullString
+	if err := tx.QueryRow("SELECT linked_to FROM users WHERE discord_id = ?", toID).Scan(&linkedTo); err == sql.ErrNoRows {
+		return "", ErrUnknownUser
+	} else if err != nil {
+		return "", err
+	}
+	if linkedTo.String != "" {
+		return "", ErrLinkedUser
+	}
+
+	// The retry key belonged to the previous owner's request
+	if _, err := tx.Exec("UPDATE uploads SET discord_id = ?, retry_key = NULL WHERE id = ?", toID, id); err != nil {
+		return "", err
+	}
+	if dryRun {
+		return fromID, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	forgetPools()
+	return fromID, IndexUpload(ctx, id)
+}
+
+// UploadMerge counts the rows merging one upload into another moved over.
+// Rows the target already had, such as likes by users who liked both, are
+// dropped rather than moved.
+type UploadMerge struct {
+	Pulls     int64
+	Likes     int64
+	Wishlists int64
+	Showcases int64
+	Banners   int64
+	Seasons   int64
+	Trades    int64
+	Tags      int64
+}
+
+// MergeUploads folds an accidentally duplicated upload into the canonical
+// one: the pulls in users' collections, likes, wishlists, showcases, banners,
+// seasons, trades and notifications referring to it are repointed to the
+// target, which also gains its tags, views and downloads. The merged upload
+// is moved to the trash and marked as a duplicate of the target, so purging
+// it releases its file. With dryRun everything is done but rolled back, to
+// report what a merge would move.
+func MergeUploads(ctx context.Context, sourceID, targetID int64, dryRun bool) (*UploadMerge, error) {
+	if sourceID == targetID {
+		return nil, ErrMergeSelf
+	}
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT 1 FROM uploads WHERE id = ?", sourceID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	var targetDeleted sql.NullTime
+	if err := tx.QueryRow("SELECT deleted_at FROM uploads WHERE id = ?", targetID).Scan(&targetDeleted); err != nil {
+		return nil, err
+	}
+	if targetDeleted.Valid {
+		return nil, ErrMergeTarget
+	}
+
+	var merge UploadMerge
+	moves := []struct {
+		table, column, key string
+		count              *int64
+	}{
+		{"pulls", "upload_id", "", &merge.Pulls},
+		{"likes", "upload_id", "discord_id", &merge.Likes},
+		{"wishlists", "upload_id", "discord_id", &merge.Wishlists},
+		{"showcases", "upload_id", "discord_id", &merge.Showcases},
+		{"banner_uploads", "upload_id", "banner_id", &merge.Banners},
+		{"season_uploads", "upload_id", "season_id", &merge.Seasons},
+		{"trades", "offered_upload_id", "", &merge.Trades},
+		{"trades", "requested_upload_id", "", &merge.Trades},
+		{"notifications", "upload_id", "", nil},
+	}
+	for _, m := range moves {
+		n, err := moveUploadReferences(tx, m.table, m.column, m.key, sourceID, targetID)
+		if err != nil {
+			return nil, err
+		}
+		if m.count != nil {
+			*m.count += n
+		}
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO upload_tags (upload_id, tag_id) SELECT ?, tag_id FROM upload_tags WHERE upload_id = ? ON CONFLICT DO NOTHING",
+		targetID, sourceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if merge.Tags, err = result.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE uploads SET like_count = (SELECT COUNT(*) FROM likes WHERE upload_id = ?),
+		view_count = view_count + (SELECT view_count FROM uploads WHERE id = ?),
+		download_count = download_count + (SELECT download_count FROM uploads WHERE id = ?)
+		WHERE id = ?`,
+		targetID, sourceID, sourceID, targetID,
+	); err != nil {
+		return nil, err
+	}
+	// Its recent activity goes too, so the target trends with it
+	if _, err := tx.Exec(
+		`INSERT INTO upload_activity (upload_id, hour, views, downloads)
+		SELECT ?, hour, views, downloads FROM upload_activity WHERE upload_id = ?
+		ON CONFLICT (upload_id, hour) DO UPDATE SET
+			views = upload_activity.views + excluded.views, downloads = upload_activity.downloads + excluded.downloads`,
+		targetID, sourceID,
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM upload_activity WHERE upload_id = ?", sourceID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE uploads SET duplicate_of = ?, deleted_at = COALESCE(deleted_at, ?), like_count = 0, view_count = 0, download_count = 0 WHERE id = ?",
+		targetID, time.Now().UTC().Format(timestampFormat), sourceID,
+	); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return &merge, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	forgetPools()
+	forgetTags()
+	return &merge, IndexUpload(ctx, targetID)
+}
+
+// moveUploadReferences repoints a table's rows from one upload to another
+// and returns how many it moved. When key is set, rows sharing it with one
+// of the target's, which its primary key wouldn't allow twice, are dropped.
+func moveUploadReferences(tx *Tx, table, column, key string, sourceID, targetID int64) (int64, error) {
+	if key != "" {
+		if _, err := tx.Exec(
+			"DELETE FROM "+table+" WHERE "+column+" = ? AND "+key+" IN (SELECT "+key+" FROM "+table+" WHERE "+column+" = ?)",
+			sourceID, targetID,
+		); err != nil {
+			return 0, err
+		}
+	}
+	result, err := tx.Exec("UPDATE "+table+" SET "+column+" = ? WHERE "+column+" = ?", targetID, sourceID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
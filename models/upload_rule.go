@@ -0,0 +1,76 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// UploadRule is a content policy check an admin added at runtime, on top of
+// those in upload_rules. Which fields apply depends on Type.
+type UploadRule struct {
+	ID         int64
+	Name       string
+	Type       string
+	Pattern    string
+	Tag        string
+	MinWidth   int
+	MinHeight  int
+	BannerID   int64
+	MaxUploads int
+	Message    string
+	CreatedBy  string
+	CreatedAt  time.Time
+}
+
+// ListUploadRules returns the upload rules added at runtime, oldest first
+func ListUploadRules(ctx context.Context) ([]UploadRule, error) {
+	rows, err := DB.Query(
+		ctx, `SELECT id, name, type, pattern, tag, min_width, min_height, banner_id, max_uploads, message, created_by, created_at
+		FROM upload_rules ORDER BY id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []UploadRule{}
+	for rows.Next() {
+		var r UploadRule
+		if err := rows.Scan(&r.ID, &r.Name, &r.Type, &r.Pattern, &r.Tag, &r.MinWidth, &r.MinHeight, &r.BannerID, &r.MaxUploads, &r.Message, &r.CreatedBy, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// CreateUploadRule stores a new upload rule and sets its ID and creation
+// time
+func CreateUploadRule(ctx context.Context, r *UploadRule) error {
+	return DB.QueryRow(
+		ctx, `INSERT INTO upload_rules (name, type, pattern, tag, min_width, min_height, banner_id, max_uploads, message, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at`,
+		r.Name, r.Type, r.Pattern, r.Tag, r.MinWidth, r.MinHeight, r.BannerID, r.MaxUploads, r.Message, r.CreatedBy,
+	).Scan(&r.ID, &r.CreatedAt)
+}
+
+// DeleteUploadRule removes an upload rule added at runtime, returning
+// sql.ErrNoRows if there is no such rule
+func DeleteUploadRule(ctx context.Context, id int64) error {
+	result, err := DB.Exec(ctx, "DELETE FROM upload_rules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result)
+}
+
+// CountBannerUploads counts a user's uploads that aren't deleted, were
+// uploaded since the banner started and are featured in it
+func CountBannerUploads(ctx context.Context, b *Banner, discordID string) (int, error) {
+	var n int
+	err := DB.QueryRow(
+		ctx, `SELECT COUNT(*) FROM uploads u WHERE u.discord_id = ? AND u.deleted_at IS NULL AND u.uploaded_at >= ? AND `+bannerFeaturedCondition,
+		discordID, b.StartsAt.UTC().Format(timestampFormat), b.ID, b.ID,
+	).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// UploadSession is a resumable upload being received in chunks. Received is
+// how many bytes of FileSize have arrived so far.
+type UploadSession struct {
+	ID               int64
+	DiscordID        string
+	Filename         string
+	OriginalFilename string
+	Title            string
+	Description      string
+	Tags             []string
+	License          string
+	Visibility       string
+	FileSize         int64
+	Received         int64
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+}
+
+const uploadSessionColumns = `id, discord_id, filename, original_filename, title, description, tags, license, visibility, file_size, received, created_at, expires_at`
+
+func scanUploadSession(row rowScanner) (*UploadSession, error) {
+	s := &UploadSession{}
+	var tags string
+	err := row.Scan(&s.ID, &s.DiscordID, &s.Filename, &s.OriginalFilename, &s.Title, &s.Description, &tags, &s.License, &s.Visibility, &s.FileSize, &s.Received, &s.CreatedAt, &s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	s.Tags = splitDraftTags(tags)
+	return s, nil
+}
+
+// CreateUploadSession stores a new upload session that expires after ttl
+// and sets its ID
+func CreateUploadSession(ctx context.Context, s *UploadSession, ttl time.Duration) error {
+	expires := time.Now().Add(ttl).UTC()
+	return DB.QueryRow(
+		ctx, `INSERT INTO upload_sessions (discord_id, filename, original_filename, title, description, tags, license, visibility, file_size, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at, expires_at`,
+		s.DiscordID, s.Filename, s.OriginalFilename, s.Title, s.Description, strings.Join(s.Tags, ","), s.License, s.Visibility, s.FileSize,
+		expires.Format(timestampFormat),
+	).Scan(&s.ID, &s.CreatedAt, &s.ExpiresAt)
+}
+
+// GetUploadSession returns one of the user's unexpired upload sessions, or
+// sql.ErrNoRows
+func GetUploadSession(ctx context.Context, id int64, discordID string) (*UploadSession, error) {
+	return scanUploadSession(DB.QueryRow(
+		ctx, `SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE id = ? AND discord_id = ? AND expires_at > ?`,
+		id, discordID, time.Now().UTC().Format(timestampFormat),
+	))
+}
+
+// CountUploadSessions returns how many unexpired upload sessions the user has
+func CountUploadSessions(ctx context.Context, discordID string) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		ctx, `SELECT COUNT(*) FROM upload_sessions WHERE discord_id = ? AND expires_at > ?`,
+		discordID, time.Now().UTC().Format(timestampFormat),
+	).Scan(&count)
+	return count, err
+}
+
+// AdvanceUploadSession records that the session has received bytes up to
+// received and pushes its expiry ttl into the future. It returns
+// sql.ErrNoRows when the session is gone or another request moved it on from
+// the offset the caller wrote at.
+func AdvanceUploadSession(ctx context.Context, s *UploadSession, from, received int64, ttl time.Duration) error {
+	now := time.Now().UTC()
+	err := DB.QueryRow(
+		ctx, `UPDATE upload_sessions SET received = ?, expires_at = ?
+		WHERE id = ? AND discord_id = ? AND received = ? AND expires_at > ? RETURNING expires_at`,
+		received, now.Add(ttl).Format(timestampFormat),
+		s.ID, s.DiscordID, from, now.Format(timestampFormat),
+	).Scan(&s.ExpiresAt)
+	if err == nil {
+		s.Received = received
+	}
+	return err
+}
+
+// DeleteUploadSession removes one of the user's upload sessions and returns
+// its partial filename, or sql.ErrNoRows when there is no such session
+func DeleteUploadSession(ctx context.Context, id int64, discordID string) (string, error) {
+	var filename string
+	err := DB.QueryRow(
+		ctx, `DELETE FROM upload_sessions WHERE id = ? AND discord_id = ? RETURNING filename`,
+		id, discordID,
+	).Scan(&filename)
+	return filename, err
+}
+
+// DeleteExpiredUploadSessions removes upload sessions whose expiry has passed
+// and returns their IDs and partial filenames
+func DeleteExpiredUploadSessions(ctx context.Context) ([]int64, []string, error) {
+	rows, err := DB.Query(
+		ctx, `DELETE FROM upload_sessions WHERE expires_at <= ? RETURNING id, filename`,
+		time.Now().UTC().Format(timestampFormat),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var filenames []string
+	for rows.Next() {
+		var id int64
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		filenames = append(filenames, filename)
+	}
+	return ids, filenames, rows.Err()
+}
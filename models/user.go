@@ -1,58 +1,212 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"time"
 )
 
 type User struct {
-	DiscordID    string
-	Username     string
+	DiscordID string
+	Username  string
+	// DisplayName and Avatar are copied from the user's sign-in provider
+	// each time they sign in. Avatar is the hash of a Discord avatar, or the
+	// URL of the avatar for other providers.
+	DisplayName  string
+	Avatar       string
 	CreatedAt    time.Time
 	LastUploadAt sql.NullTime
+	Timezone     string
+	// ProfilePrivate hides the user's profile from other users and keeps
+	// them off the leaderboards
+	ProfilePrivate bool
+	// DeletionRequestedAt is set while the user's account is scheduled for
+	// deletion
+	DeletionRequestedAt sql.NullTime
+	// MaxFileSizeMB is the largest file the user's Discord roles allowed them
+	// to upload when they last signed in, or 0 when none of them raise it
+	MaxFileSizeMB int
+	// RoleCooldownMinutes is the shortest upload cooldown the user's Discord
+	// roles gave them when they last signed in, if any did
+	RoleCooldownMinutes sql.NullInt64
+	// LinkedTo is the primary account this one was merged into, if it was
+	// linked to one; signing in with it signs in to that account
+	LinkedTo string
+	// DiscordDMs is false when the user opted out of notifications by
+	// direct message from the Discord bot
+	DiscordDMs bool
 }
 
 type Upload struct {
-	ID               int
+	ID               int64
 	DiscordID        string
 	Filename         string
 	OriginalFilename string
+	Title            string
+	Description      string
 	FileSize         int64
 	UploadedAt       time.Time
+	PHash            sql.NullInt64
+	DuplicateOf      sql.NullInt64
+	SHA256           string
+	Source           string
+	ExternalID       sql.NullString
+	BlurHash         string
+	License          string
+	Visibility       string
+	GuildID          string
+	Width            int
+	Height           int
+	LikeCount        int
+	Palette          []string
+	Frozen           bool
+	ReportCount      int
+	ReportHidden     bool
+	SafetyStatus     string
+	Rarity           string
+	// RarityVotingEndsAt is set while users vote on the upload's rarity
+	RarityVotingEndsAt sql.NullTime
+	Archived           bool
+	// QualityScore is the image quality check's score from 0 to 100, unset
+	// for files it couldn't decode and uploads stored before it existed
+	QualityScore sql.NullInt64
+	// PoolEnabled is unset while an admin keeps the upload out of the pull
+	// pool
+	PoolEnabled bool
+	// RetryKey is the Idempotency-Key the client sent with the upload, so a
+	// retry of the same request finds it instead of uploading again
+	RetryKey     sql.NullString
+	DeletedAt    sql.NullTime
+	UploaderName string
+	Tags         []string
 }
 
-// GetOrCreateUser retrieves a user or creates one if it doesn't exist
-func GetOrCreateUser(discordID, username string) (*User, error) {
+// GetUser retrieves an existing user. Users are cached for a minute, and the
+// caller gets its own copy.
+func GetUser(ctx context.Context, discordID string) (*User, error) {
+	if cached, ok := userCache.Get(discordID); ok {
+		return &cached, nil
+	}
+
 	user := &User{}
 	err := DB.QueryRow(
-		"SELECT discord_id, username, created_at, last_upload_at FROM users WHERE discord_id = ?",
+		ctx, "SELECT discord_id, username, display_name, avatar_hash, created_at, last_upload_at, timezone, profile_private, deletion_requested_at, max_file_size_mb, role_cooldown_minutes, linked_to, discord_dms FROM users WHERE discord_id = ?",
 		discordID,
-	).Scan(&user.DiscordID, &user.Username, &user.CreatedAt, &user.LastUploadAt)
+	).Scan(&user.DiscordID, &user.Username, &user.DisplayName, &user.Avatar, &user.CreatedAt, &user.LastUploadAt, &user.Timezone, &user.ProfilePrivate, &user.DeletionRequestedAt, &user.MaxFileSizeMB, &user.RoleCooldownMinutes, &user.LinkedTo, &user.DiscordDMs)
+	if err != nil {
+		return nil, err
+	}
+	userCache.Set(discordID, *user)
+	return user, nil
+}
 
+// GetOrCreateUser retrieves a user or creates one if it doesn't exist
+func GetOrCreateUser(ctx context.Context, discordID, username string) (*User, error) {
+	user, err := GetUser(ctx, discordID)
 	if err == sql.ErrNoRows {
 		// Create new user
 		_, err = DB.Exec(
-			"INSERT INTO users (discord_id, username) VALUES (?, ?)",
+			ctx, "INSERT INTO users (discord_id, username) VALUES (?, ?)",
 			discordID, username,
 		)
 		if err != nil {
 			return nil, err
 		}
-		return GetOrCreateUser(discordID, username)
+		return GetOrCreateUser(ctx, discordID, username)
 	} else if err != nil {
 		return nil, err
 	}
 
+	// Deleted accounts keep no name until the user signs in again
+	if user.Username == "" && username != "" {
+		if _, err := DB.Exec(ctx, "UPDATE users SET username = ? WHERE discord_id = ? AND username = ''", username, discordID); err != nil {
+			return nil, err
+		}
+		forgetUser(discordID)
+		user.Username = username
+	}
+
 	return user, nil
 }
 
-// UpdateLastUpload updates the last upload timestamp for a user
-func (u *User) UpdateLastUpload() error {
-	_, err := DB.Exec(
-		"UPDATE users SET last_upload_at = CURRENT_TIMESTAMP WHERE discord_id = ?",
-		u.DiscordID,
-	)
-	return err
+// UpdateProfile stores the name, display name and avatar the user has with
+// their sign-in provider now, so renames show up after their next sign-in.
+// The names they replace are kept in the user's name history.
+func (u *User) UpdateProfile(ctx context.Context, username, displayName, avatar string) error {
+	if u.Username == username && u.DisplayName == displayName && u.Avatar == avatar {
+		return nil
+	}
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE users SET username = ?, display_name = ?, avatar_hash = ? WHERE discord_id = ?",
+		username, displayName, avatar, u.DiscordID,
+	); err != nil {
+		return err
+	}
+	// Newly created users and deleted accounts signing in again have no
+	// name to keep, and neither does a user who has only now set a display
+	// name
+	renamed := u.Username != username || (u.DisplayName != "" && u.DisplayName != displayName)
+	if renamed && u.Username != "" {
+		if _, err := tx.Exec(
+			"INSERT INTO username_history (discord_id, username, display_name) VALUES (?, ?, ?)",
+			u.DiscordID, u.Username, u.DisplayName,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetUser(u.DiscordID)
+	u.Username, u.DisplayName, u.Avatar = username, displayName, avatar
+	return nil
+}
+
+// SetMaxFileSize records the largest file the user's roles allow them to
+// upload, in MB, with 0 for the default
+func SetMaxFileSize(ctx context.Context, discordID string, mb int) error {
+	if _, err := DB.Exec(ctx, "UPDATE users SET max_file_size_mb = ? WHERE discord_id = ?", mb, discordID); err != nil {
+		return err
+	}
+	forgetUser(discordID)
+	return nil
+}
+
+// SetRoleCooldown records the shortest upload cooldown the user's roles give
+// them, in minutes, with NULL when none do
+func SetRoleCooldown(ctx context.Context, discordID string, minutes sql.NullInt64) error {
+	if _, err := DB.Exec(ctx, "UPDATE users SET role_cooldown_minutes = ? WHERE discord_id = ?", minutes, discordID); err != nil {
+		return err
+	}
+	forgetUser(discordID)
+	return nil
+}
+
+// SystemUserID is the account imported wallpapers are attributed to when no
+// user is named. It can never sign in, since the IDs of users who sign in
+// are numeric or start with their provider's name and a colon.
+const SystemUserID = "system"
+
+// GetSystemUser returns the system account, creating it on first use. Its
+// profile is private so it stays off the leaderboards.
+func GetSystemUser(ctx context.Context) (*User, error) {
+	user, err := GetOrCreateUser(ctx, SystemUserID, "System")
+	if err != nil {
+		return nil, err
+	}
+	if !user.ProfilePrivate {
+		if err := user.SetProfilePrivate(ctx, true); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
 }
 
 // CanUpload checks if the user can upload based on the cooldown period
@@ -71,21 +225,124 @@ func (u *User) CanUpload(cooldownMinutes int) (bool, time.Duration) {
 	return true, 0
 }
 
-// CreateUpload records a new upload in the database
-func CreateUpload(discordID, filename, originalFilename string, fileSize int64) error {
-	_, err := DB.Exec(
-		"INSERT INTO uploads (discord_id, filename, original_filename, file_size) VALUES (?, ?, ?, ?)",
-		discordID, filename, originalFilename, fileSize,
+// CreateUpload records a new upload in the database and sets its ID
+func CreateUpload(ctx context.Context, upload *Upload) error {
+	queryRow := func(query string, args ...interface{}) *Row { return DB.QueryRow(ctx, query, args...) }
+	if err := insertUpload(queryRow, upload); err != nil {
+		return err
+	}
+	forgetPools()
+	return IndexUpload(ctx, upload.ID)
+}
+
+// UploadLimits are the rate limits a user's upload is recorded under
+type UploadLimits struct {
+	// Cooldown is the least time between two uploads
+	Cooldown time.Duration
+	// MaxPerDay is how many uploads may be made since DayStart, if above 0
+	MaxPerDay int
+	DayStart  time.Time
+}
+
+// Errors returned by RecordUpload when a limit has been reached
+var (
+	ErrUploadCooldown   = errors.New("upload cooldown has not ended")
+	ErrUploadDailyLimit = errors.New("daily upload limit reached")
+)
+
+// RecordUpload records a new upload by the user and starts their cooldown in
+// one transaction, so concurrent uploads can't both pass the limits. The
+// cooldown is claimed with a conditional update before anything else, which
+// also makes concurrent uploads of the same user wait for each other.
+func (u *User) RecordUpload(ctx context.Context, upload *Upload, limits UploadLimits) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(
+		"UPDATE users SET last_upload_at = ? WHERE discord_id = ? AND (last_upload_at IS NULL OR last_upload_at <= ?)",
+		now.Format(timestampFormat), u.DiscordID, now.Add(-limits.Cooldown).Format(timestampFormat),
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result); err == sql.ErrNoRows {
+		return ErrUploadCooldown
+	} else if err != nil {
+		return err
+	}
+
+	if limits.MaxPerDay > 0 {
+		var count int
+		if err := tx.QueryRow(
+			"SELECT COUNT(*) FROM uploads WHERE discord_id = ? AND uploaded_at >= ?",
+			u.DiscordID, limits.DayStart.UTC().Format(timestampFormat),
+		).Scan(&count); err != nil {
+			return err
+		}
+		if count >= limits.MaxPerDay {
+			return ErrUploadDailyLimit
+		}
+	}
+
+	if err := insertUpload(tx.QueryRow, upload); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetUser(u.DiscordID)
+	forgetPools()
+	u.LastUploadAt = sql.NullTime{Time: now, Valid: true}
+	return IndexUpload(ctx, upload.ID)
+}
+
+// insertUpload adds the row of a new upload and sets its ID
+func insertUpload(queryRow func(string, ...interface{}) *Row, upload *Upload) error {
+	if upload.Rarity == "" {
+		upload.Rarity = RarityCommon
+	}
+	if upload.Visibility == "" {
+		upload.Visibility = VisibilityPublic
+	}
+	var votingEnds interface{}
+	if upload.RarityVotingEndsAt.Valid {
+		votingEnds = upload.RarityVotingEndsAt.Time.UTC().Format(timestampFormat)
+	}
+	return queryRow(
+		"INSERT INTO uploads (discord_id, filename, original_filename, title, description, file_size, phash, duplicate_of, sha256, blurhash, source, external_id, license, visibility, guild_id, width, height, safety_status, rarity, rarity_voting_ends_at, quality_score, retry_key) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, uploaded_at",
+		upload.DiscordID, upload.Filename, upload.OriginalFilename, upload.Title, upload.Description, upload.FileSize, upload.PHash, upload.DuplicateOf, upload.SHA256, upload.BlurHash,
+		upload.Source, upload.ExternalID, upload.License, upload.Visibility, upload.GuildID, upload.Width, upload.Height, upload.SafetyStatus, upload.Rarity, votingEnds, upload.QualityScore, upload.RetryKey,
+	).Scan(&upload.ID, &upload.UploadedAt)
+}
+
+// FindRetriedUpload returns the user's upload made with the given retry key,
+// or sql.ErrNoRows if there is none. Upload handlers use it to answer a
+// retried request with the upload it already made.
+func FindRetriedUpload(ctx context.Context, discordID, retryKey string) (*Upload, error) {
+	return scanUpload(DB.QueryRow(ctx, uploadSelect+" WHERE u.discord_id = ? AND u.retry_key = ?", discordID, retryKey))
 }
 
 // GetUserUploadCount returns the total number of uploads by a user
-func GetUserUploadCount(discordID string) (int, error) {
+func GetUserUploadCount(ctx context.Context, discordID string) (int, error) {
 	var count int
 	err := DB.QueryRow(
-		"SELECT COUNT(*) FROM uploads WHERE discord_id = ?",
+		ctx, "SELECT COUNT(*) FROM uploads WHERE discord_id = ?",
 		discordID,
 	).Scan(&count)
 	return count, err
 }
+
+// CountUploadsSince returns how many uploads the user has made since the
+// given time, including ones moved to the trash since
+func CountUploadsSince(ctx context.Context, discordID string, since time.Time) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM uploads WHERE discord_id = ? AND uploaded_at >= ?",
+		discordID, since.UTC().Format(timestampFormat),
+	).Scan(&count)
+	return count, err
+}
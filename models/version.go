@@ -0,0 +1,58 @@
+package models
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// writePattern picks the table out of the statements that change one
+var writePattern = regexp.MustCompile(`(?is)^\s*(?:INSERT\s+(?:OR\s+\w+\s+)?INTO|UPDATE|DELETE\s+FROM)\s+(\w+)`)
+
+// tableVersions counts the writes this process has made to each table, so
+// listings built from them can tell whether anything changed without
+// querying them again. Writes made elsewhere, such as by a command run while
+// the server is up or another instance, aren't counted.
+var tableVersions = struct {
+	sync.Mutex
+	byTable map[string]uint64
+}{byTable: make(map[string]uint64)}
+
+// writtenTable returns the table a statement writes to, or "" for statements
+// that only read
+func writtenTable(query string) string {
+	m := writePattern.FindStringSubmatch(query)
+	if m == nil {
+		return ""
+	}
+	return strings.ToLower(m[1])
+}
+
+// bumpTableVersions records that the given tables have been written
+func bumpTableVersions(tables ...string) {
+	tableVersions.Lock()
+	for _, t := range tables {
+		if t != "" {
+			tableVersions.byTable[t]++
+		}
+	}
+	tableVersions.Unlock()
+}
+
+// TableVersions describes the current versions of the given tables. It
+// changes once a write to any of them has completed, or for transactions,
+// committed; read it before the tables themselves, so a write racing the
+// read makes the description stale rather than the data.
+func TableVersions(tables ...string) string {
+	var sb strings.Builder
+	tableVersions.Lock()
+	for _, t := range tables {
+		sb.WriteString(t)
+		sb.WriteByte(':')
+		sb.WriteString(strconv.FormatUint(tableVersions.byTable[t], 10))
+		sb.WriteByte(' ')
+	}
+	tableVersions.Unlock()
+	return sb.String()
+}
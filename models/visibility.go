@@ -0,0 +1,27 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Visibilities an uploader may choose for a wallpaper. Public wallpapers are
+// listed and can be pulled; unlisted ones can only be reached by a direct
+// link; private ones are only shown to their uploader and to admins.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// NormalizeVisibility lowercases and checks a visibility chosen by an
+// uploader. An empty visibility means public.
+func NormalizeVisibility(visibility string) (string, error) {
+	switch visibility = strings.ToLower(strings.TrimSpace(visibility)); visibility {
+	case "":
+		return VisibilityPublic, nil
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return visibility, nil
+	}
+	return "", fmt.Errorf("visibility must be one of: %s, %s, %s", VisibilityPublic, VisibilityUnlisted, VisibilityPrivate)
+}
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Wallet transaction types. Grants and deductions are made by admins; pull
+// transactions spend a bonus pull once the daily allowance is used up, and
+// rewards are earned by taking part in the community.
+const (
+	WalletGrant  = "grant"
+	WalletDeduct = "deduct"
+	WalletPull   = "pull"
+	WalletReward = "reward"
+)
+
+// WalletTransaction is a change to a user's bonus pull balance. Amount is
+// negative for deductions and spent pulls. Reference ties the transaction to
+// what caused it, such as "guild:<id>" for guild-wide grants or "pull:<id>".
+// Rewards carry the action rewarded as their reason, and can appear only once
+// per reason and reference.
+type WalletTransaction struct {
+	ID        int64
+	DiscordID string
+	Type      string
+	Amount    int
+	Reason    string
+	ActorID   string
+	Reference string
+	CreatedAt time.Time
+}
+
+const walletTransactionColumns = `id, discord_id, type, amount, reason, actor_id, reference, created_at`
+
+const walletBalanceQuery = "SELECT COALESCE(SUM(amount), 0) FROM wallet_ledger WHERE discord_id = ?"
+
+// WalletBalance returns how many bonus pulls the user holds
+func WalletBalance(ctx context.Context, discordID string) (int, error) {
+	var balance int
+	err := DB.QueryRow(ctx, walletBalanceQuery, discordID).Scan(&balance)
+	return balance, err
+}
+
+// AdjustWallets grants or deducts amount bonus pulls for each of the users in
+// a single transaction. Deductions never take a balance below zero; users
+// with nothing to deduct are skipped. It returns how many users' balances
+// changed.
+func AdjustWallets(ctx context.Context, discordIDs []string, txType string, amount int, reason, actorID, reference string) (int, error) {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	changed := 0
+	for _, id := range discordIDs {
+		var res sql.Result
+		if txType == WalletDeduct {
+			res, err = tx.Exec(
+				`INSERT INTO wallet_ledger (discord_id, type, amount, reason, actor_id, reference)
+				SELECT ?, ?, -(CASE WHEN b.balance < ? THEN b.balance ELSE ? END), ?, ?, ?
+				FROM (SELECT COALESCE(SUM(amount), 0) AS balance FROM wallet_ledger WHERE discord_id = ?) b
+				WHERE b.balance > 0`,
+				id, txType, amount, amount, reason, actorID, reference, id,
+			)
+		} else {
+			res, err = tx.Exec(
+				`INSERT INTO wallet_ledger (discord_id, type, amount, reason, actor_id, reference) VALUES (?, ?, ?, ?, ?, ?)`,
+				id, txType, amount, reason, actorID, reference,
+			)
+		}
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		changed += int(n)
+	}
+
+	return changed, tx.Commit()
+}
+
+// GrantReward grants the user amount bonus pulls for a community action,
+// once per action and reference. It reports false if the reward was granted
+// before.
+func GrantReward(ctx context.Context, discordID, action string, amount int, reference string) (bool, error) {
+	result, err := DB.Exec(
+		ctx, `INSERT INTO wallet_ledger (discord_id, type, amount, reason, reference) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`,
+		discordID, WalletReward, amount, action, reference,
+	)
+	if err != nil {
+		return false, err
+	}
+	if err := requireAffected(result); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RewardTotals returns how many bonus pulls the user has earned from each
+// rewarded action
+func RewardTotals(ctx context.Context, discordID string) (map[string]int, error) {
+	rows, err := DB.Query(
+		ctx, "SELECT reason, SUM(amount) FROM wallet_ledger WHERE discord_id = ? AND type = ? GROUP BY reason",
+		discordID, WalletReward,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]int)
+	for rows.Next() {
+		var action string
+		var amount int
+		if err := rows.Scan(&action, &amount); err != nil {
+			return nil, err
+		}
+		totals[action] = amount
+	}
+	return totals, rows.Err()
+}
+
+// CountLikesReceived returns how many likes the user's uploads outside the
+// trash have received
+func CountLikesReceived(ctx context.Context, discordID string) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		ctx, "SELECT COALESCE(SUM(like_count), 0) FROM uploads WHERE discord_id = ? AND deleted_at IS NULL",
+		discordID,
+	).Scan(&count)
+	return count, err
+}
+
+// CountPullsByOthers returns how many times users other than its uploader
+// have pulled an upload, not counting copies bought with dust or received in
+// trades, which could be passed back and forth to run the count up
+func CountPullsByOthers(ctx context.Context, upload *Upload) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		ctx, "SELECT COUNT(*) FROM pulls WHERE upload_id = ? AND discord_id != ? AND source NOT IN (?, ?)",
+		upload.ID, upload.DiscordID, PullSourceDust, PullSourceTrade,
+	).Scan(&count)
+	return count, err
+}
+
+// ListWalletTransactions returns a page of the user's wallet history, newest
+// first, along with the total number of transactions
+func ListWalletTransactions(ctx context.Context, discordID string, limit, offset int) ([]WalletTransaction, int, error) {
+	return listWalletLedger(ctx, "discord_id = ?", []interface{}{discordID}, limit, offset)
+}
+
+// ListWalletRewards returns a page of the rewards the user has earned,
+// newest first, along with the total number of rewards
+func ListWalletRewards(ctx context.Context, discordID string, limit, offset int) ([]WalletTransaction, int, error) {
+	return listWalletLedger(ctx, "discord_id = ? AND type = ?", []interface{}{discordID, WalletReward}, limit, offset)
+}
+
+func listWalletLedger(ctx context.Context, where string, args []interface{}, limit, offset int) ([]WalletTransaction, int, error) {
+	var total int
+	if err := DB.QueryRow(ctx, "SELECT COUNT(*) FROM wallet_ledger WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := DB.Query(
+		ctx, "SELECT "+walletTransactionColumns+" FROM wallet_ledger WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	txs := []WalletTransaction{}
+	for rows.Next() {
+		var t WalletTransaction
+		if err := rows.Scan(&t.ID, &t.DiscordID, &t.Type, &t.Amount, &t.Reason, &t.ActorID, &t.Reference, &t.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		txs = append(txs, t)
+	}
+	return txs, total, rows.Err()
+}
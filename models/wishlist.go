@@ -0,0 +1,109 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrWishlistFull is returned when adding to a wishlist that has no room left
+var ErrWishlistFull = errors.New("wishlist is full")
+
+// WishlistEntry is a wallpaper on a user's wishlist
+type WishlistEntry struct {
+	Upload  Upload
+	AddedAt time.Time
+}
+
+// AddToWishlist pins a wallpaper the user doesn't own yet to their
+// wishlist, which holds at most size wallpapers. Adding one twice changes
+// nothing. It returns ErrAlreadyOwned for a wallpaper in their collection
+// and ErrWishlistFull when there is no room.
+func AddToWishlist(ctx context.Context, discordID string, uploadID int64, size int) error {
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var listed, owned, count int
+	err = tx.QueryRow(
+		`SELECT
+			(SELECT COUNT(*) FROM wishlists WHERE discord_id = ? AND upload_id = ?),
+			(SELECT COUNT(*) FROM pulls WHERE discord_id = ? AND upload_id = ? AND discarded = 0),
+			(SELECT COUNT(*) FROM wishlists WHERE discord_id = ?)`,
+		discordID, uploadID, discordID, uploadID, discordID,
+	).Scan(&listed, &owned, &count)
+	switch {
+	case err != nil:
+		return err
+	case listed > 0:
+		return nil
+	case owned > 0:
+		return ErrAlreadyOwned
+	case count >= size:
+		return ErrWishlistFull
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO wishlists (discord_id, upload_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		discordID, uploadID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveFromWishlist unpins a wallpaper from the user's wishlist
+func RemoveFromWishlist(ctx context.Context, discordID string, uploadID int64) error {
+	_, err := DB.Exec(ctx, "DELETE FROM wishlists WHERE discord_id = ? AND upload_id = ?", discordID, uploadID)
+	return err
+}
+
+// ListWishlist returns the wallpapers on the user's wishlist, oldest first,
+// including any that have since left the pool
+func ListWishlist(ctx context.Context, discordID string) ([]WishlistEntry, error) {
+	rows, err := DB.Query(ctx, "SELECT upload_id, created_at FROM wishlists WHERE discord_id = ? ORDER BY created_at, upload_id", discordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []WishlistEntry{}
+	for rows.Next() {
+		var e WishlistEntry
+		if err := rows.Scan(&e.Upload.ID, &e.AddedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ids := make([]int64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.Upload.ID
+	}
+	byID, err := uploadsByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Upload = byID[entries[i].Upload.ID]
+	}
+	return entries, nil
+}
+
+// claimWishlist takes the pulled wallpaper off the user's wishlist, now that
+// they have it, and sets the pull's wishlisted flag if it was on it
+func claimWishlist(tx *Tx, p *Pull) error {
+	res, err := tx.Exec("DELETE FROM wishlists WHERE discord_id = ? AND upload_id = ?", p.DiscordID, p.UploadID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	p.Wishlisted = n > 0
+	return err
+}
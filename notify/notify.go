@@ -0,0 +1,151 @@
+// Package notify tells users about things that happen to their uploads,
+// trades, pulls and banners while they may not be looking. Notifications are
+// stored for the user to read at /api/notifications, and the most important
+// ones are also sent by direct message from the Discord bot, when it is
+// configured, to users who haven't opted out. Failing to send one is logged
+// and never fails the action that caused it.
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/i18n"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Direct messages waiting to be sent; more are dropped rather than holding
+// up the action that caused them
+const dmQueueSize = 256
+
+// How long sending one direct message may take, retries included
+const dmTimeout = 30 * time.Second
+
+type directMessage struct {
+	discordID, kind, message string
+}
+
+var dms = make(chan directMessage, dmQueueSize)
+
+// Start sends queued direct messages one at a time until stop is closed. It
+// does nothing unless the Discord bot is configured.
+func Start(stop <-chan struct{}) {
+	if config.AppConfig.DiscordBotToken == "" {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case dm := <-dms:
+				sendDM(dm)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// UploadApproved tells an uploader that their upload, held for review or
+// its content safety check, is now public
+func UploadApproved(upload *models.Upload) {
+	send(upload.DiscordID, models.NotificationUploadApproved, upload.ID, 0, false,
+		fmt.Sprintf("Your wallpaper %q was approved and is now in the gallery", name(upload)))
+}
+
+// UploadRejected tells an uploader that their upload was taken down, and why
+// when reason is set
+func UploadRejected(upload *models.Upload, reason string) {
+	msg := fmt.Sprintf("Your wallpaper %q was rejected and moved to the trash", name(upload))
+	if reason != "" {
+		msg += ": " + reason
+	}
+	send(upload.DiscordID, models.NotificationUploadRejected, upload.ID, 0, true, msg)
+}
+
+// UploadLiked tells an uploader that someone liked their upload
+func UploadLiked(upload *models.Upload, likedBy string) {
+	send(upload.DiscordID, models.NotificationUploadLiked, upload.ID, 0, false,
+		fmt.Sprintf("%s liked your wallpaper %q", likedBy, name(upload)))
+}
+
+// TradeReceived tells a user that they were offered a trade
+func TradeReceived(trade *models.Trade, senderName string) {
+	msg := senderName + " offered you a trade"
+	if trade.RequestedUploadID.Valid {
+		msg += " and asked for a wallpaper in return"
+	}
+	send(trade.RecipientID, models.NotificationTradeReceived, trade.OfferedUploadID, trade.ID, true, msg)
+}
+
+// LegendaryPull tells a user that a pull found them a wallpaper of the top
+// rarity
+func LegendaryPull(discordID string, upload *models.Upload) {
+	send(discordID, models.NotificationLegendaryPull, upload.ID, 0, false,
+		fmt.Sprintf("You pulled the legendary wallpaper %q", name(upload)))
+}
+
+// BannerEnding tells a user who pulled on a banner that it ends soon
+func BannerEnding(discordID string, banner *models.Banner) {
+	send(discordID, models.NotificationBannerEnding, 0, 0, true,
+		fmt.Sprintf("The %q banner you pulled on ends %s", banner.Name, banner.EndsAt.UTC().Format("Jan 2 at 15:04 UTC")))
+}
+
+// name is how a notification refers to an upload
+func name(upload *models.Upload) string {
+	if upload.Title != "" {
+		return upload.Title
+	}
+	return upload.OriginalFilename
+}
+
+// send stores a notification and, with dm set, queues it as a direct message
+func send(discordID, kind string, uploadID, tradeID int64, dm bool, message string) {
+	n := &models.Notification{
+		DiscordID: discordID,
+		Type:      kind,
+		Message:   message,
+		UploadID:  sql.NullInt64{Int64: uploadID, Valid: uploadID != 0},
+		TradeID:   sql.NullInt64{Int64: tradeID, Valid: tradeID != 0},
+	}
+	if err := models.CreateNotification(context.Background(), n); err != nil {
+		log.Printf("Notifications: failed to send %s notification to user %s: %v", kind, discordID, err)
+	}
+
+	// Accounts from other sign-in providers, and the system account, have no
+	// Discord user to message
+	if _, err := strconv.ParseUint(discordID, 10, 64); !dm || config.AppConfig.DiscordBotToken == "" || err != nil {
+		return
+	}
+	select {
+	case dms <- directMessage{discordID: discordID, kind: kind, message: message}:
+	default:
+		log.Printf("Notifications: dropped %s direct message to user %s: queue is full", kind, discordID)
+	}
+}
+
+// sendDM messages a user on Discord unless they opted out
+func sendDM(dm directMessage) {
+	user, err := models.GetUser(context.Background(), dm.discordID)
+	if err != nil {
+		log.Printf("Notifications: failed to get user %s for %s direct message: %v", dm.discordID, dm.kind, err)
+		return
+	}
+	if !user.DiscordDMs {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dmTimeout)
+	defer cancel()
+	// There is no request to negotiate a language from, so direct messages
+	// are in default_locale
+	content := i18n.Translate(config.AppConfig.DefaultLocale, dm.message)
+	if err := discord.SendDirectMessage(ctx, dm.discordID, discord.Message{Content: content}); err != nil {
+		log.Printf("Notifications: failed to send %s direct message to user %s: %v", dm.kind, dm.discordID, err)
+	}
+}
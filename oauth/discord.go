@@ -0,0 +1,141 @@
+package oauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// discordProvider signs in members of the allowed Discord servers
+type discordProvider struct{}
+
+func (discordProvider) Name() string  { return Discord }
+func (discordProvider) Title() string { return "Discord" }
+
+func (discordProvider) AuthorizeURL(state, challenge string) string {
+	return discord.AuthorizeURL(state, challenge)
+}
+
+// SignIn admits members of an allowed server, who may browse each of the
+// allowed servers they are in. Uploading to a server may be limited to
+// members with particular roles, and roles may raise the file size limit; a
+// failed role lookup signs the user in without upload access or the larger
+// limit rather than failing.
+func (discordProvider) SignIn(ctx context.Context, code, verifier string) (*Account, error) {
+	token, err := discord.ExchangeCode(ctx, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := discord.GetUser(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	guilds, cached, err := memberGuilds(ctx, user.ID, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	if !discord.InAllowedGuild(guilds) {
+		return nil, &DeniedError{"You are not in an allowed Discord server"}
+	}
+
+	uploadGuildIDs, err := discord.UploadGuildIDs(ctx, token.AccessToken, guilds)
+	if err != nil {
+		log.Printf("Warning: Failed to check upload roles for user %s (ID: %s): %v", user.Username, user.ID, err)
+	}
+
+	maxFileSizeMB := 0
+	if len(config.AppConfig.RoleMaxFileSizeMB) > 0 {
+		maxFileSizeMB, err = discord.MaxFileSizeMB(ctx, token.AccessToken, guilds)
+		if err != nil {
+			log.Printf("Warning: Failed to check file size roles for user %s (ID: %s): %v", user.Username, user.ID, err)
+		}
+	}
+
+	var cooldownMinutes sql.NullInt64
+	if config.AppConfig.RoleCooldownsConfigured() {
+		minutes, ok, err := discord.UploadCooldownMinutes(ctx, token.AccessToken, guilds)
+		if err != nil {
+			log.Printf("Warning: Failed to check cooldown roles for user %s (ID: %s): %v", user.Username, user.ID, err)
+		}
+		cooldownMinutes = sql.NullInt64{Int64: int64(minutes), Valid: ok}
+	}
+
+	return &Account{
+		ID:             user.ID,
+		Username:       user.Username,
+		DisplayName:    user.GlobalName,
+		Avatar:         user.Avatar,
+		GuildIDs:       discord.AllowedGuildIDs(guilds),
+		UploadGuildIDs: uploadGuildIDs,
+		Confirmed: func() error {
+			var errs []error
+			if err := models.SetMaxFileSize(ctx, user.ID, maxFileSizeMB); err != nil {
+				errs = append(errs, fmt.Errorf("failed to record file size limit: %w", err))
+			}
+			if err := models.SetRoleCooldown(ctx, user.ID, cooldownMinutes); err != nil {
+				errs = append(errs, fmt.Errorf("failed to record upload cooldown: %w", err))
+			}
+
+			// Remember which allowed servers the user is in, for guild-wide
+			// grants
+			if !cached {
+				if err := models.SetUserGuilds(ctx, user.ID, discord.AllowedGuildIDs(guilds)); err != nil {
+					errs = append(errs, fmt.Errorf("failed to record guilds: %w", err))
+				}
+			}
+
+			// Keep the refresh token so membership can be re-verified later.
+			// A cached membership keeps the time it was confirmed at.
+			if token.RefreshToken != "" {
+				sealed, err := discord.SealToken(token.RefreshToken)
+				if err == nil && cached {
+					err = models.UpdateRefreshToken(ctx, user.ID, sealed)
+				} else if err == nil {
+					err = models.SetGuildVerified(ctx, user.ID, sealed)
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("failed to store refresh token: %w", err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+	}, nil
+}
+
+var guildCacheLookups = metrics.NewCounterVec("guild_cache_lookups_total",
+	"Guild memberships looked up at sign-in, by whether a recently confirmed one was used", "result")
+
+// memberGuilds returns the guilds the signing-in user is in. Membership of an
+// allowed server confirmed within guild_cache_minutes is trusted rather than
+// asking Discord again, since its guilds endpoint is slow and heavily rate
+// limited; cached reports whether that happened.
+func memberGuilds(ctx context.Context, discordID, accessToken string) (guilds []discord.Guild, cached bool, err error) {
+	if ttl := config.AppConfig.GuildCacheMinutes; ttl > 0 {
+		ids, err := models.RecentUserGuilds(ctx, discordID, time.Now().Add(-time.Duration(ttl)*time.Minute))
+		if err != nil {
+			log.Printf("Warning: Failed to look up cached guilds for user %s: %v", discordID, err)
+		}
+		for _, id := range ids {
+			guilds = append(guilds, discord.Guild{ID: id})
+		}
+		// Servers may have been removed from the allowed list since
+		if discord.InAllowedGuild(guilds) {
+			guildCacheLookups.Inc("hit")
+			return guilds, true, nil
+		}
+		guildCacheLookups.Inc("miss")
+	}
+
+	guilds, err = discord.GetGuilds(ctx, accessToken)
+	return guilds, false, err
+}
@@ -0,0 +1,77 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// GitHub's sign-in pages and API
+var (
+	githubWebBase = "https://github.com"
+	githubAPIBase = "https://api.github.com"
+)
+
+// githubProvider signs in members of the organizations in github_login
+type githubProvider struct{}
+
+func (githubProvider) Name() string  { return GitHub }
+func (githubProvider) Title() string { return "GitHub" }
+
+// AuthorizeURL asks for the user's organizations along with their profile,
+// including those whose membership is private
+func (githubProvider) AuthorizeURL(state, challenge string) string {
+	cfg := config.AppConfig.GitHubLogin
+	return authorizeURL(githubWebBase+"/login/oauth/authorize", cfg.ClientID, cfg.RedirectURI, "read:user read:org", state, challenge)
+}
+
+// SignIn admits users in one of the allowed organizations. Organizations
+// that restrict third-party access must have approved the OAuth app, or
+// GitHub leaves them out.
+func (githubProvider) SignIn(ctx context.Context, code, verifier string) (*Account, error) {
+	cfg := config.AppConfig.GitHubLogin
+	token, err := exchangeCode(ctx, GitHub, githubWebBase+"/login/oauth/access_token", cfg.ClientID, cfg.ClientSecret, cfg.RedirectURI, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := get(ctx, GitHub, "user", githubAPIBase+"/user", token, &user); err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// Only the first page; nobody is in more than a hundred organizations
+	var orgs []struct {
+		Login string `json:"login"`
+	}
+	if err := get(ctx, GitHub, "orgs", githubAPIBase+"/user/orgs?per_page=100", token, &orgs); err != nil {
+		return nil, fmt.Errorf("failed to get organizations: %w", err)
+	}
+	allowed := false
+	for _, org := range orgs {
+		if slices.Contains(cfg.Organizations, strings.ToLower(org.Login)) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, &DeniedError{"You are not a member of an allowed GitHub organization"}
+	}
+
+	account := &Account{
+		ID:          GitHub + ":" + strconv.FormatInt(user.ID, 10),
+		Username:    user.Login,
+		DisplayName: user.Name,
+		Avatar:      user.AvatarURL,
+	}
+	account.GuildIDs, account.UploadGuildIDs = defaultGuild()
+	return account, nil
+}
@@ -0,0 +1,64 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// Google's OpenID Connect endpoints
+var (
+	googleAuthorizeURL = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+	googleUserInfoURL  = "https://openidconnect.googleapis.com/v1/userinfo"
+)
+
+// googleProvider signs in accounts from the domains in google_login
+type googleProvider struct{}
+
+func (googleProvider) Name() string  { return Google }
+func (googleProvider) Title() string { return "Google" }
+
+func (googleProvider) AuthorizeURL(state, challenge string) string {
+	cfg := config.AppConfig.GoogleLogin
+	return authorizeURL(googleAuthorizeURL, cfg.ClientID, cfg.RedirectURI, "openid email profile", state, challenge)
+}
+
+// SignIn admits accounts whose verified email address is in one of the
+// allowed domains. The address itself is kept private: the user's name here
+// is the part before the @.
+func (googleProvider) SignIn(ctx context.Context, code, verifier string) (*Account, error) {
+	cfg := config.AppConfig.GoogleLogin
+	token, err := exchangeCode(ctx, Google, googleTokenURL, cfg.ClientID, cfg.ClientSecret, cfg.RedirectURI, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		Sub           string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Picture       string `json:"picture"`
+	}
+	if err := get(ctx, Google, "userinfo", googleUserInfoURL, token, &user); err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	local, domain, _ := strings.Cut(user.Email, "@")
+	if !user.EmailVerified || !slices.Contains(cfg.Domains, strings.ToLower(domain)) {
+		return nil, &DeniedError{"Your Google account is not in an allowed domain"}
+	}
+
+	account := &Account{
+		ID:          Google + ":" + user.Sub,
+		Username:    local,
+		DisplayName: user.Name,
+		Avatar:      user.Picture,
+	}
+	account.GuildIDs, account.UploadGuildIDs = defaultGuild()
+	return account, nil
+}
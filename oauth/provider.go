@@ -0,0 +1,219 @@
+// Package oauth signs users in with the identity providers the server is
+// configured for: Discord, and optionally GitHub and Google.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+	"github.com/Zinbhe/wallpaper-gacha/tracing"
+)
+
+// Names of the providers, as used in sign-in URLs
+const (
+	Discord = "discord"
+	GitHub  = "github"
+	Google  = "google"
+)
+
+// Default is the provider /auth/login signs in with
+const Default = Discord
+
+// Provider is an identity provider users can sign in with
+type Provider interface {
+	// Name identifies the provider in URLs and sessions
+	Name() string
+	// Title is the provider's name as shown to users
+	Title() string
+	// AuthorizeURL returns the URL users are sent to for signing in,
+	// carrying the OAuth state and PKCE challenge
+	AuthorizeURL(state, challenge string) string
+	// SignIn trades the code the user came back with for their account. It
+	// returns a *DeniedError if the provider's allowlist doesn't admit them.
+	SignIn(ctx context.Context, code, verifier string) (*Account, error)
+}
+
+// Account is a user as a provider reports them at sign-in
+type Account struct {
+	// ID is the user's ID here: their Discord ID for Discord accounts, and
+	// otherwise the provider's name and its ID for them, as in github:583231
+	ID          string
+	Username    string
+	DisplayName string
+	// Avatar is the hash of a Discord avatar, or the URL of the avatar for
+	// other providers
+	Avatar string
+	// GuildIDs are the allowed guilds the user may browse, in the order of
+	// config.GuildIDs, and UploadGuildIDs the ones of those they may upload to
+	GuildIDs       []string
+	UploadGuildIDs []string
+	// Confirmed, when set, stores what the provider confirmed about the user
+	// once their record exists
+	Confirmed func() error
+}
+
+// defaultGuild returns the guilds of users signing in with a provider other
+// than Discord, which knows nothing of their guilds: they are members of the
+// default guild, and may upload to it unless upload roles, which are Discord
+// roles, limit uploading there
+func defaultGuild() (guilds, uploadGuilds []string) {
+	guilds = []string{config.AppConfig.DefaultGuildID}
+	if len(config.AppConfig.Guilds[config.AppConfig.DefaultGuildID].UploadRoleIDs) == 0 {
+		uploadGuilds = guilds
+	}
+	return guilds, uploadGuilds
+}
+
+// DeniedError is returned by SignIn for users the provider's allowlist
+// doesn't admit. Reason is shown to them.
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Reason
+}
+
+// Enabled lists the providers users can sign in with, the default first
+func Enabled() []Provider {
+	providers := []Provider{discordProvider{}}
+	if config.AppConfig.GitHubLogin.ClientID != "" {
+		providers = append(providers, githubProvider{})
+	}
+	if config.AppConfig.GoogleLogin.ClientID != "" {
+		providers = append(providers, googleProvider{})
+	}
+	return providers
+}
+
+// Get returns the named provider if users can sign in with it
+func Get(name string) (Provider, bool) {
+	for _, p := range Enabled() {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// IsUserID reports whether s is the ID of an account from a provider other
+// than Discord, such as github:583231
+func IsUserID(s string) bool {
+	name, id, ok := strings.Cut(s, ":")
+	if !ok || (name != GitHub && name != Google) || id == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// AvatarURL returns the URL of a user's avatar as stored at sign-in
+func AvatarURL(userID, avatar string) string {
+	if strings.Contains(avatar, "://") {
+		return avatar
+	}
+	return discord.AvatarURL(userID, avatar)
+}
+
+var client = &http.Client{Timeout: 15 * time.Second}
+
+var requestDuration = metrics.NewHistogramVec("oauth_request_duration_seconds",
+	"Latency of GitHub and Google sign-in calls, by provider, endpoint and response status", metrics.DurationBuckets, "provider", "endpoint", "status")
+
+// authorizeURL returns a provider's authorization URL for the code flow with
+// a PKCE challenge
+func authorizeURL(base, clientID, redirectURI, scope, state, challenge string) string {
+	q := url.Values{}
+	q.Set("client_id", clientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("response_type", "code")
+	q.Set("scope", scope)
+	q.Set("state", state)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	return base + "?" + q.Encode()
+}
+
+// exchangeCode trades an authorization code and its PKCE verifier for an
+// access token at a provider's token endpoint
+func exchangeCode(ctx context.Context, provider, tokenURL, clientID, clientSecret, redirectURI, code, verifier string) (string, error) {
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", redirectURI)
+	data.Set("client_id", clientID)
+	data.Set("client_secret", clientSecret)
+	data.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// GitHub reports failures with a successful status and an error field
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := fetch(req, provider, "token", &token); err != nil {
+		return "", fmt.Errorf("token exchange failed: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("token exchange failed: %s %s", token.Error, token.ErrorDescription)
+	}
+	return token.AccessToken, nil
+}
+
+// get fetches a URL with the user's access token into v. endpoint names the
+// call in metrics.
+func get(ctx context.Context, provider, endpoint, rawURL, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return fetch(req, provider, endpoint, v)
+}
+
+// fetch sends a request and decodes the JSON of a successful response into v
+func fetch(req *http.Request, provider, endpoint string, v interface{}) error {
+	_, span := tracing.StartSpan(req.Context(), provider+" "+endpoint, tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("http.request.method", req.Method)
+
+	req.Header.Set("Accept", "application/json")
+	// GitHub rejects requests without one
+	req.Header.Set("User-Agent", "wallpaper-gacha")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+	}
+	span.SetError(err)
+	requestDuration.ObserveSince(start, provider, endpoint, status)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
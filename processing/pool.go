@@ -0,0 +1,86 @@
+// Package processing runs CPU-heavy image work (decoding, hashing,
+// thumbnailing) on a bounded pool of workers so bursts cannot saturate
+// small hosts.
+package processing
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"time"
+)
+
+// ErrBusy is returned when the processing queue is full
+var ErrBusy = errors.New("image processing queue is full")
+
+var (
+	backlog     = expvar.NewInt("processing_backlog")
+	inProgress  = expvar.NewInt("processing_in_progress")
+	completed   = expvar.NewInt("processing_completed")
+	rejected    = expvar.NewInt("processing_rejected_busy")
+	waitMsTotal = expvar.NewInt("processing_wait_ms_total")
+	runMsTotal  = expvar.NewInt("processing_run_ms_total")
+	lastRunMs   = expvar.NewInt("processing_last_run_ms")
+)
+
+type task struct {
+	fn     func() error
+	done   chan error
+	queued time.Time
+}
+
+var queue chan task
+
+// Init starts workers goroutines that take tasks from a queue holding up to
+// queueSize waiting tasks. nice, when non-zero, lowers the scheduling
+// priority of the worker threads where the platform supports it.
+func Init(workers, queueSize, nice int) {
+	queue = make(chan task, queueSize)
+	for i := 0; i < workers; i++ {
+		go worker(nice)
+	}
+	log.Printf("Image processing: %d workers, queue size %d, nice %d", workers, queueSize, nice)
+}
+
+func worker(nice int) {
+	if nice != 0 {
+		if err := lowerPriority(nice); err != nil {
+			log.Printf("Image processing: failed to set worker priority: %v", err)
+		}
+	}
+
+	for t := range queue {
+		backlog.Add(-1)
+		inProgress.Add(1)
+		waitMsTotal.Add(time.Since(t.queued).Milliseconds())
+
+		start := time.Now()
+		err := t.fn()
+		elapsed := time.Since(start).Milliseconds()
+
+		runMsTotal.Add(elapsed)
+		lastRunMs.Set(elapsed)
+		inProgress.Add(-1)
+		completed.Add(1)
+		t.done <- err
+	}
+}
+
+// Run queues fn on the worker pool and waits for its result. It returns
+// ErrBusy without running fn when the queue is full. Before Init is called
+// fn runs directly on the caller's goroutine.
+func Run(fn func() error) error {
+	if queue == nil {
+		return fn()
+	}
+
+	t := task{fn: fn, done: make(chan error, 1), queued: time.Now()}
+	select {
+	case queue <- t:
+		backlog.Add(1)
+	default:
+		rejected.Add(1)
+		return ErrBusy
+	}
+	return <-t.done
+}
@@ -0,0 +1,13 @@
+package processing
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// lowerPriority pins the calling goroutine to its OS thread and sets that
+// thread's nice value, leaving the rest of the server at normal priority
+func lowerPriority(nice int) error {
+	runtime.LockOSThread()
+	return syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), nice)
+}
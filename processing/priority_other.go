@@ -0,0 +1,11 @@
+//go:build !linux
+
+package processing
+
+import "log"
+
+// lowerPriority is a no-op where per-thread priorities are unavailable
+func lowerPriority(nice int) error {
+	log.Printf("Image processing: processing_nice is only supported on Linux, ignoring")
+	return nil
+}
@@ -0,0 +1,267 @@
+// Package routes maps every URL the server answers to its handler, behind
+// the middleware all requests pass through. The server and the end-to-end
+// test harness in internal/discordtest share it, so tests exercise the same
+// routes and access rules as production.
+package routes
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/Zinbhe/wallpaper-gacha/assets"
+	"github.com/Zinbhe/wallpaper-gacha/bot"
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/handlers"
+	"github.com/Zinbhe/wallpaper-gacha/metrics"
+	"github.com/Zinbhe/wallpaper-gacha/middleware"
+	"github.com/gorilla/mux"
+)
+
+// New builds the server's handler from the loaded configuration. The
+// database and session store must be initialized first.
+func New() (http.Handler, error) {
+	// Bound concurrent uploads
+	handlers.InitUploadLimiter(config.AppConfig.MaxConcurrentUploads, config.AppConfig.MaxUploadsPerUser)
+
+	// Load the authorization policy
+	if err := middleware.LoadPolicy(config.AppConfig.AuthorizationPolicy); err != nil {
+		return nil, fmt.Errorf("failed to load authorization policy: %w", err)
+	}
+
+	// Throttle sign-in, uploads, pulls and downloads per client IP and per user
+	authLimiter := middleware.NewRateLimiter("auth", config.AppConfig.RateLimitAuth)
+	uploadLimiter := middleware.NewRateLimiter("upload", config.AppConfig.RateLimitUpload)
+	pullLimiter := middleware.NewRateLimiter("pull", config.AppConfig.RateLimitPull)
+	downloadLimiter := middleware.NewRateLimiter("download", config.AppConfig.RateLimitDownload)
+
+	// Handlers that are methods of the Server reach the database, the
+	// configuration and sessions through it
+	srv := handlers.NewServer()
+
+	// Setup router; every route's access is decided by the authorization policy
+	r := mux.NewRouter()
+	r.Use(middleware.Tracing)
+	r.Use(middleware.Metrics)
+	r.Use(middleware.SecurityHeaders)
+	r.Use(middleware.Compress)
+	r.Use(middleware.LimitBody)
+	r.Use(middleware.Localize)
+	r.Use(middleware.JSONErrors)
+	r.Use(middleware.Maintenance)
+	r.Use(middleware.Authorize)
+
+	// With a content host, uploaded files are served there, to signed URLs,
+	// and it serves nothing else; the site redirects requests for them
+	files := r
+	if contentHost := config.AppConfig.ContentHost(); contentHost != "" {
+		content := r.Host(contentHost).Subrouter()
+		content.NotFoundHandler = http.NotFoundHandler()
+		content.HandleFunc("/images/{id:[0-9]+}", handlers.ImageHandler).Methods("GET")
+		content.HandleFunc("/images/{id:[0-9]+}/thumb", handlers.ThumbnailHandler).Methods("GET")
+		content.HandleFunc("/api/drafts/{id:[0-9]+}/file", handlers.DraftFileHandler).Methods("GET")
+		files = content
+	}
+	if config.AppConfig.SignedURLs.Enabled {
+		// Requests are authenticated by the URL's signature instead of a session
+		files.HandleFunc("/files/{name:.+}", handlers.SignedFileHandler).Methods("GET")
+	}
+
+	// Public routes
+	r.HandleFunc("/", handlers.HomeHandler).Methods("GET")
+	r.HandleFunc("/auth/login", middleware.RateLimit(authLimiter, handlers.LoginHandler)).Methods("GET")
+	r.HandleFunc("/auth/callback", middleware.RateLimit(authLimiter, handlers.CallbackHandler)).Methods("GET")
+	r.HandleFunc("/auth/login/{provider:[a-z]+}", middleware.RateLimit(authLimiter, handlers.LoginHandler)).Methods("GET")
+	r.HandleFunc("/auth/callback/{provider:[a-z]+}", middleware.RateLimit(authLimiter, handlers.CallbackHandler)).Methods("GET")
+	r.HandleFunc("/auth/logout", middleware.RateLimit(authLimiter, handlers.LogoutHandler)).Methods("GET")
+	r.HandleFunc("/api/takedown", handlers.TakedownHandler).Methods("POST")
+	r.HandleFunc("/api/takedown/{token}", handlers.TakedownStatusHandler).Methods("GET")
+	r.HandleFunc("/api/openapi.json", handlers.OpenAPIHandler).Methods("GET")
+	r.HandleFunc(assets.Prefix+"{name}", assets.Handler).Methods("GET")
+	r.HandleFunc("/wallpapers/{id:[0-9]+}", handlers.WallpaperPageHandler).Methods("GET")
+	r.HandleFunc("/wallpapers/{id:[0-9]+}/preview", handlers.WallpaperPreviewHandler).Methods("GET")
+	r.HandleFunc("/oembed", handlers.OEmbedHandler).Methods("GET")
+	r.HandleFunc("/readyz", handlers.ReadyHandler).Methods("GET")
+	if config.AppConfig.DiscordBotToken != "" {
+		// Requests are authenticated by Discord's signature instead of a session
+		r.HandleFunc("/discord/interactions", bot.InteractionsHandler).Methods("POST")
+	}
+
+	// Signed-in routes
+	r.HandleFunc("/upload", handlers.UploadPageHandler).Methods("GET")
+	r.HandleFunc("/users/{id:(?:[a-z]+:)?[0-9]+}", handlers.ProfilePageHandler).Methods("GET")
+	r.HandleFunc("/feed.xml", handlers.FeedHandler).Methods("GET")
+	r.HandleFunc("/ws/live", handlers.LiveHandler).Methods("GET")
+	r.HandleFunc("/api/user", handlers.UserInfoHandler).Methods("GET")
+	r.HandleFunc("/api/user/timezone", handlers.TimezoneHandler).Methods("PUT")
+	r.HandleFunc("/api/guilds", handlers.GuildsHandler).Methods("GET")
+	r.HandleFunc("/api/guilds/current", handlers.SelectGuildHandler).Methods("PUT")
+	r.HandleFunc("/api/user/privacy", handlers.ProfilePrivacyHandler).Methods("PUT")
+	r.HandleFunc("/api/user/showcase", handlers.ShowcaseHandler).Methods("PUT")
+	r.HandleFunc("/api/user/notifications", handlers.NotificationSettingsHandler).Methods("PUT")
+	r.HandleFunc("/api/me/uploads", handlers.MyUploadsHandler).Methods("GET")
+	r.HandleFunc("/api/me/uploads/{id:[0-9]+}/status", handlers.MyUploadStatusHandler).Methods("GET")
+	r.HandleFunc("/api/me/storage", handlers.MyStorageHandler).Methods("GET")
+	r.HandleFunc("/api/me/export", handlers.ExportDataHandler).Methods("GET")
+	r.HandleFunc("/api/me/delete", handlers.RequestDeletionHandler).Methods("POST")
+	r.HandleFunc("/api/me/delete", handlers.CancelDeletionHandler).Methods("DELETE")
+	r.HandleFunc("/api/me/links", handlers.MyLinksHandler).Methods("GET")
+	r.HandleFunc("/api/me/links", handlers.LinkAccountHandler).Methods("POST")
+	r.HandleFunc("/api/me/links/code", handlers.CreateLinkCodeHandler).Methods("POST")
+	r.HandleFunc("/api/me/sessions", srv.SessionsHandler).Methods("GET")
+	r.HandleFunc("/api/me/sessions", srv.RevokeOtherSessionsHandler).Methods("DELETE")
+	r.HandleFunc("/api/me/sessions/{id:[0-9a-f]+}", srv.RevokeSessionHandler).Methods("DELETE")
+	r.HandleFunc("/api/users/{id:(?:[a-z]+:)?[0-9]+}", handlers.UserProfileHandler).Methods("GET")
+	r.HandleFunc("/api/config", handlers.ConfigHandler).Methods("GET")
+	// The feed again, for bots authenticating with an API token
+	r.HandleFunc("/api/feed.xml", handlers.FeedHandler).Methods("GET")
+	r.HandleFunc("/api/tokens", handlers.APITokensHandler).Methods("GET")
+	r.HandleFunc("/api/tokens", handlers.CreateAPITokenHandler).Methods("POST")
+	r.HandleFunc("/api/tokens/{id:[0-9]+}", handlers.RevokeAPITokenHandler).Methods("DELETE")
+	r.HandleFunc("/api/upload", middleware.RateLimit(uploadLimiter, handlers.UploadHandler)).Methods("POST")
+	r.HandleFunc("/api/upload/zip", middleware.RateLimit(uploadLimiter, handlers.ZipUploadHandler)).Methods("POST")
+	r.HandleFunc("/api/upload/status", handlers.UploadStatusHandler).Methods("GET")
+	r.HandleFunc("/api/upload/progress/{ticket}", handlers.UploadProgressHandler).Methods("GET")
+	r.HandleFunc("/api/upload/sessions", handlers.CreateUploadSessionHandler).Methods("POST")
+	r.HandleFunc("/api/upload/sessions/{id:[0-9]+}", handlers.UploadSessionHandler).Methods("GET")
+	r.HandleFunc("/api/upload/sessions/{id:[0-9]+}", handlers.UploadChunkHandler).Methods("PATCH")
+	r.HandleFunc("/api/upload/sessions/{id:[0-9]+}", handlers.DeleteUploadSessionHandler).Methods("DELETE")
+	r.HandleFunc("/api/upload/sessions/{id:[0-9]+}/complete", middleware.RateLimit(uploadLimiter, handlers.CompleteUploadSessionHandler)).Methods("POST")
+	r.HandleFunc("/api/drafts", handlers.DraftsHandler).Methods("GET")
+	r.HandleFunc("/api/drafts", handlers.CreateDraftHandler).Methods("POST")
+	r.HandleFunc("/api/drafts/{id:[0-9]+}", handlers.DraftHandler).Methods("GET")
+	r.HandleFunc("/api/drafts/{id:[0-9]+}", handlers.UpdateDraftHandler).Methods("PUT")
+	r.HandleFunc("/api/drafts/{id:[0-9]+}", handlers.DeleteDraftHandler).Methods("DELETE")
+	r.HandleFunc("/api/drafts/{id:[0-9]+}/file", handlers.DraftFileHandler).Methods("GET")
+	r.HandleFunc("/api/drafts/{id:[0-9]+}/publish", handlers.PublishDraftHandler).Methods("POST")
+	r.HandleFunc("/api/uploads", handlers.GalleryHandler).Methods("GET")
+	r.HandleFunc("/api/uploads/{id:[0-9]+}", handlers.EditUploadHandler).Methods("PATCH")
+	r.HandleFunc("/api/uploads/{id:[0-9]+}", handlers.DeleteUploadHandler).Methods("DELETE")
+	r.HandleFunc("/api/uploads/{id:[0-9]+}/report", handlers.ReportHandler).Methods("POST")
+	r.HandleFunc("/api/uploads/{id:[0-9]+}/like", handlers.LikeHandler).Methods("POST", "DELETE")
+	r.HandleFunc("/api/uploads/{id:[0-9]+}/rarity-vote", handlers.RarityVoteStatusHandler).Methods("GET")
+	r.HandleFunc("/api/uploads/{id:[0-9]+}/rarity-vote", handlers.RarityVoteHandler).Methods("POST")
+	r.HandleFunc("/api/uploads/{id:[0-9]+}/image", handlers.ImageHandler).Methods("GET")
+	r.HandleFunc("/api/random", handlers.RandomWallpaperHandler).Methods("GET")
+	r.HandleFunc("/api/wallpapers/trending", handlers.TrendingHandler).Methods("GET")
+	r.HandleFunc("/api/wallpapers/{id:[0-9]+}", handlers.WallpaperDetailHandler).Methods("GET")
+	r.HandleFunc("/api/tags", handlers.TagsHandler).Methods("GET")
+	r.HandleFunc("/api/search", handlers.SearchHandler).Methods("GET")
+	r.HandleFunc("/api/pulls", middleware.RateLimit(pullLimiter, handlers.PullHandler)).Methods("POST")
+	r.HandleFunc("/api/pulls/start", middleware.RateLimit(pullLimiter, handlers.PullStartHandler)).Methods("POST")
+	r.HandleFunc("/api/pulls/reveal", handlers.PullRevealHandler).Methods("POST")
+	r.HandleFunc("/api/pulls/status", handlers.PullStatusHandler).Methods("GET")
+	r.HandleFunc("/api/pulls/history", handlers.PullHistoryHandler).Methods("GET")
+	r.HandleFunc("/api/pulls/seeds", handlers.PullSeedsHandler).Methods("GET")
+	r.HandleFunc("/api/pulls/{id:[0-9]+}/verify", handlers.PullVerifyHandler).Methods("GET")
+	r.HandleFunc("/api/pulls/{id:[0-9]+}/reroll", middleware.RateLimit(pullLimiter, handlers.RerollHandler)).Methods("POST")
+	r.HandleFunc("/api/rerolls", handlers.RerollsHandler).Methods("GET")
+	r.HandleFunc("/api/achievements", handlers.AchievementsHandler).Methods("GET")
+	r.HandleFunc("/api/wallet", handlers.WalletHandler).Methods("GET")
+	r.HandleFunc("/api/wallet/earnings", handlers.EarningsHandler).Methods("GET")
+	r.HandleFunc("/api/dust", srv.DustHandler).Methods("GET")
+	r.HandleFunc("/api/dust/convert", srv.DustConvertHandler).Methods("POST")
+	r.HandleFunc("/api/dust/exchange", middleware.RateLimit(pullLimiter, srv.DustExchangeHandler)).Methods("POST")
+	r.HandleFunc("/api/collection", handlers.CollectionHandler).Methods("GET")
+	r.HandleFunc("/api/collection/progress", handlers.CollectionProgressHandler).Methods("GET")
+	r.HandleFunc("/api/collection/download", middleware.RateLimit(downloadLimiter, handlers.CollectionDownloadHandler)).Methods("GET")
+	r.HandleFunc("/api/wishlist", handlers.WishlistHandler).Methods("GET")
+	r.HandleFunc("/api/wishlist/{id:[0-9]+}", handlers.WishlistItemHandler).Methods("PUT", "DELETE")
+	r.HandleFunc("/api/trades", handlers.TradesHandler).Methods("GET")
+	r.HandleFunc("/api/trades", handlers.CreateTradeHandler).Methods("POST")
+	r.HandleFunc("/api/trades/inbox", handlers.TradeInboxHandler).Methods("GET")
+	r.HandleFunc("/api/trades/{id:[0-9]+}", handlers.TradeHandler).Methods("GET")
+	r.HandleFunc("/api/trades/{id:[0-9]+}/accept", handlers.AcceptTradeHandler).Methods("POST")
+	r.HandleFunc("/api/trades/{id:[0-9]+}/decline", handlers.DeclineTradeHandler).Methods("POST")
+	r.HandleFunc("/api/trades/{id:[0-9]+}/cancel", handlers.CancelTradeHandler).Methods("POST")
+	r.HandleFunc("/api/notifications", handlers.NotificationsHandler).Methods("GET")
+	r.HandleFunc("/api/notifications/unread", handlers.UnreadNotificationsHandler).Methods("GET")
+	r.HandleFunc("/api/notifications/read", handlers.ReadAllNotificationsHandler).Methods("POST")
+	r.HandleFunc("/api/notifications/{id:[0-9]+}/read", handlers.ReadNotificationHandler).Methods("POST")
+	r.HandleFunc("/api/leaderboard", handlers.LeaderboardHandler).Methods("GET")
+	r.HandleFunc("/api/stats/timeseries", handlers.TimeSeriesHandler).Methods("GET")
+	r.HandleFunc("/api/banners", handlers.BannersHandler).Methods("GET")
+	r.HandleFunc("/api/seasons", handlers.SeasonsHandler).Methods("GET")
+	r.HandleFunc("/images/{id:[0-9]+}", handlers.ImageHandler).Methods("GET")
+	r.HandleFunc("/images/{id:[0-9]+}/thumb", handlers.ThumbnailHandler).Methods("GET")
+
+	// Admin routes
+	r.HandleFunc("/api/admin/uploads/bulk", handlers.AdminBulkUploadsHandler).Methods("POST")
+	r.HandleFunc("/api/admin/uploads/{id:[0-9]+}", handlers.AdminUploadDetailHandler).Methods("GET")
+	r.HandleFunc("/api/admin/uploads/{id:[0-9]+}/tags", handlers.AdminUpdateTagsHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/uploads/{id:[0-9]+}/owner", handlers.AdminReassignUploadHandler).Methods("POST")
+	r.HandleFunc("/api/admin/uploads/{id:[0-9]+}/merge", handlers.AdminMergeUploadHandler).Methods("POST")
+	r.HandleFunc("/api/admin/takedowns", handlers.AdminTakedownsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/takedowns/{id:[0-9]+}", handlers.AdminResolveTakedownHandler).Methods("POST")
+	r.HandleFunc("/api/admin/reports", handlers.AdminReportsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/uploads/{id:[0-9]+}/reports", handlers.AdminReviewReportsHandler).Methods("POST")
+	r.HandleFunc("/api/admin/stats", handlers.AdminStatsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/trash", handlers.AdminTrashHandler).Methods("GET")
+	r.HandleFunc("/api/admin/trash/{id:[0-9]+}/restore", handlers.AdminRestoreHandler).Methods("POST")
+	r.HandleFunc("/api/admin/trash/{id:[0-9]+}", handlers.AdminPurgeHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/quarantine", handlers.AdminQuarantineHandler).Methods("GET")
+	r.HandleFunc("/api/admin/quarantine/{id:[0-9]+}/file", handlers.AdminQuarantineFileHandler).Methods("GET")
+	r.HandleFunc("/api/admin/quarantine/{id:[0-9]+}", handlers.AdminDeleteQuarantinedHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/integrity", handlers.AdminIntegrityHandler).Methods("GET")
+	r.HandleFunc("/api/admin/integrity", handlers.AdminRunIntegrityHandler).Methods("POST")
+	r.HandleFunc("/api/admin/orphans", handlers.AdminOrphansHandler).Methods("GET")
+	r.HandleFunc("/api/admin/orphans", handlers.AdminRunOrphansHandler).Methods("POST")
+	r.HandleFunc("/api/admin/scheduler", handlers.AdminSchedulerHandler).Methods("GET")
+	r.HandleFunc("/api/admin/scheduler/{name:[a-z_]+}/run", handlers.AdminRunTaskHandler).Methods("POST")
+	r.HandleFunc("/api/admin/bans", handlers.AdminBansHandler).Methods("GET")
+	r.HandleFunc("/api/admin/bans", handlers.AdminBanHandler).Methods("POST")
+	r.HandleFunc("/api/admin/bans/{id}", handlers.AdminUnbanHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/storage", handlers.AdminStorageHandler).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/sessions", srv.AdminUserSessionsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/sessions", srv.AdminTerminateSessionsHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/users/{id}/names", handlers.AdminUserNamesHandler).Methods("GET")
+	r.HandleFunc("/api/admin/links", handlers.AdminLinksHandler).Methods("GET")
+	r.HandleFunc("/api/admin/links/{id:[0-9]+}", handlers.AdminResolveLinkHandler).Methods("POST")
+	r.HandleFunc("/api/admin/alts", handlers.AdminAltClustersHandler).Methods("GET")
+	r.HandleFunc("/api/admin/audit", handlers.AdminAuditHandler).Methods("GET")
+	r.HandleFunc("/api/admin/wallets/adjustments", handlers.AdminAdjustWalletHandler).Methods("POST")
+	r.HandleFunc("/api/admin/wallets/{id}", handlers.AdminWalletHandler).Methods("GET")
+	r.HandleFunc("/api/admin/banners", handlers.AdminBannersHandler).Methods("GET")
+	r.HandleFunc("/api/admin/banners", handlers.AdminCreateBannerHandler).Methods("POST")
+	r.HandleFunc("/api/admin/banners/{id:[0-9]+}", handlers.AdminUpdateBannerHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/banners/{id:[0-9]+}", handlers.AdminDeleteBannerHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/gacha/rates", handlers.AdminGachaRatesHandler).Methods("GET")
+	r.HandleFunc("/api/admin/gacha/rates", handlers.AdminUpdateGachaRatesHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/gacha/pool", handlers.AdminPoolHandler).Methods("GET")
+	r.HandleFunc("/api/admin/gacha/pool/uploads", handlers.AdminUpdatePoolHandler).Methods("POST")
+	r.HandleFunc("/api/admin/gacha/pool/{rarity:[a-z]+}", handlers.AdminPoolTierHandler).Methods("GET")
+	r.HandleFunc("/api/admin/maintenance", handlers.AdminMaintenanceHandler).Methods("GET")
+	r.HandleFunc("/api/admin/maintenance", handlers.AdminUpdateMaintenanceHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/config/reload", handlers.AdminReloadConfigHandler).Methods("POST")
+	r.HandleFunc("/api/admin/upload-rules", handlers.AdminUploadRulesHandler).Methods("GET")
+	r.HandleFunc("/api/admin/upload-rules", handlers.AdminCreateUploadRuleHandler).Methods("POST")
+	r.HandleFunc("/api/admin/upload-rules/{id:[0-9]+}", handlers.AdminDeleteUploadRuleHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/seasons", handlers.AdminSeasonsHandler).Methods("GET")
+	r.HandleFunc("/api/admin/seasons", handlers.AdminCreateSeasonHandler).Methods("POST")
+	r.HandleFunc("/api/admin/seasons/{id:[0-9]+}", handlers.AdminUpdateSeasonHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/seasons/{id:[0-9]+}", handlers.AdminDeleteSeasonHandler).Methods("DELETE")
+	r.HandleFunc("/api/admin/deliveries", handlers.AdminDeliveriesHandler).Methods("GET")
+	r.HandleFunc("/api/admin/deliveries/{id:[0-9]+}/retry", handlers.AdminRetryDeliveryHandler).Methods("POST")
+	r.HandleFunc("/api/admin/policy", handlers.AdminPolicyHandler).Methods("GET")
+	r.HandleFunc("/api/admin/impersonate/{id}", handlers.AdminImpersonateHandler).Methods("POST")
+	r.HandleFunc("/api/admin/impersonate", handlers.AdminStopImpersonationHandler).Methods("DELETE")
+
+	// Runtime counters (upload queue depth, etc.)
+	if config.AppConfig.MetricsEnabled {
+		r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+		r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	}
+
+	// Every /api route is also served as part of the versioned API
+	if err := handlers.MountVersionedAPI(r); err != nil {
+		return nil, fmt.Errorf("failed to mount the versioned API: %w", err)
+	}
+
+	if err := middleware.CheckPolicy(r); err != nil {
+		return nil, fmt.Errorf("invalid authorization policy: %w", err)
+	}
+
+	// Cross-origin preflights are answered before routing, since no route
+	// takes OPTIONS
+	return middleware.RealIP(middleware.CORS(r)), nil
+}
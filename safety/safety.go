@@ -0,0 +1,108 @@
+// Package safety runs new uploads past an external content classifier, such
+// as an NSFW detection API or a locally hosted model, before they are shown in
+// the gallery. Checks happen in the background so uploads aren't held up by a
+// slow classifier.
+package safety
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/webhooks"
+)
+
+const (
+	// Largest verdict read from the classifier's response
+	maxVerdictBytes = 64 << 10
+	// How many uploads can wait for a check before more are left for the
+	// periodic sweep
+	queueSize = 256
+)
+
+// Verdict is the classifier's answer. Score runs from 0 (safe) to 1 (certainly
+// unsafe); classifiers that only decide yes or no can set NSFW instead.
+type Verdict struct {
+	NSFW  bool    `json:"nsfw"`
+	Score float64 `json:"score"`
+	Label string  `json:"label"`
+}
+
+// Flagged reports whether the verdict reaches content_safety.threshold
+func (v Verdict) Flagged() bool {
+	return v.NSFW || v.Score >= config.AppConfig.ContentSafety.Threshold
+}
+
+// Enabled reports whether new uploads are checked
+func Enabled() bool {
+	return config.AppConfig.ContentSafety.URL != ""
+}
+
+var queue = make(chan int64, queueSize)
+
+// Queue asks for an upload to be checked in the background. If the queue is
+// full the upload stays pending until the next sweep picks it up.
+func Queue(uploadID int64) {
+	select {
+	case queue <- uploadID:
+	default:
+		log.Printf("Content safety: queue full, upload %d left for the next sweep", uploadID)
+	}
+}
+
+// Queued returns the uploads waiting for a check, for the background worker
+// to drain
+func Queued() <-chan int64 {
+	return queue
+}
+
+// Check posts the image at path to the classifier as the raw request body,
+// signed like webhook deliveries, and returns its verdict. The classifier
+// answers 2xx with a JSON Verdict.
+func Check(ctx context.Context, uploadID int64, path string) (Verdict, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	cfg := config.AppConfig.ContentSafety
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(data))
+	req.Header.Set("X-Wallpaper-Upload-ID", strconv.FormatInt(uploadID, 10))
+	if sig := webhooks.Signature(data); sig != "" {
+		req.Header.Set("X-Wallpaper-Signature", sig)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxVerdictBytes))
+	if err != nil {
+		return Verdict{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Verdict{}, fmt.Errorf("classifier responded %s", resp.Status)
+	}
+
+	var verdict Verdict
+	if err := json.Unmarshal(body, &verdict); err != nil {
+		return Verdict{}, fmt.Errorf("invalid verdict: %w", err)
+	}
+	return verdict, nil
+}
@@ -0,0 +1,243 @@
+// Package scheduler runs the server's periodic maintenance tasks, such as
+// purging the trash and making backups, on schedules that the config can
+// override. A run that is still going when the task is next due is not
+// started again; the scheduled run is skipped instead. Each task's last run is
+// kept in memory for GET /api/admin/scheduler.
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+var (
+	// ErrUnknownTask is returned by RunNow for a task that isn't registered
+	ErrUnknownTask = errors.New("no such task")
+	// ErrRunning is returned by RunNow for a task that is already running
+	ErrRunning = errors.New("task is already running")
+)
+
+// Task is a job run on a schedule
+type Task struct {
+	// Name identifies the task in the config's schedules and in the status
+	Name string
+	// Schedule is when the task runs unless the config says otherwise; see
+	// Parse. Empty leaves the task off unless the config gives a schedule.
+	Schedule string
+	// RunAtStart also runs the task when the scheduler starts, so work left
+	// over from before a restart doesn't wait for the first scheduled run
+	RunAtStart bool
+	Run        func() error
+}
+
+// Status is what is known about a task and its last run
+type Status struct {
+	Name           string     `json:"name"`
+	Schedule       string     `json:"schedule"`
+	JitterSeconds  int        `json:"jitter_seconds"`
+	Enabled        bool       `json:"enabled"`
+	Running        bool       `json:"running"`
+	NextRunAt      *time.Time `json:"next_run_at,omitempty"`
+	LastStartedAt  *time.Time `json:"last_started_at,omitempty"`
+	LastFinishedAt *time.Time `json:"last_finished_at,omitempty"`
+	LastDurationMS int64      `json:"last_duration_ms"`
+	LastError      string     `json:"last_error,omitempty"`
+	Runs           int        `json:"runs"`
+	Failures       int        `json:"failures"`
+	Skipped        int        `json:"skipped"`
+}
+
+type task struct {
+	Task
+	schedule Schedule
+	jitter   time.Duration
+
+	mu     sync.Mutex
+	status Status
+}
+
+var (
+	mu    sync.Mutex
+	tasks = map[string]*task{}
+)
+
+// Register adds a task to be run once Start is called. Registering two tasks
+// with the same name is a programming error and panics.
+func Register(t Task) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := tasks[t.Name]; ok {
+		panic("scheduler: task " + t.Name + " registered twice")
+	}
+	tasks[t.Name] = &task{Task: t, status: Status{Name: t.Name, Schedule: t.Schedule}}
+}
+
+// Start applies the config's schedules to the registered tasks and runs each
+// enabled one on its schedule until stop is closed. Cron schedules follow
+// reset_timezone, so daily tasks line up with the daily reset. It fails
+// without starting anything if the config names an unknown task or gives an
+// invalid schedule.
+func Start(stop <-chan struct{}) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for name := range config.AppConfig.Schedules {
+		if _, ok := tasks[name]; !ok {
+			return fmt.Errorf("schedules: unknown task %q", name)
+		}
+	}
+
+	loc := config.AppConfig.ResetLocation()
+	for name, t := range tasks {
+		override := config.AppConfig.Schedules[name]
+		spec := t.Task.Schedule
+		if override.Spec != "" {
+			spec = override.Spec
+		}
+		t.jitter = time.Duration(override.JitterSeconds) * time.Second
+		t.status.Schedule = spec
+		t.status.JitterSeconds = override.JitterSeconds
+		if spec == "" || override.Disabled {
+			continue
+		}
+
+		schedule, err := Parse(spec, loc)
+		if err != nil {
+			return fmt.Errorf("schedules: %s: %w", name, err)
+		}
+		t.schedule = schedule
+		t.status.Enabled = true
+	}
+
+	for _, t := range tasks {
+		if t.schedule != nil {
+			go t.loop(stop)
+		}
+	}
+	return nil
+}
+
+// Statuses returns the status of every registered task, sorted by name
+func Statuses() []Status {
+	mu.Lock()
+	defer mu.Unlock()
+
+	statuses := make([]Status, 0, len(tasks))
+	for _, t := range tasks {
+		t.mu.Lock()
+		statuses = append(statuses, t.status)
+		t.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// RunNow starts a run of the named task in the background, whether or not it
+// is enabled, and without jitter
+func RunNow(name string) error {
+	mu.Lock()
+	t, ok := tasks[name]
+	mu.Unlock()
+	if !ok {
+		return ErrUnknownTask
+	}
+	if !t.begin(false) {
+		return ErrRunning
+	}
+	go t.run()
+	return nil
+}
+
+func (t *task) loop(stop <-chan struct{}) {
+	if t.RunAtStart && t.begin(true) {
+		go t.run()
+	}
+
+	for {
+		next := t.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Scheduler: %s: schedule %q never runs again", t.Name, t.status.Schedule)
+			t.setNextRun(nil)
+			return
+		}
+		if t.jitter > 0 {
+			next = next.Add(rand.N(t.jitter))
+		}
+		t.setNextRun(&next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		if !t.begin(true) {
+			log.Printf("Scheduler: %s: skipped, the previous run is still going", t.Name)
+			continue
+		}
+		go t.run()
+	}
+}
+
+func (t *task) setNextRun(next *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.NextRunAt = next
+}
+
+// begin marks the task as running, unless it already is. A scheduled run
+// that finds it running is counted as skipped.
+func (t *task) begin(scheduled bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.status.Running {
+		if scheduled {
+			t.status.Skipped++
+		}
+		return false
+	}
+	now := time.Now()
+	t.status.Running = true
+	t.status.LastStartedAt = &now
+	return true
+}
+
+// run runs a task that begin marked as running and records the outcome
+func (t *task) run() {
+	started := time.Now()
+	err := t.safeRun()
+	finished := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Running = false
+	t.status.LastFinishedAt = &finished
+	t.status.LastDurationMS = finished.Sub(started).Milliseconds()
+	t.status.Runs++
+	t.status.LastError = ""
+	if err != nil {
+		t.status.Failures++
+		t.status.LastError = err.Error()
+		log.Printf("Scheduler: %s failed: %v", t.Name, err)
+	}
+}
+
+// safeRun turns a panic in a task into an error, so one bad run doesn't take
+// the server down or leave the task marked as running
+func (t *task) safeRun() (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return t.Run()
+}
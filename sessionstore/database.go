@@ -0,0 +1,57 @@
+package sessionstore
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Database keeps sessions in the application database's sessions table
+type Database struct{}
+
+func (Database) Load(id string) (*Record, error) {
+	s, err := models.GetSession(context.Background(), id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rec := Record(*s)
+	return &rec, nil
+}
+
+func (Database) Save(rec *Record) error {
+	s := models.Session(*rec)
+	return models.SaveSession(context.Background(), &s)
+}
+
+func (Database) Delete(id string) (bool, error) {
+	err := models.DeleteSession(context.Background(), id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (Database) List(discordID string) ([]Record, error) {
+	sessions, err := models.ListUserSessions(context.Background(), discordID)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, len(sessions))
+	for i, s := range sessions {
+		records[i] = Record(s)
+	}
+	return records, nil
+}
+
+func (Database) DeleteUser(discordID string) (int, error) {
+	n, err := models.DeleteUserSessions(context.Background(), discordID)
+	return int(n), err
+}
+
+func (Database) PurgeExpired() (int, error) {
+	n, err := models.DeleteExpiredSessions(context.Background())
+	return int(n), err
+}
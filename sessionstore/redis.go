@@ -0,0 +1,287 @@
+package sessionstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key prefixes: one key per session, and a set of session IDs per user
+const (
+	redisSessionPrefix     = "wallpaper-gacha:session:"
+	redisUserSessionPrefix = "wallpaper-gacha:user-sessions:"
+)
+
+// Idle connections kept open to Redis
+const redisMaxIdle = 8
+
+// Time allowed to connect and for each command
+const redisTimeout = 5 * time.Second
+
+// Redis keeps sessions in Redis, letting it expire them. It speaks just
+// enough of the RESP protocol for the commands it uses.
+type Redis struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// NewRedis returns a backend for a redis://[:password@]host[:port][/db] URL,
+// after checking that the server answers
+func NewRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("redis_url must look like redis://[:password@]host[:port][/db]")
+	}
+	r := &Redis{addr: u.Host}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	if _, err := r.do("PING"); err != nil {
+		return nil, fmt.Errorf("redis at %s: %w", r.addr, err)
+	}
+	return r, nil
+}
+
+func (r *Redis) Load(id string) (*Record, error) {
+	data, err := r.do("GET", redisSessionPrefix+id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var rec Record
+	if err := json.Unmarshal([]byte(data.(string)), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (r *Redis) Save(rec *Record) error {
+	ttl := time.Until(rec.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		_, err := r.Delete(rec.ID)
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := r.do("SET", redisSessionPrefix+rec.ID, string(data), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		return err
+	}
+	if rec.DiscordID == "" {
+		return nil
+	}
+	// The index outlives its longest session; stale members are dropped
+	// when the user's sessions are listed
+	index := redisUserSessionPrefix + rec.DiscordID
+	if _, err := r.do("SADD", index, rec.ID); err != nil {
+		return err
+	}
+	_, err = r.do("PEXPIRE", index, strconv.FormatInt(ttl, 10), "GT")
+	if err != nil {
+		// Servers before Redis 7 don't know GT; a plain PEXPIRE may
+		// shorten the index, which only hides sessions from listings
+		_, err = r.do("PEXPIRE", index, strconv.FormatInt(ttl, 10))
+	}
+	return err
+}
+
+func (r *Redis) Delete(id string) (bool, error) {
+	rec, err := r.Load(id)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.do("DEL", redisSessionPrefix+id)
+	if err != nil {
+		return false, err
+	}
+	if rec != nil && rec.DiscordID != "" {
+		r.do("SREM", redisUserSessionPrefix+rec.DiscordID, id)
+	}
+	return n.(int64) > 0, nil
+}
+
+func (r *Redis) List(discordID string) ([]Record, error) {
+	index := redisUserSessionPrefix + discordID
+	members, err := r.do("SMEMBERS", index)
+	if err != nil {
+		return nil, err
+	}
+	records := []Record{}
+	for _, m := range members.([]interface{}) {
+		id := m.(string)
+		rec, err := r.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil || rec.DiscordID != discordID {
+			r.do("SREM", index, id)
+			continue
+		}
+		records = append(records, *rec)
+	}
+	slices.SortFunc(records, func(a, b Record) int { return b.LastSeenAt.Compare(a.LastSeenAt) })
+	return records, nil
+}
+
+func (r *Redis) DeleteUser(discordID string) (int, error) {
+	records, err := r.List(discordID)
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range records {
+		if _, err := r.do("DEL", redisSessionPrefix+rec.ID); err != nil {
+			return 0, err
+		}
+	}
+	_, err = r.do("DEL", redisUserSessionPrefix+discordID)
+	return len(records), err
+}
+
+// PurgeExpired does nothing; Redis expires sessions itself
+func (r *Redis) PurgeExpired() (int, error) {
+	return 0, nil
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// errRedis is an error reply from the server
+type errRedis string
+
+func (e errRedis) Error() string { return "redis: " + string(e) }
+
+// do runs one command on a pooled connection. Replies are nil, string,
+// int64 or []interface{}.
+func (r *Redis) do(args ...string) (interface{}, error) {
+	c, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	var replyErr errRedis
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be out of step; don't reuse it
+		c.conn.Close()
+		return nil, err
+	}
+	r.put(c)
+	return reply, err
+}
+
+func (r *Redis) get() (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err := c.do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *Redis) put(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) >= redisMaxIdle {
+		c.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errRedis(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
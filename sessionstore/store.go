@@ -0,0 +1,217 @@
+// Package sessionstore keeps browser sessions server-side, in the database or
+// in Redis, behind the gorilla/sessions Store interface. The cookie holds only
+// a random session ID, so sessions can be listed and revoked one at a time,
+// and rotating session_secret doesn't sign anyone out.
+package sessionstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// How stale a session's last-seen time may get before a request updates it
+const touchInterval = 5 * time.Minute
+
+// Longest user agent kept with a session
+const maxUserAgentLength = 256
+
+// Record is a stored session. ID is the SHA-256 of the cookie value.
+type Record struct {
+	ID         string    `json:"id"`
+	DiscordID  string    `json:"discord_id"`
+	Data       string    `json:"data"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Backend stores session records
+type Backend interface {
+	// Load returns the unexpired record with the given ID, or nil if there
+	// is none
+	Load(id string) (*Record, error)
+	Save(rec *Record) error
+	// Delete removes a record, returning false if it didn't exist
+	Delete(id string) (bool, error)
+	// List returns the user's unexpired records, most recently used first
+	List(discordID string) ([]Record, error)
+	// DeleteUser removes every record of the user, returning how many there were
+	DeleteUser(discordID string) (int, error)
+	// PurgeExpired removes expired records, returning how many were removed
+	PurgeExpired() (int, error)
+}
+
+// Store implements sessions.Store on top of a Backend
+type Store struct {
+	Backend Backend
+	Options *sessions.Options
+	// ClientIP gives the address recorded with a session
+	ClientIP func(r *http.Request) string
+}
+
+// New returns a store keeping sessions in backend
+func New(backend Backend, options *sessions.Options) *Store {
+	return &Store{
+		Backend:  backend,
+		Options:  options,
+		ClientIP: func(r *http.Request) string { return r.RemoteAddr },
+	}
+}
+
+// Get returns the named session, cached for the rest of the request
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie, or starts an empty
+// one when the cookie is missing, unknown or expired
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return session, nil
+	}
+	rec, err := s.Backend.Load(HashID(cookie.Value))
+	if err != nil || rec == nil {
+		return session, err
+	}
+	if err := decode(rec.Data, session); err != nil {
+		return sessions.NewSession(s, name), err
+	}
+	session.ID = cookie.Value
+	session.IsNew = false
+
+	if time.Since(rec.LastSeenAt) > touchInterval {
+		rec.LastSeenAt = time.Now().UTC().Truncate(time.Second)
+		rec.IPAddress = s.ClientIP(r)
+		s.Backend.Save(rec)
+	}
+	return session, nil
+}
+
+// Save stores the session and sets its cookie, or deletes both when MaxAge is
+// negative. A session that signs in, or changes user, gets a new ID so one
+// planted in the browser beforehand is worthless.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	discordID, _ := session.Values["discord_id"].(string)
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := s.Backend.Delete(HashID(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	createdAt := now
+	if session.ID != "" {
+		old, err := s.Backend.Load(HashID(session.ID))
+		if err != nil {
+			return err
+		}
+		if old != nil && old.DiscordID != discordID {
+			if _, err := s.Backend.Delete(old.ID); err != nil {
+				return err
+			}
+			session.ID = ""
+		} else if old != nil {
+			createdAt = old.CreatedAt
+		}
+	}
+	if session.ID == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+
+	data, err := encode(session)
+	if err != nil {
+		return err
+	}
+	// Sessions created without the store's options, or meant to end with the
+	// browser, still need an expiry on the server
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = s.Options.MaxAge
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	rec := &Record{
+		ID:         HashID(session.ID),
+		DiscordID:  discordID,
+		Data:       data,
+		IPAddress:  s.ClientIP(r),
+		UserAgent:  userAgent,
+		CreatedAt:  createdAt,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(maxAge) * time.Second),
+	}
+	if err := s.Backend.Save(rec); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// CurrentID returns the stored ID of the request's session, or "" if it has
+// none, so listings can mark the session in use
+func CurrentID(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	return HashID(cookie.Value)
+}
+
+// HashID returns the stored ID of a session cookie value
+func HashID(cookieValue string) string {
+	sum := sha256.Sum256([]byte(cookieValue))
+	return hex.EncodeToString(sum[:])
+}
+
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Session values are gob-encoded, like gorilla's cookie store does, so
+// int64 and bool values come back with their types
+func encode(session *sessions.Session) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decode(data string, session *sessions.Session) error {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(&session.Values)
+}
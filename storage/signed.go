@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// Backend hands out URLs that serve stored files without going through the
+// server's access checks, for a CDN or proxy to deliver
+type Backend interface {
+	// SignedURL returns a URL that serves the stored file at name, relative
+	// to the upload directory, to anyone who has it until expires. With
+	// filename set the file is sent as an attachment of that name.
+	SignedURL(name, filename string, expires time.Time) string
+}
+
+// Files is the backend signed URLs are made by
+var Files Backend = Local{}
+
+// Local is the upload directory on this server's disk, delivered at
+// signed_urls.base_url by the /files route, possibly through a CDN or
+// caching proxy that keeps responses by their full URL
+type Local struct{}
+
+// Query parameters of a signed file URL
+const (
+	expiresParam   = "expires"
+	filenameParam  = "filename"
+	signatureParam = "signature"
+)
+
+func (Local) SignedURL(name, filename string, expires time.Time) string {
+	query := url.Values{}
+	query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	if filename != "" {
+		query.Set(filenameParam, filename)
+	}
+	query.Set(signatureParam, fileSignature(config.AppConfig.SessionSecret.Current(), name, query))
+	return config.AppConfig.SignedURLs.BaseURL + "/" + escapeName(name) + "?" + query.Encode()
+}
+
+// VerifySignedURL checks the query of a signed file URL for the file at
+// name, returning when it expires and the attachment name it asks for. ok is
+// false when the URL wasn't signed with any configured session secret or has
+// expired.
+func VerifySignedURL(name string, query url.Values) (expires time.Time, filename string, ok bool) {
+	unix, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil || time.Now().Unix() >= unix {
+		return time.Time{}, "", false
+	}
+	signature := query.Get(signatureParam)
+	for _, secret := range config.AppConfig.SessionSecret {
+		if hmac.Equal([]byte(signature), []byte(fileSignature(secret, name, query))) {
+			return time.Unix(unix, 0), query.Get(filenameParam), true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// SignedURLExpiry returns when a URL signed now should expire: a whole
+// multiple of signed_urls.ttl_minutes at least that far away, so the URL, and
+// what a CDN keeps for it, stays the same for that long
+func SignedURLExpiry() time.Time {
+	ttl := time.Duration(config.AppConfig.SignedURLs.TTLMinutes) * time.Minute
+	return time.Now().Truncate(ttl).Add(2 * ttl)
+}
+
+// RelativeName returns the name of a file under the upload directory, as
+// SignedURL takes it, or "" when path lies outside it
+func RelativeName(path string) string {
+	name, err := filepath.Rel(config.AppConfig.UploadDirectory, path)
+	if err != nil || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(name)
+}
+
+// fileSignature signs a file name with its expiry and attachment name, with
+// a key derived from a session secret
+func fileSignature(secret, name string, query url.Values) string {
+	key := sha256.Sum256([]byte("wallpaper-gacha signed file URL:" + secret))
+	mac := hmac.New(sha256.New, key[:])
+	for _, part := range []string{name, query.Get(expiresParam), query.Get(filenameParam)} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// escapeName escapes each segment of a file name for use in a URL path
+func escapeName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+// Subdirectories of the upload directory holding generated thumbnails and
+// resized variants, files of unpublished drafts, partially received
+// resumable uploads and the originals of transcoded files
+const (
+	ThumbnailDirectory = "thumbs"
+	VariantDirectory   = "variants"
+	DraftDirectory     = "drafts"
+	PartialDirectory   = "partial"
+	OriginalDirectory  = "originals"
+)
+
+// Path returns the on-disk location of a stored upload file
+func Path(filename string) string {
+	return filepath.Join(config.AppConfig.UploadDirectory, filename)
+}
+
+// ThumbnailPath returns where the thumbnail for a stored file is cached.
+// Uploads sharing a blob share its thumbnail.
+func ThumbnailPath(filename string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return filepath.Join(config.AppConfig.UploadDirectory, ThumbnailDirectory, base+watermarkSuffix()+".jpg")
+}
+
+// VariantPath returns where a resized copy of a stored file is cached. fit is
+// the resize mode, e.g. "contain" or "cover".
+func VariantPath(filename string, width, height int, fit string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return filepath.Join(config.AppConfig.UploadDirectory, VariantDirectory, fmt.Sprintf("%s-%dx%d-%s%s.jpg", base, width, height, fit, watermarkSuffix()))
+}
+
+// WebPPath returns where the WebP copy of a stored file, served to browsers
+// that can't display its format, is cached
+func WebPPath(filename string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return filepath.Join(config.AppConfig.UploadDirectory, VariantDirectory, base+".webp")
+}
+
+// watermarkSuffix tells watermarked previews apart from plain ones, and
+// those of different watermark texts from each other, so changing the
+// watermark never serves a stale cached preview
+func watermarkSuffix() string {
+	text := config.AppConfig.WatermarkText()
+	if text == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(text))
+	return "-wm" + hex.EncodeToString(sum[:4])
+}
+
+// OriginalPath returns where the file a stored file was transcoded from is
+// kept: under the stored file's name, with the original's extension
+func OriginalPath(filename, originalExt string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return filepath.Join(config.AppConfig.UploadDirectory, OriginalDirectory, base+originalExt)
+}
+
+// Remove deletes a stored upload file, its cached thumbnails, any resized
+// variants, watermarked or not, its WebP copy and the original it was
+// transcoded from
+func Remove(filename string) {
+	if filename == "" {
+		return
+	}
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	variants, _ := filepath.Glob(filepath.Join(config.AppConfig.UploadDirectory, VariantDirectory, base+"-*.jpg"))
+	thumbs, _ := filepath.Glob(filepath.Join(config.AppConfig.UploadDirectory, ThumbnailDirectory, base+"-wm*.jpg"))
+	originals, _ := filepath.Glob(filepath.Join(config.AppConfig.UploadDirectory, OriginalDirectory, base+".*"))
+	paths := []string{Path(filename), filepath.Join(config.AppConfig.UploadDirectory, ThumbnailDirectory, base+".jpg"), WebPPath(filename)}
+	for _, path := range append(append(append(paths, thumbs...), variants...), originals...) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove stored file %s: %v", path, err)
+		}
+	}
+}
+
+// QuarantinePath returns where a file refused by the malware scanner is kept.
+// The quarantine directory is separate from the upload directory, so these
+// files are never served.
+func QuarantinePath(filename string) string {
+	return filepath.Join(config.AppConfig.ClamAV.QuarantineDirectory, filename)
+}
+
+// DraftPath returns where the file of an unpublished draft is kept
+func DraftPath(filename string) string {
+	return filepath.Join(config.AppConfig.UploadDirectory, DraftDirectory, filename)
+}
+
+// RemoveDraft deletes the file of an unpublished draft
+func RemoveDraft(filename string) {
+	if filename == "" {
+		return
+	}
+	if err := os.Remove(DraftPath(filename)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove draft file %s: %v", filename, err)
+	}
+}
+
+// PartialPath returns where a resumable upload is kept while it is received
+func PartialPath(filename string) string {
+	return filepath.Join(config.AppConfig.UploadDirectory, PartialDirectory, filename)
+}
+
+// RemovePartial deletes the file of an unfinished resumable upload
+func RemovePartial(filename string) {
+	if filename == "" {
+		return
+	}
+	if err := os.Remove(PartialPath(filename)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove partial upload %s: %v", filename, err)
+	}
+}
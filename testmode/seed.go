@@ -0,0 +1,124 @@
+package testmode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/imaging"
+	"github.com/Zinbhe/wallpaper-gacha/internal/discordtest"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+	"github.com/Zinbhe/wallpaper-gacha/storage"
+)
+
+type seedUpload struct {
+	owner   string
+	guild   string
+	title   string
+	tags    []string
+	license string
+	pattern func(x, y int) color.RGBA
+}
+
+// Seeded uploads, created in order so their IDs are 1, 2, 3... The last is in
+// the second guild, for testing that guilds see only their own wallpapers.
+var seedUploads = []seedUpload{
+	{discordtest.Accounts[1].ID, config.TestGuildID, "Sunset gradient", []string{"gradient", "warm"}, "cc0", func(x, y int) color.RGBA {
+		return color.RGBA{255, uint8(x * 4), uint8(y * 2), 255}
+	}},
+	{discordtest.Accounts[1].ID, config.TestGuildID, "Ocean gradient", []string{"gradient", "blue"}, "cc-by", func(x, y int) color.RGBA {
+		return color.RGBA{0, uint8(y * 3), 255 - uint8(x*2), 255}
+	}},
+	{discordtest.Accounts[2].ID, config.TestGuildID, "Checkerboard", []string{"pattern", "minimal"}, "", func(x, y int) color.RGBA {
+		if (x/8+y/8)%2 == 0 {
+			return color.RGBA{20, 20, 20, 255}
+		}
+		return color.RGBA{235, 235, 235, 255}
+	}},
+	{discordtest.Accounts[1].ID, config.TestSecondGuildID, "Forest stripes", []string{"pattern", "green"}, "cc0", func(x, y int) color.RGBA {
+		if (x/6)%2 == 0 {
+			return color.RGBA{30, 110, 50, 255}
+		}
+		return color.RGBA{90, 170, 80, 255}
+	}},
+}
+
+// Seed fills a fresh database with the fake provider's guild members, a few
+// tagged uploads and a pending report, always with the same content
+func Seed() error {
+	ctx := context.Background()
+	for _, a := range discordtest.Accounts {
+		if !a.InGuild {
+			continue
+		}
+		if _, err := models.GetOrCreateUser(ctx, a.ID, a.Username); err != nil {
+			return fmt.Errorf("failed to seed user %s: %w", a.Username, err)
+		}
+	}
+
+	for i, s := range seedUploads {
+		if err := seed(i+1, s); err != nil {
+			return fmt.Errorf("failed to seed upload %q: %w", s.title, err)
+		}
+	}
+
+	// Bob reports the first of Alice's uploads
+	_, err := models.CreateReport(ctx, &models.Report{
+		UploadID:   1,
+		ReporterID: discordtest.Accounts[2].ID,
+		Category:   models.ReportOther,
+		Details:    "Seeded report",
+	}, -1)
+	return err
+}
+
+func seed(n int, s seedUpload) error {
+	ctx := context.Background()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, s.pattern(x, y))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	contentHash := hex.EncodeToString(sum[:])
+
+	filename := fmt.Sprintf("seed-%d.png", n)
+	if err := os.WriteFile(storage.Path(filename), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if _, err := models.AcquireBlob(ctx, contentHash, filename, int64(buf.Len())); err != nil {
+		return err
+	}
+
+	upload := &models.Upload{
+		DiscordID:        s.owner,
+		GuildID:          s.guild,
+		Filename:         filename,
+		OriginalFilename: filename,
+		Title:            s.title,
+		FileSize:         int64(buf.Len()),
+		PHash:            sql.NullInt64{Int64: int64(imaging.DifferenceHashImage(img)), Valid: true},
+		SHA256:           contentHash,
+		Source:           models.SourceWeb,
+		BlurHash:         imaging.BlurHash(img),
+		License:          s.license,
+	}
+	if err := models.CreateUpload(ctx, upload); err != nil {
+		return err
+	}
+	return models.SetUploadTags(ctx, upload.ID, s.tags)
+}
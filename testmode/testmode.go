@@ -0,0 +1,67 @@
+// Package testmode runs the server against a fake Discord provider, an
+// in-memory database and throwaway storage so integration tests can drive a
+// real binary without external services.
+package testmode
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/discord"
+	"github.com/Zinbhe/wallpaper-gacha/internal/discordtest"
+)
+
+// Env is a running test-mode environment
+type Env struct {
+	TempDir  string
+	Provider string
+	server   *http.Server
+}
+
+// Start loads the test configuration, creates temporary storage and starts
+// the fake Discord provider, pointing the OAuth handlers at it
+func Start(configFile string) (*Env, error) {
+	dir, err := os.MkdirTemp("", "wallpaper-gacha-test-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary storage: %w", err)
+	}
+
+	if err := config.LoadTestMode(configFile, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start fake Discord provider: %w", err)
+	}
+
+	env := &Env{
+		TempDir:  dir,
+		Provider: "http://" + listener.Addr().String() + "/api",
+		server:   &http.Server{Handler: discordtest.NewProvider()},
+	}
+	go func() {
+		if err := env.server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("Fake Discord provider stopped: %v", err)
+		}
+	}()
+	discord.UseAPI(env.Provider)
+
+	log.Printf("TEST MODE: fake Discord provider at %s, storage in %s, in-memory database", env.Provider, dir)
+	return env, nil
+}
+
+// Close stops the fake provider and deletes the temporary storage
+func (e *Env) Close() {
+	e.server.Shutdown(context.Background())
+	if err := os.RemoveAll(e.TempDir); err != nil {
+		log.Printf("Failed to remove test storage %s: %v", e.TempDir, err)
+	}
+}
@@ -0,0 +1,239 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+)
+
+const (
+	// Spans waiting for export; further spans are dropped while it is full
+	queueSize = 4096
+	// Most spans sent in one export request
+	batchSize = 512
+	// How often queued spans are sent when fewer than a batch are waiting
+	exportInterval = 5 * time.Second
+)
+
+var (
+	cfg     config.Tracing
+	queue   chan *Span
+	client  = &http.Client{Timeout: 10 * time.Second}
+	flushMu sync.Mutex
+
+	dropMu  sync.Mutex
+	dropped int
+)
+
+func enabled() bool {
+	return queue != nil
+}
+
+func exporterConfig() config.Tracing {
+	return cfg
+}
+
+// Start begins exporting spans to the collector set in the tracing section of
+// the configuration, until stop is closed. Without an otlp_endpoint tracing
+// stays off. It must be called before the server starts handling requests.
+func Start(stop <-chan struct{}) {
+	cfg = config.AppConfig.Tracing
+	if cfg.OTLPEndpoint == "" {
+		return
+	}
+	queue = make(chan *Span, queueSize)
+	log.Printf("Tracing: exporting %g of traces to %s as %s", cfg.SampleRatio, cfg.OTLPEndpoint, cfg.ServiceName)
+
+	go func() {
+		ticker := time.NewTicker(exportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				Flush(context.Background())
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Flush exports every queued span, giving up when ctx is done. It is called
+// periodically and once more on shutdown.
+func Flush(ctx context.Context) {
+	if !enabled() {
+		return
+	}
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	dropMu.Lock()
+	if dropped > 0 {
+		log.Printf("Tracing: dropped %d spans because the export queue was full", dropped)
+		dropped = 0
+	}
+	dropMu.Unlock()
+
+	for {
+		batch := make([]*Span, 0, batchSize)
+	fill:
+		for len(batch) < batchSize {
+			select {
+			case s := <-queue:
+				batch = append(batch, s)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := export(ctx, batch); err != nil {
+			log.Printf("Tracing: failed to export %d spans: %v", len(batch), err)
+			return
+		}
+	}
+}
+
+func enqueue(s *Span) {
+	select {
+	case queue <- s:
+	default:
+		dropMu.Lock()
+		dropped++
+		dropMu.Unlock()
+	}
+}
+
+// OTLP/HTTP JSON encoding of spans, per opentelemetry-proto's trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Status code of a failed span
+const otlpStatusError = 2
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+func export(ctx context.Context, batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.sc.traceID[:]),
+			SpanID:            hex.EncodeToString(s.sc.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for key, value := range s.attrs {
+			span.Attributes = append(span.Attributes, attribute(key, value))
+		}
+		if s.errMsg != "" {
+			span.Status = &otlpStatus{Code: otlpStatusError, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		spans[i] = span
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{attribute("service.name", cfg.ServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/Zinbhe/wallpaper-gacha"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(cfg.OTLPEndpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
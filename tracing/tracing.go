@@ -0,0 +1,183 @@
+// Package tracing records OpenTelemetry-compatible spans for requests and the
+// work they do, and exports them to an OTLP collector over HTTP. Trace context
+// travels in context.Context and, between services, in W3C traceparent
+// headers. When no collector is configured, starting a span is a no-op.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, numbered as in OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// spanContext identifies a span within its trace
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type contextKey struct{}
+
+// Span is one timed operation. A nil *Span is valid and ignores every call;
+// StartSpan returns one when tracing is off or the trace isn't sampled.
+type Span struct {
+	sc       spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]interface{}
+	errMsg string
+	ended  bool
+}
+
+// StartSpan begins a span named name as a child of the span in ctx, or as the
+// root of a new trace. The returned context carries the new span. Callers
+// must End it.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	parent, hasParent := ctx.Value(contextKey{}).(spanContext)
+
+	sc := spanContext{spanID: newSpanID()}
+	if hasParent {
+		sc.traceID = parent.traceID
+		sc.sampled = parent.sampled
+	} else {
+		sc.traceID = newTraceID()
+		sc.sampled = enabled() && sampled(sc.traceID)
+	}
+	ctx = context.WithValue(ctx, contextKey{}, sc)
+	if !sc.sampled || !enabled() {
+		return ctx, nil
+	}
+
+	s := &Span{sc: sc, name: name, kind: kind, start: time.Now()}
+	if hasParent {
+		s.parentID = parent.spanID
+	}
+	return ctx, s
+}
+
+// Recording reports whether ctx carries a span that is being recorded, so
+// work that is only worth tracing as part of a larger operation can skip
+// starting traces of its own
+func Recording(ctx context.Context) bool {
+	sc, ok := ctx.Value(contextKey{}).(spanContext)
+	return ok && sc.sampled && enabled()
+}
+
+// SetAttribute records a string, bool, integer or float attribute on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed with err. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and queues it for export. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	enqueue(s)
+}
+
+// Extract returns ctx carrying the trace context of an incoming traceparent
+// header, if the request has a valid one
+func Extract(ctx context.Context, h http.Header) context.Context {
+	parts := strings.Split(strings.TrimSpace(h.Get("traceparent")), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	var sc spanContext
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return ctx
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return ctx
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx
+	}
+	sc.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// Inject sets the traceparent header for the span in ctx, so a downstream
+// service can continue the trace
+func Inject(ctx context.Context, h http.Header) {
+	sc, ok := ctx.Value(contextKey{}).(spanContext)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	h.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.traceID[:]), hex.EncodeToString(sc.spanID[:]), flags))
+}
+
+// sampled decides whether a new trace is recorded, consistently for a given
+// trace ID
+func sampled(traceID [16]byte) bool {
+	ratio := exporterConfig().SampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>11)/(1<<53) < ratio
+}
+
+func newTraceID() [16]byte {
+	var id [16]byte
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	rand.Read(id[:])
+	return id
+}
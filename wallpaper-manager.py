@@ -104,6 +104,9 @@ class WallpaperManager:
             "--include=*.jpeg",
             "--include=*.jxl",
             "--include=*.webp",
+            "--include=*.avif",
+            "--include=*.heic",
+            "--include=*.heif",
             "--exclude=*",
             "-e", f"ssh -p {self.config['rsync_port']}",
             remote_path,
@@ -135,7 +138,7 @@ class WallpaperManager:
 
     def get_available_images(self) -> List[Path]:
         """Get list of all image files in local directory"""
-        extensions = ['.png', '.jpg', '.jpeg', '.jxl', '.webp']
+        extensions = ['.png', '.jpg', '.jpeg', '.jxl', '.webp', '.avif', '.heic', '.heif']
         images = []
 
         for ext in extensions:
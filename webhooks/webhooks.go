@@ -0,0 +1,267 @@
+// Package webhooks notifies configured URLs of events such as new uploads and
+// reports. Notifications are queued in the database and sent by a pool of
+// workers, so they survive restarts and failing receivers are retried with
+// backoff instead of holding up requests.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Zinbhe/wallpaper-gacha/config"
+	"github.com/Zinbhe/wallpaper-gacha/models"
+)
+
+// Events sent to webhooks
+const (
+	EventUploadCreated     = "upload.created"
+	EventUploadApproved    = "upload.approved"
+	EventPullLegendary     = "pull.legendary"
+	EventReportCreated     = "report.created"
+	EventTakedownRequested = "takedown.requested"
+	EventTakedownResolved  = "takedown.resolved"
+	EventDeletionRequested = "account.deletion_requested"
+	EventDeletionCancelled = "account.deletion_cancelled"
+	EventUserBanned        = "user.banned"
+	EventUserUnbanned      = "user.unbanned"
+)
+
+const (
+	// How often idle workers look for deliveries whose retry time has come
+	pollInterval = 5 * time.Second
+	// Backoff after the first failed attempt, doubled per attempt up to maxBackoff
+	initialBackoff = 30 * time.Second
+	maxBackoff     = time.Hour
+	// Successful deliveries are kept this long for inspection
+	deliveredRetention = 7 * 24 * time.Hour
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// wake is signalled when a delivery is queued so an idle worker picks it up
+// without waiting for the next poll
+var wake = make(chan struct{}, 1)
+
+// Payload is the JSON body posted to webhook URLs
+type Payload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Notify queues an event for every configured webhook URL, unless
+// webhook_events leaves it out. Receivers that already have
+// webhook_max_pending deliveries waiting are skipped, so a dead endpoint
+// can't grow the queue without bound.
+func Notify(event string, data interface{}) {
+	if len(config.AppConfig.WebhookURLs) == 0 {
+		return
+	}
+	if events := config.AppConfig.WebhookEvents; len(events) > 0 && !slices.Contains(events, event) {
+		return
+	}
+
+	body, err := json.Marshal(Payload{Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Printf("Webhooks: failed to encode %s event: %v", event, err)
+		return
+	}
+
+	ctx := context.Background()
+	for _, url := range config.AppConfig.WebhookURLs {
+		pending, err := models.CountPendingDeliveries(ctx, url)
+		if err != nil {
+			log.Printf("Webhooks: failed to count pending deliveries to %s: %v", url, err)
+			continue
+		}
+		if pending >= config.AppConfig.WebhookMaxPending {
+			log.Printf("Webhooks: dropped %s event for %s: %d deliveries already pending", event, url, pending)
+			continue
+		}
+		if _, err := models.EnqueueDelivery(ctx, url, event, string(body)); err != nil {
+			log.Printf("Webhooks: failed to queue %s event for %s: %v", event, url, err)
+		}
+	}
+	Wake()
+}
+
+// Wake prompts an idle worker to check the queue now
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start requeues deliveries interrupted by the last shutdown and starts the
+// delivery workers, which run until stop is closed
+func Start(workers int, stop <-chan struct{}) {
+	if n, err := models.RequeueInFlightDeliveries(context.Background()); err != nil {
+		log.Printf("Webhooks: failed to requeue interrupted deliveries: %v", err)
+	} else if n > 0 {
+		log.Printf("Webhooks: requeued %d interrupted deliveries", n)
+	}
+
+	for i := 0; i < workers; i++ {
+		go work(stop)
+	}
+	go prune(stop)
+}
+
+// work sends deliveries one at a time. A worker only claims a delivery when
+// it is free, so a slow receiver backs up the queue in the database rather
+// than in memory.
+func work(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			d, err := models.ClaimDelivery(context.Background())
+			if err == sql.ErrNoRows {
+				break
+			} else if err != nil {
+				log.Printf("Webhooks: failed to claim delivery: %v", err)
+				break
+			}
+			deliver(d)
+		}
+
+		select {
+		case <-wake:
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver posts one delivery and records the outcome
+func deliver(d *models.Delivery) {
+	ctx := context.Background()
+	retryAfter, err := send(d)
+	if err == nil {
+		if err := models.CompleteDelivery(ctx, d.ID); err != nil {
+			log.Printf("Webhooks: failed to record delivery %d: %v", d.ID, err)
+		}
+		return
+	}
+
+	if d.Attempts >= config.AppConfig.WebhookMaxAttempts {
+		log.Printf("Webhooks: giving up on delivery %d (%s to %s) after %d attempts: %v", d.ID, d.Event, d.URL, d.Attempts, err)
+		if err := models.DeadLetterDelivery(ctx, d.ID, err.Error()); err != nil {
+			log.Printf("Webhooks: failed to dead-letter delivery %d: %v", d.ID, err)
+		}
+		return
+	}
+
+	next := time.Now().Add(backoff(d.Attempts))
+	if retryAfter > 0 {
+		// The receiver is overloaded; hold back everything queued for it
+		next = time.Now().Add(retryAfter)
+		if err := models.DeferDeliveries(ctx, d.URL, next); err != nil {
+			log.Printf("Webhooks: failed to defer deliveries to %s: %v", d.URL, err)
+		}
+	}
+	log.Printf("Webhooks: delivery %d (%s to %s) failed on attempt %d, retrying at %s: %v",
+		d.ID, d.Event, d.URL, d.Attempts, next.UTC().Format(time.RFC3339), err)
+	if err := models.RetryDeliveryAt(ctx, d.ID, err.Error(), next); err != nil {
+		log.Printf("Webhooks: failed to reschedule delivery %d: %v", d.ID, err)
+	}
+}
+
+// send posts the payload, returning the receiver's requested delay when it
+// answered 429 or 503 with a Retry-After header
+func send(d *models.Delivery) (time.Duration, error) {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wallpaper-Event", d.Event)
+	req.Header.Set("X-Wallpaper-Delivery", strconv.FormatInt(d.ID, 10))
+	if sig := Signature([]byte(d.Payload)); sig != "" {
+		req.Header.Set("X-Wallpaper-Signature", sig)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+	}
+	return retryAfter, fmt.Errorf("receiver responded %s", resp.Status)
+}
+
+// Signature returns the X-Wallpaper-Signature header value for a body, or ""
+// when no webhook_secret is configured
+func Signature(body []byte) string {
+	secret := config.AppConfig.WebhookSecret
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the delay before retrying after the given number of attempts
+func backoff(attempts int) time.Duration {
+	delay := initialBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// prune deletes old successful deliveries once an hour
+func prune(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if n, err := models.DeleteDeliveredBefore(context.Background(), time.Now().Add(-deliveredRetention)); err != nil {
+			log.Printf("Webhooks: failed to prune delivered notifications: %v", err)
+		} else if n > 0 {
+			log.Printf("Webhooks: pruned %d delivered notifications", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}